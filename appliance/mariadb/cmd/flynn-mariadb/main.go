@@ -64,7 +64,7 @@ func main() {
 	if err != nil {
 		shutdown.Fatal(err)
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	log := log15.New("app", "mariadb")
 
@@ -54,7 +54,7 @@ func main() {
 	if err != nil {
 		shutdown.Fatal(err)
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	handler := httphelper.ContextInjector(serviceName+"-api", httphelper.NewRequestLogger(router))
 	shutdown.Fatal(http.ListenAndServe(addr, handler))
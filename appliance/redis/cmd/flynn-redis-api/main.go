@@ -129,7 +129,7 @@ func (m *Main) Run() error {
 	if err != nil {
 		return err
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	h := httphelper.ContextInjector(m.ServiceName+"-api", httphelper.NewRequestLogger(m.Handler))
 	go func() { http.Serve(ln, h) }()
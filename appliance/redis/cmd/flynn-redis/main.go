@@ -144,7 +144,7 @@ func (m *Main) Run() error {
 		return err
 	}
 	m.hb = hb
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	m.Logger.Info("opening port", "addr", m.Addr)
 
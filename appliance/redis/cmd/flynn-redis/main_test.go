@@ -7,6 +7,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	main "github.com/flynn/flynn/appliance/redis/cmd/flynn-redis"
 	"github.com/flynn/flynn/discoverd/client"
@@ -131,6 +132,7 @@ func (c *DiscoverdClient) RegisterInstance(service string, inst *discoverd.Insta
 // Heartbeater is a mock implementation of discoverd.Heartbeater.
 type Heartbeater struct {
 	SetMetaFn   func(map[string]string) error
+	DrainFn     func() error
 	CloseFn     func() error
 	AddrFn      func() string
 	SetClientFn func(*discoverd.Client)
@@ -140,6 +142,7 @@ type Heartbeater struct {
 func NewHeartbeater(addr string) *Heartbeater {
 	return &Heartbeater{
 		SetMetaFn:   func(map[string]string) error { return nil },
+		DrainFn:     func() error { return nil },
 		CloseFn:     func() error { return nil },
 		AddrFn:      func() string { return addr },
 		SetClientFn: func(*discoverd.Client) {},
@@ -147,6 +150,13 @@ func NewHeartbeater(addr string) *Heartbeater {
 }
 
 func (h *Heartbeater) SetMeta(m map[string]string) error { return h.SetMetaFn(m) }
-func (h *Heartbeater) Close() error                      { return h.CloseFn() }
-func (h *Heartbeater) Addr() string                      { return h.AddrFn() }
-func (h *Heartbeater) SetClient(c *discoverd.Client)     { h.SetClientFn(c) }
+func (h *Heartbeater) Drain() error                      { return h.DrainFn() }
+func (h *Heartbeater) CloseGracefully(time.Duration) error {
+	if err := h.DrainFn(); err != nil {
+		return err
+	}
+	return h.CloseFn()
+}
+func (h *Heartbeater) Close() error                  { return h.CloseFn() }
+func (h *Heartbeater) Addr() string                  { return h.AddrFn() }
+func (h *Heartbeater) SetClient(c *discoverd.Client) { h.SetClientFn(c) }
@@ -162,7 +162,7 @@ func runServer(_ *docopt.Args) error {
 	if err != nil {
 		return err
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	log.Println("Blobstore serving files on " + addr)
 
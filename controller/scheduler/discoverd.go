@@ -5,7 +5,6 @@ import (
 	"time"
 
 	discoverd "github.com/flynn/flynn/discoverd/client"
-	"github.com/flynn/flynn/pkg/shutdown"
 	"github.com/flynn/flynn/pkg/stream"
 	"github.com/inconshreveable/log15"
 )
@@ -43,7 +42,7 @@ func (d *discoverdWrapper) Register() bool {
 		log.Error("error registering with service discovery", "err", err)
 		time.Sleep(time.Second)
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	selfAddr := hb.Addr()
 	log = log.New("self.addr", selfAddr)
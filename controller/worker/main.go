@@ -52,7 +52,7 @@ func main() {
 		if err != nil {
 			shutdown.Fatal(err)
 		}
-		shutdown.BeforeExit(func() { hb.Close() })
+		discoverd.CloseOnExit(hb)
 		shutdown.Fatal(http.ListenAndServe(addr, nil))
 	}()
 
@@ -0,0 +1,268 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Agent runs alongside applications on every host, maintaining watch-driven
+// caches of the configured services and exposing the query API and DNS on
+// loopback. Applications only ever talk to localhost, so they keep resolving
+// cached state across discoverd server blips.
+type Agent struct {
+	// HTTPAddr is the loopback address to serve the query API from.
+	HTTPAddr string
+
+	// DNSAddr is the loopback address to serve DNS from.
+	// If empty no DNS server is started.
+	DNSAddr string
+
+	// Services is the set of services to cache.
+	Services []string
+
+	// Proxies maps a service name to a loopback address to proxy TCP
+	// connections to its instances from.
+	Proxies map[string]string
+
+	// Logger is where log messages are written to.
+	Logger *log.Logger
+
+	client *discoverd.Client
+
+	mu        sync.RWMutex
+	caches    map[string]*cache.ServiceCache
+	proxies   []*serviceProxy
+	ln        net.Listener
+	dnsServer *server.DNSServer
+}
+
+// NewAgent returns an agent which resolves services using c.
+func NewAgent(c *discoverd.Client) *Agent {
+	return &Agent{
+		client: c,
+		caches: make(map[string]*cache.ServiceCache),
+	}
+}
+
+// Run starts the caches, the loopback query API and DNS servers and any
+// configured service proxies. It returns once everything is listening.
+func (a *Agent) Run() error {
+	// Start a watch-driven cache for each configured service.
+	for _, name := range a.Services {
+		c, err := cache.New(a.client.Service(name))
+		if err != nil {
+			return fmt.Errorf("cache %s: %s", name, err)
+		}
+		a.mu.Lock()
+		a.caches[name] = c
+		a.mu.Unlock()
+	}
+
+	// Start the query API on loopback.
+	ln, err := net.Listen("tcp", a.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	a.ln = ln
+	go http.Serve(ln, a.handler())
+
+	// Start the DNS server on loopback, backed by the caches.
+	if a.DNSAddr != "" {
+		srv := &server.DNSServer{
+			UDPAddr: a.DNSAddr,
+			TCPAddr: a.DNSAddr,
+		}
+		srv.SetStore(a)
+		if err := srv.ListenAndServe(); err != nil {
+			return err
+		}
+		a.dnsServer = srv
+	}
+
+	// Start a local proxy port for each configured service.
+	for service, addr := range a.Proxies {
+		p := &serviceProxy{agent: a, service: service, logger: a.Logger}
+		if err := p.listen(addr); err != nil {
+			return err
+		}
+		a.proxies = append(a.proxies, p)
+		a.logger().Printf("proxying %s on %s", service, addr)
+	}
+
+	return nil
+}
+
+// Close shuts down the servers, proxies and caches.
+func (a *Agent) Close() error {
+	if a.ln != nil {
+		a.ln.Close()
+	}
+	if a.dnsServer != nil {
+		a.dnsServer.Close()
+	}
+	for _, p := range a.proxies {
+		p.close()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.caches {
+		c.Close()
+	}
+	return nil
+}
+
+func (a *Agent) logger() *log.Logger {
+	if a.Logger != nil {
+		return a.Logger
+	}
+	return log.Default()
+}
+
+func (a *Agent) cache(service string) *cache.ServiceCache {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.caches[service]
+}
+
+// Instances returns the cached instances of a service, implementing
+// server.DNSStore.
+func (a *Agent) Instances(service string) ([]*discoverd.Instance, error) {
+	c := a.cache(service)
+	if c == nil {
+		return nil, server.NotFoundError{Service: service}
+	}
+	return c.Instances(), nil
+}
+
+// ServiceLeader returns the cached leader of a service, implementing
+// server.DNSStore.
+func (a *Agent) ServiceLeader(service string) (*discoverd.Instance, error) {
+	c := a.cache(service)
+	if c == nil {
+		return nil, server.NotFoundError{Service: service}
+	}
+	if leader := c.Leader(); len(leader) > 0 {
+		return leader[0], nil
+	}
+	return nil, nil
+}
+
+// handler returns the loopback query API handler. It serves the read side of
+// the discoverd HTTP API from the caches.
+func (a *Agent) handler() http.Handler {
+	r := httprouter.New()
+	r.HandlerFunc("GET", "/ping", func(http.ResponseWriter, *http.Request) {})
+	r.GET("/services/:service/instances", a.serveGetInstances)
+	r.GET("/services/:service/leader", a.serveGetLeader)
+	return r
+}
+
+func (a *Agent) serveGetInstances(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	c := a.cache(params.ByName("service"))
+	if c == nil {
+		hh.ObjectNotFoundError(w, "service not found")
+		return
+	}
+	hh.JSON(w, 200, c.Instances())
+}
+
+func (a *Agent) serveGetLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	c := a.cache(params.ByName("service"))
+	if c == nil {
+		hh.ObjectNotFoundError(w, "service not found")
+		return
+	}
+	if leader := c.Leader(); len(leader) > 0 {
+		hh.JSON(w, 200, leader[0])
+		return
+	}
+	hh.ObjectNotFoundError(w, "no leader found")
+}
+
+// serviceProxy forwards TCP connections from a loopback port to the cached
+// instances of a service, round-robining between them.
+type serviceProxy struct {
+	agent   *Agent
+	service string
+	logger  *log.Logger
+	ln      net.Listener
+	next    uint64
+	closed  int32
+}
+
+func (p *serviceProxy) listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.ln = ln
+	go p.serve()
+	return nil
+}
+
+func (p *serviceProxy) close() {
+	atomic.StoreInt32(&p.closed, 1)
+	p.ln.Close()
+}
+
+func (p *serviceProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&p.closed) == 1 {
+				return
+			}
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *serviceProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	addr := p.pick()
+	if addr == "" {
+		p.logger.Printf("no instances available for %s", p.service)
+		return
+	}
+	backend, err := net.Dial("tcp", addr)
+	if err != nil {
+		p.logger.Printf("error dialing %s instance %s: %s", p.service, addr, err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(backend, conn)
+		backend.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, backend)
+	<-done
+}
+
+// pick returns the address of the next instance to proxy to.
+func (p *serviceProxy) pick() string {
+	c := p.agent.cache(p.service)
+	if c == nil {
+		return ""
+	}
+	addrs := c.Addrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[(atomic.AddUint64(&p.next, 1)-1)%uint64(len(addrs))]
+}
@@ -0,0 +1,331 @@
+// Package api contains the protobuf types and gRPC bindings for the discoverd
+// API defined in discoverd.proto.
+//
+// The message types and service bindings are maintained by hand in the shape
+// protoc-gen-go would emit; the proto runtime derives their descriptors from
+// the struct tags. Keep them in sync with discoverd.proto.
+package api
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+)
+
+type Instance struct {
+	Id     string            `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Addr   string            `protobuf:"bytes,2,opt,name=addr" json:"addr,omitempty"`
+	Proto  string            `protobuf:"bytes,3,opt,name=proto" json:"proto,omitempty"`
+	Meta   map[string]string `protobuf:"bytes,4,rep,name=meta" json:"meta,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Ttl    uint32            `protobuf:"varint,5,opt,name=ttl" json:"ttl,omitempty"`
+	State  string            `protobuf:"bytes,6,opt,name=state" json:"state,omitempty"`
+	Index  uint64            `protobuf:"varint,7,opt,name=index" json:"index,omitempty"`
+	Weight uint32            `protobuf:"varint,8,opt,name=weight" json:"weight,omitempty"`
+	Canary bool              `protobuf:"varint,9,opt,name=canary" json:"canary,omitempty"`
+
+	Annotations map[string][]byte `protobuf:"bytes,10,rep,name=annotations" json:"annotations,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Zone        string            `protobuf:"bytes,11,opt,name=zone" json:"zone,omitempty"`
+}
+
+func (m *Instance) Reset()         { *m = Instance{} }
+func (m *Instance) String() string { return proto.CompactTextString(m) }
+func (*Instance) ProtoMessage()    {}
+
+type RegisterRequest struct {
+	Service  string    `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+	Instance *Instance `protobuf:"bytes,2,opt,name=instance" json:"instance,omitempty"`
+}
+
+func (m *RegisterRequest) Reset()         { *m = RegisterRequest{} }
+func (m *RegisterRequest) String() string { return proto.CompactTextString(m) }
+func (*RegisterRequest) ProtoMessage()    {}
+
+type RegisterResponse struct{}
+
+func (m *RegisterResponse) Reset()         { *m = RegisterResponse{} }
+func (m *RegisterResponse) String() string { return proto.CompactTextString(m) }
+func (*RegisterResponse) ProtoMessage()    {}
+
+type DeregisterRequest struct {
+	Service    string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+	InstanceId string `protobuf:"bytes,2,opt,name=instance_id,json=instanceId" json:"instance_id,omitempty"`
+}
+
+func (m *DeregisterRequest) Reset()         { *m = DeregisterRequest{} }
+func (m *DeregisterRequest) String() string { return proto.CompactTextString(m) }
+func (*DeregisterRequest) ProtoMessage()    {}
+
+type DeregisterResponse struct{}
+
+func (m *DeregisterResponse) Reset()         { *m = DeregisterResponse{} }
+func (m *DeregisterResponse) String() string { return proto.CompactTextString(m) }
+func (*DeregisterResponse) ProtoMessage()    {}
+
+type ListRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+}
+
+func (m *ListRequest) Reset()         { *m = ListRequest{} }
+func (m *ListRequest) String() string { return proto.CompactTextString(m) }
+func (*ListRequest) ProtoMessage()    {}
+
+type ListResponse struct {
+	Instances []*Instance `protobuf:"bytes,1,rep,name=instances" json:"instances,omitempty"`
+}
+
+func (m *ListResponse) Reset()         { *m = ListResponse{} }
+func (m *ListResponse) String() string { return proto.CompactTextString(m) }
+func (*ListResponse) ProtoMessage()    {}
+
+type LeaderRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+}
+
+func (m *LeaderRequest) Reset()         { *m = LeaderRequest{} }
+func (m *LeaderRequest) String() string { return proto.CompactTextString(m) }
+func (*LeaderRequest) ProtoMessage()    {}
+
+type WatchRequest struct {
+	Service string `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+
+	// Kinds is a bitmask of discoverd event kinds to receive. Zero subscribes
+	// to all kinds.
+	Kinds uint64 `protobuf:"varint,2,opt,name=kinds" json:"kinds,omitempty"`
+
+	// SendCurrent causes the current state to be sent as events at the start
+	// of the stream, followed by a "current" event.
+	SendCurrent bool `protobuf:"varint,3,opt,name=send_current,json=sendCurrent" json:"send_current,omitempty"`
+}
+
+func (m *WatchRequest) Reset()         { *m = WatchRequest{} }
+func (m *WatchRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()    {}
+
+type Event struct {
+	Service  string    `protobuf:"bytes,1,opt,name=service" json:"service,omitempty"`
+	Kind     string    `protobuf:"bytes,2,opt,name=kind" json:"kind,omitempty"`
+	Instance *Instance `protobuf:"bytes,3,opt,name=instance" json:"instance,omitempty"`
+}
+
+func (m *Event) Reset()         { *m = Event{} }
+func (m *Event) String() string { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()    {}
+
+// DiscoverdClient is the client API for the Discoverd service.
+type DiscoverdClient interface {
+	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	Leader(ctx context.Context, in *LeaderRequest, opts ...grpc.CallOption) (*Instance, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Discoverd_WatchClient, error)
+}
+
+type discoverdClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewDiscoverdClient(cc *grpc.ClientConn) DiscoverdClient {
+	return &discoverdClient{cc}
+}
+
+func (c *discoverdClient) Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error) {
+	out := new(RegisterResponse)
+	if err := c.cc.Invoke(ctx, "/flynn.discoverd.v1.Discoverd/Register", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoverdClient) Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*DeregisterResponse, error) {
+	out := new(DeregisterResponse)
+	if err := c.cc.Invoke(ctx, "/flynn.discoverd.v1.Discoverd/Deregister", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoverdClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	if err := c.cc.Invoke(ctx, "/flynn.discoverd.v1.Discoverd/List", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoverdClient) Leader(ctx context.Context, in *LeaderRequest, opts ...grpc.CallOption) (*Instance, error) {
+	out := new(Instance)
+	if err := c.cc.Invoke(ctx, "/flynn.discoverd.v1.Discoverd/Leader", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoverdClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Discoverd_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Discoverd_serviceDesc.Streams[0], "/flynn.discoverd.v1.Discoverd/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &discoverdWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Discoverd_WatchClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type discoverdWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *discoverdWatchClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DiscoverdServer is the server API for the Discoverd service.
+type DiscoverdServer interface {
+	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	Deregister(context.Context, *DeregisterRequest) (*DeregisterResponse, error)
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	Leader(context.Context, *LeaderRequest) (*Instance, error)
+	Watch(*WatchRequest, Discoverd_WatchServer) error
+}
+
+func RegisterDiscoverdServer(s *grpc.Server, srv DiscoverdServer) {
+	s.RegisterService(&_Discoverd_serviceDesc, srv)
+}
+
+func _Discoverd_Register_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RegisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoverdServer).Register(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/flynn.discoverd.v1.Discoverd/Register",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoverdServer).Register(ctx, req.(*RegisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discoverd_Deregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoverdServer).Deregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/flynn.discoverd.v1.Discoverd/Deregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoverdServer).Deregister(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discoverd_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoverdServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/flynn.discoverd.v1.Discoverd/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoverdServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discoverd_Leader_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaderRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoverdServer).Leader(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/flynn.discoverd.v1.Discoverd/Leader",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoverdServer).Leader(ctx, req.(*LeaderRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discoverd_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DiscoverdServer).Watch(m, &discoverdWatchServer{stream})
+}
+
+type Discoverd_WatchServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type discoverdWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *discoverdWatchServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Discoverd_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "flynn.discoverd.v1.Discoverd",
+	HandlerType: (*DiscoverdServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    _Discoverd_Register_Handler,
+		},
+		{
+			MethodName: "Deregister",
+			Handler:    _Discoverd_Deregister_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Discoverd_List_Handler,
+		},
+		{
+			MethodName: "Leader",
+			Handler:    _Discoverd_Leader_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Discoverd_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "discoverd.proto",
+}
@@ -0,0 +1,266 @@
+// Package balancer provides client-side load balancing over the instances
+// of a discoverd service. A LoadBalancer maintains the instance set from the
+// service's event stream and selects instances with a pluggable Picker, so
+// Go services can connect to healthy peers without re-implementing instance
+// selection.
+package balancer
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// ErrNoInstances is returned by Pick and Dial when the service has no
+// instances available.
+var ErrNoInstances = errors.New("balancer: no instances available")
+
+// Picker selects an instance from a non-empty set. The instances are sorted
+// by creation order. Implementations must be safe for concurrent use.
+type Picker interface {
+	Pick(instances []*discoverd.Instance) *discoverd.Instance
+}
+
+// connTracker is implemented by pickers that track in-flight connections,
+// such as LeastConnections.
+type connTracker interface {
+	connOpened(id string)
+	connClosed(id string)
+}
+
+// CanaryMode controls how a LoadBalancer treats instances registered with
+// the canary flag.
+type CanaryMode int
+
+const (
+	// CanaryInclude considers canary and non-canary instances alike. It is
+	// the default.
+	CanaryInclude CanaryMode = iota
+
+	// CanaryExclude skips canary instances.
+	CanaryExclude
+
+	// CanaryOnly considers only canary instances.
+	CanaryOnly
+)
+
+// LoadBalancer selects instances of a service using a pluggable Picker and
+// dials connections to them.
+type LoadBalancer struct {
+	cache  *cache.ServiceCache
+	picker Picker
+
+	mu     sync.Mutex
+	canary CanaryMode
+	zone   string
+}
+
+// New returns a load balancer over the instances of s, watching the service's
+// event stream to keep the instance set current. A nil picker defaults to
+// round-robin.
+func New(s discoverd.Service, picker Picker) (*LoadBalancer, error) {
+	if picker == nil {
+		picker = NewRoundRobin()
+	}
+	c, err := cache.New(s)
+	if err != nil {
+		return nil, err
+	}
+	return &LoadBalancer{cache: c, picker: picker}, nil
+}
+
+// SetCanaryMode controls how Pick treats canary instances.
+func (lb *LoadBalancer) SetCanaryMode(mode CanaryMode) {
+	lb.mu.Lock()
+	lb.canary = mode
+	lb.mu.Unlock()
+}
+
+// SetZone sets the caller's zone. If set, Pick only considers instances in
+// the same zone, falling back to instances in other zones when the zone has
+// none, so traffic stays local whenever it can.
+func (lb *LoadBalancer) SetZone(zone string) {
+	lb.mu.Lock()
+	lb.zone = zone
+	lb.mu.Unlock()
+}
+
+// Pick selects an instance of the service, skipping instances that are
+// draining or excluded by the canary mode. It returns ErrNoInstances if none
+// are available.
+func (lb *LoadBalancer) Pick() (*discoverd.Instance, error) {
+	instances := lb.cache.Instances()
+	lb.mu.Lock()
+	canary, zone := lb.canary, lb.zone
+	lb.mu.Unlock()
+
+	// Skip draining and canary-excluded instances and sort by creation
+	// order so pickers see a stable sequence.
+	filtered := instances[:0]
+	for _, inst := range instances {
+		if inst.State == discoverd.InstanceStateDraining {
+			continue
+		}
+		if canary == CanaryExclude && inst.Canary || canary == CanaryOnly && !inst.Canary {
+			continue
+		}
+		filtered = append(filtered, inst)
+	}
+
+	// Prefer instances in the caller's zone, using other zones only as a
+	// fallback when the zone has none.
+	if zone != "" {
+		same := make([]*discoverd.Instance, 0, len(filtered))
+		for _, inst := range filtered {
+			if inst.EffectiveZone() == zone {
+				same = append(same, inst)
+			}
+		}
+		if len(same) > 0 {
+			filtered = same
+		}
+	}
+
+	if len(filtered) == 0 {
+		return nil, ErrNoInstances
+	}
+	sort.Sort(instanceIndexSlice(filtered))
+
+	inst := lb.picker.Pick(filtered)
+	if inst == nil {
+		return nil, ErrNoInstances
+	}
+	return inst, nil
+}
+
+// Dial connects to a picked instance. If the picker tracks in-flight
+// connections the returned connection reports back when it is closed.
+func (lb *LoadBalancer) Dial() (net.Conn, error) {
+	inst, err := lb.Pick()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", inst.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if tracker, ok := lb.picker.(connTracker); ok {
+		tracker.connOpened(inst.ID)
+		conn = &trackedConn{Conn: conn, id: inst.ID, tracker: tracker}
+	}
+	return conn, nil
+}
+
+// Close stops watching the service.
+func (lb *LoadBalancer) Close() error {
+	return lb.cache.Close()
+}
+
+// trackedConn reports to the picker when the connection is closed.
+type trackedConn struct {
+	net.Conn
+	id      string
+	tracker connTracker
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.tracker.connClosed(c.id) })
+	return c.Conn.Close()
+}
+
+// RoundRobin cycles through instances in creation order.
+type RoundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func NewRoundRobin() *RoundRobin { return &RoundRobin{} }
+
+func (p *RoundRobin) Pick(instances []*discoverd.Instance) *discoverd.Instance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	inst := instances[p.next%len(instances)]
+	p.next++
+	return inst
+}
+
+// Random picks an instance uniformly at random.
+type Random struct{}
+
+func NewRandom() *Random { return &Random{} }
+
+func (p *Random) Pick(instances []*discoverd.Instance) *discoverd.Instance {
+	return instances[rand.Intn(len(instances))]
+}
+
+// Weighted picks an instance at random with probability proportional to its
+// effective weight, which allows gradual traffic shifting.
+type Weighted struct{}
+
+func NewWeighted() *Weighted { return &Weighted{} }
+
+func (p *Weighted) Pick(instances []*discoverd.Instance) *discoverd.Instance {
+	var total int
+	for _, inst := range instances {
+		total += int(inst.EffectiveWeight())
+	}
+	n := rand.Intn(total)
+	for _, inst := range instances {
+		n -= int(inst.EffectiveWeight())
+		if n < 0 {
+			return inst
+		}
+	}
+	return instances[len(instances)-1]
+}
+
+// LeastConnections picks the instance with the fewest in-flight connections
+// dialed through the load balancer, with creation order as a tiebreak.
+type LeastConnections struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{conns: make(map[string]int)}
+}
+
+func (p *LeastConnections) Pick(instances []*discoverd.Instance) *discoverd.Instance {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var pick *discoverd.Instance
+	for _, inst := range instances {
+		if pick == nil || p.conns[inst.ID] < p.conns[pick.ID] {
+			pick = inst
+		}
+	}
+	return pick
+}
+
+func (p *LeastConnections) connOpened(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[id]++
+}
+
+func (p *LeastConnections) connClosed(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns[id]--; p.conns[id] <= 0 {
+		delete(p.conns, id)
+	}
+}
+
+// instanceIndexSlice represents a sortable list of instances by creation
+// order.
+type instanceIndexSlice []*discoverd.Instance
+
+func (a instanceIndexSlice) Len() int           { return len(a) }
+func (a instanceIndexSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a instanceIndexSlice) Less(i, j int) bool { return a[i].Index < a[j].Index }
@@ -5,7 +5,6 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
-	"github.com/flynn/flynn/pkg/attempt"
 	"github.com/flynn/flynn/pkg/stream"
 )
 
@@ -25,6 +24,15 @@ type ServiceCache struct {
 	leader    *discoverd.Instance
 	instances map[string]*discoverd.Instance
 
+	// index is the event index of the last applied event, used to resume
+	// the watch after a disconnect.
+	index uint64
+
+	// resync, when non-nil, collects the instance IDs seen during a full
+	// sync so stale instances can be pruned once the current state has
+	// been received.
+	resync map[string]struct{}
+
 	// used by the test suite
 	watchers map[chan *discoverd.Event]struct{}
 
@@ -32,18 +40,31 @@ type ServiceCache struct {
 	done chan struct{}
 }
 
-var connectAttempts = attempt.Strategy{
-	Total: 10 * time.Minute,
-	Delay: 500 * time.Millisecond,
-}
+// Reconnects back off exponentially, doubling the delay after each failed
+// attempt up to reconnectMax and giving up after reconnectTotal.
+var (
+	reconnectDelay = 500 * time.Millisecond
+	reconnectMax   = time.Minute
+	reconnectTotal = 10 * time.Minute
+)
 
 func (d *ServiceCache) start(s discoverd.Service) (err error) {
-	// use a function to create the watcher so we can reconnect if it closes
-	// unexpectedly (ideally the discoverd client would use a ResumingStream
-	// but service events do not yet support it).
+	// use a function to create the watcher so we can reconnect if it
+	// closes unexpectedly, resuming from the last seen event index so
+	// missed events are replayed, and falling back to a full sync when
+	// the server has truncated its event log past the resume point.
 	var events chan *discoverd.Event
 	connect := func() (err error) {
 		events = make(chan *discoverd.Event)
+		if since := d.eventIndex(); since > 0 {
+			d.stream, err = s.WatchSince(since, events)
+			if err == nil || !discoverd.IsEventLogTruncated(err) {
+				return err
+			}
+		}
+		d.Lock()
+		d.resync = make(map[string]struct{})
+		d.Unlock()
 		d.stream, err = s.Watch(events)
 		return
 	}
@@ -60,7 +81,7 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 				return
 			case event, ok := <-events:
 				if !ok {
-					if err := connectAttempts.Run(connect); err != nil {
+					if err := d.reconnect(connect); err != nil {
 						once.Do(func() { current <- err })
 						return
 					}
@@ -68,9 +89,12 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 				}
 
 				switch event.Kind {
-				case discoverd.EventKindUp, discoverd.EventKindUpdate:
+				case discoverd.EventKindUp, discoverd.EventKindUpdate, discoverd.EventKindDraining:
 					d.Lock()
 					d.instances[event.Instance.ID] = event.Instance
+					if d.resync != nil {
+						d.resync[event.Instance.ID] = struct{}{}
+					}
 					d.Unlock()
 				case discoverd.EventKindDown:
 					d.Lock()
@@ -85,8 +109,23 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 					}
 					d.Unlock()
 				case discoverd.EventKindCurrent:
+					d.Lock()
+					if d.resync != nil {
+						for id := range d.instances {
+							if _, ok := d.resync[id]; !ok {
+								delete(d.instances, id)
+							}
+						}
+						d.resync = nil
+					}
+					d.Unlock()
 					once.Do(func() { current <- nil })
 				}
+				if event.EventIndex > 0 {
+					d.Lock()
+					d.index = event.EventIndex
+					d.Unlock()
+				}
 				d.broadcast(event)
 			}
 		}
@@ -94,6 +133,35 @@ func (d *ServiceCache) start(s discoverd.Service) (err error) {
 	return <-current
 }
 
+// reconnect retries connect with exponential backoff.
+func (d *ServiceCache) reconnect(connect func() error) error {
+	delay := reconnectDelay
+	deadline := time.Now().Add(reconnectTotal)
+	for {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		select {
+		case <-d.stop:
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > reconnectMax {
+			delay = reconnectMax
+		}
+	}
+}
+
+func (d *ServiceCache) eventIndex() uint64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.index
+}
+
 func (d *ServiceCache) Close() error {
 	close(d.stop)
 	return d.stream.Close()
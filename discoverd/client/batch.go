@@ -0,0 +1,117 @@
+package discoverd
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registration pairs an instance with the service it should be registered in,
+// for use with the bulk registration API.
+type Registration struct {
+	Service  string    `json:"service"`
+	Instance *Instance `json:"instance"`
+}
+
+// AddInstances registers a batch of instances in a single request. The batch
+// is applied atomically by the server.
+func (c *Client) AddInstances(regs []*Registration) error {
+	return c.Put("/instances", regs, nil)
+}
+
+// BatchHeartbeater maintains the registration of a batch of instances.
+type BatchHeartbeater interface {
+	Close() error
+	SetClient(*Client)
+}
+
+// RegisterBatch registers a batch of instances and keeps them registered by
+// re-sending the batch on the heartbeat interval. Closing the heartbeater
+// deregisters all of the instances.
+func (c *Client) RegisterBatch(regs []*Registration) (BatchHeartbeater, error) {
+	for _, reg := range regs {
+		reg.Instance.Addr = expandAddr(reg.Instance.Addr)
+		if addr, err := NormalizeAddr(reg.Instance.Addr); err == nil {
+			reg.Instance.Addr = addr
+		}
+		if reg.Instance.Proto == "" {
+			reg.Instance.Proto = "tcp"
+		}
+		if reg.Instance.ID == "" {
+			reg.Instance.ID = reg.Instance.id()
+		}
+	}
+	h := &batchHeartbeater{
+		regs: regs,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	h.c.Store(c)
+	err := runAttempts.Run(func() error {
+		firstErr := make(chan error)
+		go h.run(firstErr)
+		return <-firstErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+type batchHeartbeater struct {
+	c atomic.Value // *Client
+
+	regs []*Registration
+
+	stop chan struct{}
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+func (h *batchHeartbeater) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.stop)
+		<-h.done
+	})
+	return nil
+}
+
+func (h *batchHeartbeater) SetClient(c *Client) {
+	h.c.Store(c)
+}
+
+func (h *batchHeartbeater) client() *Client {
+	return h.c.Load().(*Client)
+}
+
+func (h *batchHeartbeater) run(firstErr chan<- error) {
+	register := func() error {
+		return h.client().AddInstances(h.regs)
+	}
+
+	err := register()
+	firstErr <- err
+	if err != nil {
+		return
+	}
+	timer := time.NewTimer(nextHeartbeat())
+	for {
+		select {
+		case <-timer.C:
+			if err := register(); err != nil {
+				h.client().Logger.Error("batch heartbeat failed", "instances", len(h.regs), "err", err)
+				timer.Reset(nextHeartbeatFailing())
+				break
+			}
+			timer.Reset(nextHeartbeat())
+		case <-h.stop:
+			for _, reg := range h.regs {
+				h.client().Delete(fmt.Sprintf("/services/%s/instances/%s", reg.Service, reg.Instance.ID))
+			}
+			close(h.done)
+			return
+		}
+	}
+}
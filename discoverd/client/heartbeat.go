@@ -11,6 +11,7 @@ import (
 	"github.com/flynn/flynn/pkg/attempt"
 	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/shutdown"
 )
 
 // EnvInstanceMeta are environment variables which will be automatically added
@@ -25,6 +26,8 @@ var EnvInstanceMeta = map[string]struct{}{
 
 type Heartbeater interface {
 	SetMeta(map[string]string) error
+	Drain() error
+	CloseGracefully(delay time.Duration) error
 	Close() error
 	Addr() string
 	SetClient(*Client)
@@ -58,16 +61,41 @@ func (c *Client) AddServiceAndRegisterInstance(service string, inst *Instance) (
 	return c.RegisterInstance(service, inst)
 }
 
+// CloseOnExit arranges for the heartbeater to deregister when the process
+// exits via pkg/shutdown, which handles SIGTERM and SIGINT, so processes
+// don't have to wire the exit hook themselves. It returns the heartbeater
+// for chaining with Register calls.
+func CloseOnExit(h Heartbeater) Heartbeater {
+	shutdown.BeforeExit(func() { h.Close() })
+	return h
+}
+
+// CloseGracefullyOnExit arranges for the heartbeater to drain and then
+// deregister when the process exits via pkg/shutdown, waiting the given
+// delay between the two so routers have stopped sending traffic before the
+// instance goes down.
+func CloseGracefullyOnExit(h Heartbeater, delay time.Duration) Heartbeater {
+	shutdown.BeforeExit(func() { h.CloseGracefully(delay) })
+	return h
+}
+
 func (c *Client) Register(service, addr string) (Heartbeater, error) {
 	return c.RegisterInstance(service, &Instance{Addr: addr})
 }
 
 func (c *Client) RegisterInstance(service string, inst *Instance) (Heartbeater, error) {
 	inst.Addr = expandAddr(inst.Addr)
+	// Canonicalize the address before deriving the instance ID so
+	// equivalent spellings register as the same instance.
+	if addr, err := NormalizeAddr(inst.Addr); err == nil {
+		inst.Addr = addr
+	}
 	if inst.Proto == "" {
 		inst.Proto = "tcp"
 	}
-	inst.ID = inst.id()
+	if inst.ID == "" {
+		inst.ID = inst.id()
+	}
 	// add EnvInstanceMeta if present
 	for _, env := range os.Environ() {
 		kv := strings.SplitN(env, "=", 2)
@@ -109,9 +137,10 @@ type heartbeater struct {
 	stop chan struct{}
 	done chan struct{}
 
-	// Mutex protects inst.Meta
+	// Mutex protects inst.Meta and draining
 	sync.Mutex
-	inst *Instance
+	inst     *Instance
+	draining bool
 
 	service   string
 	closeOnce sync.Once
@@ -125,6 +154,28 @@ func (h *heartbeater) Close() error {
 	return nil
 }
 
+// Drain marks the instance as draining so routers stop sending it new
+// traffic, and suspends heartbeats so they don't revive the instance.
+func (h *heartbeater) Drain() error {
+	h.Lock()
+	h.draining = true
+	h.Unlock()
+	return h.client().Put(fmt.Sprintf("/services/%s/instances/%s/drain", h.service, h.inst.ID), nil, nil)
+}
+
+// CloseGracefully drains the instance, waits for the delay so routers can
+// react to the draining event, then deregisters. The deregistration is
+// applied by the server before Close returns, so the down event has been
+// broadcast by the time the process exits.
+func (h *heartbeater) CloseGracefully(delay time.Duration) error {
+	if err := h.Drain(); err != nil {
+		h.client().Logger.Error("drain failed", "service", h.service, "addr", h.inst.Addr, "err", err)
+	} else {
+		time.Sleep(delay)
+	}
+	return h.Close()
+}
+
 func (h *heartbeater) SetMeta(meta map[string]string) error {
 	h.Lock()
 	defer h.Unlock()
@@ -155,6 +206,9 @@ func (h *heartbeater) run(firstErr chan<- error) {
 	register := func() error {
 		h.Lock()
 		defer h.Unlock()
+		if h.draining {
+			return nil
+		}
 		return h.client().Put(path, h.inst, nil)
 	}
 
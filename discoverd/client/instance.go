@@ -1,12 +1,16 @@
 package discoverd
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type EventKind uint
@@ -18,18 +22,38 @@ const (
 	EventKindLeader
 	EventKindCurrent
 	EventKindServiceMeta
+	EventKindServiceDown
+	EventKindServiceConfig
+	EventKindBatch
+	EventKindHealthy
+	EventKindUnhealthy
+	EventKindDraining
+	EventKindServiceUp
+	EventKindMaintenance
+	EventKindDependencyDown
+	EventKindShutdown
 	EventKindAll     = ^EventKind(0)
 	EventKindUnknown = EventKind(0)
 )
 
 var eventKindStrings = map[EventKind]string{
-	EventKindUp:          "up",
-	EventKindUpdate:      "update",
-	EventKindDown:        "down",
-	EventKindLeader:      "leader",
-	EventKindCurrent:     "current",
-	EventKindUnknown:     "unknown",
-	EventKindServiceMeta: "service_meta",
+	EventKindUp:             "up",
+	EventKindUpdate:         "update",
+	EventKindDown:           "down",
+	EventKindLeader:         "leader",
+	EventKindCurrent:        "current",
+	EventKindUnknown:        "unknown",
+	EventKindServiceMeta:    "service_meta",
+	EventKindServiceDown:    "service_down",
+	EventKindServiceConfig:  "service_config",
+	EventKindBatch:          "batch",
+	EventKindHealthy:        "healthy",
+	EventKindUnhealthy:      "unhealthy",
+	EventKindDraining:       "draining",
+	EventKindServiceUp:      "service_up",
+	EventKindMaintenance:    "maintenance",
+	EventKindDependencyDown: "dependency_down",
+	EventKindShutdown:       "shutdown",
 }
 
 func (k EventKind) String() string {
@@ -59,6 +83,32 @@ func init() {
 	}
 }
 
+// RegisterEventKind registers an additional event kind under the given name,
+// wiring up its string and JSON mappings so extension subsystems can define
+// kinds without consumers decoding them as "unknown". The kind must be a
+// single bit not already in use, and the name must be unique. It must be
+// called at init time, before any events are encoded or decoded.
+func RegisterEventKind(kind EventKind, name string) {
+	if kind == 0 || kind&(kind-1) != 0 {
+		panic(fmt.Sprintf("discoverd: event kind %d is not a single bit", kind))
+	}
+	if s, ok := eventKindStrings[kind]; ok {
+		panic(fmt.Sprintf("discoverd: event kind %d is already registered as %q", kind, s))
+	}
+	json := `"` + name + `"`
+	if _, ok := eventKindUnmarshalJSON[json]; ok {
+		panic(fmt.Sprintf("discoverd: event kind name %q is already registered", name))
+	}
+	eventKindStrings[kind] = name
+	eventKindMarshalJSON[kind] = []byte(json)
+	eventKindUnmarshalJSON[json] = kind
+}
+
+// StrictEventKinds makes decoding an unregistered event kind an error instead
+// of silently mapping it to EventKindUnknown, so version skew between client
+// and server surfaces immediately. Set it before decoding begins.
+var StrictEventKinds bool
+
 func (k EventKind) MarshalJSON() ([]byte, error) {
 	data, ok := eventKindMarshalJSON[k]
 	if ok {
@@ -70,6 +120,10 @@ func (k EventKind) MarshalJSON() ([]byte, error) {
 func (k *EventKind) UnmarshalJSON(data []byte) error {
 	if kind, ok := eventKindUnmarshalJSON[string(data)]; ok {
 		*k = kind
+		return nil
+	}
+	if StrictEventKinds {
+		return fmt.Errorf("discoverd: unknown event kind %s", data)
 	}
 	return nil
 }
@@ -79,23 +133,132 @@ type Event struct {
 	Kind        EventKind    `json:"kind"`
 	Instance    *Instance    `json:"instance,omitempty"`
 	ServiceMeta *ServiceMeta `json:"service_meta,omitempty"`
+
+	// EventIndex is a monotonically increasing sequence number assigned
+	// when the event is broadcast. It is only set on events delivered to
+	// resumable subscriptions, and can be passed back when resubscribing
+	// to replay missed events after a reconnect.
+	EventIndex uint64 `json:"event_index,omitempty"`
+
+	// Batch holds the events of one atomic bulk state change. It is only
+	// set on "batch" events delivered to batching subscriptions.
+	Batch []*Event `json:"batch,omitempty"`
+
+	// Changed lists which instance fields differ from the previous
+	// registration: "addr", "proto" and/or "meta", or "health_info" for
+	// updates published by the server's health checker. It is only set on
+	// "update" events, so consumers such as routers can skip expensive
+	// backend rebuilds when only metadata changed.
+	Changed []string `json:"changed,omitempty"`
+
+	// Proto is the protocol a per-proto "leader" event applies to. It is
+	// only set for services with per-proto leader election enabled;
+	// service-wide leader events leave it empty.
+	Proto string `json:"proto,omitempty"`
+
+	// Dependency is the service that lost its last healthy instance. It is
+	// only set on "dependency_down" events, which are delivered to the
+	// services that declared a dependency on it.
+	Dependency string `json:"dependency,omitempty"`
+
+	// LeaderToken is the fencing token issued for the leadership announced
+	// by a "leader" event. Tokens increase monotonically with every
+	// leadership change, so external systems can reject writes from deposed
+	// leaders by comparing tokens.
+	LeaderToken uint64 `json:"leader_token,omitempty"`
+
+	// Timestamp is the wall-clock time on the broadcasting node when the
+	// event was sequenced, in nanoseconds since the Unix epoch, so
+	// consumers can measure propagation latency. Clocks on different nodes
+	// may be skewed; use EventIndex to order events within one cluster.
+	Timestamp int64 `json:"timestamp,omitempty"`
+
+	// Origin identifies the node that broadcast the event by its advertise
+	// address, so events mirrored from federated clusters can be traced
+	// back to their source.
+	Origin string `json:"origin,omitempty"`
+
+	// Reason states why an instance was removed. It is only set on "down"
+	// events, so automation can treat a clean shutdown differently from a
+	// crash. Instances failing health checks are not removed; those
+	// transitions are surfaced as "unhealthy" events instead.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Reasons attached to "down" events.
+const (
+	// DownReasonDeregistered marks an instance that was explicitly
+	// removed by a client.
+	DownReasonDeregistered = "deregistered"
+
+	// DownReasonDrained marks an instance that was deregistered after it
+	// finished draining.
+	DownReasonDrained = "drained"
+
+	// DownReasonExpired marks an instance that missed its heartbeats and
+	// was expired.
+	DownReasonExpired = "expired"
+
+	// DownReasonServiceRemoved marks an instance removed because its
+	// whole service was removed.
+	DownReasonServiceRemoved = "service-removed"
+)
+
+// Time returns the event timestamp as a time.Time. It returns the zero time
+// for events from servers that predate event timestamping.
+func (e *Event) Time() time.Time {
+	if e.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, e.Timestamp)
 }
 
 func (e *Event) String() string {
 	return fmt.Sprintf("[%s] %s %#v", e.Service, e.Kind, e.Instance)
 }
 
+// InstanceState is the lifecycle state of an instance.
+type InstanceState string
+
+const (
+	// InstanceStateUp is the normal running state. It is the zero value so
+	// instances registered by older clients are considered up.
+	InstanceStateUp InstanceState = ""
+
+	// InstanceStateDraining marks an instance that is about to deregister.
+	// Routers should stop sending it new connections but may let existing
+	// connections finish.
+	InstanceStateDraining InstanceState = "draining"
+
+	// InstanceStateMaintenance marks an instance an operator has temporarily
+	// pulled from rotation. It stays registered, keeping its metadata and
+	// index, but is excluded from instance lists, DNS answers and leader
+	// election until maintenance is cleared.
+	InstanceStateMaintenance InstanceState = "maintenance"
+)
+
 // Instance is a single running instance of a service. It is immutable after it
 // has been initialized.
 type Instance struct {
-	// ID is unique within the service, and is currently defined as
-	// Hex(MD5(Proto + "-" + Addr)) but this may change in the future.
+	// ID is unique within the service. If left blank at registration it
+	// defaults to Hex(MD5(Proto + "-" + Addr)). Callers may instead supply
+	// their own stable ID, such as a host UUID plus job ID, so an instance
+	// that changes address across restarts is tracked as the same logical
+	// entity and preserves its Index and any leadership. The ID is the
+	// uniqueness key: registering under an existing ID updates that
+	// instance rather than adding a new one.
 	ID string `json:"id"`
 
 	// Addr is the IP/port address that can be used to communicate with the
 	// service. It must be valid to dial this address.
 	Addr string `json:"addr"`
 
+	// AdvertiseAddr is an optional external address for the instance, used
+	// when it sits behind NAT or on an overlay network. Lookups from
+	// clients outside the server's configured internal networks are
+	// answered with this address instead of Addr.
+	AdvertiseAddr string `json:"advertise_addr,omitempty"`
+
 	// Proto is the protocol used to connect to the service, examples include:
 	// tcp, udp, http, https. It must be lowercase alphanumeric.
 	Proto string `json:"proto"`
@@ -103,33 +266,144 @@ type Instance struct {
 	// Meta is arbitrary metadata specified when registering the instance.
 	Meta map[string]string `json:"meta,omitempty"`
 
+	// Annotations holds small binary values attached to the instance, such
+	// as TLS certificate fingerprints or serialized routing hints that don't
+	// fit the string-only Meta map. Values travel base64-encoded over the
+	// wire and their total size per instance is capped by the server.
+	Annotations map[string][]byte `json:"annotations,omitempty"`
+
+	// TTL is the number of seconds after the last heartbeat before the
+	// instance expires. If zero the server default is used.
+	TTL int `json:"ttl,omitempty"`
+
+	// ExpiresAt is an optional absolute deadline after which the instance
+	// is deregistered automatically, even if it is still heartbeating.
+	// Useful for canary instances and time-boxed maintenance
+	// registrations.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Weight biases load balancing between instances of the service.
+	// Instances with higher weights receive proportionally more traffic,
+	// which allows gradual traffic shifting. Zero means unweighted, which
+	// balancers and the DNS server treat as a weight of 1.
+	Weight uint16 `json:"weight,omitempty"`
+
+	// Canary marks the instance as part of a canary subset. Deploy tooling
+	// can register a fraction of instances as canaries and filter on the
+	// flag in lookups, subscriptions and client balancers to shift traffic
+	// without ad-hoc Meta conventions.
+	Canary bool `json:"canary,omitempty"`
+
+	// Zone is the failure domain the instance runs in, such as a cloud
+	// availability zone or region. Lookups, the DNS server and client
+	// balancers can prefer instances in the caller's zone so traffic
+	// stays local by default.
+	Zone string `json:"zone,omitempty"`
+
+	// State is the lifecycle state of the instance. It is maintained by the
+	// server and ignored during registration.
+	State InstanceState `json:"state,omitempty"`
+
 	// Index is the logical epoch of the initial registration of the instance.
 	// It is guaranteed to be unique, greater than zero, not change as long as
 	// the instance does not expire, and sort with other indexes in the order of
 	// instance creation.
 	Index uint64 `json:"index,omitempty"`
 
+	// HealthInfo is rolling probe data published by the server's health
+	// checker for services with a health check configured. It is maintained
+	// by the server and ignored during registration. Load balancers can use
+	// it to prefer fast instances.
+	HealthInfo *HealthInfo `json:"health_info,omitempty"`
+
 	// addrOnce is used to initialize host/port
 	addrOnce sync.Once
 	host     string
 	port     string
 }
 
+// HealthInfo is rolling health data for an instance, computed by the server
+// from its recent health probes. It is republished only on significant
+// change, so consumers see trends rather than per-probe noise.
+type HealthInfo struct {
+	// Latency is the rolling average probe latency.
+	Latency time.Duration `json:"latency,omitempty"`
+
+	// FailureRate is the fraction of recent probes that failed, between 0
+	// and 1.
+	FailureRate float64 `json:"failure_rate,omitempty"`
+}
+
 func (inst *Instance) Equal(other *Instance) bool {
 	return inst.Addr == other.Addr &&
+		inst.AdvertiseAddr == other.AdvertiseAddr &&
 		inst.Proto == other.Proto &&
-		mapEqual(inst.Meta, other.Meta)
+		inst.Weight == other.Weight &&
+		inst.Canary == other.Canary &&
+		inst.Zone == other.Zone &&
+		mapEqual(inst.Meta, other.Meta) &&
+		annotationsEqual(inst.Annotations, other.Annotations)
+}
+
+// EffectiveWeight returns the weight balancers should use for the instance:
+// the Weight field if set, otherwise the legacy "weight" meta key, and 1 if
+// neither is present.
+func (inst *Instance) EffectiveWeight() uint16 {
+	if inst.Weight > 0 {
+		return inst.Weight
+	}
+	if s, ok := inst.Meta["weight"]; ok {
+		if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+			return uint16(n)
+		}
+	}
+	return 1
+}
+
+// EffectiveZone returns the zone balancers should use for the instance: the
+// Zone field if set, otherwise the legacy "zone" meta key. It returns the
+// empty string for instances that declared no zone.
+func (inst *Instance) EffectiveZone() string {
+	if inst.Zone != "" {
+		return inst.Zone
+	}
+	return inst.Meta["zone"]
+}
+
+// NormalizeAddr canonicalizes an address so textually different spellings of
+// the same address don't produce distinct instances. IP literals are reduced
+// to their canonical form — in particular IPv6 addresses, which have many
+// equivalent spellings and are re-bracketed by JoinHostPort — keeping any
+// zone ID, while DNS hostnames are lowercased and stripped of a trailing dot.
+func NormalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	// Split off any IPv6 zone ID before parsing the literal.
+	ipHost, zone := host, ""
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		ipHost, zone = host[:i], host[i:]
+	}
+	if ip := net.ParseIP(ipHost); ip != nil {
+		host = ip.String() + zone
+	}
+	return net.JoinHostPort(host, port), nil
 }
 
 func (inst *Instance) Valid() error {
 	if err := inst.validProto(); err != nil {
 		return err
 	}
-	if _, _, err := net.SplitHostPort(inst.Addr); err != nil {
+	addr, err := NormalizeAddr(inst.Addr)
+	if err != nil {
 		return err
 	}
-	if expected := inst.id(); inst.ID != expected {
-		return fmt.Errorf("discoverd: instance id is incorrect, expected %s", expected)
+	inst.Addr = addr
+	if err := inst.validID(); err != nil {
+		return err
 	}
 	return nil
 }
@@ -150,22 +424,74 @@ func (inst *Instance) splitHostPort() {
 	})
 }
 
+// StructuredProtos relaxes protocol validation to also allow '+', '-' and
+// '.', so structured protocols such as "grpc+tls" or "postgres.replication"
+// can be registered. It is disabled by default for compatibility with the
+// historical lowercase alphanumeric scheme, and is enabled cluster-wide via
+// the server's -structured-protos flag.
+var StructuredProtos = false
+
 var ErrUnsetProto = errors.New("discoverd: proto must be set")
 var ErrInvalidProto = errors.New("discoverd: proto must be lowercase alphanumeric")
+var ErrInvalidStructuredProto = errors.New("discoverd: proto must be lowercase alphanumeric plus '+', '-' and '.', starting and ending with an alphanumeric")
+var ErrUnsetID = errors.New("discoverd: instance id must be set")
+var ErrInvalidID = errors.New("discoverd: instance id must be at most 64 characters of lowercase alphanumeric plus dash")
 
 func (inst *Instance) validProto() error {
 	if inst.Proto == "" {
 		return ErrUnsetProto
 	}
+	if StructuredProtos {
+		return validStructuredProto(inst.Proto)
+	}
 	for _, r := range inst.Proto {
-		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+		if !protoAlnum(r) {
 			return ErrInvalidProto
 		}
 	}
 	return nil
 }
 
+func protoAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
+
+func validStructuredProto(proto string) error {
+	for i, r := range proto {
+		if protoAlnum(r) {
+			continue
+		}
+		if (r == '+' || r == '-' || r == '.') && i > 0 && i < len(proto)-1 {
+			continue
+		}
+		return ErrInvalidStructuredProto
+	}
+	return nil
+}
+
+func (inst *Instance) validID() error {
+	if inst.ID == "" {
+		return ErrUnsetID
+	}
+	if len(inst.ID) > 64 {
+		return ErrInvalidID
+	}
+	for _, r := range inst.ID {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return ErrInvalidID
+		}
+	}
+	return nil
+}
+
 func (inst *Instance) id() string {
+	// Structured protos can themselves contain the historical "-"
+	// separator, so hash them with a separator that can't appear in a
+	// proto or address to keep the derivation unambiguous. Plain protos
+	// keep the historical scheme so existing instance IDs don't change.
+	if strings.ContainsAny(inst.Proto, "+-.") {
+		return md5sum(inst.Proto + "/" + inst.Addr)
+	}
 	return md5sum(inst.Proto + "-" + inst.Addr)
 }
 
@@ -194,3 +520,15 @@ func mapEqual(x, y map[string]string) bool {
 	}
 	return true
 }
+
+func annotationsEqual(x, y map[string][]byte) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for k, v := range x {
+		if yv, ok := y[k]; !ok || !bytes.Equal(yv, v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package discoverd
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInstanceValidProto(t *testing.T) {
+	valid := func(proto string) error {
+		inst := &Instance{Proto: proto, Addr: "127.0.0.1:80"}
+		inst.ID = inst.id()
+		return inst.Valid()
+	}
+
+	// The strict scheme only allows lowercase alphanumerics.
+	for _, proto := range []string{"http", "http2", "tcp"} {
+		if err := valid(proto); err != nil {
+			t.Fatalf("unexpected error for %q: %s", proto, err)
+		}
+	}
+	for _, proto := range []string{"", "HTTP", "grpc+tls", "postgres.replication", "http-alt"} {
+		if err := valid(proto); err == nil {
+			t.Fatalf("expected error for %q", proto)
+		}
+	}
+
+	// Structured protos additionally allow '+', '-' and '.' between
+	// alphanumerics.
+	StructuredProtos = true
+	defer func() { StructuredProtos = false }()
+
+	for _, proto := range []string{"http", "grpc+tls", "postgres.replication", "http-alt"} {
+		if err := valid(proto); err != nil {
+			t.Fatalf("unexpected error for %q: %s", proto, err)
+		}
+	}
+	for _, proto := range []string{"", "HTTP", "+grpc", "grpc+", ".http", "a_b"} {
+		if err := valid(proto); err == nil {
+			t.Fatalf("expected error for %q", proto)
+		}
+	}
+}
+
+func TestRegisterEventKind(t *testing.T) {
+	// Register an extension kind and verify its mappings.
+	const kind = EventKind(1 << 20)
+	RegisterEventKind(kind, "custom")
+	if kind.String() != "custom" {
+		t.Fatalf("unexpected string: %s", kind.String())
+	}
+	if data, err := json.Marshal(kind); err != nil {
+		t.Fatal(err)
+	} else if string(data) != `"custom"` {
+		t.Fatalf("unexpected json: %s", data)
+	}
+	var decoded EventKind
+	if err := json.Unmarshal([]byte(`"custom"`), &decoded); err != nil {
+		t.Fatal(err)
+	} else if decoded != kind {
+		t.Fatalf("unexpected kind: %d", decoded)
+	}
+
+	// Re-registering the kind or its name panics.
+	for _, fn := range []func(){
+		func() { RegisterEventKind(kind, "other") },
+		func() { RegisterEventKind(1<<21, "custom") },
+		func() { RegisterEventKind(3<<22, "multi") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected panic")
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestEventKindStrictDecoding(t *testing.T) {
+	// Unknown kinds are silently ignored by default.
+	var kind EventKind
+	if err := json.Unmarshal([]byte(`"bogus"`), &kind); err != nil {
+		t.Fatal(err)
+	} else if kind != EventKindUnknown {
+		t.Fatalf("unexpected kind: %d", kind)
+	}
+
+	// In strict mode they are an error.
+	StrictEventKinds = true
+	defer func() { StrictEventKinds = false }()
+
+	err := json.Unmarshal([]byte(`"bogus"`), &kind)
+	if err == nil || err.Error() != `discoverd: unknown event kind "bogus"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := json.Unmarshal([]byte(`"up"`), &kind); err != nil {
+		t.Fatal(err)
+	} else if kind != EventKindUp {
+		t.Fatalf("unexpected kind: %d", kind)
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1:80":              "127.0.0.1:80",
+		"[::1]:80":                  "[::1]:80",
+		"[0:0:0:0:0:0:0:1]:80":      "[::1]:80",
+		"[2001:DB8::1]:80":          "[2001:db8::1]:80",
+		"[fe80::1%eth0]:80":         "[fe80::1%eth0]:80",
+		"[FE80:0:0:0:0:0:0:1%I1]:8": "[fe80::1%i1]:8",
+		"db.example.com:5432":       "db.example.com:5432",
+		"DB.example.com.:5432":      "db.example.com:5432",
+	} {
+		if got, err := NormalizeAddr(addr); err != nil {
+			t.Fatalf("unexpected error for %q: %s", addr, err)
+		} else if got != want {
+			t.Fatalf("unexpected normalization of %q: got %q, want %q", addr, got, want)
+		}
+	}
+
+	if _, err := NormalizeAddr("noport"); err == nil {
+		t.Fatal("expected error for address without port")
+	}
+}
+
+func TestInstanceIDScheme(t *testing.T) {
+	// Plain protos keep the historical ID derivation.
+	plain := &Instance{Proto: "http", Addr: "127.0.0.1:80"}
+	if id := plain.id(); id != md5sum("http-127.0.0.1:80") {
+		t.Fatalf("unexpected id: %s", id)
+	}
+
+	// Structured protos can contain the historical "-" separator, so they
+	// hash with an unambiguous one.
+	structured := &Instance{Proto: "http-alt", Addr: "127.0.0.1:80"}
+	if id := structured.id(); id != md5sum("http-alt/127.0.0.1:80") {
+		t.Fatalf("unexpected id: %s", id)
+	}
+	if structured.id() == (&Instance{Proto: "http", Addr: "alt-127.0.0.1:80"}).id() {
+		t.Fatal("expected distinct ids")
+	}
+}
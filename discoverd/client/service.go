@@ -3,6 +3,7 @@ package discoverd
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"time"
 
 	hh "github.com/flynn/flynn/pkg/httphelper"
@@ -15,6 +16,7 @@ type Service interface {
 	Addrs() ([]string, error)
 	Leaders(chan *Instance) (stream.Stream, error)
 	Watch(events chan *Event) (stream.Stream, error)
+	WatchSince(since uint64, events chan *Event) (stream.Stream, error)
 	GetMeta() (*ServiceMeta, error)
 	SetMeta(*ServiceMeta) error
 	SetLeader(string) error
@@ -25,17 +27,101 @@ type LeaderType string
 const (
 	LeaderTypeManual LeaderType = "manual"
 	LeaderTypeOldest LeaderType = "oldest"
+
+	// LeaderTypeNewest elects the most recently registered instance.
+	LeaderTypeNewest LeaderType = "newest"
+
+	// LeaderTypeLexicographic elects the instance with the lowest Addr,
+	// giving a stable choice that doesn't move as instances churn.
+	LeaderTypeLexicographic LeaderType = "lexicographic"
+
+	// LeaderTypeMetaPriority elects the instance with the highest numeric
+	// value of the meta key named by ServiceConfig.LeaderMetaKey.
+	LeaderTypeMetaPriority LeaderType = "meta-priority"
+
+	// LeaderTypeNone disables leader election for the service entirely.
+	LeaderTypeNone LeaderType = "none"
+)
+
+// DNSPolicy controls how the DNS server orders the records it answers for a
+// service.
+type DNSPolicy string
+
+const (
+	// DNSPolicyRandom shuffles the records on every query. It is the
+	// default.
+	DNSPolicyRandom DNSPolicy = "random"
+
+	// DNSPolicyRoundRobin rotates the records by one position on every
+	// query, spreading DNS-only consumers evenly across instances.
+	DNSPolicyRoundRobin DNSPolicy = "round_robin"
+
+	// DNSPolicyLeader answers only with the current service leader.
+	DNSPolicyLeader DNSPolicy = "leader"
+
+	// DNSPolicyWeighted orders the records by weighted random draws on the
+	// instance weight, so heavier instances are listed first more often.
+	DNSPolicyWeighted DNSPolicy = "weighted"
 )
 
 type ServiceConfig struct {
 	LeaderType LeaderType `json:"leader_type"`
+
+	// Profile names an appliance profile registered on the server (e.g.
+	// "postgres"). The server fills in the leader election mode and
+	// health check the appliance expects, and instances of the service
+	// must register the meta keys the profile requires.
+	Profile string `json:"profile,omitempty"`
+
+	// LeaderMetaKey is the meta key compared by "meta-priority" leader
+	// election. It defaults to "priority".
+	LeaderMetaKey string `json:"leader_meta_key,omitempty"`
+
+	// LeaderPerProto additionally elects a leader for each protocol the
+	// service's instances register, so a service serving e.g. both "http"
+	// and "tcp" has a leader per protocol. Per-proto "leader" events carry
+	// the proto they apply to.
+	LeaderPerProto bool `json:"leader_per_proto,omitempty"`
+
+	// DNSPolicy controls how the DNS server answers queries for the
+	// service. If empty the records are shuffled on every query.
+	DNSPolicy DNSPolicy `json:"dns_policy,omitempty"`
+
+	// InstanceTTL is the number of seconds after the last heartbeat before
+	// instances of the service expire. If zero the server default is used.
+	InstanceTTL int `json:"instance_ttl,omitempty"`
+
+	// HealthCheck, if set, enables periodic probing of the service's
+	// instances. Instances that fail the probe are marked unhealthy and are
+	// excluded from instance lists and leader election until they recover.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+}
+
+// HealthCheck configures how the instances of a service are probed.
+type HealthCheck struct {
+	// Type is the probe type: "tcp", "http" or "script".
+	Type string `json:"type"`
+
+	// Path is the HTTP path to probe. It is only used by "http" checks and
+	// defaults to "/".
+	Path string `json:"path,omitempty"`
+
+	// Command is the command to run, with the instance address appended as
+	// the final argument. A zero exit status means the instance is healthy.
+	// It is only used by "script" checks.
+	Command []string `json:"command,omitempty"`
+
+	// Threshold is the number of consecutive probe results required before
+	// an instance transitions between healthy and unhealthy. If zero the
+	// server default is used.
+	Threshold int `json:"threshold,omitempty"`
 }
 
 func (c *Client) AddService(name string, conf *ServiceConfig) error {
 	if conf == nil {
 		conf = &ServiceConfig{}
 	}
-	if conf.LeaderType == "" {
+	if conf.LeaderType == "" && conf.Profile == "" {
 		conf.LeaderType = LeaderTypeOldest
 	}
 	return runAttempts.RunWithValidator(func() error {
@@ -101,6 +187,51 @@ outer:
 	}
 }
 
+// listPage is the envelope returned by the server's paginated listing
+// endpoints.
+type listPage struct {
+	Items      json.RawMessage `json:"items"`
+	NextCursor string          `json:"next_cursor"`
+}
+
+// InstancesPage fetches one page of a service's instances, sorted by
+// registration index. It returns the page and the cursor to pass when
+// fetching the next one, which is empty once the last page has been reached.
+// Pass an empty cursor to fetch the first page.
+func (c *Client) InstancesPage(service string, limit int, cursor string) ([]*Instance, string, error) {
+	var page listPage
+	path := fmt.Sprintf("/services/%s/instances?limit=%d", service, limit)
+	if cursor != "" {
+		path += "&cursor=" + url.QueryEscape(cursor)
+	}
+	if err := c.Get(path, &page); err != nil {
+		return nil, "", err
+	}
+	var instances []*Instance
+	if err := json.Unmarshal(page.Items, &instances); err != nil {
+		return nil, "", err
+	}
+	return instances, page.NextCursor, nil
+}
+
+// ServiceNamesPage fetches one page of service names, sorted by name. The
+// cursor works the same way as in InstancesPage.
+func (c *Client) ServiceNamesPage(limit int, cursor string) ([]string, string, error) {
+	var page listPage
+	path := fmt.Sprintf("/services?limit=%d", limit)
+	if cursor != "" {
+		path += "&cursor=" + url.QueryEscape(cursor)
+	}
+	if err := c.Get(path, &page); err != nil {
+		return nil, "", err
+	}
+	var names []string
+	if err := json.Unmarshal(page.Items, &names); err != nil {
+		return nil, "", err
+	}
+	return names, page.NextCursor, nil
+}
+
 type service struct {
 	client *Client
 	name   string
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/pkg/attempt"
+	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/stream"
 )
 
@@ -86,17 +87,33 @@ var connectAttempts = attempt.Strategy{
 //
 // On reconnect, current events from the server are handled as follows:
 //
-// * EventKindUp
+//   - EventKindUp
 //     Compared to local instances, and only sent if the instance was previously
 //     unknown or has changed in some way (with the event's kind being set to
 //     EventKindUpdate in the latter case).
 //
-// * EventKindLeader
+//   - EventKindLeader
 //     Compared to the most recently known leader, and only sent if it differs.
 //
-// * EventKindServiceMeta
+//   - EventKindServiceMeta
 //     Compared to the most recently known service metadata, and only sent if
 //     it differs.
+// WatchSince starts a raw event stream which resumes from the given event
+// index, replaying the events which followed it before delivering live
+// events. Unlike Watch it does not reconnect on error, and if the index has
+// been truncated out of the server's event log it fails with an error
+// matched by IsEventLogTruncated, in which case the caller must fall back to
+// a full Watch.
+func (s *service) WatchSince(since uint64, ch chan *Event) (stream.Stream, error) {
+	return s.client.Stream("GET", fmt.Sprintf("/services/%s?since=%d", s.name, since), nil, ch)
+}
+
+// IsEventLogTruncated returns whether an error from WatchSince means the
+// requested event index is no longer covered by the server's event log.
+func IsEventLogTruncated(err error) bool {
+	return hh.IsPreconditionFailedError(err)
+}
+
 func (s *service) Watch(ch chan *Event) (stream.Stream, error) {
 	var events chan *Event
 	var stream stream.Stream
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("discoverd-bench", flag.ExitOnError)
+	var (
+		url         = fs.String("url", "http://127.0.0.1:1111", "discoverd server URL")
+		service     = fs.String("service", "bench", "service to register instances in")
+		registrants = fs.Int("registrants", 100, "number of registered instances to maintain")
+		watchers    = fs.Int("watchers", 10, "number of concurrent event watchers")
+		churn       = fs.Duration("churn", time.Second, "interval between instance re-registrations")
+		duration    = fs.Duration("duration", 30*time.Second, "how long to run the benchmark")
+	)
+	fs.Parse(args)
+
+	client := discoverd.NewClientWithURL(*url)
+	if err := client.AddService(*service, nil); err != nil && !hh.IsObjectExistsError(err) {
+		return err
+	}
+
+	b := newBench(client, *service)
+
+	// Start watchers before generating any events.
+	for i := 0; i < *watchers; i++ {
+		if err := b.startWatcher(); err != nil {
+			return err
+		}
+	}
+
+	// Register the instances and keep them heartbeating.
+	for i := 0; i < *registrants; i++ {
+		if err := b.startRegistrant(i, *churn); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("running for %s: %d registrants, %d watchers, churn every %s\n",
+		*duration, *registrants, *watchers, *churn)
+	time.Sleep(*duration)
+	b.stop()
+
+	b.report(os.Stdout, *duration, *watchers)
+	return nil
+}
+
+type bench struct {
+	client  *discoverd.Client
+	service string
+
+	mu         sync.Mutex
+	registered map[string]time.Time // instance ID -> registration time
+	latencies  []time.Duration
+
+	registrations uint64 // total successful registrations
+	dropped       uint64 // watchers dropped by the server
+
+	stopped  chan struct{}
+	wg       sync.WaitGroup
+	watchers []stream.Stream
+	beaters  []discoverd.Heartbeater
+}
+
+func newBench(client *discoverd.Client, service string) *bench {
+	return &bench{
+		client:     client,
+		service:    service,
+		registered: make(map[string]time.Time),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// startWatcher watches the service, recording the latency of "up" events for
+// instances this process registered.
+func (b *bench) startWatcher() error {
+	events := make(chan *discoverd.Event)
+	s, err := b.client.Service(b.service).Watch(events)
+	if err != nil {
+		return err
+	}
+	b.watchers = append(b.watchers, s)
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for event := range events {
+			if event.Kind != discoverd.EventKindUp || event.Instance == nil {
+				continue
+			}
+			b.mu.Lock()
+			if t, ok := b.registered[event.Instance.ID]; ok {
+				b.latencies = append(b.latencies, time.Since(t))
+			}
+			b.mu.Unlock()
+		}
+		if s.Err() != nil {
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}()
+	return nil
+}
+
+// startRegistrant registers an instance and re-registers it on the churn
+// interval to generate a steady stream of events.
+func (b *bench) startRegistrant(i int, churn time.Duration) error {
+	inst := &discoverd.Instance{
+		Addr:  fmt.Sprintf("127.0.0.1:%d", 20000+i),
+		Proto: "tcp",
+	}
+
+	register := func() error {
+		start := time.Now()
+		hb, err := b.client.RegisterInstance(b.service, inst)
+		if err != nil {
+			return err
+		}
+		atomic.AddUint64(&b.registrations, 1)
+		b.mu.Lock()
+		b.registered[inst.ID] = start
+		b.beaters = append(b.beaters, hb)
+		b.mu.Unlock()
+		return nil
+	}
+
+	if err := register(); err != nil {
+		return err
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			select {
+			case <-b.stopped:
+				return
+			case <-time.After(churn):
+			}
+
+			// Deregister and re-register to generate down/up events.
+			b.mu.Lock()
+			var hb discoverd.Heartbeater
+			if n := len(b.beaters); n > 0 {
+				hb, b.beaters = b.beaters[n-1], b.beaters[:n-1]
+			}
+			b.mu.Unlock()
+			if hb != nil {
+				hb.Close()
+			}
+			if err := register(); err != nil {
+				fmt.Fprintf(os.Stderr, "re-register: %s\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *bench) stop() {
+	close(b.stopped)
+
+	b.mu.Lock()
+	beaters := b.beaters
+	b.beaters = nil
+	b.mu.Unlock()
+	for _, hb := range beaters {
+		hb.Close()
+	}
+	for _, s := range b.watchers {
+		s.Close()
+	}
+	b.wg.Wait()
+}
+
+func (b *bench) report(w io.Writer, duration time.Duration, watchers int) {
+	b.mu.Lock()
+	latencies := b.latencies
+	b.mu.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	registrations := atomic.LoadUint64(&b.registrations)
+	fmt.Fprintf(w, "\nregistrations: %d (%.1f/sec)\n",
+		registrations, float64(registrations)/duration.Seconds())
+	fmt.Fprintf(w, "events observed: %d\n", len(latencies))
+	fmt.Fprintf(w, "event latency: p50=%s p95=%s p99=%s max=%s\n",
+		percentile(latencies, 0.50), percentile(latencies, 0.95),
+		percentile(latencies, 0.99), percentile(latencies, 1))
+	fmt.Fprintf(w, "dropped watchers: %d/%d\n", atomic.LoadUint64(&b.dropped), watchers)
+}
+
+// percentile returns the p'th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
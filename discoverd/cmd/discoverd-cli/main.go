@@ -0,0 +1,325 @@
+// discoverd-cli is an operator tool for inspecting and mutating discovery
+// state interactively.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+const usage = `usage: discoverd-cli [-url URL] COMMAND [ARG...]
+
+Commands:
+  services                          list services
+  instances SERVICE                 list instances of a service
+  leader SERVICE                    show the leader of a service
+  register SERVICE ADDR [K=V...]    register an instance and heartbeat until interrupted
+  deregister SERVICE ID             deregister an instance
+  meta SERVICE [JSON]               show or set service metadata
+  watch SERVICE                     tail the event stream (-json for raw events)
+  export [FILE]                     dump the full cluster state as JSON
+  import [FILE]                     replace the cluster state with a dump
+  replay FILE                       reconstruct state from a persisted event
+                                    log (-index N or -at TIME for a cutoff)
+`
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	fs := flag.NewFlagSet("discoverd-cli", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	var (
+		url     = fs.String("url", "http://127.0.0.1:1111", "discoverd server URL")
+		jsonOut = fs.Bool("json", false, "print watch events as JSON")
+		proto   = fs.String("proto", "tcp", "proto to register instances with")
+		timeout = fs.Duration("timeout", 2*time.Second, "timeout waiting for instances")
+		index   = fs.Uint64("index", 0, "event index to replay up to (0 replays everything)")
+		at      = fs.String("at", "", "RFC3339 time to replay up to, e.g. 2026-08-27T14:32:00Z")
+	)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client := discoverd.NewClientWithURL(*url)
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "services":
+		return runServices(client)
+	case "instances":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: discoverd-cli instances SERVICE")
+		}
+		return runInstances(client, cmdArgs[0], *timeout)
+	case "leader":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: discoverd-cli leader SERVICE")
+		}
+		return runLeader(client, cmdArgs[0])
+	case "register":
+		if len(cmdArgs) < 2 {
+			return fmt.Errorf("usage: discoverd-cli register SERVICE ADDR [K=V...]")
+		}
+		return runRegister(client, cmdArgs[0], cmdArgs[1], *proto, cmdArgs[2:])
+	case "deregister":
+		if len(cmdArgs) != 2 {
+			return fmt.Errorf("usage: discoverd-cli deregister SERVICE ID")
+		}
+		return runDeregister(client, cmdArgs[0], cmdArgs[1])
+	case "meta":
+		if len(cmdArgs) != 1 && len(cmdArgs) != 2 {
+			return fmt.Errorf("usage: discoverd-cli meta SERVICE [JSON]")
+		}
+		return runMeta(client, cmdArgs)
+	case "watch":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: discoverd-cli watch SERVICE")
+		}
+		return runWatch(client, cmdArgs[0], *jsonOut)
+	case "export":
+		if len(cmdArgs) > 1 {
+			return fmt.Errorf("usage: discoverd-cli export [FILE]")
+		}
+		return runExport(client, cmdArgs)
+	case "import":
+		if len(cmdArgs) > 1 {
+			return fmt.Errorf("usage: discoverd-cli import [FILE]")
+		}
+		return runImport(client, cmdArgs)
+	case "replay":
+		if len(cmdArgs) != 1 {
+			return fmt.Errorf("usage: discoverd-cli replay FILE")
+		}
+		return runReplay(cmdArgs[0], *index, *at)
+	default:
+		return fmt.Errorf("unknown command: %q\n%s", cmd, usage)
+	}
+}
+
+func runServices(client *discoverd.Client) error {
+	cursor := ""
+	for {
+		names, next, err := client.ServiceNamesPage(0, cursor)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func runInstances(client *discoverd.Client, service string, timeout time.Duration) error {
+	instances, err := client.Instances(service, timeout)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDR\tPROTO\tSTATE\tCREATED\tMETA")
+	for _, inst := range instances {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			inst.ID, inst.Addr, inst.Proto, inst.State, inst.Index, formatMeta(inst.Meta))
+	}
+	return w.Flush()
+}
+
+func runLeader(client *discoverd.Client, service string) error {
+	leader, err := client.Service(service).Leader()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", leader.ID, leader.Addr)
+	return nil
+}
+
+// runRegister registers an instance and heartbeats it until the process is
+// interrupted, since registrations expire without heartbeats.
+func runRegister(client *discoverd.Client, service, addr, proto string, meta []string) error {
+	inst := &discoverd.Instance{Addr: addr, Proto: proto}
+	if len(meta) > 0 {
+		inst.Meta = make(map[string]string, len(meta))
+		for _, pair := range meta {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid meta pair: %q", pair)
+			}
+			inst.Meta[k] = v
+		}
+	}
+
+	hb, err := client.AddServiceAndRegisterInstance(service, inst)
+	if err != nil {
+		return err
+	}
+	defer hb.Close()
+
+	fmt.Printf("registered %s in %s, heartbeating until interrupted\n", inst.ID, service)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	<-ch
+	return nil
+}
+
+func runDeregister(client *discoverd.Client, service, id string) error {
+	return client.Delete(fmt.Sprintf("/services/%s/instances/%s", service, id))
+}
+
+func runMeta(client *discoverd.Client, args []string) error {
+	s := client.Service(args[0])
+	meta, err := s.GetMeta()
+	if err != nil {
+		if len(args) == 1 || !hh.IsObjectNotFoundError(err) {
+			return err
+		}
+		meta = &discoverd.ServiceMeta{}
+	}
+	if len(args) == 1 {
+		fmt.Printf("%s\n", meta.Data)
+		return nil
+	}
+
+	// Set, using the current index so concurrent updates fail cleanly.
+	meta.Data = json.RawMessage(args[1])
+	if err := s.SetMeta(meta); err != nil {
+		return err
+	}
+	fmt.Printf("set meta at index %d\n", meta.Index)
+	return nil
+}
+
+func runWatch(client *discoverd.Client, service string, jsonOut bool) error {
+	events := make(chan *discoverd.Event)
+	s, err := client.Service(service).Watch(events)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	for event := range events {
+		if jsonOut {
+			if err := enc.Encode(event); err != nil {
+				return err
+			}
+			continue
+		}
+		line := fmt.Sprintf("%s %s %s", time.Now().Format(time.RFC3339), event.Service, event.Kind)
+		if event.Instance != nil {
+			line += fmt.Sprintf(" %s %s", event.Instance.ID, event.Instance.Addr)
+		}
+		fmt.Println(line)
+	}
+	return s.Err()
+}
+
+// runExport writes the cluster's export document to a file, or stdout if
+// no file is given.
+func runExport(client *discoverd.Client, args []string) error {
+	var export json.RawMessage
+	if err := client.Get("/cluster/export", &export); err != nil {
+		return err
+	}
+	out := os.Stdout
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, export, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := out.Write(buf.Bytes())
+	return err
+}
+
+// runImport replaces the cluster state with an export document read from a
+// file, or stdin if no file is given.
+func runImport(client *discoverd.Client, args []string) error {
+	in := io.Reader(os.Stdin)
+	if len(args) == 1 {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var export json.RawMessage
+	if err := json.NewDecoder(in).Decode(&export); err != nil {
+		return err
+	}
+	if err := client.Send("POST", "/cluster/import", export, nil); err != nil {
+		return err
+	}
+	fmt.Println("cluster state imported")
+	return nil
+}
+
+// runReplay reconstructs discovery state from a persisted event log and
+// prints it as JSON. It reads the log file directly and needs no server.
+func runReplay(path string, index uint64, at string) error {
+	if index != 0 && at != "" {
+		return fmt.Errorf("-index and -at are mutually exclusive")
+	}
+	var state *server.ReplayState
+	var err error
+	if at != "" {
+		t, perr := time.Parse(time.RFC3339, at)
+		if perr != nil {
+			return fmt.Errorf("invalid -at time: %q", at)
+		}
+		state, err = server.ReplayEventLogAt(path, t)
+	} else {
+		state, err = server.ReplayEventLog(path, index)
+	}
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", out)
+	return nil
+}
+
+func formatMeta(meta map[string]string) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(meta))
+	for k, v := range meta {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,151 @@
+// Package dialer provides a discovery-aware dialer and http.RoundTripper
+// that resolve service names to registered instances, so applications can
+// use standard net/http against discoverd-registered services.
+package dialer
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/balancer"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// ErrRequestNotRetryable is returned by the transport when a request fails
+// and its body cannot be replayed against another instance.
+var ErrRequestNotRetryable = errors.New("dialer: request body is not retryable")
+
+// DefaultMaxAttempts is the number of instances a transport tries before
+// giving up on a request.
+const DefaultMaxAttempts = 3
+
+// Dialer resolves addresses of the form "service-name" or
+// "service-name:port" to registered instances of the service, balancing
+// connections across them. The port, such as the default port added by
+// http.Transport, is ignored; connections use the registered instance
+// address.
+type Dialer struct {
+	client *discoverd.Client
+
+	// NewPicker returns the picker used for each service's balancer. Nil
+	// means round-robin. It must be set before the first Dial.
+	NewPicker func() balancer.Picker
+
+	mu        sync.Mutex
+	balancers map[string]*balancer.LoadBalancer
+	closed    bool
+}
+
+// New returns a dialer resolving service names via the given client.
+func New(c *discoverd.Client) *Dialer {
+	return &Dialer{
+		client:    c,
+		balancers: make(map[string]*balancer.LoadBalancer),
+	}
+}
+
+// Dial connects to an instance of the service named by addr. The network is
+// ignored; instances are dialed over TCP at their registered address.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	service := addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		service = host
+	}
+
+	lb, err := d.balancer(service)
+	if err != nil {
+		return nil, err
+	}
+	return lb.Dial()
+}
+
+// balancer returns the load balancer for a service, creating it on first
+// use.
+func (d *Dialer) balancer(service string) (*balancer.LoadBalancer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil, errors.New("dialer: closed")
+	}
+	if lb, ok := d.balancers[service]; ok {
+		return lb, nil
+	}
+
+	var picker balancer.Picker
+	if d.NewPicker != nil {
+		picker = d.NewPicker()
+	}
+	lb, err := balancer.New(d.client.Service(service), picker)
+	if err != nil {
+		return nil, err
+	}
+	d.balancers[service] = lb
+	return lb, nil
+}
+
+// Close stops watching all services dialed through the dialer.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	var err error
+	for service, lb := range d.balancers {
+		if e := lb.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(d.balancers, service)
+	}
+	return err
+}
+
+// Transport returns an http.RoundTripper that resolves request hosts as
+// service names through the dialer and retries a failed request against
+// another instance.
+func (d *Dialer) Transport() *Transport {
+	return &Transport{
+		rt:          &http.Transport{Dial: d.Dial},
+		MaxAttempts: DefaultMaxAttempts,
+	}
+}
+
+// Transport is an http.RoundTripper that retries a request against another
+// instance when no response was received, e.g. on connect failure. Requests
+// with a body are only retried when the body can be replayed via GetBody.
+type Transport struct {
+	rt http.RoundTripper
+
+	// MaxAttempts is the number of instances tried before giving up.
+	MaxAttempts int
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := t.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			// Rewind the body before retrying against another instance.
+			if req.Body != nil {
+				if req.GetBody == nil {
+					return nil, ErrRequestNotRetryable
+				}
+				body, e := req.GetBody()
+				if e != nil {
+					return nil, e
+				}
+				req.Body = body
+			}
+		}
+
+		var res *http.Response
+		if res, err = t.rt.RoundTrip(req); err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,330 @@
+// Package docker watches the local Docker daemon's events API and
+// registers labelled containers with discoverd, so containers not managed
+// by Flynn still appear in discovery.
+//
+// Containers opt in with labels:
+//
+//	discoverd.service      service to register with (required)
+//	discoverd.proto        instance proto (default "tcp")
+//	discoverd.port         container port to register (default the first
+//	                       exposed port)
+//	discoverd.meta.<key>   instance metadata
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// Container labels read by the watcher.
+const (
+	ServiceLabel    = "discoverd.service"
+	ProtoLabel      = "discoverd.proto"
+	PortLabel       = "discoverd.port"
+	MetaLabelPrefix = "discoverd.meta."
+)
+
+// DefaultEndpoint is the default Docker daemon socket.
+const DefaultEndpoint = "unix:///var/run/docker.sock"
+
+// Config configures a Watcher.
+type Config struct {
+	// Endpoint is the Docker daemon address, either a unix:// socket
+	// path or a tcp:// address. Empty means DefaultEndpoint.
+	Endpoint string
+
+	// HostIP is the address registered for container ports published to
+	// the host. Empty means the container's own IP is registered instead.
+	HostIP string
+}
+
+// Watcher registers labelled containers with discoverd, maintaining a
+// heartbeater per container until it stops.
+type Watcher struct {
+	client *discoverd.Client
+	conf   Config
+	http   *http.Client
+
+	// heartbeaters tracks registrations by container ID.
+	heartbeaters map[string]discoverd.Heartbeater
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWatcher returns a watcher registering containers from the configured
+// Docker daemon into the given client's cluster.
+func NewWatcher(client *discoverd.Client, conf Config) *Watcher {
+	if conf.Endpoint == "" {
+		conf.Endpoint = DefaultEndpoint
+	}
+	w := &Watcher{
+		client:       client,
+		conf:         conf,
+		heartbeaters: make(map[string]discoverd.Heartbeater),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	w.http = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := &net.Dialer{}
+			if path := strings.TrimPrefix(conf.Endpoint, "unix://"); path != conf.Endpoint {
+				return d.DialContext(ctx, "unix", path)
+			}
+			return d.DialContext(ctx, "tcp", strings.TrimPrefix(conf.Endpoint, "tcp://"))
+		},
+	}}
+	return w
+}
+
+// Start registers the currently running containers and then follows the
+// events API until the watcher is closed.
+func (w *Watcher) Start() error {
+	containers, err := w.listContainers()
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		w.register(c.ID)
+	}
+	go w.run()
+	return nil
+}
+
+// Close stops the watcher and deregisters the containers it registered.
+func (w *Watcher) Close() error {
+	close(w.stop)
+	<-w.done
+	for id, hb := range w.heartbeaters {
+		hb.Close()
+		delete(w.heartbeaters, id)
+	}
+	return nil
+}
+
+// run follows the events stream, reconnecting with a delay if the daemon
+// drops the connection.
+func (w *Watcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		if err := w.watchEvents(); err != nil {
+			w.client.Logger.Error("error watching docker events", "err", err)
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// watchEvents streams container events, registering on start and
+// deregistering on die.
+func (w *Watcher) watchEvents() error {
+	res, err := w.get("/events?filters=%7B%22type%22%3A%5B%22container%22%5D%7D")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// Close the stream when the watcher is stopped so the decode loop
+	// unblocks.
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-w.stop:
+			res.Body.Close()
+		case <-closed:
+		}
+	}()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var event dockerEvent
+		if err := dec.Decode(&event); err != nil {
+			select {
+			case <-w.stop:
+				return nil
+			default:
+				return err
+			}
+		}
+		switch event.Action {
+		case "start":
+			w.register(event.Actor.ID)
+		case "die":
+			w.deregister(event.Actor.ID)
+		}
+	}
+}
+
+// register inspects the container and registers it if it carries a service
+// label.
+func (w *Watcher) register(id string) {
+	container, err := w.inspectContainer(id)
+	if err != nil {
+		w.client.Logger.Error("error inspecting container", "id", id, "err", err)
+		return
+	}
+	service := container.Config.Labels[ServiceLabel]
+	if service == "" {
+		return
+	}
+	inst, err := w.containerInstance(container)
+	if err != nil {
+		w.client.Logger.Error("error registering container", "id", id, "service", service, "err", err)
+		return
+	}
+	hb, err := w.client.AddServiceAndRegisterInstance(service, inst)
+	if err != nil {
+		w.client.Logger.Error("error registering container", "id", id, "service", service, "err", err)
+		return
+	}
+	if prev, ok := w.heartbeaters[container.ID]; ok {
+		prev.Close()
+	}
+	w.heartbeaters[container.ID] = hb
+}
+
+// deregister closes the container's heartbeater, if any.
+func (w *Watcher) deregister(id string) {
+	if hb, ok := w.heartbeaters[id]; ok {
+		hb.Close()
+		delete(w.heartbeaters, id)
+	}
+}
+
+// containerInstance converts an inspected container to an instance with a
+// stable ID derived from the container ID.
+func (w *Watcher) containerInstance(container *dockerContainer) (*discoverd.Instance, error) {
+	port := container.Config.Labels[PortLabel]
+	if port == "" {
+		for exposed := range container.NetworkSettings.Ports {
+			p := strings.SplitN(exposed, "/", 2)[0]
+			if port == "" || p < port {
+				port = p
+			}
+		}
+	}
+	if port == "" {
+		return nil, fmt.Errorf("docker: container %s exposes no ports", container.ID[:12])
+	}
+
+	proto := container.Config.Labels[ProtoLabel]
+	if proto == "" {
+		proto = "tcp"
+	}
+
+	addr, err := w.containerAddr(container, port)
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &discoverd.Instance{
+		ID:    container.ID[:12],
+		Addr:  addr,
+		Proto: proto,
+		Meta:  map[string]string{"docker_container": container.ID[:12]},
+	}
+	for label, value := range container.Config.Labels {
+		if key := strings.TrimPrefix(label, MetaLabelPrefix); key != label {
+			inst.Meta[key] = value
+		}
+	}
+	return inst, nil
+}
+
+// containerAddr resolves the address to register for the given container
+// port, preferring a port published to the configured host IP.
+func (w *Watcher) containerAddr(container *dockerContainer, port string) (string, error) {
+	if w.conf.HostIP != "" {
+		for exposed, bindings := range container.NetworkSettings.Ports {
+			if strings.SplitN(exposed, "/", 2)[0] != port {
+				continue
+			}
+			for _, binding := range bindings {
+				if binding.HostPort != "" {
+					return net.JoinHostPort(w.conf.HostIP, binding.HostPort), nil
+				}
+			}
+		}
+	}
+	if container.NetworkSettings.IPAddress == "" {
+		return "", fmt.Errorf("docker: container %s has no IP address", container.ID[:12])
+	}
+	return net.JoinHostPort(container.NetworkSettings.IPAddress, port), nil
+}
+
+// listContainers lists running containers.
+func (w *Watcher) listContainers() ([]*dockerContainer, error) {
+	res, err := w.get("/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var containers []*dockerContainer
+	return containers, json.NewDecoder(res.Body).Decode(&containers)
+}
+
+// inspectContainer fetches a single container.
+func (w *Watcher) inspectContainer(id string) (*dockerContainer, error) {
+	res, err := w.get("/containers/" + id + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	container := &dockerContainer{}
+	return container, json.NewDecoder(res.Body).Decode(container)
+}
+
+func (w *Watcher) get(path string) (*http.Response, error) {
+	res, err := w.http.Get("http://docker" + path)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("docker: unexpected status from GET %s: %d", path, res.StatusCode)
+	}
+	return res, nil
+}
+
+// dockerContainer is the subset of the Docker container object consumed by
+// the watcher, covering both the list and inspect responses.
+type dockerContainer struct {
+	ID     string `json:"Id"`
+	Config struct {
+		Labels map[string]string
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Ports     map[string][]portBinding
+	}
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string
+}
+
+// dockerEvent is the subset of the Docker events API message consumed by
+// the watcher.
+type dockerEvent struct {
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os/exec"
+	"strings"
 	"time"
 )
 
@@ -18,6 +20,7 @@ type Check interface {
 
 var _ Check = &TCPCheck{}
 var _ Check = &HTTPCheck{}
+var _ Check = &ScriptCheck{}
 
 type TCPCheck struct {
 	Addr    string
@@ -113,3 +116,41 @@ func (c *HTTPCheck) Check() error {
 func (c *HTTPCheck) String() string {
 	return c.URL
 }
+
+type ScriptCheck struct {
+	// Command is the command to run with its arguments. A zero exit status
+	// means the check passed.
+	Command []string
+
+	Timeout time.Duration
+}
+
+func (c *ScriptCheck) Check() error {
+	if len(c.Command) == 0 {
+		return fmt.Errorf("healthcheck: script command must be set")
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	cmd := exec.Command(c.Command[0], c.Command[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("healthcheck: script timed out after %s", timeout)
+	}
+}
+
+func (c *ScriptCheck) String() string {
+	return "script: " + strings.Join(c.Command, " ")
+}
@@ -153,3 +153,22 @@ func (CheckSuite) TestHTTPInvalidURL(c *C) {
 	c.Assert(err, NotNil)
 	c.Assert(strings.Contains(err.Error(), "URL"), Equals, true, Commentf("err = %s", err))
 }
+
+func (CheckSuite) TestScriptSuccess(c *C) {
+	err := (&ScriptCheck{Command: []string{"true"}}).Check()
+	c.Assert(err, IsNil)
+}
+
+func (CheckSuite) TestScriptFailure(c *C) {
+	err := (&ScriptCheck{Command: []string{"false"}}).Check()
+	c.Assert(err, NotNil)
+}
+
+func (CheckSuite) TestScriptTimeout(c *C) {
+	err := (&ScriptCheck{
+		Command: []string{"sleep", "10"},
+		Timeout: 10 * time.Millisecond,
+	}).Check()
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "timed out"), Equals, true, Commentf("err = %s", err))
+}
@@ -127,6 +127,27 @@ func (h *heartbeater) SetMeta(meta map[string]string) error {
 	return h.hb.SetMeta(meta)
 }
 
+func (h *heartbeater) Drain() error {
+	h.Lock()
+	defer h.Unlock()
+	if h.hb == nil {
+		return nil
+	}
+	return h.hb.Drain()
+}
+
+func (h *heartbeater) CloseGracefully(delay time.Duration) error {
+	h.stream.Close()
+	h.Lock()
+	hb := h.hb
+	h.hb = nil
+	h.Unlock()
+	if hb != nil {
+		return hb.CloseGracefully(delay)
+	}
+	return nil
+}
+
 func (h *heartbeater) Close() error {
 	h.stream.Close()
 	h.Lock()
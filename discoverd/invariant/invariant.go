@@ -0,0 +1,146 @@
+// Package invariant validates discoverd event streams against the protocol
+// invariants the server is expected to uphold. It is used by our own tests
+// and can be embedded by downstream consumers to validate their handling of
+// watch streams.
+package invariant
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// Checker consumes events from a watch stream and asserts invariants:
+//
+//   - an "up" event is never sent for an instance that is already live
+//   - "update" and "down" events only refer to live instances
+//   - the leader is always among the live instances
+//   - instance and service meta indexes are monotonic
+//   - after the "current" sentinel, the snapshot is complete: a "down" never
+//     refers to an instance the snapshot didn't contain
+//
+// Check returns an error describing the first violated invariant for an
+// event, and all violations are retained for inspection via Violations.
+type Checker struct {
+	mu         sync.Mutex
+	services   map[string]*serviceState
+	violations []string
+}
+
+// serviceState tracks the live instances, leader and indexes for a service.
+type serviceState struct {
+	current   bool
+	live      map[string]*discoverd.Instance
+	lastIndex map[string]uint64
+	leader    string
+	metaIndex uint64
+}
+
+// NewChecker returns a checker with no observed state.
+func NewChecker() *Checker {
+	return &Checker{services: make(map[string]*serviceState)}
+}
+
+// Check validates event against the stream observed so far, then applies it.
+func (c *Checker) Check(event *discoverd.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := c.services[event.Service]
+	if state == nil {
+		state = &serviceState{
+			live:      make(map[string]*discoverd.Instance),
+			lastIndex: make(map[string]uint64),
+		}
+		c.services[event.Service] = state
+	}
+
+	switch event.Kind {
+	case discoverd.EventKindUp:
+		if event.Instance == nil {
+			return c.violate(event, "up event without instance")
+		}
+		inst := event.Instance
+		if _, ok := state.live[inst.ID]; ok {
+			return c.violate(event, "up event for live instance %s", inst.ID)
+		}
+		if last := state.lastIndex[inst.ID]; inst.Index < last {
+			return c.violate(event, "instance %s index decreased: %d < %d", inst.ID, inst.Index, last)
+		}
+		state.live[inst.ID] = inst
+		state.lastIndex[inst.ID] = inst.Index
+
+	case discoverd.EventKindUpdate:
+		if event.Instance == nil {
+			return c.violate(event, "update event without instance")
+		}
+		inst := event.Instance
+		if _, ok := state.live[inst.ID]; !ok {
+			return c.violate(event, "update event for unknown instance %s", inst.ID)
+		}
+		if last := state.lastIndex[inst.ID]; inst.Index < last {
+			return c.violate(event, "instance %s index decreased: %d < %d", inst.ID, inst.Index, last)
+		}
+		state.live[inst.ID] = inst
+		state.lastIndex[inst.ID] = inst.Index
+
+	case discoverd.EventKindDown:
+		if event.Instance == nil {
+			return c.violate(event, "down event without instance")
+		}
+		inst := event.Instance
+		if _, ok := state.live[inst.ID]; !ok {
+			if state.current {
+				return c.violate(event, "down event for instance %s missing from snapshot", inst.ID)
+			}
+			return c.violate(event, "down event for unknown instance %s", inst.ID)
+		}
+		delete(state.live, inst.ID)
+		if state.leader == inst.ID {
+			state.leader = ""
+		}
+
+	case discoverd.EventKindLeader:
+		if event.Instance == nil {
+			return c.violate(event, "leader event without instance")
+		}
+		inst := event.Instance
+		if _, ok := state.live[inst.ID]; !ok {
+			return c.violate(event, "leader %s is not a live instance", inst.ID)
+		}
+		state.leader = inst.ID
+
+	case discoverd.EventKindCurrent:
+		state.current = true
+
+	case discoverd.EventKindServiceMeta:
+		if event.ServiceMeta == nil {
+			return c.violate(event, "service meta event without meta")
+		}
+		if event.ServiceMeta.Index <= state.metaIndex {
+			return c.violate(event, "service meta index not monotonic: %d <= %d", event.ServiceMeta.Index, state.metaIndex)
+		}
+		state.metaIndex = event.ServiceMeta.Index
+
+	case discoverd.EventKindServiceDown:
+		delete(c.services, event.Service)
+	}
+
+	return nil
+}
+
+// Violations returns a description of every invariant violated so far.
+func (c *Checker) Violations() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	other := make([]string, len(c.violations))
+	copy(other, c.violations)
+	return other
+}
+
+func (c *Checker) violate(event *discoverd.Event, format string, args ...interface{}) error {
+	msg := fmt.Sprintf("%s: %s", event.Service, fmt.Sprintf(format, args...))
+	c.violations = append(c.violations, msg)
+	return fmt.Errorf("discoverd: invariant violated: %s", msg)
+}
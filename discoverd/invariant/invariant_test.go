@@ -0,0 +1,87 @@
+package invariant_test
+
+import (
+	"testing"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/invariant"
+)
+
+// Ensure a well-formed stream passes all invariants.
+func TestChecker(t *testing.T) {
+	c := invariant.NewChecker()
+	events := []*discoverd.Event{
+		{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+		{Service: "a", Kind: discoverd.EventKindCurrent},
+		{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst1", Index: 3}},
+		{Service: "a", Kind: discoverd.EventKindLeader, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+		{Service: "a", Kind: discoverd.EventKindUpdate, Instance: &discoverd.Instance{ID: "inst1", Index: 3}},
+		{Service: "a", Kind: discoverd.EventKindServiceMeta, ServiceMeta: &discoverd.ServiceMeta{Index: 4}},
+		{Service: "a", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+		{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 5}},
+	}
+	for i, event := range events {
+		if err := c.Check(event); err != nil {
+			t.Fatalf("unexpected error for event %d: %s", i, err)
+		}
+	}
+	if v := c.Violations(); len(v) != 0 {
+		t.Fatalf("unexpected violations: %v", v)
+	}
+}
+
+// Ensure invalid transitions are reported as violations.
+func TestChecker_Violations(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		events []*discoverd.Event
+	}{
+		{
+			name: "up for live instance",
+			events: []*discoverd.Event{
+				{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+				{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+			},
+		},
+		{
+			name: "down for unknown instance",
+			events: []*discoverd.Event{
+				{Service: "a", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+			},
+		},
+		{
+			name: "leader not live",
+			events: []*discoverd.Event{
+				{Service: "a", Kind: discoverd.EventKindLeader, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+			},
+		},
+		{
+			name: "instance index decreased",
+			events: []*discoverd.Event{
+				{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 5}},
+				{Service: "a", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 5}},
+				{Service: "a", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 2}},
+			},
+		},
+		{
+			name: "service meta index not monotonic",
+			events: []*discoverd.Event{
+				{Service: "a", Kind: discoverd.EventKindServiceMeta, ServiceMeta: &discoverd.ServiceMeta{Index: 4}},
+				{Service: "a", Kind: discoverd.EventKindServiceMeta, ServiceMeta: &discoverd.ServiceMeta{Index: 4}},
+			},
+		},
+	} {
+		c := invariant.NewChecker()
+		var err error
+		for _, event := range tt.events {
+			if err = c.Check(event); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: expected violation", tt.name)
+		} else if len(c.Violations()) != 1 {
+			t.Errorf("%s: unexpected violations: %v", tt.name, c.Violations())
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package kubernetes mirrors Kubernetes Endpoints into discoverd services,
+// so mixed Flynn/Kubernetes environments share one discovery namespace.
+// Endpoints in the Kubernetes namespace "prod" appear as services in the
+// discoverd namespace "prod", e.g. "prod/web".
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+// DefaultResyncInterval is the default interval between full listings of
+// the Kubernetes Endpoints API.
+const DefaultResyncInterval = 15 * time.Second
+
+// Config configures a Bridge.
+type Config struct {
+	// URL is the Kubernetes API server base URL.
+	URL string
+
+	// Token is a bearer token used to authenticate with the API server,
+	// e.g. a service account token.
+	Token string
+
+	// HTTPClient is used for API requests. Nil means http.DefaultClient,
+	// so in-cluster deployments should supply a client configured with the
+	// cluster CA.
+	HTTPClient *http.Client
+
+	// Namespaces restricts mirroring to the given Kubernetes namespaces.
+	// Empty means all namespaces.
+	Namespaces []string
+
+	// ResyncInterval is the interval between full listings. Zero means
+	// DefaultResyncInterval.
+	ResyncInterval time.Duration
+}
+
+// Bridge periodically lists Kubernetes Endpoints and mirrors them into
+// discoverd services. Mirrored instances are registered with a TTL of three
+// resync intervals, so they expire if the bridge stops. Mirroring is one
+// way; registrations made directly against discoverd are not written back
+// to Kubernetes.
+type Bridge struct {
+	client *discoverd.Client
+	conf   Config
+
+	// registered tracks the instances created by the bridge per service,
+	// so instances that vanish from Kubernetes are deregistered.
+	registered map[string]map[string]struct{}
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBridge returns a bridge mirroring Endpoints into the given client's
+// cluster.
+func NewBridge(client *discoverd.Client, conf Config) *Bridge {
+	if conf.HTTPClient == nil {
+		conf.HTTPClient = http.DefaultClient
+	}
+	if conf.ResyncInterval == 0 {
+		conf.ResyncInterval = DefaultResyncInterval
+	}
+	return &Bridge{
+		client:     client,
+		conf:       conf,
+		registered: make(map[string]map[string]struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start performs an initial sync and then resyncs on the configured
+// interval until the bridge is closed.
+func (b *Bridge) Start() error {
+	if err := b.sync(); err != nil {
+		return err
+	}
+	go b.run()
+	return nil
+}
+
+// Close stops the bridge. Mirrored instances are left registered and expire
+// via their TTLs.
+func (b *Bridge) Close() error {
+	close(b.stop)
+	<-b.done
+	return nil
+}
+
+func (b *Bridge) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.conf.ResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			if err := b.sync(); err != nil && b.client.Logger != nil {
+				b.client.Logger.Error("error syncing kubernetes endpoints", "err", err)
+			}
+		}
+	}
+}
+
+// sync lists Endpoints, registers their addresses and deregisters instances
+// that are no longer present.
+func (b *Bridge) sync() error {
+	endpoints, err := b.listEndpoints()
+	if err != nil {
+		return err
+	}
+
+	// Register the current endpoint addresses.
+	current := make(map[string]map[string]struct{})
+	ttl := int(3 * b.conf.ResyncInterval / time.Second)
+	for _, ep := range endpoints {
+		service := ep.Metadata.Namespace + "/" + ep.Metadata.Name
+		for _, subset := range ep.Subsets {
+			for _, port := range subset.Ports {
+				for _, addr := range subset.Addresses {
+					inst := mirrorInstance(&addr, &port, &ep.Metadata, ttl)
+					if err := b.register(service, inst); err != nil {
+						return err
+					}
+					if current[service] == nil {
+						current[service] = make(map[string]struct{})
+					}
+					current[service][inst.ID] = struct{}{}
+				}
+			}
+		}
+	}
+
+	// Deregister instances that vanished from Kubernetes.
+	for service, ids := range b.registered {
+		for id := range ids {
+			if _, ok := current[service][id]; ok {
+				continue
+			}
+			path := fmt.Sprintf("/services/%s/instances/%s", service, id)
+			if err := b.client.Delete(path); err != nil && !hh.IsObjectNotFoundError(err) {
+				return err
+			}
+		}
+	}
+	b.registered = current
+
+	return nil
+}
+
+// register creates the service if necessary and registers the instance.
+func (b *Bridge) register(service string, inst *discoverd.Instance) error {
+	if _, ok := b.registered[service]; !ok {
+		if err := b.client.AddService(service, nil); err != nil && !hh.IsObjectExistsError(err) {
+			return err
+		}
+	}
+	path := fmt.Sprintf("/services/%s/instances/%s", service, inst.ID)
+	return b.client.Put(path, inst, nil)
+}
+
+// mirrorInstance converts an endpoint address and port to an instance with
+// a stable ID and the Kubernetes object names mapped to meta keys.
+func mirrorInstance(addr *endpointAddress, port *endpointPort, meta *objectMeta, ttl int) *discoverd.Instance {
+	id := addr.TargetRef.Name
+	if id == "" {
+		id = strings.Replace(addr.IP, ".", "-", -1) + "-" + fmt.Sprint(port.Port)
+	}
+	inst := &discoverd.Instance{
+		ID:    id,
+		Addr:  fmt.Sprintf("%s:%d", addr.IP, port.Port),
+		Proto: strings.ToLower(port.Protocol),
+		TTL:   ttl,
+		Meta: map[string]string{
+			"kubernetes_namespace": meta.Namespace,
+			"kubernetes_name":      meta.Name,
+		},
+	}
+	if inst.Proto == "" {
+		inst.Proto = "tcp"
+	}
+	if addr.TargetRef.Name != "" {
+		inst.Meta["kubernetes_pod"] = addr.TargetRef.Name
+	}
+	if port.Name != "" {
+		inst.Meta["kubernetes_port_name"] = port.Name
+	}
+	return inst
+}
+
+// listEndpoints lists Endpoints for the configured namespaces.
+func (b *Bridge) listEndpoints() ([]endpoints, error) {
+	if len(b.conf.Namespaces) == 0 {
+		list, err := b.getEndpoints(b.conf.URL + "/api/v1/endpoints")
+		if err != nil {
+			return nil, err
+		}
+		return list.Items, nil
+	}
+
+	var items []endpoints
+	for _, ns := range b.conf.Namespaces {
+		list, err := b.getEndpoints(fmt.Sprintf("%s/api/v1/namespaces/%s/endpoints", b.conf.URL, ns))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+	}
+	return items, nil
+}
+
+func (b *Bridge) getEndpoints(url string) (*endpointsList, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.conf.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.conf.Token)
+	}
+	res, err := b.conf.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes: unexpected status listing endpoints: %d", res.StatusCode)
+	}
+	list := &endpointsList{}
+	if err := json.NewDecoder(res.Body).Decode(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// endpointsList is the subset of the Kubernetes EndpointsList object
+// consumed by the bridge.
+type endpointsList struct {
+	Items []endpoints `json:"items"`
+}
+
+type endpoints struct {
+	Metadata objectMeta       `json:"metadata"`
+	Subsets  []endpointSubset `json:"subsets"`
+}
+
+type objectMeta struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+type endpointSubset struct {
+	Addresses []endpointAddress `json:"addresses"`
+	Ports     []endpointPort    `json:"ports"`
+}
+
+type endpointAddress struct {
+	IP        string    `json:"ip"`
+	TargetRef objectRef `json:"targetRef"`
+}
+
+type objectRef struct {
+	Name string `json:"name"`
+}
+
+type endpointPort struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
@@ -0,0 +1,163 @@
+// Package lock implements distributed locks on top of discoverd leader
+// election.
+//
+// A lock is backed by a discoverd service whose leader is the current lock
+// holder. Acquiring registers an instance with the service and waits for it
+// to be elected leader, and the registration's heartbeats double as the TTL
+// renewal: if a holder crashes or is partitioned its instance expires and
+// leadership moves to the next waiter, so a lock can never be held by a dead
+// process forever.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// ServicePrefix is prepended to lock names to form the name of the discoverd
+// service backing the lock.
+const ServicePrefix = "lock-"
+
+var (
+	// ErrHeld is returned by Acquire if the lock is already held by this
+	// Lock instance.
+	ErrHeld = errors.New("lock: already held")
+
+	// ErrNotHeld is returned by Release if the lock is not held.
+	ErrNotHeld = errors.New("lock: not held")
+)
+
+// Lock is a distributed lock identified by a name. All processes using the
+// same name against the same cluster contend for the same lock.
+type Lock struct {
+	client  *discoverd.Client
+	service string
+
+	// addr identifies this holder within the lock service. Lock instances
+	// don't serve traffic, so it is a random placeholder address.
+	addr string
+
+	mu     sync.Mutex
+	hb     discoverd.Heartbeater
+	stream stream.Stream
+	token  uint64
+	lost   chan struct{}
+}
+
+// New returns a lock named name which will be coordinated through client.
+func New(client *discoverd.Client, name string) *Lock {
+	return &Lock{
+		client:  client,
+		service: ServicePrefix + name,
+		addr:    random.String(16) + ":1",
+	}
+}
+
+// Acquire blocks until the lock is held, and returns the fencing token
+// issued for the acquisition. The token increases monotonically with each
+// change of holder, so systems written to by lock holders can reject writes
+// carrying a stale token.
+//
+// The lock is held until Release is called, the Lost channel is closed, or
+// the process stops heartbeating and the registration expires.
+func (l *Lock) Acquire() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hb != nil {
+		return 0, ErrHeld
+	}
+
+	if err := l.client.AddService(l.service, nil); err != nil && !hh.IsObjectExistsError(err) {
+		return 0, err
+	}
+
+	// Watch for leader changes before registering so the election that
+	// follows our registration cannot be missed.
+	events := make(chan *discoverd.Event)
+	s, err := l.client.Service(l.service).Watch(events)
+	if err != nil {
+		return 0, err
+	}
+
+	hb, err := l.client.Register(l.service, l.addr)
+	if err != nil {
+		s.Close()
+		return 0, err
+	}
+
+	for event := range events {
+		if event.Kind != discoverd.EventKindLeader || event.Instance == nil {
+			continue
+		}
+		if event.Instance.Addr != l.addr {
+			continue
+		}
+		l.hb = hb
+		l.stream = s
+		l.token = event.LeaderToken
+		l.lost = make(chan struct{})
+		go l.watch(events, l.lost)
+		return l.token, nil
+	}
+
+	hb.Close()
+	s.Close()
+	return 0, fmt.Errorf("lock: event stream closed: %s", s.Err())
+}
+
+// Release releases the lock by deregistering the holder's instance.
+func (l *Lock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.hb == nil {
+		return ErrNotHeld
+	}
+	err := l.hb.Close()
+	l.stream.Close()
+	l.hb = nil
+	return err
+}
+
+// Token returns the fencing token from the most recent acquisition.
+func (l *Lock) Token() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.token
+}
+
+// Lost returns a channel which is closed if the lock is lost before Release
+// is called, for example because heartbeats stopped reaching the cluster and
+// the registration expired. It is only valid after a successful Acquire.
+func (l *Lock) Lost() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// watch consumes leader events while the lock is held. If leadership moves
+// to another instance, or the stream breaks and we can no longer tell, the
+// lock is treated as lost.
+func (l *Lock) watch(events chan *discoverd.Event, lost chan struct{}) {
+	for event := range events {
+		if event.Kind == discoverd.EventKindLeader && event.Instance != nil && event.Instance.Addr != l.addr {
+			break
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hb != nil {
+		l.hb.Close()
+		l.stream.Close()
+		l.hb = nil
+		close(lost)
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -15,8 +18,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/flynn/flynn/discoverd/agent"
 	"github.com/flynn/flynn/discoverd/client"
 	dd "github.com/flynn/flynn/discoverd/deployment"
+	"github.com/flynn/flynn/discoverd/docker"
 	"github.com/flynn/flynn/discoverd/server"
 	dt "github.com/flynn/flynn/discoverd/types"
 	"github.com/flynn/flynn/host/types"
@@ -53,14 +58,28 @@ type Main struct {
 	store      *server.Store
 	dnsServer  *server.DNSServer
 	httpServer *http.Server
+	webhooks   *server.WebhookDispatcher
+	fileSD     *server.FileSDExporter
 	ln         net.Listener
 	hb         discoverd.Heartbeater
+	selfReg    *server.SelfRegistrar
 	mux        *mux.Mux
 
 	advertiseAddr string
 	dataDir       string
+	auditLogPath  string
+	eventLogPath  string
+	fileSDPath    string
+	chaos         bool
+	acl           map[string][]string
+	tlsConfig     TLSOptions
+	tlsLn         net.Listener
+	unixSocket    string
+	unixLn        net.Listener
 	handler       *server.Handler
 	peers         []string
+	addrMapper    *server.AddrMapper
+	zone          string
 
 	logger *log.Logger
 
@@ -89,6 +108,49 @@ func (m *Main) Run(args ...string) error {
 		return err
 	}
 
+	// Relax instance protocol validation cluster-wide, if requested.
+	if opt.StructuredProtos {
+		discoverd.StructuredProtos = true
+	}
+
+	// Apply log level overrides.
+	for component, level := range opt.LogLevels {
+		if component == "" {
+			server.SetDefaultLogLevel(level)
+		} else {
+			server.SetLogLevel(component, level)
+		}
+	}
+
+	// Enable tracing, if requested.
+	if opt.Tracing {
+		server.EnableTracing()
+	}
+
+	// Configure NAT address mapping, if internal networks are given.
+	if len(opt.InternalCIDRs) > 0 {
+		mapper, err := server.NewAddrMapper(opt.InternalCIDRs)
+		if err != nil {
+			return fmt.Errorf("parse internal cidrs: %s", err)
+		}
+		m.addrMapper = mapper
+	}
+
+	// Record the node's zone for zone-aware DNS answers.
+	m.zone = opt.Zone
+
+	// If agent mode is requested, run as a local sidecar instead of a
+	// server. The agent only needs the peer list to reach the cluster.
+	if opt.Agent {
+		return m.runAgent(opt)
+	}
+
+	// If a primary is configured, run as a read-only replica that mirrors
+	// the primary's state and redirects writes to it.
+	if opt.ReplicaOf != "" {
+		return m.runReplica(opt)
+	}
+
 	// Set up advertised address and default peer set.
 	m.advertiseAddr = MergeHostPort(opt.Host, opt.Addr)
 	if len(opt.Peers) == 0 {
@@ -164,6 +226,13 @@ func (m *Main) Run(args ...string) error {
 	go m.mux.Serve()
 
 	m.dataDir = opt.DataDir
+	m.auditLogPath = opt.AuditLog
+	m.eventLogPath = opt.EventLog
+	m.fileSDPath = opt.PrometheusSD
+	m.acl = opt.ACL
+	m.tlsConfig = opt.TLS
+	m.unixSocket = opt.UnixSocket
+	m.chaos = opt.Chaos
 
 	// if the advertise addr is not in the peer list we are proxying
 	proxying := true
@@ -228,6 +297,16 @@ func (m *Main) Run(args ...string) error {
 		return fmt.Errorf("Failed to start HTTP server: %s", err)
 	}
 
+	// Announce registered services on the local network, if requested.
+	if opt.MDNS && m.store != nil {
+		announcer := server.NewMDNSAnnouncer(m.store)
+		if err := announcer.Start(); err != nil {
+			return fmt.Errorf("Failed to start mDNS announcer: %s", err)
+		}
+		m.logger.Println("discoverd announcing services via mDNS")
+		shutdown.BeforeExit(func() { announcer.Close() })
+	}
+
 	if deploy != nil {
 		if err := deploy.MarkDone(m.advertiseAddr); err != nil {
 			return err
@@ -250,20 +329,31 @@ func (m *Main) Run(args ...string) error {
 		httpAddr = net.JoinHostPort(os.Getenv("EXTERNAL_IP"), port)
 	}
 	m.Notify(opt.Notify, opt.DNSAddr)
-	go func() {
-		for {
-			hb, err := discoverd.AddServiceAndRegister("discoverd", httpAddr)
-			if err != nil {
-				m.logger.Println("failed to register service/instance, retrying in 5 seconds:", err)
-				time.Sleep(5 * time.Second)
-				continue
+	if m.store != nil {
+		// Register the discovery tier into its own state, so clients can
+		// find the other servers and fail over like any other service.
+		m.mu.Lock()
+		m.selfReg = server.NewSelfRegistrar(m.store)
+		m.selfReg.Start()
+		m.mu.Unlock()
+	} else {
+		// Proxies have no store; register through the cluster like a
+		// regular client.
+		go func() {
+			for {
+				hb, err := discoverd.AddServiceAndRegister("discoverd", httpAddr)
+				if err != nil {
+					m.logger.Println("failed to register service/instance, retrying in 5 seconds:", err)
+					time.Sleep(5 * time.Second)
+					continue
+				}
+				m.mu.Lock()
+				m.hb = hb
+				m.mu.Unlock()
+				break
 			}
-			m.mu.Lock()
-			m.hb = hb
-			m.mu.Unlock()
-			break
-		}
-	}()
+		}()
+	}
 	return nil
 }
 
@@ -327,6 +417,12 @@ func (m *Main) Promote() error {
 	m.handler.Store = m.store
 	m.handler.Proxy.Store(false)
 
+	// Start registering ourselves directly into the store.
+	if m.selfReg == nil {
+		m.selfReg = server.NewSelfRegistrar(m.store)
+		m.selfReg.Start()
+	}
+
 	m.logger.Println("promoted successfully")
 	return nil
 }
@@ -382,6 +478,13 @@ func (m *Main) Demote() error {
 		}
 	}
 
+	// Stop self-registration; the remaining raft leader deregisters us on
+	// its next sync.
+	if m.selfReg != nil {
+		m.selfReg.Close()
+		m.selfReg = nil
+	}
+
 	// Close the raft store.
 	if m.store != nil {
 		m.store.Close()
@@ -396,6 +499,12 @@ func (m *Main) Demote() error {
 func (m *Main) Deregister() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.selfReg != nil {
+		m.logger.Println("deregistering service")
+		m.selfReg.Close()
+		m.selfReg = nil
+		return nil
+	}
 	if m.hb != nil {
 		m.logger.Println("deregistering service")
 		return m.hb.Close()
@@ -420,6 +529,26 @@ func (m *Main) Close() (info dt.TargetLogIndex, err error) {
 		m.ln.Close()
 		m.ln = nil
 	}
+	if m.tlsLn != nil {
+		m.tlsLn.Close()
+		m.tlsLn = nil
+	}
+	if m.unixLn != nil {
+		m.unixLn.Close()
+		m.unixLn = nil
+	}
+	if m.webhooks != nil {
+		m.webhooks.Close()
+		m.webhooks = nil
+	}
+	if m.fileSD != nil {
+		m.fileSD.Close()
+		m.fileSD = nil
+	}
+	if m.selfReg != nil {
+		m.selfReg.Close()
+		m.selfReg = nil
+	}
 	if m.store != nil {
 		info.LastIndex, err = m.store.Close()
 		m.store = nil
@@ -427,6 +556,112 @@ func (m *Main) Close() (info dt.TargetLogIndex, err error) {
 	return info, err
 }
 
+// runAgent starts a local sidecar agent which caches the configured services
+// and exposes the query API, DNS and per-service proxies on loopback.
+func (m *Main) runAgent(opt Options) error {
+	os.Setenv("DISCOVERD", strings.Join(opt.Peers, ","))
+	discoverd.DefaultClient = discoverd.NewClient()
+
+	a := agent.NewAgent(discoverd.DefaultClient)
+	a.HTTPAddr = opt.Addr
+	a.DNSAddr = opt.DNSAddr
+	a.Services = opt.AgentServices
+	a.Proxies = opt.AgentProxies
+	a.Logger = m.logger
+	if err := a.Run(); err != nil {
+		return fmt.Errorf("Failed to start agent: %s", err)
+	}
+	m.logger.Printf("discoverd agent listening for HTTP on %s", opt.Addr)
+	if opt.DNSAddr != "" {
+		m.logger.Printf("discoverd agent listening for DNS on %s", opt.DNSAddr)
+	}
+	shutdown.BeforeExit(func() { a.Close() })
+
+	// If requested, watch the local docker daemon and register labelled
+	// containers.
+	if opt.Docker {
+		w := docker.NewWatcher(discoverd.DefaultClient, docker.Config{
+			Endpoint: opt.DockerEndpoint,
+			HostIP:   opt.DockerHostIP,
+		})
+		if err := w.Start(); err != nil {
+			return fmt.Errorf("Failed to start docker watcher: %s", err)
+		}
+		m.logger.Printf("discoverd agent watching docker events")
+		shutdown.BeforeExit(func() { w.Close() })
+	}
+	return nil
+}
+
+// runReplica runs the server as a read-only replica. A single-node local
+// store mirrors the primary's state over standby replication streams, so
+// reads, watches and DNS are served locally while writes are redirected to
+// the primary. If the primary disappears for longer than the fencing delay
+// the replica promotes itself and starts accepting writes.
+func (m *Main) runReplica(opt Options) error {
+	m.advertiseAddr = MergeHostPort(opt.Host, opt.Addr)
+
+	// Open listener.
+	ln, err := net.Listen("tcp4", opt.Addr)
+	if err != nil {
+		return err
+	}
+	m.ln = keepalive.Listener(ln)
+
+	// Open mux
+	m.mux = mux.New(m.ln)
+	go m.mux.Serve()
+
+	m.dataDir = opt.DataDir
+	m.auditLogPath = opt.AuditLog
+	m.eventLogPath = opt.EventLog
+	m.fileSDPath = opt.PrometheusSD
+	m.acl = opt.ACL
+	m.tlsConfig = opt.TLS
+	m.unixSocket = opt.UnixSocket
+	m.chaos = opt.Chaos
+
+	// The replica runs its own single-node store for the primary's state
+	// to be mirrored into. With no peers configured the store elects
+	// itself immediately.
+	if err := m.openStore(); err != nil {
+		return fmt.Errorf("Failed to open store: %s", err)
+	}
+	if err := m.waitForLeader(IndefiniteTimeout); err != nil {
+		return err
+	}
+
+	if opt.DNSAddr != "" {
+		if err := m.openDNSServer(opt.DNSAddr, opt.Recursors); err != nil {
+			return fmt.Errorf("Failed to start DNS server: %s", err)
+		}
+		m.logger.Printf("discoverd replica listening for DNS on %s", opt.DNSAddr)
+	}
+
+	if err := m.openHTTPServer(); err != nil {
+		return fmt.Errorf("Failed to start HTTP server: %s", err)
+	}
+
+	// Redirect writes to the primary until promoted.
+	primary := strings.TrimPrefix(strings.TrimPrefix(opt.ReplicaOf, "http://"), "https://")
+	m.handler.SetReadOnly(primary)
+
+	// Start mirroring the primary's state.
+	standby := server.NewStandby(discoverd.NewClientWithURL("http://" + primary))
+	standby.Store = m.store
+	standby.Logger = m.logger
+	standby.OnPromote = func() {
+		m.logger.Println("primary unreachable, promoting replica to primary")
+		m.handler.SetReadOnly("")
+	}
+	standby.Start()
+	shutdown.BeforeExit(func() { standby.Close() })
+
+	m.logger.Printf("discoverd replica of %s listening for HTTP on %s", primary, opt.Addr)
+	m.Notify(opt.Notify, opt.DNSAddr)
+	return nil
+}
+
 // openStore initializes and opens the store.
 func (m *Main) openStore() error {
 	// If the advertised address is not in the peer list then we should proxy.
@@ -448,6 +683,30 @@ func (m *Main) openStore() error {
 	// Allow single node if there's no peers set.
 	s.EnableSingleNode = len(m.peers) <= 1
 
+	// Open the audit log, if enabled.
+	if m.auditLogPath != "" {
+		auditLog, err := server.OpenAuditLog(m.auditLogPath)
+		if err != nil {
+			return err
+		}
+		s.AuditLog = auditLog
+	}
+
+	// Open the on-disk event log, if enabled.
+	if m.eventLogPath != "" {
+		eventLog, err := server.OpenEventLog(m.eventLogPath, s.EventLogSize)
+		if err != nil {
+			return err
+		}
+		s.EventLog = eventLog
+	}
+
+	// Inject controlled failures, if testing with chaos mode.
+	if m.chaos {
+		m.logger.Println("chaos mode enabled, injecting controlled failures")
+		s.Chaos = server.DefaultChaos()
+	}
+
 	// Open store.
 	if err := s.Open(); err != nil {
 		return err
@@ -468,9 +727,11 @@ func (m *Main) openStore() error {
 // The store must already be open.
 func (m *Main) openDNSServer(addr string, recursors []string) error {
 	s := &server.DNSServer{
-		UDPAddr:   addr,
-		TCPAddr:   addr,
-		Recursors: recursors,
+		UDPAddr:    addr,
+		TCPAddr:    addr,
+		Recursors:  recursors,
+		AddrMapper: m.addrMapper,
+		Zone:       m.zone,
 	}
 
 	// If store is available then attach it. Otherwise use a proxy.
@@ -493,11 +754,36 @@ func (m *Main) openHTTPServer() error {
 	h := server.NewHandler(false, m.peers)
 	h.Main = m
 	h.Peers = m.peers
+	h.AddrMapper = m.addrMapper
+
+	// Enforce write ACLs, if configured.
+	if len(m.acl) > 0 {
+		acl := server.NewACL()
+		for token, prefixes := range m.acl {
+			acl.Allow(token, prefixes...)
+		}
+		h.ACL = acl
+	}
 	// If we have no store then start the handler in proxy mode
 	if m.store == nil {
 		h.Proxy.Store(true)
 	} else {
 		h.Store = m.store
+
+		// Start delivering events to registered webhooks.
+		m.webhooks = server.NewWebhookDispatcher(m.store)
+		if err := m.webhooks.Start(); err != nil {
+			return err
+		}
+		h.Webhooks = m.webhooks
+
+		// Start writing Prometheus file_sd output, if configured.
+		if m.fileSDPath != "" {
+			m.fileSD = server.NewFileSDExporter(m.store, m.fileSDPath)
+			if err := m.fileSD.Start(); err != nil {
+				return err
+			}
+		}
 	}
 	m.handler = h
 	m.httpServer = &http.Server{Handler: h}
@@ -506,9 +792,57 @@ func (m *Main) openHTTPServer() error {
 	// HTTP listens to all methods: CONNECT, DELETE, GET, HEAD, OPTIONS, POST, PUT, TRACE.
 	httpLn := m.mux.Listen([]byte{'C', 'D', 'G', 'H', 'O', 'P', 'T'})
 	go m.httpServer.Serve(httpLn)
+
+	// Serve the same API over TLS on a separate listener, if configured.
+	if m.tlsConfig.Addr != "" {
+		ln, err := m.openTLSListener()
+		if err != nil {
+			return err
+		}
+		m.tlsLn = ln
+		go m.httpServer.Serve(ln)
+	}
+
+	// Serve the same API on a unix socket, if configured. Peer credentials
+	// authorize local writes without a token.
+	if m.unixSocket != "" {
+		ln, err := server.ListenUnix(m.unixSocket)
+		if err != nil {
+			return err
+		}
+		m.unixLn = ln
+		unixServer := &http.Server{Handler: h, ConnContext: server.UnixConnContext}
+		go unixServer.Serve(ln)
+	}
 	return nil
 }
 
+// openTLSListener opens the TLS API listener, optionally requiring verified
+// client certificates. Certificate common names are matched against the ACL
+// rules, so mutual TLS clients are authorized like token holders.
+func (m *Main) openTLSListener() (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(m.tlsConfig.Cert, m.tlsConfig.Key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if m.tlsConfig.ClientCA != "" {
+		pem, err := ioutil.ReadFile(m.tlsConfig.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client ca file %q", m.tlsConfig.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tls.Listen("tcp4", m.tlsConfig.Addr, config)
+}
+
 // Notify sends a POST to notifyURL to let it know that addr is accessible.
 func (m *Main) Notify(notifyURL, dnsAddr string) {
 	m.mu.Lock()
@@ -559,7 +893,7 @@ func (m *Main) waitForLeader(timeout time.Duration) error {
 // ParseFlags parses the command line flags.
 func (m *Main) ParseFlags(args ...string) (Options, error) {
 	var opt Options
-	var peers, recursors string
+	var peers, recursors, agentServices, agentProxies, acl, internalCIDRs, logLevels string
 
 	fs := flag.NewFlagSet("discoverd", flag.ContinueOnError)
 	fs.SetOutput(m.Stderr)
@@ -569,8 +903,31 @@ func (m *Main) ParseFlags(args ...string) (Options, error) {
 	fs.StringVar(&opt.Addr, "addr", ":1111", "address to serve http and raft from")
 	fs.StringVar(&opt.DNSAddr, "dns-addr", "", "address to service DNS from")
 	fs.StringVar(&recursors, "recursors", "", "upstream recursive DNS servers")
+	fs.StringVar(&opt.Zone, "zone", "", "zone this node runs in, same-zone instances are listed first in DNS answers")
 	fs.StringVar(&opt.Notify, "notify", "", "url to send webhook to after starting listener")
+	fs.StringVar(&opt.AuditLog, "audit-log", "", "path to an append-only audit log of service events")
+	fs.StringVar(&opt.EventLog, "event-log", "", "path to a compacted on-disk log of broadcast events")
+	fs.StringVar(&opt.PrometheusSD, "prometheus-sd", "", "path to write Prometheus file_sd targets to")
+	fs.StringVar(&acl, "acl", "", "write ACL rules as token=prefix1:prefix2 pairs, an empty prefix list matches all")
+	fs.StringVar(&opt.TLS.Addr, "tls-addr", "", "address to serve https from")
+	fs.StringVar(&opt.TLS.Cert, "tls-cert", "", "path to the TLS server certificate")
+	fs.StringVar(&opt.TLS.Key, "tls-key", "", "path to the TLS server key")
+	fs.StringVar(&opt.TLS.ClientCA, "tls-client-ca", "", "path to a CA bundle to verify client certificates against")
+	fs.StringVar(&opt.UnixSocket, "unix-socket", "", "unix socket path to additionally serve the http api on")
 	fs.BoolVar(&opt.WaitNetDNS, "wait-net-dns", false, "start DNS server after host network is configured")
+	fs.StringVar(&opt.ReplicaOf, "replica-of", "", "primary address to replicate from as a read-only replica")
+	fs.BoolVar(&opt.StructuredProtos, "structured-protos", false, "allow '+', '-' and '.' in instance protocols")
+	fs.StringVar(&internalCIDRs, "internal-cidrs", "", "internal network CIDRs, clients outside them get instance advertise addresses")
+	fs.BoolVar(&opt.MDNS, "mdns", false, "announce registered services via multicast DNS")
+	fs.BoolVar(&opt.Agent, "agent", false, "run as a local sidecar agent instead of a server")
+	fs.StringVar(&agentServices, "agent-services", "", "services for the agent to cache")
+	fs.StringVar(&agentProxies, "agent-proxies", "", "local proxy ports as service=addr pairs")
+	fs.BoolVar(&opt.Docker, "docker", false, "register labelled docker containers in agent mode")
+	fs.StringVar(&opt.DockerEndpoint, "docker-endpoint", "", "docker daemon address (default unix:///var/run/docker.sock)")
+	fs.StringVar(&opt.DockerHostIP, "docker-host-ip", "", "address to register for container ports published to the host")
+	fs.StringVar(&logLevels, "log-level", "", "minimum log level, a level name or component=level pairs")
+	fs.BoolVar(&opt.Tracing, "tracing", false, "collect opencensus trace spans for mutations and event delivery")
+	fs.BoolVar(&opt.Chaos, "chaos", false, "inject random broadcast delays, heartbeat drops and re-elections for testing")
 	if err := fs.Parse(args); err != nil {
 		return Options{}, err
 	}
@@ -585,6 +942,82 @@ func (m *Main) ParseFlags(args ...string) (Options, error) {
 		opt.Recursors = TrimSpaceSlice(strings.Split(recursors, ","))
 	}
 
+	// Split internal CIDRs into slice.
+	if internalCIDRs != "" {
+		opt.InternalCIDRs = TrimSpaceSlice(strings.Split(internalCIDRs, ","))
+	}
+
+	// Split ACL rules into a map of token to service name prefixes.
+	if acl != "" {
+		opt.ACL = make(map[string][]string)
+		for _, pair := range TrimSpaceSlice(strings.Split(acl, ",")) {
+			token, prefixes, ok := strings.Cut(pair, "=")
+			if !ok {
+				return opt, fmt.Errorf("invalid acl rule: %q", pair)
+			}
+			if prefixes == "" {
+				opt.ACL[token] = []string{""}
+			} else {
+				opt.ACL[token] = strings.Split(prefixes, ":")
+			}
+		}
+	}
+
+	// Split log levels into a map of component to level. A bare level name
+	// applies to every component without an explicit level.
+	if logLevels != "" {
+		opt.LogLevels = make(map[string]server.LogLevel)
+		for _, pair := range TrimSpaceSlice(strings.Split(logLevels, ",")) {
+			component, name, ok := strings.Cut(pair, "=")
+			if !ok {
+				component, name = "", pair
+			}
+			level, err := server.ParseLogLevel(name)
+			if err != nil {
+				return opt, fmt.Errorf("invalid log level: %q", pair)
+			}
+			opt.LogLevels[component] = level
+		}
+	}
+
+	// Validate TLS options.
+	if opt.TLS.Addr != "" && (opt.TLS.Cert == "" || opt.TLS.Key == "") {
+		return opt, errors.New("tls-cert and tls-key are required with tls-addr")
+	}
+
+	// Split agent services into slice and proxies into a map.
+	if agentServices != "" {
+		opt.AgentServices = TrimSpaceSlice(strings.Split(agentServices, ","))
+	}
+	if agentProxies != "" {
+		opt.AgentProxies = make(map[string]string)
+		for _, pair := range TrimSpaceSlice(strings.Split(agentProxies, ",")) {
+			service, addr, ok := strings.Cut(pair, "=")
+			if !ok {
+				return opt, fmt.Errorf("invalid agent proxy: %q", pair)
+			}
+			opt.AgentProxies[service] = addr
+		}
+	}
+
+	// Validate agent options. The agent needs the peer list to reach the
+	// cluster but has no data directory or advertised host.
+	if opt.Docker && !opt.Agent {
+		return opt, errors.New("docker requires agent mode")
+	}
+	if opt.Agent {
+		if len(opt.Peers) == 0 {
+			return opt, errors.New("peers required in agent mode")
+		}
+		return opt, nil
+	}
+
+	// Validate replica options. A replica follows a single primary rather
+	// than a raft peer set.
+	if opt.ReplicaOf != "" && len(opt.Peers) > 0 {
+		return opt, errors.New("peers cannot be combined with replica-of")
+	}
+
 	// Validate options.
 	if opt.DataDir == "" {
 		return opt, errors.New("data directory required")
@@ -603,8 +1036,48 @@ type Options struct {
 	Addr       string   // bind address (raft & http)
 	DNSAddr    string   // dns bind address
 	Recursors  []string // dns recursors
+	Zone       string   // zone this node runs in, for zone-aware DNS answers
 	Notify     string   // notify URL
 	WaitNetDNS bool     // wait for the network DNS
+	AuditLog   string   // audit log path
+	EventLog   string   // on-disk event log path
+
+	PrometheusSD string // prometheus file_sd output path
+
+	LogLevels map[string]server.LogLevel // minimum log level by component, "" is the default
+
+	Tracing bool // collect trace spans for mutations and event delivery
+
+	Chaos bool // inject controlled discovery failures for testing
+
+	ACL map[string][]string // write ACL rules, token to service name prefixes
+	TLS TLSOptions          // TLS listener configuration
+
+	UnixSocket string // unix socket path to additionally serve the API on
+
+	ReplicaOf string // primary address to replicate from as a read-only replica
+
+	StructuredProtos bool // allow '+', '-' and '.' in instance protocols
+
+	InternalCIDRs []string // internal networks for NAT address mapping
+
+	MDNS bool // announce registered services via multicast DNS
+
+	Agent         bool              // run as a local sidecar agent
+	AgentServices []string          // services for the agent to cache
+	AgentProxies  map[string]string // local proxy addresses by service
+
+	Docker         bool   // register labelled docker containers
+	DockerEndpoint string // docker daemon address
+	DockerHostIP   string // address for ports published to the host
+}
+
+// TLSOptions configures the optional TLS API listener.
+type TLSOptions struct {
+	Addr     string // TLS bind address, empty disables TLS
+	Cert     string // server certificate path
+	Key      string // server key path
+	ClientCA string // CA bundle for client certificate verification, empty disables mutual TLS
 }
 
 // TrimSpaceSlice returns a new slice of trimmed strings.
@@ -0,0 +1,112 @@
+// Package proxy provides a reverse proxy whose backend set is kept in sync
+// with a discoverd service subscription, so routers and gateways don't have
+// to re-implement instance selection.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// ErrNoBackends is returned to clients when the service has no instances
+// available to serve a request.
+var ErrNoBackends = errors.New("proxy: no backends available")
+
+// backendKey is the request context key holding the picked backend.
+type backendKey struct{}
+
+// Proxy is an http.Handler that forwards requests to instances of a
+// service, picking a backend round-robin per request and skipping instances
+// that are draining. With leader-only routing requests are only sent to the
+// current service leader, for services where only the leader accepts
+// writes.
+type Proxy struct {
+	cache      *cache.ServiceCache
+	leaderOnly bool
+
+	mu   sync.Mutex
+	next int
+
+	rp *httputil.ReverseProxy
+}
+
+// New returns a proxy forwarding requests to instances of s, watching the
+// service's event stream to keep the backend set current. If leaderOnly is
+// true requests are only forwarded to the service leader.
+func New(s discoverd.Service, leaderOnly bool) (*Proxy, error) {
+	c, err := cache.New(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{cache: c, leaderOnly: leaderOnly}
+	p.rp = &httputil.ReverseProxy{Director: p.director}
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inst := p.backend()
+	if inst == nil {
+		http.Error(w, ErrNoBackends.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	p.rp.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendKey{}, inst)))
+}
+
+// director points the request at the backend picked in ServeHTTP.
+func (p *Proxy) director(req *http.Request) {
+	inst := req.Context().Value(backendKey{}).(*discoverd.Instance)
+	req.URL.Scheme = "http"
+	req.URL.Host = inst.Addr
+}
+
+// backend picks the instance to forward the next request to, or nil if none
+// are available.
+func (p *Proxy) backend() *discoverd.Instance {
+	if p.leaderOnly {
+		if leaders := p.cache.Leader(); len(leaders) > 0 {
+			return leaders[0]
+		}
+		return nil
+	}
+
+	// Skip draining instances and sort by creation order so the rotation
+	// is stable across requests.
+	instances := p.cache.Instances()
+	filtered := instances[:0]
+	for _, inst := range instances {
+		if inst.State == discoverd.InstanceStateDraining {
+			continue
+		}
+		filtered = append(filtered, inst)
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+	sort.Sort(instanceIndexSlice(filtered))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	inst := filtered[p.next%len(filtered)]
+	p.next++
+	return inst
+}
+
+// Close stops watching the service.
+func (p *Proxy) Close() error {
+	return p.cache.Close()
+}
+
+// instanceIndexSlice represents a sortable list of instances by creation
+// order.
+type instanceIndexSlice []*discoverd.Instance
+
+func (a instanceIndexSlice) Len() int           { return len(a) }
+func (a instanceIndexSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a instanceIndexSlice) Less(i, j int) bool { return a[i].Index < a[j].Index }
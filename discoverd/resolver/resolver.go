@@ -0,0 +1,147 @@
+// Package resolver provides host and SRV lookups backed by the discoverd
+// client cache. The lookup methods match the signatures of net.Resolver, so
+// programs that resolve names through an interface can switch to service
+// discovery with no changes beyond construction.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// Resolver resolves discoverd service names to the addresses of their
+// registered instances. Each looked-up service is watched through a cache,
+// so repeated lookups are answered locally.
+type Resolver struct {
+	client *discoverd.Client
+
+	mu     sync.Mutex
+	caches map[string]*cache.ServiceCache
+	closed bool
+}
+
+// New returns a resolver resolving service names via the given client.
+func New(c *discoverd.Client) *Resolver {
+	return &Resolver{
+		client: c,
+		caches: make(map[string]*cache.ServiceCache),
+	}
+}
+
+// LookupHost resolves a service name to the hosts of its registered
+// instances. Like net.Resolver, it returns a *net.DNSError with IsNotFound
+// set when nothing is registered under the name.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	instances, err := r.instances(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(instances))
+	seen := make(map[string]struct{}, len(instances))
+	for _, inst := range instances {
+		h, _, err := net.SplitHostPort(inst.Addr)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[h]; ok {
+			continue
+		}
+		seen[h] = struct{}{}
+		addrs = append(addrs, h)
+	}
+	if len(addrs) == 0 {
+		return nil, dnsNotFound(host)
+	}
+	return addrs, nil
+}
+
+// LookupSRV resolves a service name to SRV records for its registered
+// instances, one per instance with its host, port and effective weight. A
+// non-empty service argument selects only instances registered with that
+// proto; the proto argument is ignored.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	instances, err := r.instances(ctx, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	srvs := make([]*net.SRV, 0, len(instances))
+	for _, inst := range instances {
+		if service != "" && inst.Proto != service {
+			continue
+		}
+		host, portStr, err := net.SplitHostPort(inst.Addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+		srvs = append(srvs, &net.SRV{
+			Target: host,
+			Port:   uint16(port),
+			Weight: inst.EffectiveWeight(),
+		})
+	}
+	if len(srvs) == 0 {
+		return "", nil, dnsNotFound(name)
+	}
+	return name, srvs, nil
+}
+
+// instances returns the current instances of a service from its cache,
+// creating the cache on first use.
+func (r *Resolver) instances(ctx context.Context, service string) ([]*discoverd.Instance, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errors.New("resolver: closed")
+	}
+	c, ok := r.caches[service]
+	if !ok {
+		var err error
+		c, err = cache.New(r.client.Service(service))
+		if err != nil {
+			return nil, err
+		}
+		r.caches[service] = c
+	}
+	return c.Instances(), nil
+}
+
+// dnsNotFound returns the error net.Resolver reports for names with no
+// records, so callers checking for net.DNSError see familiar behavior.
+func dnsNotFound(name string) *net.DNSError {
+	return &net.DNSError{
+		Err:        "no such host",
+		Name:       name,
+		IsNotFound: true,
+	}
+}
+
+// Close stops watching all services looked up through the resolver.
+func (r *Resolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	var err error
+	for service, c := range r.caches {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(r.caches, service)
+	}
+	return err
+}
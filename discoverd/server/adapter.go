@@ -0,0 +1,99 @@
+package server
+
+import (
+	"sync"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// adapterSubs is the subscription registry shared by the external-store
+// adapters (etcd, ZooKeeper). Unlike the raft store's sharded registry it
+// is a flat set under one lock: adapters translate a single upstream watch
+// stream, so fan-out never contends with the mutation path.
+type adapterSubs struct {
+	mu   sync.Mutex
+	subs map[*adapterSubscription]struct{}
+}
+
+func (a *adapterSubs) add(sub *adapterSubscription) {
+	a.mu.Lock()
+	if a.subs == nil {
+		a.subs = make(map[*adapterSubscription]struct{})
+	}
+	a.subs[sub] = struct{}{}
+	a.mu.Unlock()
+}
+
+func (a *adapterSubs) remove(sub *adapterSubscription) {
+	a.mu.Lock()
+	delete(a.subs, sub)
+	a.mu.Unlock()
+}
+
+// broadcast delivers an event to every registered subscription.
+func (a *adapterSubs) broadcast(event *discoverd.Event) {
+	a.mu.Lock()
+	subs := make([]*adapterSubscription, 0, len(a.subs))
+	for sub := range a.subs {
+		subs = append(subs, sub)
+	}
+	a.mu.Unlock()
+	for _, sub := range subs {
+		sub.deliver(event)
+	}
+}
+
+// closeAll closes every registered subscription.
+func (a *adapterSubs) closeAll() {
+	a.mu.Lock()
+	subs := make([]*adapterSubscription, 0, len(a.subs))
+	for sub := range a.subs {
+		subs = append(subs, sub)
+	}
+	a.mu.Unlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// adapterSubscription is a subscription fed by an adapter's watch stream.
+type adapterSubscription struct {
+	registry *adapterSubs
+	services map[string]bool // nil means all services
+	kinds    discoverd.EventKind
+	selector Selector
+	ch       chan *discoverd.Event
+	logger   Logger
+
+	closeOnce sync.Once
+	err       error
+}
+
+func (s *adapterSubscription) Close() error {
+	s.closeOnce.Do(func() {
+		s.registry.remove(s)
+		close(s.ch)
+	})
+	return nil
+}
+
+func (s *adapterSubscription) Err() error { return s.err }
+
+// deliver sends an event if the subscription wants it, dropping it if the
+// subscriber channel is full so the watch loop never blocks.
+func (s *adapterSubscription) deliver(event *discoverd.Event) {
+	if s.services != nil && !s.services[event.Service] {
+		return
+	}
+	if s.kinds&event.Kind == 0 {
+		return
+	}
+	if s.selector != nil && event.Instance != nil && !s.selector.Match(event.Instance) {
+		return
+	}
+	select {
+	case s.ch <- event:
+	default:
+		s.logger.Warn("dropping event for slow subscriber", "service", event.Service, "kind", event.Kind.String())
+	}
+}
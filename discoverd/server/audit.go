@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// AuditEntry is one record in the audit log.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Kind       string    `json:"kind"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	Addr       string    `json:"addr,omitempty"`
+	Origin     string    `json:"origin,omitempty"`
+}
+
+// AuditLog is an append-only JSON-lines log of instance lifecycle and
+// leadership events, so flapping services can be debugged after the fact
+// without ad-hoc client side logging.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	enc  *json.Encoder
+}
+
+// OpenAuditLog opens the audit log at path, creating it if necessary.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{path: path, f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Append writes an entry to the log.
+func (l *AuditLog) Append(entry *AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(entry)
+}
+
+// Query returns the logged entries for a service between from and to,
+// inclusive. A zero from or to leaves that end of the range unbounded.
+func (l *AuditLog) Query(service string, from, to time.Time) ([]*AuditEntry, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// Skip partial lines, such as a record cut short by a
+			// crash mid-write.
+			continue
+		}
+		if entry.Service != service {
+			continue
+		} else if !from.IsZero() && entry.Time.Before(from) {
+			continue
+		} else if !to.IsZero() && entry.Time.After(to) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Close closes the underlying file.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// auditKinds are the event kinds recorded in the audit log.
+const auditKinds = discoverd.EventKindUp | discoverd.EventKindUpdate | discoverd.EventKindDown | discoverd.EventKindLeader
+
+// audit records an event in the audit log, if one is configured.
+// Must be called under mutex.
+func (s *Store) audit(event *discoverd.Event) {
+	if s.AuditLog == nil || event.Kind&auditKinds == 0 {
+		return
+	}
+	entry := &AuditEntry{
+		Time:    time.Now().UTC(),
+		Service: event.Service,
+		Kind:    event.Kind.String(),
+		Origin:  event.Origin,
+	}
+	if event.Timestamp != 0 {
+		entry.Time = event.Time().UTC()
+	}
+	if event.Instance != nil {
+		entry.InstanceID = event.Instance.ID
+		entry.Addr = event.Instance.Addr
+	}
+	if err := s.AuditLog.Append(entry); err != nil {
+		logger.Error("error appending to audit log", "fn", "audit", "error", err)
+	}
+}
+
+// AuditQuery returns audit log entries for a service between from and to.
+func (s *Store) AuditQuery(service string, from, to time.Time) ([]*AuditEntry, error) {
+	if s.AuditLog == nil {
+		return nil, hh.PreconditionFailedErr("audit log is not enabled")
+	}
+	return s.AuditLog.Query(service, from, to)
+}
+
+// serveGetAudit returns audit log entries for a service, optionally bounded
+// by a from/to time range given in RFC 3339 format.
+func (h *Handler) serveGetAudit(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := r.FormValue("service")
+	if err := ValidServiceName(service); err != nil {
+		hh.ValidationError(w, "service", err.Error())
+		return
+	}
+
+	var from, to time.Time
+	if v := r.FormValue("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			hh.ValidationError(w, "from", err.Error())
+			return
+		}
+		from = t
+	}
+	if v := r.FormValue("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			hh.ValidationError(w, "to", err.Error())
+			return
+		}
+		to = t
+	}
+
+	entries, err := h.Store.AuditQuery(service, from, to)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, entries)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// Backend is the storage interface the API layers sit on top of: the HTTP
+// handler and the gRPC handler are written against it rather than the
+// concrete Store, so deployments can choose their consistency and durability
+// story without forking the server.
+//
+// The raft-backed Store is the canonical implementation. An alternative
+// backend (e.g. in-memory for tests, or one delegating to an external
+// coordination service) only needs to provide the same registration, lookup
+// and subscription semantics; see DNSStore for the narrower interface used
+// by the DNS server.
+type Backend interface {
+	Leader() string
+	ServiceNames() []string
+	AddService(service string, config *discoverd.ServiceConfig) error
+	RemoveService(service string) error
+	RemoveServiceAsync(service string) (string, error)
+	ServiceRemoval(id string) *ServiceRemoval
+	RenameService(service, newName string) error
+	RetireAlias(alias string) error
+	SetServiceFrozen(service string, frozen bool) error
+	SetServiceMeta(service string, meta *discoverd.ServiceMeta) error
+	ServiceMeta(service string) *discoverd.ServiceMeta
+	AddInstance(service string, inst *discoverd.Instance) error
+	AddInstances(regs []*discoverd.Registration) error
+	AddServiceInstances(service string, instances []*discoverd.Instance) error
+	Transact(ops []*TxOp) error
+	RemoveInstance(service, id string) error
+	Drain(service, id string) error
+	SetMaintenance(service, id string, maintenance bool) error
+	Instances(service string) ([]*discoverd.Instance, error)
+	InstancesFiltered(service string, selector Selector) ([]*discoverd.Instance, error)
+	GetWithIndex(service string, selector Selector) ([]*discoverd.Instance, uint64, error)
+	ServiceState(service string) *ServiceState
+	History(service string) []*InstanceDeparture
+	Config(service string) *discoverd.ServiceConfig
+	SetServiceConfig(service string, config *discoverd.ServiceConfig) error
+	SetServiceLeader(service, id string) error
+	FailoverServiceLeader(service, id string) error
+	ServiceLeader(service string) (*discoverd.Instance, error)
+	ProtoLeader(service, proto string) (*discoverd.Instance, error)
+	Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
+	SubscribeFiltered(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector) stream.Stream
+	SubscribePriority(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) stream.Stream
+	SubscribeClient(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) (stream.Stream, error)
+	SubscribeSince(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error)
+	Stats() map[string]ServiceStats
+	Subscribers() []SubscriberStats
+	AuditQuery(service string, from, to time.Time) ([]*AuditEntry, error)
+	EventStats() map[string]map[string]EventKindStats
+	EvictionStats() map[string]uint64
+	ServiceDigests() map[string]uint64
+	Dependencies() map[string][]string
+	MissingDependencies() map[string][]string
+	Export() *ClusterExport
+	Import(export *ClusterExport) error
+
+	// Peer management. Backends without a replication cluster of their own
+	// can implement these as no-ops.
+	AddPeer(peer string) error
+	RemovePeer(peer string) error
+	GetPeers() ([]string, error)
+	LastIndex() uint64
+	WriteConsistency() WriteConsistency
+}
+
+var _ Backend = (*Store)(nil)
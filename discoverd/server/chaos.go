@@ -0,0 +1,80 @@
+package server
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Chaos injects controlled discovery instability so integration tests can
+// verify that consumers handle real-world churn: broadcast deliveries are
+// randomly delayed, heartbeats randomly dropped and service leaderships
+// periodically failed over. It is opt-in behind the server's -chaos flag and
+// must never be enabled in production.
+type Chaos struct {
+	// BroadcastDelayMax bounds the random delay injected before delivering
+	// a broadcast job to subscribers. Zero disables delays.
+	BroadcastDelayMax time.Duration
+
+	// HeartbeatDropRate is the fraction of heartbeats discarded, between 0
+	// and 1, simulating lost packets so instances flap through expiry and
+	// re-registration. Zero disables drops.
+	HeartbeatDropRate float64
+
+	// ElectionInterval is how often the leadership of one randomly chosen
+	// service is failed over. Zero disables forced re-elections.
+	ElectionInterval time.Duration
+}
+
+// DefaultChaos returns the chaos settings enabled by the -chaos flag.
+func DefaultChaos() *Chaos {
+	return &Chaos{
+		BroadcastDelayMax: 100 * time.Millisecond,
+		HeartbeatDropRate: 0.1,
+		ElectionInterval:  30 * time.Second,
+	}
+}
+
+// delayBroadcast sleeps for a random duration up to BroadcastDelayMax.
+func (c *Chaos) delayBroadcast() {
+	if c.BroadcastDelayMax <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(c.BroadcastDelayMax))))
+}
+
+// dropHeartbeat reports whether the current heartbeat should be discarded.
+func (c *Chaos) dropHeartbeat() bool {
+	return c.HeartbeatDropRate > 0 && rand.Float64() < c.HeartbeatDropRate
+}
+
+// chaosLoop periodically forces a leader re-election on a random service.
+func (s *Store) chaosLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.Chaos.ElectionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.chaosElection()
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// chaosElection fails over the leadership of one randomly chosen service.
+// Errors are ignored; a service without a promotable instance is left alone.
+func (s *Store) chaosElection() {
+	if !s.IsLeader() {
+		return
+	}
+	names := s.ServiceNames()
+	if len(names) == 0 {
+		return
+	}
+	service := names[rand.Intn(len(names))]
+	logger.Info("chaos: forcing leader re-election", "fn", "chaosElection", "service", service)
+	s.FailoverServiceLeader(service, "")
+}
@@ -0,0 +1,80 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure chaos mode periodically forces service leader re-elections.
+func TestStore_Chaos_Election(t *testing.T) {
+	s := NewStore()
+	s.Chaos = &server.Chaos{ElectionInterval: 50 * time.Millisecond}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.MustWaitForLeader()
+
+	// Register two instances; the oldest becomes leader.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for chaos to fail leadership over to the other instance.
+	ch := make(chan *discoverd.Event, 16)
+	s.Subscribe("service0", true, discoverd.EventKindLeader, ch)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if e.Instance != nil && e.Instance.ID == "inst1" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for forced re-election")
+		}
+	}
+}
+
+// Ensure chaos mode discards heartbeats, expiring instances as if their
+// renewal packets were lost.
+func TestStore_Chaos_DropHeartbeat(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 100 * time.Millisecond // low TTL
+	s.Chaos = &server.Chaos{HeartbeatDropRate: 1.0}
+	defer s.Close()
+
+	// Add service & instance.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Renew the instance; the heartbeats report success but are discarded.
+	for i := 0; i < 4; i++ {
+		if err := s.Heartbeat("service0", "inst0"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(s.InstanceTTL / 2)
+	}
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the instance expired despite the renewals.
+	if e := unstamp(<-ch); e.Kind != discoverd.EventKindDown || e.Reason != discoverd.DownReasonExpired {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
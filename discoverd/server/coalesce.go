@@ -0,0 +1,145 @@
+package server
+
+import (
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// coalesceEvents forwards events from in to out, buffering them for the
+// given window once the initial state has been delivered: if several events
+// arrive for the same instance within a window only the latest one is
+// forwarded, so subscribers that rebuild configuration don't see every
+// intermediate flap. Buffered events are flushed in arrival order. The
+// initial state and its "current" marker are forwarded immediately. Returns
+// when in is closed, closing out.
+func coalesceEvents(in, out chan *discoverd.Event, window time.Duration) {
+	pending := make(map[string]*discoverd.Event)
+	var order []string
+	var timer *time.Timer
+	var fire <-chan time.Time
+
+	flush := func() {
+		for _, key := range order {
+			out <- pending[key]
+			delete(pending, key)
+		}
+		order = order[:0]
+	}
+
+	// Forward the initial state unbuffered.
+	live := false
+
+	for {
+		select {
+		case event, ok := <-in:
+			if !ok {
+				flush()
+				close(out)
+				return
+			}
+			if !live {
+				out <- event
+				if event.Kind == discoverd.EventKindCurrent {
+					live = true
+				}
+				continue
+			}
+
+			key := coalesceKey(event)
+			if _, ok := pending[key]; !ok {
+				order = append(order, key)
+			}
+			pending[key] = event
+
+			if fire == nil {
+				if timer == nil {
+					timer = time.NewTimer(window)
+				} else {
+					timer.Reset(window)
+				}
+				fire = timer.C
+			}
+		case <-fire:
+			fire = nil
+			flush()
+		}
+	}
+}
+
+// coalesceKey returns the key events are coalesced under: the instance for
+// instance events, so a later event supersedes an earlier one for the same
+// instance, and the event kind otherwise.
+func coalesceKey(event *discoverd.Event) string {
+	if event.Instance != nil {
+		return event.Service + "\x00" + event.Instance.ID
+	}
+	return event.Service + "\x00\x00" + event.Kind.String()
+}
+
+// digestEvents forwards the initial state from in to out and then replaces
+// individual events with a periodic full-state digest: whenever events
+// arrive within an interval, a single "batch" event carrying an "up" event
+// per current instance is emitted at the end of it. Subscribers always see
+// the complete instance set rather than increments. Returns when in is
+// closed, closing out.
+func digestEvents(in, out chan *discoverd.Event, interval time.Duration, service string, snapshot func() ([]*discoverd.Instance, error)) {
+	var timer *time.Timer
+	var fire <-chan time.Time
+
+	flush := func() {
+		instances, err := snapshot()
+		if err != nil {
+			return
+		}
+		event := &discoverd.Event{
+			Service: service,
+			Kind:    discoverd.EventKindBatch,
+			Batch:   make([]*discoverd.Event, len(instances)),
+		}
+		for i, inst := range instances {
+			event.Batch[i] = &discoverd.Event{
+				Service:  service,
+				Kind:     discoverd.EventKindUp,
+				Instance: inst,
+			}
+		}
+		out <- event
+	}
+
+	// Forward the initial state unbuffered.
+	live := false
+
+	for {
+		select {
+		case event, ok := <-in:
+			if !ok {
+				if fire != nil {
+					flush()
+				}
+				close(out)
+				return
+			}
+			if !live {
+				out <- event
+				if event.Kind == discoverd.EventKindCurrent {
+					live = true
+				}
+				continue
+			}
+
+			// Any event just marks the state dirty.
+			if fire == nil {
+				if timer == nil {
+					timer = time.NewTimer(interval)
+				} else {
+					timer.Reset(interval)
+				}
+				fire = timer.C
+			}
+		case <-fire:
+			fire = nil
+			flush()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Streaming watches on a large cluster move substantial JSON volume: every
+// instance flap and meta update is re-encoded to every router. Clients that
+// advertise gzip support in their Accept-Encoding header get the event
+// stream compressed transparently; the Go HTTP client does this by default,
+// so existing consumers benefit without changes. The stream stays
+// interactive because the compressor is flushed after every event.
+
+// negotiateCompression wraps a response writer with gzip compression when
+// the request advertises support for it. The returned close function
+// flushes the compressed trailer and must be called once streaming ends.
+func negotiateCompression(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if !acceptsGzip(r) {
+		return w, func() {}
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	return &gzipResponseWriter{ResponseWriter: w, gz: gz}, func() { gz.Close() }
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding header lists
+// gzip with a non-zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if strings.TrimSpace(param) == "q=0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter compresses everything written to a response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+// Flush pushes buffered data through the compressor and down the wire, so
+// each event still reaches the subscriber immediately.
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify forwards the client-gone signal so a compressed stream still
+// stops when the subscriber disconnects. Writers without the signal, such
+// as test recorders, fall back to a channel that never fires.
+func (w *gzipResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
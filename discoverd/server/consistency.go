@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+)
+
+// WriteConsistency is the replication level a registration write asks for.
+// Writes always go through the raft log, which replicates them to a quorum
+// of peers before acknowledging, so the requested level is a floor: "one"
+// and "quorum" are both satisfied by the commit, while "all" is only
+// achieved when the quorum spans every peer.
+type WriteConsistency string
+
+const (
+	// ConsistencyOne is satisfied once the cluster leader accepts the
+	// write.
+	ConsistencyOne WriteConsistency = "one"
+
+	// ConsistencyQuorum is satisfied once a majority of peers hold the
+	// write. This is the default, and what a raft commit guarantees.
+	ConsistencyQuorum WriteConsistency = "quorum"
+
+	// ConsistencyAll is satisfied once every peer holds the write.
+	ConsistencyAll WriteConsistency = "all"
+)
+
+// ParseWriteConsistency parses a consistency level by name. An empty name
+// selects the default quorum level.
+func ParseWriteConsistency(name string) (WriteConsistency, error) {
+	switch c := WriteConsistency(name); c {
+	case "":
+		return ConsistencyQuorum, nil
+	case ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return c, nil
+	}
+	return "", fmt.Errorf("discoverd: invalid write consistency %q", name)
+}
+
+// WriteConsistency reports the replication level guaranteed for an
+// acknowledged write: quorum, or all when the commit quorum spans every
+// peer, as in one- and two-node clusters.
+func (s *Store) WriteConsistency() WriteConsistency {
+	peers, err := s.GetPeers()
+	if err != nil {
+		return ConsistencyQuorum
+	}
+	if n := len(peers); n <= 1 || n/2+1 == n {
+		return ConsistencyAll
+	}
+	return ConsistencyQuorum
+}
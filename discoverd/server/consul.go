@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// consulNode is the node name reported by the Consul compatibility API.
+// discoverd has no node concept, so every instance is reported against a
+// single synthetic node.
+const consulNode = "discoverd"
+
+// consulCatalogService is a Consul catalog service entry. Instance meta is
+// mapped to service meta and the protos registered for the service are
+// exposed as tags.
+type consulCatalogService struct {
+	Node           string            `json:"Node"`
+	Address        string            `json:"Address"`
+	ServiceID      string            `json:"ServiceID"`
+	ServiceName    string            `json:"ServiceName"`
+	ServiceAddress string            `json:"ServiceAddress"`
+	ServicePort    int               `json:"ServicePort"`
+	ServiceTags    []string          `json:"ServiceTags"`
+	ServiceMeta    map[string]string `json:"ServiceMeta"`
+	CreateIndex    uint64            `json:"CreateIndex"`
+	ModifyIndex    uint64            `json:"ModifyIndex"`
+}
+
+// consulHealthEntry is a Consul health API entry. Registered instances are
+// passing; draining instances are reported as warning so ?passing filters
+// them out of rotation.
+type consulHealthEntry struct {
+	Node    consulNodeInfo     `json:"Node"`
+	Service consulServiceInfo  `json:"Service"`
+	Checks  []*consulCheckInfo `json:"Checks"`
+}
+
+type consulNodeInfo struct {
+	Node    string `json:"Node"`
+	Address string `json:"Address"`
+}
+
+type consulServiceInfo struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags"`
+	Meta    map[string]string `json:"Meta"`
+}
+
+type consulCheckInfo struct {
+	CheckID     string `json:"CheckID"`
+	Name        string `json:"Name"`
+	Status      string `json:"Status"`
+	ServiceID   string `json:"ServiceID"`
+	ServiceName string `json:"ServiceName"`
+}
+
+// serveConsulCatalogServices implements GET /v1/catalog/services, listing
+// service names with their protos as tags.
+func (h *Handler) serveConsulCatalogServices(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	services := make(map[string][]string)
+	for _, name := range h.Store.ServiceNames() {
+		instances, err := h.Store.Instances(name)
+		if err != nil {
+			hh.Error(w, err)
+			return
+		}
+		services[name] = consulTags(instances)
+	}
+	h.setConsulIndex(w)
+	hh.JSON(w, 200, services)
+}
+
+// serveConsulCatalogService implements GET /v1/catalog/service/:service.
+// Unknown services return an empty list, matching Consul.
+func (h *Handler) serveConsulCatalogService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := params.ByName("service")
+	instances, err := h.Store.Instances(service)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	tags := consulTags(instances)
+
+	entries := make([]*consulCatalogService, 0, len(instances))
+	for _, inst := range instances {
+		host, port := consulHostPort(inst.Addr)
+		entries = append(entries, &consulCatalogService{
+			Node:           consulNode,
+			Address:        host,
+			ServiceID:      inst.ID,
+			ServiceName:    service,
+			ServiceAddress: host,
+			ServicePort:    port,
+			ServiceTags:    tags,
+			ServiceMeta:    consulMeta(inst),
+			CreateIndex:    inst.Index,
+			ModifyIndex:    inst.Index,
+		})
+	}
+	h.setConsulIndex(w)
+	hh.JSON(w, 200, entries)
+}
+
+// serveConsulHealthService implements GET /v1/health/service/:service,
+// including the ?passing filter used by consul-template and fabio. Blocking
+// queries are not supported; the ?index parameter is ignored, so watchers
+// degrade to polling.
+func (h *Handler) serveConsulHealthService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := params.ByName("service")
+	instances, err := h.Store.Instances(service)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	tags := consulTags(instances)
+	_, passing := r.URL.Query()["passing"]
+
+	entries := make([]*consulHealthEntry, 0, len(instances))
+	for _, inst := range instances {
+		status := "passing"
+		if inst.State == discoverd.InstanceStateDraining {
+			status = "warning"
+		}
+		if passing && status != "passing" {
+			continue
+		}
+		host, port := consulHostPort(inst.Addr)
+		entries = append(entries, &consulHealthEntry{
+			Node: consulNodeInfo{Node: consulNode, Address: host},
+			Service: consulServiceInfo{
+				ID:      inst.ID,
+				Service: service,
+				Address: host,
+				Port:    port,
+				Tags:    tags,
+				Meta:    consulMeta(inst),
+			},
+			Checks: []*consulCheckInfo{{
+				CheckID:     "service:" + inst.ID,
+				Name:        "Service '" + service + "' check",
+				Status:      status,
+				ServiceID:   inst.ID,
+				ServiceName: service,
+			}},
+		})
+	}
+	h.setConsulIndex(w)
+	hh.JSON(w, 200, entries)
+}
+
+// setConsulIndex sets the X-Consul-Index header expected by Consul clients.
+func (h *Handler) setConsulIndex(w http.ResponseWriter) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(h.Store.LastIndex(), 10))
+}
+
+// consulTags returns the sorted set of protos registered by the given
+// instances.
+func consulTags(instances []*discoverd.Instance) []string {
+	tags := make([]string, 0, 1)
+	for _, inst := range instances {
+		if inst.Proto == "" || containsString(tags, inst.Proto) {
+			continue
+		}
+		tags = append(tags, inst.Proto)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// consulMeta returns the instance meta, never nil so it serializes as an
+// object.
+func consulMeta(inst *discoverd.Instance) map[string]string {
+	if inst.Meta == nil {
+		return map[string]string{}
+	}
+	return inst.Meta
+}
+
+// consulHostPort splits an instance address into host and numeric port.
+func consulHostPort(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"sort"
+	"strings"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Instances declare the services they depend on with the "depends" meta key,
+// a comma-separated list of service names. The store aggregates the
+// declarations into a dependency graph, exposes it over the HTTP API, and
+// warns dependent services with a "dependency_down" event when a dependency
+// loses its last healthy instance.
+
+// MetaKeyDepends is the instance meta key listing the services an instance
+// depends on.
+const MetaKeyDepends = "depends"
+
+// dependencyKinds are the event kinds that can change a service's healthy
+// instance count and therefore trigger a dependency check.
+const dependencyKinds = discoverd.EventKindUp | discoverd.EventKindDown |
+	discoverd.EventKindHealthy | discoverd.EventKindUnhealthy |
+	discoverd.EventKindDraining | discoverd.EventKindMaintenance |
+	discoverd.EventKindServiceDown
+
+// instanceDepends parses the dependencies declared by an instance.
+func instanceDepends(inst *discoverd.Instance) []string {
+	if inst.Meta == nil || inst.Meta[MetaKeyDepends] == "" {
+		return nil
+	}
+	var deps []string
+	for _, dep := range strings.Split(inst.Meta[MetaKeyDepends], ",") {
+		if dep = strings.TrimSpace(dep); dep != "" {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// dependencyGraph builds the dependency graph from a snapshot: each service
+// that declares dependencies mapped to the sorted union of the dependencies
+// declared by its instances.
+func dependencyGraph(data *raftData) map[string][]string {
+	graph := make(map[string][]string)
+	for service, instances := range data.Instances {
+		set := make(map[string]struct{})
+		for _, inst := range instances {
+			for _, dep := range instanceDepends(inst) {
+				set[dep] = struct{}{}
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		deps := make([]string, 0, len(set))
+		for dep := range set {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		graph[service] = deps
+	}
+	return graph
+}
+
+// healthyCount returns the number of instances of a service that are in
+// rotation and passing their health check.
+func healthyCount(data *raftData, service string) int {
+	service = data.resolve(service)
+	n := 0
+	for id, inst := range data.Instances[service] {
+		if data.Unhealthy[service][id] || outOfRotation(inst) {
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// Dependencies returns the service dependency graph.
+func (s *Store) Dependencies() map[string][]string {
+	return dependencyGraph(s.readData())
+}
+
+// MissingDependencies returns, for each service declaring dependencies, the
+// subset that currently has no healthy instances.
+func (s *Store) MissingDependencies() map[string][]string {
+	data := s.readData()
+	missing := make(map[string][]string)
+	for service, deps := range dependencyGraph(data) {
+		for _, dep := range deps {
+			if healthyCount(data, dep) == 0 {
+				missing[service] = append(missing[service], dep)
+			}
+		}
+	}
+	return missing
+}
+
+// invalidateDependencies broadcasts a dependency_down warning to the
+// services depending on the named service once it has lost its last healthy
+// instance. The warning is rearmed when the service regains one.
+// Must be called under mutex.
+func (s *Store) invalidateDependencies(service string) {
+	if healthyCount(s.data, service) > 0 {
+		delete(s.depWarned, service)
+		return
+	}
+	if s.depWarned[service] {
+		return
+	}
+	if s.depWarned == nil {
+		s.depWarned = make(map[string]bool)
+	}
+	s.depWarned[service] = true
+
+	for dependent, instances := range s.data.Instances {
+	declared:
+		for _, inst := range instances {
+			for _, dep := range instanceDepends(inst) {
+				if dep == service {
+					s.broadcastService(&discoverd.Event{
+						Service:    dependent,
+						Kind:       discoverd.EventKindDependencyDown,
+						Dependency: service,
+					})
+					break declared
+				}
+			}
+		}
+	}
+}
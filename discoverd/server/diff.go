@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sort"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Diff returns the ordered list of events that would transform snapshot a
+// into snapshot b: removed services first, then per retained or added
+// service its instance changes, metadata change and leader change. The
+// order is deterministic — services and instances are visited in sorted
+// order — so replication and import tooling can compare or replay diffs
+// without reimplementing the state comparison.
+func Diff(a, b *ClusterExport) []*discoverd.Event {
+	return diffData(exportData(a), exportData(b))
+}
+
+// diffData computes the events transforming old into new. It is the diff
+// the store broadcasts when restoring a state dump.
+func diffData(old, data *raftData) []*discoverd.Event {
+	var events []*discoverd.Event
+
+	// Emit "down" and "service down" events for removed services.
+	for _, service := range sortedServices(old.Services) {
+		if _, ok := data.Services[service]; ok {
+			continue
+		}
+		for _, id := range sortedInstances(old.Instances[service]) {
+			events = append(events, &discoverd.Event{
+				Service:  service,
+				Kind:     discoverd.EventKindDown,
+				Instance: old.Instances[service][id],
+				Reason:   discoverd.DownReasonServiceRemoved,
+			})
+		}
+		events = append(events, &discoverd.Event{
+			Service: service,
+			Kind:    discoverd.EventKindServiceDown,
+		})
+	}
+
+	// Emit the diff for retained and added services.
+	for _, service := range sortedServices(data.Services) {
+		// Emit a "service up" event for added services.
+		if _, ok := old.Services[service]; !ok {
+			events = append(events, &discoverd.Event{
+				Service: service,
+				Kind:    discoverd.EventKindServiceUp,
+			})
+		}
+		oldInsts := old.Instances[service]
+		for _, id := range sortedInstances(oldInsts) {
+			if m := data.Instances[service]; m == nil || m[id] == nil {
+				events = append(events, &discoverd.Event{
+					Service:  service,
+					Kind:     discoverd.EventKindDown,
+					Instance: oldInsts[id],
+					Reason:   discoverd.DownReasonDeregistered,
+				})
+			}
+		}
+		for _, id := range sortedInstances(data.Instances[service]) {
+			inst := data.Instances[service][id]
+			if prev := oldInsts[id]; prev == nil || !inst.Equal(prev) {
+				events = append(events, &discoverd.Event{
+					Service:  service,
+					Kind:     discoverd.EventKindUp,
+					Instance: inst,
+				})
+			}
+		}
+		if meta := data.Metas[service]; meta != nil {
+			if prev := old.Metas[service]; prev == nil || prev.Index != meta.Index {
+				events = append(events, &discoverd.Event{
+					Service:     service,
+					Kind:        discoverd.EventKindServiceMeta,
+					ServiceMeta: meta,
+				})
+			}
+		}
+		if old.Leaders[service] != data.Leaders[service] {
+			var inst *discoverd.Instance
+			if m := data.Instances[service]; m != nil {
+				inst = m[data.Leaders[service]]
+			}
+			events = append(events, &discoverd.Event{
+				Service:     service,
+				Kind:        discoverd.EventKindLeader,
+				Instance:    inst,
+				LeaderToken: data.LeaderTokens[service],
+			})
+		}
+	}
+	return events
+}
+
+func sortedServices(services map[string]*discoverd.ServiceConfig) []string {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedInstances(instances map[string]*discoverd.Instance) []string {
+	ids := make([]string, 0, len(instances))
+	for id := range instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
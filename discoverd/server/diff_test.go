@@ -0,0 +1,51 @@
+package server_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure Diff produces the ordered events transforming one snapshot into
+// another: removed services first, then per-service instance, meta and
+// leader changes.
+func TestDiff(t *testing.T) {
+	inst0 := &discoverd.Instance{ID: "inst0", Addr: "localhost:1000", Index: 1}
+	inst1 := &discoverd.Instance{ID: "inst1", Addr: "localhost:1001", Index: 2}
+	meta := &discoverd.ServiceMeta{Data: json.RawMessage(`{"foo":"bar"}`), Index: 9}
+
+	a := &server.ClusterExport{
+		Version: server.ClusterExportVersion,
+		Services: []*server.ServiceExport{
+			{Name: "old", Instances: []*discoverd.Instance{inst0}},
+			{Name: "web", LeaderID: "inst0", Instances: []*discoverd.Instance{inst0}},
+		},
+	}
+	b := &server.ClusterExport{
+		Version: server.ClusterExportVersion,
+		Services: []*server.ServiceExport{
+			{Name: "web", Meta: meta, LeaderID: "inst1", Instances: []*discoverd.Instance{inst1}},
+		},
+	}
+
+	events := server.Diff(a, b)
+	expected := []*discoverd.Event{
+		{Service: "old", Kind: discoverd.EventKindDown, Instance: inst0, Reason: discoverd.DownReasonServiceRemoved},
+		{Service: "old", Kind: discoverd.EventKindServiceDown},
+		{Service: "web", Kind: discoverd.EventKindDown, Instance: inst0, Reason: discoverd.DownReasonDeregistered},
+		{Service: "web", Kind: discoverd.EventKindUp, Instance: inst1},
+		{Service: "web", Kind: discoverd.EventKindServiceMeta, ServiceMeta: meta},
+		{Service: "web", Kind: discoverd.EventKindLeader, Instance: inst1},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("unexpected events: %#v", events)
+	}
+
+	// Identical snapshots produce no events.
+	if events := server.Diff(b, b); len(events) != 0 {
+		t.Fatalf("unexpected events: %#v", events)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ServiceDigests returns a hash of each service's registered state: its
+// configuration, instance set (IDs, addresses, lifecycle state and health),
+// leader assignment and metadata index.
+//
+// Replication between servers goes through raft, so replicas that have
+// applied the same log index always converge; the digests give operators and
+// monitoring tools a cheap way to verify that across nodes (compare digests
+// at the same LastIndex) without transferring full service payloads.
+func (s *Store) ServiceDigests() map[string]uint64 {
+	d := s.readData()
+
+	digests := make(map[string]uint64, len(d.Services))
+	for service := range d.Services {
+		digests[service] = serviceDigest(d, service)
+	}
+	return digests
+}
+
+// serviceDigest hashes one service's state within a state snapshot.
+func serviceDigest(d *raftData, service string) uint64 {
+	h := fnv.New64a()
+
+	// Hash the configuration.
+	if config := d.Services[service]; config != nil {
+		if buf, err := json.Marshal(config); err == nil {
+			h.Write(buf)
+		}
+	}
+	h.Write([]byte{0})
+
+	// Hash the instance set in a stable order.
+	ids := make([]string, 0, len(d.Instances[service]))
+	for id := range d.Instances[service] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		inst := d.Instances[service][id]
+		h.Write([]byte(inst.ID))
+		h.Write([]byte{0})
+		h.Write([]byte(inst.Addr))
+		h.Write([]byte{0})
+		h.Write([]byte(inst.State))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.FormatUint(inst.Index, 10)))
+		h.Write([]byte{0})
+		if d.Unhealthy[service][id] {
+			h.Write([]byte("unhealthy"))
+		}
+		h.Write([]byte{0})
+	}
+
+	// Hash the leader assignment and metadata index.
+	h.Write([]byte(d.Leaders[service]))
+	h.Write([]byte{0})
+	if meta := d.Metas[service]; meta != nil {
+		h.Write([]byte(strconv.FormatUint(meta.Index, 10)))
+	}
+
+	return h.Sum64()
+}
+
+// digestsEqual reports whether two state snapshots cover the same services
+// and hash identically for each of them.
+func digestsEqual(a, b *raftData) bool {
+	if len(a.Services) != len(b.Services) {
+		return false
+	}
+	for service := range a.Services {
+		if _, ok := b.Services[service]; !ok {
+			return false
+		}
+		if serviceDigest(a, service) != serviceDigest(b, service) {
+			return false
+		}
+	}
+	return true
+}
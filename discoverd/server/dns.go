@@ -6,6 +6,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -21,14 +22,42 @@ type DNSStore interface {
 	ServiceLeader(service string) (*discoverd.Instance, error)
 }
 
+// DNSConfigStore is implemented by stores that expose service configs. The
+// DNS server uses it to look up per-service response policies; stores without
+// it answer every service with the default shuffle.
+type DNSConfigStore interface {
+	Config(service string) *discoverd.ServiceConfig
+}
+
+// DNSServer answers SRV and A queries for service names (e.g.
+// "web.discoverd") directly from a DNSStore, so legacy applications that only
+// speak DNS can consume service discovery without the client library.
+// Queries outside the discoverd domain are forwarded to the recursors.
 type DNSServer struct {
 	UDPAddr   string
 	TCPAddr   string
 	Domain    string
 	Recursors []string
 
+	// RecursorCacheSize is the number of recursive responses to cache.
+	// If zero a default size is used.
+	RecursorCacheSize int
+
+	// AddrMapper rewrites instance addresses for clients outside the
+	// internal networks. Nil disables address mapping.
+	AddrMapper *AddrMapper
+
+	// Zone is the zone this server runs in. If set, answers list instances
+	// in the same zone first so DNS clients that use the first record keep
+	// traffic local. Empty disables zone ordering.
+	Zone string
+
 	store   atomic.Value // *DNSStore
+	cache   *dnsCache
 	servers []*dns.Server
+
+	mtx       sync.Mutex
+	rrOffsets map[string]int // per-service round-robin rotation offsets
 }
 
 func (srv *DNSServer) GetStore() DNSStore {
@@ -57,6 +86,7 @@ func (srv *DNSServer) ListenAndServe() error {
 	mux := dns.NewServeMux()
 	mux.HandleFunc(srv.Domain, api.ServiceLookup)
 	if len(srv.Recursors) > 0 {
+		srv.cache = newDNSCache(srv.RecursorCacheSize)
 		mux.HandleFunc(".", api.Recurse)
 	}
 
@@ -148,12 +178,22 @@ func (d dnsAPI) Recurse(w dns.ResponseWriter, req *dns.Msg) {
 		client.Net = "tcp"
 	}
 
+	// Serve from the cache if we have an unexpired response.
+	q := req.Question[0]
+	if res := d.cache.Get(q); res != nil {
+		res.Id = req.Id
+		res.Compress = true
+		w.WriteMsg(res)
+		return
+	}
+
 	for _, recursor := range d.Recursors {
 		req.Compress = true
 		res, _, err := client.Exchange(req, recursor)
 		if err != nil {
 			continue
 		}
+		d.cache.Set(q, res)
 		res.Compress = true
 		w.WriteMsg(res)
 		return
@@ -217,6 +257,17 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	var policy discoverd.DNSPolicy
+	if cs, ok := d.GetStore().(DNSConfigStore); ok {
+		if config := cs.Config(service); config != nil {
+			policy = config.DNSPolicy
+		}
+	}
+	if policy == discoverd.DNSPolicyLeader && instanceID == "" {
+		// Answer only with the leader, reusing the single-instance path.
+		leader = true
+	}
+
 	var instances []*discoverd.Instance
 	if !leader {
 		a, err := d.GetStore().Instances(service)
@@ -228,6 +279,9 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 			nxdomain()
 			return
 		}
+		if d.AddrMapper != nil {
+			a = d.AddrMapper.MapAll(a, w.RemoteAddr().String())
+		}
 		instances = a
 	}
 
@@ -241,6 +295,9 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 				nxdomain()
 				return
 			}
+			if d.AddrMapper != nil {
+				sl = d.AddrMapper.Map(sl, w.RemoteAddr().String())
+			}
 			resInst = sl
 		} else {
 			for _, inst := range instances {
@@ -307,7 +364,19 @@ func (d dnsAPI) ServiceLookup(w dns.ResponseWriter, req *dns.Msg) {
 		// return empty response
 		return
 	}
-	shuffle(addrs)
+	switch policy {
+	case discoverd.DNSPolicyRoundRobin:
+		d.rotate(service, addrs)
+	case discoverd.DNSPolicyWeighted:
+		weightedOrder(addrs)
+	default:
+		shuffle(addrs)
+	}
+	if d.Zone != "" {
+		// List same-zone instances first, keeping the policy's order
+		// within each group.
+		zoneOrder(addrs, d.Zone)
+	}
 
 	// Truncate the response if we're using UDP
 	if !tcp && len(addrs) > maxUDPRecords {
@@ -358,8 +427,8 @@ func (d dnsAPI) srvRecord(name, service string, addr *addrData, instTarget bool)
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
 		},
-		Priority: 1,
-		Weight:   1,
+		Priority: addr.Priority,
+		Weight:   addr.Weight,
 		Port:     addr.Port,
 		Target:   name,
 	}
@@ -395,15 +464,23 @@ func addrRecord(name string, addr *addrData) dns.RR {
 }
 
 type addrData struct {
-	IPv6   net.IP
-	IPv4   net.IP
-	String string
-	Port   uint16
-	ID     string
+	IPv6     net.IP
+	IPv4     net.IP
+	String   string
+	Port     uint16
+	ID       string
+	Priority uint16
+	Weight   uint16
+	Zone     string
 }
 
 func parseAddr(inst *discoverd.Instance) *addrData {
-	res := &addrData{ID: inst.ID}
+	res := &addrData{
+		ID:       inst.ID,
+		Priority: metaUint16(inst.Meta, "priority", 1),
+		Weight:   inst.EffectiveWeight(),
+		Zone:     inst.EffectiveZone(),
+	}
 	ip, port, _ := net.SplitHostPort(inst.Addr)
 	res.String = ip
 	portInt, _ := strconv.Atoi(port)
@@ -416,6 +493,85 @@ func parseAddr(inst *discoverd.Instance) *addrData {
 	return res
 }
 
+// metaUint16 parses the named instance meta key as a uint16, returning def if
+// the key is missing or invalid.
+func metaUint16(meta map[string]string, key string, def uint16) uint16 {
+	s, ok := meta[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return def
+	}
+	return uint16(n)
+}
+
+// rotate shifts addrs by the service's rotation offset, advancing the offset
+// so successive queries start from successive instances.
+func (srv *DNSServer) rotate(service string, addrs []*addrData) {
+	srv.mtx.Lock()
+	if srv.rrOffsets == nil {
+		srv.rrOffsets = make(map[string]int)
+	}
+	offset := srv.rrOffsets[service]
+	srv.rrOffsets[service] = offset + 1
+	srv.mtx.Unlock()
+
+	if len(addrs) < 2 {
+		return
+	}
+	if offset %= len(addrs); offset == 0 {
+		return
+	}
+	rotated := make([]*addrData, 0, len(addrs))
+	rotated = append(rotated, addrs[offset:]...)
+	rotated = append(rotated, addrs[:offset]...)
+	copy(addrs, rotated)
+}
+
+// weightedOrder orders addrs by repeated weighted random draws on the SRV
+// weight, so heavier instances are listed first more often. A zero weight
+// counts as one so the instance still appears.
+func weightedOrder(s []*addrData) []*addrData {
+	weight := func(addr *addrData) int {
+		if addr.Weight == 0 {
+			return 1
+		}
+		return int(addr.Weight)
+	}
+	for i := 0; i < len(s)-1; i++ {
+		total := 0
+		for _, addr := range s[i:] {
+			total += weight(addr)
+		}
+		n := random.Math.Intn(total)
+		for j := i; j < len(s); j++ {
+			if n -= weight(s[j]); n < 0 {
+				s[i], s[j] = s[j], s[i]
+				break
+			}
+		}
+	}
+	return s
+}
+
+// zoneOrder moves addrs in the given zone ahead of the rest, preserving the
+// existing order within each group.
+func zoneOrder(s []*addrData, zone string) []*addrData {
+	same := make([]*addrData, 0, len(s))
+	other := make([]*addrData, 0, len(s))
+	for _, addr := range s {
+		if addr.Zone == zone {
+			same = append(same, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+	copy(s, append(same, other...))
+	return s
+}
+
 func shuffle(s []*addrData) []*addrData {
 	for i := len(s) - 1; i > 0; i-- {
 		j := random.Math.Intn(i + 1)
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultDNSCacheSize is the number of recursive responses to cache.
+	defaultDNSCacheSize = 1024
+
+	// negativeCacheTTL is the length of time to cache NXDOMAIN and empty
+	// responses from upstream recursors.
+	negativeCacheTTL = 30 * time.Second
+
+	// maxCacheTTL caps how long a recursive response may be cached,
+	// regardless of the TTLs it contains.
+	maxCacheTTL = 10 * time.Minute
+)
+
+// dnsCacheKey identifies a cached response by question name and type.
+type dnsCacheKey struct {
+	name  string
+	qtype uint16
+}
+
+// dnsCacheEntry is a cached response and the time it expires.
+type dnsCacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// dnsCache caches responses from upstream recursors so repeated lookups for
+// public names don't require a network round-trip. Successful responses are
+// cached for the minimum TTL of their records, and NXDOMAIN or empty
+// responses are cached for a short negative TTL.
+type dnsCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+	now func() time.Time
+}
+
+// newDNSCache returns a cache holding up to size responses.
+func newDNSCache(size int) *dnsCache {
+	if size <= 0 {
+		size = defaultDNSCacheSize
+	}
+	lru, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		panic(err) // only possible if size <= 0
+	}
+	return &dnsCache{lru: lru, now: time.Now}
+}
+
+// Get returns a copy of the cached response for the question, or nil if there
+// is no unexpired entry. Record TTLs are decremented by the time the entry has
+// spent in the cache.
+func (c *dnsCache) Get(q dns.Question) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := dnsCacheKey{name: q.Name, qtype: q.Qtype}
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil
+	}
+	entry := v.(*dnsCacheEntry)
+	if c.now().After(entry.expires) {
+		c.lru.Remove(key)
+		return nil
+	}
+
+	res := entry.msg.Copy()
+	elapsed := uint32(c.now().Sub(entry.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Ttl > elapsed {
+				hdr.Ttl -= elapsed
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return res
+}
+
+// Set caches the response to the question. The entry expires after the
+// minimum TTL of the answer records, or after negativeCacheTTL if the
+// response is NXDOMAIN or has no answers.
+func (c *dnsCache) Set(q dns.Question, msg *dns.Msg) {
+	// Don't cache server failures, they are likely transient.
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	ttl := negativeCacheTTL
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		min := uint32(maxCacheTTL / time.Second)
+		for _, rr := range msg.Answer {
+			if t := rr.Header().Ttl; t < min {
+				min = t
+			}
+		}
+		ttl = time.Duration(min) * time.Second
+		if ttl == 0 {
+			return // uncacheable
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.lru.Add(dnsCacheKey{name: q.Name, qtype: q.Qtype}, &dnsCacheEntry{
+		msg:     msg.Copy(),
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+}
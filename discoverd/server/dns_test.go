@@ -168,6 +168,71 @@ func (s *DNSSuite) TestRecursor(c *C) {
 	}
 }
 
+func (s *DNSSuite) TestRecursorCache(c *C) {
+	var requests int32
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&requests, 1)
+		res := &dns.Msg{}
+		res.SetReply(req)
+		switch req.Question[0].Name {
+		case "cached.example.com.":
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{192, 168, 0, 1},
+			})
+		default:
+			res.SetRcode(req, dns.RcodeNameError)
+		}
+		w.WriteMsg(res)
+	})
+	up := make(chan struct{}, 1)
+	udpListener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	upstream := &dns.Server{
+		Net:               "udp",
+		PacketConn:        udpListener,
+		Handler:           h,
+		NotifyStartedFunc: func() { up <- struct{}{} },
+	}
+	go upstream.ActivateAndServe()
+	defer upstream.Shutdown()
+	select {
+	case <-up:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for server to start")
+	}
+
+	srv := s.newServer(c, []string{udpListener.(*net.UDPConn).LocalAddr().String()})
+	defer func() { c.Assert(srv.Close(), IsNil) }()
+	client := &dns.Client{ReadTimeout: 10 * time.Second}
+
+	// Repeated lookups should be answered from the cache.
+	msg := &dns.Msg{}
+	msg.SetQuestion("cached.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		res, _, err := client.Exchange(msg, srv.UDPAddr)
+		c.Assert(err, IsNil)
+		c.Assert(res.Rcode, Equals, dns.RcodeSuccess)
+		c.Assert(res.Answer, HasLen, 1)
+	}
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+
+	// NXDOMAIN responses should be negatively cached.
+	msg = &dns.Msg{}
+	msg.SetQuestion("missing.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		res, _, err := client.Exchange(msg, srv.UDPAddr)
+		c.Assert(err, IsNil)
+		c.Assert(res.Rcode, Equals, dns.RcodeNameError)
+	}
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+}
+
 func (s *DNSSuite) TestServiceLookup(c *C) {
 	type test struct {
 		name   string
@@ -636,6 +701,166 @@ func (s *DNSSuite) TestServiceLookup(c *C) {
 	}
 }
 
+func (s *DNSSuite) TestSRVPriorityWeight(c *C) {
+	inst, _ := fakeStaticInstance("tcp", "192.168.0.1", 80)
+	inst.Meta = map[string]string{"priority": "10", "weight": "200"}
+
+	srv := s.newServer(c, nil)
+	defer srv.Close()
+	srv.SetStore(&DNSServerStore{
+		InstancesFn: func(service string) ([]*discoverd.Instance, error) {
+			return []*discoverd.Instance{inst}, nil
+		},
+		ServiceLeaderFn: func(service string) (*discoverd.Instance, error) {
+			return inst, nil
+		},
+	})
+
+	client := &dns.Client{}
+	req := &dns.Msg{}
+	req.SetQuestion("a.discoverd.", dns.TypeSRV)
+	res, _, err := client.Exchange(req, srv.UDPAddr)
+	c.Assert(err, IsNil)
+	c.Assert(res.Answer, HasLen, 1)
+	record := res.Answer[0].(*dns.SRV)
+	c.Assert(record.Priority, Equals, uint16(10))
+	c.Assert(record.Weight, Equals, uint16(200))
+}
+
+func (s *DNSSuite) TestDNSPolicyLeader(c *C) {
+	inst1, _ := fakeStaticInstance("tcp", "192.168.0.1", 80)
+	inst2, addr2 := fakeStaticInstance("tcp", "192.168.0.2", 80)
+
+	srv := s.newServer(c, nil)
+	defer srv.Close()
+	srv.SetStore(&DNSServerStore{
+		InstancesFn: func(service string) ([]*discoverd.Instance, error) {
+			return []*discoverd.Instance{inst1, inst2}, nil
+		},
+		ServiceLeaderFn: func(service string) (*discoverd.Instance, error) {
+			return inst2, nil
+		},
+		ConfigFn: func(service string) *discoverd.ServiceConfig {
+			return &discoverd.ServiceConfig{DNSPolicy: discoverd.DNSPolicyLeader}
+		},
+	})
+
+	client := &dns.Client{}
+	req := &dns.Msg{}
+	req.SetQuestion("a.discoverd.", dns.TypeA)
+	res, _, err := client.Exchange(req, srv.UDPAddr)
+	c.Assert(err, IsNil)
+	c.Assert(res.Answer, HasLen, 1)
+	c.Assert(res.Answer[0].(*dns.A).A.String(), Equals, addr2.IP.String())
+}
+
+func (s *DNSSuite) TestDNSPolicyRoundRobin(c *C) {
+	instances := make([]*discoverd.Instance, 3)
+	ips := make([]string, 3)
+	for i := range instances {
+		ip := fmt.Sprintf("192.168.0.%d", i+1)
+		instances[i], _ = fakeStaticInstance("tcp", ip, 80)
+		ips[i] = ip
+	}
+
+	srv := s.newServer(c, nil)
+	defer srv.Close()
+	srv.SetStore(&DNSServerStore{
+		InstancesFn: func(service string) ([]*discoverd.Instance, error) {
+			return instances, nil
+		},
+		ServiceLeaderFn: func(service string) (*discoverd.Instance, error) {
+			return instances[0], nil
+		},
+		ConfigFn: func(service string) *discoverd.ServiceConfig {
+			return &discoverd.ServiceConfig{DNSPolicy: discoverd.DNSPolicyRoundRobin}
+		},
+	})
+
+	// Successive queries start from successive instances.
+	client := &dns.Client{}
+	for i := 0; i < len(ips)*2; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("a.discoverd.", dns.TypeA)
+		res, _, err := client.Exchange(req, srv.UDPAddr)
+		c.Assert(err, IsNil)
+		c.Assert(res.Answer, HasLen, len(ips))
+		c.Assert(res.Answer[0].(*dns.A).A.String(), Equals, ips[i%len(ips)])
+	}
+}
+
+func (s *DNSSuite) TestDNSPolicyWeighted(c *C) {
+	heavy, heavyAddr := fakeStaticInstance("tcp", "192.168.0.1", 80)
+	heavy.Meta = map[string]string{"weight": "200"}
+	light, _ := fakeStaticInstance("tcp", "192.168.0.2", 80)
+	light.Meta = map[string]string{"weight": "1"}
+
+	srv := s.newServer(c, nil)
+	defer srv.Close()
+	srv.SetStore(&DNSServerStore{
+		InstancesFn: func(service string) ([]*discoverd.Instance, error) {
+			return []*discoverd.Instance{light, heavy}, nil
+		},
+		ServiceLeaderFn: func(service string) (*discoverd.Instance, error) {
+			return heavy, nil
+		},
+		ConfigFn: func(service string) *discoverd.ServiceConfig {
+			return &discoverd.ServiceConfig{DNSPolicy: discoverd.DNSPolicyWeighted}
+		},
+	})
+
+	// With a 200:1 weight ratio the heavy instance should be listed first
+	// in the overwhelming majority of responses.
+	client := &dns.Client{}
+	heavyFirst := 0
+	for i := 0; i < 50; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("a.discoverd.", dns.TypeA)
+		res, _, err := client.Exchange(req, srv.UDPAddr)
+		c.Assert(err, IsNil)
+		c.Assert(res.Answer, HasLen, 2)
+		if res.Answer[0].(*dns.A).A.String() == heavyAddr.IP.String() {
+			heavyFirst++
+		}
+	}
+	c.Assert(heavyFirst > 40, Equals, true, Commentf("heavy instance first in %d/50 responses", heavyFirst))
+}
+
+func (s *DNSSuite) TestZoneOrder(c *C) {
+	local, localAddr := fakeStaticInstance("tcp", "192.168.0.1", 80)
+	local.Zone = "a"
+	remote, _ := fakeStaticInstance("tcp", "192.168.0.2", 80)
+	remote.Zone = "b"
+
+	srv := &DNSServer{
+		UDPAddr: "127.0.0.1:0",
+		TCPAddr: "127.0.0.1:0",
+		Zone:    "a",
+	}
+	srv.SetStore(&DNSServerStore{
+		InstancesFn: func(service string) ([]*discoverd.Instance, error) {
+			return []*discoverd.Instance{remote, local}, nil
+		},
+		ServiceLeaderFn: func(service string) (*discoverd.Instance, error) {
+			return local, nil
+		},
+	})
+	c.Assert(srv.ListenAndServe(), IsNil)
+	defer srv.Close()
+
+	// The same-zone instance leads every response, regardless of how the
+	// shuffle ordered the rest.
+	client := &dns.Client{}
+	for i := 0; i < 10; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("a.discoverd.", dns.TypeA)
+		res, _, err := client.Exchange(req, srv.UDPAddr)
+		c.Assert(err, IsNil)
+		c.Assert(res.Answer, HasLen, 2)
+		c.Assert(res.Answer[0].(*dns.A).A.String(), Equals, localAddr.IP.String())
+	}
+}
+
 func assertSOA(c *C, rrs []dns.RR) {
 	c.Assert(rrs, HasLen, 1)
 	c.Assert(rrs[0], FitsTypeOf, &dns.SOA{})
@@ -669,6 +894,7 @@ type testAddr struct {
 type DNSServerStore struct {
 	InstancesFn     func(service string) ([]*discoverd.Instance, error)
 	ServiceLeaderFn func(service string) (*discoverd.Instance, error)
+	ConfigFn        func(service string) *discoverd.ServiceConfig
 }
 
 func (s *DNSServerStore) Instances(service string) ([]*discoverd.Instance, error) {
@@ -678,3 +904,10 @@ func (s *DNSServerStore) Instances(service string) ([]*discoverd.Instance, error
 func (s *DNSServerStore) ServiceLeader(service string) (*discoverd.Instance, error) {
 	return s.ServiceLeaderFn(service)
 }
+
+func (s *DNSServerStore) Config(service string) *discoverd.ServiceConfig {
+	if s.ConfigFn == nil {
+		return nil
+	}
+	return s.ConfigFn(service)
+}
@@ -0,0 +1,942 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// etcdLogger records watch stream failures and dropped subscriber events.
+var etcdLogger = NewLogger("etcd")
+
+// DefaultEtcdPrefix is the key prefix registrations are stored under when
+// EtcdConfig.Prefix is empty.
+const DefaultEtcdPrefix = "/discoverd"
+
+// EtcdConfig configures an EtcdBackend.
+type EtcdConfig struct {
+	// URL is the base URL of an etcd v3 gRPC gateway, e.g.
+	// "http://localhost:2379". The backend speaks the gateway's JSON API,
+	// so it needs no etcd client library.
+	URL string
+
+	// Prefix is the key prefix state is stored under. Empty means
+	// DefaultEtcdPrefix. Multiple discoverd façades sharing an etcd
+	// cluster should use distinct prefixes.
+	Prefix string
+
+	// InstanceTTL is the lease TTL granted to registrations that don't
+	// carry their own. Zero means DefaultInstanceTTL. etcd enforces a
+	// minimum lease TTL; values below it are raised by the server.
+	InstanceTTL time.Duration
+
+	// HTTPClient is used for API requests. Nil means http.DefaultClient,
+	// so TLS deployments should supply a client configured with the
+	// cluster CA.
+	HTTPClient *http.Client
+}
+
+// EtcdBackend is a Backend that stores registrations in an etcd v3 cluster,
+// for users who already operate etcd and want discoverd as a thin,
+// Flynn-compatible façade. Instance TTLs map to etcd leases, heartbeats to
+// lease keepalives, and subscriptions to a single watch on the key prefix.
+//
+// The mapping is deliberately thin, so features that depend on the raft
+// store's replicated state machine are unavailable: transactions, renames,
+// freezes, the audit log, departure history and resumable subscriptions all
+// return errors or empty results. Leader election is first-registered: the
+// instance with the lowest create revision leads unless a leader key names
+// another instance.
+type EtcdBackend struct {
+	url    string
+	prefix string
+	ttl    time.Duration
+	client *http.Client
+
+	subs      adapterSubs
+	watchOnce sync.Once
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+
+	// lastIndex is the highest etcd revision observed in a response
+	// header, reported as the store index.
+	lastIndex uint64
+}
+
+// NewEtcdBackend returns a backend storing registrations in the etcd
+// cluster behind config.URL.
+func NewEtcdBackend(config EtcdConfig) *EtcdBackend {
+	b := &EtcdBackend{
+		url:    strings.TrimSuffix(config.URL, "/"),
+		prefix: config.Prefix,
+		ttl:    config.InstanceTTL,
+		client: config.HTTPClient,
+	}
+	if b.prefix == "" {
+		b.prefix = DefaultEtcdPrefix
+	}
+	if b.ttl == 0 {
+		b.ttl = DefaultInstanceTTL
+	}
+	if b.client == nil {
+		b.client = http.DefaultClient
+	}
+	return b
+}
+
+// Close stops the watch stream, closing any active subscriptions.
+func (b *EtcdBackend) Close() error {
+	b.mu.Lock()
+	cancel := b.cancel
+	b.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	b.subs.closeAll()
+	return nil
+}
+
+// Key layout under the prefix:
+//
+//	<prefix>/services/<service>/config          ServiceConfig JSON
+//	<prefix>/services/<service>/meta            ServiceMeta JSON
+//	<prefix>/services/<service>/leader          instance ID
+//	<prefix>/services/<service>/instances/<id>  Instance JSON, lease-bound
+
+func (b *EtcdBackend) serviceKey(service string) string {
+	return b.prefix + "/services/" + service
+}
+
+func (b *EtcdBackend) instanceKey(service, id string) string {
+	return b.serviceKey(service) + "/instances/" + id
+}
+
+// etcdKV is a key-value pair as returned by the gateway. Revisions and
+// lease IDs are int64s which the gateway encodes as JSON strings.
+type etcdKV struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision string `json:"create_revision"`
+	ModRevision    string `json:"mod_revision"`
+	Lease          string `json:"lease"`
+}
+
+func (kv *etcdKV) createRevision() uint64 {
+	n, _ := strconv.ParseUint(kv.CreateRevision, 10, 64)
+	return n
+}
+
+func (kv *etcdKV) modRevision() uint64 {
+	n, _ := strconv.ParseUint(kv.ModRevision, 10, 64)
+	return n
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []*etcdKV  `json:"kvs"`
+}
+
+// call POSTs a JSON request to an etcd gateway endpoint and decodes the
+// response into resp, tracking the cluster revision from the header.
+func (b *EtcdBackend) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := b.client.Post(b.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("discoverd: etcd %s: %s", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var gwErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&gwErr)
+		if gwErr.Message == "" {
+			gwErr.Message = res.Status
+		}
+		return fmt.Errorf("discoverd: etcd %s: %s", path, gwErr.Message)
+	}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return fmt.Errorf("discoverd: etcd %s: %s", path, err)
+	}
+	if v := headerRevision(resp); v != 0 {
+		b.observeRevision(v)
+	}
+	return nil
+}
+
+// headerRevision extracts the cluster revision if resp carries a header.
+func headerRevision(resp interface{}) uint64 {
+	type headed interface{ revision() uint64 }
+	if h, ok := resp.(headed); ok {
+		return h.revision()
+	}
+	return 0
+}
+
+func (r *etcdRangeResponse) revision() uint64 {
+	n, _ := strconv.ParseUint(r.Header.Revision, 10, 64)
+	return n
+}
+
+func (b *EtcdBackend) observeRevision(rev uint64) {
+	for {
+		old := atomic.LoadUint64(&b.lastIndex)
+		if rev <= old || atomic.CompareAndSwapUint64(&b.lastIndex, old, rev) {
+			return
+		}
+	}
+}
+
+// b64 encodes a key or value for the gateway, which carries bytes fields
+// as base64.
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the range_end covering every key under prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
+
+// get returns the key-value pair at key, or nil if the key is unset.
+func (b *EtcdBackend) get(key string) (*etcdKV, error) {
+	var resp etcdRangeResponse
+	if err := b.call("/v3/kv/range", map[string]string{"key": b64(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, nil
+	}
+	return resp.KVs[0], nil
+}
+
+// list returns the key-value pairs under prefix.
+func (b *EtcdBackend) list(prefix string) ([]*etcdKV, uint64, error) {
+	var resp etcdRangeResponse
+	req := map[string]string{"key": b64(prefix), "range_end": b64(prefixEnd(prefix))}
+	if err := b.call("/v3/kv/range", req, &resp); err != nil {
+		return nil, 0, err
+	}
+	return resp.KVs, resp.revision(), nil
+}
+
+// put stores value at key, optionally bound to a lease.
+func (b *EtcdBackend) put(key, value, lease string) error {
+	req := map[string]string{"key": b64(key), "value": b64(value)}
+	if lease != "" && lease != "0" {
+		req["lease"] = lease
+	}
+	var resp struct{}
+	return b.call("/v3/kv/put", req, &resp)
+}
+
+// delete removes key, or every key under it when subtree is set.
+func (b *EtcdBackend) delete(key string, subtree bool) error {
+	req := map[string]string{"key": b64(key)}
+	if subtree {
+		req["range_end"] = b64(prefixEnd(key))
+	}
+	var resp struct{}
+	return b.call("/v3/kv/deleterange", req, &resp)
+}
+
+// etcdUnsupported is returned by operations the etcd mapping cannot
+// provide.
+func etcdUnsupported(op string) error {
+	return fmt.Errorf("discoverd: %s is not supported by the etcd backend", op)
+}
+
+// Leader returns an empty address: every façade node writes to etcd
+// directly, so there is nothing to proxy writes to.
+func (b *EtcdBackend) Leader() string { return "" }
+
+// ServiceNames returns the sorted names of services with a config key.
+func (b *EtcdBackend) ServiceNames() []string {
+	kvs, _, err := b.list(b.prefix + "/services/")
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, kv := range kvs {
+		rest := strings.TrimPrefix(string(kv.Key), b.prefix+"/services/")
+		if i := strings.LastIndex(rest, "/"); i >= 0 && rest[i+1:] == "config" {
+			name := rest[:i]
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *EtcdBackend) serviceExists(service string) (bool, error) {
+	kv, err := b.get(b.serviceKey(service) + "/config")
+	return kv != nil, err
+}
+
+func (b *EtcdBackend) AddService(service string, config *discoverd.ServiceConfig) error {
+	if err := ValidServiceName(service); err != nil {
+		return err
+	}
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if exists {
+		return ServiceExistsError(service)
+	}
+	if config == nil {
+		config = DefaultServiceConfig
+	}
+	value, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return b.put(b.serviceKey(service)+"/config", string(value), "")
+}
+
+func (b *EtcdBackend) RemoveService(service string) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	return b.delete(b.serviceKey(service)+"/", true)
+}
+
+func (b *EtcdBackend) RemoveServiceAsync(service string) (string, error) {
+	return "", etcdUnsupported("asynchronous service removal")
+}
+
+func (b *EtcdBackend) ServiceRemoval(id string) *ServiceRemoval { return nil }
+
+func (b *EtcdBackend) RenameService(service, newName string) error {
+	return etcdUnsupported("service rename")
+}
+
+func (b *EtcdBackend) RetireAlias(alias string) error {
+	return etcdUnsupported("alias retirement")
+}
+
+func (b *EtcdBackend) SetServiceFrozen(service string, frozen bool) error {
+	return etcdUnsupported("service freeze")
+}
+
+// SetServiceMeta stores the service metadata. The optimistic Index check is
+// not enforced; last write wins.
+func (b *EtcdBackend) SetServiceMeta(service string, meta *discoverd.ServiceMeta) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := b.put(b.serviceKey(service)+"/meta", string(value), ""); err != nil {
+		return err
+	}
+	meta.Index = atomic.LoadUint64(&b.lastIndex)
+	return nil
+}
+
+func (b *EtcdBackend) ServiceMeta(service string) *discoverd.ServiceMeta {
+	kv, err := b.get(b.serviceKey(service) + "/meta")
+	if err != nil || kv == nil {
+		return nil
+	}
+	meta := &discoverd.ServiceMeta{}
+	if err := json.Unmarshal(kv.Value, meta); err != nil {
+		return nil
+	}
+	meta.Index = kv.modRevision()
+	return meta
+}
+
+// AddInstance registers an instance under a lease whose TTL is the
+// instance's TTL, or the backend default. Re-registering under an existing
+// ID renews the lease, so repeated registration doubles as the heartbeat.
+func (b *EtcdBackend) AddInstance(service string, inst *discoverd.Instance) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	if addr, err := discoverd.NormalizeAddr(inst.Addr); err == nil {
+		inst.Addr = addr
+	}
+
+	key := b.instanceKey(service, inst.ID)
+	current, err := b.get(key)
+	if err != nil {
+		return err
+	}
+
+	var lease string
+	if current != nil && current.Lease != "" && current.Lease != "0" {
+		lease = current.Lease
+		if err := b.keepalive(lease); err != nil {
+			return err
+		}
+	} else {
+		ttl := b.ttl
+		if inst.TTL > 0 {
+			ttl = time.Duration(inst.TTL) * time.Second
+		}
+		lease, err = b.grantLease(ttl)
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	return b.put(key, string(value), lease)
+}
+
+// AddInstances registers a batch of instances. Unlike the raft store the
+// registrations are applied one at a time, so a failure can leave a prefix
+// of the batch registered.
+func (b *EtcdBackend) AddInstances(regs []*discoverd.Registration) error {
+	for _, reg := range regs {
+		if err := b.AddInstance(reg.Service, reg.Instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *EtcdBackend) AddServiceInstances(service string, instances []*discoverd.Instance) error {
+	for _, inst := range instances {
+		if err := b.AddInstance(service, inst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *EtcdBackend) Transact(ops []*TxOp) error {
+	return etcdUnsupported("transactions")
+}
+
+func (b *EtcdBackend) RemoveInstance(service, id string) error {
+	key := b.instanceKey(service, id)
+	kv, err := b.get(key)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	if err := b.delete(key, false); err != nil {
+		return err
+	}
+	if kv.Lease != "" && kv.Lease != "0" {
+		// Revoking the lease is best-effort cleanup; the key is gone.
+		b.revokeLease(kv.Lease)
+	}
+	return nil
+}
+
+// setInstanceState rewrites an instance with a new lifecycle state,
+// preserving its lease.
+func (b *EtcdBackend) setInstanceState(service, id string, state discoverd.InstanceState) error {
+	key := b.instanceKey(service, id)
+	kv, err := b.get(key)
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	inst := &discoverd.Instance{}
+	if err := json.Unmarshal(kv.Value, inst); err != nil {
+		return err
+	}
+	if inst.State == state {
+		return nil
+	}
+	inst.State = state
+	value, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	return b.put(key, string(value), kv.Lease)
+}
+
+func (b *EtcdBackend) Drain(service, id string) error {
+	return b.setInstanceState(service, id, discoverd.InstanceStateDraining)
+}
+
+func (b *EtcdBackend) SetMaintenance(service, id string, maintenance bool) error {
+	state := discoverd.InstanceStateUp
+	if maintenance {
+		state = discoverd.InstanceStateMaintenance
+	}
+	return b.setInstanceState(service, id, state)
+}
+
+// instances returns the registered instances ordered by create revision,
+// which stands in for the store's registration index, plus the cluster
+// revision of the read.
+func (b *EtcdBackend) instances(service string) ([]*discoverd.Instance, uint64, error) {
+	if exists, err := b.serviceExists(service); err != nil {
+		return nil, 0, err
+	} else if !exists {
+		return nil, 0, NotFoundError{Service: service}
+	}
+	kvs, rev, err := b.list(b.serviceKey(service) + "/instances/")
+	if err != nil {
+		return nil, 0, err
+	}
+	instances := make([]*discoverd.Instance, 0, len(kvs))
+	for _, kv := range kvs {
+		inst := decodeEtcdInstance(kv)
+		if inst == nil {
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Index < instances[j].Index })
+	return instances, rev, nil
+}
+
+// decodeEtcdInstance decodes an instance value, mapping the key's create
+// revision to the instance index.
+func decodeEtcdInstance(kv *etcdKV) *discoverd.Instance {
+	inst := &discoverd.Instance{}
+	if err := json.Unmarshal(kv.Value, inst); err != nil {
+		return nil
+	}
+	inst.Index = kv.createRevision()
+	return inst
+}
+
+func (b *EtcdBackend) Instances(service string) ([]*discoverd.Instance, error) {
+	instances, _, err := b.instances(service)
+	return instances, err
+}
+
+func (b *EtcdBackend) InstancesFiltered(service string, selector Selector) ([]*discoverd.Instance, error) {
+	instances, err := b.Instances(service)
+	if err != nil || selector == nil {
+		return instances, err
+	}
+	filtered := instances[:0]
+	for _, inst := range instances {
+		if selector.Match(inst) {
+			filtered = append(filtered, inst)
+		}
+	}
+	return filtered, nil
+}
+
+func (b *EtcdBackend) GetWithIndex(service string, selector Selector) ([]*discoverd.Instance, uint64, error) {
+	instances, rev, err := b.instances(service)
+	if err != nil {
+		return nil, 0, err
+	}
+	if selector != nil {
+		filtered := instances[:0]
+		for _, inst := range instances {
+			if selector.Match(inst) {
+				filtered = append(filtered, inst)
+			}
+		}
+		instances = filtered
+	}
+	return instances, rev, nil
+}
+
+func (b *EtcdBackend) ServiceState(service string) *ServiceState { return nil }
+
+func (b *EtcdBackend) History(service string) []*InstanceDeparture { return nil }
+
+func (b *EtcdBackend) Config(service string) *discoverd.ServiceConfig {
+	kv, err := b.get(b.serviceKey(service) + "/config")
+	if err != nil || kv == nil {
+		return nil
+	}
+	config := &discoverd.ServiceConfig{}
+	if err := json.Unmarshal(kv.Value, config); err != nil {
+		return nil
+	}
+	return config
+}
+
+func (b *EtcdBackend) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	value, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return b.put(b.serviceKey(service)+"/config", string(value), "")
+}
+
+func (b *EtcdBackend) SetServiceLeader(service, id string) error {
+	kv, err := b.get(b.instanceKey(service, id))
+	if err != nil {
+		return err
+	}
+	if kv == nil {
+		return NotFoundError{Service: service, Instance: id}
+	}
+	return b.put(b.serviceKey(service)+"/leader", id, "")
+}
+
+func (b *EtcdBackend) FailoverServiceLeader(service, id string) error {
+	return b.SetServiceLeader(service, id)
+}
+
+// ServiceLeader returns the instance named by the leader key, falling back
+// to the longest-registered instance.
+func (b *EtcdBackend) ServiceLeader(service string) (*discoverd.Instance, error) {
+	instances, _, err := b.instances(service)
+	if err != nil {
+		return nil, err
+	}
+	if kv, err := b.get(b.serviceKey(service) + "/leader"); err != nil {
+		return nil, err
+	} else if kv != nil {
+		for _, inst := range instances {
+			if inst.ID == string(kv.Value) {
+				return inst, nil
+			}
+		}
+	}
+	if len(instances) == 0 {
+		return nil, nil
+	}
+	return instances[0], nil
+}
+
+// ProtoLeader returns the longest-registered instance speaking proto.
+func (b *EtcdBackend) ProtoLeader(service, proto string) (*discoverd.Instance, error) {
+	instances, _, err := b.instances(service)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range instances {
+		if inst.Proto == proto {
+			return inst, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *EtcdBackend) Stats() map[string]ServiceStats                   { return nil }
+func (b *EtcdBackend) Subscribers() []SubscriberStats                   { return nil }
+func (b *EtcdBackend) EventStats() map[string]map[string]EventKindStats { return nil }
+func (b *EtcdBackend) EvictionStats() map[string]uint64                 { return nil }
+func (b *EtcdBackend) ServiceDigests() map[string]uint64                { return nil }
+func (b *EtcdBackend) Dependencies() map[string][]string                { return nil }
+func (b *EtcdBackend) MissingDependencies() map[string][]string         { return nil }
+
+func (b *EtcdBackend) Export() *ClusterExport {
+	return adapterExport(b, time.Now().UTC())
+}
+
+func (b *EtcdBackend) Import(export *ClusterExport) error {
+	return adapterImport(b, export)
+}
+
+func (b *EtcdBackend) AuditQuery(service string, from, to time.Time) ([]*AuditEntry, error) {
+	return nil, etcdUnsupported("the audit log")
+}
+
+// AddPeer returns an error: etcd cluster membership is managed with etcd's
+// own tooling, not through the façade.
+func (b *EtcdBackend) AddPeer(peer string) error {
+	return etcdUnsupported("peer management")
+}
+
+func (b *EtcdBackend) RemovePeer(peer string) error {
+	return etcdUnsupported("peer management")
+}
+
+// GetPeers returns the client URLs of the etcd cluster members.
+func (b *EtcdBackend) GetPeers() ([]string, error) {
+	var resp struct {
+		Members []struct {
+			ClientURLs []string `json:"clientURLs"`
+		} `json:"members"`
+	}
+	if err := b.call("/v3/cluster/member/list", struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	var peers []string
+	for _, m := range resp.Members {
+		peers = append(peers, m.ClientURLs...)
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+func (b *EtcdBackend) LastIndex() uint64 {
+	return atomic.LoadUint64(&b.lastIndex)
+}
+
+// WriteConsistency reports the level an acknowledged etcd write guarantees,
+// using the same quorum math as the raft store.
+func (b *EtcdBackend) WriteConsistency() WriteConsistency {
+	peers, err := b.GetPeers()
+	if err != nil {
+		return ConsistencyQuorum
+	}
+	if n := len(peers); n <= 1 || n/2+1 == n {
+		return ConsistencyAll
+	}
+	return ConsistencyQuorum
+}
+
+// grantLease grants a lease with the given TTL and returns its ID.
+func (b *EtcdBackend) grantLease(ttl time.Duration) (string, error) {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	req := map[string]interface{}{"TTL": strconv.FormatInt(seconds, 10)}
+	if err := b.call("/v3/lease/grant", req, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// keepalive renews a lease. The gateway endpoint is a stream, but a single
+// request-response exchange performs one renewal.
+func (b *EtcdBackend) keepalive(lease string) error {
+	var resp struct{}
+	return b.call("/v3/lease/keepalive", map[string]string{"ID": lease}, &resp)
+}
+
+func (b *EtcdBackend) revokeLease(lease string) error {
+	var resp struct{}
+	return b.call("/v3/lease/revoke", map[string]string{"ID": lease}, &resp)
+}
+
+func (b *EtcdBackend) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	return b.SubscribeFiltered(service, sendCurrent, kinds, ch, nil)
+}
+
+func (b *EtcdBackend) SubscribeFiltered(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector) stream.Stream {
+	sub := &adapterSubscription{registry: &b.subs, kinds: kinds, selector: selector, ch: ch, logger: etcdLogger}
+	if service != "" {
+		sub.services = map[string]bool{service: true}
+	}
+
+	if sendCurrent {
+		instances, _ := b.Instances(service)
+		for _, inst := range instances {
+			if selector != nil && !selector.Match(inst) {
+				continue
+			}
+			if kinds&discoverd.EventKindUp != 0 {
+				ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUp, Instance: inst}
+			}
+		}
+		if kinds&discoverd.EventKindLeader != 0 {
+			if leader, err := b.ServiceLeader(service); err == nil && leader != nil {
+				ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindLeader, Instance: leader}
+			}
+		}
+		if kinds&discoverd.EventKindCurrent != 0 {
+			ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindCurrent}
+		}
+	}
+
+	b.subs.add(sub)
+	b.ensureWatcher()
+	return sub
+}
+
+// SubscribePriority ignores the priority: the adapter's delivery pipeline
+// drops on overflow rather than tiering subscribers.
+func (b *EtcdBackend) SubscribePriority(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) stream.Stream {
+	return b.SubscribeFiltered(service, sendCurrent, kinds, ch, selector)
+}
+
+// SubscribeClient ignores the client identity: the adapter does not enforce
+// subscriber quotas.
+func (b *EtcdBackend) SubscribeClient(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) (stream.Stream, error) {
+	return b.SubscribeFiltered(service, sendCurrent, kinds, ch, selector), nil
+}
+
+// SubscribeSince is unavailable: etcd compacts old revisions, so the
+// backend cannot promise replay from an arbitrary index.
+func (b *EtcdBackend) SubscribeSince(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error) {
+	return nil, etcdUnsupported("resumable subscriptions")
+}
+
+// ensureWatcher starts the shared watch loop on first use.
+func (b *EtcdBackend) ensureWatcher() {
+	b.watchOnce.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		b.mu.Lock()
+		b.cancel = cancel
+		b.mu.Unlock()
+		go b.watchLoop(ctx)
+	})
+}
+
+// watchLoop maintains a single watch over the key prefix, translating etcd
+// events into discoverd events. The stream is re-established after errors.
+func (b *EtcdBackend) watchLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := b.watch(ctx); err != nil && ctx.Err() == nil {
+			etcdLogger.Error("watch stream failed, retrying", "err", err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// etcdWatchEvent is one event from the watch stream.
+type etcdWatchEvent struct {
+	Type   string  `json:"type"` // "DELETE"; PUT is the proto zero value and omitted
+	KV     *etcdKV `json:"kv"`
+	PrevKV *etcdKV `json:"prev_kv"`
+}
+
+func (b *EtcdBackend) watch(ctx context.Context) error {
+	prefix := b.prefix + "/services/"
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":       b64(prefix),
+			"range_end": b64(prefixEnd(prefix)),
+			"prev_kv":   true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", b.url+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("discoverd: etcd /v3/watch: %s", res.Status)
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Header etcdHeader        `json:"header"`
+				Events []*etcdWatchEvent `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		if rev, err := strconv.ParseUint(msg.Result.Header.Revision, 10, 64); err == nil {
+			b.observeRevision(rev)
+		}
+		for _, we := range msg.Result.Events {
+			if event := b.translateWatchEvent(we); event != nil {
+				b.subs.broadcast(event)
+			}
+		}
+	}
+}
+
+// translateWatchEvent maps an etcd key change to a discoverd event, or nil
+// for keys that don't correspond to one.
+func (b *EtcdBackend) translateWatchEvent(we *etcdWatchEvent) *discoverd.Event {
+	kv := we.KV
+	if kv == nil {
+		return nil
+	}
+	rest := strings.TrimPrefix(string(kv.Key), b.prefix+"/services/")
+	deleted := we.Type == "DELETE"
+
+	if i := strings.Index(rest, "/instances/"); i >= 0 {
+		service := rest[:i]
+		if deleted {
+			if we.PrevKV == nil {
+				return nil
+			}
+			inst := decodeEtcdInstance(we.PrevKV)
+			if inst == nil {
+				return nil
+			}
+			return &discoverd.Event{Service: service, Kind: discoverd.EventKindDown, Instance: inst}
+		}
+		inst := decodeEtcdInstance(kv)
+		if inst == nil {
+			return nil
+		}
+		kind := discoverd.EventKindUpdate
+		if kv.CreateRevision == kv.ModRevision {
+			kind = discoverd.EventKindUp
+		}
+		return &discoverd.Event{Service: service, Kind: kind, Instance: inst}
+	}
+
+	if service := strings.TrimSuffix(rest, "/meta"); service != rest && !deleted {
+		meta := &discoverd.ServiceMeta{}
+		if err := json.Unmarshal(kv.Value, meta); err != nil {
+			return nil
+		}
+		meta.Index = kv.modRevision()
+		return &discoverd.Event{Service: service, Kind: discoverd.EventKindServiceMeta, ServiceMeta: meta}
+	}
+
+	if service := strings.TrimSuffix(rest, "/leader"); service != rest && !deleted {
+		inst, err := b.ServiceLeader(service)
+		if err != nil || inst == nil {
+			return nil
+		}
+		return &discoverd.Event{Service: service, Kind: discoverd.EventKindLeader, Instance: inst}
+	}
+
+	if service := strings.TrimSuffix(rest, "/config"); service != rest && deleted {
+		return &discoverd.Event{Service: service, Kind: discoverd.EventKindServiceDown}
+	}
+
+	return nil
+}
+
+var _ Backend = (*EtcdBackend)(nil)
@@ -0,0 +1,186 @@
+package server_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// fakeEtcd is an in-memory stand-in for the etcd v3 gRPC gateway, covering
+// the KV and lease endpoints the backend uses.
+type fakeEtcd struct {
+	rev    uint64
+	leases uint64
+	kvs    map[string]*fakeEtcdKV
+}
+
+type fakeEtcdKV struct {
+	value     []byte
+	createRev uint64
+	modRev    uint64
+	lease     uint64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: make(map[string]*fakeEtcdKV)}
+}
+
+func (f *fakeEtcd) encodeKV(key string, kv *fakeEtcdKV) map[string]interface{} {
+	return map[string]interface{}{
+		"key":             base64.StdEncoding.EncodeToString([]byte(key)),
+		"value":           base64.StdEncoding.EncodeToString(kv.value),
+		"create_revision": strconv.FormatUint(kv.createRev, 10),
+		"mod_revision":    strconv.FormatUint(kv.modRev, 10),
+		"lease":           strconv.FormatUint(kv.lease, 10),
+	}
+}
+
+func (f *fakeEtcd) header() map[string]string {
+	return map[string]string{"revision": strconv.FormatUint(f.rev, 10)}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Key      string `json:"key"`
+		RangeEnd string `json:"range_end"`
+		Value    string `json:"value"`
+		Lease    string `json:"lease"`
+		TTL      string `json:"TTL"`
+		ID       string `json:"ID"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	key, _ := base64.StdEncoding.DecodeString(req.Key)
+	end, _ := base64.StdEncoding.DecodeString(req.RangeEnd)
+
+	resp := map[string]interface{}{}
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var kvs []map[string]interface{}
+		for k, kv := range f.kvs {
+			if len(end) == 0 && k != string(key) {
+				continue
+			}
+			if len(end) > 0 && (k < string(key) || k >= string(end)) {
+				continue
+			}
+			kvs = append(kvs, f.encodeKV(k, kv))
+		}
+		resp["kvs"] = kvs
+	case "/v3/kv/put":
+		f.rev++
+		value, _ := base64.StdEncoding.DecodeString(req.Value)
+		lease, _ := strconv.ParseUint(req.Lease, 10, 64)
+		kv := f.kvs[string(key)]
+		if kv == nil {
+			kv = &fakeEtcdKV{createRev: f.rev}
+			f.kvs[string(key)] = kv
+		}
+		kv.value = value
+		kv.modRev = f.rev
+		if lease != 0 {
+			kv.lease = lease
+		}
+	case "/v3/kv/deleterange":
+		f.rev++
+		for k := range f.kvs {
+			if k == string(key) || (len(end) > 0 && k >= string(key) && k < string(end)) {
+				delete(f.kvs, k)
+			}
+		}
+	case "/v3/lease/grant":
+		f.leases++
+		resp["ID"] = strconv.FormatUint(f.leases, 10)
+	case "/v3/lease/keepalive", "/v3/lease/revoke":
+	default:
+		http.Error(w, "unexpected path: "+r.URL.Path, 404)
+		return
+	}
+	resp["header"] = f.header()
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Ensure the etcd backend round-trips services and instances, binding
+// registrations to leases and mapping create revisions to indexes.
+func TestEtcdBackend(t *testing.T) {
+	fake := newFakeEtcd()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	b := server.NewEtcdBackend(server.EtcdConfig{URL: srv.URL})
+	defer b.Close()
+
+	// Registering against a missing service fails.
+	if err := b.AddInstance("abc", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Create the service; creating it again fails.
+	if err := b.AddService("abc", nil); err != nil {
+		t.Fatal(err)
+	} else if err = b.AddService("abc", nil); !server.IsServiceExists(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := b.ServiceNames(); !strings.HasPrefix(strings.Join(names, ","), "abc") {
+		t.Fatalf("unexpected service names: %v", names)
+	}
+
+	// Register two instances and verify they come back ordered by
+	// registration with lease-bound keys.
+	if err := b.AddInstance("abc", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err = b.AddInstance("abc", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := b.Instances("abc")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	} else if instances[0].ID != "inst0" || instances[1].ID != "inst1" {
+		t.Fatalf("unexpected order: %s, %s", instances[0].ID, instances[1].ID)
+	} else if instances[0].Index == 0 || instances[0].Index >= instances[1].Index {
+		t.Fatalf("unexpected indexes: %d, %d", instances[0].Index, instances[1].Index)
+	}
+	if kv := fake.kvs["/discoverd/services/abc/instances/inst0"]; kv == nil || kv.lease == 0 {
+		t.Fatalf("expected lease-bound instance key, got %#v", kv)
+	}
+
+	// The first registered instance leads until a leader is set.
+	if leader, err := b.ServiceLeader("abc"); err != nil {
+		t.Fatal(err)
+	} else if leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %s", leader.ID)
+	}
+	if err := b.SetServiceLeader("abc", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := b.ServiceLeader("abc"); err != nil {
+		t.Fatal(err)
+	} else if leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %s", leader.ID)
+	}
+
+	// Deregister an instance and verify it is gone.
+	if err := b.RemoveInstance("abc", "inst0"); err != nil {
+		t.Fatal(err)
+	} else if err = b.RemoveInstance("abc", "inst0"); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Removing the service clears its subtree.
+	if err := b.RemoveService("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.kvs) != 0 {
+		t.Fatalf("unexpected keys: %#v", fake.kvs)
+	}
+}
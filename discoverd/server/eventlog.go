@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// EventLog is an append-only binary log of broadcast events, persisting the
+// in-memory event ring so resumable subscriptions survive server restarts:
+// after a crash or upgrade the store reloads the retained tail of the log,
+// and clients reconnecting with a since index pick up exactly where they
+// left off instead of re-syncing full state.
+//
+// Each record is framed as a 4-byte big-endian payload length, a 4-byte IEEE
+// CRC-32 of the payload, and the JSON-encoded event. Replay stops at the
+// first short or corrupt record, so a write cut short by a crash loses at
+// most the final event. The log is periodically compacted: once it holds
+// twice the retention count, it is rewritten in place (via a temporary file
+// and rename) keeping only the newest events, which bounds disk usage
+// without ever dropping events a resuming client could still request.
+type EventLog struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	retain int
+	count  int                // records in the current log file
+	events []*discoverd.Event // retained tail, newest last
+}
+
+// OpenEventLog opens the event log at path, creating it if necessary, and
+// replays any existing records. retain is the number of events kept across
+// compactions; if it is not positive, DefaultEventLogSize is used.
+func OpenEventLog(path string, retain int) (*EventLog, error) {
+	if retain <= 0 {
+		retain = DefaultEventLogSize
+	}
+	l := &EventLog{path: path, retain: retain}
+	if err := l.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+// replay reads the records in the log file, retaining the newest tail. Any
+// short or corrupt trailing record — the tail left by a crash mid-write — is
+// truncated away so that subsequent appends stay readable.
+func (l *EventLog) replay() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	valid := int64(0)
+	for {
+		event, n, err := readRecord(f)
+		if err != nil {
+			break
+		}
+		valid += n
+		l.count++
+		l.events = append(l.events, event)
+		if len(l.events) > l.retain {
+			l.events = l.events[1:]
+		}
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > valid {
+		return os.Truncate(l.path, valid)
+	}
+	return nil
+}
+
+// Append writes an event to the log, compacting it first if it has grown to
+// twice the retention count.
+func (l *EventLog) Append(event *discoverd.Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.count >= 2*l.retain {
+		if err := l.compact(); err != nil {
+			return err
+		}
+	}
+
+	if err := writeRecord(l.f, event); err != nil {
+		return err
+	}
+	l.count++
+	l.events = append(l.events, event)
+	if len(l.events) > l.retain {
+		l.events = l.events[1:]
+	}
+	return nil
+}
+
+// compact rewrites the log keeping only the retained tail, using a temporary
+// file and rename so a crash mid-compaction leaves the old log intact.
+// Must be called with the mutex held.
+func (l *EventLog) compact() error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	for _, event := range l.events {
+		if err := writeRecord(f, event); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Reopen the log file so appends go to the compacted log.
+	l.f.Close()
+	nf, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.f = nf
+	l.count = len(l.events)
+	return nil
+}
+
+// Events returns a copy of the retained events, oldest first.
+func (l *EventLog) Events() []*discoverd.Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]*discoverd.Event, len(l.events))
+	copy(events, l.events)
+	return events
+}
+
+// LastIndex returns the sequence number of the newest retained event, or
+// zero if the log is empty.
+func (l *EventLog) LastIndex() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) == 0 {
+		return 0
+	}
+	return l.events[len(l.events)-1].EventIndex
+}
+
+// Close closes the underlying file.
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// writeRecord frames and writes a single event record.
+func writeRecord(w io.Writer, event *discoverd.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// readRecord reads and verifies a single event record, returning the event
+// and the number of bytes consumed.
+func readRecord(r io.Reader) (*discoverd.Event, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptRecord
+	}
+	event := &discoverd.Event{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, 0, err
+	}
+	return event, int64(len(header) + len(payload)), nil
+}
+
+var errCorruptRecord = errors.New("discoverd: corrupt event log record")
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// ClusterExportVersion is the version of the export document format.
+// Importers reject documents with a different version, so the format can
+// evolve without silently misreading old backups.
+const ClusterExportVersion = 1
+
+// ClusterExport is a versioned dump of the cluster's discovery state,
+// suitable for disaster recovery or for seeding a staging environment from
+// production topology. Unlike the raw SnapshotState dump it is a stable
+// public format, decoupled from the store's internal representation.
+type ClusterExport struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Services   []*ServiceExport `json:"services"`
+}
+
+// ServiceExport is one service's state within a ClusterExport.
+type ServiceExport struct {
+	Name      string                   `json:"name"`
+	Config    *discoverd.ServiceConfig `json:"config,omitempty"`
+	Meta      *discoverd.ServiceMeta   `json:"meta,omitempty"`
+	LeaderID  string                   `json:"leader_id,omitempty"`
+	Instances []*discoverd.Instance    `json:"instances,omitempty"`
+}
+
+// Export returns a dump of every service with its config, instances,
+// metadata and leader, sorted by name so exports diff cleanly.
+func (s *Store) Export() *ClusterExport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	export := &ClusterExport{
+		Version:    ClusterExportVersion,
+		ExportedAt: s.Now().UTC(),
+		Services:   make([]*ServiceExport, 0, len(s.data.Services)),
+	}
+	for name, config := range s.data.Services {
+		svc := &ServiceExport{
+			Name:     name,
+			Config:   config,
+			Meta:     s.data.Metas[name],
+			LeaderID: s.data.Leaders[name],
+		}
+		for _, inst := range s.data.Instances[name] {
+			svc.Instances = append(svc.Instances, inst)
+		}
+		sort.Slice(svc.Instances, func(i, j int) bool { return svc.Instances[i].Index < svc.Instances[j].Index })
+		export.Services = append(export.Services, svc)
+	}
+	sort.Slice(export.Services, func(i, j int) bool { return export.Services[i].Name < export.Services[j].Name })
+	return export
+}
+
+// Import atomically replaces the cluster's discovery state with the
+// contents of an export document, broadcasting the diff to subscribers the
+// same way RestoreState does. Imported instances keep their indexes but
+// are subject to expiry, so they age out unless something heartbeats them.
+func (s *Store) Import(export *ClusterExport) error {
+	if export.Version != ClusterExportVersion {
+		return fmt.Errorf("discoverd: unsupported export version %d", export.Version)
+	}
+
+	for _, svc := range export.Services {
+		if err := ValidServiceName(svc.Name); err != nil {
+			return err
+		}
+	}
+
+	// Skip the restore when the document hashes identically to the current
+	// state, so periodic full-sync importers generate zero events.
+	data := exportData(export)
+	if digestsEqual(data, s.readData()) {
+		return nil
+	}
+
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.RestoreState(buf)
+}
+
+// exportData converts an export document to the store's internal state
+// representation.
+func exportData(export *ClusterExport) *raftData {
+	data := newRaftData()
+	if export == nil {
+		return data
+	}
+	for _, svc := range export.Services {
+		config := svc.Config
+		if config == nil {
+			config = DefaultServiceConfig
+		}
+		data.Services[svc.Name] = config
+		if svc.Meta != nil {
+			data.Metas[svc.Name] = svc.Meta
+		}
+		if svc.LeaderID != "" {
+			data.Leaders[svc.Name] = svc.LeaderID
+		}
+		if len(svc.Instances) > 0 {
+			instances := make(map[string]*discoverd.Instance, len(svc.Instances))
+			for _, inst := range svc.Instances {
+				instances[inst.ID] = inst
+			}
+			data.Instances[svc.Name] = instances
+		}
+	}
+	return data
+}
+
+// adapterExport builds an export document from a backend's public reads.
+// The external-store adapters use it in place of the raft store's direct
+// state snapshot.
+func adapterExport(b Backend, now time.Time) *ClusterExport {
+	names := b.ServiceNames()
+	export := &ClusterExport{
+		Version:    ClusterExportVersion,
+		ExportedAt: now,
+		Services:   make([]*ServiceExport, 0, len(names)),
+	}
+	for _, name := range names {
+		svc := &ServiceExport{
+			Name:   name,
+			Config: b.Config(name),
+			Meta:   b.ServiceMeta(name),
+		}
+		svc.Instances, _ = b.Instances(name)
+		if leader, err := b.ServiceLeader(name); err == nil && leader != nil {
+			svc.LeaderID = leader.ID
+		}
+		export.Services = append(export.Services, svc)
+	}
+	return export
+}
+
+// adapterImport replays an export document through a backend's write
+// methods. Unlike the raft store's Import it is not atomic: a failure can
+// leave a prefix of the document applied.
+func adapterImport(b Backend, export *ClusterExport) error {
+	if export.Version != ClusterExportVersion {
+		return fmt.Errorf("discoverd: unsupported export version %d", export.Version)
+	}
+	for _, svc := range export.Services {
+		if err := b.AddService(svc.Name, svc.Config); err != nil && !IsServiceExists(err) {
+			return err
+		}
+		if svc.Meta != nil {
+			if err := b.SetServiceMeta(svc.Name, svc.Meta); err != nil {
+				return err
+			}
+		}
+		for _, inst := range svc.Instances {
+			if err := b.AddInstance(svc.Name, inst); err != nil {
+				return err
+			}
+		}
+		if svc.LeaderID != "" {
+			if err := b.SetServiceLeader(svc.Name, svc.LeaderID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serveGetClusterExport returns the export document.
+func (h *Handler) serveGetClusterExport(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hh.JSON(w, 200, h.Store.Export())
+}
+
+// servePostClusterImport replaces the cluster state with the posted export
+// document.
+func (h *Handler) servePostClusterImport(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	export := &ClusterExport{}
+	if err := hh.DecodeJSON(r, export); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	err := h.Store.Import(export)
+	if err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,112 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure a cluster export round-trips through import into a fresh store.
+func TestStore_ExportImport(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: json.RawMessage(`{"foo":"bar"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	export := s.Export()
+	if export.Version != server.ClusterExportVersion {
+		t.Fatalf("unexpected version: %d", export.Version)
+	} else if len(export.Services) != 1 {
+		t.Fatalf("unexpected services: %#v", export.Services)
+	} else if len(export.Services[0].Instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", export.Services[0].Instances)
+	} else if export.Services[0].LeaderID != "inst0" {
+		t.Fatalf("unexpected leader: %s", export.Services[0].LeaderID)
+	}
+
+	// Import into a fresh store and verify the state carried over.
+	other := MustOpenStore()
+	defer other.Close()
+	if err := other.Import(export); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err := other.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+	if leader, err := other.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+	if meta := other.ServiceMeta("service0"); meta == nil || string(meta.Data) != `{"foo":"bar"}` {
+		t.Fatalf("unexpected meta: %#v", meta)
+	}
+
+	// Documents with an unknown version are rejected.
+	if err := other.Import(&server.ClusterExport{Version: 99}); err == nil || !strings.Contains(err.Error(), "unsupported export version") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure importing a document identical to the current state is a no-op
+// that applies nothing and broadcasts no events.
+func TestStore_Import_Idempotent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindAll, ch)
+
+	// Re-importing the store's own export changes nothing.
+	index := s.LastIndex()
+	if err := s.Import(s.Export()); err != nil {
+		t.Fatal(err)
+	} else if s.LastIndex() != index {
+		t.Fatalf("unexpected index: %d", s.LastIndex())
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+}
+
+// Ensure the handler serves exports and rejects imports with an unknown
+// version.
+func TestHandler_ClusterImport(t *testing.T) {
+	h := NewHandler()
+	var imported *server.ClusterExport
+	h.Store.ImportFn = func(export *server.ClusterExport) error {
+		imported = export
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("POST", "/cluster/import",
+		strings.NewReader(`{"version":1,"exported_at":"2000-01-01T00:00:00Z","services":[{"name":"abc"}]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if imported == nil || len(imported.Services) != 1 || imported.Services[0].Name != "abc" {
+		t.Fatalf("unexpected import: %#v", imported)
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"go.opencensus.io/trace"
+)
+
+// Broadcast delivery is decoupled from the mutation path: mutations assign
+// sequence numbers and record events under the store mutex, then hand the
+// prepared events to a single fan-out worker which delivers them to
+// subscribers while holding only registry shard locks. Slow subscriber
+// handling — selector matching and the overflow policy — therefore no
+// longer extends the time registration calls hold the store mutex. A single
+// worker preserves the global event order, which wildcard subscribers and
+// the resumable event log rely on.
+
+// broadcastLogger records event deliveries and slow subscriber closes.
+var broadcastLogger = NewLogger("broadcast")
+
+// fanoutItem is one broadcast event prepared under the store mutex.
+type fanoutItem struct {
+	event   *discoverd.Event // as handed to plain subscribers
+	indexed *discoverd.Event // copy carrying the sequence number
+}
+
+// fanoutJob is one unit of delivery work for the fan-out worker.
+type fanoutJob struct {
+	items []fanoutItem
+
+	// batched indicates the items form one atomic change, so batching
+	// subscribers receive them as a single event.
+	batched bool
+
+	// done, when non-nil, marks a flush barrier: the worker closes it
+	// once every previously queued job has been delivered.
+	done chan struct{}
+}
+
+// queueFanout hands the events collected by the current mutation to the
+// fan-out worker, blocking if the queue is full so events are never lost.
+// Must be called under mutex.
+func (s *Store) queueFanout(batched bool) {
+	if len(s.pendingFanout) == 0 {
+		return
+	}
+	// Once shutdown has begun the terminal event must be the last one
+	// subscribers see, so late events are discarded.
+	if s.shuttingDown {
+		s.pendingFanout = nil
+		return
+	}
+	job := &fanoutJob{items: s.pendingFanout, batched: batched}
+	s.pendingFanout = nil
+
+	// Before the worker is running, e.g. while replaying the raft log
+	// during open, deliver synchronously.
+	if s.fanout == nil {
+		s.deliverFanout(job)
+		return
+	}
+	select {
+	case s.fanout <- job:
+	case <-s.closing:
+	}
+}
+
+// flushFanout blocks until the worker has delivered every event queued
+// before the call, so a new subscriber's current-state snapshot is not
+// followed by replays of events it already reflects.
+// Must be called under mutex.
+func (s *Store) flushFanout() {
+	if s.fanout == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case s.fanout <- &fanoutJob{done: done}:
+	case <-s.closing:
+		return
+	}
+	select {
+	case <-done:
+	case <-s.closing:
+	}
+}
+
+// fanoutLoop delivers queued events to subscribers until the store closes.
+func (s *Store) fanoutLoop() {
+	defer s.wg.Done()
+	for {
+		select {
+		case job := <-s.fanout:
+			s.deliverFanout(job)
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// deliverFanout sends a job's events to their subscribers, including
+// wildcard and glob subscribers whose pattern matches, and delivers the
+// collected batch events for batching subscribers.
+func (s *Store) deliverFanout(job *fanoutJob) {
+	if job.done != nil {
+		close(job.done)
+		return
+	}
+	// Chaos mode delays deliveries to surface ordering and staleness
+	// assumptions in consumers. Flush barriers above are exempt so
+	// mutations aren't stalled.
+	if c := s.Chaos; c != nil {
+		c.delayBroadcast()
+	}
+	// A span per job shows whether delivery stalls on slow subscribers.
+	_, span := traceStart(context.Background(), "discoverd.fanout.deliver",
+		trace.Int64Attribute("events", int64(len(job.items))),
+		trace.BoolAttribute("batched", job.batched))
+	defer traceEnd(span, nil)
+	var batches map[*subscription][]*discoverd.Event
+	if job.batched {
+		batches = make(map[*subscription][]*discoverd.Event)
+	}
+	for _, item := range job.items {
+		s.broadcastTo(item.event.Service, item.event, item.indexed, batches)
+		for _, pattern := range s.subs.matchingPatterns(item.event.Service) {
+			s.broadcastTo(pattern, item.event, item.indexed, batches)
+		}
+	}
+	for sub, batch := range batches {
+		sub.enqueue(&discoverd.Event{
+			Service: sub.service,
+			Kind:    discoverd.EventKindBatch,
+			Batch:   batch,
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+const (
+	// DefaultFederationHeartbeatInterval is the default interval at which
+	// mirrored instances are heartbeated in the local store.
+	DefaultFederationHeartbeatInterval = 5 * time.Second
+
+	// DefaultFederationRetryInterval is the default wait before
+	// re-establishing a failed remote watch stream.
+	DefaultFederationRetryInterval = time.Second
+)
+
+// Federator mirrors selected services from a remote discoverd cluster into
+// the local store using the remote watch stream, so cross-datacenter clients
+// can discover remote instances with local read latency.
+//
+// Mirrored instances are tagged with the remote datacenter name under the
+// "dc" meta key. While the watch stream is healthy the federator renews the
+// instances' leases in the local store; if the remote cluster becomes
+// unreachable the mirrored instances stop being heartbeated and expire like
+// any other stale registration.
+//
+// The federator writes through the local raft leader, so it should run
+// alongside it; writes attempted from a follower fail and are retried once
+// the stream reconnects.
+type Federator struct {
+	// DC is the name of the remote datacenter.
+	DC string
+
+	// Services are the remote service names to mirror.
+	Services []string
+
+	// Remote is a client for the remote cluster.
+	Remote *discoverd.Client
+
+	// Store is the local store that remote instances are mirrored into.
+	Store interface {
+		AddService(service string, config *discoverd.ServiceConfig) error
+		AddInstance(service string, inst *discoverd.Instance) error
+		RemoveInstance(service, id string) error
+		Heartbeat(service, id string) error
+	}
+
+	HeartbeatInterval time.Duration
+	RetryInterval     time.Duration
+	Logger            *log.Logger
+
+	mu       sync.Mutex
+	mirrored map[string]map[string]struct{} // mirrored instance IDs by service
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewFederator returns a federator mirroring the given services from the
+// remote cluster identified by dc.
+func NewFederator(dc string, remote *discoverd.Client, services []string) *Federator {
+	return &Federator{
+		DC:                dc,
+		Services:          services,
+		Remote:            remote,
+		HeartbeatInterval: DefaultFederationHeartbeatInterval,
+		RetryInterval:     DefaultFederationRetryInterval,
+		mirrored:          make(map[string]map[string]struct{}),
+		closing:           make(chan struct{}),
+	}
+}
+
+// Start begins mirroring each configured service in a separate goroutine.
+func (f *Federator) Start() {
+	for _, service := range f.Services {
+		f.wg.Add(1)
+		go f.mirror(service)
+	}
+}
+
+// Close stops mirroring and waits for the watch streams to shut down.
+// Mirrored instances are left in the local store to expire normally.
+func (f *Federator) Close() error {
+	close(f.closing)
+	f.wg.Wait()
+	return nil
+}
+
+// mirror watches service on the remote cluster and replays its events into
+// the local store, re-establishing the stream on failure.
+func (f *Federator) mirror(service string) {
+	defer f.wg.Done()
+
+	for {
+		if err := f.mirrorStream(service); err != nil {
+			f.logf("federation: mirror %s from %s: %s", service, f.DC, err)
+		}
+		select {
+		case <-f.closing:
+			return
+		case <-time.After(f.RetryInterval):
+		}
+	}
+}
+
+func (f *Federator) mirrorStream(service string) error {
+	// Ensure the service exists locally.
+	if err := f.Store.AddService(service, nil); err != nil && !IsServiceExists(err) {
+		return err
+	}
+
+	// Watch the remote service.
+	events := make(chan *discoverd.Event, StreamBufferSize)
+	stream, err := f.Remote.Service(service).Watch(events)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	heartbeat := time.NewTicker(f.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// seen collects the instances sent before the "current" event so stale
+	// local mirrors can be pruned once the initial state is complete.
+	seen := make(map[string]struct{})
+	current := false
+
+	for {
+		select {
+		case <-f.closing:
+			return nil
+
+		case <-heartbeat.C:
+			f.renewLeases(service)
+
+		case event, ok := <-events:
+			if !ok {
+				return stream.Err()
+			}
+			switch event.Kind {
+			case discoverd.EventKindUp, discoverd.EventKindUpdate:
+				if !current {
+					seen[event.Instance.ID] = struct{}{}
+				}
+				if err := f.register(service, event.Instance); err != nil {
+					return err
+				}
+			case discoverd.EventKindDown:
+				if err := f.remove(service, event.Instance.ID); err != nil {
+					return err
+				}
+			case discoverd.EventKindCurrent:
+				current = true
+				if err := f.prune(service, seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// register mirrors a remote instance into the local store with the remote
+// datacenter injected into its metadata.
+func (f *Federator) register(service string, inst *discoverd.Instance) error {
+	other := inst.Clone()
+	other.Meta["dc"] = f.DC
+	if err := f.Store.AddInstance(service, other); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if f.mirrored[service] == nil {
+		f.mirrored[service] = make(map[string]struct{})
+	}
+	f.mirrored[service][inst.ID] = struct{}{}
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Federator) remove(service, id string) error {
+	f.mu.Lock()
+	delete(f.mirrored[service], id)
+	f.mu.Unlock()
+
+	if err := f.Store.RemoveInstance(service, id); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// prune removes local mirrors that are no longer registered on the remote
+// cluster, e.g. instances that went down while the stream was disconnected.
+func (f *Federator) prune(service string, seen map[string]struct{}) error {
+	f.mu.Lock()
+	var stale []string
+	for id := range f.mirrored[service] {
+		if _, ok := seen[id]; !ok {
+			stale = append(stale, id)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, id := range stale {
+		if err := f.remove(service, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewLeases heartbeats all mirrored instances of a service so they don't
+// expire while the remote watch stream is healthy.
+func (f *Federator) renewLeases(service string) {
+	f.mu.Lock()
+	ids := make([]string, 0, len(f.mirrored[service]))
+	for id := range f.mirrored[service] {
+		ids = append(ids, id)
+	}
+	f.mu.Unlock()
+
+	for _, id := range ids {
+		if err := f.Store.Heartbeat(service, id); err != nil && !IsNotFound(err) {
+			f.logf("federation: heartbeat %s/%s: %s", service, id, err)
+		}
+	}
+}
+
+func (f *Federator) logf(format string, args ...interface{}) {
+	if f.Logger != nil {
+		f.Logger.Printf(format, args...)
+	}
+}
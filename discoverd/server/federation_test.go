@@ -0,0 +1,79 @@
+package server_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// Ensure the federator mirrors a remote service into the local store with a
+// "dc" meta tag, and removes instances when they go down remotely.
+func TestFederator_Mirror(t *testing.T) {
+	// Run a fake remote cluster that streams events for the service.
+	remote := NewHandler()
+	events := make(chan *discoverd.Event)
+	remote.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		go func() {
+			for event := range events {
+				ch <- event
+			}
+			close(ch)
+		}()
+		return chanStream(ch)
+	}
+	srv := httptest.NewServer(remote)
+	defer srv.Close()
+
+	// Open a local store to mirror into.
+	s := MustOpenStore()
+	defer s.Close()
+
+	f := server.NewFederator("east", discoverd.NewClientWithURL(srv.URL), []string{"web"})
+	f.Store = s.Store
+	f.Start()
+	defer f.Close()
+
+	// Register an instance on the remote cluster.
+	inst := &discoverd.Instance{
+		ID:    "74667cebd845d088d811ddef924895b7",
+		Addr:  "localhost:10000",
+		Proto: "http",
+	}
+	events <- &discoverd.Event{Service: "web", Kind: discoverd.EventKindUp, Instance: inst}
+	events <- &discoverd.Event{Service: "web", Kind: discoverd.EventKindCurrent}
+
+	// Verify it is mirrored locally with the datacenter tag.
+	mirrored := waitForInstances(t, s.Store, "web", 1)
+	if mirrored[0].ID != inst.ID {
+		t.Fatalf("unexpected instance: %#v", mirrored[0])
+	} else if mirrored[0].Meta["dc"] != "east" {
+		t.Fatalf("unexpected meta: %#v", mirrored[0].Meta)
+	}
+
+	// Deregister the instance remotely and verify the mirror is removed.
+	events <- &discoverd.Event{Service: "web", Kind: discoverd.EventKindDown, Instance: inst}
+	waitForInstances(t, s.Store, "web", 0)
+}
+
+// waitForInstances polls the store until service has n instances, failing
+// the test if that doesn't happen within 5 seconds.
+func waitForInstances(t *testing.T, s *server.Store, service string, n int) []*discoverd.Instance {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instances, err := s.Instances(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) == n {
+			return instances
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d instances, have %d", n, len(instances))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
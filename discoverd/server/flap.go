@@ -0,0 +1,113 @@
+package server
+
+import (
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+const (
+	// DefaultFlapThreshold is the number of up/down transitions within
+	// FlapWindow after which an instance is considered flapping.
+	DefaultFlapThreshold = 6
+
+	// DefaultFlapWindow is the window up/down transitions are counted over.
+	DefaultFlapWindow = time.Minute
+
+	// DefaultFlapBackoff is how long a flapping instance's events are
+	// suppressed once the threshold is crossed.
+	DefaultFlapBackoff = time.Minute
+)
+
+// flapState tracks the recent up/down transitions of a single instance.
+type flapState struct {
+	transitions  []time.Time // transition times within the window, oldest first
+	backoffUntil time.Time   // events are suppressed until this time
+	heldDown     bool        // a final "down" was delivered and later events are being held
+}
+
+// damping returns true if the instance's events are currently suppressed.
+func (f *flapState) damping(now time.Time) bool {
+	return now.Before(f.backoffUntil)
+}
+
+// suppressFlap records an up or down transition for an instance and reports
+// whether the resulting event should be suppressed. An instance that cycles
+// more than FlapThreshold times within FlapWindow enters a backoff during
+// which subscribers are held at "down": the triggering "down" event is
+// delivered, subsequent events are swallowed, and the first "up" after the
+// instance stops cycling brings it back. Only broadcasts are damped — the
+// registrations themselves still apply, so reads reflect the true state.
+// Must be called with the store lock held.
+func (s *Store) suppressFlap(service, id string, kind discoverd.EventKind, now time.Time) bool {
+	if s.FlapThreshold <= 0 {
+		return false
+	}
+	s.sweepFlaps(now)
+
+	key := instanceKey{service, id}
+	f := s.flaps[key]
+	if f == nil {
+		f = &flapState{}
+		s.flaps[key] = f
+	}
+
+	// Drop transitions that have fallen outside the window and record the
+	// new one.
+	cutoff := now.Add(-s.FlapWindow)
+	keep := f.transitions[:0]
+	for _, t := range f.transitions {
+		if t.After(cutoff) {
+			keep = append(keep, t)
+		}
+	}
+	f.transitions = append(keep, now)
+
+	// Start, or extend, the backoff once the threshold is crossed, so an
+	// instance that keeps cycling stays suppressed.
+	if len(f.transitions) > s.FlapThreshold {
+		f.backoffUntil = now.Add(s.FlapBackoff)
+	}
+
+	if f.damping(now) {
+		// Let the first "down" through so subscribers converge on the
+		// instance being down, then swallow everything else.
+		if kind == discoverd.EventKindDown && !f.heldDown {
+			f.heldDown = true
+			return false
+		}
+		return true
+	}
+
+	f.heldDown = false
+	return false
+}
+
+// flapDamped reports whether events for an instance are currently suppressed,
+// without recording a transition. Must be called with the store lock held.
+func (s *Store) flapDamped(service, id string, now time.Time) bool {
+	if s.FlapThreshold <= 0 {
+		return false
+	}
+	f := s.flaps[instanceKey{service, id}]
+	return f != nil && f.damping(now)
+}
+
+// sweepFlaps lazily removes flap state for instances that have had no
+// transitions for a full window, at most once per window.
+func (s *Store) sweepFlaps(now time.Time) {
+	if now.Sub(s.lastFlapSweep) < s.FlapWindow {
+		return
+	}
+	s.lastFlapSweep = now
+
+	cutoff := now.Add(-s.FlapWindow)
+	for key, f := range s.flaps {
+		if f.damping(now) {
+			continue
+		}
+		if n := len(f.transitions); n == 0 || !f.transitions[n-1].After(cutoff) {
+			delete(s.flaps, key)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+
+	"github.com/flynn/flynn/discoverd/api"
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCHandler is the gRPC surface over the store. It exposes instance
+// registration, instance lists, leaders and a server-streaming Watch mapped
+// onto store subscriptions, so non-HTTP clients get protobuf-typed events
+// with backpressure handled by gRPC flow control.
+type GRPCHandler struct {
+	Store interface {
+		AddInstance(service string, inst *discoverd.Instance) error
+		RemoveInstance(service, id string) error
+		Instances(service string) ([]*discoverd.Instance, error)
+		ServiceLeader(service string) (*discoverd.Instance, error)
+		Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
+	}
+}
+
+// NewGRPCServer returns a gRPC server with the discoverd service registered
+// on it.
+func NewGRPCServer(h *GRPCHandler, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	api.RegisterDiscoverdServer(s, h)
+	return s
+}
+
+func (h *GRPCHandler) Register(ctx context.Context, req *api.RegisterRequest) (*api.RegisterResponse, error) {
+	inst := instanceFromProto(req.Instance)
+	if inst == nil {
+		return nil, status.Error(codes.InvalidArgument, "discoverd: instance must be set")
+	}
+	if err := inst.Valid(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	_, span := traceStart(ctx, "discoverd.store.AddInstance",
+		trace.StringAttribute("service", req.Service),
+		trace.StringAttribute("instance.id", inst.ID))
+	err := h.Store.AddInstance(req.Service, inst)
+	traceEnd(span, err)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	return &api.RegisterResponse{}, nil
+}
+
+func (h *GRPCHandler) Deregister(ctx context.Context, req *api.DeregisterRequest) (*api.DeregisterResponse, error) {
+	_, span := traceStart(ctx, "discoverd.store.RemoveInstance",
+		trace.StringAttribute("service", req.Service),
+		trace.StringAttribute("instance.id", req.InstanceId))
+	err := h.Store.RemoveInstance(req.Service, req.InstanceId)
+	traceEnd(span, err)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	return &api.DeregisterResponse{}, nil
+}
+
+func (h *GRPCHandler) List(ctx context.Context, req *api.ListRequest) (*api.ListResponse, error) {
+	instances, err := h.Store.Instances(req.Service)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	}
+	res := &api.ListResponse{Instances: make([]*api.Instance, len(instances))}
+	for i, inst := range instances {
+		res.Instances[i] = instanceToProto(inst)
+	}
+	return res, nil
+}
+
+func (h *GRPCHandler) Leader(ctx context.Context, req *api.LeaderRequest) (*api.Instance, error) {
+	leader, err := h.Store.ServiceLeader(req.Service)
+	if err != nil {
+		return nil, grpcStoreError(err)
+	} else if leader == nil {
+		return nil, status.Error(codes.NotFound, "discoverd: no leader found")
+	}
+	return instanceToProto(leader), nil
+}
+
+func (h *GRPCHandler) Watch(req *api.WatchRequest, ws api.Discoverd_WatchServer) error {
+	kinds := discoverd.EventKind(req.Kinds)
+	if kinds == 0 {
+		kinds = discoverd.EventKindAll
+	}
+
+	// Create a buffered channel to receive events.
+	ch := make(chan *discoverd.Event, StreamBufferSize)
+
+	// Subscribe to events on the store.
+	sub := h.Store.Subscribe(req.Service, req.SendCurrent, kinds, ch)
+	defer sub.Close()
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				// The subscription was closed by the store, e.g.
+				// because the stream could not keep up.
+				if err := sub.Err(); err != nil {
+					return status.Error(codes.ResourceExhausted, err.Error())
+				}
+				return nil
+			}
+			if err := ws.Send(eventToProto(event)); err != nil {
+				return err
+			}
+		case <-ws.Context().Done():
+			return ws.Context().Err()
+		}
+	}
+}
+
+// grpcStoreError maps store errors to gRPC statuses.
+func grpcStoreError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrNotLeader:
+		// Unlike the HTTP API there is no redirect; clients should retry
+		// against the current raft leader.
+		return status.Error(codes.Unavailable, err.Error())
+	case IsNotFound(err):
+		return status.Error(codes.NotFound, err.Error())
+	case IsServiceFrozen(err):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func instanceToProto(inst *discoverd.Instance) *api.Instance {
+	if inst == nil {
+		return nil
+	}
+	return &api.Instance{
+		Id:     inst.ID,
+		Addr:   inst.Addr,
+		Proto:  inst.Proto,
+		Meta:   inst.Meta,
+		Ttl:    uint32(inst.TTL),
+		State:  string(inst.State),
+		Index:  inst.Index,
+		Weight: uint32(inst.Weight),
+		Canary: inst.Canary,
+		Zone:   inst.Zone,
+
+		Annotations: inst.Annotations,
+	}
+}
+
+func instanceFromProto(inst *api.Instance) *discoverd.Instance {
+	if inst == nil {
+		return nil
+	}
+	return &discoverd.Instance{
+		ID:     inst.Id,
+		Addr:   inst.Addr,
+		Proto:  inst.Proto,
+		Meta:   inst.Meta,
+		TTL:    int(inst.Ttl),
+		State:  discoverd.InstanceState(inst.State),
+		Index:  inst.Index,
+		Weight: uint16(inst.Weight),
+		Canary: inst.Canary,
+		Zone:   inst.Zone,
+
+		Annotations: inst.Annotations,
+	}
+}
+
+func eventToProto(event *discoverd.Event) *api.Event {
+	return &api.Event{
+		Service:  event.Service,
+		Kind:     event.Kind.String(),
+		Instance: instanceToProto(event.Instance),
+	}
+}
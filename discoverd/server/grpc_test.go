@@ -0,0 +1,146 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/api"
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+	"github.com/flynn/flynn/pkg/stream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ensure the gRPC server can register instances and stream events.
+func TestGRPC_RegisterAndWatch(t *testing.T) {
+	store := &MockStore{}
+
+	var registered *discoverd.Instance
+	store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		registered = inst
+		return nil
+	}
+
+	events := make(chan *discoverd.Event, 1)
+	store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		} else if kinds != discoverd.EventKindAll {
+			t.Fatalf("unexpected kinds: %d", kinds)
+		}
+		go func() {
+			for event := range events {
+				ch <- event
+			}
+			close(ch)
+		}()
+		return chanStream(ch)
+	}
+
+	client, done := MustRunGRPCServer(t, store)
+	defer done()
+
+	// Register an instance.
+	inst := &discoverd.Instance{
+		ID:    "74667cebd845d088d811ddef924895b7",
+		Addr:  "localhost:10000",
+		Proto: "http",
+	}
+	if _, err := client.Register(context.Background(), &api.RegisterRequest{
+		Service: "abc",
+		Instance: &api.Instance{
+			Id:    inst.ID,
+			Addr:  inst.Addr,
+			Proto: inst.Proto,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	} else if registered == nil || registered.ID != inst.ID {
+		t.Fatalf("unexpected registered instance: %#v", registered)
+	}
+
+	// Watch the service and verify events are streamed.
+	watch, err := client.Watch(context.Background(), &api.WatchRequest{Service: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events <- &discoverd.Event{Service: "abc", Kind: discoverd.EventKindUp, Instance: inst}
+	if event, err := watch.Recv(); err != nil {
+		t.Fatal(err)
+	} else if event.Kind != "up" || event.Instance == nil || event.Instance.Id != inst.ID {
+		t.Fatalf("unexpected event: %s", event)
+	}
+
+	// Closing the subscription ends the stream cleanly.
+	close(events)
+	if _, err := watch.Recv(); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the gRPC server maps store errors to statuses.
+func TestGRPC_Deregister_ErrNotFound(t *testing.T) {
+	store := &MockStore{}
+	store.RemoveInstanceFn = func(service, id string) error {
+		return server.NotFoundError{Service: service, Instance: id}
+	}
+
+	client, done := MustRunGRPCServer(t, store)
+	defer done()
+
+	_, err := client.Deregister(context.Background(), &api.DeregisterRequest{Service: "abc", InstanceId: "xyz"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the gRPC server returns the list of instances.
+func TestGRPC_List(t *testing.T) {
+	store := &MockStore{}
+	store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Addr: "localhost:1111", Proto: "http", Index: 7},
+		}, nil
+	}
+
+	client, done := MustRunGRPCServer(t, store)
+	defer done()
+
+	res, err := client.List(context.Background(), &api.ListRequest{Service: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res.Instances) != 1 || res.Instances[0].Id != "inst0" || res.Instances[0].Index != 7 {
+		t.Fatalf("unexpected instances: %s", res)
+	}
+}
+
+// MustRunGRPCServer starts a gRPC server for the store on a local listener
+// and returns a connected client along with a function to tear both down.
+func MustRunGRPCServer(t *testing.T, store *MockStore) (api.DiscoverdClient, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewGRPCServer(&server.GRPCHandler{Store: store})
+	go s.Serve(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, ln.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	return api.NewDiscoverdClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
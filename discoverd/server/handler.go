@@ -2,29 +2,39 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/flynn/flynn/discoverd/api"
 	"github.com/flynn/flynn/discoverd/client"
 	dt "github.com/flynn/flynn/discoverd/types"
 	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/sse"
 	"github.com/flynn/flynn/pkg/status"
-	"github.com/flynn/flynn/pkg/stream"
 	log "github.com/inconshreveable/log15"
 	"github.com/julienschmidt/httprouter"
+	"go.opencensus.io/trace"
 )
 
 // StreamBufferSize is the size of the channel buffer used for event subscription.
 const StreamBufferSize = 64 // TODO: Figure out how big this buffer should be.
 
+// DefaultLongPollTimeout and MaxLongPollTimeout bound how long an instances
+// GET with an If-None-Match index is held open waiting for a change.
+const (
+	DefaultLongPollTimeout = 30 * time.Second
+	MaxLongPollTimeout     = 5 * time.Minute
+)
+
 func loggerFn(handler http.Handler, logger log.Logger, clientIP string, rw *hh.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	handler.ServeHTTP(rw, req)
@@ -36,48 +46,133 @@ func loggerFn(handler http.Handler, logger log.Logger, clientIP string, rw *hh.R
 }
 
 // NewHandler returns a new instance of Handler.
+//
+// The handler is the HTTP surface over the store: it exposes PUT/DELETE for
+// instance registration, GET for instance lists, leaders and metadata, and a
+// streaming watch endpoint over SSE. The full surface is described by the
+// OpenAPI specification served at /openapi.json.
 func NewHandler(proxy bool, peers []string) *Handler {
 	r := httprouter.New()
 
-	h := &Handler{Handler: r}
+	h := &Handler{Handler: r, idempotency: newIdempotencyCache()}
 	h.Shutdown.Store(false)
 
 	h.Peers = peers
 	h.Proxy.Store(proxy)
+	h.primary.Store("")
 
 	if os.Getenv("DEBUG") != "" {
 		h.Handler = hh.ContextInjector("discoverd", hh.NewRequestLoggerCustom(h.Handler, loggerFn))
 	}
+	h.Handler = traceHandler(h.Handler)
 
 	r.HandlerFunc("GET", status.Path, status.HealthyHandler.ServeHTTP)
 
-	r.PUT("/services/:service", h.servePutService)
-	r.DELETE("/services/:service", h.serveDeleteService)
-	r.GET("/services/:service", h.serveGetService)
-
-	r.PUT("/services/:service/meta", h.servePutServiceMeta)
-	r.GET("/services/:service/meta", h.serveGetServiceMeta)
-
-	r.PUT("/services/:service/instances/:instance_id", h.servePutInstance)
-	r.DELETE("/services/:service/instances/:instance_id", h.serveDeleteInstance)
-	r.GET("/services/:service/instances", h.serveGetInstances)
-
-	r.PUT("/services/:service/leader", h.servePutLeader)
-	r.GET("/services/:service/leader", h.serveGetLeader)
-
-	r.GET("/raft/leader", h.serveGetRaftLeader)
-	r.GET("/raft/peers", h.serveGetRaftPeers)
-	r.PUT("/raft/peers/:peer", h.servePutRaftPeer)
-	r.DELETE("/raft/peers/:peer", h.serveDeleteRaftPeer)
-	r.POST("/raft/promote", h.servePromote)
-	r.POST("/raft/demote", h.serveDemote)
+	// register adds a route to the router and records it so the route list
+	// can be verified against the OpenAPI specification.
+	register := func(method, path string, handle httprouter.Handle) {
+		r.Handle(method, path, handle)
+		h.routes = append(h.routes, Route{Method: method, Path: path})
+	}
 
-	r.GET("/ping", h.servePing)
+	register("GET", "/services", h.serveGetServices)
+	register("PUT", "/services/:service", h.authorized(h.servePutService))
+	register("DELETE", "/services/:service", h.authorized(h.serveDeleteService))
+	register("GET", "/services/:service", h.serveGetService)
+
+	register("GET", "/removals/:removal_id", h.serveGetServiceRemoval)
+
+	register("PUT", "/services/:service/freeze", h.authorized(h.idempotent(h.serveFreezeService)))
+	register("DELETE", "/services/:service/freeze", h.authorized(h.idempotent(h.serveUnfreezeService)))
+
+	register("PUT", "/services/:service/rename", h.authorized(h.idempotent(h.servePutRename)))
+	register("DELETE", "/aliases/:alias", h.authorized(h.idempotent(h.serveDeleteAlias)))
+
+	register("PUT", "/services/:service/config", h.authorized(h.idempotent(h.servePutServiceConfig)))
+	register("GET", "/services/:service/config", h.serveGetServiceConfig)
+
+	register("PUT", "/services/:service/meta", h.authorized(h.servePutServiceMeta))
+	register("GET", "/services/:service/meta", h.serveGetServiceMeta)
+
+	register("PUT", "/services/:service/instances/:instance_id", h.authorized(h.idempotent(h.servePutInstance)))
+	register("DELETE", "/services/:service/instances/:instance_id", h.authorized(h.idempotent(h.serveDeleteInstance)))
+	register("PUT", "/services/:service/instances/:instance_id/drain", h.authorized(h.idempotent(h.serveDrainInstance)))
+	register("PUT", "/services/:service/instances/:instance_id/maintenance", h.authorized(h.idempotent(h.servePutMaintenance)))
+	register("DELETE", "/services/:service/instances/:instance_id/maintenance", h.authorized(h.idempotent(h.serveDeleteMaintenance)))
+	register("PUT", "/services/:service/instances", h.authorized(h.idempotent(h.servePutServiceInstances)))
+	register("GET", "/services/:service/instances", h.serveGetInstances)
+	register("GET", "/services/:service/state", h.serveGetServiceState)
+	register("GET", "/services/:service/history", h.serveGetHistory)
+	register("GET", "/services/:service/watch", h.serveWatch)
+
+	register("PUT", "/instances", h.authorized(h.idempotent(h.servePutInstances)))
+	register("POST", "/transactions", h.authorized(h.idempotent(h.servePostTransaction)))
+
+	register("PUT", "/services/:service/leader", h.authorized(h.idempotent(h.servePutLeader)))
+	register("GET", "/services/:service/leader", h.serveGetLeader)
+	register("POST", "/services/:service/failover", h.authorized(h.idempotent(h.serveFailoverLeader)))
+
+	register("GET", "/raft/leader", h.serveGetRaftLeader)
+	register("GET", "/raft/peers", h.serveGetRaftPeers)
+	register("PUT", "/raft/peers/:peer", h.authorized(h.servePutRaftPeer))
+	register("DELETE", "/raft/peers/:peer", h.authorized(h.serveDeleteRaftPeer))
+	register("POST", "/raft/promote", h.authorized(h.servePromote))
+	register("POST", "/raft/demote", h.authorized(h.serveDemote))
+
+	register("GET", "/stats", h.serveGetStats)
+	register("GET", "/metrics", h.serveGetMetrics)
+	register("GET", "/prometheus/sd", h.serveGetPrometheusSD)
+	register("GET", "/audit", h.serveGetAudit)
+
+	register("GET", "/webhooks", h.serveGetWebhooks)
+	register("PUT", "/webhooks/:id", h.authorized(h.servePutWebhook))
+	register("DELETE", "/webhooks/:id", h.authorized(h.serveDeleteWebhook))
+	register("GET", "/digests", h.serveGetDigests)
+	register("GET", "/subscribers", h.serveGetSubscribers)
+	register("GET", "/dependencies", h.serveGetDependencies)
+
+	register("GET", "/cluster/members", h.serveGetClusterMembers)
+	register("PUT", "/cluster/members/:peer", h.authorized(h.servePutClusterMember))
+	register("DELETE", "/cluster/members/:peer", h.authorized(h.serveDeleteClusterMember))
+
+	register("GET", "/cluster/export", h.serveGetClusterExport)
+	register("POST", "/cluster/import", h.authorized(h.idempotent(h.servePostClusterImport)))
+
+	register("GET", "/legacy/services", h.serveV1Services)
+	register("GET", "/legacy/services/:service", h.serveV1Service)
+
+	register("GET", "/v1/catalog/services", h.serveConsulCatalogServices)
+	register("GET", "/v1/catalog/service/:service", h.serveConsulCatalogService)
+	register("GET", "/v1/health/service/:service", h.serveConsulHealthService)
+
+	register("GET", "/ping", h.servePing)
+
+	register("POST", "/shutdown", h.authorized(h.serveShutdown))
+
+	register("GET", "/openapi.json", h.serveOpenAPI)
+
+	// Envoy's REST-JSON xDS transport posts to a path containing a literal
+	// colon, which the router would parse as a parameter, so it is matched
+	// before routing.
+	routed := h.Handler
+	h.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == xdsEndpointsPath {
+			h.serveXDSEndpoints(w, r)
+			return
+		}
+		routed.ServeHTTP(w, r)
+	})
+	h.routes = append(h.routes, Route{Method: "POST", Path: xdsEndpointsPath})
 
-	r.POST("/shutdown", h.serveShutdown)
 	return h
 }
 
+// Route represents a method and path registered on the handler.
+type Route struct {
+	Method string
+	Path   string
+}
+
 // Handler represents an HTTP handler for the Store.
 type Handler struct {
 	http.Handler
@@ -89,28 +184,43 @@ type Handler struct {
 		Promote() error
 		Demote() error
 	}
-	Store interface {
-		Leader() string
-		AddService(service string, config *discoverd.ServiceConfig) error
-		RemoveService(service string) error
-		SetServiceMeta(service string, meta *discoverd.ServiceMeta) error
-		ServiceMeta(service string) *discoverd.ServiceMeta
-		AddInstance(service string, inst *discoverd.Instance) error
-		RemoveInstance(service, id string) error
-		Instances(service string) ([]*discoverd.Instance, error)
-		Config(service string) *discoverd.ServiceConfig
-		SetServiceLeader(service, id string) error
-		ServiceLeader(service string) (*discoverd.Instance, error)
-		Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
-
-		AddPeer(peer string) error
-		RemovePeer(peer string) error
-		GetPeers() ([]string, error)
-		LastIndex() uint64
-	}
+	Store Backend
 	Peers []string
+
+	// Webhooks delivers events to registered webhook URLs. Nil disables
+	// the webhook endpoints.
+	Webhooks *WebhookDispatcher
+
+	// ACL controls which tokens may perform write operations. Nil disables
+	// authentication.
+	ACL *ACL
+
+	// AddrMapper rewrites instance addresses for clients outside the
+	// internal networks. Nil disables address mapping.
+	AddrMapper *AddrMapper
+
+	routes      []Route
+	idempotency *idempotencyCache
+	primary     atomic.Value // string
 }
 
+// SetReadOnly puts the handler into read-only replica mode, serving reads,
+// watches and DNS from the locally mirrored store while redirecting write
+// requests to the primary host. An empty primary disables replica mode,
+// e.g. after a standby promotes itself.
+func (h *Handler) SetReadOnly(primary string) {
+	h.primary.Store(primary)
+}
+
+// isWriteRequest returns whether a request mutates the registry and so must
+// be handled by the primary when running as a read-only replica.
+func isWriteRequest(r *http.Request) bool {
+	return r.Method != "GET" && r.Method != "HEAD"
+}
+
+// Routes returns the routes registered on the handler.
+func (h *Handler) Routes() []Route { return h.routes }
+
 // Whitelisted endpoints won't be proxied.
 func proxyWhitelisted(r *http.Request) bool {
 	for _, url := range []string{"/raft/promote", "/raft/demote", "/shutdown"} {
@@ -134,6 +244,11 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			redirectToHost(w, r, host)
 			return
 		}
+	} else if primary := h.primary.Load().(string); primary != "" && isWriteRequest(r) && !proxyWhitelisted(r) {
+		// Read-only replica: serve reads from the mirrored store but
+		// send writes to the primary.
+		redirectToHost(w, r, primary)
+		return
 	} else {
 		// Send current peer list and index to the client so it can keep the list of
 		// peers in sync with the cluster.
@@ -164,18 +279,67 @@ func (h *Handler) servePutService(w http.ResponseWriter, r *http.Request, params
 	}
 
 	// Add the service to the store.
-	if err := h.Store.AddService(service, config); err == ErrNotLeader {
+	_, span := traceStart(r.Context(), "discoverd.store.AddService",
+		trace.StringAttribute("service", service))
+	err := h.Store.AddService(service, config)
+	traceEnd(span, err)
+	if err == ErrNotLeader {
 		h.redirectToLeader(w, r)
 		return
 	} else if IsServiceExists(err) {
 		hh.ObjectExistsError(w, err.Error())
 		return
+	} else if IsLimitError(err) || IsProfileError(err) {
+		hh.ValidationError(w, "", err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// servePutServiceConfig updates the configuration of an existing service.
+func (h *Handler) servePutServiceConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve the path parameter.
+	service := params.ByName("service")
+	if err := ValidServiceName(service); err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+
+	// Read config from the request.
+	config := &discoverd.ServiceConfig{}
+	if err := hh.DecodeJSON(r, config); err != nil {
+		hh.Error(w, err)
+		return
+	}
+
+	// Update the service configuration in the store.
+	if err := h.Store.SetServiceConfig(service, config); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsProfileError(err) {
+		hh.ValidationError(w, "", err.Error())
+		return
 	} else if err != nil {
 		hh.Error(w, err)
 		return
 	}
 }
 
+// serveGetServiceConfig returns the configuration of a service.
+func (h *Handler) serveGetServiceConfig(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	config := h.Store.Config(params.ByName("service"))
+	if config == nil {
+		hh.ObjectNotFoundError(w, fmt.Sprintf("service not found: %q", params.ByName("service")))
+		return
+	}
+	hh.JSON(w, 200, config)
+}
+
 // serveDeleteService removes a service from the store by name.
 func (h *Handler) serveDeleteService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	// Retrieve the path parameter.
@@ -185,8 +349,26 @@ func (h *Handler) serveDeleteService(w http.ResponseWriter, r *http.Request, par
 		return
 	}
 
+	// Remove asynchronously if requested, responding with a job that can be
+	// polled for broadcast completion.
+	if r.FormValue("async") == "true" {
+		jobID, err := h.Store.RemoveServiceAsync(service)
+		if err == ErrNotLeader {
+			h.redirectToLeader(w, r)
+			return
+		} else if IsNotFound(err) {
+			hh.ObjectNotFoundError(w, err.Error())
+			return
+		} else if err != nil {
+			hh.Error(w, err)
+			return
+		}
+		hh.JSON(w, http.StatusAccepted, h.Store.ServiceRemoval(jobID))
+		return
+	}
+
 	// Delete from the store.
-	if err := h.Store.RemoveService(params.ByName("service")); err == ErrNotLeader {
+	if err := h.Store.RemoveService(service); err == ErrNotLeader {
 		h.redirectToLeader(w, r)
 		return
 	} else if IsNotFound(err) {
@@ -198,15 +380,35 @@ func (h *Handler) serveDeleteService(w http.ResponseWriter, r *http.Request, par
 	}
 }
 
+// serveGetServiceRemoval returns the status of an asynchronous service
+// removal job.
+func (h *Handler) serveGetServiceRemoval(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	job := h.Store.ServiceRemoval(params.ByName("removal_id"))
+	if job == nil {
+		hh.ObjectNotFoundError(w, "discoverd: removal job not found")
+		return
+	}
+	hh.JSON(w, 200, job)
+}
+
 // serveGetService streams service events to the client.
 func (h *Handler) serveGetService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	// This should only return a stream if the Accept header is
-	// text/event-stream (and return a 406 otherwise), but we
-	// always return a stream due to Go's http.Client not
+	// text/event-stream or ?watch=true is set (and return a 406 otherwise),
+	// but we always return a stream due to Go's http.Client not
 	// maintaining headers through a redirect.
 	//
 	// See https://github.com/flynn/flynn/issues/1880
-	h.serveStream(w, params, discoverd.EventKindAll)
+	h.serveStream(w, r, params, discoverd.EventKindAll)
+}
+
+// wantsStream reports whether the client is requesting an SSE stream, either
+// via the Accept header or the "watch" query parameter. The latter exists so
+// browser dashboards and curl-based tooling can watch changes without setting
+// headers.
+func wantsStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream") ||
+		r.FormValue("watch") == "true"
 }
 
 // serveServiceMeta sets the metadata for a service.
@@ -219,7 +421,11 @@ func (h *Handler) servePutServiceMeta(w http.ResponseWriter, r *http.Request, pa
 	}
 
 	// Update the meta in the store.
-	if err := h.Store.SetServiceMeta(params.ByName("service"), meta); err == ErrNotLeader {
+	_, span := traceStart(r.Context(), "discoverd.store.SetServiceMeta",
+		trace.StringAttribute("service", params.ByName("service")))
+	err := h.Store.SetServiceMeta(params.ByName("service"), meta)
+	traceEnd(span, err)
+	if err == ErrNotLeader {
 		h.redirectToLeader(w, r)
 		return
 	} else if IsNotFound(err) {
@@ -250,45 +456,48 @@ func (h *Handler) serveGetServiceMeta(w http.ResponseWriter, r *http.Request, pa
 	hh.JSON(w, 200, meta)
 }
 
-// servePutInstance adds an instance to a service.
-func (h *Handler) servePutInstance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	// Read path parameter.
+// servePutRename renames a service, leaving an alias behind under the old
+// name for a transition window.
+func (h *Handler) servePutRename(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve the path parameter.
 	service := params.ByName("service")
+	if err := ValidServiceName(service); err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
 
-	// Read instance from request.
-	inst := &discoverd.Instance{}
-	if err := json.NewDecoder(r.Body).Decode(inst); err != nil {
+	// Read the new name from the request.
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		hh.Error(w, err)
 		return
 	}
-
-	// Ensure instance is valid.
-	if err := inst.Valid(); err != nil {
-		hh.ValidationError(w, "", err.Error())
+	if err := ValidServiceName(req.Name); err != nil {
+		hh.ValidationError(w, "name", err.Error())
 		return
 	}
 
-	// Add instance to service in the store.
-	if err := h.Store.AddInstance(service, inst); err == ErrNotLeader {
+	// Rename the service in the store.
+	if err := h.Store.RenameService(service, req.Name); err == ErrNotLeader {
 		h.redirectToLeader(w, r)
 		return
 	} else if IsNotFound(err) {
 		hh.ObjectNotFoundError(w, err.Error())
 		return
+	} else if IsServiceExists(err) {
+		hh.ObjectExistsError(w, err.Error())
+		return
 	} else if err != nil {
 		hh.Error(w, err)
 		return
 	}
 }
 
-// serveDeleteInstance removes an instance from the store by name.
-func (h *Handler) serveDeleteInstance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	// Retrieve path parameters.
-	service := params.ByName("service")
-	instanceID := params.ByName("instance_id")
-
-	// Remove instance from the store.
-	if err := h.Store.RemoveInstance(service, instanceID); err == ErrNotLeader {
+// serveDeleteAlias retires an alias left behind by a rename.
+func (h *Handler) serveDeleteAlias(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := h.Store.RetireAlias(params.ByName("alias")); err == ErrNotLeader {
 		h.redirectToLeader(w, r)
 		return
 	} else if IsNotFound(err) {
@@ -300,126 +509,1128 @@ func (h *Handler) serveDeleteInstance(w http.ResponseWriter, r *http.Request, pa
 	}
 }
 
-// serveGetInstances returns a list of all instances for a service.
-func (h *Handler) serveGetInstances(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	// If the client is requesting a stream, then handle as a stream.
-	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		h.serveStream(w, params, discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown)
+// serveFreezeService freezes writes to a service.
+func (h *Handler) serveFreezeService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.serveSetServiceFrozen(w, r, params, true)
+}
+
+// serveUnfreezeService unfreezes writes to a service.
+func (h *Handler) serveUnfreezeService(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.serveSetServiceFrozen(w, r, params, false)
+}
+
+func (h *Handler) serveSetServiceFrozen(w http.ResponseWriter, r *http.Request, params httprouter.Params, frozen bool) {
+	// Retrieve the path parameter.
+	service := params.ByName("service")
+	if err := ValidServiceName(service); err != nil {
+		hh.ValidationError(w, "", err.Error())
 		return
 	}
 
-	// Otherwise read instances from the store.
-	instances, err := h.Store.Instances(params.ByName("service"))
-	if err != nil {
-		hh.Error(w, err)
+	// Update the freeze state in the store.
+	if err := h.Store.SetServiceFrozen(service, frozen); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
 		return
-	} else if instances == nil {
-		hh.ObjectNotFoundError(w, fmt.Sprintf("service not found: %q", params.ByName("service")))
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
 		return
 	}
-
-	// Write instances to the response.
-	hh.JSON(w, 200, instances)
 }
 
-// servePutLeader sets the leader for a service.
-func (h *Handler) servePutLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	// Retrieve path parameters.
+// servePutInstance adds an instance to a service.
+func (h *Handler) servePutInstance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Read path parameter.
 	service := params.ByName("service")
 
-	// Check if the service allows manual leader election.
-	config := h.Store.Config(service)
-	if config == nil || config.LeaderType != discoverd.LeaderTypeManual {
-		hh.ValidationError(w, "", "service leader election type is not manual")
+	// Read instance from request, decoding protobuf if the client sent it.
+	inst := &discoverd.Instance{}
+	if sendsProto(r) {
+		pb := &api.Instance{}
+		if err := readProto(r, pb); err != nil {
+			hh.Error(w, err)
+			return
+		}
+		inst = instanceFromProto(pb)
+	} else if err := json.NewDecoder(r.Body).Decode(inst); err != nil {
+		hh.Error(w, err)
 		return
 	}
 
-	// Read instance from the request.
-	inst := &discoverd.Instance{}
-	if err := hh.DecodeJSON(r, inst); err != nil {
-		hh.Error(w, err)
+	// Ensure instance is valid.
+	if err := inst.Valid(); err != nil {
+		hh.ValidationError(w, "", err.Error())
 		return
 	}
 
-	// Manually set the leader on the service.
-	if err := h.Store.SetServiceLeader(service, inst.ID); err == ErrNotLeader {
+	// Check the If-Match precondition, if any.
+	if !h.checkIfMatch(w, r, service, inst.ID) {
+		return
+	}
+
+	// Validate the requested write consistency. Writes commit through the
+	// raft log regardless, so the requested level is a floor on
+	// durability, not a behavior switch.
+	if _, err := ParseWriteConsistency(r.URL.Query().Get("consistency")); err != nil {
+		hh.ValidationError(w, "consistency", err.Error())
+		return
+	}
+
+	// Add instance to service in the store.
+	_, span := traceStart(r.Context(), "discoverd.store.AddInstance",
+		trace.StringAttribute("service", service),
+		trace.StringAttribute("instance.id", inst.ID))
+	err := h.Store.AddInstance(service, inst)
+	traceEnd(span, err)
+	if err == ErrNotLeader {
 		h.redirectToLeader(w, r)
 		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if IsLimitError(err) || IsProfileError(err) {
+		hh.ValidationError(w, "", err.Error())
+		return
 	} else if err != nil {
 		hh.Error(w, err)
 		return
 	}
+
+	// Report the replication level the acknowledged write achieved.
+	w.Header().Set("Discoverd-Consistency", string(h.Store.WriteConsistency()))
 }
 
-// serveGetLeader returns the current leader for a service.
-func (h *Handler) serveGetLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	// Process as a stream if that's what the client wants.
-	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-		h.serveStream(w, params, discoverd.EventKindLeader)
+// servePutInstances registers a batch of instances atomically.
+func (h *Handler) servePutInstances(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Read registrations from the request.
+	var regs []*discoverd.Registration
+	if err := json.NewDecoder(r.Body).Decode(&regs); err != nil {
+		hh.Error(w, err)
 		return
 	}
 
-	// Otherwise retrieve the current leader.
-	service := params.ByName("service")
-	leader, err := h.Store.ServiceLeader(service)
-	if err != nil {
-		hh.Error(w, err)
+	// Ensure all registrations are valid before applying any of them.
+	for _, reg := range regs {
+		if err := ValidServiceName(reg.Service); err != nil {
+			hh.ValidationError(w, "", err.Error())
+			return
+		}
+		if reg.Instance == nil {
+			hh.ValidationError(w, "", "discoverd: instance must not be null")
+			return
+		}
+		if err := reg.Instance.Valid(); err != nil {
+			hh.ValidationError(w, "", err.Error())
+			return
+		}
+	}
+
+	// Validate the requested write consistency.
+	if _, err := ParseWriteConsistency(r.URL.Query().Get("consistency")); err != nil {
+		hh.ValidationError(w, "consistency", err.Error())
 		return
-	} else if leader == nil {
-		hh.ObjectNotFoundError(w, "no leader found")
+	}
+
+	// Add the batch to the store.
+	if err := h.Store.AddInstances(regs); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if IsLimitError(err) || IsProfileError(err) {
+		hh.ValidationError(w, "", err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
 		return
 	}
 
-	// Write leader to the response.
-	hh.JSON(w, 200, leader)
+	// Report the replication level the acknowledged write achieved.
+	w.Header().Set("Discoverd-Consistency", string(h.Store.WriteConsistency()))
 }
 
-// servePing returns a 200 OK.
-func (h *Handler) servePing(w http.ResponseWriter, r *http.Request, params httprouter.Params) {}
+// servePutServiceInstances registers a batch of instances under one service
+// atomically.
+func (h *Handler) servePutServiceInstances(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve the path parameter.
+	service := params.ByName("service")
+	if err := ValidServiceName(service); err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
 
-func (h *Handler) serveShutdown(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	// deregister the server before marking as shutdown as deregistration
-	// is performed using the HTTP server
-	if err := h.Main.Deregister(); err != nil {
+	// Read instances from the request.
+	var instances []*discoverd.Instance
+	if err := json.NewDecoder(r.Body).Decode(&instances); err != nil {
 		hh.Error(w, err)
 		return
 	}
-	h.Shutdown.Store(true)
-	targetLogIndex, err := h.Main.Close()
-	if err != nil {
+
+	// Ensure all instances are valid before applying any of them.
+	for _, inst := range instances {
+		if inst == nil {
+			hh.ValidationError(w, "", "discoverd: instance must not be null")
+			return
+		}
+		if err := inst.Valid(); err != nil {
+			hh.ValidationError(w, "", err.Error())
+			return
+		}
+	}
+
+	// Validate the requested write consistency.
+	if _, err := ParseWriteConsistency(r.URL.Query().Get("consistency")); err != nil {
+		hh.ValidationError(w, "consistency", err.Error())
+		return
+	}
+
+	// Add the batch to the store.
+	if err := h.Store.AddServiceInstances(service, instances); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if IsLimitError(err) || IsProfileError(err) {
+		hh.ValidationError(w, "", err.Error())
+		return
+	} else if err != nil {
 		hh.Error(w, err)
 		return
 	}
-	hh.JSON(w, 200, targetLogIndex)
+
+	// Report the replication level the acknowledged write achieved.
+	w.Header().Set("Discoverd-Consistency", string(h.Store.WriteConsistency()))
 }
 
-// servePromote attempts to promote this discoverd peer to a raft peer
-func (h *Handler) servePromote(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	if err := h.Main.Promote(); err != nil {
+// servePostTransaction applies a set of mutations across services
+// atomically.
+func (h *Handler) servePostTransaction(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Read operations from the request.
+	var ops []*TxOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
 		hh.Error(w, err)
 		return
 	}
-}
+	if len(ops) == 0 {
+		hh.ValidationError(w, "", "discoverd: transaction must contain at least one op")
+		return
+	}
 
-// serveDemote attempts to demote this peer from a raft peer to a proxy
-func (h *Handler) serveDemote(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	if err := h.Main.Demote(); err != nil {
+	// Ensure all operations are valid before applying any of them.
+	for _, op := range ops {
+		if op == nil {
+			hh.ValidationError(w, "", "discoverd: transaction op must not be null")
+			return
+		}
+		if err := ValidServiceName(op.Service); err != nil {
+			hh.ValidationError(w, "", err.Error())
+			return
+		}
+		switch op.Op {
+		case TxOpAddInstance:
+			if op.Instance == nil {
+				hh.ValidationError(w, "", "discoverd: transaction op \"add_instance\" requires an instance")
+				return
+			}
+			if err := op.Instance.Valid(); err != nil {
+				hh.ValidationError(w, "", err.Error())
+				return
+			}
+		case TxOpRemoveInstance, TxOpSetLeader:
+			if op.ID == "" {
+				hh.ValidationError(w, "", fmt.Sprintf("discoverd: transaction op %q requires an instance id", op.Op))
+				return
+			}
+		default:
+			hh.ValidationError(w, "", fmt.Sprintf("discoverd: invalid transaction op %q", op.Op))
+			return
+		}
+	}
+
+	// Apply the transaction to the store.
+	if err := h.Store.Transact(ops); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if IsLimitError(err) || IsProfileError(err) {
+		hh.ValidationError(w, "", err.Error())
+		return
+	} else if err != nil {
 		hh.Error(w, err)
 		return
 	}
 }
 
-// serveStream creates a subscription and streams out events in SSE format.
-func (h *Handler) serveStream(w http.ResponseWriter, params httprouter.Params, kind discoverd.EventKind) {
-	// Create a buffered channel to receive events.
-	ch := make(chan *discoverd.Event, StreamBufferSize)
-
-	// Subscribe to events on the store.
+// serveDeleteInstance removes an instance from the store by name.
+func (h *Handler) serveDeleteInstance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve path parameters.
 	service := params.ByName("service")
-	stream := h.Store.Subscribe(service, true, kind, ch)
+	instanceID := params.ByName("instance_id")
 
-	// Create and serve an SSE stream.
-	s := sse.NewStream(w, ch, nil)
+	// Check the If-Match precondition, if any.
+	if !h.checkIfMatch(w, r, service, instanceID) {
+		return
+	}
+
+	// Remove instance from the store.
+	_, span := traceStart(r.Context(), "discoverd.store.RemoveInstance",
+		trace.StringAttribute("service", service),
+		trace.StringAttribute("instance.id", instanceID))
+	err := h.Store.RemoveInstance(service, instanceID)
+	traceEnd(span, err)
+	if err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+func (h *Handler) serveDrainInstance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve path parameters.
+	service := params.ByName("service")
+	instanceID := params.ByName("instance_id")
+
+	// Mark the instance as draining in the store.
+	if err := h.Store.Drain(service, instanceID); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// servePutMaintenance puts an instance into maintenance, pulling it from
+// rotation while keeping it registered.
+func (h *Handler) servePutMaintenance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.setMaintenance(w, r, params, true)
+}
+
+// serveDeleteMaintenance takes an instance out of maintenance.
+func (h *Handler) serveDeleteMaintenance(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.setMaintenance(w, r, params, false)
+}
+
+func (h *Handler) setMaintenance(w http.ResponseWriter, r *http.Request, params httprouter.Params, maintenance bool) {
+	// Retrieve path parameters.
+	service := params.ByName("service")
+	instanceID := params.ByName("instance_id")
+
+	// Update the maintenance state in the store.
+	if err := h.Store.SetMaintenance(service, instanceID, maintenance); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// checkIfMatch verifies an If-Match header, if present, against the current
+// raft index of the instance. It writes a 412 response and returns false when
+// the supplied index is stale, mirroring the CAS semantics of service
+// metadata at the HTTP layer.
+func (h *Handler) checkIfMatch(w http.ResponseWriter, r *http.Request, service, instanceID string) bool {
+	match := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if match == "" {
+		return true
+	}
+
+	index, err := strconv.ParseUint(match, 10, 64)
+	if err != nil {
+		hh.ValidationError(w, "If-Match", "discoverd: index must be an integer")
+		return false
+	}
+
+	instances, err := h.Store.Instances(service)
+	if err != nil {
+		hh.Error(w, err)
+		return false
+	}
+	var current uint64
+	for _, inst := range instances {
+		if inst.ID == instanceID {
+			current = inst.Index
+			break
+		}
+	}
+	if current != index {
+		hh.Error(w, hh.PreconditionFailedErr(fmt.Sprintf("discoverd: instance index is %d, not %d", current, index)))
+		return false
+	}
+	return true
+}
+
+// waitForChange implements long-polling on instance reads for environments
+// where proxies terminate streaming connections: the request is held until
+// the service's event index moves past the index in the If-None-Match header
+// or the wait elapses. It returns true when the caller should serve the
+// listing, and false when it has already written a 304 or an error response.
+func (h *Handler) waitForChange(w http.ResponseWriter, r *http.Request, service, match string) bool {
+	index, err := strconv.ParseUint(match, 10, 64)
+	if err != nil {
+		hh.ValidationError(w, "If-None-Match", "discoverd: index must be an integer")
+		return false
+	}
+
+	timeout := DefaultLongPollTimeout
+	if s := r.URL.Query().Get("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			hh.ValidationError(w, "wait", "discoverd: wait must be a positive duration")
+			return false
+		}
+		if d > MaxLongPollTimeout {
+			d = MaxLongPollTimeout
+		}
+		timeout = d
+	}
+
+	// Subscribe before reading the current index so a change between the
+	// read and the wait is not missed.
+	events := make(chan *discoverd.Event, StreamBufferSize)
+	stream := h.Store.Subscribe(service, false, discoverd.EventKindAll, events)
+	defer stream.Close()
+
+	instances, current, err := h.Store.GetWithIndex(service, nil)
+	if err != nil {
+		hh.Error(w, err)
+		return false
+	}
+	if instances == nil || current != index {
+		// The service has already moved past (or does not exist); let the
+		// caller answer immediately.
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case _, ok := <-events:
+		if ok {
+			return true
+		}
+	case <-timer.C:
+	case <-r.Context().Done():
+		return false
+	}
+
+	// Nothing changed within the wait (or the subscription closed), so
+	// answer 304 with the index the client already has.
+	w.Header().Set("Discoverd-Event-Index", strconv.FormatUint(index, 10))
+	w.WriteHeader(http.StatusNotModified)
+	return false
+}
+
+// serveGetInstances returns a list of all instances for a service.
+func (h *Handler) serveGetInstances(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// If the client is requesting a stream, then handle as a stream.
+	if wantsStream(r) {
+		h.serveStream(w, r, params, discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown)
+		return
+	}
+
+	// A client that passes its last seen event index long-polls: the
+	// request is held until the service changes or the wait elapses.
+	if match := strings.Trim(r.Header.Get("If-None-Match"), `"`); match != "" {
+		if !h.waitForChange(w, r, params.ByName("service"), match) {
+			return
+		}
+	}
+
+	// Parse sorting and pagination parameters.
+	opts, err := parseListOptions(r, "index", "addr", "weight")
+	if err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+
+	// Parse the metadata selector, if given.
+	selector, err := parseSelectorParam(r)
+	if err != nil {
+		hh.ValidationError(w, "selector", err.Error())
+		return
+	}
+
+	// Parse the canary filter, if given.
+	canary, err := parseCanaryParam(r)
+	if err != nil {
+		hh.ValidationError(w, "canary", err.Error())
+		return
+	}
+
+	// Parse the caller's zone, if given.
+	zone := r.FormValue("zone")
+
+	// Negotiate the response schema version.
+	apiVersion, err := negotiateAPIVersion(w, r)
+	if err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+
+	// Otherwise read instances from the store, along with the current event
+	// index so clients can resume a stream exactly where the read left off.
+	instances, eventIndex, err := h.Store.GetWithIndex(params.ByName("service"), selector)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	} else if instances == nil {
+		hh.ObjectNotFoundError(w, fmt.Sprintf("service not found: %q", params.ByName("service")))
+		return
+	}
+	w.Header().Set("Discoverd-Event-Index", strconv.FormatUint(eventIndex, 10))
+
+	// Expose the service's content hash so clients can detect changes by
+	// comparing headers instead of response bodies.
+	if digest, ok := h.Store.ServiceDigests()[params.ByName("service")]; ok {
+		w.Header().Set("Discoverd-Digest", strconv.FormatUint(digest, 10))
+	}
+
+	// Rewrite addresses for clients on external networks.
+	if h.AddrMapper != nil {
+		instances = h.AddrMapper.MapAll(instances, r.RemoteAddr)
+	}
+
+	// Restrict the listing to canaries or non-canaries if requested.
+	if canary != nil {
+		filtered := make([]*discoverd.Instance, 0, len(instances))
+		for _, inst := range instances {
+			if inst.Canary == *canary {
+				filtered = append(filtered, inst)
+			}
+		}
+		instances = filtered
+	}
+
+	// Sort by address or descending weight if requested, instances are
+	// sorted by index by default.
+	switch opts.sort {
+	case "addr":
+		sort.Sort(instanceAddrSlice(instances))
+	case "weight":
+		sort.Sort(instanceWeightSlice(instances))
+	}
+
+	// List instances in the caller's zone first, keeping the sort order
+	// within each group, so cross-zone traffic is the fallback rather than
+	// the default.
+	if zone != "" {
+		sort.Stable(instanceZonePartition{instances, zone})
+	}
+
+	// Apply pagination over the instance sort keys. Numeric keys are
+	// zero-padded so that cursors compare correctly as strings.
+	keys := make([]string, len(instances))
+	for i, inst := range instances {
+		switch opts.sort {
+		case "addr":
+			keys[i] = inst.Addr
+		case "weight":
+			keys[i] = fmt.Sprintf("%05d%020d", 0xffff-inst.EffectiveWeight(), inst.Index)
+		default:
+			keys[i] = fmt.Sprintf("%020d", inst.Index)
+		}
+		// Prefix the keys with the zone group so cursors stay monotonic
+		// across the same-zone/other-zone boundary.
+		if zone != "" {
+			if inst.EffectiveZone() == zone {
+				keys[i] = "0" + keys[i]
+			} else {
+				keys[i] = "1" + keys[i]
+			}
+		}
+	}
+	page, next := paginate(keys, opts)
+	instances = instances[page[0]:page[1]]
+
+	// Translate the listing down for old clients.
+	instances = downgradeInstances(instances, apiVersion)
+
+	// Write instances to the response, using the pagination envelope if
+	// pagination parameters were supplied.
+	if opts.paginated {
+		hh.JSON(w, 200, &listResponse{Items: instances, NextCursor: next})
+		return
+	}
+
+	// Protobuf has no pagination envelope, so negotiation only applies to
+	// plain listings.
+	if wantsProto(r) {
+		writeProto(w, 200, instancesToProto(instances))
+		return
+	}
+	hh.JSON(w, 200, instances)
+}
+
+// serveGetServiceState returns a service's instances and leadership as one
+// atomic snapshot, so clients don't race separate instance and leader reads.
+func (h *Handler) serveGetServiceState(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	state := h.Store.ServiceState(params.ByName("service"))
+	if state == nil {
+		hh.ObjectNotFoundError(w, fmt.Sprintf("service not found: %q", params.ByName("service")))
+		return
+	}
+
+	// Rewrite addresses for clients on external networks.
+	if h.AddrMapper != nil {
+		state.Instances = h.AddrMapper.MapAll(state.Instances, r.RemoteAddr)
+	}
+
+	hh.JSON(w, 200, state)
+}
+
+// serveGetServices returns a list of all service names.
+func (h *Handler) serveGetServices(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Parse sorting and pagination parameters.
+	opts, err := parseListOptions(r, "name")
+	if err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+
+	// Read the sorted service names from the store.
+	names := h.Store.ServiceNames()
+
+	// Restrict the listing to a single namespace if one was given.
+	if ns := r.URL.Query().Get("namespace"); ns != "" {
+		filtered := make([]string, 0, len(names))
+		for _, name := range names {
+			if namespace, _ := SplitNamespace(name); namespace == ns {
+				filtered = append(filtered, name)
+			}
+		}
+		names = filtered
+	}
+
+	// Apply pagination.
+	page, next := paginate(names, opts)
+	names = names[page[0]:page[1]]
+
+	if opts.paginated {
+		hh.JSON(w, 200, &listResponse{Items: names, NextCursor: next})
+		return
+	}
+	hh.JSON(w, 200, names)
+}
+
+// listOptions represents the sorting and pagination query parameters accepted
+// by the listing endpoints.
+type listOptions struct {
+	sort      string
+	limit     int
+	cursor    string
+	paginated bool
+}
+
+// listResponse is the envelope returned by listing endpoints when pagination
+// parameters are supplied.
+type listResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// parseListOptions parses the sort, limit and cursor query parameters.
+// The first sort key in sorts is the default.
+func parseListOptions(r *http.Request, sorts ...string) (*listOptions, error) {
+	q := r.URL.Query()
+	opts := &listOptions{sort: sorts[0]}
+
+	if s := q.Get("sort"); s != "" {
+		valid := false
+		for _, k := range sorts {
+			if s == k {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("discoverd: invalid sort key %q", s)
+		}
+		opts.sort = s
+	}
+
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("discoverd: invalid limit %q", l)
+		}
+		opts.limit = n
+		opts.paginated = true
+	}
+
+	if c := q.Get("cursor"); c != "" {
+		opts.cursor = c
+		opts.paginated = true
+	}
+
+	return opts, nil
+}
+
+// paginate returns the half-open range of keys selected by the pagination
+// options, plus the cursor for the next page (empty if this is the last page).
+// The keys must be sorted in the listing's sort order.
+func paginate(keys []string, opts *listOptions) ([2]int, string) {
+	start := 0
+	if opts.cursor != "" {
+		// Skip keys up to and including the cursor.
+		for start < len(keys) && keys[start] <= opts.cursor {
+			start++
+		}
+	}
+
+	end := len(keys)
+	if opts.limit > 0 && start+opts.limit < end {
+		end = start + opts.limit
+	}
+
+	var next string
+	if end < len(keys) {
+		next = keys[end-1]
+	}
+	return [2]int{start, end}, next
+}
+
+// instanceAddrSlice represents a sortable list of instances by address.
+type instanceAddrSlice []*discoverd.Instance
+
+func (a instanceAddrSlice) Len() int           { return len(a) }
+func (a instanceAddrSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a instanceAddrSlice) Less(i, j int) bool { return a[i].Addr < a[j].Addr }
+
+// instanceWeightSlice represents a sortable list of instances by descending
+// effective weight, with creation order as a tiebreak.
+type instanceWeightSlice []*discoverd.Instance
+
+func (a instanceWeightSlice) Len() int      { return len(a) }
+func (a instanceWeightSlice) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a instanceWeightSlice) Less(i, j int) bool {
+	wi, wj := a[i].EffectiveWeight(), a[j].EffectiveWeight()
+	if wi != wj {
+		return wi > wj
+	}
+	return a[i].Index < a[j].Index
+}
+
+// instanceZonePartition sorts instances in the given zone ahead of the rest.
+// It is used with sort.Stable so the existing order is preserved within each
+// group.
+type instanceZonePartition struct {
+	instances []*discoverd.Instance
+	zone      string
+}
+
+func (a instanceZonePartition) Len() int { return len(a.instances) }
+func (a instanceZonePartition) Swap(i, j int) {
+	a.instances[i], a.instances[j] = a.instances[j], a.instances[i]
+}
+func (a instanceZonePartition) Less(i, j int) bool {
+	return a.instances[i].EffectiveZone() == a.zone && a.instances[j].EffectiveZone() != a.zone
+}
+
+// servePutLeader sets the leader for a service.
+func (h *Handler) servePutLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve path parameters.
+	service := params.ByName("service")
+
+	// Check if the service allows manual leader election.
+	config := h.Store.Config(service)
+	if config == nil || config.LeaderType != discoverd.LeaderTypeManual {
+		hh.ValidationError(w, "", "service leader election type is not manual")
+		return
+	}
+
+	// Read instance from the request.
+	inst := &discoverd.Instance{}
+	if err := hh.DecodeJSON(r, inst); err != nil {
+		hh.Error(w, err)
+		return
+	}
+
+	// Manually set the leader on the service.
+	if err := h.Store.SetServiceLeader(service, inst.ID); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// serveFailoverLeader demotes the current leader for a service and promotes
+// the instance named in the request body, or the next-oldest instance if the
+// body is empty.
+func (h *Handler) serveFailoverLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Retrieve path parameters.
+	service := params.ByName("service")
+
+	// Read the target instance from the request, tolerating an empty body.
+	inst := &discoverd.Instance{}
+	if r.ContentLength != 0 {
+		if err := hh.DecodeJSON(r, inst); err != nil {
+			hh.Error(w, err)
+			return
+		}
+	}
+
+	// Force the failover.
+	if err := h.Store.FailoverServiceLeader(service, inst.ID); err == ErrNotLeader {
+		h.redirectToLeader(w, r)
+		return
+	} else if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if IsServiceFrozen(err) {
+		hh.ConflictError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+
+	// Write the new leader to the response.
+	leader, err := h.Store.ServiceLeader(service)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, leader)
+}
+
+// serveGetLeader returns the current leader for a service.
+func (h *Handler) serveGetLeader(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// Process as a stream if that's what the client wants.
+	if wantsStream(r) {
+		h.serveStream(w, r, params, discoverd.EventKindLeader)
+		return
+	}
+
+	// Otherwise retrieve the current leader, either for one protocol or
+	// service-wide.
+	service := params.ByName("service")
+	var leader *discoverd.Instance
+	var err error
+	if proto := r.URL.Query().Get("proto"); proto != "" {
+		leader, err = h.Store.ProtoLeader(service, proto)
+	} else {
+		leader, err = h.Store.ServiceLeader(service)
+	}
+	if err != nil {
+		hh.Error(w, err)
+		return
+	} else if leader == nil {
+		hh.ObjectNotFoundError(w, "no leader found")
+		return
+	}
+	if h.AddrMapper != nil {
+		leader = h.AddrMapper.Map(leader, r.RemoteAddr)
+	}
+
+	// Translate down for old clients.
+	apiVersion, err := negotiateAPIVersion(w, r)
+	if err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+	leader = downgradeInstance(leader, apiVersion)
+
+	// Write leader to the response.
+	if wantsProto(r) {
+		writeProto(w, 200, instanceToProto(leader))
+		return
+	}
+	hh.JSON(w, 200, leader)
+}
+
+// servePing returns a 200 OK.
+// serveGetStats returns per-service state summaries along with event
+// delivery and eviction statistics, so operators can quantify instance
+// counts and churn composition per service without fetching full listings.
+func (h *Handler) serveGetStats(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hh.JSON(w, 200, struct {
+		Services  map[string]ServiceStats              `json:"services"`
+		Events    map[string]map[string]EventKindStats `json:"events"`
+		Evictions map[string]uint64                    `json:"evictions"`
+	}{
+		Services:  h.Store.Stats(),
+		Events:    h.Store.EventStats(),
+		Evictions: h.Store.EvictionStats(),
+	})
+}
+
+// serveGetSubscribers returns delivery statistics for the active event
+// subscriptions, so operators can identify which consumers are too slow to
+// keep up with the event stream.
+func (h *Handler) serveGetSubscribers(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hh.JSON(w, 200, h.Store.Subscribers())
+}
+
+// serveGetDependencies returns the service dependency graph declared via the
+// "depends" instance meta key, along with the dependencies that currently
+// have no healthy instances.
+func (h *Handler) serveGetDependencies(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hh.JSON(w, 200, struct {
+		Services map[string][]string `json:"services"`
+		Missing  map[string][]string `json:"missing"`
+	}{
+		Services: h.Store.Dependencies(),
+		Missing:  h.Store.MissingDependencies(),
+	})
+}
+
+// serveGetDigests returns per-service state digests along with the last
+// applied raft index, so replicas can be compared for divergence without
+// transferring full service payloads.
+func (h *Handler) serveGetDigests(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hh.JSON(w, 200, struct {
+		LastIndex uint64            `json:"last_index"`
+		Digests   map[string]uint64 `json:"digests"`
+	}{
+		LastIndex: h.Store.LastIndex(),
+		Digests:   h.Store.ServiceDigests(),
+	})
+}
+
+func (h *Handler) servePing(w http.ResponseWriter, r *http.Request, params httprouter.Params) {}
+
+func (h *Handler) serveShutdown(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	// deregister the server before marking as shutdown as deregistration
+	// is performed using the HTTP server
+	if err := h.Main.Deregister(); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	h.Shutdown.Store(true)
+	targetLogIndex, err := h.Main.Close()
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, targetLogIndex)
+}
+
+// servePromote attempts to promote this discoverd peer to a raft peer
+func (h *Handler) servePromote(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := h.Main.Promote(); err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// serveDemote attempts to demote this peer from a raft peer to a proxy
+func (h *Handler) serveDemote(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if err := h.Main.Demote(); err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// parseSelectorParam parses the "selector" query parameter, returning a nil
+// selector if the parameter is absent.
+func parseSelectorParam(r *http.Request) (Selector, error) {
+	raw := r.FormValue("selector")
+	if raw == "" {
+		return nil, nil
+	}
+	return ParseSelector(raw)
+}
+
+// parseCanaryParam parses the "canary" query parameter into a tristate:
+// nil when unset, otherwise the canary flag to match instances against.
+func parseCanaryParam(r *http.Request) (*bool, error) {
+	s := r.URL.Query().Get("canary")
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, errors.New("discoverd: canary must be a boolean")
+	}
+	return &v, nil
+}
+
+// filterCanaryEvents copies events from in to out, dropping instance events
+// whose canary flag does not match want. Events without an instance (e.g.
+// leadership loss or config changes) pass through.
+func filterCanaryEvents(in, out chan *discoverd.Event, want bool) {
+	defer close(out)
+	for event := range in {
+		if event.Instance != nil && event.Instance.Canary != want {
+			continue
+		}
+		out <- event
+	}
+}
+
+// serveStream creates a subscription and streams out events in SSE format.
+func (h *Handler) serveStream(w http.ResponseWriter, r *http.Request, params httprouter.Params, kind discoverd.EventKind) {
+	// Parse the metadata selector, if given.
+	selector, err := parseSelectorParam(r)
+	if err != nil {
+		hh.ValidationError(w, "selector", err.Error())
+		return
+	}
+
+	// Parse the delivery priority, if given.
+	priority, err := ParseSubscriptionPriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		hh.ValidationError(w, "priority", err.Error())
+		return
+	}
+
+	// Parse the canary filter, if given.
+	canary, err := parseCanaryParam(r)
+	if err != nil {
+		hh.ValidationError(w, "canary", err.Error())
+		return
+	}
+
+	// Negotiate the event schema version.
+	apiVersion, err := negotiateAPIVersion(w, r)
+	if err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+
+	// Create a buffered channel to receive events.
+	ch := make(chan *discoverd.Event, StreamBufferSize)
+
+	// Resume from a previous event index, if requested, replaying the
+	// events that followed it before delivering live events.
+	if since := r.URL.Query().Get("since"); since != "" {
+		if selector != nil || r.URL.Query().Get("coalesce") != "" || r.URL.Query().Get("digest") != "" || priority != PriorityNormal || canary != nil {
+			hh.ValidationError(w, "since", "discoverd: since cannot be combined with selector, coalesce, digest, priority or canary")
+			return
+		}
+		sinceIndex, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			hh.ValidationError(w, "since", "discoverd: since must be an unsigned integer")
+			return
+		}
+
+		stream, err := h.Store.SubscribeSince(params.ByName("service"), sinceIndex, kind, ch)
+		if err == ErrEventLogTruncated {
+			hh.Error(w, hh.PreconditionFailedErr(err.Error()))
+			return
+		} else if err != nil {
+			hh.Error(w, err)
+			return
+		}
+
+		cw, closeCompress := negotiateCompression(w, r)
+		s := sse.NewStream(cw, ch, nil)
+		s.Serve()
+		s.Wait()
+		stream.Close()
+		if err := stream.Err(); err != nil {
+			s.CloseWithError(err)
+		}
+		closeCompress()
+		return
+	}
+
+	// If requested, coalesce event bursts or replace them with periodic
+	// full-state digests, so subscribers that rebuild configuration don't
+	// see every intermediate flap.
+	service := params.ByName("service")
+	sub := ch
+	coalesce, digest := r.URL.Query().Get("coalesce"), r.URL.Query().Get("digest")
+	if coalesce != "" && digest != "" {
+		hh.ValidationError(w, "coalesce", "discoverd: coalesce and digest are mutually exclusive")
+		return
+	} else if coalesce != "" {
+		window, err := time.ParseDuration(coalesce)
+		if err != nil || window <= 0 {
+			hh.ValidationError(w, "coalesce", "discoverd: coalesce must be a positive duration")
+			return
+		}
+		sub = make(chan *discoverd.Event, StreamBufferSize)
+		go coalesceEvents(sub, ch, window)
+	} else if digest != "" {
+		interval, err := time.ParseDuration(digest)
+		if err != nil || interval <= 0 {
+			hh.ValidationError(w, "digest", "discoverd: digest must be a positive duration")
+			return
+		}
+		sub = make(chan *discoverd.Event, StreamBufferSize)
+		go digestEvents(sub, ch, interval, service, func() ([]*discoverd.Instance, error) {
+			return h.Store.InstancesFiltered(service, selector)
+		})
+	}
+
+	// Translate events down for old clients. The canary filter below runs
+	// upstream of this stage, so filtering still sees the full schema.
+	if apiVersion < APIVersionLatest {
+		in := make(chan *discoverd.Event, StreamBufferSize)
+		go downgradeEvents(in, sub, apiVersion)
+		sub = in
+	}
+
+	// Restrict instance events to canaries or non-canaries if requested.
+	if canary != nil {
+		in := make(chan *discoverd.Event, StreamBufferSize)
+		go filterCanaryEvents(in, sub, *canary)
+		sub = in
+	}
+
+	// Subscribe to events on the store, attributed to the client so the
+	// subscriber quotas apply.
+	stream, err := h.Store.SubscribeClient(service, clientIdentity(r), true, kind, sub, selector, priority)
+	if IsSubscriberQuotaError(err) {
+		// Unwind any coalesce, digest or canary goroutines; each stage
+		// closes its output when its input closes.
+		if sub != ch {
+			close(sub)
+		}
+		hh.Error(w, hh.JSONError{Code: hh.RatelimitedErrorCode, Message: err.Error()})
+		return
+	} else if err != nil {
+		if sub != ch {
+			close(sub)
+		}
+		hh.Error(w, err)
+		return
+	}
+
+	// Create and serve an SSE stream, compressed when the client supports
+	// it.
+	cw, closeCompress := negotiateCompression(w, r)
+	s := sse.NewStream(cw, ch, nil)
 	s.Serve()
 	s.Wait()
 	stream.Close()
@@ -428,6 +1639,21 @@ func (h *Handler) serveStream(w http.ResponseWriter, params httprouter.Params, k
 	if err := stream.Err(); err != nil {
 		s.CloseWithError(err)
 	}
+	closeCompress()
+}
+
+// clientIdentity returns the identity a streaming subscription is attributed
+// to for quota accounting: the request's auth token if it carries one,
+// otherwise the remote host, so unauthenticated clients behind one address
+// share a quota slot.
+func clientIdentity(r *http.Request) string {
+	if token := parseAuthToken(r); token != "" {
+		return token
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
 }
 
 // serveGetRaftLeader returns the current raft leader.
@@ -1,6 +1,11 @@
 package server_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"errors"
 	"io"
@@ -10,10 +15,13 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/flynn/flynn/discoverd/api"
 	discoverd "github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/server"
 	"github.com/flynn/flynn/pkg/stream"
+	"github.com/golang/protobuf/proto"
 )
 
 // Ensure the handler can register a service.
@@ -80,7 +88,7 @@ func TestHandler_PutService_ErrInvalidService(t *testing.T) {
 	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/XXX", strings.NewReader(`{"leader_type":"manual"}`)))
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: service must be lowercase alphanumeric plus dash","retry":false}` {
+	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: service must be lowercase alphanumeric plus dash, optionally prefixed with a namespace and slash","retry":false}` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
@@ -112,6 +120,41 @@ func TestHandler_PutService_ErrNotLeader(t *testing.T) {
 	}
 }
 
+// Ensure a read-only replica redirects writes to the primary while serving
+// reads locally.
+func TestHandler_ReadOnly(t *testing.T) {
+	h := NewHandler()
+	h.SetReadOnly("primary0:1111")
+
+	// Writes are redirected to the primary.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "http://replica0:1111/services/abc", strings.NewReader(`{}`)))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if loc := w.Header().Get("Location"); loc != `http://primary0:1111/services/abc` {
+		t.Fatalf("unexpected Location header: %s", loc)
+	}
+
+	// Reads are served from the local store.
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{}, nil
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "http://replica0:1111/services/abc/instances", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	// Clearing the primary re-enables writes.
+	h.SetReadOnly("")
+	h.Store.AddServiceFn = func(service string, config *discoverd.ServiceConfig) error { return nil }
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "http://replica0:1111/services/abc", strings.NewReader(`{}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
 // Ensure the handler can remove a service.
 func TestHandler_DeleteService(t *testing.T) {
 	h := NewHandler()
@@ -142,7 +185,7 @@ func TestHandler_DeleteService_ErrInvalidService(t *testing.T) {
 	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/XXX", strings.NewReader(`{"leader_type":"manual"}`)))
 	if w.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: service must be lowercase alphanumeric plus dash","retry":false}` {
+	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: service must be lowercase alphanumeric plus dash, optionally prefixed with a namespace and slash","retry":false}` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
@@ -211,6 +254,183 @@ func TestHandler_GetService_Stream(t *testing.T) {
 	}
 }
 
+// Ensure the handler compresses an event stream when the client advertises
+// gzip support.
+func TestHandler_GetService_Stream_Gzip(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		ch <- &discoverd.Event{
+			Service: service,
+			Kind:    discoverd.EventKindLeader,
+		}
+		close(ch)
+		return chanStream(ch)
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("unexpected content encoding: %q", enc)
+	}
+
+	// Verify the stream decompresses to the usual SSE frames.
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, gz); err != nil {
+		t.Fatal(err)
+	} else if body.String() != `data: {"service":"abc","kind":"leader"}`+"\n\n" {
+		t.Fatalf("unexpected body: %s", body.String())
+	}
+}
+
+// Ensure the handler leaves an event stream uncompressed when the client
+// declines gzip.
+func TestHandler_GetService_Stream_GzipDeclined(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		close(ch)
+		return chanStream(ch)
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Accept-Encoding", "gzip;q=0")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("unexpected content encoding: %q", enc)
+	}
+}
+
+// Ensure the handler translates a stream down for clients requesting the
+// original schema.
+func TestHandler_GetService_Stream_APIVersion(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		// A kind the original schema doesn't define, then a down event
+		// carrying post-v1 fields.
+		ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindServiceUp}
+		ch <- &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindDown,
+			Instance: &discoverd.Instance{ID: "inst0", Weight: 7},
+			Reason:   discoverd.DownReasonExpired,
+		}
+		close(ch)
+		return chanStream(ch)
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	r.Header.Set("Discoverd-API-Version", "1")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `data: {"service":"abc","kind":"down","instance":{"id":"inst0","addr":"","proto":""}}`+"\n\n" {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can coalesce a burst of events for one instance into
+// the latest event.
+func TestHandler_GetService_Stream_Coalesce(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		// Deliver the initial state, then a burst of events for the
+		// same instance.
+		ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindCurrent}
+		ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Proto: "http"}}
+		ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUpdate, Instance: &discoverd.Instance{ID: "inst0", Proto: "https"}}
+		close(ch)
+		return chanStream(ch)
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc?coalesce=100ms", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `data: {"service":"abc","kind":"current"}`+"\n\n"+
+		`data: {"service":"abc","kind":"update","instance":{"id":"inst0","addr":"","proto":"https"}}`+"\n\n" {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler rejects an invalid coalesce window.
+func TestHandler_GetService_Stream_ErrCoalesce(t *testing.T) {
+	h := NewHandler()
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc?coalesce=nope", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler passes the requested delivery priority to the store.
+func TestHandler_GetService_Stream_Priority(t *testing.T) {
+	h := NewHandler()
+	var priority server.SubscriptionPriority
+	h.Store.SubscribePriorityFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector, p server.SubscriptionPriority) stream.Stream {
+		priority = p
+		close(ch)
+		return chanStream(ch)
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc?priority=high", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if priority != server.PriorityHigh {
+		t.Fatalf("unexpected priority: %v", priority)
+	}
+}
+
+// Ensure the handler reports a subscriber quota rejection as a rate limit.
+func TestHandler_GetService_Stream_QuotaExceeded(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeClientFn = func(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector, priority server.SubscriptionPriority) (stream.Stream, error) {
+		return nil, server.SubscriberQuotaError{Scope: "service", Key: service, Limit: 1}
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler rejects an invalid delivery priority.
+func TestHandler_GetService_Stream_ErrPriority(t *testing.T) {
+	h := NewHandler()
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc?priority=urgent", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
 // Ensure the handler can return errors from a closing stream.
 func TestHandler_GetService_Stream_ErrStream(t *testing.T) {
 	h := NewHandler()
@@ -257,282 +477,1382 @@ func TestHandler_PutServiceMeta(t *testing.T) {
 	}
 }
 
-// Ensure the handler returns an error if invalid JSON is passed in.
-func TestHandler_PutServiceMeta_ErrInvalidJSON(t *testing.T) {
+// Ensure the handler returns an error if invalid JSON is passed in.
+func TestHandler_PutServiceMeta_ErrInvalidJSON(t *testing.T) {
+	h := NewHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/meta", strings.NewReader(`{"index":`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the service isn't found.
+func TestHandler_PutServiceMeta_ErrNotFound(t *testing.T) {
+	h := NewHandler()
+	h.Store.SetServiceMetaFn = func(_ string, _ *discoverd.ServiceMeta) error {
+		return server.NotFoundError{Service: "abc"}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/meta", strings.NewReader(`{"index":12}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"object_not_found","message":"discoverd: service \"abc\" not found","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the meta cannot be set.
+func TestHandler_PutServiceMeta_ErrUnknown(t *testing.T) {
+	h := NewHandler()
+	h.Store.SetServiceMetaFn = func(_ string, _ *discoverd.ServiceMeta) error {
+		return errors.New("marker")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/meta", strings.NewReader(`{"index":12}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can retrieve metadata for a service.
+func TestHandler_GetServiceMeta(t *testing.T) {
+	h := NewHandler()
+	h.Store.ServiceMetaFn = func(service string) *discoverd.ServiceMeta {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		return &discoverd.ServiceMeta{Index: 12, Data: json.RawMessage(`{"foo":"bar"}`)}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/meta", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"data":{"foo":"bar"},"index":12}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the service cannot be found.
+func TestHandler_GetServiceMeta_ErrNotFound(t *testing.T) {
+	h := NewHandler()
+	h.Store.ServiceMetaFn = func(service string) *discoverd.ServiceMeta { return nil }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/meta", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"object_not_found","message":"service meta not found","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can return event delivery and eviction statistics.
+func TestHandler_GetStats(t *testing.T) {
+	h := NewHandler()
+	h.Store.StatsFn = func() map[string]server.ServiceStats {
+		return map[string]server.ServiceStats{
+			"abc": {Instances: 2, LeaderID: "inst0"},
+		}
+	}
+	h.Store.EventStatsFn = func() map[string]map[string]server.EventKindStats {
+		return map[string]map[string]server.EventKindStats{
+			"abc": {"up": {Count: 2, TotalLatency: 1000}},
+		}
+	}
+	h.Store.EvictionStatsFn = func() map[string]uint64 {
+		return map[string]uint64{"subscribers": 1}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"services":{"abc":{"instances":2,"leader_id":"inst0"}},"events":{"abc":{"up":{"count":2,"total_latency_ns":1000}}},"evictions":{"subscribers":1}}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler renders metrics in the Prometheus text format.
+func TestHandler_GetMetrics(t *testing.T) {
+	h := NewHandler()
+	h.Store.StatsFn = func() map[string]server.ServiceStats {
+		return map[string]server.ServiceStats{
+			"abc": {Instances: 2, Subscribers: 1},
+		}
+	}
+	h.Store.EventStatsFn = func() map[string]map[string]server.EventKindStats {
+		return map[string]map[string]server.EventKindStats{
+			"abc": {"up": {Count: 2, TotalLatency: 1000}},
+		}
+	}
+	h.Store.EvictionStatsFn = func() map[string]uint64 {
+		return map[string]uint64{"slow_subscribers": 1}
+	}
+	h.Store.SubscribersFn = func() []server.SubscriberStats {
+		return []server.SubscriberStats{
+			{ID: 1, Service: "abc", Delivered: 10, Dropped: 3, QueueDepth: 4, QueueSize: 8},
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("unexpected content type: %q", ct)
+	}
+	for _, line := range []string{
+		`discoverd_service_instances{service="abc"} 2`,
+		`discoverd_service_subscribers{service="abc"} 1`,
+		`discoverd_events_total{service="abc",kind="up"} 2`,
+		`discoverd_broadcast_latency_seconds_sum{service="abc",kind="up"} 1e-06`,
+		`discoverd_evictions_total{resource="slow_subscribers"} 1`,
+		`discoverd_subscriber_dropped_events_total{service="abc",id="1"} 3`,
+		`discoverd_subscriber_queue_depth{service="abc",id="1"} 4`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("missing metric line %q in body:\n%s", line, w.Body.String())
+		}
+	}
+}
+
+// Ensure the handler returns per-subscription delivery statistics.
+func TestHandler_GetSubscribers(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribersFn = func() []server.SubscriberStats {
+		return []server.SubscriberStats{
+			{ID: 1, Service: "abc", Priority: "normal", CreatedAt: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), Delivered: 10, Dropped: 3, QueueDepth: 4, QueueSize: 8},
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/subscribers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"id":1,"service":"abc","priority":"normal","created_at":"2016-01-01T00:00:00Z","delivered":10,"dropped":3,"queue_depth":4,"queue_size":8}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler enforces write ACLs when one is configured.
+func TestHandler_ACL(t *testing.T) {
+	h := NewHandler()
+	h.ACL = server.NewACL()
+	h.ACL.Allow("webtoken", "web-")
+
+	var called bool
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		called = true
+		return nil
+	}
+
+	body := `{"id": "74667cebd845d088d811ddef924895b7", "addr": "localhost:10000", "proto": "http"}`
+
+	// A request without a token is rejected.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/web-app/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body)))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if called {
+		t.Fatal("store should not have been called")
+	}
+
+	// A token scoped to another prefix is rejected.
+	w = httptest.NewRecorder()
+	req := MustNewHTTPRequest("PUT", "/services/db-primary/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer webtoken")
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	// A token matching the service prefix is allowed.
+	w = httptest.NewRecorder()
+	req = MustNewHTTPRequest("PUT", "/services/web-app/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer webtoken")
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("store should have been called")
+	}
+
+	// Reads are not authenticated.
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{}, nil
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/db-primary/instances", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure a verified TLS client certificate's common name is matched against
+// the ACL rules like a token.
+func TestHandler_ACL_ClientCert(t *testing.T) {
+	h := NewHandler()
+	h.ACL = server.NewACL()
+	h.ACL.Allow("router", "web-")
+
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		return nil
+	}
+
+	body := `{"id": "74667cebd845d088d811ddef924895b7", "addr": "localhost:10000", "proto": "http"}`
+	req := MustNewHTTPRequest("PUT", "/services/web-app/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "router"}}},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler can create an instance for a service.
+func TestHandler_PutInstance(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the instance creation.
+	var called bool
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		called = true
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		} else if !reflect.DeepEqual(inst, &discoverd.Instance{
+			ID:    "74667cebd845d088d811ddef924895b7",
+			Addr:  "localhost:10000",
+			Proto: "http",
+			Meta:  map[string]string{"foo": "bar"},
+			Index: 12,
+		}) {
+			t.Fatalf("unexpected inst: %#v", inst)
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7",
+		strings.NewReader(`{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http","meta":{"foo":"bar"},"index":12}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	} else if !called {
+		t.Fatal("Store.AddInstance() not called")
+	}
+}
+
+// Ensure the handler reports the achieved write consistency on registration
+// and rejects invalid consistency levels.
+func TestHandler_PutInstance_Consistency(t *testing.T) {
+	h := NewHandler()
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error { return nil }
+	h.Store.WriteConsistencyFn = func() server.WriteConsistency { return server.ConsistencyAll }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/inst0?consistency=all",
+		strings.NewReader(`{"id":"inst0","addr":"localhost:10000","proto":"http"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if v := w.Header().Get("Discoverd-Consistency"); v != "all" {
+		t.Fatalf("unexpected consistency header: %q", v)
+	}
+
+	// An unknown consistency level is rejected before the write.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/inst0?consistency=bogus",
+		strings.NewReader(`{"id":"inst0","addr":"localhost:10000","proto":"http"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler can register an instance sent as protobuf.
+func TestHandler_PutInstance_Proto(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the instance creation.
+	var called bool
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		called = true
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		} else if !reflect.DeepEqual(inst, &discoverd.Instance{
+			ID:    "74667cebd845d088d811ddef924895b7",
+			Addr:  "localhost:10000",
+			Proto: "http",
+			Meta:  map[string]string{"foo": "bar"},
+		}) {
+			t.Fatalf("unexpected inst: %#v", inst)
+		}
+		return nil
+	}
+
+	// Encode the instance as protobuf.
+	data, err := proto.Marshal(&api.Instance{
+		Id:    "74667cebd845d088d811ddef924895b7",
+		Addr:  "localhost:10000",
+		Proto: "http",
+		Meta:  map[string]string{"foo": "bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", bytes.NewReader(data))
+	req.Header.Set("Content-Type", server.ProtoContentType)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("Store.AddInstance() not called")
+	}
+}
+
+// Ensure the handler can return instances encoded as protobuf.
+func TestHandler_GetInstances_Proto(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the store to return instances.
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		return []*discoverd.Instance{
+			{ID: "inst1", Addr: "localhost:10000", Proto: "http", Index: 3},
+		}, nil
+	}
+
+	// Request the instances with a protobuf Accept header.
+	w := httptest.NewRecorder()
+	req := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
+	req.Header.Set("Accept", server.ProtoContentType)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if ct := w.Header().Get("Content-Type"); ct != server.ProtoContentType {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	// Decode the protobuf body.
+	res := &api.ListResponse{}
+	if err := proto.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, &api.ListResponse{Instances: []*api.Instance{
+		{Id: "inst1", Addr: "localhost:10000", Proto: "http", Index: 3},
+	}}) {
+		t.Fatalf("unexpected response: %s", res)
+	}
+}
+
+// Ensure the handler can return the leader encoded as protobuf.
+func TestHandler_GetLeader_Proto(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the store to return a leader.
+	h.Store.ServiceLeaderFn = func(service string) (*discoverd.Instance, error) {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		return &discoverd.Instance{ID: "inst1", Addr: "localhost:10000", Proto: "http", Index: 3}, nil
+	}
+
+	// Request the leader with a protobuf Accept header.
+	w := httptest.NewRecorder()
+	req := MustNewHTTPRequest("GET", "/services/abc/leader", nil)
+	req.Header.Set("Accept", server.ProtoContentType)
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if ct := w.Header().Get("Content-Type"); ct != server.ProtoContentType {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	// Decode the protobuf body.
+	leader := &api.Instance{}
+	if err := proto.Unmarshal(w.Body.Bytes(), leader); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(leader, &api.Instance{Id: "inst1", Addr: "localhost:10000", Proto: "http", Index: 3}) {
+		t.Fatalf("unexpected leader: %s", leader)
+	}
+}
+
+// Ensure the handler can register a batch of instances under one service.
+func TestHandler_PutServiceInstances(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the batch registration.
+	var called bool
+	h.Store.AddServiceInstancesFn = func(service string, instances []*discoverd.Instance) error {
+		called = true
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		} else if !reflect.DeepEqual(instances, []*discoverd.Instance{
+			{ID: "74667cebd845d088d811ddef924895b7", Addr: "localhost:10000", Proto: "http"},
+			{ID: "9c30d56bb4a1a8f872bcbe3297e06e6d", Addr: "localhost:10001", Proto: "http"},
+		}) {
+			t.Fatalf("unexpected instances: %#v", instances)
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances",
+		strings.NewReader(`[{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http"},{"id":"9c30d56bb4a1a8f872bcbe3297e06e6d","addr":"localhost:10001","proto":"http"}]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("Store.AddServiceInstances() not called")
+	}
+}
+
+// Ensure the handler validates every instance before applying a batch.
+func TestHandler_PutServiceInstances_ErrValidation(t *testing.T) {
+	h := NewHandler()
+	h.Store.AddServiceInstancesFn = func(service string, instances []*discoverd.Instance) error {
+		t.Fatal("Store.AddServiceInstances() should not be called")
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances",
+		strings.NewReader(`[{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http"},{"id":"9c30d56bb4a1a8f872bcbe3297e06e6d","addr":"localhost","proto":"http"}]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler can apply an atomic transaction.
+func TestHandler_PostTransaction(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the transaction.
+	var called bool
+	h.Store.TransactFn = func(ops []*server.TxOp) error {
+		called = true
+		if !reflect.DeepEqual(ops, []*server.TxOp{
+			{Op: server.TxOpRemoveInstance, Service: "web-old", ID: "74667cebd845d088d811ddef924895b7"},
+			{Op: server.TxOpAddInstance, Service: "web-new", Instance: &discoverd.Instance{ID: "74667cebd845d088d811ddef924895b7", Addr: "localhost:10000", Proto: "http"}},
+			{Op: server.TxOpSetLeader, Service: "web-new", ID: "74667cebd845d088d811ddef924895b7"},
+		}) {
+			t.Fatalf("unexpected ops: %#v", ops)
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("POST", "/transactions",
+		strings.NewReader(`[{"op":"remove_instance","service":"web-old","id":"74667cebd845d088d811ddef924895b7"},{"op":"add_instance","service":"web-new","instance":{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http"}},{"op":"set_leader","service":"web-new","id":"74667cebd845d088d811ddef924895b7"}]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("Store.Transact() not called")
+	}
+}
+
+// Ensure the handler rejects a transaction with an unknown op.
+func TestHandler_PostTransaction_ErrValidation(t *testing.T) {
+	h := NewHandler()
+	h.Store.TransactFn = func(ops []*server.TxOp) error {
+		t.Fatal("Store.Transact() should not be called")
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("POST", "/transactions",
+		strings.NewReader(`[{"op":"rename_service","service":"web-old"}]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: invalid transaction op \"rename_service\"","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler rejects updates with a stale If-Match index.
+func TestHandler_PutInstance_IfMatch(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the current instance and the update.
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "74667cebd845d088d811ddef924895b7", Addr: "localhost:10000", Proto: "http", Index: 5},
+		}, nil
+	}
+	var called bool
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		called = true
+		return nil
+	}
+
+	body := `{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http"}`
+
+	// A stale index is rejected with 412.
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+	r.Header.Set("If-Match", "4")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"precondition_failed","message":"discoverd: instance index is 5, not 4","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	} else if called {
+		t.Fatal("Store.AddInstance() called with stale index")
+	}
+
+	// The current index is accepted.
+	w = httptest.NewRecorder()
+	r = MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+	r.Header.Set("If-Match", "5")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("Store.AddInstance() not called")
+	}
+}
+
+// Ensure the handler rejects deregistration with a stale If-Match index.
+func TestHandler_DeleteInstance_IfMatch(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Addr: "localhost:10000", Proto: "http", Index: 7},
+		}, nil
+	}
+	var called bool
+	h.Store.RemoveInstanceFn = func(service, id string) error {
+		called = true
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("DELETE", "/services/abc/instances/inst0", nil)
+	r.Header.Set("If-Match", "6")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if called {
+		t.Fatal("Store.RemoveInstance() called with stale index")
+	}
+
+	w = httptest.NewRecorder()
+	r = MustNewHTTPRequest("DELETE", "/services/abc/instances/inst0", nil)
+	r.Header.Set("If-Match", "7")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("Store.RemoveInstance() not called")
+	}
+}
+
+// Ensure the handler dedupes retried requests carrying the same
+// Idempotency-Key header.
+func TestHandler_PutInstance_IdempotencyKey(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the instance creation, counting invocations.
+	var calls int
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		calls++
+		return nil
+	}
+
+	body := `{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http"}`
+	req := func() *http.Request {
+		r := MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", "key0")
+		return r
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req())
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	// Retry with the same key, the store should not be called again.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req())
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Header().Get("Idempotency-Replayed") != "true" {
+		t.Fatalf("expected replayed response, got header %q", w.Header().Get("Idempotency-Replayed"))
+	} else if calls != 1 {
+		t.Fatalf("unexpected call count: %d", calls)
+	}
+
+	// A different key applies the mutation again.
+	w = httptest.NewRecorder()
+	r := MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", "key1")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if calls != 2 {
+		t.Fatalf("unexpected call count: %d", calls)
+	}
+}
+
+// Ensure the handler returns an error if body cannot be parsed.
+func TestHandler_PutInstance_ErrInvalidJSON(t *testing.T) {
+	h := NewHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(`{"id":`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the instance is invalid.
+func TestHandler_PutInstance_ErrInvalid(t *testing.T) {
+	h := NewHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/xxx",
+		strings.NewReader(`{"id":"xxx"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: proto must be set","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler accepts a caller-supplied stable instance ID.
+func TestHandler_PutInstance_CustomID(t *testing.T) {
+	h := NewHandler()
+
+	var called bool
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		called = true
+		if inst.ID != "host0-job1" {
+			t.Fatalf("unexpected id: %s", inst.ID)
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/host0-job1",
+		strings.NewReader(`{"id":"host0-job1","addr":"localhost:10000","proto":"http"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if !called {
+		t.Fatal("Store.AddInstance() not called")
+	}
+}
+
+// Ensure the handler rejects instance IDs with invalid characters.
+func TestHandler_PutInstance_ErrInvalidID(t *testing.T) {
+	h := NewHandler()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/Host0",
+		strings.NewReader(`{"id":"Host0","addr":"localhost:10000","proto":"http"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: instance id must be at most 64 characters of lowercase alphanumeric plus dash","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the service is not found.
+func TestHandler_PutInstance_ErrNotFound(t *testing.T) {
+	h := NewHandler()
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		return server.NotFoundError{Service: "abc"}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/xxx",
+		strings.NewReader(`{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http","meta":{"foo":"bar"},"index":12}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"object_not_found","message":"discoverd: service \"abc\" not found","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the instance cannot be created.
+func TestHandler_PutInstance_ErrUnknown(t *testing.T) {
+	h := NewHandler()
+	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
+		return errors.New("marker")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/xxx",
+		strings.NewReader(`{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http","meta":{"foo":"bar"},"index":12}`)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can remove an instance.
+func TestHandler_DeleteInstance(t *testing.T) {
+	h := NewHandler()
+
+	// Mock the instance deletion.
+	var called bool
+	h.Store.RemoveInstanceFn = func(service, instanceID string) error {
+		called = true
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		} else if instanceID != "74667cebd845d088d811ddef924895b7" {
+			t.Fatalf("unexpected instance id: %#v", instanceID)
+		}
+		return nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/abc/instances/74667cebd845d088d811ddef924895b7", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	} else if !called {
+		t.Fatal("Store.RemoveInstance() not called")
+	}
+}
+
+// Ensure the handler returns an error if the instance doesn't exist.
+func TestHandler_DeleteInstance_ErrNotFound(t *testing.T) {
+	h := NewHandler()
+	h.Store.RemoveInstanceFn = func(service, instanceID string) error {
+		return server.NotFoundError{Service: "abc", Instance: "74667cebd845d088d811ddef924895b7"}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/abc/instances/74667cebd845d088d811ddef924895b7", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"object_not_found","message":"discoverd: instance abc/74667cebd845d088d811ddef924895b7 not found","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the instance can't be removed.
+func TestHandler_DeleteInstance_ErrUnknown(t *testing.T) {
+	h := NewHandler()
+	h.Store.RemoveInstanceFn = func(service, instanceID string) error { return errors.New("marker") }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/abc/instances/74667cebd845d088d811ddef924895b7", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can retrieve a list of instances for a service.
+func TestHandler_GetInstances(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{{ID: "inst0"}, {ID: "inst1"}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"id":"inst0","addr":"","proto":""},{"id":"inst1","addr":"","proto":""}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler translates instance listings down for clients
+// requesting the original schema.
+func TestHandler_GetInstances_APIVersion(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{{ID: "inst0", Weight: 7, Canary: true, Index: 3}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
+	r.Header.Set("Discoverd-API-Version", "1")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if v := w.Header().Get("Discoverd-API-Version"); v != "1" {
+		t.Fatalf("unexpected api version: %q", v)
+	} else if w.Body.String() != `[{"id":"inst0","addr":"","proto":"","index":3}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	// Requests without the header get the latest schema.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if v := w.Header().Get("Discoverd-API-Version"); v != "2" {
+		t.Fatalf("unexpected api version: %q", v)
+	} else if w.Body.String() != `[{"id":"inst0","addr":"","proto":"","weight":7,"canary":true,"index":3}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler rejects an unsupported API version.
+func TestHandler_GetInstances_ErrAPIVersion(t *testing.T) {
+	h := NewHandler()
+
+	w := httptest.NewRecorder()
+	r := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
+	r.Header.Set("Discoverd-API-Version", "3")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler filters instance listings on the canary flag.
+func TestHandler_GetInstances_Canary(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{{ID: "inst0"}, {ID: "inst1", Canary: true}}, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?canary=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"id":"inst1","addr":"","proto":"","canary":true}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?canary=false", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"id":"inst0","addr":"","proto":""}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler lists instances in the caller's zone first.
+func TestHandler_GetInstances_Zone(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Index: 1, Zone: "a"},
+			{ID: "inst1", Index: 2, Zone: "b"},
+			{ID: "inst2", Index: 3, Meta: map[string]string{"zone": "b"}},
+		}, nil
+	}
+
+	// Same-zone instances lead, including one using the legacy meta key,
+	// with creation order preserved within each group.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?zone=b", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"id":"inst1","addr":"","proto":"","zone":"b","index":2},{"id":"inst2","addr":"","proto":"","meta":{"zone":"b"},"index":3},{"id":"inst0","addr":"","proto":"","zone":"a","index":1}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure instance reads expose the service's content hash in a header.
+func TestHandler_GetInstances_Digest(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{{ID: "inst0"}}, nil
+	}
+	h.Store.ServiceDigestsFn = func() map[string]uint64 {
+		return map[string]uint64{"abc": 12345}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if digest := w.Header().Get("Discoverd-Digest"); digest != "12345" {
+		t.Fatalf("unexpected digest header: %q", digest)
+	}
+}
+
+// Ensure the handler can return a service state snapshot.
+func TestHandler_GetServiceState(t *testing.T) {
+	h := NewHandler()
+	h.Store.ServiceStateFn = func(service string) *server.ServiceState {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		return &server.ServiceState{
+			Instances: []*discoverd.Instance{{ID: "inst0", Index: 3}},
+			LeaderID:  "inst0",
+			Index:     7,
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/state", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `{"instances":[{"id":"inst0","addr":"","proto":"","index":3}],"leader_id":"inst0","index":7}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler returns an error if the service state doesn't exist.
+func TestHandler_GetServiceState_ErrNotFound(t *testing.T) {
+	h := NewHandler()
+	h.Store.ServiceStateFn = func(service string) *server.ServiceState { return nil }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/state", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
+// Ensure the handler can return a service's departure history.
+func TestHandler_GetHistory(t *testing.T) {
+	h := NewHandler()
+	h.Store.HistoryFn = func(service string) []*server.InstanceDeparture {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		return []*server.InstanceDeparture{{
+			Instance:   &discoverd.Instance{ID: "inst0", Index: 3},
+			Reason:     server.DepartureReasonExpired,
+			DepartedAt: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		}}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/history", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"instance":{"id":"inst0","addr":"","proto":"","index":3},"reason":"expired","departed_at":"2000-01-01T00:00:00Z"}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can sort instances by descending weight.
+func TestHandler_GetInstances_SortWeight(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Index: 1},
+			{ID: "inst1", Index: 2, Weight: 200},
+			{ID: "inst2", Index: 3, Weight: 50},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?sort=weight", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"id":"inst1","addr":"","proto":"","weight":200,"index":2},{"id":"inst2","addr":"","proto":"","weight":50,"index":3},{"id":"inst0","addr":"","proto":"","index":1}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
+// Ensure the handler can paginate instances for a service.
+func TestHandler_GetInstances_Paginated(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Index: 1},
+			{ID: "inst1", Index: 2},
+			{ID: "inst2", Index: 3},
+		}, nil
+	}
+
+	// Request the first page.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?limit=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	var page struct {
+		Items      []*discoverd.Instance `json:"items"`
+		NextCursor string                `json:"next_cursor"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	} else if len(page.Items) != 2 || page.Items[0].ID != "inst0" || page.Items[1].ID != "inst1" {
+		t.Fatalf("unexpected items: %#v", page.Items)
+	} else if page.NextCursor == "" {
+		t.Fatal("expected next cursor")
+	}
+
+	// Request the next page using the cursor.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?limit=2&cursor="+page.NextCursor, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	page.NextCursor = ""
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	} else if len(page.Items) != 1 || page.Items[0].ID != "inst2" {
+		t.Fatalf("unexpected items: %#v", page.Items)
+	} else if page.NextCursor != "" {
+		t.Fatalf("unexpected next cursor: %s", page.NextCursor)
+	}
+}
+
+// Ensure the handler returns an error for an invalid sort key.
+func TestHandler_GetInstances_ErrInvalidSort(t *testing.T) {
 	h := NewHandler()
+
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/meta", strings.NewReader(`{"index":`)))
-	if w.Code != http.StatusInternalServerError {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?sort=foo", nil))
+	if w.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
-		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the service isn't found.
-func TestHandler_PutServiceMeta_ErrNotFound(t *testing.T) {
+// Ensure the handler serves Prometheus HTTP service discovery targets.
+func TestHandler_GetPrometheusSD(t *testing.T) {
 	h := NewHandler()
-	h.Store.SetServiceMetaFn = func(_ string, _ *discoverd.ServiceMeta) error {
-		return server.NotFoundError{Service: "abc"}
+	h.Store.ServiceNamesFn = func() []string { return []string{"abc"} }
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Addr: "10.0.0.1:80", Proto: "http", Meta: map[string]string{"flynn-app": "web"}},
+		}, nil
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/meta", strings.NewReader(`{"index":12}`)))
-	if w.Code != http.StatusNotFound {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/prometheus/sd", nil))
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"object_not_found","message":"discoverd: service \"abc\" not found","retry":false}` {
+	} else if w.Body.String() != `[{"targets":["10.0.0.1:80"],"labels":{"__meta_discoverd_instance_id":"inst0","__meta_discoverd_meta_flynn_app":"web","__meta_discoverd_proto":"http","__meta_discoverd_service":"abc"}}]` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the meta cannot be set.
-func TestHandler_PutServiceMeta_ErrUnknown(t *testing.T) {
+// Ensure the handler serves Consul-compatible health entries, with draining
+// instances excluded by the passing filter.
+func TestHandler_ConsulHealthService(t *testing.T) {
 	h := NewHandler()
-	h.Store.SetServiceMetaFn = func(_ string, _ *discoverd.ServiceMeta) error {
-		return errors.New("marker")
+	h.Store.LastIndexFn = func() uint64 { return 7 }
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		}
+		return []*discoverd.Instance{
+			{ID: "inst0", Addr: "10.0.0.1:80", Proto: "http", Index: 5},
+			{ID: "inst1", Addr: "10.0.0.2:80", Proto: "http", Index: 6, State: discoverd.InstanceStateDraining},
+		}, nil
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/meta", strings.NewReader(`{"index":12}`)))
-	if w.Code != http.StatusInternalServerError {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/v1/health/service/abc?passing", nil))
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+	} else if idx := w.Header().Get("X-Consul-Index"); idx != "7" {
+		t.Fatalf("unexpected consul index: %s", idx)
+	} else if w.Body.String() != `[{"Node":{"Node":"discoverd","Address":"10.0.0.1"},"Service":{"ID":"inst0","Service":"abc","Address":"10.0.0.1","Port":80,"Tags":["http"],"Meta":{}},"Checks":[{"CheckID":"service:inst0","Name":"Service 'abc' check","Status":"passing","ServiceID":"inst0","ServiceName":"abc"}]}]` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler can retrieve metadata for a service.
-func TestHandler_GetServiceMeta(t *testing.T) {
+// Ensure the handler serves Envoy EDS responses over REST-JSON xDS.
+func TestHandler_XDSEndpoints(t *testing.T) {
 	h := NewHandler()
-	h.Store.ServiceMetaFn = func(service string) *discoverd.ServiceMeta {
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
 		if service != "abc" {
 			t.Fatalf("unexpected service: %s", service)
 		}
-		return &discoverd.ServiceMeta{Index: 12, Data: json.RawMessage(`{"foo":"bar"}`)}
+		return []*discoverd.Instance{
+			{ID: "inst0", Addr: "10.0.0.1:80", Proto: "http", Index: 5, Meta: map[string]string{"zone": "a"}},
+			{ID: "inst1", Addr: "10.0.0.2:80", Proto: "http", Index: 6, Weight: 200},
+		}, nil
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/meta", nil))
+	h.ServeHTTP(w, MustNewHTTPRequest("POST", "/xds/v3/discovery:endpoints",
+		strings.NewReader(`{"resource_names":["abc"]}`)))
 	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"data":{"foo":"bar"},"index":12}` {
+	} else if w.Body.String() != `{"version_info":"6","resources":[{"@type":"type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment","cluster_name":"abc","endpoints":[{"lb_endpoints":[{"endpoint":{"address":{"socket_address":{"address":"10.0.0.2","port_value":80}}},"health_status":"HEALTHY","load_balancing_weight":200}]},{"locality":{"zone":"a"},"lb_endpoints":[{"endpoint":{"address":{"socket_address":{"address":"10.0.0.1","port_value":80}}},"health_status":"HEALTHY","load_balancing_weight":1}]}]}],"type_url":"type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"}` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the service cannot be found.
-func TestHandler_GetServiceMeta_ErrNotFound(t *testing.T) {
+// Ensure the handler can list service names.
+func TestHandler_GetServices(t *testing.T) {
 	h := NewHandler()
-	h.Store.ServiceMetaFn = func(service string) *discoverd.ServiceMeta { return nil }
+	h.Store.ServiceNamesFn = func() []string {
+		return []string{"service0", "service1"}
+	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/meta", nil))
-	if w.Code != http.StatusNotFound {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services", nil))
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"object_not_found","message":"service meta not found","retry":false}` {
+	} else if w.Body.String() != `["service0","service1"]` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler can create an instance for a service.
-func TestHandler_PutInstance(t *testing.T) {
+// Ensure the handler can restrict a service name listing to a namespace.
+func TestHandler_GetServices_Namespace(t *testing.T) {
 	h := NewHandler()
-
-	// Mock the instance creation.
-	var called bool
-	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
-		called = true
-		if service != "abc" {
-			t.Fatalf("unexpected service: %s", service)
-		} else if !reflect.DeepEqual(inst, &discoverd.Instance{
-			ID:    "74667cebd845d088d811ddef924895b7",
-			Addr:  "localhost:10000",
-			Proto: "http",
-			Meta:  map[string]string{"foo": "bar"},
-			Index: 12,
-		}) {
-			t.Fatalf("unexpected inst: %#v", inst)
-		}
-		return nil
+	h.Store.ServiceNamesFn = func() []string {
+		return []string{"prod/web", "staging/web", "web"}
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7",
-		strings.NewReader(`{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http","meta":{"foo":"bar"},"index":12}`)))
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services?namespace=prod", nil))
 	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `` {
+	} else if w.Body.String() != `["prod/web"]` {
 		t.Fatalf("unexpected body: %s", w.Body.String())
-	} else if !called {
-		t.Fatal("Store.AddInstance() not called")
 	}
 }
 
-// Ensure the handler returns an error if body cannot be parsed.
-func TestHandler_PutInstance_ErrInvalidJSON(t *testing.T) {
+// Ensure the handler can stream instances events from a service.
+func TestHandler_GetInstances_Stream(t *testing.T) {
 	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		if service != "abc" {
+			t.Fatalf("unexpected service: %s", service)
+		} else if sendCurrent != true {
+			t.Fatalf("unexpected send current: %v", sendCurrent)
+		} else if kinds != discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown {
+			t.Fatalf("unexpected kinds: %d", kinds)
+		}
+
+		// Send an event back to the stream.
+		ch <- &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindUp,
+			Instance: &discoverd.Instance{ID: "xxx"},
+		}
+		close(ch)
+		return chanStream(ch)
+	}
+
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/74667cebd845d088d811ddef924895b7", strings.NewReader(`{"id":`)))
-	if w.Code != http.StatusInternalServerError {
+	r := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
+	r.Header.Set("Accept", "text/event-stream")
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
+	} else if w.Body.String() != `data: {"service":"abc","kind":"up","instance":{"id":"xxx","addr":"","proto":""}}`+"\n\n" {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the instance is invalid.
-func TestHandler_PutInstance_ErrInvalid(t *testing.T) {
+// Ensure the handler streams instance events when the "watch" query
+// parameter is set, without requiring an Accept header.
+func TestHandler_GetInstances_Watch(t *testing.T) {
 	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		// Send an event back to the stream.
+		ch <- &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindUp,
+			Instance: &discoverd.Instance{ID: "xxx"},
+		}
+		close(ch)
+		return chanStream(ch)
+	}
+
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/xxx",
-		strings.NewReader(`{"id":"xxx"}`)))
-	if w.Code != http.StatusBadRequest {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?watch=true", nil))
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"validation_error","message":"discoverd: proto must be set","retry":false}` {
+	} else if w.Header().Get("Content-Type") != "text/event-stream; charset=utf-8" {
+		t.Fatalf("unexpected content type: %s", w.Header().Get("Content-Type"))
+	} else if w.Body.String() != `data: {"service":"abc","kind":"up","instance":{"id":"xxx","addr":"","proto":""}}`+"\n\n" {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the service is not found.
-func TestHandler_PutInstance_ErrNotFound(t *testing.T) {
+// Ensure the handler filters instance events on the canary flag when
+// streaming.
+func TestHandler_GetInstances_Stream_Canary(t *testing.T) {
 	h := NewHandler()
-	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
-		return server.NotFoundError{Service: "abc"}
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		ch <- &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindUp,
+			Instance: &discoverd.Instance{ID: "xxx", Canary: true},
+		}
+		ch <- &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindUp,
+			Instance: &discoverd.Instance{ID: "yyy"},
+		}
+		close(ch)
+		return chanStream(ch)
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/xxx",
-		strings.NewReader(`{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http","meta":{"foo":"bar"},"index":12}`)))
-	if w.Code != http.StatusNotFound {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?watch=true&canary=false", nil))
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"object_not_found","message":"discoverd: service \"abc\" not found","retry":false}` {
+	} else if w.Body.String() != `data: {"service":"abc","kind":"up","instance":{"id":"yyy","addr":"","proto":""}}`+"\n\n" {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the instance cannot be created.
-func TestHandler_PutInstance_ErrUnknown(t *testing.T) {
+// Ensure the handler returns the current event index with instance listings.
+func TestHandler_GetInstances_EventIndex(t *testing.T) {
 	h := NewHandler()
-	h.Store.AddInstanceFn = func(service string, inst *discoverd.Instance) error {
-		return errors.New("marker")
+	h.Store.GetWithIndexFn = func(service string, selector server.Selector) ([]*discoverd.Instance, uint64, error) {
+		return []*discoverd.Instance{{ID: "inst0", Addr: "localhost:1111", Proto: "http", Index: 3}}, 7, nil
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("PUT", "/services/abc/instances/xxx",
-		strings.NewReader(`{"id":"74667cebd845d088d811ddef924895b7","addr":"localhost:10000","proto":"http","meta":{"foo":"bar"},"index":12}`)))
-	if w.Code != http.StatusInternalServerError {
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances", nil))
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
-		t.Fatalf("unexpected body: %s", w.Body.String())
+	} else if w.Header().Get("Discoverd-Event-Index") != "7" {
+		t.Fatalf("unexpected event index: %q", w.Header().Get("Discoverd-Event-Index"))
 	}
 }
 
-// Ensure the handler can remove an instance.
-func TestHandler_DeleteInstance(t *testing.T) {
+// Ensure a long-poll answers immediately when the event index has already
+// moved past the one in the If-None-Match header.
+func TestHandler_GetInstances_LongPollChanged(t *testing.T) {
 	h := NewHandler()
-
-	// Mock the instance deletion.
-	var called bool
-	h.Store.RemoveInstanceFn = func(service, instanceID string) error {
-		called = true
-		if service != "abc" {
-			t.Fatalf("unexpected service: %s", service)
-		} else if instanceID != "74667cebd845d088d811ddef924895b7" {
-			t.Fatalf("unexpected instance id: %#v", instanceID)
-		}
-		return nil
+	h.Store.GetWithIndexFn = func(service string, selector server.Selector) ([]*discoverd.Instance, uint64, error) {
+		return []*discoverd.Instance{{ID: "inst0", Addr: "localhost:1111", Proto: "http", Index: 3}}, 7, nil
+	}
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		return chanStream(ch)
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/abc/instances/74667cebd845d088d811ddef924895b7", nil))
+	r := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
+	r.Header.Set("If-None-Match", `"5"`)
+	h.ServeHTTP(w, r)
 	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `` {
-		t.Fatalf("unexpected body: %s", w.Body.String())
-	} else if !called {
-		t.Fatal("Store.RemoveInstance() not called")
+	} else if w.Header().Get("Discoverd-Event-Index") != "7" {
+		t.Fatalf("unexpected event index: %q", w.Header().Get("Discoverd-Event-Index"))
 	}
 }
 
-// Ensure the handler returns an error if the instance doesn't exist.
-func TestHandler_DeleteInstance_ErrNotFound(t *testing.T) {
+// Ensure a long-poll is held until an event arrives when the event index
+// still matches the one in the If-None-Match header.
+func TestHandler_GetInstances_LongPollEvent(t *testing.T) {
 	h := NewHandler()
-	h.Store.RemoveInstanceFn = func(service, instanceID string) error {
-		return server.NotFoundError{Service: "abc", Instance: "74667cebd845d088d811ddef924895b7"}
+	h.Store.GetWithIndexFn = func(service string, selector server.Selector) ([]*discoverd.Instance, uint64, error) {
+		return []*discoverd.Instance{{ID: "inst0", Addr: "localhost:1111", Proto: "http", Index: 3}}, 7, nil
+	}
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		if sendCurrent {
+			t.Fatalf("unexpected send current: %v", sendCurrent)
+		}
+		ch <- &discoverd.Event{
+			Service:  service,
+			Kind:     discoverd.EventKindUp,
+			Instance: &discoverd.Instance{ID: "inst1"},
+		}
+		return chanStream(ch)
 	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/abc/instances/74667cebd845d088d811ddef924895b7", nil))
-	if w.Code != http.StatusNotFound {
+	r := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
+	r.Header.Set("If-None-Match", `"7"`)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"object_not_found","message":"discoverd: instance abc/74667cebd845d088d811ddef924895b7 not found","retry":false}` {
-		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler returns an error if the instance can't be removed.
-func TestHandler_DeleteInstance_ErrUnknown(t *testing.T) {
+// Ensure a long-poll answers 304 when nothing changes within the wait.
+func TestHandler_GetInstances_LongPollTimeout(t *testing.T) {
 	h := NewHandler()
-	h.Store.RemoveInstanceFn = func(service, instanceID string) error { return errors.New("marker") }
+	h.Store.GetWithIndexFn = func(service string, selector server.Selector) ([]*discoverd.Instance, uint64, error) {
+		return []*discoverd.Instance{{ID: "inst0", Addr: "localhost:1111", Proto: "http", Index: 3}}, 7, nil
+	}
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		return chanStream(ch)
+	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("DELETE", "/services/abc/instances/74667cebd845d088d811ddef924895b7", nil))
-	if w.Code != http.StatusInternalServerError {
+	r := MustNewHTTPRequest("GET", "/services/abc/instances?wait=10ms", nil)
+	r.Header.Set("If-None-Match", `"7"`)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `{"code":"unknown_error","message":"Something went wrong","retry":false}` {
-		t.Fatalf("unexpected body: %s", w.Body.String())
+	} else if w.Header().Get("Discoverd-Event-Index") != "7" {
+		t.Fatalf("unexpected event index: %q", w.Header().Get("Discoverd-Event-Index"))
 	}
 }
 
-// Ensure the handler can retrieve a list of instances for a service.
-func TestHandler_GetInstances(t *testing.T) {
+// Ensure a long-poll rejects an invalid wait duration.
+func TestHandler_GetInstances_LongPollErrWait(t *testing.T) {
 	h := NewHandler()
-	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
-		return []*discoverd.Instance{{ID: "inst0"}, {ID: "inst1"}}, nil
-	}
 
 	w := httptest.NewRecorder()
-	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances", nil))
-	if w.Code != http.StatusOK {
+	r := MustNewHTTPRequest("GET", "/services/abc/instances?wait=bogus", nil)
+	r.Header.Set("If-None-Match", `"7"`)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `[{"id":"inst0","addr":"","proto":""},{"id":"inst1","addr":"","proto":""}]` {
-		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
-// Ensure the handler can stream instances events from a service.
-func TestHandler_GetInstances_Stream(t *testing.T) {
+// Ensure the handler resumes a stream from a previous event index when the
+// "since" query parameter is set.
+func TestHandler_GetInstances_Stream_Since(t *testing.T) {
 	h := NewHandler()
-	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	h.Store.SubscribeSinceFn = func(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error) {
 		if service != "abc" {
 			t.Fatalf("unexpected service: %s", service)
-		} else if sendCurrent != true {
-			t.Fatalf("unexpected send current: %v", sendCurrent)
-		} else if kinds != discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown {
-			t.Fatalf("unexpected kinds: %d", kinds)
+		} else if sinceIndex != 7 {
+			t.Fatalf("unexpected since index: %d", sinceIndex)
 		}
 
-		// Send an event back to the stream.
+		// Replay the next event to the stream.
 		ch <- &discoverd.Event{
-			Service:  service,
-			Kind:     discoverd.EventKindUp,
-			Instance: &discoverd.Instance{ID: "xxx"},
+			Service:    service,
+			Kind:       discoverd.EventKindUp,
+			Instance:   &discoverd.Instance{ID: "xxx"},
+			EventIndex: 8,
 		}
 		close(ch)
-		return chanStream(ch)
+		return chanStream(ch), nil
 	}
 
 	w := httptest.NewRecorder()
-	r := MustNewHTTPRequest("GET", "/services/abc/instances", nil)
-	r.Header.Set("Accept", "text/event-stream")
-	h.ServeHTTP(w, r)
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?watch=true&since=7", nil))
 	if w.Code != http.StatusOK {
 		t.Fatalf("unexpected status code: %d", w.Code)
-	} else if w.Body.String() != `data: {"service":"abc","kind":"up","instance":{"id":"xxx","addr":"","proto":""}}`+"\n\n" {
+	} else if w.Body.String() != `data: {"service":"abc","kind":"up","instance":{"id":"xxx","addr":"","proto":""},"event_index":8}`+"\n\n" {
 		t.Fatalf("unexpected body: %s", w.Body.String())
 	}
 }
 
+// Ensure the handler reports a truncated event log so the client can resync.
+func TestHandler_GetInstances_Stream_SinceTruncated(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeSinceFn = func(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error) {
+		return nil, server.ErrEventLogTruncated
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/instances?watch=true&since=1", nil))
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
+
 // Ensure the handler returns an error if a nil set of instances is returned from the store.
 func TestHandler_GetInstances_ErrNotFound(t *testing.T) {
 	h := NewHandler()
@@ -705,6 +2025,39 @@ func TestHandler_GetLeader_ErrNoLeader(t *testing.T) {
 	}
 }
 
+// Ensure the handler can list cluster members with their health and lag.
+func TestHandler_GetClusterMembers(t *testing.T) {
+	// Mock a healthy peer answering status probes at log index 7.
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Discoverd-Index", "7")
+	}))
+	defer peer.Close()
+	addr := strings.TrimPrefix(peer.URL, "http://")
+
+	h := NewHandler()
+	h.Store.GetPeersFn = func() ([]string, error) {
+		return []string{addr, "127.0.0.1:1"}, nil
+	}
+	h.Store.LeaderFn = func() string { return addr }
+	h.Store.LastIndexFn = func() uint64 { return 10 }
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/cluster/members", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	var members []*server.ClusterMember
+	if err := json.Unmarshal(w.Body.Bytes(), &members); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(members, []*server.ClusterMember{
+		{Addr: addr, Role: "leader", Healthy: true, LastIndex: 7, Lag: 3},
+		{Addr: "127.0.0.1:1", Role: "peer"},
+	}) {
+		t.Fatalf("unexpected members: %v", members)
+	}
+}
+
 // Handler represents a test wrapper for server.Handler.
 type Handler struct {
 	*server.Handler
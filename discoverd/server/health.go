@@ -0,0 +1,348 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/health"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// DefaultHealthCheckInterval is the default interval between instance
+	// health probes on the leader.
+	DefaultHealthCheckInterval = 2 * time.Second
+
+	// DefaultHealthThreshold is the default number of consecutive probe
+	// results before an instance transitions between healthy and unhealthy.
+	DefaultHealthThreshold = 2
+
+	// healthStatsWindow is the number of recent probes the rolling latency
+	// and failure-rate data is computed over.
+	healthStatsWindow = 10
+
+	// healthLatencyRatio and healthFailureDelta bound what counts as a
+	// significant change: health info is republished when the rolling
+	// latency moves by more than the ratio in either direction or the
+	// failure rate moves by at least the delta.
+	healthLatencyRatio = 1.5
+	healthFailureDelta = 0.2
+)
+
+// healthLogger records health state transitions.
+var healthLogger = NewLogger("health")
+
+// instanceProbe is a single health probe of an instance, built from the
+// health check configured on its service.
+type instanceProbe struct {
+	service   string
+	id        string
+	addr      string
+	check     health.Check
+	healthy   bool // health state in the store before the probe
+	threshold int
+}
+
+// healthStats is a ring of an instance's recent probe results, from which
+// its rolling latency and failure rate are computed.
+type healthStats struct {
+	latencies [healthStatsWindow]time.Duration
+	failed    [healthStatsWindow]bool
+	n, next   int
+}
+
+// add records one probe result.
+func (h *healthStats) add(latency time.Duration, failed bool) {
+	h.latencies[h.next] = latency
+	h.failed[h.next] = failed
+	h.next = (h.next + 1) % healthStatsWindow
+	if h.n < healthStatsWindow {
+		h.n++
+	}
+}
+
+// info returns the rolling data over the recorded probes. The latency
+// averages successful probes only, so timeouts don't masquerade as slowness.
+func (h *healthStats) info() *discoverd.HealthInfo {
+	info := &discoverd.HealthInfo{}
+	var total time.Duration
+	var ok int
+	for i := 0; i < h.n; i++ {
+		if h.failed[i] {
+			info.FailureRate++
+			continue
+		}
+		total += h.latencies[i]
+		ok++
+	}
+	if h.n > 0 {
+		info.FailureRate /= float64(h.n)
+	}
+	if ok > 0 {
+		info.Latency = total / time.Duration(ok)
+	}
+	return info
+}
+
+// significantHealthChange returns whether next differs enough from the last
+// published info to be worth republishing.
+func significantHealthChange(prev, next *discoverd.HealthInfo) bool {
+	if prev == nil {
+		return true
+	}
+	delta := next.FailureRate - prev.FailureRate
+	if delta >= healthFailureDelta || -delta >= healthFailureDelta {
+		return true
+	}
+	if prev.Latency == 0 {
+		return next.Latency != 0
+	}
+	ratio := float64(next.Latency) / float64(prev.Latency)
+	return ratio >= healthLatencyRatio || ratio <= 1/healthLatencyRatio
+}
+
+// checker runs in a separate goroutine and probes instances of services with
+// a health check configured.
+func (s *Store) checker() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		// Wait for next check or for close signal.
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+
+		// Probe all instances with a health check configured.
+		if err := s.EnforceHealthChecks(); err != nil && err != raft.ErrNotLeader {
+			s.logger.Printf("enforce health checks: %s", err)
+		}
+	}
+}
+
+// EnforceHealthChecks probes every instance of services with a health check
+// configured and issues health transitions for instances that have failed or
+// passed enough consecutive probes.
+// This function returns raft.ErrNotLeader if this store is not the current leader.
+func (s *Store) EnforceHealthChecks() error {
+	if !s.IsLeader() {
+		return raft.ErrNotLeader
+	}
+
+	// Build probes for services with a health check configured.
+	var probes []*instanceProbe
+	d := s.readData()
+	for service, config := range d.Services {
+		if config == nil || config.HealthCheck == nil {
+			continue
+		}
+		hc := config.HealthCheck
+		threshold := hc.Threshold
+		if threshold <= 0 {
+			threshold = DefaultHealthThreshold
+		}
+		for id, inst := range d.Instances[service] {
+			var check health.Check
+			switch hc.Type {
+			case "tcp":
+				check = &health.TCPCheck{Addr: inst.Addr}
+			case "http":
+				path := hc.Path
+				if path == "" {
+					path = "/"
+				}
+				check = &health.HTTPCheck{URL: "http://" + inst.Addr + path}
+			case "script":
+				cmd := make([]string, 0, len(hc.Command)+1)
+				cmd = append(cmd, hc.Command...)
+				cmd = append(cmd, inst.Addr)
+				check = &health.ScriptCheck{Command: cmd}
+			default:
+				continue
+			}
+			probes = append(probes, &instanceProbe{
+				service:   service,
+				id:        id,
+				addr:      inst.Addr,
+				check:     check,
+				healthy:   !d.Unhealthy[service][id],
+				threshold: threshold,
+			})
+		}
+	}
+
+	// Run the probes concurrently, timing each one.
+	errs := make([]error, len(probes))
+	latencies := make([]time.Duration, len(probes))
+	var wg sync.WaitGroup
+	wg.Add(len(probes))
+	for i, probe := range probes {
+		go func(i int, probe *instanceProbe) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = probe.check.Check()
+			latencies[i] = time.Since(start)
+		}(i, probe)
+	}
+	wg.Wait()
+
+	// Update the consecutive result counts and collect transitions for
+	// instances that have crossed their threshold.
+	type transition struct {
+		service string
+		id      string
+		healthy bool
+	}
+	var transitions []transition
+	type publication struct {
+		service string
+		id      string
+		info    *discoverd.HealthInfo
+	}
+	var publications []publication
+	s.mu.Lock()
+	seen := make(map[instanceKey]struct{}, len(probes))
+	for i, probe := range probes {
+		key := instanceKey{probe.service, probe.id}
+		seen[key] = struct{}{}
+
+		// Update the rolling latency and failure-rate data, collecting
+		// a publication if it changed significantly since last publish.
+		stats := s.healthStats[key]
+		if stats == nil {
+			stats = &healthStats{}
+			s.healthStats[key] = stats
+		}
+		stats.add(latencies[i], errs[i] != nil)
+		if info := stats.info(); significantHealthChange(s.healthPublished[key], info) {
+			publications = append(publications, publication{probe.service, probe.id, info})
+			s.healthPublished[key] = info
+		}
+
+		if errs[i] != nil {
+			if s.healthStreaks[key] > 0 {
+				s.healthStreaks[key] = 0
+			}
+			s.healthStreaks[key]--
+			if probe.healthy && -s.healthStreaks[key] >= probe.threshold {
+				healthLogger.Warn("marking instance unhealthy",
+					"fn", "EnforceHealthChecks",
+					"service", probe.service,
+					"instance.id", probe.id,
+					"instance.addr", probe.addr,
+					"err", errs[i],
+				)
+				transitions = append(transitions, transition{probe.service, probe.id, false})
+			}
+		} else {
+			if s.healthStreaks[key] < 0 {
+				s.healthStreaks[key] = 0
+			}
+			s.healthStreaks[key]++
+			if !probe.healthy && s.healthStreaks[key] >= probe.threshold {
+				healthLogger.Info("marking instance healthy",
+					"fn", "EnforceHealthChecks",
+					"service", probe.service,
+					"instance.id", probe.id,
+					"instance.addr", probe.addr,
+				)
+				transitions = append(transitions, transition{probe.service, probe.id, true})
+			}
+		}
+	}
+
+	// Drop counts for instances that are no longer probed.
+	for key := range s.healthStreaks {
+		if _, ok := seen[key]; !ok {
+			delete(s.healthStreaks, key)
+		}
+	}
+	for key := range s.healthStats {
+		if _, ok := seen[key]; !ok {
+			delete(s.healthStats, key)
+			delete(s.healthPublished, key)
+		}
+	}
+	s.mu.Unlock()
+
+	// Apply the transitions via raft.
+	for _, t := range transitions {
+		if err := s.SetInstanceHealth(t.service, t.id, t.healthy); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+
+	// Publish significantly changed health info via raft.
+	for _, p := range publications {
+		if err := s.SetInstanceHealthInfo(p.service, p.id, p.info); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetInstanceHealthInfo attaches rolling latency and failure-rate data to an
+// instance, broadcasting an "update" event so load balancers can rebalance
+// towards fast instances.
+func (s *Store) SetInstanceHealthInfo(service, id string, info *discoverd.HealthInfo) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&setHealthInfoCommand{
+		Service: service,
+		ID:      id,
+		Info:    info,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(setHealthInfoCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+type setHealthInfoCommand struct {
+	Service string
+	ID      string
+	Info    *discoverd.HealthInfo
+}
+
+func (s *Store) applySetHealthInfoCommand(cmd []byte) error {
+	var c setHealthInfoCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the instance exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+	inst := s.data.Instances[c.Service][c.ID]
+	if inst == nil {
+		return NotFoundError{Service: c.Service, Instance: c.ID}
+	}
+
+	// Replace the instance with an annotated copy so the published read
+	// snapshot is unaffected.
+	m := s.data.cowInstances(c.Service)
+	other := *inst
+	other.HealthInfo = c.Info
+	m[c.ID] = &other
+
+	// Broadcast event.
+	s.broadcast(&discoverd.Event{
+		Service:  c.Service,
+		Kind:     discoverd.EventKindUpdate,
+		Instance: &other,
+		Changed:  []string{"health_info"},
+	})
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Departure reasons recorded in the per-service history. They share their
+// values with the reasons attached to "down" events.
+const (
+	DepartureReasonDeregistered = discoverd.DownReasonDeregistered
+	DepartureReasonExpired      = discoverd.DownReasonExpired
+	DepartureReasonDrained      = discoverd.DownReasonDrained
+)
+
+// downReason refines the reason for an instance's removal: an instance that
+// was draining when it deregistered is reported as drained.
+func downReason(inst *discoverd.Instance, reason string) string {
+	if reason == discoverd.DownReasonDeregistered && inst.State == discoverd.InstanceStateDraining {
+		return discoverd.DownReasonDrained
+	}
+	return reason
+}
+
+// DefaultServiceHistorySize is the default number of departed instances
+// retained per service.
+const DefaultServiceHistorySize = 32
+
+// InstanceDeparture is one record in a service's departure history: an
+// instance that was recently removed, when, and why.
+type InstanceDeparture struct {
+	Instance   *discoverd.Instance `json:"instance"`
+	Reason     string              `json:"reason"`
+	DepartedAt time.Time           `json:"departed_at"`
+}
+
+// recordDeparture appends an entry to a service's departure history,
+// discarding the oldest entries once the retention bound is reached. An
+// instance that was draining when it deregistered is recorded as drained.
+// Must be called under mutex.
+func (s *Store) recordDeparture(service string, inst *discoverd.Instance, reason string, now time.Time) {
+	if s.ServiceHistorySize <= 0 {
+		return
+	}
+	reason = downReason(inst, reason)
+	if s.history == nil {
+		s.history = make(map[string][]*InstanceDeparture)
+	}
+	h := append(s.history[service], &InstanceDeparture{
+		Instance:   inst,
+		Reason:     reason,
+		DepartedAt: now.UTC(),
+	})
+	if len(h) > s.ServiceHistorySize {
+		h = h[len(h)-s.ServiceHistorySize:]
+	}
+	s.history[service] = h
+}
+
+// History returns a service's recently departed instances, oldest first, so
+// operators debugging a vanished instance can see when it went away and why
+// without consulting external logs.
+func (s *Store) History(service string) []*InstanceDeparture {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := s.history[s.resolveService(service)]
+	other := make([]*InstanceDeparture, len(h))
+	copy(other, h)
+	return other
+}
+
+// serveGetHistory returns the recently departed instances of a service.
+func (h *Handler) serveGetHistory(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := params.ByName("service")
+	if err := ValidServiceName(service); err != nil {
+		hh.ValidationError(w, "service", err.Error())
+		return
+	}
+	hh.JSON(w, 200, h.Store.History(service))
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// idempotencyCacheSize is the number of responses retained for replay.
+	idempotencyCacheSize = 4096
+
+	// idempotencyWindow is how long a recorded response is replayed for
+	// retries carrying the same Idempotency-Key.
+	idempotencyWindow = time.Minute
+)
+
+// idempotencyCache records responses to mutating requests so that retries
+// carrying the same Idempotency-Key header receive the recorded response
+// instead of re-applying the mutation.
+type idempotencyCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+	now func() time.Time
+}
+
+// idempotencyEntry is a recorded response and the time it expires.
+type idempotencyEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	lru, err := simplelru.NewLRU(idempotencyCacheSize, nil)
+	if err != nil {
+		panic(err) // only possible if size <= 0
+	}
+	return &idempotencyCache{lru: lru, now: time.Now}
+}
+
+func (c *idempotencyCache) get(key string) *idempotencyEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil
+	}
+	entry := v.(*idempotencyEntry)
+	if c.now().After(entry.expires) {
+		c.lru.Remove(key)
+		return nil
+	}
+	return entry
+}
+
+func (c *idempotencyCache) set(key string, entry *idempotencyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.expires = c.now().Add(idempotencyWindow)
+	c.lru.Add(key, entry)
+}
+
+// idempotent wraps a mutating handler with Idempotency-Key support. Requests
+// without the header pass through unchanged.
+func (h *Handler) idempotent(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handle(w, r, params)
+			return
+		}
+
+		// Scope the key by method and path so the same key used against
+		// different endpoints doesn't collide.
+		key = r.Method + " " + r.URL.Path + " " + key
+
+		// Replay the recorded response, if any.
+		if entry := h.idempotency.get(key); entry != nil {
+			for k, v := range entry.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotency-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		// Record the response while serving the request.
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handle(rec, r, params)
+
+		// Don't record redirects, the retry should follow the redirect to
+		// the current leader instead.
+		if rec.status >= 300 && rec.status < 400 {
+			return
+		}
+
+		h.idempotency.set(key, &idempotencyEntry{
+			status: rec.status,
+			header: w.Header().Clone(),
+			body:   rec.body.Bytes(),
+		})
+	}
+}
+
+// responseRecorder passes a response through while recording the status code
+// and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Interceptor is invoked synchronously around instance and leadership
+// mutations, so embedders can enforce custom policies — such as rejecting
+// registrations missing a required meta key — without forking the store.
+//
+// Before hooks run on the node handling the mutation, before it is proposed
+// to raft; returning an error rejects the mutation and the error is returned
+// to the caller. After hooks run once the mutation has been committed.
+// Hooks must be fast: they run on the mutation path and block the caller.
+type Interceptor interface {
+	// BeforeAddInstance is called before an instance registration is
+	// proposed. The registration may be mutated.
+	BeforeAddInstance(service string, inst *discoverd.Instance) error
+
+	// AfterAddInstance is called after a registration is committed.
+	AfterAddInstance(service string, inst *discoverd.Instance)
+
+	// BeforeRemoveInstance is called before an instance removal is
+	// proposed.
+	BeforeRemoveInstance(service, id string) error
+
+	// AfterRemoveInstance is called after a removal is committed.
+	AfterRemoveInstance(service, id string)
+
+	// BeforeSetLeader is called before a manual leader change is proposed.
+	BeforeSetLeader(service, id string) error
+
+	// AfterSetLeader is called after a manual leader change is committed.
+	AfterSetLeader(service, id string)
+}
+
+// NopInterceptor is an Interceptor whose hooks all do nothing. Embed it to
+// implement only the hooks of interest.
+type NopInterceptor struct{}
+
+func (NopInterceptor) BeforeAddInstance(service string, inst *discoverd.Instance) error {
+	return nil
+}
+func (NopInterceptor) AfterAddInstance(service string, inst *discoverd.Instance) {}
+func (NopInterceptor) BeforeRemoveInstance(service, id string) error             { return nil }
+func (NopInterceptor) AfterRemoveInstance(service, id string)                    {}
+func (NopInterceptor) BeforeSetLeader(service, id string) error                  { return nil }
+func (NopInterceptor) AfterSetLeader(service, id string)                         {}
@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// policyInterceptor rejects registrations missing an "env" meta key and
+// records the hooks invoked.
+type policyInterceptor struct {
+	server.NopInterceptor
+	calls []string
+}
+
+func (i *policyInterceptor) BeforeAddInstance(service string, inst *discoverd.Instance) error {
+	if inst.Meta["env"] == "" {
+		return errors.New("missing env meta key")
+	}
+	i.calls = append(i.calls, "before-add "+service+"/"+inst.ID)
+	return nil
+}
+
+func (i *policyInterceptor) AfterAddInstance(service string, inst *discoverd.Instance) {
+	i.calls = append(i.calls, "after-add "+service+"/"+inst.ID)
+}
+
+func (i *policyInterceptor) BeforeRemoveInstance(service, id string) error {
+	i.calls = append(i.calls, "before-remove "+service+"/"+id)
+	return nil
+}
+
+func (i *policyInterceptor) AfterRemoveInstance(service, id string) {
+	i.calls = append(i.calls, "after-remove "+service+"/"+id)
+}
+
+// Ensure store mutations consult the interceptor and a rejection is returned
+// to the caller without registering the instance.
+func TestStore_Interceptor(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	ic := &policyInterceptor{}
+	s.Interceptor = ic
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify a registration without the required meta key is rejected.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err == nil || err.Error() != "missing env meta key" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if insts, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(insts) != 0 {
+		t.Fatalf("unexpected instances: %#v", insts)
+	}
+
+	// Verify a valid registration and a removal pass through the hooks.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Meta: map[string]string{"env": "prod"}}); err != nil {
+		t.Fatal(err)
+	} else if err = s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"before-add service0/inst0",
+		"after-add service0/inst0",
+		"before-remove service0/inst0",
+		"after-remove service0/inst0",
+	}
+	if !reflect.DeepEqual(ic.calls, expected) {
+		t.Fatalf("unexpected calls: %#v", ic.calls)
+	}
+}
+
+// Ensure a transaction consults the interceptor for each operation and is
+// rejected as a whole when any operation is.
+func TestStore_Interceptor_Transact(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	s.Interceptor = &policyInterceptor{}
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Transact([]*server.TxOp{
+		{Op: server.TxOpAddInstance, Service: "service0", Instance: &discoverd.Instance{ID: "inst0", Meta: map[string]string{"env": "prod"}}},
+		{Op: server.TxOpAddInstance, Service: "service0", Instance: &discoverd.Instance{ID: "inst1"}},
+	})
+	if err == nil || err.Error() != "missing env meta key" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if insts, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(insts) != 0 {
+		t.Fatalf("unexpected instances: %#v", insts)
+	}
+}
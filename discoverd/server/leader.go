@@ -0,0 +1,107 @@
+package server
+
+import (
+	"strconv"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// DefaultLeaderMetaKey is the meta key compared by meta-priority leader
+// election when the service config doesn't name one.
+const DefaultLeaderMetaKey = "priority"
+
+// LeaderPicker selects a service leader from the candidate instances.
+// Candidates have already been filtered to exclude unhealthy and
+// out-of-rotation instances; a picker only decides the ordering.
+type LeaderPicker interface {
+	// PickLeader returns the instance that should lead, or nil if there
+	// are no candidates.
+	PickLeader(candidates []*discoverd.Instance) *discoverd.Instance
+}
+
+// leaderPicker returns the picker for a service config, or nil if the
+// service elects its leader manually or not at all.
+func leaderPicker(config *discoverd.ServiceConfig) LeaderPicker {
+	if config == nil {
+		return nil
+	}
+	switch config.LeaderType {
+	case discoverd.LeaderTypeOldest:
+		return oldestPicker{}
+	case discoverd.LeaderTypeNewest:
+		return newestPicker{}
+	case discoverd.LeaderTypeLexicographic:
+		return lexicographicPicker{}
+	case discoverd.LeaderTypeMetaPriority:
+		key := config.LeaderMetaKey
+		if key == "" {
+			key = DefaultLeaderMetaKey
+		}
+		return metaPriorityPicker{key: key}
+	default:
+		return nil
+	}
+}
+
+// oldestPicker elects the instance with the lowest Index, i.e. the longest
+// registered instance. This is the historical default.
+type oldestPicker struct{}
+
+func (oldestPicker) PickLeader(candidates []*discoverd.Instance) *discoverd.Instance {
+	var leader *discoverd.Instance
+	for _, inst := range candidates {
+		if leader == nil || inst.Index < leader.Index {
+			leader = inst
+		}
+	}
+	return leader
+}
+
+// newestPicker elects the instance with the highest Index, i.e. the most
+// recently registered instance.
+type newestPicker struct{}
+
+func (newestPicker) PickLeader(candidates []*discoverd.Instance) *discoverd.Instance {
+	var leader *discoverd.Instance
+	for _, inst := range candidates {
+		if leader == nil || inst.Index > leader.Index {
+			leader = inst
+		}
+	}
+	return leader
+}
+
+// lexicographicPicker elects the instance with the lowest Addr, breaking
+// ties on Index so re-registrations don't flap leadership.
+type lexicographicPicker struct{}
+
+func (lexicographicPicker) PickLeader(candidates []*discoverd.Instance) *discoverd.Instance {
+	var leader *discoverd.Instance
+	for _, inst := range candidates {
+		if leader == nil || inst.Addr < leader.Addr || (inst.Addr == leader.Addr && inst.Index < leader.Index) {
+			leader = inst
+		}
+	}
+	return leader
+}
+
+// metaPriorityPicker elects the instance with the highest numeric value of a
+// designated meta key. Instances without the key, or with a non-numeric
+// value, are treated as priority zero, and ties fall back to the oldest
+// instance so adding unprioritized instances doesn't move leadership.
+type metaPriorityPicker struct {
+	key string
+}
+
+func (p metaPriorityPicker) PickLeader(candidates []*discoverd.Instance) *discoverd.Instance {
+	var leader *discoverd.Instance
+	var leaderPriority float64
+	for _, inst := range candidates {
+		priority, _ := strconv.ParseFloat(inst.Meta[p.key], 64)
+		if leader == nil || priority > leaderPriority || (priority == leaderPriority && inst.Index < leader.Index) {
+			leader = inst
+			leaderPriority = priority
+		}
+	}
+	return leader
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Registration-time memory limits. Each limit is a knob on Store and zero
+// disables the check. Unlike the subscriber and removal job ceilings, which
+// evict, registrations over a limit are rejected with a LimitError so a
+// misbehaving client can't exhaust server memory.
+
+// LimitError is returned when a registration would exceed a configured
+// memory limit.
+type LimitError struct {
+	// Resource names the limited resource, e.g. "services".
+	Resource string
+	Limit    int
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("discoverd: %s limit of %d exceeded", e.Resource, e.Limit)
+}
+
+// IsLimitError returns whether err is a LimitError.
+func IsLimitError(err error) bool {
+	_, ok := err.(LimitError)
+	return ok
+}
+
+// checkInstanceLimits verifies a registration against the instance limits.
+// added counts new instances the current atomic change has already accepted
+// for the service, so batches can't overshoot the ceiling.
+// Must be called under mutex.
+func (s *Store) checkInstanceLimits(service string, inst *discoverd.Instance, added int) error {
+	if prevExists := s.data.Instances[service][inst.ID] != nil; !prevExists {
+		if s.MaxInstances > 0 && len(s.data.Instances[service])+added >= s.MaxInstances {
+			return LimitError{Resource: "instances per service", Limit: s.MaxInstances}
+		}
+	}
+	if s.MaxMetaBytes > 0 && metaSize(inst.Meta) > s.MaxMetaBytes {
+		return LimitError{Resource: "instance meta bytes", Limit: s.MaxMetaBytes}
+	}
+	if s.MaxAnnotationBytes > 0 && annotationSize(inst.Annotations) > s.MaxAnnotationBytes {
+		return LimitError{Resource: "instance annotation bytes", Limit: s.MaxAnnotationBytes}
+	}
+	return nil
+}
+
+// metaSize returns the size of an instance's metadata, counting both keys
+// and values.
+func metaSize(meta map[string]string) int {
+	n := 0
+	for k, v := range meta {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// annotationSize returns the size of an instance's annotations, counting
+// both keys and decoded values.
+func annotationSize(annotations map[string][]byte) int {
+	n := 0
+	for k, v := range annotations {
+		n += len(k) + len(v)
+	}
+	return n
+}
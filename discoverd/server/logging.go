@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	stdlog "log"
+	"strings"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+)
+
+// LogLevel is the severity of a log record. Records below a component's
+// configured level are dropped before reaching the backend.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+	LogOff
+)
+
+// ParseLogLevel parses a level name as used by the -log-level flag.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "warn":
+		return LogWarn, nil
+	case "error":
+		return LogError, nil
+	case "off":
+		return LogOff, nil
+	}
+	return 0, fmt.Errorf("discoverd: invalid log level %q", name)
+}
+
+// Logger is the minimal structured logging interface used by the server.
+// Records are a message plus alternating key/value context. Adapters are
+// provided for log15, the default backend, and the standard library logger;
+// any other backend can be plugged in with SetLogger.
+type Logger interface {
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+
+	// New returns a child logger with additional bound context.
+	New(ctx ...interface{}) Logger
+}
+
+var logConfig = struct {
+	mu           sync.RWMutex
+	sink         Logger
+	defaultLevel LogLevel
+	levels       map[string]LogLevel
+}{
+	sink:         Log15Logger(log15.New()),
+	defaultLevel: LogInfo,
+	levels:       make(map[string]LogLevel),
+}
+
+// SetLogger replaces the logging backend used by every component.
+func SetLogger(l Logger) {
+	logConfig.mu.Lock()
+	logConfig.sink = l
+	logConfig.mu.Unlock()
+}
+
+// SetLogLevel sets the minimum level logged by a component, such as "store",
+// "broadcast", "health" or "shadow".
+func SetLogLevel(component string, level LogLevel) {
+	logConfig.mu.Lock()
+	logConfig.levels[component] = level
+	logConfig.mu.Unlock()
+}
+
+// SetDefaultLogLevel sets the minimum level for components without an
+// explicit level. The initial default is LogInfo.
+func SetDefaultLogLevel(level LogLevel) {
+	logConfig.mu.Lock()
+	logConfig.defaultLevel = level
+	logConfig.mu.Unlock()
+}
+
+func logSink() Logger {
+	logConfig.mu.RLock()
+	defer logConfig.mu.RUnlock()
+	return logConfig.sink
+}
+
+func logLevelFor(component string) LogLevel {
+	logConfig.mu.RLock()
+	defer logConfig.mu.RUnlock()
+	if level, ok := logConfig.levels[component]; ok {
+		return level
+	}
+	return logConfig.defaultLevel
+}
+
+// NewLogger returns a logger for one server component. Records carry the
+// component name as context and are filtered by the component's level.
+func NewLogger(component string, ctx ...interface{}) Logger {
+	return &componentLogger{component: component, ctx: ctx}
+}
+
+type componentLogger struct {
+	component string
+	ctx       []interface{}
+}
+
+func (l *componentLogger) merged(ctx []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(l.ctx)+len(ctx)+2)
+	out = append(out, "component", l.component)
+	out = append(out, l.ctx...)
+	return append(out, ctx...)
+}
+
+func (l *componentLogger) enabled(level LogLevel) bool {
+	return level >= logLevelFor(l.component)
+}
+
+func (l *componentLogger) Debug(msg string, ctx ...interface{}) {
+	if l.enabled(LogDebug) {
+		logSink().Debug(msg, l.merged(ctx)...)
+	}
+}
+
+func (l *componentLogger) Info(msg string, ctx ...interface{}) {
+	if l.enabled(LogInfo) {
+		logSink().Info(msg, l.merged(ctx)...)
+	}
+}
+
+func (l *componentLogger) Warn(msg string, ctx ...interface{}) {
+	if l.enabled(LogWarn) {
+		logSink().Warn(msg, l.merged(ctx)...)
+	}
+}
+
+func (l *componentLogger) Error(msg string, ctx ...interface{}) {
+	if l.enabled(LogError) {
+		logSink().Error(msg, l.merged(ctx)...)
+	}
+}
+
+func (l *componentLogger) New(ctx ...interface{}) Logger {
+	merged := make([]interface{}, 0, len(l.ctx)+len(ctx))
+	merged = append(merged, l.ctx...)
+	return &componentLogger{component: l.component, ctx: append(merged, ctx...)}
+}
+
+// Log15Logger adapts a log15 logger to the Logger interface.
+func Log15Logger(l log15.Logger) Logger {
+	return log15Adapter{l}
+}
+
+type log15Adapter struct {
+	l log15.Logger
+}
+
+func (a log15Adapter) Debug(msg string, ctx ...interface{}) { a.l.Debug(msg, ctx...) }
+func (a log15Adapter) Info(msg string, ctx ...interface{})  { a.l.Info(msg, ctx...) }
+func (a log15Adapter) Warn(msg string, ctx ...interface{})  { a.l.Warn(msg, ctx...) }
+func (a log15Adapter) Error(msg string, ctx ...interface{}) { a.l.Error(msg, ctx...) }
+func (a log15Adapter) New(ctx ...interface{}) Logger        { return log15Adapter{a.l.New(ctx...)} }
+
+// StdLogger adapts a standard library logger, rendering records as
+// logfmt-style lines.
+func StdLogger(l *stdlog.Logger) Logger {
+	return stdAdapter{l: l}
+}
+
+type stdAdapter struct {
+	l   *stdlog.Logger
+	ctx []interface{}
+}
+
+func (a stdAdapter) print(level, msg string, ctx []interface{}) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "lvl=%s msg=%q", level, msg)
+	all := make([]interface{}, 0, len(a.ctx)+len(ctx))
+	all = append(all, a.ctx...)
+	all = append(all, ctx...)
+	for i := 0; i+1 < len(all); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", all[i], all[i+1])
+	}
+	a.l.Print(b.String())
+}
+
+func (a stdAdapter) Debug(msg string, ctx ...interface{}) { a.print("dbug", msg, ctx) }
+func (a stdAdapter) Info(msg string, ctx ...interface{})  { a.print("info", msg, ctx) }
+func (a stdAdapter) Warn(msg string, ctx ...interface{})  { a.print("warn", msg, ctx) }
+func (a stdAdapter) Error(msg string, ctx ...interface{}) { a.print("eror", msg, ctx) }
+
+func (a stdAdapter) New(ctx ...interface{}) Logger {
+	merged := make([]interface{}, 0, len(a.ctx)+len(ctx))
+	merged = append(merged, a.ctx...)
+	return stdAdapter{l: a.l, ctx: append(merged, ctx...)}
+}
@@ -0,0 +1,111 @@
+package server_test
+
+import (
+	"bytes"
+	stdlog "log"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flynn/flynn/discoverd/server"
+	"github.com/inconshreveable/log15"
+)
+
+// recordingLogger is a Logger backend that captures records for inspection.
+// It locks because stores from other tests may still log from background
+// goroutines.
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+type logRecord struct {
+	level string
+	msg   string
+	ctx   []interface{}
+}
+
+func (l *recordingLogger) log(level, msg string, ctx []interface{}) {
+	// Only record the test's own components, in case a store from another
+	// test is still logging.
+	if len(ctx) < 2 || (ctx[1] != "quiet" && ctx[1] != "chatty") {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, logRecord{level: level, msg: msg, ctx: ctx})
+}
+
+func (l *recordingLogger) snapshot() []logRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logRecord{}, l.records...)
+}
+
+func (l *recordingLogger) Debug(msg string, ctx ...interface{}) { l.log("debug", msg, ctx) }
+func (l *recordingLogger) Info(msg string, ctx ...interface{})  { l.log("info", msg, ctx) }
+func (l *recordingLogger) Warn(msg string, ctx ...interface{})  { l.log("warn", msg, ctx) }
+func (l *recordingLogger) Error(msg string, ctx ...interface{}) { l.log("error", msg, ctx) }
+func (l *recordingLogger) New(ctx ...interface{}) server.Logger { return l }
+
+// Ensure records are filtered by per-component level and carry the component
+// and bound context.
+func TestLogging_ComponentLevels(t *testing.T) {
+	sink := &recordingLogger{}
+	server.SetLogger(sink)
+	defer server.SetLogger(server.Log15Logger(log15.New()))
+	defer server.SetLogLevel("quiet", server.LogInfo)
+
+	server.SetLogLevel("quiet", server.LogWarn)
+	quiet := server.NewLogger("quiet")
+	chatty := server.NewLogger("chatty").New("bound", "ctx")
+
+	quiet.Info("suppressed")
+	quiet.Warn("kept")
+	chatty.Debug("suppressed") // below the LogInfo default
+	chatty.Info("kept too", "extra", 1)
+
+	records := sink.snapshot()
+	if len(records) != 2 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if r := records[0]; r.level != "warn" || r.msg != "kept" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	r := records[1]
+	if r.level != "info" || r.msg != "kept too" {
+		t.Fatalf("unexpected record: %+v", r)
+	}
+	want := []interface{}{"component", "chatty", "bound", "ctx", "extra", 1}
+	if len(r.ctx) != len(want) {
+		t.Fatalf("unexpected context: %+v", r.ctx)
+	}
+	for i := range want {
+		if r.ctx[i] != want[i] {
+			t.Fatalf("unexpected context: %+v", r.ctx)
+		}
+	}
+}
+
+// Ensure the standard library adapter renders logfmt-style lines.
+func TestLogging_StdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := server.StdLogger(stdlog.New(&buf, "", 0)).New("service", "a")
+	l.Warn("queue full", "depth", 64)
+	if line := strings.TrimSpace(buf.String()); line != `lvl=warn msg="queue full" service=a depth=64` {
+		t.Fatalf("unexpected line: %s", line)
+	}
+}
+
+// Ensure log level names parse and invalid names are rejected.
+func TestParseLogLevel(t *testing.T) {
+	if level, err := server.ParseLogLevel("debug"); err != nil || level != server.LogDebug {
+		t.Fatalf("unexpected result: %v, %v", level, err)
+	}
+	if level, err := server.ParseLogLevel("WARN"); err != nil || level != server.LogWarn {
+		t.Fatalf("unexpected result: %v, %v", level, err)
+	}
+	if _, err := server.ParseLogLevel("loud"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultMDNSInterval is the default interval between unsolicited
+	// mDNS re-announcements.
+	DefaultMDNSInterval = time.Minute
+
+	// mdnsTTL is the TTL of announced records; re-announcements happen
+	// well within it.
+	mdnsTTL = 120
+
+	// mdnsAddr is the well-known IPv4 multicast DNS group.
+	mdnsAddr = "224.0.0.251:5353"
+)
+
+// MDNSAnnouncer announces registered services on the local network via
+// multicast DNS, publishing each service as _<name>._tcp.local with SRV, TXT
+// and address records per instance, so developer laptops and edge devices can
+// browse Flynn services with standard zeroconf tools.
+//
+// The announcer multicasts unsolicited responses on registration changes and
+// on a refresh interval, and sends goodbye packets (TTL zero) when closed.
+// It is announce-only: mDNS queries from the network are not answered.
+type MDNSAnnouncer struct {
+	// Store is the source of announced services.
+	Store interface {
+		ServiceNames() []string
+		Instances(service string) ([]*discoverd.Instance, error)
+		Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
+	}
+
+	// Interval is the time between unsolicited re-announcements.
+	Interval time.Duration
+
+	mu   sync.Mutex
+	conn *net.UDPConn
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewMDNSAnnouncer returns an announcer publishing the store's services.
+func NewMDNSAnnouncer(store *Store) *MDNSAnnouncer {
+	return &MDNSAnnouncer{
+		Store:    store,
+		Interval: DefaultMDNSInterval,
+		closing:  make(chan struct{}),
+	}
+}
+
+// Start opens the multicast socket and begins announcing.
+func (a *MDNSAnnouncer) Start() error {
+	addr, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+	a.conn = conn
+
+	a.wg.Add(1)
+	go a.run()
+	return nil
+}
+
+// Close sends goodbye packets for all announced services and stops the
+// announcer.
+func (a *MDNSAnnouncer) Close() error {
+	close(a.closing)
+	a.wg.Wait()
+	for _, service := range a.Store.ServiceNames() {
+		a.announce(service, 0)
+	}
+	return a.conn.Close()
+}
+
+// run re-announces all services on the refresh interval and announces
+// individual services as their registrations change.
+func (a *MDNSAnnouncer) run() {
+	defer a.wg.Done()
+
+	events := make(chan *discoverd.Event, StreamBufferSize)
+	stream := a.Store.Subscribe(WildcardService, false, discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown|discoverd.EventKindServiceDown, events)
+	defer stream.Close()
+
+	a.announceAll()
+
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.closing:
+			return
+		case <-ticker.C:
+			a.announceAll()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			a.announce(event.Service, mdnsTTL)
+		}
+	}
+}
+
+func (a *MDNSAnnouncer) announceAll() {
+	for _, service := range a.Store.ServiceNames() {
+		a.announce(service, mdnsTTL)
+	}
+}
+
+// announce multicasts an unsolicited response with the service's current
+// records. A zero ttl is a goodbye packet telling caches to drop them.
+func (a *MDNSAnnouncer) announce(service string, ttl uint32) error {
+	instances, err := a.Store.Instances(service)
+	if err != nil {
+		return err
+	}
+
+	msg := &dns.Msg{}
+	msg.Response = true
+	msg.Authoritative = true
+
+	svcName := fmt.Sprintf("_%s._tcp.local.", service)
+	for _, inst := range instances {
+		msg.Answer = append(msg.Answer, instanceMDNSRecords(svcName, inst, ttl)...)
+	}
+	if len(msg.Answer) == 0 {
+		return nil
+	}
+
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.conn.Write(buf)
+	return err
+}
+
+// instanceMDNSRecords builds the PTR, SRV, TXT and address records that
+// announce one instance of a service.
+func instanceMDNSRecords(svcName string, inst *discoverd.Instance, ttl uint32) []dns.RR {
+	instName := fmt.Sprintf("%s.%s", inst.ID, svcName)
+	target := fmt.Sprintf("%s.local.", inst.ID)
+	host, portStr, _ := net.SplitHostPort(inst.Addr)
+	port, _ := strconv.Atoi(portStr)
+
+	records := []dns.RR{
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: svcName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: instName,
+		},
+		&dns.SRV{
+			Hdr:      dns.RR_Header{Name: instName, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Priority: metaUint16(inst.Meta, "priority", 1),
+			Weight:   inst.EffectiveWeight(),
+			Port:     uint16(port),
+			Target:   target,
+		},
+	}
+
+	// Publish instance metadata as TXT key=value pairs.
+	if len(inst.Meta) > 0 {
+		txt := &dns.TXT{
+			Hdr: dns.RR_Header{Name: instName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		}
+		for k, v := range inst.Meta {
+			txt.Txt = append(txt.Txt, fmt.Sprintf("%s=%s", k, v))
+		}
+		records = append(records, txt)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+				A:   ip4,
+			})
+		} else {
+			records = append(records, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: target, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: ip,
+			})
+		}
+	}
+	return records
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/status"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Operators manage the discovery tier itself through the /cluster/members
+// API: it lists the discoverd servers with their role, health and
+// replication lag, and joins or removes peers like any other resource.
+
+// clusterProbeTimeout bounds the health probe of each peer when listing
+// cluster members.
+const clusterProbeTimeout = 2 * time.Second
+
+// ClusterMember describes one discoverd server in the cluster.
+type ClusterMember struct {
+	// Addr is the peer's advertised host:port.
+	Addr string `json:"addr"`
+
+	// Role is "leader" for the current raft leader and "peer" otherwise.
+	Role string `json:"role"`
+
+	// Healthy reports whether the peer answered its status probe.
+	Healthy bool `json:"healthy"`
+
+	// LastIndex is the last raft log index the peer reported in its probe
+	// response.
+	LastIndex uint64 `json:"last_index,omitempty"`
+
+	// Lag is how many log entries the peer trails behind the server
+	// answering the listing.
+	Lag uint64 `json:"lag,omitempty"`
+}
+
+// serveGetClusterMembers lists the discoverd servers in the cluster, probing
+// each peer concurrently for its health and applied log index.
+func (h *Handler) serveGetClusterMembers(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	peers, err := h.Store.GetPeers()
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+
+	leader := h.Store.Leader()
+	localIndex := h.Store.LastIndex()
+
+	members := make([]*ClusterMember, len(peers))
+	var wg sync.WaitGroup
+	wg.Add(len(peers))
+	for i, peer := range peers {
+		go func(i int, peer string) {
+			defer wg.Done()
+			m := &ClusterMember{Addr: peer, Role: "peer"}
+			if peer == leader {
+				m.Role = "leader"
+			}
+			m.Healthy, m.LastIndex = probePeer(peer)
+			if m.Healthy && m.LastIndex < localIndex {
+				m.Lag = localIndex - m.LastIndex
+			}
+			members[i] = m
+		}(i, peer)
+	}
+	wg.Wait()
+
+	hh.JSON(w, 200, members)
+}
+
+// probePeer checks a peer's status endpoint, returning whether it answered
+// and the last log index it reported.
+func probePeer(peer string) (healthy bool, lastIndex uint64) {
+	client := &http.Client{Timeout: clusterProbeTimeout}
+	res, err := client.Get("http://" + peer + status.Path)
+	if err != nil {
+		return false, 0
+	}
+	res.Body.Close()
+	index, _ := strconv.ParseUint(res.Header.Get("Discoverd-Index"), 10, 64)
+	return res.StatusCode == http.StatusOK, index
+}
+
+// servePutClusterMember joins a peer to the cluster.
+func (h *Handler) servePutClusterMember(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.servePutRaftPeer(w, r, params)
+}
+
+// serveDeleteClusterMember removes a peer from the cluster.
+func (h *Handler) serveDeleteClusterMember(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.serveDeleteRaftPeer(w, r, params)
+}
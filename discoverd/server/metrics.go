@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// serveGetMetrics renders server state in the Prometheus text exposition
+// format so the server can be scraped directly, without a sidecar exporter.
+// Broadcast latency is exposed as a summary (sum and count) since the store
+// tracks totals rather than buckets.
+func (h *Handler) serveGetMetrics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var buf bytes.Buffer
+
+	stats := h.Store.Stats()
+	services := make([]string, 0, len(stats))
+	for service := range stats {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	writeGauge := func(name, help string, value func(ServiceStats) int) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, service := range services {
+			fmt.Fprintf(&buf, "%s{service=%q} %d\n", name, service, value(stats[service]))
+		}
+	}
+	writeGauge("discoverd_service_instances", "Number of registered instances.", func(s ServiceStats) int { return s.Instances })
+	writeGauge("discoverd_service_instances_unhealthy", "Number of instances failing their health check.", func(s ServiceStats) int { return s.Unhealthy })
+	writeGauge("discoverd_service_instances_draining", "Number of instances draining before deregistration.", func(s ServiceStats) int { return s.Draining })
+	writeGauge("discoverd_service_subscribers", "Number of event subscribers.", func(s ServiceStats) int { return s.Subscribers })
+
+	events := h.Store.EventStats()
+	eventServices := make([]string, 0, len(events))
+	for service := range events {
+		eventServices = append(eventServices, service)
+	}
+	sort.Strings(eventServices)
+
+	buf.WriteString("# HELP discoverd_events_total Number of events broadcast.\n# TYPE discoverd_events_total counter\n")
+	for _, service := range eventServices {
+		kinds := make([]string, 0, len(events[service]))
+		for kind := range events[service] {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			fmt.Fprintf(&buf, "discoverd_events_total{service=%q,kind=%q} %d\n", service, kind, events[service][kind].Count)
+		}
+	}
+
+	buf.WriteString("# HELP discoverd_broadcast_latency_seconds Time spent delivering events to subscribers.\n# TYPE discoverd_broadcast_latency_seconds summary\n")
+	for _, service := range eventServices {
+		kinds := make([]string, 0, len(events[service]))
+		for kind := range events[service] {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			s := events[service][kind]
+			fmt.Fprintf(&buf, "discoverd_broadcast_latency_seconds_sum{service=%q,kind=%q} %g\n", service, kind, float64(s.TotalLatency)/1e9)
+			fmt.Fprintf(&buf, "discoverd_broadcast_latency_seconds_count{service=%q,kind=%q} %d\n", service, kind, s.Count)
+		}
+	}
+
+	evictions := h.Store.EvictionStats()
+	resources := make([]string, 0, len(evictions))
+	for resource := range evictions {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	buf.WriteString("# HELP discoverd_evictions_total Number of evictions per limited resource, including dropped events and closed slow subscribers.\n# TYPE discoverd_evictions_total counter\n")
+	for _, resource := range resources {
+		fmt.Fprintf(&buf, "discoverd_evictions_total{resource=%q} %d\n", resource, evictions[resource])
+	}
+
+	// Per-subscription delivery statistics, so slow consumers that trigger
+	// ErrSendBlocked closures or dropped events can be identified.
+	subscribers := h.Store.Subscribers()
+	buf.WriteString("# HELP discoverd_subscriber_dropped_events_total Events dropped or abandoned because a subscriber's queue was full.\n# TYPE discoverd_subscriber_dropped_events_total counter\n")
+	for _, sub := range subscribers {
+		fmt.Fprintf(&buf, "discoverd_subscriber_dropped_events_total{service=%q,id=\"%d\"} %d\n", sub.Service, sub.ID, sub.Dropped)
+	}
+	buf.WriteString("# HELP discoverd_subscriber_queue_depth Events waiting in a subscriber's queue.\n# TYPE discoverd_subscriber_queue_depth gauge\n")
+	for _, sub := range subscribers {
+		fmt.Fprintf(&buf, "discoverd_subscriber_queue_depth{service=%q,id=\"%d\"} %d\n", sub.Service, sub.ID, sub.QueueDepth)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// AddrMapper selects between an instance's internal Addr and its external
+// AdvertiseAddr based on the network the requesting client is on. Clients
+// whose source address falls inside one of the configured internal CIDRs are
+// answered with the internal address; everyone else gets the advertised one.
+// Instances without an AdvertiseAddr are returned unchanged.
+type AddrMapper struct {
+	internal []*net.IPNet
+}
+
+// NewAddrMapper returns a mapper treating the given CIDRs as internal
+// networks.
+func NewAddrMapper(cidrs []string) (*AddrMapper, error) {
+	m := &AddrMapper{}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		m.internal = append(m.internal, ipnet)
+	}
+	return m, nil
+}
+
+// External reports whether a client address is outside all internal networks.
+// Unparseable addresses are treated as internal, so loopback and unix socket
+// clients keep the historical behaviour.
+func (m *AddrMapper) External(clientAddr string) bool {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		host = clientAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range m.internal {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Map returns the instance with the address appropriate for the client,
+// cloning it if a rewrite is needed so stored state is never modified.
+func (m *AddrMapper) Map(inst *discoverd.Instance, clientAddr string) *discoverd.Instance {
+	if inst == nil || inst.AdvertiseAddr == "" || !m.External(clientAddr) {
+		return inst
+	}
+	other := inst.Clone()
+	other.Addr = other.AdvertiseAddr
+	return other
+}
+
+// MapAll maps a list of instances for the client, cloning the slice only if
+// at least one instance needs rewriting.
+func (m *AddrMapper) MapAll(instances []*discoverd.Instance, clientAddr string) []*discoverd.Instance {
+	rewrite := false
+	for _, inst := range instances {
+		if inst.AdvertiseAddr != "" {
+			rewrite = true
+			break
+		}
+	}
+	if !rewrite || !m.External(clientAddr) {
+		return instances
+	}
+	other := make([]*discoverd.Instance, len(instances))
+	for i, inst := range instances {
+		other[i] = m.Map(inst, clientAddr)
+	}
+	return other
+}
@@ -0,0 +1,56 @@
+package server_test
+
+import (
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure the address mapper answers internal clients with the internal
+// address and external clients with the advertised one.
+func TestAddrMapper(t *testing.T) {
+	m, err := server.NewAddrMapper([]string{"10.0.0.0/8", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inst := &discoverd.Instance{
+		ID:            "inst0",
+		Addr:          "10.0.0.1:80",
+		AdvertiseAddr: "203.0.113.5:8080",
+	}
+
+	// Internal clients get the internal address.
+	if mapped := m.Map(inst, "10.1.2.3:5555"); mapped.Addr != "10.0.0.1:80" {
+		t.Fatalf("unexpected addr: %s", mapped.Addr)
+	}
+
+	// External clients get the advertised address; the stored instance is
+	// not modified.
+	if mapped := m.Map(inst, "198.51.100.7:5555"); mapped.Addr != "203.0.113.5:8080" {
+		t.Fatalf("unexpected addr: %s", mapped.Addr)
+	} else if inst.Addr != "10.0.0.1:80" {
+		t.Fatalf("instance was modified: %s", inst.Addr)
+	}
+
+	// Instances without an advertise address are returned unchanged.
+	plain := &discoverd.Instance{ID: "inst1", Addr: "10.0.0.2:80"}
+	if mapped := m.Map(plain, "198.51.100.7:5555"); mapped != plain {
+		t.Fatal("expected unmapped instance")
+	}
+
+	// Unparseable client addresses are treated as internal.
+	if m.External("@") {
+		t.Fatal("expected unparseable address to be internal")
+	}
+
+	instances := []*discoverd.Instance{inst, plain}
+	mapped := m.MapAll(instances, "198.51.100.7:5555")
+	if mapped[0].Addr != "203.0.113.5:8080" || mapped[1].Addr != "10.0.0.2:80" {
+		t.Fatalf("unexpected addrs: %s, %s", mapped[0].Addr, mapped[1].Addr)
+	}
+	if same := m.MapAll(instances, "192.168.1.1:5555"); &same[0] != &instances[0] && same[0] != instances[0] {
+		t.Fatal("expected unmapped slice for internal client")
+	}
+}
@@ -0,0 +1,776 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// serveOpenAPI returns the OpenAPI specification for the HTTP API.
+func (h *Handler) serveOpenAPI(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
+
+// openAPISpec is the OpenAPI 3.0 description of the HTTP API. It is verified
+// against the registered routes in openapi_test.go.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "discoverd",
+    "description": "Service discovery API for registering service instances, querying them, electing leaders and watching for changes.",
+    "version": "1.0.0"
+  },
+  "paths": {
+    "/services": {
+      "get": {
+        "summary": "List service names",
+        "parameters": [
+          {"name": "namespace", "in": "query", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["name"]}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer"}},
+          {"name": "cursor", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Service names", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}}}
+      }
+    },
+    "/services/{service}": {
+      "put": {
+        "summary": "Create a service",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceConfig"}}}},
+        "responses": {"200": {"description": "Service created"}}
+      },
+      "delete": {
+        "summary": "Remove a service",
+        "parameters": [
+          {"name": "async", "in": "query", "schema": {"type": "boolean"}}
+        ],
+        "responses": {
+          "200": {"description": "Service removed"},
+          "202": {"description": "Asynchronous removal started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceRemoval"}}}}
+        }
+      },
+      "get": {
+        "summary": "Stream service events",
+        "parameters": [
+          {"name": "selector", "in": "query", "schema": {"type": "string"}},
+          {"name": "watch", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "coalesce", "in": "query", "schema": {"type": "string"}},
+          {"name": "digest", "in": "query", "schema": {"type": "string"}},
+          {"name": "priority", "in": "query", "schema": {"type": "string", "enum": ["low", "normal", "high"]}},
+          {"name": "canary", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "since", "in": "query", "schema": {"type": "integer", "format": "uint64"}}
+        ],
+        "responses": {"200": {"description": "Event stream", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/Event"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/freeze": {
+      "put": {
+        "summary": "Freeze writes to a service",
+        "responses": {"200": {"description": "Service frozen"}}
+      },
+      "delete": {
+        "summary": "Unfreeze writes to a service",
+        "responses": {"200": {"description": "Service unfrozen"}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/rename": {
+      "put": {
+        "summary": "Rename a service, leaving an alias under the old name",
+        "requestBody": {"content": {"application/json": {"schema": {"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}}}},
+        "responses": {"200": {"description": "Service renamed"}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/aliases/{alias}": {
+      "delete": {
+        "summary": "Retire an alias left behind by a rename",
+        "responses": {"200": {"description": "Alias retired"}}
+      },
+      "parameters": [{"name": "alias", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/config": {
+      "put": {
+        "summary": "Update service configuration",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceConfig"}}}},
+        "responses": {"200": {"description": "Configuration updated"}}
+      },
+      "get": {
+        "summary": "Get service configuration",
+        "responses": {"200": {"description": "Service configuration", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceConfig"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/meta": {
+      "put": {
+        "summary": "Set service metadata",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceMeta"}}}},
+        "responses": {"200": {"description": "Updated metadata", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceMeta"}}}}}
+      },
+      "get": {
+        "summary": "Get service metadata",
+        "responses": {"200": {"description": "Service metadata", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceMeta"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/instances": {
+      "get": {
+        "summary": "List service instances",
+        "parameters": [
+          {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["index", "addr", "weight"]}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer"}},
+          {"name": "cursor", "in": "query", "schema": {"type": "string"}},
+          {"name": "selector", "in": "query", "schema": {"type": "string"}},
+          {"name": "watch", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "coalesce", "in": "query", "schema": {"type": "string"}},
+          {"name": "digest", "in": "query", "schema": {"type": "string"}},
+          {"name": "priority", "in": "query", "schema": {"type": "string", "enum": ["low", "normal", "high"]}},
+          {"name": "canary", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "zone", "in": "query", "schema": {"type": "string"}},
+          {"name": "since", "in": "query", "schema": {"type": "integer", "format": "uint64"}},
+          {"name": "wait", "in": "query", "schema": {"type": "string"}},
+          {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Instances", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Instance"}}}, "application/x-protobuf": {"schema": {"type": "string", "format": "binary"}}}}, "304": {"description": "No change within the wait"}}
+      },
+      "put": {
+        "summary": "Register a batch of instances atomically",
+        "parameters": [{"name": "consistency", "in": "query", "schema": {"type": "string", "enum": ["one", "quorum", "all"]}}],
+        "requestBody": {"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Instance"}}}}},
+        "responses": {"200": {"description": "Instances registered"}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/instances/{instance_id}": {
+      "put": {
+        "summary": "Register an instance",
+        "parameters": [{"name": "consistency", "in": "query", "schema": {"type": "string", "enum": ["one", "quorum", "all"]}}],
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Instance"}}, "application/x-protobuf": {"schema": {"type": "string", "format": "binary"}}}},
+        "responses": {"200": {"description": "Instance registered"}}
+      },
+      "delete": {
+        "summary": "Deregister an instance",
+        "responses": {"200": {"description": "Instance deregistered"}}
+      },
+      "parameters": [
+        {"name": "service", "in": "path", "required": true, "schema": {"type": "string"}},
+        {"name": "instance_id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ]
+    },
+    "/services/{service}/instances/{instance_id}/drain": {
+      "put": {
+        "summary": "Mark an instance as draining before deregistration",
+        "responses": {"200": {"description": "Instance draining"}}
+      },
+      "parameters": [
+        {"name": "service", "in": "path", "required": true, "schema": {"type": "string"}},
+        {"name": "instance_id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ]
+    },
+    "/services/{service}/instances/{instance_id}/maintenance": {
+      "put": {
+        "summary": "Put an instance into maintenance, pulling it from rotation",
+        "responses": {"200": {"description": "Instance in maintenance"}}
+      },
+      "delete": {
+        "summary": "Take an instance out of maintenance",
+        "responses": {"200": {"description": "Instance back in rotation"}}
+      },
+      "parameters": [
+        {"name": "service", "in": "path", "required": true, "schema": {"type": "string"}},
+        {"name": "instance_id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ]
+    },
+    "/services/{service}/state": {
+      "get": {
+        "summary": "Get a service's instances and leadership as one atomic snapshot",
+        "responses": {"200": {"description": "Service state", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceState"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/history": {
+      "get": {
+        "summary": "Get a service's recently departed instances",
+        "responses": {"200": {"description": "Departure history", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/InstanceDeparture"}}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/watch": {
+      "get": {
+        "summary": "Watch a service over the framed, acknowledged protocol",
+        "parameters": [
+          {"name": "selector", "in": "query", "schema": {"type": "string"}},
+          {"name": "priority", "in": "query", "schema": {"type": "string", "enum": ["low", "normal", "high"]}},
+          {"name": "window", "in": "query", "schema": {"type": "integer"}},
+          {"name": "ping", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Watch frames", "content": {"application/vnd.discoverd.watch+json": {"schema": {"type": "string"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/leader": {
+      "put": {
+        "summary": "Set the service leader",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Instance"}}}},
+        "responses": {"200": {"description": "Leader set"}}
+      },
+      "get": {
+        "summary": "Get the service leader",
+        "parameters": [
+          {"name": "watch", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "coalesce", "in": "query", "schema": {"type": "string"}},
+          {"name": "digest", "in": "query", "schema": {"type": "string"}},
+          {"name": "priority", "in": "query", "schema": {"type": "string", "enum": ["low", "normal", "high"]}},
+          {"name": "canary", "in": "query", "schema": {"type": "boolean"}},
+          {"name": "since", "in": "query", "schema": {"type": "integer", "format": "uint64"}},
+          {"name": "proto", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Leader instance", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Instance"}}, "application/x-protobuf": {"schema": {"type": "string", "format": "binary"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/services/{service}/failover": {
+      "post": {
+        "summary": "Demote the current leader and promote another instance",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Instance"}}}},
+        "responses": {"200": {"description": "New leader instance", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Instance"}}}}}
+      },
+      "parameters": [{"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/instances": {
+      "put": {
+        "summary": "Register a batch of instances atomically",
+        "parameters": [{"name": "consistency", "in": "query", "schema": {"type": "string", "enum": ["one", "quorum", "all"]}}],
+        "requestBody": {"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Registration"}}}}},
+        "responses": {"200": {"description": "Instances registered"}}
+      }
+    },
+    "/transactions": {
+      "post": {
+        "summary": "Apply a set of mutations across services atomically",
+        "requestBody": {"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/TxOp"}}}}},
+        "responses": {"200": {"description": "Transaction applied"}}
+      }
+    },
+    "/removals/{removal_id}": {
+      "get": {
+        "summary": "Get the status of an asynchronous service removal",
+        "responses": {"200": {"description": "Removal status", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServiceRemoval"}}}}}
+      },
+      "parameters": [{"name": "removal_id", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/raft/leader": {
+      "get": {
+        "summary": "Get the raft leader",
+        "responses": {"200": {"description": "Raft leader", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RaftLeader"}}}}}
+      }
+    },
+    "/raft/peers": {
+      "get": {
+        "summary": "List raft peers",
+        "responses": {"200": {"description": "Peers", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}}}
+      }
+    },
+    "/raft/peers/{peer}": {
+      "put": {
+        "summary": "Add a raft peer",
+        "responses": {"200": {"description": "Peer added", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TargetLogIndex"}}}}}
+      },
+      "delete": {
+        "summary": "Remove a raft peer",
+        "responses": {"200": {"description": "Peer removed"}}
+      },
+      "parameters": [{"name": "peer", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/raft/promote": {
+      "post": {
+        "summary": "Promote this peer to a raft node",
+        "responses": {"200": {"description": "Promoted"}}
+      }
+    },
+    "/raft/demote": {
+      "post": {
+        "summary": "Demote this peer to a proxy",
+        "responses": {"200": {"description": "Demoted"}}
+      }
+    },
+    "/stats": {
+      "get": {
+        "summary": "Get per-service state, event delivery and eviction statistics",
+        "responses": {"200": {"description": "Statistics", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Stats"}}}}}
+      }
+    },
+    "/webhooks": {
+      "get": {
+        "summary": "List registered webhooks",
+        "responses": {"200": {"description": "Webhooks", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}}}}}
+      }
+    },
+    "/webhooks/{id}": {
+      "put": {
+        "summary": "Register a webhook",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+        "responses": {"200": {"description": "Webhook registered", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}}}
+      },
+      "delete": {
+        "summary": "Deregister a webhook",
+        "responses": {"200": {"description": "Webhook deregistered"}}
+      },
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/audit": {
+      "get": {
+        "summary": "Query the audit log for a service's events",
+        "parameters": [
+          {"name": "service", "in": "query", "required": true, "schema": {"type": "string"}},
+          {"name": "from", "in": "query", "schema": {"type": "string", "format": "date-time"}},
+          {"name": "to", "in": "query", "schema": {"type": "string", "format": "date-time"}}
+        ],
+        "responses": {"200": {"description": "Audit log entries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/AuditEntry"}}}}}}
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Get server metrics in the Prometheus text format",
+        "responses": {"200": {"description": "Metrics", "content": {"text/plain": {"schema": {"type": "string"}}}}}
+      }
+    },
+    "/digests": {
+      "get": {
+        "summary": "Get per-service state digests for replica comparison",
+        "responses": {"200": {"description": "Digests", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Digests"}}}}}
+      }
+    },
+    "/subscribers": {
+      "get": {
+        "summary": "Get delivery statistics for the active event subscriptions",
+        "responses": {"200": {"description": "Subscribers", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/SubscriberStats"}}}}}}
+      }
+    },
+    "/dependencies": {
+      "get": {
+        "summary": "Get the service dependency graph and missing dependencies",
+        "responses": {"200": {"description": "Dependency graph", "content": {"application/json": {"schema": {
+          "type": "object",
+          "properties": {
+            "services": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
+            "missing": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}}
+          }
+        }}}}}
+      }
+    },
+    "/ping": {
+      "get": {
+        "summary": "Check server liveness",
+        "responses": {"200": {"description": "Server is up"}}
+      }
+    },
+    "/shutdown": {
+      "post": {
+        "summary": "Shut down the server",
+        "responses": {"200": {"description": "Shutdown started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TargetLogIndex"}}}}}
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "Get this specification",
+        "responses": {"200": {"description": "OpenAPI specification"}}
+      }
+    },
+    "/prometheus/sd": {
+      "get": {
+        "summary": "Prometheus HTTP service discovery targets",
+        "parameters": [
+          {"name": "service", "in": "query", "schema": {"type": "string"}}
+        ],
+        "responses": {"200": {"description": "Target groups", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/TargetGroup"}}}}}}
+      }
+    },
+    "/cluster/members": {
+      "get": {
+        "summary": "List the discoverd servers with their role, health and lag",
+        "responses": {"200": {"description": "Cluster members", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ClusterMember"}}}}}}
+      }
+    },
+    "/cluster/members/{peer}": {
+      "put": {
+        "summary": "Join a peer to the cluster",
+        "responses": {"200": {"description": "Peer joined", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TargetLogIndex"}}}}}
+      },
+      "delete": {
+        "summary": "Remove a peer from the cluster",
+        "responses": {"200": {"description": "Peer removed"}}
+      },
+      "parameters": [{"name": "peer", "in": "path", "required": true, "schema": {"type": "string"}}]
+    },
+    "/cluster/export": {
+      "get": {
+        "summary": "Export the full cluster state as a versioned document",
+        "responses": {"200": {"description": "Export document", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ClusterExport"}}}}}
+      }
+    },
+    "/cluster/import": {
+      "post": {
+        "summary": "Replace the cluster state with an export document",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ClusterExport"}}}},
+        "responses": {"200": {"description": "State imported"}}
+      }
+    },
+    "/legacy/services": {
+      "get": {
+        "summary": "Legacy v1-compatible service name listing",
+        "responses": {"200": {"description": "Service names", "content": {"application/json": {"schema": {"type": "array", "items": {"type": "string"}}}}}}
+      }
+    },
+    "/legacy/services/{service}": {
+      "parameters": [
+        {"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "Legacy v1-compatible service updates, read-only",
+        "responses": {"200": {"description": "Service updates", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/V1ServiceUpdate"}}}}}}
+      }
+    },
+    "/v1/catalog/services": {
+      "get": {
+        "summary": "Consul-compatible service catalog",
+        "responses": {"200": {"description": "Service names to tags", "content": {"application/json": {"schema": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}}}}}}
+      }
+    },
+    "/v1/catalog/service/{service}": {
+      "parameters": [
+        {"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "Consul-compatible catalog entries for a service",
+        "responses": {"200": {"description": "Catalog entries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ConsulCatalogService"}}}}}}
+      }
+    },
+    "/v1/health/service/{service}": {
+      "parameters": [
+        {"name": "service", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "Consul-compatible health entries for a service",
+        "parameters": [
+          {"name": "passing", "in": "query", "schema": {"type": "boolean"}}
+        ],
+        "responses": {"200": {"description": "Health entries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ConsulHealthEntry"}}}}}}
+      }
+    },
+    "/xds/v3/discovery:endpoints": {
+      "post": {
+        "summary": "Envoy endpoint discovery (EDS) over REST-JSON xDS",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/DiscoveryRequest"}}}},
+        "responses": {"200": {"description": "Cluster load assignments", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DiscoveryResponse"}}}}}
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "tokenAuth": {"type": "http", "scheme": "bearer"}
+    },
+    "schemas": {
+      "Instance": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "addr": {"type": "string"},
+          "advertise_addr": {"type": "string"},
+          "proto": {"type": "string"},
+          "meta": {"type": "object", "additionalProperties": {"type": "string"}},
+          "annotations": {"type": "object", "additionalProperties": {"type": "string", "format": "byte"}},
+          "ttl": {"type": "integer"},
+          "weight": {"type": "integer"},
+          "canary": {"type": "boolean"},
+          "zone": {"type": "string"},
+          "expires_at": {"type": "string", "format": "date-time"},
+          "state": {"type": "string", "enum": ["", "draining", "maintenance"]},
+          "index": {"type": "integer", "format": "uint64"},
+          "health_info": {"$ref": "#/components/schemas/HealthInfo"}
+        },
+        "required": ["id", "addr", "proto"]
+      },
+      "HealthInfo": {
+        "type": "object",
+        "properties": {
+          "latency": {"type": "integer", "format": "int64", "description": "Rolling average probe latency in nanoseconds"},
+          "failure_rate": {"type": "number"}
+        }
+      },
+      "Registration": {
+        "type": "object",
+        "properties": {
+          "service": {"type": "string"},
+          "instance": {"$ref": "#/components/schemas/Instance"}
+        },
+        "required": ["service", "instance"]
+      },
+      "TxOp": {
+        "type": "object",
+        "properties": {
+          "op": {"type": "string", "enum": ["add_instance", "remove_instance", "set_leader"]},
+          "service": {"type": "string"},
+          "id": {"type": "string"},
+          "instance": {"$ref": "#/components/schemas/Instance"}
+        },
+        "required": ["op", "service"]
+      },
+      "Event": {
+        "type": "object",
+        "properties": {
+          "service": {"type": "string"},
+          "kind": {"type": "string"},
+          "instance": {"$ref": "#/components/schemas/Instance"},
+          "service_meta": {"$ref": "#/components/schemas/ServiceMeta"},
+          "changed": {"type": "array", "items": {"type": "string", "enum": ["addr", "advertise_addr", "proto", "weight", "meta"]}},
+          "proto": {"type": "string"},
+          "dependency": {"type": "string"},
+          "leader_token": {"type": "integer", "format": "uint64"},
+          "timestamp": {"type": "integer", "format": "int64"},
+          "origin": {"type": "string"},
+          "reason": {"type": "string", "enum": ["deregistered", "drained", "expired", "service-removed"]}
+        },
+        "required": ["service", "kind"]
+      },
+      "ServiceMeta": {
+        "type": "object",
+        "properties": {
+          "data": {},
+          "leader_id": {"type": "string"},
+          "index": {"type": "integer", "format": "uint64"}
+        },
+        "required": ["data", "index"]
+      },
+      "ServiceState": {
+        "type": "object",
+        "properties": {
+          "instances": {"type": "array", "items": {"$ref": "#/components/schemas/Instance"}},
+          "leader_id": {"type": "string"},
+          "index": {"type": "integer", "format": "uint64"}
+        },
+        "required": ["instances", "index"]
+      },
+      "InstanceDeparture": {
+        "type": "object",
+        "properties": {
+          "instance": {"$ref": "#/components/schemas/Instance"},
+          "reason": {"type": "string", "enum": ["deregistered", "expired", "drained"]},
+          "departed_at": {"type": "string", "format": "date-time"}
+        },
+        "required": ["instance", "reason", "departed_at"]
+      },
+      "ServiceConfig": {
+        "type": "object",
+        "properties": {
+          "leader_type": {"type": "string", "enum": ["manual", "oldest", "newest", "lexicographic", "meta-priority", "none"]},
+          "profile": {"type": "string", "enum": ["postgres", "mysql", "mongodb", "redis"]},
+          "leader_meta_key": {"type": "string"},
+          "dns_policy": {"type": "string", "enum": ["random", "round_robin", "leader", "weighted"]},
+          "instance_ttl": {"type": "integer"},
+          "health_check": {"$ref": "#/components/schemas/HealthCheck"}
+        }
+      },
+      "HealthCheck": {
+        "type": "object",
+        "properties": {
+          "type": {"type": "string", "enum": ["tcp", "http", "script"]},
+          "path": {"type": "string"},
+          "command": {"type": "array", "items": {"type": "string"}},
+          "threshold": {"type": "integer"}
+        },
+        "required": ["type"]
+      },
+      "ServiceRemoval": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "service": {"type": "string"},
+          "total": {"type": "integer"},
+          "sent": {"type": "integer"},
+          "done": {"type": "boolean"}
+        }
+      },
+      "Stats": {
+        "type": "object",
+        "properties": {
+          "services": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "properties": {
+                "instances": {"type": "integer"},
+                "unhealthy": {"type": "integer"},
+                "draining": {"type": "integer"},
+                "maintenance": {"type": "integer"},
+                "flapping": {"type": "integer"},
+                "leader_id": {"type": "string"},
+                "subscribers": {"type": "integer"}
+              }
+            }
+          },
+          "events": {
+            "type": "object",
+            "additionalProperties": {
+              "type": "object",
+              "additionalProperties": {
+                "type": "object",
+                "properties": {
+                  "count": {"type": "integer", "format": "uint64"},
+                  "total_latency_ns": {"type": "integer", "format": "int64"}
+                }
+              }
+            }
+          },
+          "evictions": {"type": "object", "additionalProperties": {"type": "integer", "format": "uint64"}}
+        }
+      },
+      "Webhook": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "url": {"type": "string"},
+          "services": {"type": "array", "items": {"type": "string"}},
+          "kinds": {"type": "array", "items": {"type": "string"}},
+          "secret": {"type": "string"}
+        },
+        "required": ["url"]
+      },
+      "AuditEntry": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "service": {"type": "string"},
+          "kind": {"type": "string"},
+          "instance_id": {"type": "string"},
+          "addr": {"type": "string"}
+        },
+        "required": ["time", "service", "kind"]
+      },
+      "Digests": {
+        "type": "object",
+        "properties": {
+          "last_index": {"type": "integer", "format": "uint64"},
+          "digests": {"type": "object", "additionalProperties": {"type": "integer", "format": "uint64"}}
+        }
+      },
+      "SubscriberStats": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer", "format": "uint64"},
+          "service": {"type": "string"},
+          "priority": {"type": "string", "enum": ["low", "normal", "high"]},
+          "created_at": {"type": "string", "format": "date-time"},
+          "delivered": {"type": "integer", "format": "uint64"},
+          "dropped": {"type": "integer", "format": "uint64"},
+          "queue_depth": {"type": "integer"},
+          "queue_size": {"type": "integer"}
+        },
+        "required": ["id", "service", "created_at"]
+      },
+      "TargetGroup": {
+        "type": "object",
+        "properties": {
+          "targets": {"type": "array", "items": {"type": "string"}},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}}
+        },
+        "required": ["targets"]
+      },
+      "DiscoveryRequest": {
+        "type": "object",
+        "properties": {
+          "version_info": {"type": "string"},
+          "resource_names": {"type": "array", "items": {"type": "string"}},
+          "response_nonce": {"type": "string"}
+        }
+      },
+      "DiscoveryResponse": {
+        "type": "object",
+        "properties": {
+          "version_info": {"type": "string"},
+          "resources": {"type": "array", "items": {"type": "object"}},
+          "type_url": {"type": "string"}
+        }
+      },
+      "ClusterExport": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "integer"},
+          "exported_at": {"type": "string", "format": "date-time"},
+          "services": {"type": "array", "items": {"$ref": "#/components/schemas/ServiceExport"}}
+        },
+        "required": ["version", "exported_at", "services"]
+      },
+      "ServiceExport": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "config": {"$ref": "#/components/schemas/ServiceConfig"},
+          "meta": {"$ref": "#/components/schemas/ServiceMeta"},
+          "leader_id": {"type": "string"},
+          "instances": {"type": "array", "items": {"$ref": "#/components/schemas/Instance"}}
+        },
+        "required": ["name"]
+      },
+      "V1ServiceUpdate": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "addr": {"type": "string"},
+          "online": {"type": "boolean"},
+          "attrs": {"type": "object", "additionalProperties": {"type": "string"}},
+          "created": {"type": "integer", "format": "uint64"}
+        },
+        "required": ["name", "addr", "online", "created"]
+      },
+      "ConsulCatalogService": {
+        "type": "object",
+        "properties": {
+          "Node": {"type": "string"},
+          "Address": {"type": "string"},
+          "ServiceID": {"type": "string"},
+          "ServiceName": {"type": "string"},
+          "ServiceAddress": {"type": "string"},
+          "ServicePort": {"type": "integer"},
+          "ServiceTags": {"type": "array", "items": {"type": "string"}},
+          "ServiceMeta": {"type": "object", "additionalProperties": {"type": "string"}},
+          "CreateIndex": {"type": "integer"},
+          "ModifyIndex": {"type": "integer"}
+        }
+      },
+      "ConsulHealthEntry": {
+        "type": "object",
+        "properties": {
+          "Node": {"type": "object"},
+          "Service": {"type": "object"},
+          "Checks": {"type": "array", "items": {"type": "object"}}
+        }
+      },
+      "RaftLeader": {
+        "type": "object",
+        "properties": {
+          "host": {"type": "string"}
+        }
+      },
+      "TargetLogIndex": {
+        "type": "object",
+        "properties": {
+          "last_index": {"type": "integer", "format": "uint64"}
+        }
+      },
+      "ClusterMember": {
+        "type": "object",
+        "properties": {
+          "addr": {"type": "string"},
+          "role": {"type": "string", "enum": ["leader", "peer"]},
+          "healthy": {"type": "boolean"},
+          "last_index": {"type": "integer", "format": "uint64"},
+          "lag": {"type": "integer", "format": "uint64"}
+        }
+      }
+    }
+  }
+}
+`
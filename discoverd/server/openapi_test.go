@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Ensure the handler serves a valid OpenAPI specification.
+func TestHandler_OpenAPI(t *testing.T) {
+	h := NewHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	} else if spec.OpenAPI == "" {
+		t.Fatal("missing openapi version")
+	}
+
+	// Build the set of operations described by the spec, converting
+	// {param} path segments to httprouter's :param form.
+	param := regexp.MustCompile(`\{([^}]+)\}`)
+	specRoutes := make([]string, 0, len(spec.Paths))
+	for path, ops := range spec.Paths {
+		path = param.ReplaceAllString(path, ":$1")
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			specRoutes = append(specRoutes, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	// Build the set of routes registered on the handler.
+	routes := h.Handler.Routes()
+	registered := make([]string, 0, len(routes))
+	for _, r := range routes {
+		registered = append(registered, r.Method+" "+r.Path)
+	}
+
+	// The spec must describe exactly the registered routes.
+	sort.Strings(specRoutes)
+	sort.Strings(registered)
+	if !equalStrings(specRoutes, registered) {
+		t.Fatalf("spec does not match routes:\nspec:   %v\nroutes: %v", specRoutes, registered)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
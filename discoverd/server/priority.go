@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// SubscriptionPriority ranks a subscriber for delivery degradation. When the
+// store is overloaded, lower tiers fall back to drop-oldest delivery before
+// higher tiers see any delay, so e.g. routers keep full event streams while
+// dashboards are coalesced.
+type SubscriptionPriority int
+
+const (
+	// PriorityLow subscribers are degraded first during overload.
+	PriorityLow SubscriptionPriority = iota
+
+	// PriorityNormal is the default tier. It tolerates twice the backlog
+	// low-priority subscribers do before degrading.
+	PriorityNormal
+
+	// PriorityHigh subscribers are never degraded; their configured
+	// overflow policy always applies.
+	PriorityHigh
+
+	numPriorities = 3
+)
+
+// String returns the API name of the priority.
+func (p SubscriptionPriority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// ParseSubscriptionPriority parses the API name of a priority. An empty
+// string parses as PriorityNormal.
+func ParseSubscriptionPriority(s string) (SubscriptionPriority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "", "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return 0, fmt.Errorf("discoverd: invalid subscription priority %q", s)
+	}
+}
+
+// SubscribePriority creates a subscription at the given delivery tier,
+// otherwise behaving like SubscribeFiltered.
+func (s *Store) SubscribePriority(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) stream.Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Wait for in-flight deliveries so the snapshot sent below is not
+	// followed by replays of events it already reflects.
+	s.flushFanout()
+
+	// Collect the current state under the mutex but leave its delivery to
+	// the subscription, so syncing a huge service can't stall broadcasts to
+	// other subscribers. The terminating "current" event carries the
+	// sequence number of the most recent broadcast so clients completing a
+	// full sync have an index to resume from.
+	var snapshot []*discoverd.Event
+	if sendCurrent {
+		snapshot = s.currentState(service, kinds, selector)
+		if kinds.Any(discoverd.EventKindCurrent) {
+			snapshot = append(snapshot, &discoverd.Event{
+				Service:    service,
+				Kind:       discoverd.EventKindCurrent,
+				EventIndex: s.seq,
+			})
+		}
+	}
+
+	return s.addSubscription([]string{service}, kinds, ch, selector, false, false, priority, snapshot, "")
+}
+
+// tierEnqueued and tierDequeued account for events entering and leaving
+// subscriber queues, per delivery tier. The counts drive the overload
+// degradation decision and are exposed for inspection.
+func (s *Store) tierEnqueued(p SubscriptionPriority) { atomic.AddInt64(&s.tierQueued[p], 1) }
+func (s *Store) tierDequeued(p SubscriptionPriority) { atomic.AddInt64(&s.tierQueued[p], -1) }
+
+// QueuedByPriority returns the number of queued-but-undelivered events per
+// delivery tier.
+func (s *Store) QueuedByPriority() map[string]int64 {
+	queued := make(map[string]int64, numPriorities)
+	for p := SubscriptionPriority(0); p < numPriorities; p++ {
+		queued[p.String()] = atomic.LoadInt64(&s.tierQueued[p])
+	}
+	return queued
+}
+
+// degraded returns whether a subscriber at priority p should fall back to
+// drop-oldest delivery. The lowest tier degrades once the total queued
+// backlog reaches OverloadThreshold, the normal tier at twice that, and the
+// highest tier never degrades.
+func (s *Store) degraded(p SubscriptionPriority) bool {
+	if p == PriorityHigh || s.OverloadThreshold <= 0 {
+		return false
+	}
+	var queued int64
+	for i := SubscriptionPriority(0); i < numPriorities; i++ {
+		queued += atomic.LoadInt64(&s.tierQueued[i])
+	}
+	threshold := int64(s.OverloadThreshold)
+	if p == PriorityNormal {
+		threshold *= 2
+	}
+	return queued >= threshold
+}
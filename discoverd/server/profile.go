@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Appliance profiles capture the service configuration conventions of the
+// appliances Flynn ships. Creating a service with a profile fills in the
+// leader election mode and health check the appliance expects, and instances
+// of the service must register the meta keys its components rely on.
+
+// ServiceProfile is a named bundle of service configuration defaults plus
+// the meta keys instances of the appliance are required to register with.
+type ServiceProfile struct {
+	LeaderType    discoverd.LeaderType
+	LeaderMetaKey string
+	HealthCheck   *discoverd.HealthCheck
+	RequiredMeta  []string
+}
+
+// serviceProfiles registers the known appliance profiles. The sirenia-managed
+// appliances appoint their primary through their own state machines, so their
+// leadership is manual; each appliance advertises its cluster identity under
+// the meta key its peers read.
+var serviceProfiles = map[string]*ServiceProfile{
+	"postgres": {
+		LeaderType:   discoverd.LeaderTypeManual,
+		HealthCheck:  &discoverd.HealthCheck{Type: "tcp"},
+		RequiredMeta: []string{"POSTGRES_ID"},
+	},
+	"mysql": {
+		LeaderType:   discoverd.LeaderTypeManual,
+		HealthCheck:  &discoverd.HealthCheck{Type: "tcp"},
+		RequiredMeta: []string{"MYSQL_ID"},
+	},
+	"mongodb": {
+		LeaderType:   discoverd.LeaderTypeManual,
+		HealthCheck:  &discoverd.HealthCheck{Type: "tcp"},
+		RequiredMeta: []string{"MONGODB_ID"},
+	},
+	// Redis runs a single process with no election of its own.
+	"redis": {
+		LeaderType:   discoverd.LeaderTypeOldest,
+		HealthCheck:  &discoverd.HealthCheck{Type: "tcp"},
+		RequiredMeta: []string{"REDIS_ID"},
+	},
+}
+
+// UnknownProfileError is returned when a service is configured with a profile
+// that is not registered.
+type UnknownProfileError string
+
+func (e UnknownProfileError) Error() string {
+	return fmt.Sprintf("discoverd: unknown service profile %q", string(e))
+}
+
+// ProfileMetaError is returned when an instance registers without a meta key
+// required by its service's profile.
+type ProfileMetaError struct {
+	Service string
+	Profile string
+	Key     string
+}
+
+func (e ProfileMetaError) Error() string {
+	return fmt.Sprintf("discoverd: profile %q of service %q requires instance meta key %q", e.Profile, e.Service, e.Key)
+}
+
+// IsProfileError returns whether err relates to an appliance profile.
+func IsProfileError(err error) bool {
+	switch err.(type) {
+	case UnknownProfileError, ProfileMetaError:
+		return true
+	}
+	return false
+}
+
+// applyProfile expands the config's appliance profile, filling in the fields
+// the profile specifies that the caller left unset.
+func applyProfile(config *discoverd.ServiceConfig) error {
+	if config.Profile == "" {
+		return nil
+	}
+	profile := serviceProfiles[config.Profile]
+	if profile == nil {
+		return UnknownProfileError(config.Profile)
+	}
+	if config.LeaderType == "" {
+		config.LeaderType = profile.LeaderType
+	}
+	if config.LeaderMetaKey == "" {
+		config.LeaderMetaKey = profile.LeaderMetaKey
+	}
+	if config.HealthCheck == nil && profile.HealthCheck != nil {
+		check := *profile.HealthCheck
+		config.HealthCheck = &check
+	}
+	return nil
+}
+
+// checkRequiredMeta verifies an instance carries the meta keys required by
+// its service's appliance profile. Must be called under mutex.
+func (s *Store) checkRequiredMeta(service string, inst *discoverd.Instance) error {
+	config := s.data.Services[service]
+	if config == nil || config.Profile == "" {
+		return nil
+	}
+	profile := serviceProfiles[config.Profile]
+	if profile == nil {
+		return nil
+	}
+	for _, key := range profile.RequiredMeta {
+		if _, ok := inst.Meta[key]; !ok {
+			return ProfileMetaError{Service: service, Profile: config.Profile, Key: key}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sdTargetGroup is a Prometheus service discovery target group, the format
+// shared by the http_sd API and file_sd files.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// sdTargetGroups renders the current state as Prometheus target groups, one
+// per instance so instance meta can be mapped to target labels. Groups are
+// sorted by service and creation order.
+func sdTargetGroups(store Backend, service string) ([]*sdTargetGroup, error) {
+	names := store.ServiceNames()
+	if service != "" {
+		names = []string{service}
+	}
+
+	groups := make([]*sdTargetGroup, 0, len(names))
+	for _, name := range names {
+		instances, err := store.Instances(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, inst := range instances {
+			labels := map[string]string{
+				"__meta_discoverd_service":     name,
+				"__meta_discoverd_instance_id": inst.ID,
+				"__meta_discoverd_proto":       inst.Proto,
+			}
+			if inst.State != discoverd.InstanceStateUp {
+				labels["__meta_discoverd_state"] = string(inst.State)
+			}
+			for k, v := range inst.Meta {
+				labels["__meta_discoverd_meta_"+sanitizeLabelName(k)] = v
+			}
+			groups = append(groups, &sdTargetGroup{
+				Targets: []string{inst.Addr},
+				Labels:  labels,
+			})
+		}
+	}
+	return groups, nil
+}
+
+// sanitizeLabelName replaces characters not allowed in Prometheus label
+// names with underscores.
+func sanitizeLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// serveGetPrometheusSD implements the Prometheus HTTP service discovery API,
+// so scrape configs automatically track registered services.
+func (h *Handler) serveGetPrometheusSD(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := r.URL.Query().Get("service")
+	if service != "" {
+		if err := ValidServiceName(service); err != nil {
+			hh.ValidationError(w, "service", err.Error())
+			return
+		}
+	}
+
+	groups, err := sdTargetGroups(h.Store, service)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, groups)
+}
+
+// FileSDExporter writes the current state as a Prometheus file_sd JSON file,
+// rewriting it whenever instances change. Writes are atomic so Prometheus
+// never reads a partial file.
+type FileSDExporter struct {
+	store Backend
+	path  string
+
+	events chan *discoverd.Event
+	stream stream.Stream
+	wg     sync.WaitGroup
+}
+
+// NewFileSDExporter returns an exporter writing target groups to path.
+func NewFileSDExporter(store Backend, path string) *FileSDExporter {
+	return &FileSDExporter{store: store, path: path}
+}
+
+// Start writes the initial file and begins rewriting it on instance events.
+func (e *FileSDExporter) Start() error {
+	if err := e.write(); err != nil {
+		return err
+	}
+	e.events = make(chan *discoverd.Event, StreamBufferSize)
+	e.stream = e.store.Subscribe(WildcardService, false,
+		discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown|discoverd.EventKindServiceDown,
+		e.events)
+	e.wg.Add(1)
+	go e.run()
+	return nil
+}
+
+// Close stops the exporter. The file is left in place for Prometheus.
+func (e *FileSDExporter) Close() error {
+	err := e.stream.Close()
+	e.wg.Wait()
+	return err
+}
+
+func (e *FileSDExporter) run() {
+	defer e.wg.Done()
+	for range e.events {
+		// Drain any queued events so a burst results in one rewrite.
+		for len(e.events) > 0 {
+			<-e.events
+		}
+		if err := e.write(); err != nil {
+			logger.Error("error writing prometheus file_sd output", "path", e.path, "err", err)
+		}
+	}
+}
+
+// write atomically replaces the file with the current target groups.
+func (e *FileSDExporter) write() error {
+	groups, err := sdTargetGroups(e.store, "")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(groups)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file in the same directory and rename it over the
+	// destination so readers never see a partial file.
+	tmp := e.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.path)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/discoverd/api"
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/golang/protobuf/proto"
+)
+
+// ProtoContentType is the media type for protobuf-encoded request and
+// response bodies on the HTTP API. Protobuf encoding is negotiated per
+// request: clients opt in by sending it in the Accept header for responses
+// or the Content-Type header for request bodies, and JSON remains the
+// default. The wire messages are the ones defined in discoverd.proto, shared
+// with the gRPC API.
+const ProtoContentType = "application/x-protobuf"
+
+// wantsProto reports whether the client asked for a protobuf-encoded
+// response via the Accept header.
+func wantsProto(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), ProtoContentType)
+}
+
+// sendsProto reports whether the request body is protobuf-encoded.
+func sendsProto(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Content-Type"), ProtoContentType)
+}
+
+// writeProto marshals msg and writes it as a protobuf response body.
+func writeProto(w http.ResponseWriter, status int, msg proto.Message) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", ProtoContentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// readProto reads the request body and unmarshals it into msg.
+func readProto(r *http.Request, msg proto.Message) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, msg)
+}
+
+// instancesToProto converts a list of instances to the protobuf list
+// response shared with the gRPC API.
+func instancesToProto(instances []*discoverd.Instance) *api.ListResponse {
+	res := &api.ListResponse{Instances: make([]*api.Instance, len(instances))}
+	for i, inst := range instances {
+		res.Instances[i] = instanceToProto(inst)
+	}
+	return res
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// Subscription admission control. The SubscriberQuota and
+// ClientSubscriberQuota knobs on Store cap how many concurrent subscriptions
+// are admitted per service and per client identity. Unlike MaxSubscribers,
+// which admits new subscribers and evicts the oldest, a subscription over a
+// quota is rejected outright with a SubscriberQuotaError, so a misconfigured
+// client opening thousands of watches is turned away instead of cycling
+// everyone else's streams. Only subscriptions created through
+// SubscribeClient are attributed to a client and checked; the server's own
+// internal subscriptions are exempt.
+
+// SubscriberQuotaError is returned when a new subscription would exceed a
+// configured subscriber quota.
+type SubscriberQuotaError struct {
+	// Scope is the quota that was exceeded, "service" or "client", and Key
+	// the service name or client identity it applies to.
+	Scope string
+	Key   string
+	Limit int
+}
+
+func (e SubscriberQuotaError) Error() string {
+	return fmt.Sprintf("discoverd: subscriber quota of %d for %s %q exceeded", e.Limit, e.Scope, e.Key)
+}
+
+// IsSubscriberQuotaError returns whether err is a SubscriberQuotaError.
+func IsSubscriberQuotaError(err error) bool {
+	_, ok := err.(SubscriberQuotaError)
+	return ok
+}
+
+// SubscribeClient creates a subscription attributed to a client identity,
+// such as an auth token or remote host, otherwise behaving like
+// SubscribePriority. The subscription counts against the subscriber quotas
+// and is rejected with a SubscriberQuotaError when admitting it would exceed
+// one.
+func (s *Store) SubscribeClient(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) (stream.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkSubscriberQuota(service, client); err != nil {
+		return nil, err
+	}
+
+	// Wait for in-flight deliveries so the snapshot sent below is not
+	// followed by replays of events it already reflects.
+	s.flushFanout()
+
+	var snapshot []*discoverd.Event
+	if sendCurrent {
+		snapshot = s.currentState(service, kinds, selector)
+		if kinds.Any(discoverd.EventKindCurrent) {
+			snapshot = append(snapshot, &discoverd.Event{
+				Service:    service,
+				Kind:       discoverd.EventKindCurrent,
+				EventIndex: s.seq,
+			})
+		}
+	}
+
+	return s.addSubscription([]string{service}, kinds, ch, selector, false, false, priority, snapshot, client), nil
+}
+
+// checkSubscriberQuota verifies a new subscription against the subscriber
+// quotas.
+// Must be called under mutex.
+func (s *Store) checkSubscriberQuota(service, client string) error {
+	if s.SubscriberQuota > 0 && s.subs.count(service) >= s.SubscriberQuota {
+		return SubscriberQuotaError{Scope: "service", Key: service, Limit: s.SubscriberQuota}
+	}
+	if s.ClientSubscriberQuota > 0 && client != "" && s.clientSubCount(client) >= s.ClientSubscriberQuota {
+		return SubscriberQuotaError{Scope: "client", Key: client, Limit: s.ClientSubscriberQuota}
+	}
+	return nil
+}
+
+// clientSubCount returns the number of active subscriptions attributed to a
+// client identity.
+func (s *Store) clientSubCount(client string) int {
+	s.clientSubsMu.Lock()
+	defer s.clientSubsMu.Unlock()
+	return s.clientSubs[client]
+}
+
+// acquireClientSub attributes a new subscription to a client identity.
+func (s *Store) acquireClientSub(client string) {
+	s.clientSubsMu.Lock()
+	defer s.clientSubsMu.Unlock()
+	if s.clientSubs == nil {
+		s.clientSubs = make(map[string]int)
+	}
+	s.clientSubs[client]++
+}
+
+// releaseClientSub drops a closed subscription's attribution.
+func (s *Store) releaseClientSub(client string) {
+	s.clientSubsMu.Lock()
+	defer s.clientSubsMu.Unlock()
+	if s.clientSubs[client]--; s.clientSubs[client] <= 0 {
+		delete(s.clientSubs, client)
+	}
+}
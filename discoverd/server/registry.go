@@ -0,0 +1,153 @@
+package server
+
+import (
+	"container/list"
+	"hash/fnv"
+	"path"
+	"sync"
+)
+
+// subscriberShardCount is the number of independently locked buckets the
+// subscriber registry is split across. Subscription keys are assigned to
+// buckets by hash, so services hash to different buckets and broadcasts to
+// unrelated services don't contend on a single registry lock.
+const subscriberShardCount = 16
+
+// subscriberShard is one bucket of the registry. Its mutex guards the
+// subscriber lists registered under keys hashing to the shard; the
+// subscriptions' delivery statistics remain guarded by the store mutex.
+type subscriberShard struct {
+	mu          sync.RWMutex
+	subscribers map[string]*list.List
+}
+
+// subscriberRegistry tracks the active subscriptions, sharded by
+// subscription key so registration, removal and fan-out for one service
+// don't serialize against every other service.
+type subscriberRegistry struct {
+	shards [subscriberShardCount]subscriberShard
+
+	// Wildcard and glob patterns must be consulted on every broadcast
+	// regardless of which shard their subscribers hash to, so they are
+	// tracked separately under their own lock.
+	patternMu sync.RWMutex
+	patterns  map[string]struct{}
+}
+
+func newSubscriberRegistry() *subscriberRegistry {
+	r := &subscriberRegistry{patterns: make(map[string]struct{})}
+	for i := range r.shards {
+		r.shards[i].subscribers = make(map[string]*list.List)
+	}
+	return r
+}
+
+// shard returns the bucket responsible for a subscription key.
+func (r *subscriberRegistry) shard(key string) *subscriberShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &r.shards[h.Sum32()%subscriberShardCount]
+}
+
+// add registers a subscription under each of its keys. If max is positive
+// and a key already has max subscribers, the oldest one under that key is
+// returned so the caller can evict it.
+func (r *subscriberRegistry) add(sub *subscription, max int) (evicted *subscription) {
+	for _, key := range sub.keys() {
+		shard := r.shard(key)
+		shard.mu.Lock()
+		l := shard.subscribers[key]
+		if l == nil {
+			l = list.New()
+			shard.subscribers[key] = l
+		}
+		if max > 0 && l.Len() >= max && evicted == nil {
+			evicted = l.Front().Value.(*subscription)
+		}
+		sub.els = append(sub.els, l.PushBack(sub))
+		shard.mu.Unlock()
+
+		if isPattern(key) {
+			r.patternMu.Lock()
+			r.patterns[key] = struct{}{}
+			r.patternMu.Unlock()
+		}
+	}
+	return evicted
+}
+
+// remove deregisters a subscription, dropping each of its keys, and any
+// pattern tracking, once the last subscriber is gone.
+func (r *subscriberRegistry) remove(sub *subscription) {
+	for i, key := range sub.keys() {
+		shard := r.shard(key)
+		shard.mu.Lock()
+		last := false
+		if l := shard.subscribers[key]; l != nil {
+			l.Remove(sub.els[i])
+			if l.Len() == 0 {
+				delete(shard.subscribers, key)
+				last = true
+			}
+		}
+		shard.mu.Unlock()
+
+		if last && isPattern(key) {
+			r.patternMu.Lock()
+			delete(r.patterns, key)
+			r.patternMu.Unlock()
+		}
+	}
+}
+
+// forEach calls fn for each subscription registered under key, holding only
+// the key's shard lock.
+func (r *subscriberRegistry) forEach(key string, fn func(*subscription)) {
+	shard := r.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if l := shard.subscribers[key]; l != nil {
+		for el := l.Front(); el != nil; el = el.Next() {
+			fn(el.Value.(*subscription))
+		}
+	}
+}
+
+// forEachAll calls fn for every active subscription, shard by shard.
+func (r *subscriberRegistry) forEachAll(fn func(*subscription)) {
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mu.RLock()
+		for _, l := range shard.subscribers {
+			for el := l.Front(); el != nil; el = el.Next() {
+				fn(el.Value.(*subscription))
+			}
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// count returns the number of subscriptions registered under key.
+func (r *subscriberRegistry) count(key string) int {
+	shard := r.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	if l := shard.subscribers[key]; l != nil {
+		return l.Len()
+	}
+	return 0
+}
+
+// matchingPatterns returns the wildcard and glob subscription keys that
+// match a service name.
+func (r *subscriberRegistry) matchingPatterns(service string) []string {
+	r.patternMu.RLock()
+	defer r.patternMu.RUnlock()
+	var matches []string
+	for pattern := range r.patterns {
+		if ok, _ := path.Match(pattern, service); ok {
+			matches = append(matches, pattern)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Replaying a persisted event log reconstructs what discovery looked like at
+// an earlier point: every registration, departure and leadership change is
+// on the log, so applying the events up to a cutoff yields the services,
+// instances and leaders as a client would have seen them then. Operators use
+// it through the discoverd-cli replay command to investigate incidents after
+// the fact; tests can feed captured production logs through ReplayEvents to
+// exercise new code against real-world churn.
+
+// ReplayState is the discovery state reconstructed by a replay.
+type ReplayState struct {
+	// Services maps each service that existed at the cutoff to its
+	// snapshot. A snapshot's Index is the sequence number of the last
+	// event applied to that service.
+	Services map[string]*ServiceState `json:"services"`
+
+	// EventIndex and Timestamp identify the last event applied, so a
+	// reconstructed state can be attributed to an exact log position and
+	// wall-clock time.
+	EventIndex uint64 `json:"event_index"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+}
+
+// ReplayEvents reconstructs the discovery state after applying the events
+// with a sequence number up to and including index; a zero index applies
+// them all. The events must be in broadcast order, as read from an event
+// log. Service metadata events are skipped: the snapshot covers instances
+// and leadership.
+func ReplayEvents(events []*discoverd.Event, index uint64) *ReplayState {
+	state := &ReplayState{Services: make(map[string]*ServiceState)}
+	for _, event := range events {
+		if index > 0 && event.EventIndex > index {
+			break
+		}
+		replayEvent(state, event)
+	}
+	for _, st := range state.Services {
+		sort.Sort(instanceSlice(st.Instances))
+	}
+	return state
+}
+
+// ReplayEventsAt reconstructs the discovery state as of a wall-clock time,
+// applying the events stamped at or before it. Timestamps are assigned by
+// the broadcasting node, so the cutoff is as accurate as its clock.
+func ReplayEventsAt(events []*discoverd.Event, t time.Time) *ReplayState {
+	cutoff := t.UnixNano()
+	var index uint64
+	for _, event := range events {
+		if event.Timestamp > cutoff {
+			break
+		}
+		index = event.EventIndex
+	}
+	if index == 0 {
+		return &ReplayState{Services: make(map[string]*ServiceState)}
+	}
+	return ReplayEvents(events, index)
+}
+
+// ReplayEventLog reads the event log at path and reconstructs the discovery
+// state at index, or after the newest event if index is zero. The log is
+// opened read-only, so a production log can be inspected in place; like the
+// server's own replay, reading stops at the first corrupt record.
+func ReplayEventLog(path string, index uint64) (*ReplayState, error) {
+	events, err := readEventLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return ReplayEvents(events, index), nil
+}
+
+// ReplayEventLogAt reads the event log at path and reconstructs the
+// discovery state as of a wall-clock time.
+func ReplayEventLogAt(path string, t time.Time) (*ReplayState, error) {
+	events, err := readEventLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return ReplayEventsAt(events, t), nil
+}
+
+// readEventLog reads every valid record in the event log at path.
+func readEventLog(path string) ([]*discoverd.Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*discoverd.Event
+	for {
+		event, _, err := readRecord(f)
+		if err != nil {
+			return events, nil
+		}
+		events = append(events, event)
+	}
+}
+
+// replayEvent applies one event to the state being reconstructed.
+func replayEvent(state *ReplayState, event *discoverd.Event) {
+	switch event.Kind {
+	case discoverd.EventKindServiceUp:
+		state.service(event.Service)
+	case discoverd.EventKindServiceDown:
+		delete(state.Services, event.Service)
+	case discoverd.EventKindUp, discoverd.EventKindUpdate,
+		discoverd.EventKindUnhealthy, discoverd.EventKindDraining:
+		if event.Instance == nil {
+			return
+		}
+		st := state.service(event.Service)
+		st.Instances = upsertInstance(st.Instances, event.Instance)
+	case discoverd.EventKindDown:
+		if event.Instance == nil {
+			return
+		}
+		st := state.service(event.Service)
+		st.Instances = removeInstance(st.Instances, event.Instance.ID)
+	case discoverd.EventKindLeader:
+		st := state.service(event.Service)
+		if event.Instance != nil {
+			st.LeaderID = event.Instance.ID
+		} else {
+			st.LeaderID = ""
+		}
+	default:
+		// Metadata, dependency and sentinel events don't change the
+		// instance or leadership state.
+		return
+	}
+	st := state.Services[event.Service]
+	if st != nil {
+		st.Index = event.EventIndex
+	}
+	if event.EventIndex > state.EventIndex {
+		state.EventIndex = event.EventIndex
+		state.Timestamp = event.Timestamp
+	}
+}
+
+// service returns the snapshot for a service, creating it if necessary.
+func (s *ReplayState) service(name string) *ServiceState {
+	st := s.Services[name]
+	if st == nil {
+		st = &ServiceState{Instances: []*discoverd.Instance{}}
+		s.Services[name] = st
+	}
+	return st
+}
+
+// upsertInstance adds an instance to a listing, replacing any previous
+// registration under the same ID.
+func upsertInstance(instances []*discoverd.Instance, inst *discoverd.Instance) []*discoverd.Instance {
+	for i, other := range instances {
+		if other.ID == inst.ID {
+			instances[i] = inst
+			return instances
+		}
+	}
+	return append(instances, inst)
+}
+
+// removeInstance drops an instance from a listing by ID.
+func removeInstance(instances []*discoverd.Instance, id string) []*discoverd.Instance {
+	for i, other := range instances {
+		if other.ID == id {
+			return append(instances[:i], instances[i+1:]...)
+		}
+	}
+	return instances
+}
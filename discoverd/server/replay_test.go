@@ -0,0 +1,112 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// replayTestEvents is the churn the replay tests reconstruct from: two
+// instances come up, one is elected leader and then departs.
+func replayTestEvents() []*discoverd.Event {
+	base := time.Date(2026, 8, 27, 14, 30, 0, 0, time.UTC).UnixNano()
+	return []*discoverd.Event{
+		{Service: "web", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Index: 1}, EventIndex: 1, Timestamp: base},
+		{Service: "web", Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst1", Index: 2}, EventIndex: 2, Timestamp: base + int64(time.Minute)},
+		{Service: "web", Kind: discoverd.EventKindLeader, Instance: &discoverd.Instance{ID: "inst0", Index: 1}, EventIndex: 3, Timestamp: base + int64(2*time.Minute)},
+		{Service: "web", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 1}, EventIndex: 4, Timestamp: base + int64(3*time.Minute)},
+		{Service: "web", Kind: discoverd.EventKindLeader, Instance: &discoverd.Instance{ID: "inst1", Index: 2}, EventIndex: 5, Timestamp: base + int64(4*time.Minute)},
+	}
+}
+
+// Ensure a replay reconstructs state both at a historical index and after
+// the full log.
+func TestReplayEvents(t *testing.T) {
+	events := replayTestEvents()
+
+	// Replay everything: only inst1 remains and leads.
+	state := server.ReplayEvents(events, 0)
+	if state.EventIndex != 5 {
+		t.Fatalf("unexpected event index: %d", state.EventIndex)
+	}
+	st := state.Services["web"]
+	if st == nil {
+		t.Fatal("expected web service")
+	} else if len(st.Instances) != 1 || st.Instances[0].ID != "inst1" {
+		t.Fatalf("unexpected instances: %#v", st.Instances)
+	} else if st.LeaderID != "inst1" {
+		t.Fatalf("unexpected leader: %q", st.LeaderID)
+	}
+
+	// Replay to just after the election: both instances, inst0 leading.
+	state = server.ReplayEvents(events, 3)
+	st = state.Services["web"]
+	if len(st.Instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", st.Instances)
+	} else if st.LeaderID != "inst0" {
+		t.Fatalf("unexpected leader: %q", st.LeaderID)
+	} else if st.Index != 3 {
+		t.Fatalf("unexpected service index: %d", st.Index)
+	}
+}
+
+// Ensure a replay can use a wall-clock cutoff.
+func TestReplayEventsAt(t *testing.T) {
+	events := replayTestEvents()
+
+	// 14:32 falls after the election but before inst0 departs.
+	state := server.ReplayEventsAt(events, time.Date(2026, 8, 27, 14, 32, 30, 0, time.UTC))
+	if state.EventIndex != 3 {
+		t.Fatalf("unexpected event index: %d", state.EventIndex)
+	} else if st := state.Services["web"]; st.LeaderID != "inst0" {
+		t.Fatalf("unexpected leader: %q", st.LeaderID)
+	}
+
+	// A cutoff before the first event yields empty state.
+	state = server.ReplayEventsAt(events, time.Date(2026, 8, 27, 14, 0, 0, 0, time.UTC))
+	if len(state.Services) != 0 {
+		t.Fatalf("unexpected services: %#v", state.Services)
+	}
+}
+
+// Ensure a replay can reconstruct state from a persisted event log file.
+func TestReplayEventLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Write the events through the server's own log implementation.
+	path := filepath.Join(dir, "events.log")
+	l, err := server.OpenEventLog(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range replayTestEvents() {
+		if err := l.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := server.ReplayEventLog(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := state.Services["web"]
+	if st == nil {
+		t.Fatal("expected web service")
+	} else if len(st.Instances) != 1 || st.Instances[0].ID != "inst1" {
+		t.Fatalf("unexpected instances: %#v", st.Instances)
+	} else if st.LeaderID != "inst0" {
+		t.Fatalf("unexpected leader: %q", st.LeaderID)
+	}
+}
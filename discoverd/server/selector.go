@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Selector filters instances by metadata. An instance matches if every
+// key in the selector is present in its metadata with an equal value.
+type Selector map[string]string
+
+// ParseSelector parses a comma-separated list of key=value pairs (e.g.
+// "zone=us-east,env=prod") into a Selector. Both "=" and "==" are accepted
+// as separators.
+func ParseSelector(s string) (Selector, error) {
+	sel := make(Selector)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("discoverd: invalid selector: %q", pair)
+		}
+		sel[key] = strings.TrimPrefix(value, "=")
+	}
+	return sel, nil
+}
+
+// Match returns whether an instance's metadata satisfies the selector.
+// A nil selector matches every instance.
+func (sel Selector) Match(inst *discoverd.Instance) bool {
+	for key, value := range sel {
+		if inst.Meta[key] != value {
+			return false
+		}
+	}
+	return true
+}
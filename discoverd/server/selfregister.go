@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+const (
+	// SelfService is the service name the discovery tier registers itself
+	// under.
+	SelfService = "discoverd"
+
+	// DefaultSelfRegisterInterval is the default interval between
+	// self-registration syncs.
+	DefaultSelfRegisterInterval = 5 * time.Second
+)
+
+// SelfRegistrar registers the discoverd servers themselves as a service in
+// the store, so clients discover additional discovery servers and fail over
+// to them with the same lookups and watches they use for every other
+// service.
+//
+// The raft leader runs the sync: it registers an instance per raft peer,
+// keeps them heartbeated, removes instances of departed peers and points the
+// service leadership at itself. Followers stay passive, so leadership of the
+// "discoverd" service follows raft leadership across replicas.
+type SelfRegistrar struct {
+	// Store is the store the servers are registered into.
+	Store interface {
+		IsLeader() bool
+		Leader() string
+		GetPeers() ([]string, error)
+		AddService(service string, config *discoverd.ServiceConfig) error
+		AddInstance(service string, inst *discoverd.Instance) error
+		RemoveInstance(service, id string) error
+		Instances(service string) ([]*discoverd.Instance, error)
+		ServiceLeader(service string) (*discoverd.Instance, error)
+		SetServiceLeader(service, id string) error
+	}
+
+	// Interval is the time between syncs. It must be comfortably below the
+	// store's instance TTL, since the syncs double as heartbeats.
+	Interval time.Duration
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewSelfRegistrar returns a registrar publishing the store's peers.
+func NewSelfRegistrar(store *Store) *SelfRegistrar {
+	return &SelfRegistrar{
+		Store:    store,
+		Interval: DefaultSelfRegisterInterval,
+		closing:  make(chan struct{}),
+	}
+}
+
+// Start begins the periodic self-registration sync.
+func (r *SelfRegistrar) Start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Close stops the sync. Registered instances are left to either the next
+// raft leader's registrar or instance expiry.
+func (r *SelfRegistrar) Close() error {
+	close(r.closing)
+	r.wg.Wait()
+	return nil
+}
+
+func (r *SelfRegistrar) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	r.sync()
+	for {
+		select {
+		case <-ticker.C:
+			r.sync()
+		case <-r.closing:
+			return
+		}
+	}
+}
+
+// sync reconciles the "discoverd" service with the raft peer set. Only the
+// raft leader syncs; followers are registered by it.
+func (r *SelfRegistrar) sync() {
+	if !r.Store.IsLeader() {
+		return
+	}
+	peers, err := r.Store.GetPeers()
+	if err != nil || len(peers) == 0 {
+		return
+	}
+
+	// The service leader is set manually below, following raft leadership.
+	err = r.Store.AddService(SelfService, &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual})
+	if err != nil && !IsServiceExists(err) {
+		logger.Error("error adding self service", "fn", "SelfRegistrar.sync", "error", err)
+		return
+	}
+
+	// Register an instance per raft peer. Re-registration of an unchanged
+	// instance refreshes its heartbeat without a log entry.
+	want := make(map[string]struct{}, len(peers))
+	for _, peer := range peers {
+		id := selfInstanceID(peer)
+		want[id] = struct{}{}
+		if err := r.Store.AddInstance(SelfService, &discoverd.Instance{
+			ID:    id,
+			Addr:  peer,
+			Proto: "http",
+		}); err != nil {
+			logger.Error("error registering peer", "fn", "SelfRegistrar.sync", "peer", peer, "error", err)
+		}
+	}
+
+	// Deregister peers that have left the cluster.
+	if instances, err := r.Store.Instances(SelfService); err == nil {
+		for _, inst := range instances {
+			if _, ok := want[inst.ID]; !ok {
+				r.Store.RemoveInstance(SelfService, inst.ID)
+			}
+		}
+	}
+
+	// Point the service leadership at the raft leader.
+	leaderID := selfInstanceID(r.Store.Leader())
+	if _, ok := want[leaderID]; !ok {
+		return
+	}
+	if current, err := r.Store.ServiceLeader(SelfService); err == nil && (current == nil || current.ID != leaderID) {
+		r.Store.SetServiceLeader(SelfService, leaderID)
+	}
+}
+
+// selfInstanceID derives the instance ID for a peer address, matching the
+// default ID the client derives from proto and address so a server
+// registered either way is the same instance.
+func selfInstanceID(addr string) string {
+	digest := md5.Sum([]byte("http-" + addr))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,49 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure the registrar publishes the raft peers as the "discoverd" service
+// with leadership following raft leadership.
+func TestSelfRegistrar(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	r := server.NewSelfRegistrar(s.Store)
+	r.Interval = 50 * time.Millisecond
+	r.Start()
+	defer r.Close()
+
+	// Wait for the server to register itself.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if instances, err := s.Instances(server.SelfService); err == nil && len(instances) == 1 {
+			if instances[0].Addr != s.Advertise.String() || instances[0].Proto != "http" {
+				t.Fatalf("unexpected instance: %#v", instances[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for self-registration")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Verify the raft leader holds the service leadership.
+	for {
+		if leader, err := s.ServiceLeader(server.SelfService); err == nil && leader != nil {
+			if leader.Addr != s.Advertise.String() {
+				t.Fatalf("unexpected leader: %#v", leader)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for service leadership")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
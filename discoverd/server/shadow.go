@@ -0,0 +1,378 @@
+package server
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// shadowLogger records comparison mismatches.
+var shadowLogger = NewLogger("shadow")
+
+// ShadowStore wraps a primary store and issues the same read operations to a
+// shadow store, serving results from the primary while recording mismatches.
+// It is used to de-risk migrations of the registry itself by comparing a
+// candidate backend or server version against the live one.
+//
+// With dual writes enabled, write operations are also mirrored to the shadow
+// store so it tracks the primary during a migration window. Once the shadow
+// has proven itself, Cutover swaps the two so reads and writes are served
+// from the new backend.
+type ShadowStore struct {
+	mu         sync.Mutex
+	primary    *Store
+	shadow     *Store
+	dualWrite  bool
+	mismatches map[string]uint64
+}
+
+// NewShadowStore returns a store that serves reads from primary while
+// comparing them against shadow.
+func NewShadowStore(primary, shadow *Store) *ShadowStore {
+	return &ShadowStore{
+		primary:    primary,
+		shadow:     shadow,
+		mismatches: make(map[string]uint64),
+	}
+}
+
+// SetDualWrite enables or disables mirroring of writes to the shadow store.
+func (s *ShadowStore) SetDualWrite(v bool) {
+	s.mu.Lock()
+	s.dualWrite = v
+	s.mu.Unlock()
+}
+
+// Cutover swaps the primary and shadow stores so subsequent reads and writes
+// are served from the new backend. Dual writes then keep the old backend in
+// sync until it is decommissioned.
+func (s *ShadowStore) Cutover() {
+	s.mu.Lock()
+	s.primary, s.shadow = s.shadow, s.primary
+	s.mu.Unlock()
+}
+
+// Mismatches returns the number of mismatched reads and failed shadow writes
+// recorded per operation.
+func (s *ShadowStore) Mismatches() map[string]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	other := make(map[string]uint64, len(s.mismatches))
+	for op, n := range s.mismatches {
+		other[op] = n
+	}
+	return other
+}
+
+// CheckDrift compares the full state of the two stores and returns the names
+// of services that differ, from the primary's point of view.
+func (s *ShadowStore) CheckDrift() []string {
+	primary, shadow := s.stores()
+
+	names := primary.ServiceNames()
+	seen := make(map[string]bool, len(names))
+	var drifted []string
+	for _, service := range names {
+		seen[service] = true
+		if !s.serviceEqual(primary, shadow, service) {
+			drifted = append(drifted, service)
+		}
+	}
+
+	// Services that only exist on the shadow have drifted too.
+	for _, service := range shadow.ServiceNames() {
+		if !seen[service] {
+			drifted = append(drifted, service)
+		}
+	}
+	return drifted
+}
+
+// serviceEqual returns whether both stores agree on the state of service.
+func (s *ShadowStore) serviceEqual(primary, shadow *Store, service string) bool {
+	if !reflect.DeepEqual(primary.Config(service), shadow.Config(service)) {
+		return false
+	}
+	a, _ := primary.Instances(service)
+	b, _ := shadow.Instances(service)
+	if !instancesEqual(a, b) {
+		return false
+	}
+	am := primary.ServiceMeta(service)
+	bm := shadow.ServiceMeta(service)
+	if (am == nil) != (bm == nil) || (am != nil && string(am.Data) != string(bm.Data)) {
+		return false
+	}
+	al, _ := primary.ServiceLeader(service)
+	bl, _ := shadow.ServiceLeader(service)
+	if (al == nil) != (bl == nil) || (al != nil && al.ID != bl.ID) {
+		return false
+	}
+	return true
+}
+
+// instancesEqual compares instances ignoring their raft indexes, which are
+// never in step across two stores.
+func instancesEqual(a, b []*discoverd.Instance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ShadowStore) stores() (primary, shadow *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.primary, s.shadow
+}
+
+// mirror applies a write to the shadow store when dual writes are enabled,
+// recording a mismatch if the shadow write fails.
+func (s *ShadowStore) mirror(op string, fn func(*Store) error) {
+	s.mu.Lock()
+	dualWrite, shadow := s.dualWrite, s.shadow
+	s.mu.Unlock()
+	if !dualWrite {
+		return
+	}
+	if err := fn(shadow); err != nil {
+		s.record(op)
+	}
+}
+
+func (s *ShadowStore) Leader() string {
+	primary, _ := s.stores()
+	return primary.Leader()
+}
+
+func (s *ShadowStore) IsLeader() bool {
+	primary, _ := s.stores()
+	return primary.IsLeader()
+}
+
+func (s *ShadowStore) LastIndex() uint64 {
+	primary, _ := s.stores()
+	return primary.LastIndex()
+}
+
+func (s *ShadowStore) ServiceNames() []string {
+	primary, shadow := s.stores()
+	names := primary.ServiceNames()
+	s.compare("ServiceNames", names, shadow.ServiceNames())
+	return names
+}
+
+func (s *ShadowStore) Instances(service string) ([]*discoverd.Instance, error) {
+	primary, shadow := s.stores()
+	instances, err := primary.Instances(service)
+	if err == nil {
+		other, otherErr := shadow.Instances(service)
+		if otherErr != nil || !instancesEqual(instances, other) {
+			s.record("Instances")
+		}
+	}
+	return instances, err
+}
+
+func (s *ShadowStore) Config(service string) *discoverd.ServiceConfig {
+	primary, shadow := s.stores()
+	config := primary.Config(service)
+	s.compare("Config", config, shadow.Config(service))
+	return config
+}
+
+func (s *ShadowStore) ServiceMeta(service string) *discoverd.ServiceMeta {
+	primary, shadow := s.stores()
+	meta := primary.ServiceMeta(service)
+	other := shadow.ServiceMeta(service)
+	if (meta == nil) != (other == nil) || (meta != nil && string(meta.Data) != string(other.Data)) {
+		s.record("ServiceMeta")
+	}
+	return meta
+}
+
+func (s *ShadowStore) ServiceLeader(service string) (*discoverd.Instance, error) {
+	primary, shadow := s.stores()
+	leader, err := primary.ServiceLeader(service)
+	if err == nil {
+		other, otherErr := shadow.ServiceLeader(service)
+		if otherErr != nil || (leader == nil) != (other == nil) || (leader != nil && leader.ID != other.ID) {
+			s.record("ServiceLeader")
+		}
+	}
+	return leader, err
+}
+
+func (s *ShadowStore) AddService(service string, config *discoverd.ServiceConfig) error {
+	primary, _ := s.stores()
+	if err := primary.AddService(service, config); err != nil {
+		return err
+	}
+	s.mirror("AddService", func(shadow *Store) error {
+		return shadow.AddService(service, config)
+	})
+	return nil
+}
+
+func (s *ShadowStore) RemoveService(service string) error {
+	primary, _ := s.stores()
+	if err := primary.RemoveService(service); err != nil {
+		return err
+	}
+	s.mirror("RemoveService", func(shadow *Store) error {
+		return shadow.RemoveService(service)
+	})
+	return nil
+}
+
+func (s *ShadowStore) AddInstance(service string, inst *discoverd.Instance) error {
+	primary, _ := s.stores()
+	if err := primary.AddInstance(service, inst); err != nil {
+		return err
+	}
+	s.mirror("AddInstance", func(shadow *Store) error {
+		other := *inst
+		return shadow.AddInstance(service, &other)
+	})
+	return nil
+}
+
+func (s *ShadowStore) AddInstances(regs []*discoverd.Registration) error {
+	primary, _ := s.stores()
+	if err := primary.AddInstances(regs); err != nil {
+		return err
+	}
+	s.mirror("AddInstances", func(shadow *Store) error {
+		other := make([]*discoverd.Registration, len(regs))
+		for i, reg := range regs {
+			inst := *reg.Instance
+			other[i] = &discoverd.Registration{Service: reg.Service, Instance: &inst}
+		}
+		return shadow.AddInstances(other)
+	})
+	return nil
+}
+
+func (s *ShadowStore) AddServiceInstances(service string, instances []*discoverd.Instance) error {
+	primary, _ := s.stores()
+	if err := primary.AddServiceInstances(service, instances); err != nil {
+		return err
+	}
+	s.mirror("AddServiceInstances", func(shadow *Store) error {
+		other := make([]*discoverd.Instance, len(instances))
+		for i, inst := range instances {
+			dup := *inst
+			other[i] = &dup
+		}
+		return shadow.AddServiceInstances(service, other)
+	})
+	return nil
+}
+
+func (s *ShadowStore) Transact(ops []*TxOp) error {
+	primary, _ := s.stores()
+	if err := primary.Transact(ops); err != nil {
+		return err
+	}
+	s.mirror("Transact", func(shadow *Store) error {
+		other := make([]*TxOp, len(ops))
+		for i, op := range ops {
+			dup := *op
+			if op.Instance != nil {
+				inst := *op.Instance
+				dup.Instance = &inst
+			}
+			other[i] = &dup
+		}
+		return shadow.Transact(other)
+	})
+	return nil
+}
+
+func (s *ShadowStore) RemoveInstance(service, id string) error {
+	primary, _ := s.stores()
+	if err := primary.RemoveInstance(service, id); err != nil {
+		return err
+	}
+	s.mirror("RemoveInstance", func(shadow *Store) error {
+		return shadow.RemoveInstance(service, id)
+	})
+	return nil
+}
+
+func (s *ShadowStore) SetServiceMeta(service string, meta *discoverd.ServiceMeta) error {
+	primary, _ := s.stores()
+
+	// The shadow's meta index is never in step with the primary's, so give
+	// the mirrored write the shadow's current index instead.
+	if err := primary.SetServiceMeta(service, meta); err != nil {
+		return err
+	}
+	s.mirror("SetServiceMeta", func(shadow *Store) error {
+		other := *meta
+		other.Index = 0
+		if current := shadow.ServiceMeta(service); current != nil {
+			other.Index = current.Index
+		}
+		return shadow.SetServiceMeta(service, &other)
+	})
+	return nil
+}
+
+func (s *ShadowStore) SetServiceLeader(service, id string) error {
+	primary, _ := s.stores()
+	if err := primary.SetServiceLeader(service, id); err != nil {
+		return err
+	}
+	s.mirror("SetServiceLeader", func(shadow *Store) error {
+		return shadow.SetServiceLeader(service, id)
+	})
+	return nil
+}
+
+func (s *ShadowStore) SetMaintenance(service, id string, maintenance bool) error {
+	primary, _ := s.stores()
+	if err := primary.SetMaintenance(service, id, maintenance); err != nil {
+		return err
+	}
+	s.mirror("SetMaintenance", func(shadow *Store) error {
+		return shadow.SetMaintenance(service, id, maintenance)
+	})
+	return nil
+}
+
+func (s *ShadowStore) FailoverServiceLeader(service, id string) error {
+	primary, _ := s.stores()
+	if err := primary.FailoverServiceLeader(service, id); err != nil {
+		return err
+	}
+	s.mirror("FailoverServiceLeader", func(shadow *Store) error {
+		return shadow.FailoverServiceLeader(service, id)
+	})
+	return nil
+}
+
+// compare records a mismatch if the primary and shadow results differ.
+func (s *ShadowStore) compare(op string, primary, shadow interface{}) {
+	if reflect.DeepEqual(primary, shadow) {
+		return
+	}
+	s.record(op)
+}
+
+func (s *ShadowStore) record(op string) {
+	s.mu.Lock()
+	s.mismatches[op]++
+	s.mu.Unlock()
+
+	shadowLogger.Warn("shadow store mismatch",
+		"fn", "record",
+		"op", op,
+	)
+}
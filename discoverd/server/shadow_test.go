@@ -0,0 +1,114 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure the shadow store serves reads from the primary and records no
+// mismatches while the two stores agree.
+func TestShadowStore(t *testing.T) {
+	primary := MustOpenStore()
+	defer primary.Close()
+	shadow := MustOpenStore()
+	defer shadow.Close()
+
+	// Apply the same writes to both stores.
+	for _, s := range []*Store{primary, shadow} {
+		if err := s.AddService("service0", nil); err != nil {
+			t.Fatal(err)
+		} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss := server.NewShadowStore(primary.Store, shadow.Store)
+
+	// Reads are served from the primary.
+	if a, err := ss.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 1 || a[0].ID != "inst0" {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+	ss.ServiceNames()
+	ss.Config("service0")
+	ss.ServiceMeta("service0")
+
+	// No mismatches are recorded while the stores agree.
+	if m := ss.Mismatches(); len(m) != 0 {
+		t.Fatalf("unexpected mismatches: %#v", m)
+	}
+}
+
+// Ensure dual writes keep the shadow store in step with the primary, drift is
+// detected when they diverge, and cutover swaps the two stores.
+func TestShadowStore_DualWrite(t *testing.T) {
+	primary := MustOpenStore()
+	defer primary.Close()
+	shadow := MustOpenStore()
+	defer shadow.Close()
+
+	ss := server.NewShadowStore(primary.Store, shadow.Store)
+	ss.SetDualWrite(true)
+
+	// Writes are mirrored to both stores.
+	if err := ss.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = ss.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := shadow.Instances("service0"); err != nil || len(a) != 1 {
+		t.Fatalf("unexpected shadow instances: %#v (%s)", a, err)
+	}
+	if drifted := ss.CheckDrift(); len(drifted) != 0 {
+		t.Fatalf("unexpected drift: %#v", drifted)
+	}
+
+	// Diverge the shadow and verify the drift is detected.
+	if err := shadow.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+	if drifted := ss.CheckDrift(); len(drifted) != 1 || drifted[0] != "service0" {
+		t.Fatalf("unexpected drift: %#v", drifted)
+	}
+
+	// Cut over to the shadow and verify reads come from it.
+	ss.Cutover()
+	if a, err := ss.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 2 {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+}
+
+// Ensure the shadow store records mismatches when the stores diverge.
+func TestShadowStore_Mismatch(t *testing.T) {
+	primary := MustOpenStore()
+	defer primary.Close()
+	shadow := MustOpenStore()
+	defer shadow.Close()
+
+	// Register an instance on the primary only.
+	if err := primary.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = primary.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := server.NewShadowStore(primary.Store, shadow.Store)
+
+	// The primary result is returned despite the divergence.
+	if a, err := ss.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 1 {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+	ss.ServiceNames()
+
+	// Both reads are recorded as mismatches.
+	if m := ss.Mismatches(); m["Instances"] != 1 || m["ServiceNames"] != 1 {
+		t.Fatalf("unexpected mismatches: %#v", m)
+	}
+}
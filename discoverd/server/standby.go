@@ -0,0 +1,383 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+const (
+	// DefaultStandbyFencingDelay is the default time the primary must be
+	// continuously unreachable before a standby promotes itself.
+	DefaultStandbyFencingDelay = 30 * time.Second
+
+	// DefaultStandbyPingInterval is the default interval between primary
+	// liveness probes.
+	DefaultStandbyPingInterval = time.Second
+
+	// DefaultStandbyHeartbeatInterval is the default interval at which
+	// replicated instances are heartbeated in the local store.
+	DefaultStandbyHeartbeatInterval = 5 * time.Second
+
+	// DefaultStandbyRetryInterval is the default wait before
+	// re-establishing a failed replication stream.
+	DefaultStandbyRetryInterval = time.Second
+)
+
+// Standby tails the event streams of a primary discoverd server and applies
+// them to the local store, keeping a hot copy of the registry without the
+// coordination cost of running full raft replication. If the primary becomes
+// unreachable the standby promotes itself to primary once a fencing delay has
+// elapsed, giving the old primary time to notice the partition and stop
+// serving writes before the standby starts accepting them.
+//
+// The standby discovers the primary's service list by polling it, and mirrors
+// each service over the watch stream the same way clients do, so it works
+// against any discoverd server version that serves the HTTP API.
+type Standby struct {
+	// Primary is a client for the primary server.
+	Primary *discoverd.Client
+
+	// Store is the local store that the primary's state is replicated into.
+	Store interface {
+		AddService(service string, config *discoverd.ServiceConfig) error
+		RemoveService(service string) error
+		AddInstance(service string, inst *discoverd.Instance) error
+		RemoveInstance(service, id string) error
+		ServiceMeta(service string) *discoverd.ServiceMeta
+		SetServiceMeta(service string, meta *discoverd.ServiceMeta) error
+		SetServiceLeader(service, id string) error
+		Heartbeat(service, id string) error
+	}
+
+	// FencingDelay is how long the primary must be continuously
+	// unreachable before the standby promotes itself. It should be longer
+	// than the primary's own failure detection so a partitioned primary
+	// has demoted itself before the standby takes over.
+	FencingDelay time.Duration
+
+	// OnPromote is called once, from the monitor goroutine, when the
+	// standby promotes itself. Callers use it to start accepting writes
+	// and to re-announce the server's address.
+	OnPromote func()
+
+	PingInterval      time.Duration
+	HeartbeatInterval time.Duration
+	RetryInterval     time.Duration
+	Logger            *log.Logger
+
+	mu         sync.Mutex
+	promoted   bool
+	downSince  time.Time
+	mirrors    map[string]chan struct{} // stop channel per mirrored service
+	replicated map[string]map[string]struct{}
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewStandby returns a standby replicating from the primary reached via the
+// given client.
+func NewStandby(primary *discoverd.Client) *Standby {
+	return &Standby{
+		Primary:           primary,
+		FencingDelay:      DefaultStandbyFencingDelay,
+		PingInterval:      DefaultStandbyPingInterval,
+		HeartbeatInterval: DefaultStandbyHeartbeatInterval,
+		RetryInterval:     DefaultStandbyRetryInterval,
+		mirrors:           make(map[string]chan struct{}),
+		replicated:        make(map[string]map[string]struct{}),
+		closing:           make(chan struct{}),
+	}
+}
+
+// Start begins replicating from the primary and monitoring its liveness.
+func (s *Standby) Start() {
+	s.wg.Add(1)
+	go s.monitor()
+}
+
+// Close stops replication without promoting. Replicated instances are left
+// in the local store to expire normally.
+func (s *Standby) Close() error {
+	close(s.closing)
+	s.wg.Wait()
+	return nil
+}
+
+// Promoted returns whether the standby has promoted itself to primary.
+func (s *Standby) Promoted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.promoted
+}
+
+// monitor polls the primary's service list, reconciling the set of mirror
+// streams on success and tracking unreachability on failure. Once the
+// primary has been unreachable for FencingDelay the standby promotes itself.
+func (s *Standby) monitor() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		services, err := s.serviceNames()
+		if err != nil {
+			if s.primaryGone() {
+				s.promote()
+				return
+			}
+		} else {
+			s.mu.Lock()
+			s.downSince = time.Time{}
+			s.mu.Unlock()
+			s.reconcile(services)
+		}
+
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serviceNames fetches the full service list from the primary.
+func (s *Standby) serviceNames() ([]string, error) {
+	var names []string
+	cursor := ""
+	for {
+		page, next, err := s.Primary.ServiceNamesPage(0, cursor)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, page...)
+		if next == "" {
+			return names, nil
+		}
+		cursor = next
+	}
+}
+
+// primaryGone records a failed probe and reports whether the primary has now
+// been unreachable for at least the fencing delay.
+func (s *Standby) primaryGone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downSince.IsZero() {
+		s.downSince = time.Now()
+		return false
+	}
+	return time.Since(s.downSince) >= s.FencingDelay
+}
+
+// reconcile starts mirror streams for newly seen services and stops streams
+// (and removes local state) for services the primary no longer has.
+func (s *Standby) reconcile(services []string) {
+	current := make(map[string]struct{}, len(services))
+	for _, service := range services {
+		current[service] = struct{}{}
+	}
+
+	s.mu.Lock()
+	var removed []string
+	for service, stop := range s.mirrors {
+		if _, ok := current[service]; !ok {
+			close(stop)
+			delete(s.mirrors, service)
+			delete(s.replicated, service)
+			removed = append(removed, service)
+		}
+	}
+	for service := range current {
+		if _, ok := s.mirrors[service]; !ok {
+			stop := make(chan struct{})
+			s.mirrors[service] = stop
+			s.wg.Add(1)
+			go s.mirror(service, stop)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, service := range removed {
+		if err := s.Store.RemoveService(service); err != nil && !IsNotFound(err) {
+			s.logf("standby: remove service %s: %s", service, err)
+		}
+	}
+}
+
+// promote stops replication and hands the store over to the caller.
+func (s *Standby) promote() {
+	s.mu.Lock()
+	s.promoted = true
+	for _, stop := range s.mirrors {
+		close(stop)
+	}
+	s.mirrors = make(map[string]chan struct{})
+	s.mu.Unlock()
+
+	s.logf("standby: primary unreachable for %s, promoting", s.FencingDelay)
+	if s.OnPromote != nil {
+		s.OnPromote()
+	}
+}
+
+// mirror replays a service's events from the primary into the local store,
+// re-establishing the stream on failure, until stopped.
+func (s *Standby) mirror(service string, stop chan struct{}) {
+	defer s.wg.Done()
+
+	for {
+		if err := s.mirrorStream(service, stop); err != nil {
+			s.logf("standby: mirror %s: %s", service, err)
+		}
+		select {
+		case <-s.closing:
+			return
+		case <-stop:
+			return
+		case <-time.After(s.RetryInterval):
+		}
+	}
+}
+
+func (s *Standby) mirrorStream(service string, stop chan struct{}) error {
+	if err := s.Store.AddService(service, nil); err != nil && !IsServiceExists(err) {
+		return err
+	}
+
+	events := make(chan *discoverd.Event, StreamBufferSize)
+	stream, err := s.Primary.Service(service).Watch(events)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	heartbeat := time.NewTicker(s.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// seen collects the instances sent before the "current" event so stale
+	// local copies can be pruned once the initial state is complete.
+	seen := make(map[string]struct{})
+	current := false
+
+	for {
+		select {
+		case <-s.closing:
+			return nil
+
+		case <-stop:
+			return nil
+
+		case <-heartbeat.C:
+			s.renewLeases(service)
+
+		case event, ok := <-events:
+			if !ok {
+				return stream.Err()
+			}
+			if err := s.apply(service, event, seen, &current); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply replays one event from the primary into the local store.
+func (s *Standby) apply(service string, event *discoverd.Event, seen map[string]struct{}, current *bool) error {
+	switch event.Kind {
+	case discoverd.EventKindUp, discoverd.EventKindUpdate:
+		if !*current {
+			seen[event.Instance.ID] = struct{}{}
+		}
+		if err := s.Store.AddInstance(service, event.Instance.Clone()); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		if s.replicated[service] == nil {
+			s.replicated[service] = make(map[string]struct{})
+		}
+		s.replicated[service][event.Instance.ID] = struct{}{}
+		s.mu.Unlock()
+
+	case discoverd.EventKindDown:
+		s.mu.Lock()
+		delete(s.replicated[service], event.Instance.ID)
+		s.mu.Unlock()
+		if err := s.Store.RemoveInstance(service, event.Instance.ID); err != nil && !IsNotFound(err) {
+			return err
+		}
+
+	case discoverd.EventKindLeader:
+		if event.Instance != nil {
+			if err := s.Store.SetServiceLeader(service, event.Instance.ID); err != nil && !IsNotFound(err) {
+				return err
+			}
+		}
+
+	case discoverd.EventKindServiceMeta:
+		// The primary's meta index doesn't line up with the local raft
+		// log, so replay the write against the current local index.
+		meta := &discoverd.ServiceMeta{Data: event.ServiceMeta.Data}
+		if curr := s.Store.ServiceMeta(service); curr != nil {
+			meta.Index = curr.Index
+		}
+		if err := s.Store.SetServiceMeta(service, meta); err != nil {
+			return err
+		}
+
+	case discoverd.EventKindCurrent:
+		*current = true
+		return s.prune(service, seen)
+	}
+	return nil
+}
+
+// prune removes local copies that are no longer registered on the primary,
+// e.g. instances that went down while the stream was disconnected.
+func (s *Standby) prune(service string, seen map[string]struct{}) error {
+	s.mu.Lock()
+	var stale []string
+	for id := range s.replicated[service] {
+		if _, ok := seen[id]; !ok {
+			stale = append(stale, id)
+		}
+	}
+	for _, id := range stale {
+		delete(s.replicated[service], id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range stale {
+		if err := s.Store.RemoveInstance(service, id); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// renewLeases heartbeats all replicated instances of a service so they don't
+// expire locally while the replication stream is healthy.
+func (s *Standby) renewLeases(service string) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.replicated[service]))
+	for id := range s.replicated[service] {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		if err := s.Store.Heartbeat(service, id); err != nil && !IsNotFound(err) {
+			s.logf("standby: heartbeat %s/%s: %s", service, id, err)
+		}
+	}
+}
+
+func (s *Standby) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
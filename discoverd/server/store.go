@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/json"
 	"errors"
@@ -10,17 +11,21 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/stream"
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/raft-boltdb"
-	"github.com/inconshreveable/log15"
 )
 
 const (
@@ -29,9 +34,51 @@ const (
 
 	// DefaultExpiryCheckInterval is the default interval between checks for expired instances.
 	DefaultExpiryCheckInterval = 1 * time.Second
+
+	// DefaultTombstoneGrace is the default window after an instance departs
+	// during which an identical re-registration reclaims its previous Index.
+	DefaultTombstoneGrace = 30 * time.Second
+
+	// WildcardService subscribes to events across every service, including
+	// services created after subscribing.
+	WildcardService = "*"
+
+	// DefaultEventLogSize is the default number of broadcast events retained
+	// in memory for resumable subscriptions.
+	DefaultEventLogSize = 1024
+
+	// DefaultSubscriberQueueSize is the default size of the per-subscriber
+	// event queue.
+	DefaultSubscriberQueueSize = 256
+
+	// DefaultFanoutQueueSize is the default size of the queue between
+	// mutations and the fan-out worker.
+	DefaultFanoutQueueSize = 4096
+
+	// DefaultOverflowTimeout is the default wait for queue space when using
+	// the OverflowBlockTimeout policy.
+	DefaultOverflowTimeout = 10 * time.Millisecond
+
+	// DefaultOverloadThreshold is the default queued-event backlog above
+	// which low-priority subscribers degrade to drop-oldest delivery.
+	DefaultOverloadThreshold = 4096
+
+	// removalBroadcastBatchSize is the number of "down" events broadcast per
+	// batch during an asynchronous service removal.
+	removalBroadcastBatchSize = 100
+
+	// removalBroadcastInterval is the pause between batches during an
+	// asynchronous service removal.
+	removalBroadcastInterval = 10 * time.Millisecond
+
+	// DefaultMaxRemovalJobs is the default ceiling on retained service
+	// removal jobs before old ones are evicted.
+	DefaultMaxRemovalJobs = 1000
 )
 
-var logger = log15.New("component", "discoverd")
+// logger is the store's component logger. Other subsystems declare their own
+// so operators can tune levels independently with SetLogLevel.
+var logger = NewLogger("store")
 
 // DefaultServiceConfig is the default configuration for a service when one is not specified.
 var DefaultServiceConfig = &discoverd.ServiceConfig{
@@ -41,7 +88,7 @@ var DefaultServiceConfig = &discoverd.ServiceConfig{
 var (
 	ErrUnsetService = errors.New("discoverd: service name must not be empty")
 
-	ErrInvalidService = errors.New("discoverd: service must be lowercase alphanumeric plus dash")
+	ErrInvalidService = errors.New("discoverd: service must be lowercase alphanumeric plus dash, optionally prefixed with a namespace and slash")
 
 	ErrSendBlocked = errors.New("discoverd: channel send failed due to blocked receiver")
 
@@ -61,6 +108,31 @@ var (
 	ErrLeaderWait = errors.New("discoverd: new leader, waiting for 2x TTL")
 
 	ErrShutdown = errors.New("discoverd: shutting down")
+
+	// ErrSubscriberLimit is the error reported by subscriptions that were
+	// evicted because the per-service subscriber limit was reached.
+	ErrSubscriberLimit = errors.New("discoverd: subscriber limit reached")
+
+	// ErrEventLogTruncated is returned when resuming a subscription from an
+	// event index that has already been evicted from the ring buffer.
+	ErrEventLogTruncated = errors.New("discoverd: event log truncated, full resync required")
+)
+
+// OverflowPolicy determines what happens to a subscriber whose event queue
+// is full.
+type OverflowPolicy int
+
+const (
+	// OverflowClose closes the subscriber with ErrSendBlocked.
+	OverflowClose OverflowPolicy = iota
+
+	// OverflowDropOldest discards the oldest queued event to make room for
+	// the new one.
+	OverflowDropOldest
+
+	// OverflowBlockTimeout waits up to OverflowTimeout for queue space and
+	// closes the subscriber with ErrSendBlocked if none becomes available.
+	OverflowBlockTimeout
 )
 
 // Store represents a storage backend using the raft protocol.
@@ -74,16 +146,54 @@ type Store struct {
 	stableStore *raftboltdb.BoltStore
 
 	data        *raftData
-	subscribers map[string]*list.List
-
-	leaderCh   chan bool                 // channel for notifying when leadership changes
-	leaderTime time.Time                 // time when leadership was established
-	heartbeats map[instanceKey]time.Time // heartbeat recv time for each instance
+	readState   atomic.Value // *raftData copy-on-write snapshot for lock-free reads
+	applyIndex  uint64       // index of the raft log entry currently being applied
+	subs          *subscriberRegistry // sharded subscriber registry
+	fanout        chan *fanoutJob     // queue between mutations and the fan-out worker
+	pendingFanout []fanoutItem        // events collected by the mutation being applied
+	subID         uint64              // id of the most recently created subscription
+	clientSubsMu  sync.Mutex          // guards clientSubs; never held with mu wanted
+	clientSubs    map[string]int      // active subscriptions per client identity
+	tierQueued    [numPriorities]int64 // queued-but-undelivered events per delivery tier, updated atomically
+	seq         uint64              // sequence number of the last broadcast event
+	eventLog    []*discoverd.Event  // ring buffer of indexed events for resume
+	removals map[string]*ServiceRemoval
+	history  map[string][]*InstanceDeparture // recently departed instances per service
+
+	// Eviction counters have their own lock because the fan-out worker
+	// records evictions without holding mu.
+	evictMu   sync.Mutex
+	evictions map[string]uint64 // eviction count per limited resource
+	eventStats  map[string]map[string]*EventKindStats
+	depWarned   map[string]bool // services already warned about, rearmed on recovery
+
+	// invariantEvents collects the events broadcast by the mutation being
+	// applied. It is only used in builds with the "invariant" tag.
+	invariantEvents []*discoverd.Event
+
+	leaderCh   chan bool                     // channel for notifying when leadership changes
+	leaderTime time.Time                     // time when leadership was established
+	heartbeats map[instanceKey]time.Time     // heartbeat recv time for each instance
+	ttls       map[instanceKey]time.Duration // per-instance TTL overrides
+	emptySince map[string]time.Time          // time each empty service was first seen empty
+
+	healthStreaks map[instanceKey]int // consecutive probe results, negative for failures
+	healthStats     map[instanceKey]*healthStats          // rolling probe data per instance
+	healthPublished map[instanceKey]*discoverd.HealthInfo // health info as last published
+
+	flaps         map[instanceKey]*flapState // up/down churn tracking per instance
+	lastFlapSweep time.Time                  // time stale flap state was last swept
 
 	// Goroutine management
 	wg      sync.WaitGroup
+	subWG   sync.WaitGroup // subscription drain goroutines
 	closing chan struct{}
 
+	// shuttingDown rejects mutations and new broadcasts once Close has
+	// begun, so the terminal shutdown event is the last one subscribers
+	// see. Guarded by mu.
+	shuttingDown bool
+
 	// The underlying network listener.
 	Listener net.Listener
 
@@ -103,9 +213,111 @@ type Store struct {
 	// The duration without a heartbeat before an instance is expired.
 	InstanceTTL time.Duration
 
+	// The window after an instance departs during which a re-registration
+	// with the same Addr, Proto and Meta reclaims its previous Index, so
+	// leadership doesn't needlessly transfer across a brief network blip.
+	// Zero disables index reclamation.
+	TombstoneGrace time.Duration
+
+	// The minimum duration a service leadership is held after its elected
+	// leader departs before a replacement is elected, so rapid
+	// register/deregister churn doesn't ping-pong leadership between
+	// instances. A new leader is only elected once the grace period passes
+	// without the old leader returning. Zero elects a replacement
+	// immediately.
+	LeaderHoldTime time.Duration
+
+	// The duration a service may remain empty (zero instances and no
+	// service meta) before it is garbage collected. Zero disables
+	// garbage collection.
+	ServiceRetention time.Duration
+
+	// The maximum number of subscribers per service. When the ceiling is
+	// reached the oldest subscriber is evicted with ErrSubscriberLimit.
+	// Zero means no limit.
+	MaxSubscribers int
+
+	// The maximum number of concurrent subscriptions admitted per service
+	// and per client identity through SubscribeClient. Unlike
+	// MaxSubscribers, a subscription over a quota is rejected with a
+	// SubscriberQuotaError instead of evicting an existing subscriber.
+	// Zero means no quota.
+	SubscriberQuota       int
+	ClientSubscriberQuota int
+
+	// The maximum number of retained service removal jobs. Completed jobs
+	// are evicted first when the ceiling is reached.
+	MaxRemovalJobs int
+
+	// The maximum number of services, registered instances per service and
+	// metadata bytes (keys plus values) per instance. Registrations over a
+	// limit are rejected with a LimitError. Zero means no limit.
+	MaxServices  int
+	MaxInstances int
+	MaxMetaBytes int
+
+	// The maximum annotation bytes (keys plus values) per instance.
+	// Registrations over the limit are rejected with a LimitError. Zero
+	// means no limit.
+	MaxAnnotationBytes int
+
+	// The number of broadcast events retained in memory for resumable
+	// subscriptions.
+	EventLogSize int
+
+	// The number of departed instances retained per service for the
+	// history API. Zero disables departure history.
+	ServiceHistorySize int
+
+	// The size of the per-subscriber event queue.
+	SubscriberQueueSize int
+
+	// The size of the queue between mutations and the fan-out worker.
+	// Mutations block when it is full so events are never lost.
+	FanoutQueueSize int
+
+	// How to handle a subscriber whose queue is full.
+	OverflowPolicy OverflowPolicy
+
+	// The total queued-event backlog above which low-priority subscribers
+	// degrade to drop-oldest delivery; normal-priority subscribers degrade
+	// at twice the threshold. Zero disables degradation.
+	OverloadThreshold int
+
+	// How long to wait for queue space when using OverflowBlockTimeout.
+	OverflowTimeout time.Duration
+
+	// An optional append-only log of instance lifecycle and leadership
+	// events. Nil disables audit logging.
+	AuditLog *AuditLog
+
+	// An optional interceptor invoked synchronously around instance and
+	// leadership mutations. Nil disables interception.
+	Interceptor Interceptor
+
+	// Optional chaos settings injecting controlled failures for
+	// integration testing. Nil disables chaos. Must be set before Open.
+	Chaos *Chaos
+
+	// An optional on-disk log of broadcast events, periodically compacted,
+	// so resumable subscriptions survive server restarts. Nil keeps the
+	// event log in memory only.
+	EventLog *EventLog
+
 	// The interval between checks for instance expiry on the leader.
 	ExpiryCheckInterval time.Duration
 
+	// The interval between instance health probes on the leader.
+	HealthCheckInterval time.Duration
+
+	// The number of up/down transitions within FlapWindow after which an
+	// instance is considered flapping and its events are suppressed for
+	// FlapBackoff, so a crash-looping instance doesn't flood every
+	// subscriber. Zero disables flap damping.
+	FlapThreshold int
+	FlapWindow    time.Duration
+	FlapBackoff   time.Duration
+
 	// Returns the current time.
 	// This defaults to time.Now and can be changed for mocking.
 	Now func() time.Time
@@ -113,13 +325,22 @@ type Store struct {
 
 // NewStore returns an instance of Store.
 func NewStore(path string) *Store {
-	return &Store{
+	s := &Store{
 		path:        path,
 		data:        newRaftData(),
-		subscribers: make(map[string]*list.List),
-
-		leaderCh:   make(chan bool),
-		heartbeats: make(map[instanceKey]time.Time),
+		subs:        newSubscriberRegistry(),
+		removals:    make(map[string]*ServiceRemoval),
+		evictions:   make(map[string]uint64),
+		eventStats:  make(map[string]map[string]*EventKindStats),
+
+		leaderCh:      make(chan bool),
+		heartbeats:    make(map[instanceKey]time.Time),
+		healthStreaks: make(map[instanceKey]int),
+		healthStats:     make(map[instanceKey]*healthStats),
+		healthPublished: make(map[instanceKey]*discoverd.HealthInfo),
+		flaps:         make(map[instanceKey]*flapState),
+		ttls:          make(map[instanceKey]time.Duration),
+		emptySince:    make(map[string]time.Time),
 
 		closing: make(chan struct{}),
 
@@ -129,17 +350,42 @@ func NewStore(path string) *Store {
 		CommitTimeout:      50 * time.Millisecond,
 
 		InstanceTTL:         DefaultInstanceTTL,
+		TombstoneGrace:      DefaultTombstoneGrace,
 		ExpiryCheckInterval: DefaultExpiryCheckInterval,
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		MaxRemovalJobs:      DefaultMaxRemovalJobs,
+		EventLogSize:        DefaultEventLogSize,
+		ServiceHistorySize:  DefaultServiceHistorySize,
+		SubscriberQueueSize: DefaultSubscriberQueueSize,
+		FanoutQueueSize:     DefaultFanoutQueueSize,
+		OverflowTimeout:     DefaultOverflowTimeout,
+		OverloadThreshold:   DefaultOverloadThreshold,
+		FlapThreshold:       DefaultFlapThreshold,
+		FlapWindow:          DefaultFlapWindow,
+		FlapBackoff:         DefaultFlapBackoff,
 
 		LogOutput: os.Stderr,
 		Now:       time.Now,
 	}
+	s.readState.Store(s.data)
+	return s
 }
 
 // Path returns the path that the store was initialized with.
 func (s *Store) Path() string { return s.path }
 
 // Open starts the raft consensus and opens the store.
+//
+// All replicated state — registrations with their TTLs, service configs,
+// metadata and leader assignments — is persisted under the store path: the
+// raft log is written to BoltDB (raft.db) and periodically compacted into
+// file snapshots. On startup raft restores the latest snapshot and replays
+// the remaining log through Apply, so the state survives server restarts
+// without instances having to re-register. Subscribers reconnecting after a
+// restart receive the recovered state via sendCurrent, and expiry is
+// deferred for two TTL intervals after leadership is established so
+// recovered instances have a chance to resume heartbeating before they are
+// expired.
 func (s *Store) Open() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -154,6 +400,26 @@ func (s *Store) Open() error {
 		return ErrAdvertiseRequired
 	}
 
+	// Start the fan-out worker which delivers broadcast events to
+	// subscribers off the mutation path.
+	s.fanout = make(chan *fanoutJob, s.FanoutQueueSize)
+	s.wg.Add(1)
+	go s.fanoutLoop()
+
+	// Restore the persisted event log, if one is configured, so resumable
+	// subscriptions pick up where they left off before the restart.
+	if s.EventLog != nil {
+		if events := s.EventLog.Events(); len(events) > 0 {
+			if s.eventLog == nil {
+				s.eventLog = make([]*discoverd.Event, s.EventLogSize)
+			}
+			for _, event := range events {
+				s.eventLog[(event.EventIndex-1)%uint64(len(s.eventLog))] = event
+			}
+			s.seq = s.EventLog.LastIndex()
+		}
+	}
+
 	// Create root directory.
 	if err := os.MkdirAll(s.path, 0777); err != nil {
 		return err
@@ -224,6 +490,16 @@ func (s *Store) Open() error {
 	s.wg.Add(1)
 	go s.expirer()
 
+	// Start goroutine to probe instance health.
+	s.wg.Add(1)
+	go s.checker()
+
+	// Start goroutine to force leader re-elections in chaos mode.
+	if s.Chaos != nil && s.Chaos.ElectionInterval > 0 {
+		s.wg.Add(1)
+		go s.chaosLoop()
+	}
+
 	return nil
 }
 
@@ -240,18 +516,41 @@ func (s *Store) LastIndex() uint64 {
 	return 0
 }
 
-// Close shuts down the transport and store.
+// Close shuts down the transport and store. The shutdown is graceful for
+// subscribers: events already queued with the fan-out worker are delivered,
+// every subscriber receives a terminal "shutdown" event, and the subscriber
+// channels are closed before Close returns, so embedding servers can restart
+// without leaking goroutines or leaving clients blocked on silent channels.
 func (s *Store) Close() (lastIdx uint64, err error) {
+	// Reject further mutations, flush events already queued for delivery
+	// and hand every subscriber the terminal event.
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.flushFanout()
+	seen := make(map[uint64]struct{})
+	s.subs.forEachAll(func(sub *subscription) {
+		// Multi-service subscriptions are registered once per key.
+		if _, ok := seen[sub.id]; ok {
+			return
+		}
+		seen[sub.id] = struct{}{}
+		sub.enqueue(&discoverd.Event{Service: sub.service, Kind: discoverd.EventKindShutdown})
+	})
+	s.mu.Unlock()
+
 	// Notify goroutines of closing and wait until they finish.
 	close(s.closing)
 	s.wg.Wait()
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	for _, l := range s.subscribers {
-		for el := l.Front(); el != nil; el = el.Next() {
-			go el.Value.(*subscription).Close()
-		}
+	// Collect the subscriptions before closing them, since close removes
+	// them from the registry the iteration walks.
+	var subs []*subscription
+	s.subs.forEachAll(func(sub *subscription) {
+		subs = append(subs, sub)
+	})
+	for _, sub := range subs {
+		sub.close()
 	}
 	if s.raft != nil {
 		s.raft.Shutdown().Error()
@@ -266,6 +565,11 @@ func (s *Store) Close() (lastIdx uint64, err error) {
 		s.stableStore.Close()
 		s.stableStore = nil
 	}
+	s.mu.Unlock()
+
+	// Wait for the subscription drain goroutines to finish delivering and
+	// close their subscriber channels, so none outlive the store.
+	s.subWG.Wait()
 
 	return lastIdx, nil
 }
@@ -360,13 +664,19 @@ func (s *Store) SetPeers(peers []string) error {
 	return s.raft.SetPeers(peers).Error()
 }
 
+// readData returns the most recently published copy-on-write snapshot of
+// the store data. The snapshot is immutable and can be read without taking
+// the lock, so read-heavy workloads don't contend with writes.
+func (s *Store) readData() *raftData {
+	return s.readState.Load().(*raftData)
+}
+
 // ServiceNames returns a sorted list of existing service names.
 func (s *Store) ServiceNames() []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	d := s.readData()
 
 	var a []string
-	for name := range s.data.Services {
+	for name := range d.Services {
 		a = append(a, name)
 	}
 	sort.Strings(a)
@@ -381,6 +691,11 @@ func (s *Store) AddService(service string, config *discoverd.ServiceConfig) erro
 		config = DefaultServiceConfig
 	}
 
+	// Expand the appliance profile, if one was named.
+	if err := applyProfile(config); err != nil {
+		return err
+	}
+
 	// Serialize command.
 	cmd, err := json.Marshal(&addServiceCommand{
 		Service: service,
@@ -407,17 +722,88 @@ func (s *Store) applyAddServiceCommand(cmd []byte) error {
 		return ServiceExistsError(c.Service)
 	}
 
+	// Enforce the service ceiling.
+	if s.MaxServices > 0 && len(s.data.Services) >= s.MaxServices {
+		return LimitError{Resource: "services", Limit: s.MaxServices}
+	}
+
 	// Create new named service with configuration.
 	s.data.Services[c.Service] = c.Config
 
+	// Broadcast a "service up" event so wildcard subscribers can react to
+	// new services appearing without polling the service list.
+	s.broadcast(&discoverd.Event{
+		Service: c.Service,
+		Kind:    discoverd.EventKindServiceUp,
+	})
+
+	return nil
+}
+
+// SetServiceConfig updates the configuration for an existing service at
+// runtime. A "service config" event is broadcast so watchers can react to
+// changed knobs such as the leader election strategy.
+func (s *Store) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	if config == nil {
+		config = DefaultServiceConfig
+	}
+
+	// Expand the appliance profile, if one was named.
+	if err := applyProfile(config); err != nil {
+		return err
+	}
+
+	// Skip the raft proposal if the configuration is unchanged so
+	// idempotent writes broadcast no event.
+	if d := s.readData(); reflect.DeepEqual(d.Services[d.resolve(service)], config) {
+		return nil
+	}
+
+	// Serialize command.
+	cmd, err := json.Marshal(&setServiceConfigCommand{
+		Service: service,
+		Config:  config,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(setServiceConfigCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applySetServiceConfigCommand(cmd []byte) error {
+	var c setServiceConfigCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the service exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+
+	s.data.Services[c.Service] = c.Config
+
+	// Broadcast event.
+	s.broadcast(&discoverd.Event{
+		Service: c.Service,
+		Kind:    discoverd.EventKindServiceConfig,
+	})
+
+	// Re-run leader election in case the strategy changed.
+	s.invalidateServiceLeader(c.Service)
+
 	return nil
 }
 
 // Config returns the configuration for service.
 func (s *Store) Config(service string) *discoverd.ServiceConfig {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return s.data.Services[service]
+	d := s.readData()
+	return d.Services[d.resolve(service)]
 }
 
 // RemoveService deletes the service from the store.
@@ -434,6 +820,51 @@ func (s *Store) RemoveService(service string) error {
 	return nil
 }
 
+// ServiceRemoval tracks the progress of an asynchronous service removal.
+type ServiceRemoval struct {
+	ID      string `json:"id"`
+	Service string `json:"service"`
+	Total   int    `json:"total"`
+	Sent    int    `json:"sent"`
+	Done    bool   `json:"done"`
+}
+
+// RemoveServiceAsync deletes the service from the store, broadcasting the
+// "down" events for its instances asynchronously with rate limiting instead of
+// emitting them all under the store lock. It returns the ID of a removal job
+// whose progress can be checked with ServiceRemoval.
+func (s *Store) RemoveServiceAsync(service string) (string, error) {
+	jobID := random.UUID()
+
+	// Serialize command.
+	cmd, err := json.Marshal(&removeServiceCommand{
+		Service: service,
+		Async:   true,
+		JobID:   jobID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := s.raftApply(removeServiceCommandType, cmd); err != nil {
+		return "", err
+	}
+	return jobID, nil
+}
+
+// ServiceRemoval returns a copy of the removal job with the given ID, or nil
+// if no such job exists on this node.
+func (s *Store) ServiceRemoval(id string) *ServiceRemoval {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job := s.removals[id]
+	if job == nil {
+		return nil
+	}
+	other := *job
+	return &other
+}
+
 func (s *Store) applyRemoveServiceCommand(cmd []byte) error {
 	var c removeServiceCommand
 	if err := json.Unmarshal(cmd, &c); err != nil {
@@ -451,164 +882,1531 @@ func (s *Store) applyRemoveServiceCommand(cmd []byte) error {
 	// Delete service meta
 	delete(s.data.Metas, c.Service)
 
-	// Broadcast EventKindDown for all instances on the service.
-	for _, inst := range s.data.ServiceInstances(c.Service) {
-		s.broadcast(&discoverd.Event{
+	// Delete health state.
+	delete(s.data.Unhealthy, c.Service)
+
+	// Delete the per-proto leaders and the leadership fencing token.
+	delete(s.data.ProtoLeaders, c.Service)
+	delete(s.data.LeaderTokens, c.Service)
+
+	// Delete any tombstones for departed instances.
+	delete(s.data.Tombstones, c.Service)
+
+	// Delete the departure history so a later re-registration of the
+	// service starts with an empty one.
+	delete(s.history, c.Service)
+
+	// Drop any pending leadership hold.
+	delete(s.data.LeaderHolds, c.Service)
+
+	// Stop tracking the service for garbage collection.
+	delete(s.emptySince, c.Service)
+
+	// Forget any flap tracking state for the service's instances.
+	for key := range s.flaps {
+		if key.service == c.Service {
+			delete(s.flaps, key)
+		}
+	}
+
+	instances := s.data.ServiceInstances(c.Service)
+
+	// Delete the instances and leadership so a later re-registration of the
+	// service starts from a clean slate.
+	delete(s.data.Instances, c.Service)
+	delete(s.data.Leaders, c.Service)
+
+	// Broadcast the "down" events asynchronously, if requested, so large
+	// services don't emit thousands of broadcasts under the store lock.
+	if c.Async {
+		// Evict an old job if the ceiling is reached, completed jobs first.
+		if s.MaxRemovalJobs > 0 && len(s.removals) >= s.MaxRemovalJobs {
+			s.evictRemovalJob()
+		}
+		job := &ServiceRemoval{ID: c.JobID, Service: c.Service, Total: len(instances)}
+		s.removals[c.JobID] = job
+		s.wg.Add(1)
+		go s.broadcastRemoval(job, instances)
+		return nil
+	}
+
+	// Broadcast EventKindDown for all instances on the service followed by
+	// the service itself going down, batched as one atomic change.
+	events := make([]*discoverd.Event, 0, len(instances)+1)
+	for _, inst := range instances {
+		events = append(events, &discoverd.Event{
 			Service:  c.Service,
 			Kind:     discoverd.EventKindDown,
 			Instance: inst,
+			Reason:   discoverd.DownReasonServiceRemoved,
 		})
 	}
+	events = append(events, &discoverd.Event{
+		Service: c.Service,
+		Kind:    discoverd.EventKindServiceDown,
+	})
+	s.broadcastBatch(events)
 
 	return nil
 }
 
-// Instances returns a list of instances for service.
-func (s *Store) Instances(service string) ([]*discoverd.Instance, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.instances(service), nil
+// evictRemovalJob removes a retained removal job, preferring completed ones.
+// Must be called under mutex.
+func (s *Store) evictRemovalJob() {
+	var id string
+	for jobID, job := range s.removals {
+		if job.Done {
+			id = jobID
+			break
+		}
+		if id == "" {
+			id = jobID
+		}
+	}
+	if id != "" {
+		delete(s.removals, id)
+		s.evict("removal_jobs")
+	}
 }
 
-func (s *Store) instances(service string) []*discoverd.Instance {
-	var a []*discoverd.Instance
-	for _, inst := range s.data.Instances[service] {
-		var other = *inst
-		a = append(a, &other)
-	}
-	sort.Sort(instanceSlice(a))
-	return a
+// evict increments the eviction count for a limited resource.
+func (s *Store) evict(resource string) {
+	s.evictMu.Lock()
+	s.evictions[resource]++
+	s.evictMu.Unlock()
+	logger.Warn("memory ceiling reached, evicting",
+		"fn", "evict",
+		"resource", resource,
+	)
 }
 
-func (s *Store) AddInstance(service string, inst *discoverd.Instance) error {
-	// Check if it's the leader.
-	// This check is needed because the heartbeats don't go through raft so
-	// it is not verified here like it normally would be when calling raftApply().
-	if !s.IsLeader() {
-		return ErrNotLeader
+// EvictionStats returns the number of evictions per limited resource.
+func (s *Store) EvictionStats() map[string]uint64 {
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+	stats := make(map[string]uint64, len(s.evictions))
+	for resource, n := range s.evictions {
+		stats[resource] = n
 	}
+	return stats
+}
 
-	s.mu.Lock()
-	// Track heartbeat time, if leader.
-	s.heartbeats[instanceKey{service, inst.ID}] = time.Now()
+// broadcastRemoval broadcasts "down" events for instances of a removed
+// service in rate limited batches, updating job as it goes.
+func (s *Store) broadcastRemoval(job *ServiceRemoval, instances []*discoverd.Instance) {
+	defer s.wg.Done()
 
-	// Ignore if instance already exists and it hasn't changed.
-	if m := s.data.Instances[service]; m != nil {
-		if prev := m[inst.ID]; prev != nil && inst.Equal(prev) {
-			s.mu.Unlock()
-			return nil
+	for len(instances) > 0 {
+		batch := instances
+		if len(batch) > removalBroadcastBatchSize {
+			batch = batch[:removalBroadcastBatchSize]
+		}
+		instances = instances[len(batch):]
+
+		s.mu.Lock()
+		for _, inst := range batch {
+			s.broadcast(&discoverd.Event{
+				Service:  job.Service,
+				Kind:     discoverd.EventKindDown,
+				Instance: inst,
+				Reason:   discoverd.DownReasonServiceRemoved,
+			})
+		}
+		job.Sent += len(batch)
+		s.mu.Unlock()
+
+		if len(instances) == 0 {
+			break
+		}
+
+		select {
+		case <-time.After(removalBroadcastInterval):
+		case <-s.closing:
+			return
 		}
 	}
+
+	s.mu.Lock()
+	// Broadcast that the service itself is gone.
+	s.broadcast(&discoverd.Event{
+		Service: job.Service,
+		Kind:    discoverd.EventKindServiceDown,
+	})
+	job.Done = true
 	s.mu.Unlock()
+}
 
+// RenameService atomically renames a service, moving its config, meta, leader
+// and instances to the new name and leaving an alias behind under the old
+// name. While the alias exists, reads and writes under the old name resolve
+// to the new service and events are dual-published under both names. Call
+// RetireAlias to finish the migration once clients have moved over.
+func (s *Store) RenameService(service, newName string) error {
 	// Serialize command.
-	cmd, err := json.Marshal(&addInstanceCommand{
-		Service:  service,
-		Instance: inst,
+	cmd, err := json.Marshal(&renameServiceCommand{
+		Service: service,
+		NewName: newName,
 	})
 	if err != nil {
 		return err
 	}
 
-	if _, err := s.raftApply(addInstanceCommandType, cmd); err != nil {
+	if _, err := s.raftApply(renameServiceCommandType, cmd); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *Store) applyAddInstanceCommand(cmd []byte, index uint64) error {
-	var c addInstanceCommand
+func (s *Store) applyRenameServiceCommand(cmd []byte) error {
+	var c renameServiceCommand
 	if err := json.Unmarshal(cmd, &c); err != nil {
 		return err
 	}
 
-	// Verify that the service exists.
-	if s.data.Services[c.Service] == nil {
+	// Verify that the service exists, isn't itself an alias and that the
+	// new name is unused.
+	if s.data.Services[c.Service] == nil || s.data.Aliases[c.Service] != "" {
 		return NotFoundError{Service: c.Service}
 	}
-
-	// Save the instance data.
-	if s.data.Instances[c.Service] == nil {
-		s.data.Instances[c.Service] = make(map[string]*discoverd.Instance)
+	if s.data.Services[c.NewName] != nil || s.data.Aliases[c.NewName] != "" {
+		return ServiceExistsError(c.NewName)
 	}
 
-	// Check if the instance already exists.
-	// If it does then copy the original index.
-	// Otherwise set the index to the current log entry's index.
-	prev := s.data.Instances[c.Service][c.Instance.ID]
-	if prev != nil {
-		c.Instance.Index = prev.Index
-	} else {
-		c.Instance.Index = index
+	// Move the config, meta, leader, instances and freeze state.
+	s.data.Services[c.NewName] = s.data.Services[c.Service]
+	delete(s.data.Services, c.Service)
+	if meta := s.data.Metas[c.Service]; meta != nil {
+		s.data.Metas[c.NewName] = meta
+		delete(s.data.Metas, c.Service)
+	}
+	if id, ok := s.data.Leaders[c.Service]; ok {
+		s.data.Leaders[c.NewName] = id
+		delete(s.data.Leaders, c.Service)
+	}
+	if m := s.data.Instances[c.Service]; m != nil {
+		s.data.Instances[c.NewName] = m
+		delete(s.data.Instances, c.Service)
+	}
+	if s.data.Frozen[c.Service] {
+		s.data.Frozen[c.NewName] = true
+		delete(s.data.Frozen, c.Service)
+	}
+	if m := s.data.Unhealthy[c.Service]; m != nil {
+		s.data.Unhealthy[c.NewName] = m
+		delete(s.data.Unhealthy, c.Service)
+	}
+	if m := s.data.ProtoLeaders[c.Service]; m != nil {
+		s.data.ProtoLeaders[c.NewName] = m
+		delete(s.data.ProtoLeaders, c.Service)
+	}
+	if token, ok := s.data.LeaderTokens[c.Service]; ok {
+		s.data.LeaderTokens[c.NewName] = token
+		delete(s.data.LeaderTokens, c.Service)
+	}
+	if m := s.data.Tombstones[c.Service]; m != nil {
+		s.data.Tombstones[c.NewName] = m
+		delete(s.data.Tombstones, c.Service)
 	}
 
-	// Check if the existing instance is being updated.
-	updating := prev != nil && !c.Instance.Equal(prev)
+	// Copy heartbeat times so the instances don't immediately expire.
+	for key, t := range s.heartbeats {
+		if key.service == c.Service {
+			s.heartbeats[instanceKey{c.NewName, key.instanceID}] = t
+			delete(s.heartbeats, key)
+		}
+	}
+	for key, ttl := range s.ttls {
+		if key.service == c.Service {
+			s.ttls[instanceKey{c.NewName, key.instanceID}] = ttl
+			delete(s.ttls, key)
+		}
+	}
+	for key, f := range s.flaps {
+		if key.service == c.Service {
+			s.flaps[instanceKey{c.NewName, key.instanceID}] = f
+			delete(s.flaps, key)
+		}
+	}
 
-	// Update entry.
-	s.data.Instances[c.Service][c.Instance.ID] = c.Instance
+	// Leave an alias behind under the old name.
+	if s.data.Aliases == nil {
+		s.data.Aliases = make(map[string]string)
+	}
+	s.data.Aliases[c.Service] = c.NewName
 
-	// Broadcast "up" event if new instance.
-	if prev == nil {
+	// Broadcast "up" events under the new name so subscribers pick up the
+	// existing instances. The alias dual-publishes them under the old name.
+	for _, inst := range s.data.ServiceInstances(c.NewName) {
 		s.broadcast(&discoverd.Event{
-			Service:  c.Service,
+			Service:  c.NewName,
 			Kind:     discoverd.EventKindUp,
-			Instance: c.Instance,
-		})
-	} else if updating {
-		s.broadcast(&discoverd.Event{
-			Service:  c.Service,
-			Kind:     discoverd.EventKindUpdate,
-			Instance: c.Instance,
+			Instance: inst,
 		})
 	}
 
-	// Update service leader, if necessary.
-	s.invalidateServiceLeader(c.Service)
-
 	return nil
 }
 
-func (s *Store) RemoveInstance(service, id string) error {
+// RetireAlias removes an alias left behind by RenameService, completing the
+// migration. Subscribers of the old name receive a "service down" event.
+func (s *Store) RetireAlias(alias string) error {
 	// Serialize command.
-	cmd, err := json.Marshal(&removeInstanceCommand{
-		Service: service,
-		ID:      id,
-	})
+	cmd, err := json.Marshal(&removeAliasCommand{Alias: alias})
 	if err != nil {
 		return err
 	}
 
-	if _, err := s.raftApply(removeInstanceCommandType, cmd); err != nil {
+	if _, err := s.raftApply(removeAliasCommandType, cmd); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (s *Store) applyRemoveInstanceCommand(cmd []byte) error {
-	var c removeInstanceCommand
+func (s *Store) applyRemoveAliasCommand(cmd []byte) error {
+	var c removeAliasCommand
 	if err := json.Unmarshal(cmd, &c); err != nil {
 		return err
 	}
 
-	// Verify that the service exists.
-	if s.data.Instances[c.Service] == nil {
-		return NotFoundError{Service: c.Service}
+	// Verify that the alias exists.
+	if s.data.Aliases[c.Alias] == "" {
+		return NotFoundError{Service: c.Alias}
 	}
 
-	// Remove instance data.
-	inst := s.data.Instances[c.Service][c.ID]
-	delete(s.data.Instances[c.Service], c.ID)
-	delete(s.heartbeats, instanceKey{c.Service, c.ID})
-
-	// Broadcast "down" event for instance.
-	if inst != nil {
-		s.broadcast(&discoverd.Event{
-			Service:  c.Service,
-			Kind:     discoverd.EventKindDown,
-			Instance: inst,
-		})
-	}
+	// Remove the alias.
+	delete(s.data.Aliases, c.Alias)
+
+	// Broadcast that the old name is gone.
+	s.broadcast(&discoverd.Event{
+		Service: c.Alias,
+		Kind:    discoverd.EventKindServiceDown,
+	})
+
+	return nil
+}
+
+// resolveService returns the service that name refers to, following an alias
+// left behind by RenameService.
+func (s *Store) resolveService(name string) string {
+	return s.data.resolve(name)
+}
+
+// SetServiceFrozen freezes or unfreezes writes to a service. While a service
+// is frozen, reads and watches continue but registrations, deregistrations,
+// leader changes and TTL expiry are rejected until the service is unfrozen.
+func (s *Store) SetServiceFrozen(service string, frozen bool) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&setServiceFrozenCommand{
+		Service: service,
+		Frozen:  frozen,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(setServiceFrozenCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applySetServiceFrozenCommand(cmd []byte) error {
+	var c setServiceFrozenCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the service exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+
+	if c.Frozen {
+		if s.data.Frozen == nil {
+			s.data.Frozen = make(map[string]bool)
+		}
+		s.data.Frozen[c.Service] = true
+	} else {
+		delete(s.data.Frozen, c.Service)
+	}
+
+	return nil
+}
+
+// Instances returns a list of instances for service.
+//
+// The ordering is part of the API contract: instances are sorted by
+// registration index, with ties broken by ID, so every call on every server
+// returns the same sequence and clients doing consistent hashing see stable
+// positions. The HTTP API can additionally sort by address.
+func (s *Store) Instances(service string) ([]*discoverd.Instance, error) {
+	return s.InstancesFiltered(service, nil)
+}
+
+// InstancesFiltered returns the instances of a service whose metadata
+// matches the selector, so clients don't have to filter large services
+// locally. The results are ordered as documented on Instances.
+func (s *Store) InstancesFiltered(service string, selector Selector) ([]*discoverd.Instance, error) {
+	d := s.readData()
+	service = d.resolve(service)
+
+	var a []*discoverd.Instance
+	for _, inst := range d.Instances[service] {
+		// Exclude instances that have failed their health check or are
+		// out of rotation (draining or in maintenance).
+		if d.Unhealthy[service][inst.ID] || outOfRotation(inst) {
+			continue
+		}
+		if selector != nil && !selector.Match(inst) {
+			continue
+		}
+		var other = *inst
+		a = append(a, &other)
+	}
+	sort.Sort(instanceSlice(a))
+	return a, nil
+}
+
+// EachInstance calls fn for each live instance of a service, stopping early
+// if fn returns false. It passes the shared snapshot instances directly, so
+// nothing is allocated or copied per call; in exchange fn must treat the
+// instances as read-only and must not retain them. Iteration order is
+// unspecified.
+func (s *Store) EachInstance(service string, fn func(*discoverd.Instance) bool) {
+	d := s.readData()
+	service = d.resolve(service)
+	for _, inst := range d.Instances[service] {
+		if d.Unhealthy[service][inst.ID] || outOfRotation(inst) {
+			continue
+		}
+		if !fn(inst) {
+			return
+		}
+	}
+}
+
+// AppendInstances appends the live instances of a service to buf, in the
+// order documented on Instances, and returns the extended buffer. Callers
+// reusing buf across calls avoid the slice and instance copies Instances
+// makes on every call; in exchange the appended instances must be treated
+// as read-only.
+func (s *Store) AppendInstances(buf []*discoverd.Instance, service string) []*discoverd.Instance {
+	d := s.readData()
+	service = d.resolve(service)
+	start := len(buf)
+	for _, inst := range d.Instances[service] {
+		if d.Unhealthy[service][inst.ID] || outOfRotation(inst) {
+			continue
+		}
+		buf = append(buf, inst)
+	}
+
+	// Insertion sort the appended region: the result is typically small
+	// and this avoids the interface conversion sort.Sort allocates for.
+	a := buf[start:]
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && instanceLess(a[j], a[j-1]); j-- {
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
+	return buf
+}
+
+// GetWithIndex returns the instances of a service whose metadata matches the
+// selector, together with the sequence number of the most recent broadcast
+// event, read under a single lock acquisition. Passing the index to
+// SubscribeSince replays exactly the events that follow the snapshot, giving
+// clients a race-free snapshot+watch pattern.
+func (s *Store) GetWithIndex(service string, selector Selector) ([]*discoverd.Instance, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	a := s.instances(service)
+	if selector != nil {
+		var filtered []*discoverd.Instance
+		for _, inst := range a {
+			if selector.Match(inst) {
+				filtered = append(filtered, inst)
+			}
+		}
+		a = filtered
+	}
+	return a, s.seq, nil
+}
+
+// ServiceState is an atomic snapshot of a service's instances and
+// leadership. Reading instances and the leader separately can disagree when
+// a mutation lands between the two reads; a snapshot cannot.
+type ServiceState struct {
+	Instances []*discoverd.Instance `json:"instances"`
+
+	// LeaderID is the ID of the current leader, empty when leadership is
+	// vacant or election is disabled. It may name an instance missing
+	// from Instances, e.g. a manually elected leader that is unhealthy.
+	LeaderID string `json:"leader_id,omitempty"`
+
+	// Index is the sequence number of the most recent broadcast event,
+	// usable with SubscribeSince to resume a stream from this snapshot.
+	Index uint64 `json:"index"`
+}
+
+// ServiceState returns the instances and leadership of a service as one
+// atomic snapshot. It returns nil if the service doesn't exist.
+func (s *Store) ServiceState(service string) *ServiceState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	service = s.resolveService(service)
+	if s.data.Services[service] == nil {
+		return nil
+	}
+	instances := s.instances(service)
+	if instances == nil {
+		instances = []*discoverd.Instance{}
+	}
+	return &ServiceState{
+		Instances: instances,
+		LeaderID:  s.data.Leaders[service],
+		Index:     s.seq,
+	}
+}
+
+func (s *Store) instances(service string) []*discoverd.Instance {
+	service = s.resolveService(service)
+	var a []*discoverd.Instance
+	for _, inst := range s.data.Instances[service] {
+		// Exclude instances that have failed their health check or are
+		// out of rotation (draining or in maintenance).
+		if s.data.Unhealthy[service][inst.ID] || outOfRotation(inst) {
+			continue
+		}
+		var other = *inst
+		a = append(a, &other)
+	}
+	sort.Sort(instanceSlice(a))
+	return a
+}
+
+func (s *Store) AddInstance(service string, inst *discoverd.Instance) error {
+	// Check if it's the leader.
+	// This check is needed because the heartbeats don't go through raft so
+	// it is not verified here like it normally would be when calling raftApply().
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+
+	// Canonicalize the address so equivalent spellings (e.g. expanded
+	// IPv6 literals) map onto one instance.
+	if addr, err := discoverd.NormalizeAddr(inst.Addr); err == nil {
+		inst.Addr = addr
+	}
+
+	// Consult the interceptor before any state is touched.
+	if s.Interceptor != nil {
+		if err := s.Interceptor.BeforeAddInstance(service, inst); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	// Resolve any alias so heartbeats are tracked under the real name.
+	service = s.resolveService(service)
+
+	// Track heartbeat time and TTL override, if leader.
+	s.heartbeats[instanceKey{service, inst.ID}] = time.Now()
+	if inst.TTL > 0 {
+		s.ttls[instanceKey{service, inst.ID}] = time.Duration(inst.TTL) * time.Second
+	} else {
+		delete(s.ttls, instanceKey{service, inst.ID})
+	}
+
+	// Ignore if instance already exists and it hasn't changed.
+	if m := s.data.Instances[service]; m != nil {
+		if prev := m[inst.ID]; prev != nil && inst.Equal(prev) {
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.mu.Unlock()
+
+	// Serialize command.
+	cmd, err := json.Marshal(&addInstanceCommand{
+		Service:  service,
+		Instance: inst,
+		Now:      s.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(addInstanceCommandType, cmd); err != nil {
+		return err
+	}
+	if s.Interceptor != nil {
+		s.Interceptor.AfterAddInstance(service, inst)
+	}
+	return nil
+}
+
+func (s *Store) applyAddInstanceCommand(cmd []byte, index uint64) error {
+	var c addInstanceCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the service exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+
+	// Reject writes to frozen services.
+	if s.data.Frozen[c.Service] {
+		return ServiceFrozenError(c.Service)
+	}
+
+	// Enforce the instance and metadata limits.
+	if err := s.checkInstanceLimits(c.Service, c.Instance, 0); err != nil {
+		return err
+	}
+
+	// Enforce the meta keys required by the service's profile.
+	if err := s.checkRequiredMeta(c.Service, c.Instance); err != nil {
+		return err
+	}
+
+	// Copy the instance map so the published read snapshot is unaffected.
+	m := s.data.cowInstances(c.Service)
+
+	// Check if the instance already exists.
+	// If it does then copy the original index.
+	// Otherwise set the index to the current log entry's index.
+	prev := m[c.Instance.ID]
+	if prev != nil {
+		c.Instance.Index = prev.Index
+	} else {
+		c.Instance.Index = s.reclaimIndex(c.Service, c.Instance, c.Now, index)
+	}
+
+	// Check if the existing instance is being updated.
+	updating := prev != nil && !c.Instance.Equal(prev)
+
+	// Carry the lifecycle state over on unchanged re-registrations; an
+	// updated registration revives a draining instance.
+	if prev != nil && !updating {
+		c.Instance.State = prev.State
+	}
+
+	// Carry health data published by the checker across re-registrations.
+	if prev != nil && c.Instance.HealthInfo == nil {
+		c.Instance.HealthInfo = prev.HealthInfo
+	}
+
+	// Update entry.
+	m[c.Instance.ID] = c.Instance
+
+	// Broadcast "up" event if new instance, unless the instance is
+	// flapping and its events are damped.
+	if prev == nil {
+		if !s.suppressFlap(c.Service, c.Instance.ID, discoverd.EventKindUp, c.Now) {
+			s.broadcast(&discoverd.Event{
+				Service:  c.Service,
+				Kind:     discoverd.EventKindUp,
+				Instance: c.Instance,
+			})
+		}
+	} else if updating && !s.flapDamped(c.Service, c.Instance.ID, c.Now) {
+		s.broadcast(&discoverd.Event{
+			Service:  c.Service,
+			Kind:     discoverd.EventKindUpdate,
+			Instance: c.Instance,
+			Changed:  instanceChanges(prev, c.Instance),
+		})
+	}
+
+	// Update service leader, if necessary.
+	s.invalidateServiceLeader(c.Service)
+
+	return nil
+}
+
+// AddInstances atomically registers a batch of instances, which may span
+// multiple services. Either all of the instances are registered or none are.
+func (s *Store) AddInstances(regs []*discoverd.Registration) error {
+	// Check if it's the leader.
+	// This check is needed because the heartbeats don't go through raft so
+	// it is not verified here like it normally would be when calling raftApply().
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+
+	// Consult the interceptor before any state is touched. Any rejection
+	// fails the whole batch so it stays atomic.
+	if s.Interceptor != nil {
+		for _, reg := range regs {
+			if err := s.Interceptor.BeforeAddInstance(reg.Service, reg.Instance); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	// Track heartbeat times and check if any instance has changed.
+	changed := false
+	for _, reg := range regs {
+		s.heartbeats[instanceKey{reg.Service, reg.Instance.ID}] = time.Now()
+		if reg.Instance.TTL > 0 {
+			s.ttls[instanceKey{reg.Service, reg.Instance.ID}] = time.Duration(reg.Instance.TTL) * time.Second
+		} else {
+			delete(s.ttls, instanceKey{reg.Service, reg.Instance.ID})
+		}
+
+		if m := s.data.Instances[reg.Service]; m != nil {
+			if prev := m[reg.Instance.ID]; prev != nil && reg.Instance.Equal(prev) {
+				continue
+			}
+		}
+		changed = true
+	}
+	s.mu.Unlock()
+
+	// Ignore if all instances already exist and haven't changed.
+	if !changed {
+		return nil
+	}
+
+	// Serialize command.
+	cmd, err := json.Marshal(&addInstancesCommand{Registrations: regs, Now: s.Now()})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(addInstancesCommandType, cmd); err != nil {
+		return err
+	}
+	if s.Interceptor != nil {
+		for _, reg := range regs {
+			s.Interceptor.AfterAddInstance(reg.Service, reg.Instance)
+		}
+	}
+	return nil
+}
+
+// AddServiceInstances atomically registers a batch of instances under a
+// single service. The batch is applied under one lock acquisition and
+// batching subscribers receive a single event, rather than one per instance,
+// so schedulers that place dozens of instances at once don't generate a
+// thundering herd of broadcasts.
+func (s *Store) AddServiceInstances(service string, instances []*discoverd.Instance) error {
+	regs := make([]*discoverd.Registration, len(instances))
+	for i, inst := range instances {
+		regs[i] = &discoverd.Registration{Service: service, Instance: inst}
+	}
+	return s.AddInstances(regs)
+}
+
+func (s *Store) applyAddInstancesCommand(cmd []byte, index uint64) error {
+	var c addInstancesCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+
+	// Verify that all services exist and that the batch fits within the
+	// instance limits before mutating anything so it is applied atomically.
+	added := make(map[string]int)
+	for _, reg := range c.Registrations {
+		reg.Service = s.resolveService(reg.Service)
+		if s.data.Services[reg.Service] == nil {
+			return NotFoundError{Service: reg.Service}
+		}
+		if s.data.Frozen[reg.Service] {
+			return ServiceFrozenError(reg.Service)
+		}
+		if err := s.checkInstanceLimits(reg.Service, reg.Instance, added[reg.Service]); err != nil {
+			return err
+		}
+		if err := s.checkRequiredMeta(reg.Service, reg.Instance); err != nil {
+			return err
+		}
+		if s.data.Instances[reg.Service][reg.Instance.ID] == nil {
+			added[reg.Service]++
+		}
+	}
+
+	services := make(map[string]struct{}, len(c.Registrations))
+	events := make([]*discoverd.Event, 0, len(c.Registrations))
+	for _, reg := range c.Registrations {
+		// Copy the instance map once per service so the published read
+		// snapshot is unaffected.
+		if _, ok := services[reg.Service]; !ok {
+			s.data.cowInstances(reg.Service)
+		}
+
+		// Preserve the original index for existing instances.
+		prev := s.data.Instances[reg.Service][reg.Instance.ID]
+		if prev != nil {
+			reg.Instance.Index = prev.Index
+		} else {
+			reg.Instance.Index = s.reclaimIndex(reg.Service, reg.Instance, c.Now, index)
+		}
+
+		// Check if the existing instance is being updated.
+		updating := prev != nil && !reg.Instance.Equal(prev)
+
+		// Carry the lifecycle state over on unchanged re-registrations; an
+		// updated registration revives a draining instance.
+		if prev != nil && !updating {
+			reg.Instance.State = prev.State
+		}
+
+		// Carry health data published by the checker across
+		// re-registrations.
+		if prev != nil && reg.Instance.HealthInfo == nil {
+			reg.Instance.HealthInfo = prev.HealthInfo
+		}
+
+		// Update entry.
+		s.data.Instances[reg.Service][reg.Instance.ID] = reg.Instance
+
+		// Collect "up" event if new instance, "update" if changed.
+		if prev == nil {
+			events = append(events, &discoverd.Event{
+				Service:  reg.Service,
+				Kind:     discoverd.EventKindUp,
+				Instance: reg.Instance,
+			})
+		} else if updating {
+			events = append(events, &discoverd.Event{
+				Service:  reg.Service,
+				Kind:     discoverd.EventKindUpdate,
+				Instance: reg.Instance,
+				Changed:  instanceChanges(prev, reg.Instance),
+			})
+		}
+
+		services[reg.Service] = struct{}{}
+	}
+
+	// Broadcast the batch as one atomic change.
+	s.broadcastBatch(events)
+
+	// Update service leaders, if necessary.
+	for service := range services {
+		s.invalidateServiceLeader(service)
+	}
+
+	return nil
+}
+
+// Transaction op names.
+const (
+	TxOpAddInstance    = "add_instance"
+	TxOpRemoveInstance = "remove_instance"
+	TxOpSetLeader      = "set_leader"
+)
+
+// TxOp is a single operation in an atomic transaction. Op determines which
+// of the remaining fields are used: "add_instance" registers Instance under
+// Service, "remove_instance" deregisters the instance with the given ID and
+// "set_leader" assigns leadership to it.
+type TxOp struct {
+	Op       string              `json:"op"`
+	Service  string              `json:"service"`
+	ID       string              `json:"id,omitempty"`
+	Instance *discoverd.Instance `json:"instance,omitempty"`
+}
+
+// Transact applies a set of mutations, which may span multiple services,
+// atomically: either all of the operations are applied or none are, and
+// batching subscribers receive the resulting events together, so deploy
+// tooling migrating instances between services can't leave the state
+// half-migrated.
+func (s *Store) Transact(ops []*TxOp) error {
+	// Verify the operations are well formed before proposing them.
+	for _, op := range ops {
+		switch op.Op {
+		case TxOpAddInstance:
+			if op.Instance == nil {
+				return fmt.Errorf("discoverd: transaction op %q requires an instance", op.Op)
+			}
+		case TxOpRemoveInstance, TxOpSetLeader:
+			if op.ID == "" {
+				return fmt.Errorf("discoverd: transaction op %q requires an instance id", op.Op)
+			}
+		default:
+			return fmt.Errorf("discoverd: invalid transaction op %q", op.Op)
+		}
+	}
+
+	// Consult the interceptor before proposing. Any rejection fails the
+	// whole transaction so it stays atomic.
+	if s.Interceptor != nil {
+		for _, op := range ops {
+			var err error
+			switch op.Op {
+			case TxOpAddInstance:
+				err = s.Interceptor.BeforeAddInstance(op.Service, op.Instance)
+			case TxOpRemoveInstance:
+				err = s.Interceptor.BeforeRemoveInstance(op.Service, op.ID)
+			case TxOpSetLeader:
+				err = s.Interceptor.BeforeSetLeader(op.Service, op.ID)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Serialize command.
+	cmd, err := json.Marshal(&transactionCommand{Ops: ops, Now: s.Now()})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(transactionCommandType, cmd); err != nil {
+		return err
+	}
+	if s.Interceptor != nil {
+		for _, op := range ops {
+			switch op.Op {
+			case TxOpAddInstance:
+				s.Interceptor.AfterAddInstance(op.Service, op.Instance)
+			case TxOpRemoveInstance:
+				s.Interceptor.AfterRemoveInstance(op.Service, op.ID)
+			case TxOpSetLeader:
+				s.Interceptor.AfterSetLeader(op.Service, op.ID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) applyTransactionCommand(cmd []byte, index uint64) error {
+	var c transactionCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+
+	// Verify that every operation can be applied before mutating anything
+	// so the transaction is applied atomically.
+	added := make(map[string]int)
+	for _, op := range c.Ops {
+		op.Service = s.resolveService(op.Service)
+		if s.data.Services[op.Service] == nil {
+			return NotFoundError{Service: op.Service}
+		}
+		if s.data.Frozen[op.Service] {
+			return ServiceFrozenError(op.Service)
+		}
+		if op.Op == TxOpAddInstance {
+			if err := s.checkInstanceLimits(op.Service, op.Instance, added[op.Service]); err != nil {
+				return err
+			}
+			if err := s.checkRequiredMeta(op.Service, op.Instance); err != nil {
+				return err
+			}
+			if s.data.Instances[op.Service][op.Instance.ID] == nil {
+				added[op.Service]++
+			}
+		}
+		if op.Op == TxOpRemoveInstance {
+			if m := s.data.Instances[op.Service]; m == nil || m[op.ID] == nil {
+				return NotFoundError{Service: op.Service, Instance: op.ID}
+			}
+		}
+	}
+
+	// Apply the operations in order, collecting their events.
+	services := make(map[string]struct{}, len(c.Ops))
+	assigned := make(map[string]struct{})
+	events := make([]*discoverd.Event, 0, len(c.Ops))
+	for _, op := range c.Ops {
+		// Copy the instance map once per service so the published read
+		// snapshot is unaffected.
+		if _, ok := services[op.Service]; !ok {
+			s.data.cowInstances(op.Service)
+		}
+
+		switch op.Op {
+		case TxOpAddInstance:
+			// Preserve the original index for existing instances.
+			prev := s.data.Instances[op.Service][op.Instance.ID]
+			if prev != nil {
+				op.Instance.Index = prev.Index
+			} else {
+				op.Instance.Index = s.reclaimIndex(op.Service, op.Instance, c.Now, index)
+			}
+
+			// Check if the existing instance is being updated.
+			updating := prev != nil && !op.Instance.Equal(prev)
+
+			// Carry the lifecycle state over on unchanged
+			// re-registrations.
+			if prev != nil && !updating {
+				op.Instance.State = prev.State
+			}
+
+			// Carry health data published by the checker across
+			// re-registrations.
+			if prev != nil && op.Instance.HealthInfo == nil {
+				op.Instance.HealthInfo = prev.HealthInfo
+			}
+
+			// Update entry.
+			s.data.Instances[op.Service][op.Instance.ID] = op.Instance
+
+			// Collect "up" event if new instance, "update" if changed.
+			if prev == nil {
+				events = append(events, &discoverd.Event{
+					Service:  op.Service,
+					Kind:     discoverd.EventKindUp,
+					Instance: op.Instance,
+				})
+			} else if updating {
+				events = append(events, &discoverd.Event{
+					Service:  op.Service,
+					Kind:     discoverd.EventKindUpdate,
+					Instance: op.Instance,
+					Changed:  instanceChanges(prev, op.Instance),
+				})
+			}
+		case TxOpRemoveInstance:
+			inst := s.data.Instances[op.Service][op.ID]
+			delete(s.data.Instances[op.Service], op.ID)
+			s.data.setUnhealthy(op.Service, op.ID, false)
+			delete(s.heartbeats, instanceKey{op.Service, op.ID})
+			delete(s.ttls, instanceKey{op.Service, op.ID})
+
+			// Leave a tombstone behind so a quick identical
+			// re-registration can reclaim its index, and record
+			// the departure in the service history.
+			if inst != nil {
+				s.entomb(op.Service, inst, c.Now)
+				s.recordDeparture(op.Service, inst, DepartureReasonDeregistered, c.Now)
+				events = append(events, &discoverd.Event{
+					Service:  op.Service,
+					Kind:     discoverd.EventKindDown,
+					Instance: inst,
+					Reason:   downReason(inst, discoverd.DownReasonDeregistered),
+				})
+				// Notify watchers if this vacated a manually
+				// elected leadership, or start the minimum
+				// leadership hold if it vacated an elected one.
+				if event := s.clearManualLeader(op.Service, op.ID); event != nil {
+					events = append(events, event)
+				}
+				s.holdLeaderElection(op.Service, op.ID, c.Now)
+			}
+		case TxOpSetLeader:
+			// Issue a fencing token if this establishes a new
+			// leadership.
+			if s.data.Leaders[op.Service] != op.ID {
+				s.data.LeaderTokens[op.Service] = s.applyIndex
+			}
+			s.data.Leaders[op.Service] = op.ID
+			assigned[op.Service] = struct{}{}
+
+			if inst := s.data.Instances[op.Service][op.ID]; inst != nil {
+				events = append(events, &discoverd.Event{
+					Service:     op.Service,
+					Kind:        discoverd.EventKindLeader,
+					Instance:    inst,
+					LeaderToken: s.data.LeaderTokens[op.Service],
+				})
+			}
+		}
+
+		services[op.Service] = struct{}{}
+	}
+
+	// Broadcast the batch as one atomic change.
+	s.broadcastBatch(events)
+
+	// Update service leaders, skipping services the transaction explicitly
+	// assigned a leader to.
+	for service := range services {
+		if _, ok := assigned[service]; ok {
+			continue
+		}
+		s.invalidateServiceLeader(service)
+	}
+
+	return nil
+}
+
+// Heartbeat renews the lease on an instance without rewriting it through
+// raft. Instances that stop renewing are removed by the expirer and a down
+// event is broadcast.
+func (s *Store) Heartbeat(service, id string) error {
+	// Check if it's the leader.
+	// This check is needed because the heartbeats don't go through raft so
+	// it is not verified here like it normally would be when calling raftApply().
+	if !s.IsLeader() {
+		return ErrNotLeader
+	}
+
+	// Chaos mode simulates lost heartbeat packets.
+	if c := s.Chaos; c != nil && c.dropHeartbeat() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Resolve any alias so heartbeats are tracked under the real name.
+	service = s.resolveService(service)
+
+	// Verify the instance exists.
+	if s.data.Services[service] == nil {
+		return NotFoundError{Service: service}
+	} else if m := s.data.Instances[service]; m == nil || m[id] == nil {
+		return NotFoundError{Service: service, Instance: id}
+	}
+
+	s.heartbeats[instanceKey{service, id}] = time.Now()
+	return nil
+}
+
+// SetInstanceHealth marks an instance as healthy or unhealthy. Unhealthy
+// instances are excluded from instance lists and leader election until they
+// are marked healthy again.
+func (s *Store) SetInstanceHealth(service, id string, healthy bool) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&setInstanceHealthCommand{
+		Service: service,
+		ID:      id,
+		Healthy: healthy,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(setInstanceHealthCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applySetInstanceHealthCommand(cmd []byte) error {
+	var c setInstanceHealthCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the instance exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+	inst := s.data.Instances[c.Service][c.ID]
+	if inst == nil {
+		return NotFoundError{Service: c.Service, Instance: c.ID}
+	}
+
+	// Ignore if the health state hasn't changed.
+	if s.data.Unhealthy[c.Service][c.ID] == !c.Healthy {
+		return nil
+	}
+	s.data.setUnhealthy(c.Service, c.ID, !c.Healthy)
+
+	// Broadcast event.
+	kind := discoverd.EventKindHealthy
+	if !c.Healthy {
+		kind = discoverd.EventKindUnhealthy
+	}
+	s.broadcast(&discoverd.Event{
+		Service:  c.Service,
+		Kind:     kind,
+		Instance: inst,
+	})
+
+	// Move leadership off (or back onto) the instance, if necessary.
+	s.invalidateServiceLeader(c.Service)
+
+	return nil
+}
+
+// Drain marks an instance as draining so that routers stop sending it new
+// connections before it deregisters. Draining instances are excluded from
+// instance lists and leader election but keep heartbeating until they are
+// removed.
+func (s *Store) Drain(service, id string) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&drainInstanceCommand{
+		Service: service,
+		ID:      id,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(drainInstanceCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applyDrainInstanceCommand(cmd []byte) error {
+	var c drainInstanceCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the instance exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+	inst := s.data.Instances[c.Service][c.ID]
+	if inst == nil {
+		return NotFoundError{Service: c.Service, Instance: c.ID}
+	}
+
+	// Ignore if the instance is already draining.
+	if inst.State == discoverd.InstanceStateDraining {
+		return nil
+	}
+
+	// Replace the instance with a draining copy so the published read
+	// snapshot is unaffected.
+	m := s.data.cowInstances(c.Service)
+	other := *inst
+	other.State = discoverd.InstanceStateDraining
+	m[c.ID] = &other
+
+	// Broadcast event.
+	s.broadcast(&discoverd.Event{
+		Service:  c.Service,
+		Kind:     discoverd.EventKindDraining,
+		Instance: &other,
+	})
+
+	// Move leadership off the instance, if necessary.
+	s.invalidateServiceLeader(c.Service)
+
+	return nil
+}
+
+// SetMaintenance marks an instance as in maintenance, or clears the mark.
+// An instance in maintenance stays registered, keeping its metadata and
+// index, but is excluded from instance lists, DNS answers and leader
+// election, so operators can temporarily pull a node without losing its
+// registration.
+func (s *Store) SetMaintenance(service, id string, maintenance bool) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&setMaintenanceCommand{
+		Service:     service,
+		ID:          id,
+		Maintenance: maintenance,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(setMaintenanceCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applySetMaintenanceCommand(cmd []byte) error {
+	var c setMaintenanceCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the instance exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+	inst := s.data.Instances[c.Service][c.ID]
+	if inst == nil {
+		return NotFoundError{Service: c.Service, Instance: c.ID}
+	}
+
+	// Ignore if the state is unchanged. Clearing only applies to instances
+	// in maintenance so it cannot cancel a drain.
+	if c.Maintenance && inst.State == discoverd.InstanceStateMaintenance {
+		return nil
+	} else if !c.Maintenance && inst.State != discoverd.InstanceStateMaintenance {
+		return nil
+	}
+
+	// Replace the instance with an updated copy so the published read
+	// snapshot is unaffected.
+	m := s.data.cowInstances(c.Service)
+	other := *inst
+	if c.Maintenance {
+		other.State = discoverd.InstanceStateMaintenance
+	} else {
+		other.State = discoverd.InstanceStateUp
+	}
+	m[c.ID] = &other
+
+	// Broadcast event.
+	s.broadcast(&discoverd.Event{
+		Service:  c.Service,
+		Kind:     discoverd.EventKindMaintenance,
+		Instance: &other,
+	})
+
+	// Move leadership off (or back onto) the instance, if necessary.
+	s.invalidateServiceLeader(c.Service)
+
+	return nil
+}
+
+// outOfRotation reports whether an instance should be excluded from
+// instance lists, DNS answers and leader election.
+func outOfRotation(inst *discoverd.Instance) bool {
+	return inst.State == discoverd.InstanceStateDraining || inst.State == discoverd.InstanceStateMaintenance
+}
+
+// UpdateMeta replaces the metadata of an existing instance, but only if the
+// instance's Index still equals expectedIndex. This lets writers change
+// metadata without re-registering the full instance, while a stale index
+// detects that the instance expired and re-registered in the meantime.
+func (s *Store) UpdateMeta(service, id string, meta map[string]string, expectedIndex uint64) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&updateInstanceMetaCommand{
+		Service:       service,
+		ID:            id,
+		Meta:          meta,
+		ExpectedIndex: expectedIndex,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(updateInstanceMetaCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applyUpdateInstanceMetaCommand(cmd []byte) error {
+	var c updateInstanceMetaCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the instance exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+	inst := s.data.Instances[c.Service][c.ID]
+	if inst == nil {
+		return NotFoundError{Service: c.Service, Instance: c.ID}
+	}
+
+	// Reject the update if the instance has been replaced since the writer
+	// last read it.
+	if inst.Index != c.ExpectedIndex {
+		return hh.PreconditionFailedErr(fmt.Sprintf("Instance %q has index %d, but index %d provided", c.ID, inst.Index, c.ExpectedIndex))
+	}
+
+	// Ignore if the metadata hasn't changed.
+	if mapsEqual(inst.Meta, c.Meta) {
+		return nil
+	}
+
+	// Replace the instance with an updated copy so the published read
+	// snapshot is unaffected.
+	m := s.data.cowInstances(c.Service)
+	other := *inst
+	other.Meta = c.Meta
+	m[c.ID] = &other
+
+	// Broadcast event.
+	s.broadcast(&discoverd.Event{
+		Service:  c.Service,
+		Kind:     discoverd.EventKindUpdate,
+		Instance: &other,
+		Changed:  []string{"meta"},
+	})
+
+	return nil
+}
+
+// instanceChanges lists which fields of an instance differ from its previous
+// registration, for the Changed field of "update" events.
+func instanceChanges(prev, next *discoverd.Instance) []string {
+	var changed []string
+	if next.Addr != prev.Addr {
+		changed = append(changed, "addr")
+	}
+	if next.AdvertiseAddr != prev.AdvertiseAddr {
+		changed = append(changed, "advertise_addr")
+	}
+	if next.Proto != prev.Proto {
+		changed = append(changed, "proto")
+	}
+	if next.Weight != prev.Weight {
+		changed = append(changed, "weight")
+	}
+	if next.Zone != prev.Zone {
+		changed = append(changed, "zone")
+	}
+	if !mapsEqual(prev.Meta, next.Meta) {
+		changed = append(changed, "meta")
+	}
+	if !annotationsEqual(prev.Annotations, next.Annotations) {
+		changed = append(changed, "annotations")
+	}
+	return changed
+}
+
+func annotationsEqual(x, y map[string][]byte) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for k, v := range x {
+		if yv, ok := y[k]; !ok || !bytes.Equal(yv, v) {
+			return false
+		}
+	}
+	return true
+}
+
+func mapsEqual(x, y map[string]string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for k, v := range x {
+		if yv, ok := y[k]; !ok || yv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) RemoveInstance(service, id string) error {
+	// Consult the interceptor before proposing the removal.
+	if s.Interceptor != nil {
+		if err := s.Interceptor.BeforeRemoveInstance(service, id); err != nil {
+			return err
+		}
+	}
+
+	// Serialize command.
+	cmd, err := json.Marshal(&removeInstanceCommand{
+		Service: service,
+		ID:      id,
+		Now:     s.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(removeInstanceCommandType, cmd); err != nil {
+		return err
+	}
+	if s.Interceptor != nil {
+		s.Interceptor.AfterRemoveInstance(service, id)
+	}
+	return nil
+}
+
+// entomb records a departed instance so an identical re-registration within
+// the TombstoneGrace window can reclaim its Index, and prunes tombstones for
+// the service that have outlived the window. Must be called under mutex.
+func (s *Store) entomb(service string, inst *discoverd.Instance, now time.Time) {
+	if s.TombstoneGrace <= 0 || now.IsZero() {
+		return
+	}
+
+	// Copy the tombstone map so the published read snapshot is unaffected,
+	// dropping entries that have outlived the grace window.
+	m := make(map[string]*tombstone, len(s.data.Tombstones[service])+1)
+	for id, ts := range s.data.Tombstones[service] {
+		if now.Sub(ts.DepartedAt) > s.TombstoneGrace {
+			continue
+		}
+		m[id] = ts
+	}
+	m[inst.ID] = &tombstone{Instance: inst, DepartedAt: now}
+
+	if s.data.Tombstones == nil {
+		s.data.Tombstones = make(map[string]map[string]*tombstone)
+	}
+	s.data.Tombstones[service] = m
+}
+
+// reclaimIndex returns the Index a registering instance should adopt: its
+// previous Index if an identical instance departed within the TombstoneGrace
+// window, or logIndex for a fresh registration. Any tombstone for the
+// instance is consumed either way. Must be called under mutex.
+func (s *Store) reclaimIndex(service string, inst *discoverd.Instance, now time.Time, logIndex uint64) uint64 {
+	ts := s.data.Tombstones[service][inst.ID]
+	if ts == nil {
+		return logIndex
+	}
+	s.data.removeTombstone(service, inst.ID)
+
+	if s.TombstoneGrace <= 0 || now.IsZero() || now.Sub(ts.DepartedAt) > s.TombstoneGrace {
+		return logIndex
+	}
+	if !inst.Equal(ts.Instance) {
+		return logIndex
+	}
+	return ts.Instance.Index
+}
+
+func (s *Store) applyRemoveInstanceCommand(cmd []byte) error {
+	var c removeInstanceCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the service exists.
+	if s.data.Instances[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+
+	// Reject writes to frozen services.
+	if s.data.Frozen[c.Service] {
+		return ServiceFrozenError(c.Service)
+	}
+
+	// Remove instance data, copying the instance map so the published read
+	// snapshot is unaffected.
+	m := s.data.cowInstances(c.Service)
+	inst := m[c.ID]
+	delete(m, c.ID)
+	s.data.setUnhealthy(c.Service, c.ID, false)
+	delete(s.heartbeats, instanceKey{c.Service, c.ID})
+	delete(s.ttls, instanceKey{c.Service, c.ID})
+
+	// Leave a tombstone behind so a quick identical re-registration can
+	// reclaim its index, and record the departure in the service history.
+	if inst != nil {
+		s.entomb(c.Service, inst, c.Now)
+		s.recordDeparture(c.Service, inst, DepartureReasonDeregistered, c.Now)
+	}
+
+	// Broadcast "down" event for instance, unless the instance is flapping
+	// and its events are damped.
+	if inst != nil && !s.suppressFlap(c.Service, c.ID, discoverd.EventKindDown, c.Now) {
+		s.broadcast(&discoverd.Event{
+			Service:  c.Service,
+			Kind:     discoverd.EventKindDown,
+			Instance: inst,
+			Reason:   downReason(inst, discoverd.DownReasonDeregistered),
+		})
+	}
+
+	// Notify watchers if this vacated a manually elected leadership, or
+	// start the minimum leadership hold if it vacated an elected one.
+	if inst != nil {
+		if event := s.clearManualLeader(c.Service, c.ID); event != nil {
+			s.broadcast(event)
+		}
+		s.holdLeaderElection(c.Service, c.ID, c.Now)
+	}
 
 	// Invalidate service leadership.
 	s.invalidateServiceLeader(c.Service)
@@ -624,9 +2422,13 @@ func (s *Store) ServiceMeta(service string) *discoverd.ServiceMeta {
 }
 
 func (s *Store) serviceMeta(service string) *discoverd.ServiceMeta {
-	return s.data.Metas[service]
+	return s.data.Metas[s.resolveService(service)]
 }
 
+// SetServiceMeta updates the meta data for a service using compare-and-swap
+// semantics: the update only applies if meta.Index matches the current index
+// (zero to create). On success the new index is written back to meta and a
+// "service meta" event is broadcast.
 func (s *Store) SetServiceMeta(service string, meta *discoverd.ServiceMeta) error {
 	// Serialize command.
 	cmd, err := json.Marshal(&setServiceMetaCommand{
@@ -651,6 +2453,7 @@ func (s *Store) applySetServiceMetaCommand(cmd []byte, index uint64) error {
 	if err := json.Unmarshal(cmd, &c); err != nil {
 		return err
 	}
+	c.Service = s.resolveService(c.Service)
 
 	// Verify that the service exists.
 	service := s.data.Services[c.Service]
@@ -680,7 +2483,11 @@ func (s *Store) applySetServiceMetaCommand(cmd []byte, index uint64) error {
 	s.data.Metas[c.Service] = c.Meta
 
 	if leaderID != "" {
-		// If a new leader was included in the meta update, apply it
+		// If a new leader was included in the meta update, apply it and
+		// issue a fencing token if the leadership changed.
+		if s.data.Leaders[c.Service] != leaderID {
+			s.data.LeaderTokens[c.Service] = s.applyIndex
+		}
 		s.data.Leaders[c.Service] = leaderID
 	}
 
@@ -695,9 +2502,10 @@ func (s *Store) applySetServiceMetaCommand(cmd []byte, index uint64) error {
 		// Broadcast leader update, if the new instance exists
 		if inst := s.data.Instances[c.Service][leaderID]; inst != nil {
 			s.broadcast(&discoverd.Event{
-				Service:  c.Service,
-				Kind:     discoverd.EventKindLeader,
-				Instance: inst,
+				Service:     c.Service,
+				Kind:        discoverd.EventKindLeader,
+				Instance:    inst,
+				LeaderToken: s.data.LeaderTokens[c.Service],
 			})
 		}
 	}
@@ -707,6 +2515,20 @@ func (s *Store) applySetServiceMetaCommand(cmd []byte, index uint64) error {
 
 // SetServiceLeader manually sets the leader for a service.
 func (s *Store) SetServiceLeader(service, id string) error {
+	// Consult the interceptor before proposing the leader change.
+	if s.Interceptor != nil {
+		if err := s.Interceptor.BeforeSetLeader(service, id); err != nil {
+			return err
+		}
+	}
+
+	// Skip the raft proposal if the instance already leads the service, so
+	// periodic full-sync callers don't re-broadcast leader events. Frozen
+	// services still go through raft to be rejected there.
+	if d := s.readData(); d.Leaders[d.resolve(service)] == id && !d.Frozen[d.resolve(service)] {
+		return nil
+	}
+
 	// Serialize command.
 	cmd, err := json.Marshal(&setLeaderCommand{
 		Service: service,
@@ -719,6 +2541,9 @@ func (s *Store) SetServiceLeader(service, id string) error {
 	if _, err := s.raftApply(setLeaderCommandType, cmd); err != nil {
 		return err
 	}
+	if s.Interceptor != nil {
+		s.Interceptor.AfterSetLeader(service, id)
+	}
 	return nil
 }
 
@@ -727,28 +2552,148 @@ func (s *Store) applySetLeaderCommand(cmd []byte) error {
 	if err := json.Unmarshal(cmd, &c); err != nil {
 		return err
 	}
+	c.Service = s.resolveService(c.Service)
+
+	// Reject writes to frozen services.
+	if s.data.Frozen[c.Service] {
+		return ServiceFrozenError(c.Service)
+	}
+
+	// A replay of the current leader changes nothing and broadcasts no
+	// event.
+	if s.data.Leaders[c.Service] == c.ID {
+		return nil
+	}
 
+	// Issue a fencing token for the new leadership.
+	s.data.LeaderTokens[c.Service] = s.applyIndex
 	s.data.Leaders[c.Service] = c.ID
 
 	// Notify new leadership.
 	if inst := s.data.Instances[c.Service][c.ID]; inst != nil {
 		s.broadcast(&discoverd.Event{
-			Service:  c.Service,
-			Kind:     discoverd.EventKindLeader,
-			Instance: inst,
+			Service:     c.Service,
+			Kind:        discoverd.EventKindLeader,
+			Instance:    inst,
+			LeaderToken: s.data.LeaderTokens[c.Service],
 		})
 	}
 
 	return nil
 }
 
+// FailoverServiceLeader demotes the current leader of service and promotes
+// the instance with the given ID, or the next-oldest healthy, non-draining
+// instance if id is empty, so operators can drain a leader for maintenance
+// without killing it. For services with oldest-leader election the forced
+// leader holds until membership next changes, so it is usually combined
+// with draining the old leader.
+func (s *Store) FailoverServiceLeader(service, id string) error {
+	// Serialize command.
+	cmd, err := json.Marshal(&failoverLeaderCommand{
+		Service: service,
+		ID:      id,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(failoverLeaderCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applyFailoverLeaderCommand(cmd []byte) error {
+	var c failoverLeaderCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+	c.Service = s.resolveService(c.Service)
+
+	// Verify that the service exists.
+	if s.data.Services[c.Service] == nil {
+		return NotFoundError{Service: c.Service}
+	}
+
+	// Reject writes to frozen services.
+	if s.data.Frozen[c.Service] {
+		return ServiceFrozenError(c.Service)
+	}
+
+	// Find the new leader: the requested instance, or the next-oldest
+	// healthy, non-draining instance excluding the current leader.
+	prevLeaderID := s.data.Leaders[c.Service]
+	var leader *discoverd.Instance
+	if c.ID != "" {
+		leader = s.data.Instances[c.Service][c.ID]
+		if leader == nil {
+			return NotFoundError{Service: c.Service, Instance: c.ID}
+		}
+	} else {
+		for _, inst := range s.data.Instances[c.Service] {
+			if inst.ID == prevLeaderID || s.data.Unhealthy[c.Service][inst.ID] || outOfRotation(inst) {
+				continue
+			}
+			if leader == nil || inst.Index < leader.Index {
+				leader = inst
+			}
+		}
+		if leader == nil {
+			return hh.PreconditionFailedErr(fmt.Sprintf("discoverd: no failover candidate for %q", c.Service))
+		}
+	}
+
+	// Ignore if leadership is unchanged.
+	if leader.ID == prevLeaderID {
+		return nil
+	}
+
+	// Promote, issuing a fencing token for the new leadership and lifting
+	// any pending leadership hold since the failover is explicit.
+	s.data.Leaders[c.Service] = leader.ID
+	s.data.LeaderTokens[c.Service] = s.applyIndex
+	delete(s.data.LeaderHolds, c.Service)
+
+	// Broadcast event.
+	s.broadcast(&discoverd.Event{
+		Service:     c.Service,
+		Kind:        discoverd.EventKindLeader,
+		Instance:    leader,
+		LeaderToken: s.data.LeaderTokens[c.Service],
+	})
+
+	return nil
+}
+
+// LeaderToken returns the fencing token issued for the current leadership of
+// service, or zero if the service has no leader. Tokens are raft log indexes,
+// so a token from a newer leadership always compares greater and downstream
+// systems can reject writes carrying a stale token after a split brain.
+func (s *Store) LeaderToken(service string) uint64 {
+	d := s.readData()
+	return d.LeaderTokens[d.resolve(service)]
+}
+
 func (s *Store) ServiceLeader(service string) (*discoverd.Instance, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.serviceLeader(service), nil
+	// Resolve any alias to the real service name.
+	d := s.readData()
+	service = d.resolve(service)
+
+	// Ignore if there are no instances on the service.
+	m := d.Instances[service]
+	if m == nil {
+		return nil, nil
+	}
+
+	// Return instance specified by the leader id.
+	return m[d.Leaders[service]], nil
 }
 
 func (s *Store) serviceLeader(service string) *discoverd.Instance {
+	// Resolve any alias to the real service name.
+	service = s.resolveService(service)
+
 	// Find instance ID of the leader.
 	instanceID := s.data.Leaders[service]
 
@@ -765,26 +2710,83 @@ func (s *Store) serviceLeader(service string) *discoverd.Instance {
 	return m[instanceID]
 }
 
+// clearManualLeader clears a manually elected leadership after its leader
+// instance has been removed, returning a "leader" event with no instance so
+// watchers learn the leadership is vacant instead of acting on a stale
+// leader. It returns nil if the service elects leaders automatically or id
+// was not the leader; automatically elected services broadcast their own
+// vacancy event from invalidateServiceLeader.
+// Must be called under mutex.
+func (s *Store) clearManualLeader(service, id string) *discoverd.Event {
+	if id == "" || s.data.Leaders[service] != id {
+		return nil
+	}
+	if leaderPicker(s.data.Services[service]) != nil {
+		return nil
+	}
+	s.data.Leaders[service] = ""
+	delete(s.data.LeaderTokens, service)
+	return &discoverd.Event{
+		Service: service,
+		Kind:    discoverd.EventKindLeader,
+	}
+}
+
+// holdLeaderElection starts the minimum leadership hold when the departing
+// instance id is the elected leader of service, so a replacement is only
+// elected once the grace period passes without the old leader returning.
+// Must be called under mutex, before the leadership is invalidated.
+func (s *Store) holdLeaderElection(service, id string, now time.Time) {
+	if s.LeaderHoldTime <= 0 || now.IsZero() {
+		return
+	}
+	if id == "" || s.data.Leaders[service] != id {
+		return
+	}
+	if leaderPicker(s.data.Services[service]) == nil {
+		return
+	}
+	if s.data.LeaderHolds == nil {
+		s.data.LeaderHolds = make(map[string]time.Time)
+	}
+	s.data.LeaderHolds[service] = now
+}
+
 // invalidateServiceLeader updates the current leader of service.
 func (s *Store) invalidateServiceLeader(service string) {
-	// Retrieve service config.
-	c := s.data.Services[service]
-
-	// Ignore if there is no config or the leader is manually elected.
-	if c == nil || c.LeaderType == discoverd.LeaderTypeManual {
+	// Retrieve the picker for the service's leader type. There is none if
+	// the leader is manually elected or leader election is disabled.
+	config := s.data.Services[service]
+	picker := leaderPicker(config)
+	if picker == nil {
 		return
 	}
 
+	// Defer the election while a minimum leadership hold is pending: the
+	// departed leader keeps the leadership reserved until the grace period
+	// passes or it returns.
+	if _, ok := s.data.LeaderHolds[service]; ok {
+		prev := s.data.Leaders[service]
+		inst := s.data.Instances[service][prev]
+		if inst == nil || s.data.Unhealthy[service][prev] || outOfRotation(inst) {
+			return
+		}
+		// The leader returned; lift the hold and re-elect normally.
+		delete(s.data.LeaderHolds, service)
+	}
+
 	// Retrieve current leader ID.
 	prevLeaderID := s.data.Leaders[service]
 
-	// Find the oldest, non-expired instance.
-	var leader *discoverd.Instance
+	// Elect a leader from the non-expired, healthy, in-rotation instances.
+	candidates := make([]*discoverd.Instance, 0, len(s.data.Instances[service]))
 	for _, inst := range s.data.Instances[service] {
-		if leader == nil || inst.Index < leader.Index {
-			leader = inst
+		if s.data.Unhealthy[service][inst.ID] || outOfRotation(inst) {
+			continue
 		}
+		candidates = append(candidates, inst)
 	}
+	leader := picker.PickLeader(candidates)
 
 	// Retrieve the leader ID.
 	var leaderID string
@@ -802,12 +2804,88 @@ func (s *Store) invalidateServiceLeader(service string) {
 			inst = s.data.Instances[service][leaderID]
 		}
 
+		// Issue a fencing token for the new leadership so downstream
+		// systems can reject writes from deposed leaders.
+		if leaderID == "" {
+			delete(s.data.LeaderTokens, service)
+		} else {
+			s.data.LeaderTokens[service] = s.applyIndex
+		}
+
+		s.broadcast(&discoverd.Event{
+			Service:     service,
+			Kind:        discoverd.EventKindLeader,
+			Instance:    inst,
+			LeaderToken: s.data.LeaderTokens[service],
+		})
+	}
+
+	// Additionally elect a leader per protocol, if enabled.
+	if config.LeaderPerProto {
+		s.invalidateProtoLeaders(service, picker, candidates)
+	}
+}
+
+// invalidateProtoLeaders elects a leader for each protocol registered by the
+// candidate instances and broadcasts a "leader" event, carrying the proto,
+// for every protocol whose leader changed.
+func (s *Store) invalidateProtoLeaders(service string, picker LeaderPicker, candidates []*discoverd.Instance) {
+	byProto := make(map[string][]*discoverd.Instance)
+	for _, inst := range candidates {
+		byProto[inst.Proto] = append(byProto[inst.Proto], inst)
+	}
+
+	// Build a fresh leader map so published read snapshots are unaffected.
+	prev := s.data.ProtoLeaders[service]
+	next := make(map[string]string, len(byProto))
+	for proto, insts := range byProto {
+		if leader := picker.PickLeader(insts); leader != nil {
+			next[proto] = leader.ID
+		}
+	}
+	if len(next) == 0 {
+		delete(s.data.ProtoLeaders, service)
+	} else {
+		s.data.ProtoLeaders[service] = next
+	}
+
+	for proto, id := range next {
+		if prev[proto] == id {
+			continue
+		}
 		s.broadcast(&discoverd.Event{
 			Service:  service,
 			Kind:     discoverd.EventKindLeader,
-			Instance: inst,
+			Proto:    proto,
+			Instance: s.data.Instances[service][id],
 		})
 	}
+
+	// Protocols that lost their last candidate get a leaderless event.
+	for proto := range prev {
+		if _, ok := next[proto]; !ok {
+			s.broadcast(&discoverd.Event{
+				Service: service,
+				Kind:    discoverd.EventKindLeader,
+				Proto:   proto,
+			})
+		}
+	}
+}
+
+// ProtoLeader returns the current leader of a service for one protocol. It
+// returns nil if per-proto leader election is not enabled for the service or
+// the protocol has no leader.
+func (s *Store) ProtoLeader(service, proto string) (*discoverd.Instance, error) {
+	// Resolve any alias to the real service name.
+	d := s.readData()
+	service = d.resolve(service)
+
+	id := d.ProtoLeaders[service][proto]
+	if id == "" {
+		return nil, nil
+	}
+	return d.Instances[service][id], nil
 }
 
 // expirer runs in a separate goroutine and checks for instance expiration.
@@ -829,7 +2907,81 @@ func (s *Store) expirer() {
 		if err := s.EnforceExpiry(); err != nil && err != raft.ErrNotLeader {
 			s.logger.Printf("enforce expiry: %s", err)
 		}
+
+		// Elect replacement leaders for expired leadership holds.
+		if s.LeaderHoldTime > 0 {
+			if err := s.EnforceLeaderHolds(); err != nil && err != raft.ErrNotLeader {
+				s.logger.Printf("enforce leader holds: %s", err)
+			}
+		}
+
+		// Remove services that have been empty past the retention period.
+		if s.ServiceRetention > 0 {
+			if err := s.EnforceServiceGC(); err != nil && err != raft.ErrNotLeader && err != ErrLeaderWait {
+				s.logger.Printf("enforce service gc: %s", err)
+			}
+		}
+	}
+}
+
+// EnforceServiceGC deletes services that have had zero instances and no
+// service meta for at least ServiceRetention.
+// This function returns raft.ErrNotLeader if this store is not the current leader.
+func (s *Store) EnforceServiceGC() error {
+	var services []string
+	if err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Ignore if this store is not the leader and hasn't been for at least the retention period.
+		if !s.IsLeader() {
+			return raft.ErrNotLeader
+		} else if s.leaderTime.IsZero() || time.Since(s.leaderTime) < s.ServiceRetention {
+			return ErrLeaderWait
+		}
+
+		// Track when each service becomes empty and collect the ones that
+		// have been empty past the retention period.
+		now := time.Now()
+		for service := range s.data.Services {
+			if len(s.data.Instances[service]) > 0 || s.data.Metas[service] != nil || s.data.Frozen[service] {
+				delete(s.emptySince, service)
+				continue
+			}
+
+			since, ok := s.emptySince[service]
+			if !ok {
+				s.emptySince[service] = now
+				continue
+			}
+			if now.Sub(since) >= s.ServiceRetention {
+				services = append(services, service)
+			}
+		}
+
+		// Drop tracking for services that no longer exist.
+		for service := range s.emptySince {
+			if s.data.Services[service] == nil {
+				delete(s.emptySince, service)
+			}
+		}
+
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	// Remove the dead services via raft.
+	for _, service := range services {
+		logger.Info("removing empty service",
+			"fn", "EnforceServiceGC",
+			"service", service,
+		)
+		if err := s.RemoveService(service); err != nil && !IsNotFound(err) {
+			return err
+		}
 	}
+	return nil
 }
 
 // EnforceExpiry checks all instances for expiration and issues an expiration command, if necessary.
@@ -848,11 +3000,25 @@ func (s *Store) EnforceExpiry() error {
 		}
 
 		// Iterate over services and then instances.
+		now := s.Now()
 		var instances []expireInstance
 		for service, m := range s.data.Instances {
 			for _, inst := range m {
+				// Instances registered with an absolute deadline expire
+				// once it passes, regardless of heartbeats.
+				deadline := inst.ExpiresAt != nil && now.After(*inst.ExpiresAt)
+
 				// Ignore instances that have heartbeated within the TTL.
-				if t := s.heartbeats[instanceKey{service, inst.ID}]; time.Since(t) <= s.InstanceTTL {
+				// A per-instance TTL overrides the service config TTL,
+				// which overrides the store default.
+				ttl := s.InstanceTTL
+				if c := s.data.Services[service]; c != nil && c.InstanceTTL > 0 {
+					ttl = time.Duration(c.InstanceTTL) * time.Second
+				}
+				if override, ok := s.ttls[instanceKey{service, inst.ID}]; ok {
+					ttl = override
+				}
+				if t := s.heartbeats[instanceKey{service, inst.ID}]; !deadline && time.Since(t) <= ttl {
 					continue
 				}
 
@@ -881,6 +3047,7 @@ func (s *Store) EnforceExpiry() error {
 		// Create command to expire instances.
 		buf, err := json.Marshal(&expireInstancesCommand{
 			Instances: instances,
+			Now:       s.Now(),
 		})
 		if err != nil {
 			return err
@@ -911,11 +3078,22 @@ func (s *Store) applyExpireInstancesCommand(cmd []byte) error {
 	services := make(map[string]struct{})
 	for _, expireInstance := range c.Instances {
 		// Ignore if the service no longers exists.
-		m := s.data.Instances[expireInstance.Service]
-		if m == nil {
+		if s.data.Instances[expireInstance.Service] == nil {
+			continue
+		}
+
+		// Skip frozen services so instances survive while debugging.
+		if s.data.Frozen[expireInstance.Service] {
 			continue
 		}
 
+		// Copy the instance map once per service so the published read
+		// snapshot is unaffected.
+		if _, ok := services[expireInstance.Service]; !ok {
+			s.data.cowInstances(expireInstance.Service)
+		}
+		m := s.data.Instances[expireInstance.Service]
+
 		// Ignore if entry doesn't exist.
 		inst, ok := m[expireInstance.InstanceID]
 		if !ok {
@@ -924,13 +3102,32 @@ func (s *Store) applyExpireInstancesCommand(cmd []byte) error {
 
 		// Remove instance.
 		delete(m, expireInstance.InstanceID)
+		s.data.setUnhealthy(expireInstance.Service, expireInstance.InstanceID, false)
 
-		// Broadcast down event.
-		s.broadcast(&discoverd.Event{
-			Service:  expireInstance.Service,
-			Kind:     discoverd.EventKindDown,
-			Instance: inst,
-		})
+		// Leave a tombstone behind so a quick identical re-registration
+		// can reclaim its index, and record the departure in the
+		// service history.
+		s.entomb(expireInstance.Service, inst, c.Now)
+		s.recordDeparture(expireInstance.Service, inst, DepartureReasonExpired, c.Now)
+
+		// Broadcast down event, unless the instance is flapping and its
+		// events are damped.
+		if !s.suppressFlap(expireInstance.Service, expireInstance.InstanceID, discoverd.EventKindDown, c.Now) {
+			s.broadcast(&discoverd.Event{
+				Service:  expireInstance.Service,
+				Kind:     discoverd.EventKindDown,
+				Instance: inst,
+				Reason:   discoverd.DownReasonExpired,
+			})
+		}
+
+		// Notify watchers if this vacated a manually elected
+		// leadership, or start the minimum leadership hold if it
+		// vacated an elected one.
+		if event := s.clearManualLeader(expireInstance.Service, expireInstance.InstanceID); event != nil {
+			s.broadcast(event)
+		}
+		s.holdLeaderElection(expireInstance.Service, expireInstance.InstanceID, c.Now)
 
 		// Keep track of services invalidated.
 		services[expireInstance.Service] = struct{}{}
@@ -944,11 +3141,81 @@ func (s *Store) applyExpireInstancesCommand(cmd []byte) error {
 	return nil
 }
 
+// EnforceLeaderHolds elects replacement leaders for services whose minimum
+// leadership hold has expired without the old leader returning.
+// This function returns raft.ErrNotLeader if this store is not the current leader.
+func (s *Store) EnforceLeaderHolds() error {
+	var cmd []byte
+	if err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Ignore if this store is not the leader.
+		if !s.IsLeader() {
+			return raft.ErrNotLeader
+		}
+
+		// Collect services whose hold has expired, in a stable order.
+		now := s.Now()
+		var services []string
+		for service, departedAt := range s.data.LeaderHolds {
+			if now.Sub(departedAt) < s.LeaderHoldTime {
+				continue
+			}
+			services = append(services, service)
+		}
+		if len(services) == 0 {
+			return nil
+		}
+		sort.Strings(services)
+
+		buf, err := json.Marshal(&electLeadersCommand{
+			Services: services,
+			Now:      now,
+		})
+		if err != nil {
+			return err
+		}
+		cmd = buf
+
+		return nil
+	}(); err != nil {
+		return err
+	} else if cmd == nil {
+		return nil
+	}
+
+	// Apply command to raft.
+	if _, err := s.raftApply(electLeadersCommandType, cmd); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applyElectLeadersCommand(cmd []byte) error {
+	var c electLeadersCommand
+	if err := json.Unmarshal(cmd, &c); err != nil {
+		return err
+	}
+
+	for _, service := range c.Services {
+		// Skip if the hold was already lifted, such as by the leader
+		// returning after the command was proposed.
+		if _, ok := s.data.LeaderHolds[service]; !ok {
+			continue
+		}
+		delete(s.data.LeaderHolds, service)
+		s.invalidateServiceLeader(service)
+	}
+
+	return nil
+}
+
 // raftApply joins typ and cmd and applies it to raft.
 // This call blocks until the apply completes and returns the error.
 func (s *Store) raftApply(typ byte, cmd []byte) (uint64, error) {
 	s.mu.RLock()
-	if s.raft == nil {
+	if s.raft == nil || s.shuttingDown {
 		s.mu.RUnlock()
 		return 0, ErrShutdown
 	}
@@ -979,9 +3246,23 @@ func (s *Store) Apply(l *raft.Log) interface{} {
 		return errors.New("no log data found")
 	}
 
+	// Replace the data with a copy-on-write clone before applying the
+	// command, and publish the result as the new read snapshot, so queries
+	// can read the previous snapshot without taking the lock.
+	prev := s.data
+	s.data = s.data.clone()
+	defer func() { s.readState.Store(s.data) }()
+
+	// In builds with the "invariant" tag, validate the new state and the
+	// events broadcast by this mutation once the command has been applied.
+	defer s.checkInvariants(prev)
+
 	// Extract the command type and data.
 	typ, cmd := l.Data[0], l.Data[1:]
 
+	// Track the log index so appliers can derive fencing tokens from it.
+	s.applyIndex = l.Index
+
 	// Determine the command type by the first byte.
 	switch typ {
 	case addServiceCommandType:
@@ -994,134 +3275,615 @@ func (s *Store) Apply(l *raft.Log) interface{} {
 		return s.applySetLeaderCommand(cmd)
 	case addInstanceCommandType:
 		return s.applyAddInstanceCommand(cmd, l.Index)
+	case addInstancesCommandType:
+		return s.applyAddInstancesCommand(cmd, l.Index)
 	case removeInstanceCommandType:
 		return s.applyRemoveInstanceCommand(cmd)
 	case expireInstancesCommandType:
 		return s.applyExpireInstancesCommand(cmd)
+	case setServiceFrozenCommandType:
+		return s.applySetServiceFrozenCommand(cmd)
+	case renameServiceCommandType:
+		return s.applyRenameServiceCommand(cmd)
+	case removeAliasCommandType:
+		return s.applyRemoveAliasCommand(cmd)
+	case restoreStateCommandType:
+		return s.applyRestoreStateCommand(cmd)
+	case setServiceConfigCommandType:
+		return s.applySetServiceConfigCommand(cmd)
+	case setInstanceHealthCommandType:
+		return s.applySetInstanceHealthCommand(cmd)
+	case drainInstanceCommandType:
+		return s.applyDrainInstanceCommand(cmd)
+	case updateInstanceMetaCommandType:
+		return s.applyUpdateInstanceMetaCommand(cmd)
+	case failoverLeaderCommandType:
+		return s.applyFailoverLeaderCommand(cmd)
+	case setMaintenanceCommandType:
+		return s.applySetMaintenanceCommand(cmd)
+	case transactionCommandType:
+		return s.applyTransactionCommand(cmd, l.Index)
+	case electLeadersCommandType:
+		return s.applyElectLeadersCommand(cmd)
+	case setHealthInfoCommandType:
+		return s.applySetHealthInfoCommand(cmd)
 	default:
 		return fmt.Errorf("invalid command type: %d", typ)
 	}
 }
 
-// Snapshot implements raft.FSM.
-func (s *Store) Snapshot() (raft.FSMSnapshot, error) {
+// Snapshot implements raft.FSM.
+func (s *Store) Snapshot() (raft.FSMSnapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf, err := json.Marshal(s.data)
+	if err != nil {
+		return nil, err
+	}
+	return &raftSnapshot{data: buf}, nil
+}
+
+// Restore implements raft.FSM.
+func (s *Store) Restore(r io.ReadCloser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := &raftData{}
+	if err := json.NewDecoder(r).Decode(data); err != nil {
+		return err
+	}
+	s.data = data
+	s.readState.Store(s.data)
+	return nil
+}
+
+// SnapshotState returns a serializable dump of all services, instances,
+// leaders and metadata held by the store. The dump can be passed to
+// RestoreState to restore a backup or bootstrap another cluster.
+func (s *Store) SnapshotState() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return json.Marshal(s.data)
+}
+
+// RestoreState atomically replaces the store state with a dump previously
+// returned by SnapshotState. The diff between the old and new state is
+// broadcast to subscribers so watchers converge without resubscribing.
+func (s *Store) RestoreState(data []byte) error {
+	// Validate the dump before submitting it to the log.
+	if err := json.Unmarshal(data, &raftData{}); err != nil {
+		return err
+	}
+
+	if _, err := s.raftApply(restoreStateCommandType, data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) applyRestoreStateCommand(cmd []byte) error {
+	data := newRaftData()
+	if err := json.Unmarshal(cmd, data); err != nil {
+		return err
+	}
+
+	old := s.data
+	s.data = data
+
+	// Refresh heartbeats so restored instances aren't immediately expired.
+	now := time.Now()
+	s.heartbeats = make(map[instanceKey]time.Time)
+	for service, m := range data.Instances {
+		for id := range m {
+			s.heartbeats[instanceKey{service, id}] = now
+		}
+	}
+
+	// Collect the diff so it can be broadcast as one atomic change.
+	events := diffData(old, data)
+
+	s.broadcastBatch(events)
+
+	return nil
+}
+
+// Subscribe creates a subscription to events on a given service.
+//
+// If sendCurrent is true the current state is sent first, terminated by a
+// sentinel "current" event so subscribers can tell where the snapshot ends
+// and live events begin before acting on them.
+func (s *Store) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	return s.SubscribeFiltered(service, sendCurrent, kinds, ch, nil)
+}
+
+// SubscribeFiltered creates a subscription which only receives instance
+// events whose metadata matches the selector. Events without an instance,
+// such as service metadata changes, are always delivered.
+func (s *Store) SubscribeFiltered(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector) stream.Stream {
+	return s.SubscribePriority(service, sendCurrent, kinds, ch, selector, PriorityNormal)
+}
+
+// currentState collects the current instances, leader and metadata of a
+// service, or of every service matching a pattern, as a snapshot of events.
+// The snapshot is streamed to the subscriber outside the mutex by the
+// subscription's drain goroutine, so syncing a huge service only blocks the
+// subscriber's own stream.
+// Must be called under mutex.
+func (s *Store) currentState(service string, kinds discoverd.EventKind, selector Selector) []*discoverd.Event {
+	// A wildcard or glob subscription covers every matching service,
+	// including ones created after subscribing, so send the current state
+	// of all of them.
+	services := []string{service}
+	if isPattern(service) {
+		services = services[:0]
+		for name := range s.data.Services {
+			if ok, _ := path.Match(service, name); ok {
+				services = append(services, name)
+			}
+		}
+		sort.Strings(services)
+	}
+
+	// Collect current instances.
+	var events []*discoverd.Event
+	if kinds.Any(discoverd.EventKindUp) {
+		for _, name := range services {
+			for _, inst := range s.instances(name) {
+				if selector != nil && !selector.Match(inst) {
+					continue
+				}
+				events = append(events, &discoverd.Event{
+					Service:  name,
+					Kind:     discoverd.EventKindUp,
+					Instance: inst,
+				})
+			}
+		}
+	}
+
+	// Collect current leader.
+	if kinds&discoverd.EventKindLeader != 0 {
+		for _, name := range services {
+			if leader := s.serviceLeader(name); leader != nil {
+				events = append(events, &discoverd.Event{
+					Service:     name,
+					Kind:        discoverd.EventKindLeader,
+					Instance:    leader,
+					LeaderToken: s.data.LeaderTokens[s.data.resolve(name)],
+				})
+			}
+		}
+	}
+
+	// Collect current service meta data.
+	if kinds.Any(discoverd.EventKindServiceMeta) {
+		for _, name := range services {
+			if meta := s.serviceMeta(name); meta != nil {
+				events = append(events, &discoverd.Event{
+					Service:     name,
+					Kind:        discoverd.EventKindServiceMeta,
+					ServiceMeta: meta,
+				})
+			}
+		}
+	}
+	return events
+}
+
+// SubscribeMulti creates one subscription covering several named services,
+// delivering their events into a single channel with Service set on each
+// event, so clients tracking a handful of services don't need a channel and
+// goroutine per service. Names may also be patterns, and duplicates are
+// collapsed. If sendCurrent is true the current state of every named
+// service is sent first, terminated by a single "current" event.
+func (s *Store) SubscribeMulti(services []string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Wait for in-flight deliveries so the snapshot sent below is not
+	// followed by replays of events it already reflects.
+	s.flushFanout()
+
+	// Collapse duplicate names, preserving order.
+	names := make([]string, 0, len(services))
+	seen := make(map[string]struct{}, len(services))
+	for _, name := range services {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+
+	// Collect the snapshot of every named service, terminated by a single
+	// "current" event carrying the sequence number of the most recent
+	// broadcast.
+	var snapshot []*discoverd.Event
+	if sendCurrent {
+		for _, name := range names {
+			snapshot = append(snapshot, s.currentState(name, kinds, nil)...)
+		}
+		if kinds.Any(discoverd.EventKindCurrent) {
+			snapshot = append(snapshot, &discoverd.Event{
+				Service:    strings.Join(names, ","),
+				Kind:       discoverd.EventKindCurrent,
+				EventIndex: s.seq,
+			})
+		}
+	}
+
+	return s.addSubscription(names, kinds, ch, nil, false, false, PriorityNormal, snapshot, "")
+}
+
+// SubscribeSince creates a resumable subscription, replaying buffered events
+// with a sequence number greater than sinceIndex before delivering live
+// events. All delivered events carry their sequence number so the client can
+// resume again later. If the requested events have already been evicted from
+// the ring buffer then ErrEventLogTruncated is returned and the client must
+// perform a full resync instead.
+func (s *Store) SubscribeSince(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	buf, err := json.Marshal(s.data)
-	if err != nil {
-		return nil, err
+	// Wait for in-flight deliveries so the replay below is not followed by
+	// duplicates of events already in the ring buffer.
+	s.flushFanout()
+
+	// Verify the requested events are still buffered.
+	if size := uint64(len(s.eventLog)); s.seq > size && sinceIndex < s.seq-size {
+		return nil, ErrEventLogTruncated
 	}
-	return &raftSnapshot{data: buf}, nil
+
+	// Collect the missed events for replay ahead of live deliveries. Events
+	// in the ring buffer are immutable, so only their pointers are copied
+	// under the mutex.
+	var replay []*discoverd.Event
+	for i := sinceIndex + 1; i <= s.seq; i++ {
+		event := s.eventLog[(i-1)%uint64(len(s.eventLog))]
+		if kinds&event.Kind == 0 || !subscriptionMatches(service, event.Service) {
+			continue
+		}
+		replay = append(replay, event)
+	}
+
+	return s.addSubscription([]string{service}, kinds, ch, nil, true, false, PriorityNormal, replay, ""), nil
 }
 
-// Restore implements raft.FSM.
-func (s *Store) Restore(r io.ReadCloser) error {
+// SubscribeBatch creates a subscription which receives the events of a bulk
+// state change, such as a batch registration or a state restore, as a single
+// "batch" event instead of individual sends. Events from other changes are
+// still delivered individually.
+func (s *Store) SubscribeBatch(service string, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.flushFanout()
+	return s.addSubscription([]string{service}, kinds, ch, nil, false, true, PriorityNormal, nil, "")
+}
 
-	data := &raftData{}
-	if err := json.NewDecoder(r).Decode(data); err != nil {
-		return err
+// addSubscription registers a subscription for one or more services or
+// patterns. If snapshot is non-nil its events are streamed to the subscriber
+// before any live events, outside the store mutex. A non-empty client
+// attributes the subscription to that identity for quota accounting.
+// Must be called under mutex.
+func (s *Store) addSubscription(services []string, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, withIndex, batch bool, priority SubscriptionPriority, snapshot []*discoverd.Event, client string) *subscription {
+	// Create subscription.
+	s.subID++
+	sub := &subscription{
+		id:        s.subID,
+		kinds:     kinds,
+		ch:        ch,
+		store:     s,
+		service:   strings.Join(services, ","),
+		services:  services,
+		selector:  selector,
+		withIndex: withIndex,
+		batch:     batch,
+		priority:  priority,
+		snapshot:  snapshot,
+		client:    client,
+		queue:     make(chan *discoverd.Event, s.SubscriberQueueSize),
+		quit:      make(chan struct{}),
+		createdAt: s.Now(),
+	}
+	if client != "" {
+		s.acquireClientSub(client)
 	}
-	s.data = data
-	return nil
-}
 
-// Subscribe creates a subscription to events on a given service.
-func (s *Store) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	// Register it, evicting the oldest subscriber if the per-service
+	// ceiling is reached so memory use degrades predictably on huge
+	// deployments.
+	if evicted := s.subs.add(sub, s.MaxSubscribers); evicted != nil {
+		evicted.err = ErrSubscriberLimit
+		go evicted.Close()
+		s.evict("subscribers")
+	}
+	s.subWG.Add(1)
+	go sub.drain()
+	return sub
+}
 
-	// Create service subscription list if it doesn't exist yet.
-	if _, ok := s.subscribers[service]; !ok {
-		s.subscribers[service] = list.New()
+// subscriptionMatches returns whether a subscription key, which may be a
+// wildcard or glob pattern, matches a service name.
+func subscriptionMatches(key, service string) bool {
+	if key == service {
+		return true
+	}
+	if isPattern(key) {
+		ok, _ := path.Match(key, service)
+		return ok
 	}
+	return false
+}
 
-	// Create and add subscription.
-	sub := &subscription{
-		kinds:   kinds,
-		ch:      ch,
-		store:   s,
-		service: service,
-	}
-	sub.el = s.subscribers[service].PushBack(sub)
-
-	// Send current instances.
-	if sendCurrent && kinds.Any(discoverd.EventKindUp) {
-		for _, inst := range s.instances(service) {
-			ch <- &discoverd.Event{
-				Service:  service,
-				Kind:     discoverd.EventKindUp,
-				Instance: inst,
-			}
-			// TODO: add a timeout to sends so that clients can't slow things down too much
-		}
+// broadcast sends an event to all subscribers.
+// Requires the mu lock to be obtained.
+func (s *Store) broadcast(event *discoverd.Event) {
+	s.broadcastEvent(event)
+	s.queueFanout(false)
+}
+
+// broadcastBatch sends a set of events produced by one atomic bulk change.
+// Subscribers created with SubscribeBatch receive all of their matching
+// events as a single "batch" event, reducing wakeups for large diffs, while
+// other subscribers receive the events individually.
+// Requires the mu lock to be obtained.
+func (s *Store) broadcastBatch(events []*discoverd.Event) {
+	for _, event := range events {
+		s.broadcastEvent(event)
 	}
+	s.queueFanout(true)
+}
 
-	// Send current leader.
-	if leader := s.serviceLeader(service); sendCurrent && kinds&discoverd.EventKindLeader != 0 && leader != nil {
-		ch <- &discoverd.Event{
-			Service:  service,
-			Kind:     discoverd.EventKindLeader,
-			Instance: leader,
-		}
+// broadcastEvent sequences an event and queues it for delivery to
+// subscribers by the fan-out worker.
+// Must be called under mutex.
+func (s *Store) broadcastEvent(event *discoverd.Event) {
+	// Stamp the event with the broadcasting node's clock and identity so
+	// consumers can measure propagation latency and attribute events from
+	// federated sources. Events that already carry a stamp, such as ones
+	// mirrored from another cluster, keep their original one.
+	if event.Timestamp == 0 {
+		event.Timestamp = s.Now().UnixNano()
+	}
+	if event.Origin == "" && s.Advertise != nil {
+		event.Origin = s.Advertise.String()
 	}
 
-	// Send current service meta data.
-	if meta := s.serviceMeta(service); sendCurrent && kinds.Any(discoverd.EventKindServiceMeta) && meta != nil {
-		ch <- &discoverd.Event{
-			Service:     service,
-			Kind:        discoverd.EventKindServiceMeta,
-			ServiceMeta: meta,
-		}
+	s.audit(event)
+	s.broadcastService(event)
+
+	// Track dependency availability: warn dependent services when a
+	// service loses its last healthy instance, and rearm the warning when
+	// it regains one.
+	if event.Kind&dependencyKinds != 0 {
+		s.invalidateDependencies(event.Service)
 	}
 
-	// Send current service.
-	if sendCurrent && kinds.Any(discoverd.EventKindCurrent) {
-		ch <- &discoverd.Event{
-			Service: service,
-			Kind:    discoverd.EventKindCurrent,
+	// Dual-publish the event under any alias of the service so subscribers
+	// of the old name keep receiving events during a rename transition.
+	for alias, target := range s.data.Aliases {
+		if target == event.Service {
+			other := *event
+			other.Service = alias
+			s.broadcastService(&other)
 		}
 	}
-
-	return sub
 }
 
-// broadcast sends an event to all subscribers.
-// Requires the mu lock to be obtained.
-func (s *Store) broadcast(event *discoverd.Event) {
+// broadcastService sequences an event for subscribers of event.Service.
+// Must be called under mutex.
+func (s *Store) broadcastService(event *discoverd.Event) {
 	logBroadcast(event)
+	s.observeEvent(event)
 
-	// Retrieve list of subscribers for the service.
-	l, ok := s.subscribers[event.Service]
+	// Record per-kind delivery statistics for the service.
+	start := time.Now()
+	defer s.recordEvent(event, start)
 
-	if !ok {
-		return
+	// Assign the next sequence number and retain an indexed copy in the
+	// ring buffer so disconnected subscribers can resume.
+	if s.eventLog == nil {
+		s.eventLog = make([]*discoverd.Event, s.EventLogSize)
+	}
+	s.seq++
+	indexed := *event
+	indexed.EventIndex = s.seq
+	s.eventLog[(s.seq-1)%uint64(len(s.eventLog))] = &indexed
+
+	// Persist the indexed copy if an on-disk event log is configured.
+	if s.EventLog != nil {
+		if err := s.EventLog.Append(&indexed); err != nil {
+			logger.Error("error appending to event log", "fn", "broadcastService", "error", err)
+		}
 	}
 
-	// Iterate over each subscriber in the list.
-	for el := l.Front(); el != nil; el = el.Next() {
-		sub := el.Value.(*subscription)
+	// Hand the event to the fan-out worker for delivery.
+	s.pendingFanout = append(s.pendingFanout, fanoutItem{event: event, indexed: &indexed})
+}
+
+// isPattern returns whether a subscription name is a wildcard or glob
+// pattern rather than an exact service name.
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
 
+// broadcastTo sends an event to the subscribers registered under key. It is
+// called from the fan-out worker and locks only the key's registry shard,
+// so delivery doesn't hold up mutations. Resumable subscriptions receive
+// the indexed copy of the event.
+func (s *Store) broadcastTo(key string, event, indexed *discoverd.Event, batches map[*subscription][]*discoverd.Event) {
+	// Iterate over each subscriber registered under the key.
+	s.subs.forEach(key, func(sub *subscription) {
 		// Skip if event type is not subscribed to.
 		if sub.kinds&event.Kind == 0 {
-			continue
+			return
 		}
 
-		// Send event to subscriber.
-		// If subscriber is blocked then close it.
-		select {
-		case sub.ch <- event:
-		default:
-			sub.err = ErrSendBlocked
-			go sub.Close()
+		// Skip instance events that don't match the selector.
+		if sub.selector != nil && event.Instance != nil && !sub.selector.Match(event.Instance) {
+			return
+		}
+
+		// Resumable subscriptions receive the indexed copy.
+		e := event
+		if sub.withIndex {
+			e = indexed
+		}
+
+		// Collect events for batching subscribers so the whole change
+		// arrives as a single message.
+		if batches != nil && sub.batch {
+			batches[sub] = append(batches[sub], e)
+			return
+		}
+
+		// Queue event for delivery to subscriber. The overflow policy
+		// decides what happens if the queue is full.
+		sub.enqueue(e)
+	})
+}
+
+// EventKindStats holds delivery statistics for one event kind on a service.
+type EventKindStats struct {
+	Count        uint64 `json:"count"`
+	TotalLatency int64  `json:"total_latency_ns"`
+}
+
+// recordEvent updates delivery statistics for a broadcast event.
+// Must be called under mutex.
+func (s *Store) recordEvent(event *discoverd.Event, start time.Time) {
+	kinds := s.eventStats[event.Service]
+	if kinds == nil {
+		kinds = make(map[string]*EventKindStats)
+		s.eventStats[event.Service] = kinds
+	}
+	stats := kinds[event.Kind.String()]
+	if stats == nil {
+		stats = &EventKindStats{}
+		kinds[event.Kind.String()] = stats
+	}
+	stats.Count++
+	stats.TotalLatency += int64(time.Since(start))
+}
+
+// ServiceStats summarizes the state of one service.
+type ServiceStats struct {
+	// Instances is the total number of registered instances, including
+	// unhealthy and draining ones.
+	Instances   int    `json:"instances"`
+	Unhealthy   int    `json:"unhealthy,omitempty"`
+	Draining    int    `json:"draining,omitempty"`
+	Maintenance int    `json:"maintenance,omitempty"`
+	Flapping    int    `json:"flapping,omitempty"`
+	LeaderID    string `json:"leader_id,omitempty"`
+	Subscribers int    `json:"subscribers,omitempty"`
+}
+
+// Stats returns per-service instance counts, leadership and subscriber
+// counts, so dashboards don't have to fetch full instance lists just to
+// count them.
+func (s *Store) Stats() map[string]ServiceStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Count instances whose events are currently damped for flapping.
+	flapping := make(map[string]int)
+	now := s.Now()
+	for key, f := range s.flaps {
+		if f.damping(now) {
+			flapping[key.service]++
+		}
+	}
+
+	stats := make(map[string]ServiceStats, len(s.data.Services))
+	for service := range s.data.Services {
+		var st ServiceStats
+		for _, inst := range s.data.Instances[service] {
+			st.Instances++
+			if s.data.Unhealthy[service][inst.ID] {
+				st.Unhealthy++
+			} else if inst.State == discoverd.InstanceStateDraining {
+				st.Draining++
+			} else if inst.State == discoverd.InstanceStateMaintenance {
+				st.Maintenance++
+			}
+		}
+		st.Flapping = flapping[service]
+		st.LeaderID = s.data.Leaders[service]
+		st.Subscribers = s.subs.count(service)
+		stats[service] = st
+	}
+	return stats
+}
+
+// EventStats returns per-service, per-kind event delivery statistics.
+func (s *Store) EventStats() map[string]map[string]EventKindStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	other := make(map[string]map[string]EventKindStats, len(s.eventStats))
+	for service, kinds := range s.eventStats {
+		m := make(map[string]EventKindStats, len(kinds))
+		for kind, stats := range kinds {
+			m[kind] = *stats
 		}
+		other[service] = m
 	}
+	return other
+}
+
+// SubscriberStats describes one active subscription on the store.
+type SubscriberStats struct {
+	ID        uint64    `json:"id"`
+	Service   string    `json:"service"` // subscription key, may be a pattern
+	Priority  string    `json:"priority"`
+	Client    string    `json:"client,omitempty"` // quota attribution identity
+	CreatedAt time.Time `json:"created_at"`
+
+	// Delivered counts events queued for the subscriber; Dropped counts
+	// events discarded or abandoned because its queue was full.
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped,omitempty"`
+
+	// QueueDepth is the number of events waiting to be consumed, out of
+	// QueueSize. A subscriber pinned at a full queue is too slow.
+	QueueDepth int `json:"queue_depth"`
+	QueueSize  int `json:"queue_size"`
+}
+
+// Subscribers returns statistics for every active subscription, in creation
+// order, so operators can identify consumers that are too slow to keep up
+// with the event stream.
+func (s *Store) Subscribers() []SubscriberStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := []SubscriberStats{}
+	seen := make(map[uint64]struct{})
+	s.subs.forEachAll(func(sub *subscription) {
+		// Multi-service subscriptions are registered once per key.
+		if _, ok := seen[sub.id]; ok {
+			return
+		}
+		seen[sub.id] = struct{}{}
+		stats = append(stats, SubscriberStats{
+			ID:         sub.id,
+			Service:    sub.service,
+			Priority:   sub.priority.String(),
+			Client:     sub.client,
+			CreatedAt:  sub.createdAt,
+			Delivered:  atomic.LoadUint64(&sub.delivered),
+			Dropped:    atomic.LoadUint64(&sub.dropped),
+			QueueDepth: len(sub.queue),
+			QueueSize:  cap(sub.queue),
+		})
+	})
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
 }
 
 func logBroadcast(event *discoverd.Event) {
-	log := logger.New("fn", "broadcast")
+	log := broadcastLogger
 	ctx := []interface{}{
 		"event", event.Kind,
 		"service", event.Service,
@@ -1164,19 +3926,85 @@ type instanceSlice []*discoverd.Instance
 
 func (a instanceSlice) Len() int           { return len(a) }
 func (a instanceSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a instanceSlice) Less(i, j int) bool { return a[i].Index < a[j].Index }
+func (a instanceSlice) Less(i, j int) bool { return instanceLess(a[i], a[j]) }
+
+// instanceLess orders instances by registration index. Instances registered
+// in one batch share an index, so ties break by ID to keep the order
+// deterministic.
+func instanceLess(a, b *discoverd.Instance) bool {
+	if a.Index != b.Index {
+		return a.Index < b.Index
+	}
+	return a.ID < b.ID
+}
 
 // Command type header bytes.
 const (
-	addServiceCommandType      = byte(0)
-	removeServiceCommandType   = byte(1)
-	setServiceMetaCommandType  = byte(2)
-	setLeaderCommandType       = byte(3)
-	addInstanceCommandType     = byte(4)
-	removeInstanceCommandType  = byte(5)
-	expireInstancesCommandType = byte(6)
+	addServiceCommandType         = byte(0)
+	removeServiceCommandType      = byte(1)
+	setServiceMetaCommandType     = byte(2)
+	setLeaderCommandType          = byte(3)
+	addInstanceCommandType        = byte(4)
+	removeInstanceCommandType     = byte(5)
+	expireInstancesCommandType    = byte(6)
+	addInstancesCommandType       = byte(7)
+	setServiceFrozenCommandType   = byte(8)
+	renameServiceCommandType      = byte(9)
+	removeAliasCommandType        = byte(10)
+	restoreStateCommandType       = byte(11)
+	setServiceConfigCommandType   = byte(12)
+	setInstanceHealthCommandType  = byte(13)
+	drainInstanceCommandType      = byte(14)
+	updateInstanceMetaCommandType = byte(15)
+	failoverLeaderCommandType     = byte(16)
+	setMaintenanceCommandType     = byte(17)
+	transactionCommandType        = byte(18)
+	electLeadersCommandType       = byte(19)
+	setHealthInfoCommandType      = byte(20)
 )
 
+// setServiceConfigCommand represents a command object to update the
+// configuration of an existing service.
+type setServiceConfigCommand struct {
+	Service string
+	Config  *discoverd.ServiceConfig
+}
+
+type setInstanceHealthCommand struct {
+	Service string
+	ID      string
+	Healthy bool
+}
+
+type drainInstanceCommand struct {
+	Service string
+	ID      string
+}
+
+// setMaintenanceCommand represents a command object to put an instance into
+// or take it out of maintenance.
+type setMaintenanceCommand struct {
+	Service     string
+	ID          string
+	Maintenance bool
+}
+
+// transactionCommand represents a command object to apply multiple mutations
+// across services atomically.
+type transactionCommand struct {
+	Ops []*TxOp
+	Now time.Time
+}
+
+// updateInstanceMetaCommand represents a command object to replace the
+// metadata of an existing instance if its index matches.
+type updateInstanceMetaCommand struct {
+	Service       string
+	ID            string
+	Meta          map[string]string
+	ExpectedIndex uint64
+}
+
 // addServiceCommand represents a command object to create a service.
 type addServiceCommand struct {
 	Service string
@@ -1186,6 +4014,11 @@ type addServiceCommand struct {
 // removeServiceCommand represents a command object to delete a service.
 type removeServiceCommand struct {
 	Service string
+
+	// Async, if set, causes the "down" events for the service's instances
+	// to be broadcast asynchronously with rate limiting, tracked under JobID.
+	Async bool
+	JobID string
 }
 
 // setServiceMetaCommand represents a command object to set meta on a service.
@@ -1200,22 +4033,58 @@ type setLeaderCommand struct {
 	ID      string
 }
 
+// failoverLeaderCommand represents a command object to demote the current
+// leader of a service and promote another instance.
+type failoverLeaderCommand struct {
+	Service string
+	ID      string
+}
+
 // addInstanceCommand represents a command object to add an instance.
 type addInstanceCommand struct {
 	Service    string
 	Instance   *discoverd.Instance
 	ExpiryTime time.Time
+	Now        time.Time
+}
+
+// addInstancesCommand represents a command object to add a batch of instances.
+type addInstancesCommand struct {
+	Registrations []*discoverd.Registration
+	Now           time.Time
+}
+
+// setServiceFrozenCommand represents a command object to freeze or unfreeze
+// writes to a service.
+type setServiceFrozenCommand struct {
+	Service string
+	Frozen  bool
+}
+
+// renameServiceCommand represents a command object to rename a service,
+// leaving an alias behind under the old name.
+type renameServiceCommand struct {
+	Service string
+	NewName string
+}
+
+// removeAliasCommand represents a command object to retire an alias left
+// behind by a rename.
+type removeAliasCommand struct {
+	Alias string
 }
 
 // removeInstanceCommand represents a command object to remove an instance.
 type removeInstanceCommand struct {
 	Service string
 	ID      string
+	Now     time.Time
 }
 
 // expireInstancesCommand represents a command object to expire multiple instances.
 type expireInstancesCommand struct {
 	Instances []expireInstance
+	Now       time.Time
 }
 
 // expireInstance represents a single instance to expire.
@@ -1224,12 +4093,47 @@ type expireInstance struct {
 	InstanceID string
 }
 
+// electLeadersCommand represents a command object to lift expired leadership
+// holds and elect replacement leaders.
+type electLeadersCommand struct {
+	Services []string
+	Now      time.Time
+}
+
 // raftData represents the root data structure for the raft store.
 type raftData struct {
 	Services  map[string]*discoverd.ServiceConfig       `json:"services,omitempty"`
 	Metas     map[string]*discoverd.ServiceMeta         `json:"metas,omitempty"`
 	Leaders   map[string]string                         `json:"leaders,omitempty"`
 	Instances map[string]map[string]*discoverd.Instance `json:"instances,omitempty"`
+	Frozen    map[string]bool                           `json:"frozen,omitempty"`
+	Aliases   map[string]string                         `json:"aliases,omitempty"`
+	Unhealthy map[string]map[string]bool                `json:"unhealthy,omitempty"`
+
+	// ProtoLeaders holds the elected leader instance ID per protocol for
+	// services with per-proto leader election enabled.
+	ProtoLeaders map[string]map[string]string `json:"proto_leaders,omitempty"`
+
+	// LeaderTokens holds the fencing token issued for each service's
+	// current leadership. Tokens are raft log indexes, so they increase
+	// monotonically with every leadership change.
+	LeaderTokens map[string]uint64 `json:"leader_tokens,omitempty"`
+
+	// Tombstones holds recently departed instances per service so an
+	// identical re-registration within the grace window can reclaim its
+	// previous Index.
+	Tombstones map[string]map[string]*tombstone `json:"tombstones,omitempty"`
+
+	// LeaderHolds holds the departure time of each service's elected
+	// leader while a minimum leadership hold is pending, so a replacement
+	// is only elected after the grace period.
+	LeaderHolds map[string]time.Time `json:"leader_holds,omitempty"`
+}
+
+// tombstone records a departed instance and when it went down.
+type tombstone struct {
+	Instance   *discoverd.Instance `json:"instance"`
+	DepartedAt time.Time           `json:"departed_at"`
 }
 
 func newRaftData() *raftData {
@@ -1238,7 +4142,129 @@ func newRaftData() *raftData {
 		Metas:     make(map[string]*discoverd.ServiceMeta),
 		Leaders:   make(map[string]string),
 		Instances: make(map[string]map[string]*discoverd.Instance),
+		Frozen:    make(map[string]bool),
+		Aliases:   make(map[string]string),
+		Unhealthy: make(map[string]map[string]bool),
+
+		ProtoLeaders: make(map[string]map[string]string),
+		LeaderTokens: make(map[string]uint64),
+		Tombstones:   make(map[string]map[string]*tombstone),
+		LeaderHolds:  make(map[string]time.Time),
+	}
+}
+
+// clone returns a copy of the data with fresh top-level maps. The inner
+// instance maps are shared with the original and must be copied with
+// cowInstances before being modified.
+func (d *raftData) clone() *raftData {
+	other := &raftData{
+		Services:  make(map[string]*discoverd.ServiceConfig, len(d.Services)),
+		Metas:     make(map[string]*discoverd.ServiceMeta, len(d.Metas)),
+		Leaders:   make(map[string]string, len(d.Leaders)),
+		Instances: make(map[string]map[string]*discoverd.Instance, len(d.Instances)),
+		Frozen:    make(map[string]bool, len(d.Frozen)),
+		Aliases:   make(map[string]string, len(d.Aliases)),
+		Unhealthy: make(map[string]map[string]bool, len(d.Unhealthy)),
+
+		ProtoLeaders: make(map[string]map[string]string, len(d.ProtoLeaders)),
+		LeaderTokens: make(map[string]uint64, len(d.LeaderTokens)),
+		Tombstones:   make(map[string]map[string]*tombstone, len(d.Tombstones)),
+		LeaderHolds:  make(map[string]time.Time, len(d.LeaderHolds)),
+	}
+	for k, v := range d.Services {
+		other.Services[k] = v
+	}
+	for k, v := range d.Metas {
+		other.Metas[k] = v
+	}
+	for k, v := range d.Leaders {
+		other.Leaders[k] = v
+	}
+	for k, v := range d.Instances {
+		other.Instances[k] = v
+	}
+	for k, v := range d.Frozen {
+		other.Frozen[k] = v
+	}
+	for k, v := range d.Aliases {
+		other.Aliases[k] = v
+	}
+	for k, v := range d.Unhealthy {
+		other.Unhealthy[k] = v
+	}
+	for k, v := range d.ProtoLeaders {
+		other.ProtoLeaders[k] = v
 	}
+	for k, v := range d.LeaderTokens {
+		other.LeaderTokens[k] = v
+	}
+	for k, v := range d.Tombstones {
+		other.Tombstones[k] = v
+	}
+	for k, v := range d.LeaderHolds {
+		other.LeaderHolds[k] = v
+	}
+	return other
+}
+
+// removeTombstone drops the tombstone for an instance, copying the affected
+// map so published read snapshots are unaffected.
+func (d *raftData) removeTombstone(service, id string) {
+	if d.Tombstones[service][id] == nil {
+		return
+	}
+	m := make(map[string]*tombstone, len(d.Tombstones[service]))
+	for k, v := range d.Tombstones[service] {
+		if k == id {
+			continue
+		}
+		m[k] = v
+	}
+	if len(m) == 0 {
+		delete(d.Tombstones, service)
+		return
+	}
+	d.Tombstones[service] = m
+}
+
+// cowInstances replaces the instance map for a service with a fresh copy
+// and returns it, so the service can be modified without affecting a
+// previously published read snapshot.
+func (d *raftData) cowInstances(service string) map[string]*discoverd.Instance {
+	m := make(map[string]*discoverd.Instance, len(d.Instances[service]))
+	for id, inst := range d.Instances[service] {
+		m[id] = inst
+	}
+	d.Instances[service] = m
+	return m
+}
+
+// setUnhealthy records or clears the unhealthy flag for an instance,
+// copying the affected map so published read snapshots are unaffected.
+func (d *raftData) setUnhealthy(service, id string, unhealthy bool) {
+	m := make(map[string]bool, len(d.Unhealthy[service])+1)
+	for k, v := range d.Unhealthy[service] {
+		m[k] = v
+	}
+	if unhealthy {
+		m[id] = true
+	} else {
+		delete(m, id)
+	}
+	if len(m) == 0 {
+		delete(d.Unhealthy, service)
+		return
+	}
+	d.Unhealthy[service] = m
+}
+
+// resolve returns the service that name refers to, following an alias left
+// behind by RenameService.
+func (d *raftData) resolve(name string) string {
+	if target := d.Aliases[name]; target != "" {
+		return target
+	}
+	return name
 }
 
 // ServiceInstances returns the instances of a service in sorted order.
@@ -1254,19 +4280,166 @@ func (d *raftData) ServiceInstances(service string) []*discoverd.Instance {
 
 // subscription represents a listener to one or more kinds of events.
 type subscription struct {
-	kinds discoverd.EventKind
-	ch    chan *discoverd.Event
-	err   error
+	id        uint64 // unique identifier for inspection
+	kinds     discoverd.EventKind
+	ch        chan *discoverd.Event
+	queue     chan *discoverd.Event // bounded queue drained into ch
+	quit      chan struct{}
+	selector  Selector             // if set, only matching instance events are sent
+	withIndex bool                 // deliver indexed event copies for resume
+	batch     bool                 // deliver bulk changes as a single batch event
+	priority  SubscriptionPriority // delivery tier degraded during overload
+	snapshot  []*discoverd.Event   // initial sync streamed before live events
+	client    string               // quota attribution, empty for internal subscriptions
+	err       error
+
+	// Delivery statistics, updated atomically by the fan-out worker.
+	createdAt time.Time
+	delivered uint64 // events queued for delivery
+	dropped   uint64 // events discarded or abandoned on a full queue
 
 	// the following fields are used by Close to clean up
-	el      *list.Element
-	store   *Store
-	service string
-	closed  bool
+	els       []*list.Element // one registry element per subscription key
+	store     *Store
+	service   string   // display label, the joined keys for multi subscriptions
+	services  []string // subscription keys, each a service name or pattern
+	closeOnce sync.Once
 }
 
+// keys returns the registry keys the subscription is registered under.
+func (s *subscription) keys() []string { return s.services }
+
 func (s *subscription) Err() error { return s.err }
 
+// enqueue adds an event to the subscription queue, applying the store's
+// overflow policy if the queue is full. It is called from the fan-out
+// worker, so blocking here delays other deliveries but not mutations.
+func (s *subscription) enqueue(event *discoverd.Event) {
+	select {
+	case s.queue <- event:
+		s.store.tierEnqueued(s.priority)
+		atomic.AddUint64(&s.delivered, 1)
+		return
+	default:
+	}
+
+	// During overload lower-priority subscribers fall back to drop-oldest
+	// delivery, coalescing their streams so higher tiers aren't delayed
+	// behind them.
+	policy := s.store.OverflowPolicy
+	if s.store.degraded(s.priority) {
+		policy = OverflowDropOldest
+	}
+
+	switch policy {
+	case OverflowDropOldest:
+		// Discard the oldest queued event to make room.
+		s.store.evict("queued_events")
+		atomic.AddUint64(&s.dropped, 1)
+		select {
+		case <-s.queue:
+			s.store.tierDequeued(s.priority)
+		default:
+		}
+		select {
+		case s.queue <- event:
+			s.store.tierEnqueued(s.priority)
+			atomic.AddUint64(&s.delivered, 1)
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(s.store.OverflowTimeout)
+		defer timer.Stop()
+		select {
+		case s.queue <- event:
+			s.store.tierEnqueued(s.priority)
+			atomic.AddUint64(&s.delivered, 1)
+		case <-timer.C:
+			s.store.evict("slow_subscribers")
+			atomic.AddUint64(&s.dropped, 1)
+			s.err = ErrSendBlocked
+			s.logClose()
+			go s.Close()
+		}
+	default:
+		s.store.evict("slow_subscribers")
+		atomic.AddUint64(&s.dropped, 1)
+		s.err = ErrSendBlocked
+		s.logClose()
+		go s.Close()
+	}
+}
+
+// logClose records that a slow subscriber is being disconnected, since from
+// the client's perspective the stream just ends with ErrSendBlocked.
+func (s *subscription) logClose() {
+	broadcastLogger.Warn("closing slow subscriber",
+		"subscription.id", s.id,
+		"service", s.service,
+		"dropped", atomic.LoadUint64(&s.dropped),
+		"error", ErrSendBlocked,
+	)
+}
+
+// drain delivers queued events to the subscriber channel until the
+// subscription is closed.
+func (s *subscription) drain() {
+	defer s.store.subWG.Done()
+
+	// Stream the initial sync before any live events. The sends block only
+	// on the subscriber's own channel, releasing delivered events for
+	// garbage collection as they go; live events arriving meanwhile queue
+	// up behind the snapshot under the usual overflow policy.
+	for i, event := range s.snapshot {
+		select {
+		case s.ch <- event:
+			s.snapshot[i] = nil
+		case <-s.quit:
+			s.finish()
+			return
+		}
+	}
+	s.snapshot = nil
+
+	for {
+		select {
+		case event := <-s.queue:
+			s.store.tierDequeued(s.priority)
+			select {
+			case s.ch <- event:
+			case <-s.quit:
+				s.finish()
+				return
+			}
+		case <-s.quit:
+			s.finish()
+			return
+		}
+	}
+}
+
+// finish makes a best-effort delivery of any events still queued when the
+// subscription is closed — in particular the terminal shutdown event — then
+// closes the subscriber channel. The sends don't block, so subscribers that
+// have stopped reading can't stall shutdown.
+func (s *subscription) finish() {
+	for {
+		select {
+		case event := <-s.queue:
+			s.store.tierDequeued(s.priority)
+			select {
+			case s.ch <- event:
+			default:
+				atomic.AddUint64(&s.dropped, 1)
+			}
+		default:
+			close(s.ch)
+			return
+		}
+	}
+}
+
 func (s *subscription) Close() error {
 	go func() {
 		// drain channel to prevent deadlocks
@@ -1279,21 +4452,18 @@ func (s *subscription) Close() error {
 }
 
 func (s *subscription) close() {
-	s.store.mu.Lock()
-	defer s.store.mu.Unlock()
-
-	if s.closed {
-		return
-	}
+	s.closeOnce.Do(func() {
+		s.store.subs.remove(s)
 
-	l := s.store.subscribers[s.service]
-	l.Remove(s.el)
-	if l.Len() == 0 {
-		delete(s.store.subscribers, s.service)
-	}
-	close(s.ch)
+		// Free the subscription's slot in the client quota.
+		if s.client != "" {
+			s.store.releaseClientSub(s.client)
+		}
 
-	s.closed = true
+		// Stop the drain goroutine, which flushes the queue and closes
+		// the subscriber channel.
+		close(s.quit)
+	})
 }
 
 type NotFoundError struct {
@@ -1324,21 +4494,61 @@ func IsServiceExists(err error) bool {
 	return ok
 }
 
+type ServiceFrozenError string
+
+func (e ServiceFrozenError) Error() string {
+	return fmt.Sprintf("discoverd: service %q is frozen", string(e))
+}
+
+func IsServiceFrozen(err error) bool {
+	_, ok := err.(ServiceFrozenError)
+	return ok
+}
+
 // ValidServiceName returns nil if service is valid. Otherwise returns an error.
+// A service name may be prefixed with a namespace and a slash (e.g.
+// "prod/web"), which lets the same bare name exist independently per tenant.
+// Namespaces compose with the rest of the API: a glob subscription such as
+// "prod/*" receives events for every service in the namespace, and an ACL
+// prefix such as "prod/" scopes write access to it.
 func ValidServiceName(service string) error {
 	// Blank service names are not allowed.
 	if service == "" {
 		return ErrUnsetService
 	}
 
-	// Service names must consist of the characters [a-z0-9-]
-	for _, r := range service {
+	namespace, name := SplitNamespace(service)
+	if namespace != "" && !validNamePart(namespace) {
+		return ErrInvalidService
+	}
+	if !validNamePart(name) {
+		return ErrInvalidService
+	}
+
+	return nil
+}
+
+// validNamePart returns whether s is non-empty and consists of the
+// characters [a-z0-9-].
+func validNamePart(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
 		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
-			return ErrInvalidService
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// SplitNamespace splits a service name into its namespace and bare name.
+// Names without a slash live in the empty default namespace.
+func SplitNamespace(service string) (namespace, name string) {
+	if i := strings.Index(service, "/"); i >= 0 {
+		return service[:i], service[i+1:]
+	}
+	return "", service
 }
 
 // ProxyStore implements some of the Store methods as proxy calls.
@@ -0,0 +1,92 @@
+// +build invariant
+
+package server
+
+import (
+	"fmt"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// Invariant builds validate the store after every raft mutation, panicking
+// on the first violation so races surface at the mutation that introduced
+// them rather than in a later read. Enable with:
+//
+//	go test -tags invariant ./discoverd/server
+//
+// The checks cover leader consistency (elected leaders refer to live,
+// eligible instances), Index uniqueness within a service, and that the
+// up/down events broadcast by a mutation match the resulting state.
+
+// observeEvent records an event broadcast by the mutation currently being
+// applied. Must be called under mutex.
+func (s *Store) observeEvent(event *discoverd.Event) {
+	s.invariantEvents = append(s.invariantEvents, event)
+}
+
+// checkInvariants validates the store state and the events collected since
+// the previous check. Must be called under mutex.
+func (s *Store) checkInvariants(prev *raftData) {
+	events := s.invariantEvents
+	s.invariantEvents = nil
+
+	for service, instances := range s.data.Instances {
+		// Index values are unique within a service.
+		indexes := make(map[uint64]string, len(instances))
+		for id, inst := range instances {
+			if other, ok := indexes[inst.Index]; ok {
+				panic(fmt.Sprintf("invariant violation: service %q instances %q and %q share index %d", service, other, id, inst.Index))
+			}
+			indexes[inst.Index] = id
+		}
+
+		// A service with elected leadership always has a leader while it
+		// has eligible instances. The leader ID itself may dangle after a
+		// manual override (SetServiceLeader accepts unknown IDs), so only
+		// its presence is checked; per-proto leaders are purely elected
+		// and must refer to live instances.
+		config := s.data.Services[service]
+		if leaderPicker(config) == nil {
+			continue
+		}
+		eligible := false
+		for id, inst := range instances {
+			if !s.data.Unhealthy[service][id] && !outOfRotation(inst) {
+				eligible = true
+				break
+			}
+		}
+		if eligible && s.data.Leaders[service] == "" {
+			panic(fmt.Sprintf("invariant violation: service %q has eligible instances but no leader", service))
+		}
+		for proto, id := range s.data.ProtoLeaders[service] {
+			if _, ok := instances[id]; !ok {
+				panic(fmt.Sprintf("invariant violation: service %q proto %q leader %q is not a live instance", service, proto, id))
+			}
+		}
+	}
+
+	// The up/down events broadcast by the mutation match the resulting
+	// state: an "up" instance is live afterwards, a "down" instance is
+	// not. Events republished under an alias are resolved first.
+	for _, event := range events {
+		if event.Instance == nil {
+			continue
+		}
+		service := s.data.resolve(event.Service)
+		_, live := s.data.Instances[service][event.Instance.ID]
+		switch event.Kind {
+		case discoverd.EventKindUp, discoverd.EventKindUpdate:
+			if !live {
+				panic(fmt.Sprintf("invariant violation: %s event for %q/%q but the instance is not live", event.Kind, service, event.Instance.ID))
+			}
+		case discoverd.EventKindDown:
+			if live {
+				panic(fmt.Sprintf("invariant violation: down event for %q/%q but the instance is still live", service, event.Instance.ID))
+			}
+			if _, was := prev.Instances[service][event.Instance.ID]; !was {
+				panic(fmt.Sprintf("invariant violation: down event for %q/%q but the instance was not live before the mutation", service, event.Instance.ID))
+			}
+		}
+	}
+}
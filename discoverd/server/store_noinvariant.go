@@ -0,0 +1,12 @@
+// +build !invariant
+
+package server
+
+import discoverd "github.com/flynn/flynn/discoverd/client"
+
+// Invariant checking compiles to no-ops unless the "invariant" build tag is
+// set; see store_invariant.go.
+
+func (s *Store) observeEvent(event *discoverd.Event) {}
+
+func (s *Store) checkInvariants(prev *raftData) {}
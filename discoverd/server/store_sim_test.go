@@ -0,0 +1,144 @@
+package server_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// Ensure that subscribers attaching, consuming and detaching concurrently
+// with registration churn never observe an impossible event sequence. Each
+// subscriber checks that an instance is only updated or brought down while
+// up and never brought up twice, and that its channel closes promptly after
+// Close. The test is most valuable with the race detector:
+//
+//	go test -race -run TestStore_SimulatedSubscribers ./discoverd/server
+func TestStore_SimulatedSubscribers(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// The churn below would trip flap damping, which intentionally swallows
+	// events and would make the sequence checks meaningless.
+	s.FlapThreshold = 0
+
+	if err := s.AddService("sim", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		mutators    = 4
+		subscribers = 8
+		ops         = 250
+	)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errc := make(chan error, subscribers)
+
+	// Mutators churn a small set of instance IDs so subscribers see
+	// plenty of up/update/down transitions for the same instance.
+	var mwg sync.WaitGroup
+	for m := 0; m < mutators; m++ {
+		wg.Add(1)
+		mwg.Add(1)
+		go func(m int) {
+			defer wg.Done()
+			defer mwg.Done()
+			rng := rand.New(rand.NewSource(int64(m)))
+			for i := 0; i < ops; i++ {
+				id := fmt.Sprintf("inst%d", rng.Intn(8))
+				if rng.Intn(3) == 0 {
+					s.RemoveInstance("sim", id)
+				} else {
+					s.AddInstance("sim", &discoverd.Instance{
+						ID:   id,
+						Meta: map[string]string{"n": fmt.Sprint(rng.Intn(4))},
+					})
+				}
+			}
+		}(m)
+	}
+	go func() {
+		mwg.Wait()
+		close(done)
+	}()
+
+	for n := 0; n < subscribers; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(1000 + n)))
+			for i := 0; i < 20; i++ {
+				if err := runSimSubscriber(s, rng, done); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+}
+
+// runSimSubscriber attaches a subscriber, consumes a bounded number of
+// events while validating that the observed sequence is possible, then
+// closes the stream and waits for the channel to close.
+func runSimSubscriber(s *Store, rng *rand.Rand, done chan struct{}) error {
+	ch := make(chan *discoverd.Event, 512)
+	stream := s.Subscribe("sim", true, discoverd.EventKindUp|discoverd.EventKindUpdate|discoverd.EventKindDown, ch)
+
+	up := make(map[string]bool)
+	limit := 1 + rng.Intn(50)
+loop:
+	for i := 0; i < limit; i++ {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				break loop
+			}
+			id := event.Instance.ID
+			switch event.Kind {
+			case discoverd.EventKindUp:
+				if up[id] {
+					return fmt.Errorf("up event for %q but the instance is already up", id)
+				}
+				up[id] = true
+			case discoverd.EventKindUpdate:
+				if !up[id] {
+					return fmt.Errorf("update event for %q but the instance is not up", id)
+				}
+			case discoverd.EventKindDown:
+				if !up[id] {
+					return fmt.Errorf("down event for %q but the instance is not up", id)
+				}
+				delete(up, id)
+			default:
+				return fmt.Errorf("unexpected event kind %s for %q", event.Kind, id)
+			}
+		case <-done:
+			break loop
+		}
+	}
+	stream.Close()
+
+	// Close drains any remaining events and then closes the channel.
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("channel still open after stream close")
+		}
+	}
+}
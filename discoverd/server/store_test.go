@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -60,6 +61,27 @@ func TestStore_AddService(t *testing.T) {
 	}
 }
 
+// Ensure the store broadcasts a "service up" event to wildcard subscribers
+// when a service is created.
+func TestStore_AddService_ServiceUpEvent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Subscribe to all services.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("*", false, discoverd.EventKindServiceUp, ch)
+
+	// Add a service.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that a "service up" event was broadcast.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindServiceUp}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
 // Ensure the store uses a default config if one is not specified.
 func TestStore_AddService_DefaultConfig(t *testing.T) {
 	s := MustOpenStore()
@@ -76,6 +98,53 @@ func TestStore_AddService_DefaultConfig(t *testing.T) {
 	}
 }
 
+// Ensure the store expands an appliance profile into the service config and
+// enforces the meta keys it requires.
+func TestStore_AddService_Profile(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Add a service with the postgres profile.
+	if err := s.AddService("pg", &discoverd.ServiceConfig{Profile: "postgres"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate that the profile defaults were filled in.
+	if c := s.Config("pg"); !reflect.DeepEqual(c, &discoverd.ServiceConfig{
+		Profile:     "postgres",
+		LeaderType:  discoverd.LeaderTypeManual,
+		HealthCheck: &discoverd.HealthCheck{Type: "tcp"},
+	}) {
+		t.Fatalf("unexpected config: %#v", c)
+	}
+
+	// Registering without the required meta key is rejected.
+	err := s.AddInstance("pg", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"})
+	if !server.IsProfileError(err) {
+		t.Fatalf("unexpected error: %s", err)
+	} else if err.Error() != `discoverd: profile "postgres" of service "pg" requires instance meta key "POSTGRES_ID"` {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+
+	// Registering with the required meta key succeeds.
+	if err := s.AddInstance("pg", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000", Meta: map[string]string{"POSTGRES_ID": "node0"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the store rejects a config naming an unregistered profile.
+func TestStore_AddService_ErrUnknownProfile(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	err := s.AddService("service0", &discoverd.ServiceConfig{Profile: "bogus"})
+	if !server.IsProfileError(err) {
+		t.Fatalf("unexpected error: %s", err)
+	} else if err.Error() != `discoverd: unknown service profile "bogus"` {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+}
+
 // Ensure the store returns an error when creating a service that already exists.
 func TestStore_AddService_ErrServiceExists(t *testing.T) {
 	s := MustOpenStore()
@@ -137,12 +206,153 @@ func TestStore_RemoveService_Events(t *testing.T) {
 	}
 
 	// Verify two down events were received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 3}}) {
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 3}, Reason: discoverd.DownReasonServiceRemoved}) {
+		t.Fatalf("unexpected event(0): %#v", e)
+	}
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst1", Index: 4}, Reason: discoverd.DownReasonServiceRemoved}) {
+		t.Fatalf("unexpected event(1): %#v", e)
+	}
+}
+
+// Ensure the store can remove a service asynchronously, broadcasting the
+// down events in the background and reporting completion via a job.
+func TestStore_RemoveServiceAsync(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 2)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Remove service asynchronously.
+	jobID, err := s.RemoveServiceAsync("service0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The service is removed immediately.
+	if s.Config("service0") != nil {
+		t.Fatal("expected service to be removed")
+	}
+
+	// Verify two down events were received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0", Index: 3}, Reason: discoverd.DownReasonServiceRemoved}) {
 		t.Fatalf("unexpected event(0): %#v", e)
 	}
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst1", Index: 4}}) {
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst1", Index: 4}, Reason: discoverd.DownReasonServiceRemoved}) {
 		t.Fatalf("unexpected event(1): %#v", e)
 	}
+
+	// Verify the job reports completion.
+	var job *server.ServiceRemoval
+	for i := 0; i < 100; i++ {
+		if job = s.ServiceRemoval(jobID); job != nil && job.Done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job == nil || !job.Done {
+		t.Fatalf("removal job did not complete: %#v", job)
+	} else if job.Service != "service0" || job.Total != 2 || job.Sent != 2 {
+		t.Fatalf("unexpected job: %#v", job)
+	}
+}
+
+// Ensure the store returns an error when asynchronously removing a
+// non-existent service.
+func TestStore_RemoveServiceAsync_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if _, err := s.RemoveServiceAsync("no_such_service"); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store can rename a service, dual-publishing events under both
+// names until the alias is retired.
+func TestStore_RenameService(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribe under the old name.
+	ch := make(chan *discoverd.Event, 4)
+	s.Subscribe("service0", false, discoverd.EventKindUp|discoverd.EventKindServiceDown, ch)
+
+	// Rename the service.
+	if err := s.RenameService("service0", "service1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The config, meta and instances moved to the new name.
+	if c := s.Config("service1"); !reflect.DeepEqual(c, &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}) {
+		t.Fatalf("unexpected config: %#v", c)
+	} else if m := s.ServiceMeta("service1"); m == nil || string(m.Data) != `"foo"` {
+		t.Fatalf("unexpected meta: %#v", m)
+	} else if a, err := s.Instances("service1"); err != nil || len(a) != 1 {
+		t.Fatalf("unexpected instances: %#v (%s)", a, err)
+	}
+
+	// Reads under the old name resolve through the alias.
+	if a, err := s.Instances("service0"); err != nil || len(a) != 1 {
+		t.Fatalf("unexpected instances: %#v (%s)", a, err)
+	}
+
+	// Writes under the old name land on the new service and events are
+	// dual-published to old-name subscribers.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := s.Instances("service1"); err != nil || len(a) != 2 {
+		t.Fatalf("unexpected instances: %#v (%s)", a, err)
+	}
+
+	// The rename re-publishes the existing instance, then the new
+	// registration arrives under the old name too.
+	if e := <-ch; e.Kind != discoverd.EventKindUp || e.Service != "service0" || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindUp || e.Service != "service0" || e.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Retire the alias and verify the old name is gone.
+	if err := s.RetireAlias("service0"); err != nil {
+		t.Fatal(err)
+	}
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindServiceDown}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if a, err := s.Instances("service0"); err != nil || len(a) != 0 {
+		t.Fatalf("unexpected instances: %#v (%s)", a, err)
+	}
+}
+
+// Ensure the store returns an error when renaming to a name that is taken.
+func TestStore_RenameService_ErrServiceExists(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddService("service1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RenameService("service0", "service1"); !server.IsServiceExists(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
 }
 
 // Ensure the store removes service meta when service is removed
@@ -209,6 +419,76 @@ func TestStore_AddInstance(t *testing.T) {
 	}
 }
 
+// Ensure an identical instance re-registering within the tombstone grace
+// window reclaims its previous index.
+func TestStore_AddInstance_ReclaimIndex(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an instance and capture its index.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Instances("service0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := a[0].Index
+
+	// Remove the instance and immediately re-register it unchanged.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that the previous index was reclaimed.
+	if a, err = s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if a[0].Index != index {
+		t.Fatalf("unexpected index: %d, expected %d", a[0].Index, index)
+	}
+}
+
+// Ensure a re-registration after the tombstone grace window has passed is
+// assigned a fresh index.
+func TestStore_AddInstance_ReclaimIndex_Expired(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add an instance, capture its index and remove it.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Instances("service0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := a[0].Index
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-register after the grace window has passed.
+	s.Store.Now = func() time.Time { return time.Now().Add(2 * server.DefaultTombstoneGrace) }
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that a fresh index was assigned.
+	if a, err = s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if a[0].Index == index {
+		t.Fatalf("expected a fresh index, got %d", a[0].Index)
+	}
+}
+
 // Ensure the store can add instances to a service.
 func TestStore_AddInstance_ErrNotFound(t *testing.T) {
 	s := MustOpenStore()
@@ -236,7 +516,7 @@ func TestStore_AddInstance_UpEvent(t *testing.T) {
 	}
 
 	// Verify "up" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
 		Service:  "service0",
 		Kind:     discoverd.EventKindUp,
 		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
@@ -265,151 +545,146 @@ func TestStore_AddInstance_UpdateEvent(t *testing.T) {
 	}
 
 	// Verify "update" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
 		Service:  "service0",
 		Kind:     discoverd.EventKindUpdate,
 		Instance: &discoverd.Instance{ID: "inst0", Index: 3, Proto: "https"},
+		Changed:  []string{"proto"},
 	}) {
 		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store sends a "leader" event when adding the first instance.
-func TestStore_AddInstance_LeaderEvent(t *testing.T) {
+// Ensure annotation changes produce an "update" event flagging the field.
+func TestStore_AddInstance_UpdateAnnotations(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
 	if err := s.AddService("service0", nil); err != nil {
 		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Annotations: map[string][]byte{"cert": {0x01}}}); err != nil {
+		t.Fatal(err)
 	}
 
 	// Add subscription.
 	ch := make(chan *discoverd.Event, 1)
-	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
+	s.Subscribe("service0", false, discoverd.EventKindUpdate, ch)
 
-	// Update instance.
-	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+	// Re-register with a different annotation value.
+	annotations := map[string][]byte{"cert": {0x02}}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Annotations: annotations}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify "leader" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
+	// Verify "update" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
 		Service:  "service0",
-		Kind:     discoverd.EventKindLeader,
-		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
+		Kind:     discoverd.EventKindUpdate,
+		Instance: &discoverd.Instance{ID: "inst0", Index: 3, Annotations: annotations},
+		Changed:  []string{"annotations"},
 	}) {
 		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store sends a "leader" event when setting the leader.
-func TestStore_SetLeader_Event(t *testing.T) {
+// Ensure zone changes produce an "update" event flagging the field.
+func TestStore_AddInstance_UpdateZone(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
-		t.Fatal(err)
-	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+	if err := s.AddService("service0", nil); err != nil {
 		t.Fatal(err)
-	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Zone: "a"}); err != nil {
 		t.Fatal(err)
 	}
 
 	// Add subscription.
 	ch := make(chan *discoverd.Event, 1)
-	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
+	s.Subscribe("service0", false, discoverd.EventKindUpdate, ch)
 
-	// Update instance.
-	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
-		t.Fatal(err)
+	// Re-register in a different zone.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Zone: "b"}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify "leader" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
+	// Verify "update" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
 		Service:  "service0",
-		Kind:     discoverd.EventKindLeader,
-		Instance: &discoverd.Instance{ID: "inst1", Index: 4},
+		Kind:     discoverd.EventKindUpdate,
+		Instance: &discoverd.Instance{ID: "inst0", Index: 3, Zone: "b"},
+		Changed:  []string{"zone"},
 	}) {
 		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store can remove an instance from a service.
-func TestStore_RemoveInstance(t *testing.T) {
+// Ensure the store sends a "leader" event when adding the first instance.
+func TestStore_AddInstance_LeaderEvent(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
 	if err := s.AddService("service0", nil); err != nil {
 		t.Fatal(err)
-	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
-		t.Fatal(err)
-	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
-		t.Fatal(err)
-	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst2"}); err != nil {
-		t.Fatal(err)
 	}
 
-	// Remove one instance.
-	if err := s.RemoveInstance("service0", "inst1"); err != nil {
-		t.Fatal(err)
-	}
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
 
-	// Verify the remaining instances.
-	if a, err := s.Instances("service0"); err != nil {
+	// Update instance.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(a, []*discoverd.Instance{
-		{ID: "inst0", Index: 3},
-		{ID: "inst2", Index: 5},
-	}) {
-		t.Fatalf("unexpected instances: %#v", a)
 	}
-}
 
-// Ensure the store returns an error when removing an instance from a non-existent service.
-func TestStore_RemoveInstance_ErrNotFound(t *testing.T) {
-	s := MustOpenStore()
-	defer s.Close()
-	if err := s.RemoveInstance("no_such_service", "inst0"); !server.IsNotFound(err) {
-		t.Fatalf("unexpected error: %s", err)
+	// Verify "leader" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:     "service0",
+		Kind:        discoverd.EventKindLeader,
+		Instance:    &discoverd.Instance{ID: "inst0", Index: 3},
+		LeaderToken: 3,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store sends a "down" event when removing an existing service.
-func TestStore_RemoveInstance_DownEvent(t *testing.T) {
+// Ensure the store sends a "leader" event when setting the leader.
+func TestStore_SetLeader_Event(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.AddService("service0", nil); err != nil {
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
 		t.Fatal(err)
-	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
 		t.Fatal(err)
 	}
 
 	// Add subscription.
 	ch := make(chan *discoverd.Event, 1)
-	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
 
-	// Remove instance.
-	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+	// Update instance.
+	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+		t.Fatal(err)
 		t.Fatal(err)
 	}
 
-	// Verify "down" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
-		Service:  "service0",
-		Kind:     discoverd.EventKindDown,
-		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
+	// Verify "leader" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:     "service0",
+		Kind:        discoverd.EventKindLeader,
+		Instance:    &discoverd.Instance{ID: "inst1", Index: 4},
+		LeaderToken: 5,
 	}) {
 		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store sends a "leader" event when removing an existing service.
-func TestStore_RemoveInstance_LeaderEvent(t *testing.T) {
+// Ensure re-electing the current leader skips the raft proposal and
+// broadcasts no event.
+func TestStore_SetLeader_Idempotent(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
-		t.Fatal(err)
-	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
 		t.Fatal(err)
-	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -417,185 +692,255 @@ func TestStore_RemoveInstance_LeaderEvent(t *testing.T) {
 	ch := make(chan *discoverd.Event, 1)
 	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
 
-	// Remove instance, inst1 should become leader.
-	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+	// Elect the leader and consume the event.
+	if err := s.SetServiceLeader("service0", "inst0"); err != nil {
 		t.Fatal(err)
 	}
-
-	// Verify "leader" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
-		Service:  "service0",
-		Kind:     discoverd.EventKindLeader,
-		Instance: &discoverd.Instance{ID: "inst1", Index: 4},
-	}) {
+	if e := <-ch; e.Kind != discoverd.EventKindLeader {
 		t.Fatalf("unexpected event: %#v", e)
 	}
-}
-
-// Ensure the store can enforce expiration of instances.
-func TestStore_EnforceExpiry(t *testing.T) {
-	s := MustOpenStore()
-	s.InstanceTTL = 100 * time.Millisecond // low TTL
-	defer s.Close()
-
-	// Add service.
-	if err := s.AddService("service0", nil); err != nil {
-		t.Fatal(err)
-	}
-
-	// Add subscription.
-	ch := make(chan *discoverd.Event, 1)
-	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
-
-	// Heartbeat instance for a little bit.
-	for i := 0; i < 10; i++ {
-		if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
-			t.Fatal(err)
-		}
-		time.Sleep(s.InstanceTTL / 2)
-	}
 
-	// Run expiry, however, instance should not be expired.
-	if err := s.EnforceExpiry(); err != nil {
+	// Re-electing the same leader changes nothing.
+	index := s.LastIndex()
+	if err := s.SetServiceLeader("service0", "inst0"); err != nil {
 		t.Fatal(err)
+	} else if s.LastIndex() != index {
+		t.Fatalf("unexpected index: %d", s.LastIndex())
 	}
-
-	// Verify that the instance has not been expired.
 	select {
 	case e := <-ch:
 		t.Fatalf("unexpected event: %#v", e)
 	default:
 	}
+}
 
-	// Wait for TTL and then enforce expiry.
-	time.Sleep(2 * s.InstanceTTL)
-	if err := s.EnforceExpiry(); err != nil {
+// Ensure the store can force a failover to the next-oldest instance,
+// sending a "leader" event.
+// Ensure the "newest" leader type elects the most recently registered
+// instance.
+func TestStore_LeaderType_Newest(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeNewest}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Verify "down" event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
-		Service:  "service0",
-		Kind:     discoverd.EventKindDown,
-		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
-	}) {
-		t.Fatalf("unexpected event: %#v", e)
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %#v", leader)
 	}
 }
 
-// Ensure the store returns an error if it has not been leader for long enough.
-func TestStore_EnforceExpiry_ErrLeaderWait(t *testing.T) {
+// Ensure the "lexicographic" leader type elects the instance with the lowest
+// address.
+func TestStore_LeaderType_Lexicographic(t *testing.T) {
 	s := MustOpenStore()
-	s.InstanceTTL = 10 * time.Second
 	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeLexicographic}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "host2:80"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "host1:80"}); err != nil {
+		t.Fatal(err)
+	}
 
-	// Attempting to expire instances before leadership has been established
-	// for 2x TTL should return a "leader wait" error.
-	if err := s.EnforceExpiry(); err != server.ErrLeaderWait {
-		t.Fatalf("unexpected error: %s", err)
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %#v", leader)
 	}
 }
 
-// Ensure the store can store meta data for a service.
-func TestStore_SetServiceMeta_Create(t *testing.T) {
+// Ensure the "meta-priority" leader type elects the instance with the highest
+// numeric value of the configured meta key, falling back to the oldest
+// instance when priorities tie.
+func TestStore_LeaderType_MetaPriority(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.AddService("service0", nil); err != nil {
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeMetaPriority}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Meta: map[string]string{"priority": "1"}}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Meta: map[string]string{"priority": "10"}}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2"}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Set metadata.
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+	if leader, err := s.ServiceLeader("service0"); err != nil {
 		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %#v", leader)
 	}
 
-	// Verify metadata was updated.
-	if m := s.ServiceMeta("service0"); !reflect.DeepEqual(m, &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 3}) {
-		t.Fatalf("unexpected meta: %#v", m)
+	// Removing the prioritized instance falls back to the oldest of the
+	// remaining tied instances.
+	if err := s.RemoveInstance("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %#v", leader)
 	}
 }
 
-// Ensure the store returns an error when creating service meta that already exists.
-func TestStore_SetServiceMeta_Create_ErrObjectExists(t *testing.T) {
+// Ensure per-proto leader election elects and broadcasts a leader for each
+// protocol the service's instances register.
+func TestStore_LeaderPerProto(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.AddService("service0", nil); err != nil {
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest, LeaderPerProto: true}); err != nil {
 		t.Fatal(err)
-	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Proto: "http"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Proto: "tcp"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2", Proto: "tcp"}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Create metadata with index=0.
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 0}); err == nil || err.Error() != `object_exists: Service metadata for "service0" already exists, use index=n to set` {
-		t.Fatalf("unexpected error: %v", err)
+	// Each proto has its own leader; the service-wide leader is unchanged.
+	if leader, err := s.ProtoLeader("service0", "http"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected http leader: %#v", leader)
 	}
-}
-
-// Ensure the store can update existing meta data for a service.
-func TestStore_SetServiceMeta_Update(t *testing.T) {
-	s := MustOpenStore()
-	defer s.Close()
-	if err := s.AddService("service0", nil); err != nil {
+	if leader, err := s.ProtoLeader("service0", "tcp"); err != nil {
 		t.Fatal(err)
-	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected tcp leader: %#v", leader)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
 		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %#v", leader)
 	}
 
-	// Update using previous index.
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 3}); err != nil {
+	// Removing a proto's leader moves leadership within the proto and
+	// broadcasts a "leader" event carrying the proto.
+	ch := make(chan *discoverd.Event, 4)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
+	if err := s.RemoveInstance("service0", "inst1"); err != nil {
 		t.Fatal(err)
 	}
-
-	// Verify metadata was updated.
-	if m := s.ServiceMeta("service0"); !reflect.DeepEqual(m, &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 4}) {
-		t.Fatalf("unexpected meta: %#v", m)
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:  "service0",
+		Kind:     discoverd.EventKindLeader,
+		Proto:    "tcp",
+		Instance: &discoverd.Instance{ID: "inst2", Index: 5, Proto: "tcp"},
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store returns an error when updating a non-existent service meta.
-func TestStore_SetServiceMeta_Update_ErrPreconditionFailed_Create(t *testing.T) {
+// Ensure the store aggregates declared dependencies into a graph and warns
+// dependent services when a dependency loses its last healthy instance.
+func TestStore_Dependencies(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.AddService("service0", nil); err != nil {
+	if err := s.AddService("web", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddService("db", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("web", &discoverd.Instance{ID: "inst0", Meta: map[string]string{"depends": "db"}}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("db", &discoverd.Instance{ID: "inst1"}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Update metadata with index>0.
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 100}); err == nil || err.Error() != `precondition_failed: Service metadata for "service0" does not exist, use index=0 to set` {
-		t.Fatalf("unexpected error: %v", err)
+	if deps := s.Dependencies(); !reflect.DeepEqual(deps, map[string][]string{"web": {"db"}}) {
+		t.Fatalf("unexpected graph: %#v", deps)
+	}
+	if missing := s.MissingDependencies(); len(missing) != 0 {
+		t.Fatalf("unexpected missing dependencies: %#v", missing)
+	}
+
+	// Removing the last db instance warns the dependent service.
+	ch := make(chan *discoverd.Event, 4)
+	s.Subscribe("web", false, discoverd.EventKindDependencyDown, ch)
+	if err := s.RemoveInstance("db", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindDependencyDown || e.Service != "web" || e.Dependency != "db" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if missing := s.MissingDependencies(); !reflect.DeepEqual(missing, map[string][]string{"web": {"db"}}) {
+		t.Fatalf("unexpected missing dependencies: %#v", missing)
+	}
+
+	// The warning rearms once the dependency recovers.
+	if err := s.AddInstance("db", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.RemoveInstance("db", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Dependency != "db" {
+		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store returns an error when updating service meta with the wrong CAS index.
-func TestStore_SetServiceMeta_Update_ErrPreconditionFailed_WrongIndex(t *testing.T) {
+func TestStore_FailoverServiceLeader(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
 	if err := s.AddService("service0", nil); err != nil {
 		t.Fatal(err)
-	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2"}); err != nil {
 		t.Fatal(err)
 	}
 
-	// Update metadata with wrong previous index.
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 100}); err == nil || err.Error() != `precondition_failed: Service metadata for "service0" exists, but wrong index provided` {
-		t.Fatalf("unexpected error: %v", err)
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
+
+	// Force a failover without naming a target.
+	if err := s.FailoverServiceLeader("service0", ""); err != nil {
+		t.Fatal(err)
 	}
-}
 
-// Ensure the store returns an error when setting metadata for a non-existent service.
-func TestStore_SetServiceMeta_ErrNotFound(t *testing.T) {
-	s := MustOpenStore()
-	defer s.Close()
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); !server.IsNotFound(err) {
+	// Verify the next-oldest instance was promoted.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:     "service0",
+		Kind:        discoverd.EventKindLeader,
+		Instance:    &discoverd.Instance{ID: "inst1", Index: 4},
+		LeaderToken: 6,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Force a failover to a specific instance.
+	if err := s.FailoverServiceLeader("service0", "inst2"); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst2" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+
+	// Failing over to a missing instance returns an error.
+	if err := s.FailoverServiceLeader("service0", "inst9"); !server.IsNotFound(err) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
 
-// Ensure the store can set metadata and a leader at the same time for the service.
-func TestStore_SetServiceMeta_Leader(t *testing.T) {
+// Ensure the minimum leadership hold defers electing a replacement leader
+// until the grace period passes, and that a returning leader keeps the
+// leadership without any events being broadcast.
+func TestStore_LeaderHold(t *testing.T) {
 	s := MustOpenStore()
+	s.LeaderHoldTime = 100 * time.Millisecond
 	defer s.Close()
-	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+	if err := s.AddService("service0", nil); err != nil {
 		t.Fatal(err)
 	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
 		t.Fatal(err)
@@ -605,40 +950,52 @@ func TestStore_SetServiceMeta_Leader(t *testing.T) {
 
 	// Add subscription.
 	ch := make(chan *discoverd.Event, 2)
-	s.Subscribe("service0", false, discoverd.EventKindLeader|discoverd.EventKindServiceMeta, ch)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
 
-	// Set metadata and leader.
-	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), LeaderID: "inst1", Index: 0}); err != nil {
+	// Remove the leader and verify no replacement is elected during the
+	// grace period.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
 		t.Fatal(err)
 	}
-
-	expected := &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 5}
-	// Verify metadata was updated.
-	if m := s.ServiceMeta("service0"); !reflect.DeepEqual(m, expected) {
-		t.Fatalf("unexpected meta: %#v", m)
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
 	}
 
-	// Verify service meta event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
-		Service:     "service0",
-		Kind:        discoverd.EventKindServiceMeta,
-		ServiceMeta: expected,
-	}) {
+	// Re-register the leader within the grace period and verify it keeps
+	// the leadership without a leader event.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-ch:
 		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %#v", leader)
 	}
 
-	// Verify leader event was received.
-	if e := <-ch; !reflect.DeepEqual(e, &discoverd.Event{
-		Service:  "service0",
-		Kind:     discoverd.EventKindLeader,
-		Instance: &discoverd.Instance{ID: "inst1", Index: 4},
-	}) {
+	// Remove the leader again and let the hold expire; enforcing the holds
+	// should elect the remaining instance.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * s.LeaderHoldTime)
+	if err := s.EnforceLeaderHolds(); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindLeader || e.Instance == nil || e.Instance.ID != "inst1" {
 		t.Fatalf("unexpected event: %#v", e)
 	}
 }
 
-// Ensure the store can manually set a leader for a manual service.
-func TestStore_SetLeader(t *testing.T) {
+// Ensure the store issues monotonically increasing fencing tokens for each
+// leadership change.
+func TestStore_LeaderToken(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
 	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
@@ -649,70 +1006,2617 @@ func TestStore_SetLeader(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Set the leader instance ID.
-	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
-		t.Fatal(err)
+	if token := s.LeaderToken("service0"); token != 0 {
+		t.Fatalf("unexpected token: %d", token)
+	}
+
+	// Electing a leader issues a token.
+	if err := s.SetServiceLeader("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+	token := s.LeaderToken("service0")
+	if token == 0 {
+		t.Fatal("expected non-zero token")
+	}
+
+	// Re-electing the same leader keeps the token.
+	if err := s.SetServiceLeader("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	} else if other := s.LeaderToken("service0"); other != token {
+		t.Fatalf("token changed: %d != %d", other, token)
+	}
+
+	// A leadership change issues a greater token.
+	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	} else if other := s.LeaderToken("service0"); other <= token {
+		t.Fatalf("token did not increase: %d <= %d", other, token)
+	}
+}
+
+// Ensure the store can add a batch of instances across services.
+func TestStore_AddInstances(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddService("service1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a batch of instances spanning both services.
+	if err := s.AddInstances([]*discoverd.Registration{
+		{Service: "service0", Instance: &discoverd.Instance{ID: "inst0"}},
+		{Service: "service0", Instance: &discoverd.Instance{ID: "inst1"}},
+		{Service: "service1", Instance: &discoverd.Instance{ID: "inst2"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that the instances exist with the same index.
+	if a, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []*discoverd.Instance{
+		{ID: "inst0", Index: 4},
+		{ID: "inst1", Index: 4},
+	}) {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+	if a, err := s.Instances("service1"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []*discoverd.Instance{
+		{ID: "inst2", Index: 4},
+	}) {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+}
+
+// Ensure the store can add a batch of instances under a single service.
+func TestStore_AddServiceInstances(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a batch of instances to the service.
+	if err := s.AddServiceInstances("service0", []*discoverd.Instance{
+		{ID: "inst0"},
+		{ID: "inst1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that the instances exist with the same index.
+	if a, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []*discoverd.Instance{
+		{ID: "inst0", Index: 3},
+		{ID: "inst1", Index: 3},
+	}) {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+}
+
+// Ensure a consistent read returns an event index a subscription can resume
+// from without missing or double-seeing events.
+func TestStore_GetWithIndex(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take a snapshot of the service.
+	instances, index, err := s.GetWithIndex("service0", nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 || instances[0].ID != "inst0" {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+
+	// Resume from the snapshot and verify the next change is delivered
+	// exactly once, with the following event index.
+	ch := make(chan *discoverd.Event, 8)
+	if _, err := s.SubscribeSince("service0", index, discoverd.EventKindUp|discoverd.EventKindDown, ch); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:2222"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindUp || event.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", event)
+	} else if event.EventIndex != index+1 {
+		t.Fatalf("unexpected event index: %d", event.EventIndex)
+	}
+}
+
+// Ensure a service state snapshot returns instances and leadership
+// atomically.
+func TestStore_ServiceState(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:2222"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take a snapshot and verify the leader agrees with the instances.
+	state := s.ServiceState("service0")
+	if state == nil {
+		t.Fatal("expected state")
+	} else if len(state.Instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", state.Instances)
+	} else if state.LeaderID != "inst0" {
+		t.Fatalf("unexpected leader: %s", state.LeaderID)
+	} else if state.Index == 0 {
+		t.Fatal("expected event index")
+	}
+
+	// Verify an unknown service has no state.
+	if state := s.ServiceState("no_such_service"); state != nil {
+		t.Fatalf("unexpected state: %#v", state)
+	}
+}
+
+// Ensure a single-node store reports that writes reach every peer, and that
+// consistency level names parse with quorum as the default.
+func TestStore_WriteConsistency(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if c := s.WriteConsistency(); c != server.ConsistencyAll {
+		t.Fatalf("unexpected consistency: %s", c)
+	}
+
+	if c, err := server.ParseWriteConsistency(""); err != nil {
+		t.Fatal(err)
+	} else if c != server.ConsistencyQuorum {
+		t.Fatalf("unexpected consistency: %s", c)
+	}
+	if c, err := server.ParseWriteConsistency("one"); err != nil {
+		t.Fatal(err)
+	} else if c != server.ConsistencyOne {
+		t.Fatalf("unexpected consistency: %s", c)
+	}
+	if _, err := server.ParseWriteConsistency("bogus"); err == nil || err.Error() != `discoverd: invalid write consistency "bogus"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store records recently departed instances with a removal time
+// and reason, bounded per service.
+func TestStore_History(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 100 * time.Millisecond // low TTL
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Explicitly deregister an instance.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Drain an instance before deregistering it.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.Drain("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	} else if err = s.RemoveInstance("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let an instance expire.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2", Addr: "localhost:1002"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * s.InstanceTTL)
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the departures were recorded in order with their reasons.
+	h := s.History("service0")
+	if len(h) != 3 {
+		t.Fatalf("unexpected history length: %d", len(h))
+	}
+	for i, expected := range []struct{ id, reason string }{
+		{"inst0", server.DepartureReasonDeregistered},
+		{"inst1", server.DepartureReasonDrained},
+		{"inst2", server.DepartureReasonExpired},
+	} {
+		if h[i].Instance.ID != expected.id || h[i].Reason != expected.reason {
+			t.Fatalf("unexpected departure %d: %#v", i, h[i])
+		} else if h[i].DepartedAt.IsZero() {
+			t.Fatalf("expected departure %d to have a time", i)
+		}
+	}
+
+	// Verify an unknown service has no history.
+	if h := s.History("service1"); len(h) != 0 {
+		t.Fatalf("unexpected history: %#v", h)
+	}
+}
+
+// Ensure the departure history discards the oldest entries once the
+// retention bound is reached, and is dropped with its service.
+func TestStore_History_Bound(t *testing.T) {
+	s := MustOpenStore()
+	s.ServiceHistorySize = 2
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"inst0", "inst1", "inst2"} {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: id, Addr: "localhost:1000"}); err != nil {
+			t.Fatal(err)
+		} else if err = s.RemoveInstance("service0", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Verify only the most recent departures are retained.
+	h := s.History("service0")
+	if len(h) != 2 {
+		t.Fatalf("unexpected history length: %d", len(h))
+	} else if h[0].Instance.ID != "inst1" || h[1].Instance.ID != "inst2" {
+		t.Fatalf("unexpected history: %#v, %#v", h[0], h[1])
+	}
+
+	// Verify removing the service drops its history.
+	if err := s.RemoveService("service0"); err != nil {
+		t.Fatal(err)
+	} else if h := s.History("service0"); len(h) != 0 {
+		t.Fatalf("unexpected history: %#v", h)
+	}
+}
+
+// Ensure the store can migrate instances between services in one atomic
+// transaction.
+func TestStore_Transact(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("web-old", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddService("web-new", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("web-old", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("web-new", false, discoverd.EventKindUp|discoverd.EventKindLeader, ch)
+
+	// Move the instance to the new service and make it the leader.
+	if err := s.Transact([]*server.TxOp{
+		{Op: server.TxOpRemoveInstance, Service: "web-old", ID: "inst0"},
+		{Op: server.TxOpAddInstance, Service: "web-new", Instance: &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}},
+		{Op: server.TxOpSetLeader, Service: "web-new", ID: "inst0"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the instance moved.
+	if a, err := s.Instances("web-old"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 0 {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+	if a, err := s.Instances("web-new"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 1 || a[0].ID != "inst0" {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+
+	// Verify the assigned leadership and its events.
+	if leader, err := s.ServiceLeader("web-new"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindUp || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindLeader || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+}
+
+// Ensure the store rejects a transaction as a whole if any operation can't be
+// applied.
+func TestStore_Transact_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reference a non-existent instance in the second op.
+	if err := s.Transact([]*server.TxOp{
+		{Op: server.TxOpAddInstance, Service: "service0", Instance: &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}},
+		{Op: server.TxOpRemoveInstance, Service: "service0", ID: "inst9"},
+	}); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Verify that no operations were applied.
+	if a, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 0 {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+}
+
+// Ensure the store applies instance batches atomically.
+func TestStore_AddInstances_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add a batch referencing a non-existent service.
+	if err := s.AddInstances([]*discoverd.Registration{
+		{Service: "service0", Instance: &discoverd.Instance{ID: "inst0"}},
+		{Service: "no_such_service", Instance: &discoverd.Instance{ID: "inst1"}},
+	}); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Verify that no instances were registered.
+	if a, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 0 {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+}
+
+// Ensure the store rejects writes to a frozen service until it is unfrozen.
+func TestStore_SetServiceFrozen(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Freeze the service.
+	if err := s.SetServiceFrozen("service0", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Registrations, deregistrations and leader changes are rejected.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); !server.IsServiceFrozen(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.RemoveInstance("service0", "inst0"); !server.IsServiceFrozen(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.SetServiceLeader("service0", "inst0"); !server.IsServiceFrozen(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Reads continue to work.
+	if a, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 1 {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+
+	// Unfreeze the service and verify writes are accepted again.
+	if err := s.SetServiceFrozen("service0", false); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the store returns an error when freezing a non-existent service.
+func TestStore_SetServiceFrozen_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.SetServiceFrozen("no_such_service", true); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store can remove an instance from a service.
+func TestStore_RemoveInstance(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove one instance.
+	if err := s.RemoveInstance("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the remaining instances.
+	if a, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(a, []*discoverd.Instance{
+		{ID: "inst0", Index: 3},
+		{ID: "inst2", Index: 5},
+	}) {
+		t.Fatalf("unexpected instances: %#v", a)
+	}
+}
+
+// Ensure the store returns an error when removing an instance from a non-existent service.
+func TestStore_RemoveInstance_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.RemoveInstance("no_such_service", "inst0"); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store sends a "down" event when removing an existing service.
+func TestStore_RemoveInstance_DownEvent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Remove instance.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify "down" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:  "service0",
+		Kind:     discoverd.EventKindDown,
+		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
+		Reason:   discoverd.DownReasonDeregistered,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure the "down" event for an instance removed after draining reports the
+// drained reason, so automation can tell a clean shutdown from a crash.
+func TestStore_RemoveInstance_DrainedReason(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.Drain("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Remove the draining instance.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the "down" event reports the drained reason.
+	if e := <-ch; e.Reason != discoverd.DownReasonDrained {
+		t.Fatalf("unexpected reason: %q", e.Reason)
+	}
+}
+
+// Ensure the store sends a "leader" event when removing an existing service.
+func TestStore_RemoveInstance_LeaderEvent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
+
+	// Remove instance, inst1 should become leader.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify "leader" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:     "service0",
+		Kind:        discoverd.EventKindLeader,
+		Instance:    &discoverd.Instance{ID: "inst1", Index: 4},
+		LeaderToken: 5,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure removing a manually elected leader broadcasts a "leader" event with
+// no instance so watchers learn the leadership is vacant.
+func TestStore_RemoveInstance_ManualLeaderVacancy(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.SetServiceLeader("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindLeader, ch)
+
+	// Remove the leader; there is no replacement.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify a "leader" event with no instance was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service: "service0",
+		Kind:    discoverd.EventKindLeader,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Verify the leadership is vacant.
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader != nil {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+}
+
+// Ensure the store can enforce expiration of instances.
+func TestStore_EnforceExpiry(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 100 * time.Millisecond // low TTL
+	defer s.Close()
+
+	// Add service.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Heartbeat instance for a little bit.
+	for i := 0; i < 10; i++ {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(s.InstanceTTL / 2)
+	}
+
+	// Run expiry, however, instance should not be expired.
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that the instance has not been expired.
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+
+	// Wait for TTL and then enforce expiry.
+	time.Sleep(2 * s.InstanceTTL)
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify "down" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:  "service0",
+		Kind:     discoverd.EventKindDown,
+		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
+		Reason:   discoverd.DownReasonExpired,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure an instance registered with an absolute deadline is expired once it
+// passes, even while the instance keeps heartbeating.
+func TestStore_EnforceExpiry_Deadline(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 100 * time.Millisecond // low TTL to shorten the leader wait
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Register with a deadline beyond the leader wait period and keep
+	// heartbeating past it.
+	deadline := time.Now().Add(2 * s.InstanceTTL)
+	inst := &discoverd.Instance{ID: "inst0", ExpiresAt: &deadline}
+	for i := 0; i < 10; i++ {
+		if err := s.AddInstance("service0", inst); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(s.InstanceTTL / 2)
+	}
+
+	// The deadline has passed, so expiry removes the instance despite the
+	// fresh heartbeats.
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindDown || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure the store returns an error if it has not been leader for long enough.
+// Ensure the store garbage collects services that have been empty past the
+// retention period.
+func TestStore_EnforceServiceGC(t *testing.T) {
+	s := MustOpenStore()
+	s.ServiceRetention = 100 * time.Millisecond // low retention
+	defer s.Close()
+
+	// Add an empty service and one with an instance.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddService("service1", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service1", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription for the empty service.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindServiceDown, ch)
+
+	// Wait out the leader wait period and mark empty services.
+	time.Sleep(2 * s.ServiceRetention)
+	if err := s.EnforceServiceGC(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The empty service is retained until the retention period has passed.
+	if a := s.ServiceNames(); !reflect.DeepEqual(a, []string{"service0", "service1"}) {
+		t.Fatalf("unexpected services: %+v", a)
+	}
+
+	// Wait for the retention period and garbage collect.
+	time.Sleep(2 * s.ServiceRetention)
+	if err := s.EnforceServiceGC(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify only the empty service was removed.
+	if a := s.ServiceNames(); !reflect.DeepEqual(a, []string{"service1"}) {
+		t.Fatalf("unexpected services: %+v", a)
+	}
+
+	// Verify a "service down" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{Service: "service0", Kind: discoverd.EventKindServiceDown}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure the store waits for an established leader before garbage collecting services.
+func TestStore_EnforceServiceGC_ErrLeaderWait(t *testing.T) {
+	s := MustOpenStore()
+	s.ServiceRetention = 10 * time.Second
+	defer s.Close()
+
+	if err := s.EnforceServiceGC(); err != server.ErrLeaderWait {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestStore_EnforceExpiry_ErrLeaderWait(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 10 * time.Second
+	defer s.Close()
+
+	// Attempting to expire instances before leadership has been established
+	// for 2x TTL should return a "leader wait" error.
+	if err := s.EnforceExpiry(); err != server.ErrLeaderWait {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store keeps an instance alive while it renews via Heartbeat and
+// expires it once it stops renewing.
+func TestStore_Heartbeat(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 100 * time.Millisecond // low TTL
+	defer s.Close()
+
+	// Add service & instance.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Renew the instance for a little bit without re-registering.
+	for i := 0; i < 10; i++ {
+		if err := s.Heartbeat("service0", "inst0"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(s.InstanceTTL / 2)
+	}
+
+	// Run expiry, however, instance should not be expired.
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+
+	// Stop renewing, wait for the TTL and then enforce expiry.
+	time.Sleep(2 * s.InstanceTTL)
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify "down" event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:  "service0",
+		Kind:     discoverd.EventKindDown,
+		Instance: &discoverd.Instance{ID: "inst0", Index: 3},
+		Reason:   discoverd.DownReasonExpired,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure the store returns an error when renewing an unknown instance.
+func TestStore_Heartbeat_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Heartbeat("service1", "inst0"); err != (server.NotFoundError{Service: "service1"}) {
+		t.Fatalf("unexpected error: %s", err)
+	} else if err := s.Heartbeat("service0", "inst0"); err != (server.NotFoundError{Service: "service0", Instance: "inst0"}) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure a per-instance TTL overrides the store default when expiring.
+func TestStore_EnforceExpiry_InstanceTTL(t *testing.T) {
+	s := MustOpenStore()
+	s.InstanceTTL = 100 * time.Millisecond // low default TTL
+	defer s.Close()
+
+	// Add service & an instance with a much longer TTL.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", TTL: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	// Wait out the default TTL; the instance should survive expiry.
+	time.Sleep(3 * s.InstanceTTL)
+	if err := s.EnforceExpiry(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+}
+
+// Ensure the store can store meta data for a service.
+func TestStore_SetServiceMeta_Create(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set metadata.
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify metadata was updated.
+	if m := s.ServiceMeta("service0"); !reflect.DeepEqual(m, &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 3}) {
+		t.Fatalf("unexpected meta: %#v", m)
+	}
+}
+
+// Ensure the store returns an error when creating service meta that already exists.
+func TestStore_SetServiceMeta_Create_ErrObjectExists(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create metadata with index=0.
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 0}); err == nil || err.Error() != `object_exists: Service metadata for "service0" already exists, use index=n to set` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store can update existing meta data for a service.
+func TestStore_SetServiceMeta_Update(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update using previous index.
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify metadata was updated.
+	if m := s.ServiceMeta("service0"); !reflect.DeepEqual(m, &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 4}) {
+		t.Fatalf("unexpected meta: %#v", m)
+	}
+}
+
+// Ensure the store returns an error when updating a non-existent service meta.
+func TestStore_SetServiceMeta_Update_ErrPreconditionFailed_Create(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update metadata with index>0.
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 100}); err == nil || err.Error() != `precondition_failed: Service metadata for "service0" does not exist, use index=0 to set` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store returns an error when updating service meta with the wrong CAS index.
+func TestStore_SetServiceMeta_Update_ErrPreconditionFailed_WrongIndex(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update metadata with wrong previous index.
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"bar"`), Index: 100}); err == nil || err.Error() != `precondition_failed: Service metadata for "service0" exists, but wrong index provided` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store returns an error when setting metadata for a non-existent service.
+func TestStore_SetServiceMeta_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 0}); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store can set metadata and a leader at the same time for the service.
+func TestStore_SetServiceMeta_Leader(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 2)
+	s.Subscribe("service0", false, discoverd.EventKindLeader|discoverd.EventKindServiceMeta, ch)
+
+	// Set metadata and leader.
+	if err := s.SetServiceMeta("service0", &discoverd.ServiceMeta{Data: []byte(`"foo"`), LeaderID: "inst1", Index: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &discoverd.ServiceMeta{Data: []byte(`"foo"`), Index: 5}
+	// Verify metadata was updated.
+	if m := s.ServiceMeta("service0"); !reflect.DeepEqual(m, expected) {
+		t.Fatalf("unexpected meta: %#v", m)
+	}
+
+	// Verify service meta event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:     "service0",
+		Kind:        discoverd.EventKindServiceMeta,
+		ServiceMeta: expected,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Verify leader event was received.
+	if e := unstamp(<-ch); !reflect.DeepEqual(e, &discoverd.Event{
+		Service:     "service0",
+		Kind:        discoverd.EventKindLeader,
+		Instance:    &discoverd.Instance{ID: "inst1", Index: 4},
+		LeaderToken: 5,
+	}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure the store can manually set a leader for a manual service.
+func TestStore_SetLeader(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set the leader instance ID.
+	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify that the leader was set.
+	if inst, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(inst, &discoverd.Instance{ID: "inst1", Index: 4}) {
+		t.Fatalf("unexpected leader: %#v", inst)
+	}
+}
+
+// Ensure the store does not error when setting a leader for a non-existent service.
+func TestStore_SetLeader_NoService(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	} else if inst, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if inst != nil {
+		t.Fatalf("unexpected leader: %#v", inst)
+	}
+}
+
+// Ensure the store does not error when setting a leader for a non-existent instance.
+func TestStore_SetLeader_NoInstance(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	} else if inst, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if inst != nil {
+		t.Fatalf("unexpected leader: %#v", inst)
+	}
+}
+
+// Ensure the store removes blocking subscriptions.
+func TestStore_Subscribe_NoBlock(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add blocking subscription.
+	ch := make(chan *discoverd.Event, 0)
+	s.Subscribe("service0", false, discoverd.EventKindUp, ch)
+
+	// Add service.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that program does not hang.
+}
+
+// Ensure subscribing with the current state doesn't stall broadcasts to other
+// subscribers while the snapshot is still being consumed.
+func TestStore_Subscribe_SlowInitialSync(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Register instances before subscribing.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"inst0", "inst1"} {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Subscribe with an unbuffered channel and don't consume it yet. The
+	// snapshot is streamed outside the store mutex, so this must not block.
+	slow := make(chan *discoverd.Event, 0)
+	s.Subscribe("service0", true, discoverd.EventKindUp|discoverd.EventKindCurrent, slow)
+
+	// Verify another subscriber still receives a broadcast while the slow
+	// snapshot is pending.
+	fast := make(chan *discoverd.Event, 4)
+	s.Subscribe("service0", false, discoverd.EventKindUp, fast)
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-fast; e.Instance.ID != "inst2" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Drain the slow subscriber and verify the snapshot arrives in order,
+	// terminated by the "current" event, followed by the live event.
+	for i, id := range []string{"inst0", "inst1"} {
+		if e := <-slow; e.Kind != discoverd.EventKindUp || e.Instance.ID != id {
+			t.Fatalf("unexpected event %d: %#v", i, e)
+		}
+	}
+	if e := <-slow; e.Kind != discoverd.EventKindCurrent {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := <-slow; e.Kind != discoverd.EventKindUp || e.Instance.ID != "inst2" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure a wildcard subscription receives events across every service,
+// including services created after subscribing.
+func TestStore_Subscribe_Wildcard(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Add a service with an instance before subscribing.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribe to all services with the current state.
+	ch := make(chan *discoverd.Event, 4)
+	s.Subscribe(server.WildcardService, true, discoverd.EventKindUp|discoverd.EventKindCurrent, ch)
+
+	// Verify the current state was sent.
+	if e := <-ch; e.Service != "service0" || e.Kind != discoverd.EventKindUp || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindCurrent {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Register an instance on a service created after subscribing.
+	if err := s.AddService("service1", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service1", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the event was received.
+	if e := <-ch; e.Service != "service1" || e.Kind != discoverd.EventKindUp || e.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure a glob subscription tracks a family of related services without
+// knowing their names in advance.
+func TestStore_Subscribe_Glob(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Add matching and non-matching services.
+	if err := s.AddService("web-a", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("web-a", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddService("api", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribe to the family of services with the current state.
+	ch := make(chan *discoverd.Event, 4)
+	s.Subscribe("web-*", true, discoverd.EventKindUp, ch)
+
+	// Verify only the matching service's state was sent.
+	if e := <-ch; e.Service != "web-a" || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Register instances on a new matching service and the non-matching one.
+	if err := s.AddService("web-b", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("web-b", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("api", &discoverd.Instance{ID: "inst2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify only the matching service's event was received.
+	if e := <-ch; e.Service != "web-b" || e.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+}
+
+// Ensure a resumable subscription can replay missed events from the ring
+// buffer instead of re-downloading the full state.
+func TestStore_SubscribeSince(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Register an instance while nobody is subscribed.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resume from the beginning and verify the missed event is replayed
+	// with its sequence number.
+	ch := make(chan *discoverd.Event, 4)
+	if _, err := s.SubscribeSince("service0", 0, discoverd.EventKindUp, ch); err != nil {
+		t.Fatal(err)
+	}
+	e := <-ch
+	if e.Kind != discoverd.EventKindUp || e.Instance.ID != "inst0" || e.EventIndex == 0 {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Register another instance and verify the live event carries the next
+	// sequence number.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+	last := e.EventIndex
+	if e = <-ch; e.Instance.ID != "inst1" || e.EventIndex <= last {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Resume from the first event and verify only the second is replayed.
+	ch2 := make(chan *discoverd.Event, 4)
+	if _, err := s.SubscribeSince("service0", last, discoverd.EventKindUp, ch2); err != nil {
+		t.Fatal(err)
+	}
+	if e = <-ch2; e.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure resuming from an evicted event index reports a truncated log.
+func TestStore_SubscribeSince_ErrEventLogTruncated(t *testing.T) {
+	s := MustOpenStore()
+	s.EventLogSize = 2 // tiny ring buffer
+	defer s.Close()
+
+	// Broadcast more events than the ring buffer holds.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: fmt.Sprintf("inst%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ch := make(chan *discoverd.Event, 1)
+	if _, err := s.SubscribeSince("service0", 0, discoverd.EventKindUp, ch); err != server.ErrEventLogTruncated {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store can update a service's configuration at runtime,
+// broadcasting an event and re-running leader election.
+func TestStore_SetServiceConfig(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Add a manually-led service with an instance.
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 2)
+	s.Subscribe("service0", false, discoverd.EventKindServiceConfig|discoverd.EventKindLeader, ch)
+
+	// Switch to oldest-instance leader election.
+	if err := s.SetServiceConfig("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	}
+	if config := s.Config("service0"); config == nil || config.LeaderType != discoverd.LeaderTypeOldest {
+		t.Fatalf("unexpected config: %#v", config)
+	}
+
+	// Verify the config event and the newly elected leader were broadcast.
+	if e := <-ch; e.Kind != discoverd.EventKindServiceConfig {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindLeader || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure setting an unchanged config skips the raft proposal and broadcasts
+// no event.
+func TestStore_SetServiceConfig_Idempotent(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	config := &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}
+	if err := s.AddService("service0", config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Add subscription.
+	ch := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindServiceConfig, ch)
+
+	// Re-applying the current config changes nothing.
+	index := s.LastIndex()
+	if err := s.SetServiceConfig("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+		t.Fatal(err)
+	} else if s.LastIndex() != index {
+		t.Fatalf("unexpected index: %d", s.LastIndex())
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+
+	// A changed config is still applied and broadcast.
+	if err := s.SetServiceConfig("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindServiceConfig {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
+
+// Ensure the store returns an error when configuring a nonexistent service.
+func TestStore_SetServiceConfig_ErrNotFound(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.SetServiceConfig("service0", nil); err != (server.NotFoundError{Service: "service0"}) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store can filter instances by a metadata selector.
+func TestStore_InstancesFiltered(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Meta: map[string]string{"zone": "us-east"}}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Meta: map[string]string{"zone": "us-west"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err := s.InstancesFiltered("service0", server.Selector{"zone": "us-east"}); err != nil {
+		t.Fatal(err)
+	} else if len(a) != 1 || a[0].ID != "inst0" {
+		t.Fatalf("unexpected instances: %+v", a)
+	}
+}
+
+// Ensure a filtered subscription only receives instance events matching the
+// metadata selector.
+func TestStore_SubscribeFiltered(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribe with a selector.
+	ch := make(chan *discoverd.Event, 2)
+	s.SubscribeFiltered("service0", false, discoverd.EventKindUp, ch, server.Selector{"zone": "us-east"})
+
+	// Register a matching and a non-matching instance.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Meta: map[string]string{"zone": "us-west"}}); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Meta: map[string]string{"zone": "us-east"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify only the matching event was received.
+	if e := <-ch; e.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event: %#v", e)
+	default:
+	}
+}
+
+// Ensure the store can be restored from a snapshot
+// Ensure the store evicts the oldest subscriber when the per-service
+// subscriber ceiling is reached.
+func TestStore_Subscribe_MaxSubscribers(t *testing.T) {
+	s := MustOpenStore()
+	s.MaxSubscribers = 2
+	defer s.Close()
+
+	ch0 := make(chan *discoverd.Event, 1)
+	stream0 := s.Subscribe("service0", false, discoverd.EventKindUp, ch0)
+	ch1 := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindUp, ch1)
+
+	// The third subscriber evicts the oldest one.
+	ch2 := make(chan *discoverd.Event, 1)
+	s.Subscribe("service0", false, discoverd.EventKindUp, ch2)
+
+	// Verify the oldest subscription was closed with ErrSubscriberLimit.
+	select {
+	case _, ok := <-ch0:
+		if ok {
+			t.Fatal("expected closed channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for eviction")
+	}
+	if err := stream0.Err(); err != server.ErrSubscriberLimit {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Verify the eviction was counted.
+	if stats := s.EvictionStats(); stats["subscribers"] != 1 {
+		t.Fatalf("unexpected eviction stats: %#v", stats)
+	}
+}
+
+// Ensure the store rejects subscriptions over the per-service quota instead
+// of evicting an existing subscriber, and readmits once one closes.
+func TestStore_SubscribeClient_ServiceQuota(t *testing.T) {
+	s := MustOpenStore()
+	s.SubscriberQuota = 2
+	defer s.Close()
+
+	ch0 := make(chan *discoverd.Event, 1)
+	stream0, err := s.SubscribeClient("service0", "client0", false, discoverd.EventKindUp, ch0, nil, server.PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch1 := make(chan *discoverd.Event, 1)
+	if _, err := s.SubscribeClient("service0", "client1", false, discoverd.EventKindUp, ch1, nil, server.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third subscription is rejected; the existing ones are untouched.
+	ch2 := make(chan *discoverd.Event, 1)
+	_, err = s.SubscribeClient("service0", "client2", false, discoverd.EventKindUp, ch2, nil, server.PriorityNormal)
+	if !server.IsSubscriberQuotaError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err != (server.SubscriberQuotaError{Scope: "service", Key: "service0", Limit: 2}) {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	// Closing a subscription frees its slot.
+	stream0.Close()
+	ch3 := make(chan *discoverd.Event, 1)
+	if _, err := s.SubscribeClient("service0", "client2", false, discoverd.EventKindUp, ch3, nil, server.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure the store caps subscriptions per client identity across services.
+func TestStore_SubscribeClient_ClientQuota(t *testing.T) {
+	s := MustOpenStore()
+	s.ClientSubscriberQuota = 1
+	defer s.Close()
+
+	ch0 := make(chan *discoverd.Event, 1)
+	stream0, err := s.SubscribeClient("service0", "client0", false, discoverd.EventKindUp, ch0, nil, server.PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second subscription by the same client is rejected, even for
+	// another service.
+	ch1 := make(chan *discoverd.Event, 1)
+	_, err = s.SubscribeClient("service1", "client0", false, discoverd.EventKindUp, ch1, nil, server.PriorityNormal)
+	if err != (server.SubscriberQuotaError{Scope: "client", Key: "client0", Limit: 1}) {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+
+	// Other clients are unaffected.
+	ch2 := make(chan *discoverd.Event, 1)
+	if _, err := s.SubscribeClient("service0", "client1", false, discoverd.EventKindUp, ch2, nil, server.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the subscription frees the client's slot.
+	stream0.Close()
+	ch3 := make(chan *discoverd.Event, 1)
+	if _, err := s.SubscribeClient("service0", "client0", false, discoverd.EventKindUp, ch3, nil, server.PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure closing the store delivers a terminal "shutdown" event to every
+// subscriber before the channels are closed.
+func TestStore_Close_Shutdown(t *testing.T) {
+	s := MustOpenStore()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribe to a subset of kinds; the terminal event is delivered
+	// regardless of the mask.
+	ch := make(chan *discoverd.Event, 4)
+	s.Subscribe("service0", false, discoverd.EventKindDown, ch)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the terminal event arrives, followed by a clean close.
+	if e := <-ch; e.Kind != discoverd.EventKindShutdown {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e, ok := <-ch; ok {
+		t.Fatalf("expected closed channel, got: %#v", e)
+	}
+}
+
+// Ensure instances that fail their health check are marked unhealthy,
+// excluded from instance lists and leader election, and recover once the
+// probe passes again.
+func TestStore_HealthCheck(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Create a service with a TCP health check.
+	if err := s.AddService("service0", &discoverd.ServiceConfig{
+		LeaderType:  discoverd.LeaderTypeOldest,
+		HealthCheck: &discoverd.HealthCheck{Type: "tcp", Threshold: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reserve an address with nothing listening for the unhealthy instance.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	// Listen on an address for the healthy instance.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Register the unreachable instance first so it wins oldest election.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: closedAddr}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: ln.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindHealthy|discoverd.EventKindUnhealthy, ch)
+
+	// Probe the instances and verify the unreachable one went unhealthy.
+	if err := s.EnforceHealthChecks(); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindUnhealthy || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+
+	// Verify the unhealthy instance is excluded from lists and election.
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 || instances[0].ID != "inst1" {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+
+	// Start listening on the reserved address and verify the instance
+	// recovers.
+	ln2, err := net.Listen("tcp", closedAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if err := s.EnforceHealthChecks(); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindHealthy || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+}
+
+// Ensure the store can attach health info to an instance, broadcasting an
+// "update" event, and that it survives re-registration.
+func TestStore_SetInstanceHealthInfo(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 2)
+	s.Subscribe("service0", false, discoverd.EventKindUpdate, ch)
+
+	info := &discoverd.HealthInfo{Latency: 5 * time.Millisecond, FailureRate: 0.5}
+	if err := s.SetInstanceHealthInfo("service0", "inst0", info); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindUpdate || !reflect.DeepEqual(e.Changed, []string{"health_info"}) {
+		t.Fatalf("unexpected event: %#v", e)
+	} else if !reflect.DeepEqual(e.Instance.HealthInfo, info) {
+		t.Fatalf("unexpected health info: %#v", e.Instance.HealthInfo)
+	}
+
+	// Re-registering with changed metadata keeps the health info.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000", Meta: map[string]string{"foo": "bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 || !reflect.DeepEqual(instances[0].HealthInfo, info) {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+
+	// Unknown instances are rejected.
+	if err := s.SetInstanceHealthInfo("service0", "nope", info); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the health checker publishes rolling latency and failure-rate data
+// on its first probe cycle.
+func TestStore_HealthCheck_HealthInfo(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", &discoverd.ServiceConfig{
+		HealthCheck: &discoverd.HealthCheck{Type: "tcp", Threshold: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listen on an address for a healthy instance.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: ln.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 2)
+	s.Subscribe("service0", false, discoverd.EventKindUpdate, ch)
+
+	if err := s.EnforceHealthChecks(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-ch:
+		if !reflect.DeepEqual(e.Changed, []string{"health_info"}) {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+		info := e.Instance.HealthInfo
+		if info == nil || info.FailureRate != 0 || info.Latency <= 0 {
+			t.Fatalf("unexpected health info: %#v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for health info")
+	}
+}
+
+// Ensure service digests change with registered state and are stable for
+// identical state.
+func TestStore_ServiceDigests(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	digests := s.ServiceDigests()
+	if len(digests) != 1 {
+		t.Fatalf("unexpected digests: %#v", digests)
+	} else if other := s.ServiceDigests(); other["service0"] != digests["service0"] {
+		t.Fatalf("digest not stable: %d != %d", other["service0"], digests["service0"])
+	}
+
+	// Registering another instance changes the digest.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:2222"}); err != nil {
+		t.Fatal(err)
+	}
+	if other := s.ServiceDigests(); other["service0"] == digests["service0"] {
+		t.Fatalf("digest did not change: %d", other["service0"])
+	}
+}
+
+// Ensure the store can mark an instance as draining, excluding it from
+// instance lists and leader election before it deregisters.
+func TestStore_Drain(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Create a service with oldest leader election and two instances, the
+	// draining candidate first so it wins the election.
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:2222"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindDraining, ch)
+
+	// Drain the leader and verify the broadcast event.
+	if err := s.Drain("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindDraining || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	} else if event.Instance.State != discoverd.InstanceStateDraining {
+		t.Fatalf("unexpected instance state: %q", event.Instance.State)
+	}
+
+	// Draining again is a no-op.
+	if err := s.Drain("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the draining instance is excluded from lists and election.
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 || instances[0].ID != "inst1" {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+
+	// An unchanged re-registration keeps the instance draining.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+
+	// An updated registration revives the instance.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111", Meta: map[string]string{"foo": "bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+}
+
+// Ensure the store can put an instance into maintenance and back, keeping
+// its registration while excluding it from lists and leader election.
+func TestStore_SetMaintenance(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	// Create a service with oldest leader election and two instances, the
+	// maintenance candidate first so it wins the election.
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:2222"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindMaintenance, ch)
+
+	// Pull the leader into maintenance and verify the broadcast event.
+	if err := s.SetMaintenance("service0", "inst0", true); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindMaintenance || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	} else if event.Instance.State != discoverd.InstanceStateMaintenance {
+		t.Fatalf("unexpected instance state: %q", event.Instance.State)
+	}
+
+	// Setting maintenance again is a no-op.
+	if err := s.SetMaintenance("service0", "inst0", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the instance is excluded from lists and election.
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 || instances[0].ID != "inst1" {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+
+	// Clearing maintenance returns the instance to rotation and leadership.
+	if err := s.SetMaintenance("service0", "inst0", false); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindMaintenance || event.Instance.State != discoverd.InstanceStateUp {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+	if leader, err := s.ServiceLeader("service0"); err != nil {
+		t.Fatal(err)
+	} else if leader == nil || leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %#v", leader)
+	}
+
+	// Maintenance on a missing instance returns an error.
+	if err := s.SetMaintenance("service0", "inst9", true); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure the store damps the events of an instance that cycles up and down
+// faster than the flap threshold.
+func TestStore_FlapDamping(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	now := time.Now()
+	s.Store.Now = func() time.Time { return now }
+	s.Store.FlapThreshold = 3
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindUp|discoverd.EventKindDown, ch)
+
+	// Cycle the instance up and down. The fourth transition crosses the
+	// threshold, so the final "down" is delivered and the instance is held
+	// down.
+	for _, addr := range []string{"localhost:1111", "localhost:2222"} {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: addr}); err != nil {
+			t.Fatal(err)
+		} else if err := s.RemoveInstance("service0", "inst0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, expected := range []struct {
+		kind discoverd.EventKind
+		addr string
+	}{
+		{discoverd.EventKindUp, "localhost:1111"},
+		{discoverd.EventKindDown, "localhost:1111"},
+		{discoverd.EventKindUp, "localhost:2222"},
+		{discoverd.EventKindDown, "localhost:2222"},
+	} {
+		if event := <-ch; event.Kind != expected.kind || event.Instance.Addr != expected.addr {
+			t.Fatalf("unexpected event %d: %#v", i, event)
+		}
+	}
+
+	// Further cycling while damped is suppressed, but the registration
+	// itself still applies.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:3333"}); err != nil {
+		t.Fatal(err)
+	}
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 1 || instances[0].Addr != "localhost:3333" {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-ch:
+		t.Fatalf("unexpected event while damped: %#v", event)
+	default:
+	}
+
+	// The flapping instance shows up in the service stats.
+	if st := s.Store.Stats()["service0"]; st.Flapping != 1 {
+		t.Fatalf("unexpected flapping count: %d", st.Flapping)
+	}
+
+	// Once the instance stops cycling, the next "up" is delivered again.
+	now = now.Add(server.DefaultFlapWindow + server.DefaultFlapBackoff + time.Minute)
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:4444"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindUp || event.Instance.Addr != "localhost:4444" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if st := s.Store.Stats()["service0"]; st.Flapping != 0 {
+		t.Fatalf("unexpected flapping count: %d", st.Flapping)
+	}
+}
+
+// Ensure the store reports statistics for its active subscriptions.
+// Ensure one subscription can watch several named services at once.
+func TestStore_SubscribeMulti(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	for _, service := range []string{"service0", "service1", "service2"} {
+		if err := s.AddService(service, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribe to two of the services, requesting the current state.
+	// The duplicate name should be collapsed.
+	ch := make(chan *discoverd.Event, 8)
+	stream := s.SubscribeMulti([]string{"service0", "service1", "service0"}, true, discoverd.EventKindUp|discoverd.EventKindDown|discoverd.EventKindCurrent, ch)
+	defer stream.Close()
+
+	// Verify the current state of service0 and the sync sentinel arrive.
+	if e := <-ch; e.Kind != discoverd.EventKindUp || e.Service != "service0" || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindCurrent {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Mutate all three services; only events for the subscribed two
+	// should be delivered, each carrying its service.
+	if err := s.AddInstance("service1", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service2", &discoverd.Instance{ID: "inst2"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := <-ch; e.Kind != discoverd.EventKindUp || e.Service != "service1" || e.Instance.ID != "inst1" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindDown || e.Service != "service0" || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Verify the subscription appears once in the stats and closing it
+	// deregisters both services.
+	if stats := s.Subscribers(); len(stats) != 1 {
+		t.Fatalf("unexpected subscribers: %#v", stats)
+	} else if stats[0].Service != "service0,service1" {
+		t.Fatalf("unexpected subscriber service: %s", stats[0].Service)
+	}
+	stream.Close()
+	if stats := s.Subscribers(); len(stats) != 0 {
+		t.Fatalf("unexpected subscribers: %#v", stats)
+	}
+}
+
+func TestStore_Subscribers(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	stream := s.Subscribe("service0", false, discoverd.EventKindUp, ch)
+
+	// Deliver a couple of events.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:2222"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delivery is asynchronous, so wait for both events to arrive.
+	<-ch
+	<-ch
+
+	subs := s.Store.Subscribers()
+	if len(subs) != 1 {
+		t.Fatalf("unexpected subscriber count: %d", len(subs))
+	} else if sub := subs[0]; sub.ID != 1 || sub.Service != "service0" {
+		t.Fatalf("unexpected subscriber: %#v", sub)
+	} else if sub.Delivered != 2 || sub.Dropped != 0 {
+		t.Fatalf("unexpected delivery counts: %#v", sub)
+	} else if sub.QueueSize != server.DefaultSubscriberQueueSize {
+		t.Fatalf("unexpected queue size: %d", sub.QueueSize)
+	} else if sub.CreatedAt.IsZero() {
+		t.Fatal("expected created at to be set")
+	}
+
+	// Closing the subscription removes it from the list.
+	stream.Close()
+	if subs := s.Store.Subscribers(); len(subs) != 0 {
+		t.Fatalf("unexpected subscriber count: %d", len(subs))
+	}
+}
+
+// Ensure the store can update instance metadata in place with a CAS index.
+func TestStore_UpdateMeta(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := s.Instances("service0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := instances[0].Index
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindUpdate, ch)
+
+	// Update the metadata and verify the broadcast event.
+	if err := s.UpdateMeta("service0", "inst0", map[string]string{"foo": "bar"}, index); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindUpdate || event.Instance.Meta["foo"] != "bar" {
+		t.Fatalf("unexpected event: %#v", event)
+	} else if !reflect.DeepEqual(event.Changed, []string{"meta"}) {
+		t.Fatalf("unexpected changed fields: %#v", event.Changed)
+	} else if event.Instance.Index != index {
+		t.Fatalf("unexpected index: %d", event.Instance.Index)
+	}
+
+	// An unchanged update is a no-op.
+	if err := s.UpdateMeta("service0", "inst0", map[string]string{"foo": "bar"}, index); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the stored instance has the new metadata.
+	if instances, err := s.Instances("service0"); err != nil {
+		t.Fatal(err)
+	} else if instances[0].Meta["foo"] != "bar" {
+		t.Fatalf("unexpected meta: %#v", instances[0].Meta)
+	}
+}
+
+// Ensure the store rejects a metadata update carrying a stale index.
+func TestStore_UpdateMeta_ErrPreconditionFailed(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1111"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update metadata with the wrong index.
+	if err := s.UpdateMeta("service0", "inst0", map[string]string{"foo": "bar"}, 100); err == nil || !strings.Contains(err.Error(), "precondition_failed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a batching subscriber receives a bulk change as a single batch
+// event while other changes are still delivered individually.
+func TestStore_SubscribeBatch(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.SubscribeBatch("service0", discoverd.EventKindUp, ch)
+
+	// Register a batch of instances.
+	if err := s.AddInstances([]*discoverd.Registration{
+		{Service: "service0", Instance: &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}},
+		{Service: "service0", Instance: &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the whole batch arrived as one event.
+	event := <-ch
+	if event.Kind != discoverd.EventKindBatch {
+		t.Fatalf("unexpected event: %#v", event)
+	} else if len(event.Batch) != 2 {
+		t.Fatalf("unexpected batch size: %d", len(event.Batch))
+	} else if event.Batch[0].Instance.ID != "inst0" || event.Batch[1].Instance.ID != "inst1" {
+		t.Fatalf("unexpected batch events: %#v, %#v", event.Batch[0], event.Batch[1])
+	}
+
+	// Verify a single registration is still delivered individually.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2", Addr: "localhost:1002"}); err != nil {
+		t.Fatal(err)
+	}
+	if event := <-ch; event.Kind != discoverd.EventKindUp || event.Instance.ID != "inst2" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+}
+
+// Ensure a slow subscriber survives a queue overflow when the drop-oldest
+// policy is configured, and still receives the newest event.
+func TestStore_Subscribe_OverflowDropOldest(t *testing.T) {
+	s := MustOpenStore()
+	s.OverflowPolicy = server.OverflowDropOldest
+	s.SubscriberQueueSize = 1
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event)
+	stream := s.Subscribe("service0", false, discoverd.EventKindUp, ch)
+
+	// Register more instances than the queue can hold without reading.
+	for i := 0; i < 5; i++ {
+		inst := &discoverd.Instance{ID: fmt.Sprintf("inst%d", i), Addr: fmt.Sprintf("localhost:%d", 1000+i)}
+		if err := s.AddInstance("service0", inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Older events may have been dropped, but the subscription must stay
+	// open and deliver the newest event.
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				t.Fatal("subscription unexpectedly closed")
+			}
+			if event.Instance.ID == "inst4" {
+				if err := stream.Err(); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for newest event")
+		}
+	}
+}
+
+// Ensure the default overflow policy closes a subscriber whose queue is full.
+func TestStore_Subscribe_OverflowClose(t *testing.T) {
+	s := MustOpenStore()
+	s.SubscriberQueueSize = 0
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event)
+	stream := s.Subscribe("service0", false, discoverd.EventKindUp, ch)
+
+	// Register instances without reading so the queue overflows.
+	for i := 0; i < 2; i++ {
+		inst := &discoverd.Instance{ID: fmt.Sprintf("inst%d", i), Addr: fmt.Sprintf("localhost:%d", 1000+i)}
+		if err := s.AddInstance("service0", inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The overflow close happens on the fan-out worker; wait for the
+	// subscription to be deregistered before reading, since an actively
+	// reading subscriber could keep even a zero-length queue moving.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Store.Subscribers()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for deregistration")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Verify the subscription was closed with ErrSendBlocked.
+loop:
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				break loop
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for close")
+		}
+	}
+	if err := stream.Err(); err != server.ErrSendBlocked {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure a low-priority subscriber degrades to drop-oldest delivery during
+// overload instead of being closed by the default overflow policy.
+func TestStore_SubscribePriority_Degraded(t *testing.T) {
+	s := MustOpenStore()
+	s.SubscriberQueueSize = 1
+	s.OverloadThreshold = 1
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event)
+	stream := s.SubscribePriority("service0", false, discoverd.EventKindUp, ch, nil, server.PriorityLow)
+
+	// Register more instances than the queue can hold without reading.
+	for i := 0; i < 5; i++ {
+		inst := &discoverd.Instance{ID: fmt.Sprintf("inst%d", i), Addr: fmt.Sprintf("localhost:%d", 1000+i)}
+		if err := s.AddInstance("service0", inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Older events are coalesced away, but the subscription must stay open
+	// and deliver the newest event.
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				t.Fatal("subscription unexpectedly closed")
+			}
+			if event.Instance.ID == "inst4" {
+				if err := stream.Err(); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for newest event")
+		}
+	}
+}
+
+// Ensure subscription priorities parse from their API names.
+func TestSubscriptionPriority_Parse(t *testing.T) {
+	if p, err := server.ParseSubscriptionPriority(""); err != nil || p != server.PriorityNormal {
+		t.Fatalf("unexpected priority: %v, %v", p, err)
+	}
+	if p, err := server.ParseSubscriptionPriority("low"); err != nil || p != server.PriorityLow {
+		t.Fatalf("unexpected priority: %v, %v", p, err)
+	}
+	if p, err := server.ParseSubscriptionPriority("high"); err != nil || p != server.PriorityHigh {
+		t.Fatalf("unexpected priority: %v, %v", p, err)
+	}
+	if _, err := server.ParseSubscriptionPriority("bogus"); err == nil || err.Error() != `discoverd: invalid subscription priority "bogus"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the store counts delivered events per service and kind.
+func TestStore_EventStats(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.EventStats()
+	if kinds := stats["service0"]; kinds["up"].Count != 2 {
+		t.Fatalf("unexpected up stats: %#v", kinds["up"])
+	} else if kinds["down"].Count != 1 {
+		t.Fatalf("unexpected down stats: %#v", kinds["down"])
+	} else if kinds["up"].TotalLatency < 0 {
+		t.Fatalf("unexpected up latency: %d", kinds["up"].TotalLatency)
+	}
+}
+
+// Ensure the store can summarize per-service state.
+func TestStore_Stats(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeOldest}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.Drain("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 8)
+	s.Subscribe("service0", false, discoverd.EventKindAll, ch)
+
+	stats := s.Stats()
+	if st := stats["service0"]; st.Instances != 2 {
+		t.Fatalf("unexpected instance count: %d", st.Instances)
+	} else if st.Draining != 1 {
+		t.Fatalf("unexpected draining count: %d", st.Draining)
+	} else if st.LeaderID != "inst0" {
+		t.Fatalf("unexpected leader: %q", st.LeaderID)
+	} else if st.Subscribers != 1 {
+		t.Fatalf("unexpected subscriber count: %d", st.Subscribers)
+	}
+}
+
+// Ensure the store records lifecycle events in the audit log and that the
+// log can be queried by service and time range.
+func TestStore_AuditLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "discoverd-audit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	auditLog, err := server.OpenAuditLog(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	s := NewStore()
+	s.AuditLog = auditLog
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.MustWaitForLeader()
+
+	before := time.Now().Add(-time.Minute)
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.RemoveInstance("service0", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the recorded event kinds and instance details.
+	entries, err := s.AuditQuery("service0", before, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]string, len(entries))
+	for i, entry := range entries {
+		kinds[i] = entry.Kind
+	}
+	if !reflect.DeepEqual(kinds, []string{"up", "leader", "down", "leader"}) {
+		t.Fatalf("unexpected entry kinds: %#v", kinds)
+	} else if entries[0].InstanceID != "inst0" || entries[0].Addr != "localhost:1000" {
+		t.Fatalf("unexpected entry: %#v", entries[0])
+	} else if entries[0].Origin != s.Advertise.String() {
+		t.Fatalf("unexpected entry origin: %q", entries[0].Origin)
+	}
+
+	// Verify the time range filter excludes the entries.
+	if entries, err := s.AuditQuery("service0", time.Now().Add(time.Hour), time.Time{}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+}
+
+// Ensure broadcast events are stamped with the broadcasting node's clock and
+// identity so consumers can measure propagation latency.
+func TestStore_EventTimestamp(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 1)
+	stream := s.Subscribe("service0", false, discoverd.EventKindUp, ch)
+	defer stream.Close()
+
+	before := time.Now()
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-ch:
+		if event.Timestamp == 0 {
+			t.Fatal("expected event timestamp to be set")
+		} else if got := event.Time(); got.Before(before) || got.After(time.Now()) {
+			t.Fatalf("unexpected event time: %s", got)
+		} else if event.Origin != s.Advertise.String() {
+			t.Fatalf("unexpected event origin: %q", event.Origin)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+// Ensure the on-disk event log persists broadcast events so resumable
+// subscriptions survive a server restart.
+func TestStore_EventLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "discoverd-events-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	eventLog, err := server.OpenEventLog(f.Name(), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Broadcast some events with the log attached.
+	s := NewStore()
+	s.EventLog = eventLog
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	s.MustWaitForLeader()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	eventLog.Close()
+
+	// Reopen the log on a fresh store and resume a subscription from the
+	// beginning; the persisted events should be replayed.
+	eventLog, err = server.OpenEventLog(f.Name(), 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eventLog.Close()
+	other := NewStore()
+	other.EventLog = eventLog
+	if err := other.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	ch := make(chan *discoverd.Event, 16)
+	if _, err := other.SubscribeSince("service0", 0, discoverd.EventKindAll, ch); err != nil {
+		t.Fatal(err)
+	}
+	event := <-ch
+	if event.Kind != discoverd.EventKindServiceUp || event.EventIndex != 1 {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	event = <-ch
+	if event.Kind != discoverd.EventKindUp || event.EventIndex != 2 || event.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	event = <-ch
+	if event.Kind != discoverd.EventKindLeader || event.EventIndex != 3 {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+
+	// New broadcasts continue the persisted sequence.
+	other.MustWaitForLeader()
+	if err := other.AddService("service1", nil); err != nil {
+		t.Fatal(err)
+	} else if err := other.AddInstance("service1", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	}
+	if index := eventLog.LastIndex(); index != 6 {
+		t.Fatalf("unexpected last index: %d", index)
+	}
+}
+
+// Ensure the event log compacts itself once it exceeds twice its retention
+// count, keeping only the newest events.
+func TestEventLog_Compact(t *testing.T) {
+	f, err := ioutil.TempFile("", "discoverd-events-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	eventLog, err := server.OpenEventLog(f.Name(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Append more than twice the retention count.
+	for i := 1; i <= 10; i++ {
+		err := eventLog.Append(&discoverd.Event{
+			Service:    "service0",
+			Kind:       discoverd.EventKindUp,
+			EventIndex: uint64(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
+	eventLog.Close()
 
-	// Verify that the leader was set.
-	if inst, err := s.ServiceLeader("service0"); err != nil {
+	// Reopening should only find the retained tail.
+	eventLog, err = server.OpenEventLog(f.Name(), 4)
+	if err != nil {
 		t.Fatal(err)
-	} else if !reflect.DeepEqual(inst, &discoverd.Instance{ID: "inst1", Index: 4}) {
-		t.Fatalf("unexpected leader: %#v", inst)
+	}
+	defer eventLog.Close()
+	events := eventLog.Events()
+	indexes := make([]uint64, len(events))
+	for i, event := range events {
+		indexes[i] = event.EventIndex
+	}
+	if !reflect.DeepEqual(indexes, []uint64{7, 8, 9, 10}) {
+		t.Fatalf("unexpected event indexes: %v", indexes)
 	}
 }
 
-// Ensure the store does not error when setting a leader for a non-existent service.
-func TestStore_SetLeader_NoService(t *testing.T) {
+// Ensure the store can dump its state and atomically restore it elsewhere,
+// broadcasting the diff to subscribers.
+func TestStore_RestoreState(t *testing.T) {
 	s := MustOpenStore()
 	defer s.Close()
-	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+
+	// Build some state and capture a dump of it.
+	if err := s.AddService("service0", nil); err != nil {
 		t.Fatal(err)
-	} else if inst, err := s.ServiceLeader("service0"); err != nil {
+	} else if err = s.AddInstance("service0", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
 		t.Fatal(err)
-	} else if inst != nil {
-		t.Fatalf("unexpected leader: %#v", inst)
 	}
-}
-
-// Ensure the store does not error when setting a leader for a non-existent instance.
-func TestStore_SetLeader_NoInstance(t *testing.T) {
-	s := MustOpenStore()
-	defer s.Close()
-	if err := s.AddService("service0", &discoverd.ServiceConfig{LeaderType: discoverd.LeaderTypeManual}); err != nil {
+	snapshot, err := s.SnapshotState()
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := s.SetServiceLeader("service0", "inst1"); err != nil {
+	// Diverge from the dump.
+	if err := s.RemoveInstance("service0", "inst0"); err != nil {
 		t.Fatal(err)
-	} else if inst, err := s.ServiceLeader("service0"); err != nil {
+	} else if err = s.AddService("service1", nil); err != nil {
 		t.Fatal(err)
-	} else if inst != nil {
-		t.Fatalf("unexpected leader: %#v", inst)
 	}
-}
 
-// Ensure the store removes blocking subscriptions.
-func TestStore_Subscribe_NoBlock(t *testing.T) {
-	s := MustOpenStore()
-	defer s.Close()
-	if err := s.AddService("service0", nil); err != nil {
+	// Subscribe to both services.
+	ch0 := make(chan *discoverd.Event, 2)
+	s.Subscribe("service0", false, discoverd.EventKindAll, ch0)
+	ch1 := make(chan *discoverd.Event, 2)
+	s.Subscribe("service1", false, discoverd.EventKindAll, ch1)
+
+	// Restore the dump.
+	if err := s.RestoreState(snapshot); err != nil {
 		t.Fatal(err)
 	}
 
-	// Add blocking subscription.
-	ch := make(chan *discoverd.Event, 0)
-	s.Subscribe("service0", false, discoverd.EventKindUp, ch)
-
-	// Add service.
-	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+	// Verify the state matches the dump.
+	if a := s.ServiceNames(); !reflect.DeepEqual(a, []string{"service0"}) {
+		t.Fatalf("unexpected services: %+v", a)
+	}
+	if a, err := s.Instances("service0"); err != nil {
 		t.Fatal(err)
+	} else if len(a) != 1 || a[0].ID != "inst0" {
+		t.Fatalf("unexpected instances: %+v", a)
 	}
 
-	// Ensure that program does not hang.
+	// Verify the diff events were broadcast.
+	if e := <-ch0; e.Kind != discoverd.EventKindUp || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+	if e := unstamp(<-ch1); !reflect.DeepEqual(e, &discoverd.Event{Service: "service1", Kind: discoverd.EventKindServiceDown}) {
+		t.Fatalf("unexpected event: %#v", e)
+	}
 }
 
-// Ensure the store can be restored from a snapshot
 func TestStore_RestoreSnapshot(t *testing.T) {
 	// open a store, add some services and trigger a snapshot
 	s := MustOpenStore()
@@ -748,6 +3652,116 @@ func TestStore_RestoreSnapshot(t *testing.T) {
 	}
 }
 
+// Ensure the allocation-free read paths visit exactly the live instances.
+func TestStore_EachInstance(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"inst0", "inst1", "inst2"} {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Drain("service0", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// EachInstance skips the draining instance and stops when fn returns
+	// false.
+	seen := map[string]bool{}
+	s.EachInstance("service0", func(inst *discoverd.Instance) bool {
+		seen[inst.ID] = true
+		return true
+	})
+	if len(seen) != 2 || seen["inst1"] {
+		t.Fatalf("unexpected instances: %v", seen)
+	}
+	n := 0
+	s.EachInstance("service0", func(*discoverd.Instance) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatalf("expected early stop after 1 instance, got %d", n)
+	}
+
+	// AppendInstances reuses the buffer and keeps the documented order.
+	buf := make([]*discoverd.Instance, 0, 8)
+	buf = s.AppendInstances(buf[:0], "service0")
+	if len(buf) != 2 || buf[0].ID != "inst0" || buf[1].ID != "inst2" {
+		t.Fatalf("unexpected instances: %#v", buf)
+	}
+	buf = s.AppendInstances(buf[:0], "service0")
+	if len(buf) != 2 {
+		t.Fatalf("unexpected instance count after reuse: %d", len(buf))
+	}
+}
+
+// Ensure registrations over the configured memory limits are rejected.
+func TestStore_Limits(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+	s.MaxServices = 2
+	s.MaxInstances = 2
+	s.MaxMetaBytes = 16
+
+	// The service ceiling rejects a third service until one is removed.
+	if err := s.AddService("service0", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddService("service1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddService("service2", nil); !server.IsLimitError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.RemoveService("service1"); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddService("service2", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The per-service instance ceiling still allows re-registration of
+	// existing instances.
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst0"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst2"}); !server.IsLimitError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.AddInstance("service0", &discoverd.Instance{ID: "inst1", Meta: map[string]string{"a": "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch may not overshoot the ceiling either.
+	if err := s.AddInstances([]*discoverd.Registration{
+		{Service: "service2", Instance: &discoverd.Instance{ID: "inst0"}},
+		{Service: "service2", Instance: &discoverd.Instance{ID: "inst1"}},
+		{Service: "service2", Instance: &discoverd.Instance{ID: "inst2"}},
+	}); !server.IsLimitError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Oversized instance metadata is rejected.
+	meta := map[string]string{"key": "0123456789abcdefgh"}
+	if err := s.AddInstance("service2", &discoverd.Instance{ID: "inst0", Meta: meta}); !server.IsLimitError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Oversized instance annotations are rejected.
+	s.MaxAnnotationBytes = 8
+	annotations := map[string][]byte{"cert": {1, 2, 3, 4, 5}}
+	if err := s.AddInstance("service2", &discoverd.Instance{ID: "inst0", Annotations: annotations}); !server.IsLimitError(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.AddInstance("service2", &discoverd.Instance{ID: "inst0", Annotations: map[string][]byte{"cert": {1}}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkStore_AddInstance(b *testing.B) {
 	s := MustOpenStore()
 	defer s.Close()
@@ -765,6 +3779,196 @@ func BenchmarkStore_AddInstance(b *testing.B) {
 	}
 }
 
+// Ensure the allocation-free read paths really don't allocate per call.
+func BenchmarkStore_EachInstance(b *testing.B) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		b.Fatal(err)
+	}
+	const instanceN = 10
+	for i := 0; i < instanceN; i++ {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: fmt.Sprintf("inst%d", i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		n := 0
+		s.EachInstance("service0", func(*discoverd.Instance) bool {
+			n++
+			return true
+		})
+		if n != instanceN {
+			b.Fatalf("unexpected instance count: %d", n)
+		}
+	}
+}
+
+func BenchmarkStore_AppendInstances(b *testing.B) {
+	s := MustOpenStore()
+	defer s.Close()
+	if err := s.AddService("service0", nil); err != nil {
+		b.Fatal(err)
+	}
+	const instanceN = 10
+	for i := 0; i < instanceN; i++ {
+		if err := s.AddInstance("service0", &discoverd.Instance{ID: fmt.Sprintf("inst%d", i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	buf := make([]*discoverd.Instance, 0, instanceN)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf = s.AppendInstances(buf[:0], "service0")
+		if len(buf) != instanceN {
+			b.Fatalf("unexpected instance count: %d", len(buf))
+		}
+	}
+}
+
+// Ensure broadcast fan-out scales when subscribers are spread across many
+// services. Each registration broadcasts to a single service, so with the
+// sharded registry deliveries to unrelated services don't contend on one
+// lock.
+func BenchmarkStore_Broadcast(b *testing.B) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	const serviceN = 32
+	for i := 0; i < serviceN; i++ {
+		service := fmt.Sprintf("service%d", i)
+		if err := s.AddService(service, nil); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 32; j++ {
+			ch := make(chan *discoverd.Event, 1024)
+			s.Subscribe(service, false, discoverd.EventKindAll, ch)
+			go func() {
+				for range ch {
+				}
+			}()
+		}
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		inst := &discoverd.Instance{
+			ID:   fmt.Sprintf("inst%d", i%10),
+			Meta: map[string]string{"n": fmt.Sprintf("%d", i)},
+		}
+		if err := s.AddInstance(fmt.Sprintf("service%d", i%serviceN), inst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Ensure reads scale when they don't contend with registration writes.
+// The store is loaded with 10k instances and 1k subscribers, with a
+// writer registering updates concurrently with the measured reads.
+func BenchmarkStore_Instances(b *testing.B) {
+	s, stop := MustOpenBenchmarkStore(b)
+	defer stop()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.Instances("service0"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// Ensure leader lookups scale when they don't contend with registration
+// writes.
+func BenchmarkStore_ServiceLeader(b *testing.B) {
+	s, stop := MustOpenBenchmarkStore(b)
+	defer stop()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := s.ServiceLeader("service0"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// MustOpenBenchmarkStore returns a store loaded with 10k instances and 1k
+// subscribers, with a background writer continually updating instances.
+// The returned function stops the writer and closes the store.
+func MustOpenBenchmarkStore(b *testing.B) (*Store, func()) {
+	s := MustOpenStore()
+	if err := s.AddService("service0", nil); err != nil {
+		b.Fatal(err)
+	}
+
+	// Register 10k instances in batches.
+	const instanceN = 10000
+	for i := 0; i < instanceN; i += 1000 {
+		regs := make([]*discoverd.Registration, 1000)
+		for j := range regs {
+			regs[j] = &discoverd.Registration{
+				Service:  "service0",
+				Instance: &discoverd.Instance{ID: fmt.Sprintf("inst%d", i+j)},
+			}
+		}
+		if err := s.AddInstances(regs); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// Subscribe 1k watchers so broadcasts have fan-out cost.
+	for i := 0; i < 1000; i++ {
+		ch := make(chan *discoverd.Event, 1024)
+		s.Subscribe("service0", false, discoverd.EventKindAll, ch)
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+
+	// Continually update instances so reads contend with writes.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			inst := &discoverd.Instance{
+				ID:   fmt.Sprintf("inst%d", i%instanceN),
+				Meta: map[string]string{"update": fmt.Sprintf("%d", i)},
+			}
+			if err := s.AddInstance("service0", inst); err != nil {
+				return
+			}
+		}
+	}()
+
+	return s, func() {
+		close(done)
+		s.Close()
+	}
+}
+
+// unstamp clears the timestamp and origin the store assigns to broadcast
+// events, so tests can compare the remaining fields against a literal.
+func unstamp(e *discoverd.Event) *discoverd.Event {
+	e.Timestamp = 0
+	e.Origin = ""
+	return e
+}
+
 // Store represents a test wrapper for server.Store.
 type Store struct {
 	*server.Store
@@ -848,23 +4052,56 @@ func (s *Store) MustWaitForLeader() {
 
 // MockStore represents a mock implementation of Handler.Store.
 type MockStore struct {
-	LeaderFn           func() string
-	IsLeaderFn         func() bool
-	GetPeersFn         func() ([]string, error)
-	AddPeerFn          func(peer string) error
-	RemovePeerFn       func(peer string) error
-	LastIndexFn        func() uint64
-	AddServiceFn       func(service string, config *discoverd.ServiceConfig) error
-	RemoveServiceFn    func(service string) error
-	SetServiceMetaFn   func(service string, meta *discoverd.ServiceMeta) error
-	ServiceMetaFn      func(service string) *discoverd.ServiceMeta
-	AddInstanceFn      func(service string, inst *discoverd.Instance) error
-	RemoveInstanceFn   func(service, id string) error
-	InstancesFn        func(service string) ([]*discoverd.Instance, error)
-	ConfigFn           func(service string) *discoverd.ServiceConfig
-	SetServiceLeaderFn func(service, id string) error
-	ServiceLeaderFn    func(service string) (*discoverd.Instance, error)
-	SubscribeFn        func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
+	LeaderFn                func() string
+	IsLeaderFn              func() bool
+	GetPeersFn              func() ([]string, error)
+	AddPeerFn               func(peer string) error
+	RemovePeerFn            func(peer string) error
+	LastIndexFn             func() uint64
+	WriteConsistencyFn      func() server.WriteConsistency
+	ServiceNamesFn          func() []string
+	AddServiceFn            func(service string, config *discoverd.ServiceConfig) error
+	RemoveServiceFn         func(service string) error
+	RemoveServiceAsyncFn    func(service string) (string, error)
+	RenameServiceFn         func(service, newName string) error
+	RetireAliasFn           func(alias string) error
+	ServiceRemovalFn        func(id string) *server.ServiceRemoval
+	SetServiceFrozenFn      func(service string, frozen bool) error
+	SetServiceMetaFn        func(service string, meta *discoverd.ServiceMeta) error
+	ServiceMetaFn           func(service string) *discoverd.ServiceMeta
+	AddInstanceFn           func(service string, inst *discoverd.Instance) error
+	AddInstancesFn          func(regs []*discoverd.Registration) error
+	AddServiceInstancesFn   func(service string, instances []*discoverd.Instance) error
+	TransactFn              func(ops []*server.TxOp) error
+	RemoveInstanceFn        func(service, id string) error
+	DrainFn                 func(service, id string) error
+	SetMaintenanceFn        func(service, id string, maintenance bool) error
+	InstancesFn             func(service string) ([]*discoverd.Instance, error)
+	ConfigFn                func(service string) *discoverd.ServiceConfig
+	SetServiceLeaderFn      func(service, id string) error
+	FailoverServiceLeaderFn func(service, id string) error
+	ServiceLeaderFn         func(service string) (*discoverd.Instance, error)
+	ProtoLeaderFn           func(service, proto string) (*discoverd.Instance, error)
+	SubscribeFn             func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream
+	SubscribeFilteredFn     func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector) stream.Stream
+	SubscribePriorityFn     func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector, priority server.SubscriptionPriority) stream.Stream
+	SubscribeClientFn       func(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector, priority server.SubscriptionPriority) (stream.Stream, error)
+	InstancesFilteredFn     func(service string, selector server.Selector) ([]*discoverd.Instance, error)
+	GetWithIndexFn          func(service string, selector server.Selector) ([]*discoverd.Instance, uint64, error)
+	ServiceStateFn          func(service string) *server.ServiceState
+	HistoryFn               func(service string) []*server.InstanceDeparture
+	SubscribeSinceFn        func(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error)
+	SetServiceConfigFn      func(service string, config *discoverd.ServiceConfig) error
+	StatsFn                 func() map[string]server.ServiceStats
+	SubscribersFn           func() []server.SubscriberStats
+	AuditQueryFn            func(service string, from, to time.Time) ([]*server.AuditEntry, error)
+	EventStatsFn            func() map[string]map[string]server.EventKindStats
+	EvictionStatsFn         func() map[string]uint64
+	ServiceDigestsFn        func() map[string]uint64
+	DependenciesFn          func() map[string][]string
+	MissingDependenciesFn   func() map[string][]string
+	ExportFn                func() *server.ClusterExport
+	ImportFn                func(export *server.ClusterExport) error
 }
 
 func (s *MockStore) Leader() string { return s.LeaderFn() }
@@ -875,6 +4112,14 @@ func (s *MockStore) AddPeer(peer string) error    { return s.AddPeerFn(peer) }
 func (s *MockStore) RemovePeer(peer string) error { return s.RemovePeerFn(peer) }
 func (s *MockStore) LastIndex() uint64            { return s.LastIndexFn() }
 
+func (s *MockStore) WriteConsistency() server.WriteConsistency {
+	if s.WriteConsistencyFn != nil {
+		return s.WriteConsistencyFn()
+	}
+	return server.ConsistencyQuorum
+}
+func (s *MockStore) ServiceNames() []string       { return s.ServiceNamesFn() }
+
 func (s *MockStore) AddService(service string, config *discoverd.ServiceConfig) error {
 	return s.AddServiceFn(service, config)
 }
@@ -883,6 +4128,26 @@ func (s *MockStore) RemoveService(service string) error {
 	return s.RemoveServiceFn(service)
 }
 
+func (s *MockStore) RemoveServiceAsync(service string) (string, error) {
+	return s.RemoveServiceAsyncFn(service)
+}
+
+func (s *MockStore) ServiceRemoval(id string) *server.ServiceRemoval {
+	return s.ServiceRemovalFn(id)
+}
+
+func (s *MockStore) RenameService(service, newName string) error {
+	return s.RenameServiceFn(service, newName)
+}
+
+func (s *MockStore) RetireAlias(alias string) error {
+	return s.RetireAliasFn(alias)
+}
+
+func (s *MockStore) SetServiceFrozen(service string, frozen bool) error {
+	return s.SetServiceFrozenFn(service, frozen)
+}
+
 func (s *MockStore) SetServiceMeta(service string, meta *discoverd.ServiceMeta) error {
 	return s.SetServiceMetaFn(service, meta)
 }
@@ -895,10 +4160,28 @@ func (s *MockStore) AddInstance(service string, inst *discoverd.Instance) error
 	return s.AddInstanceFn(service, inst)
 }
 
+func (s *MockStore) AddInstances(regs []*discoverd.Registration) error {
+	return s.AddInstancesFn(regs)
+}
+
+func (s *MockStore) AddServiceInstances(service string, instances []*discoverd.Instance) error {
+	return s.AddServiceInstancesFn(service, instances)
+}
+
+func (s *MockStore) Transact(ops []*server.TxOp) error { return s.TransactFn(ops) }
+
 func (s *MockStore) RemoveInstance(service, id string) error {
 	return s.RemoveInstanceFn(service, id)
 }
 
+func (s *MockStore) Drain(service, id string) error {
+	return s.DrainFn(service, id)
+}
+
+func (s *MockStore) SetMaintenance(service, id string, maintenance bool) error {
+	return s.SetMaintenanceFn(service, id, maintenance)
+}
+
 func (s *MockStore) Instances(service string) ([]*discoverd.Instance, error) {
 	return s.InstancesFn(service)
 }
@@ -907,14 +4190,103 @@ func (s *MockStore) Config(service string) *discoverd.ServiceConfig {
 	return s.ConfigFn(service)
 }
 
+func (s *MockStore) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	return s.SetServiceConfigFn(service, config)
+}
+
 func (s *MockStore) SetServiceLeader(service, id string) error {
 	return s.SetServiceLeaderFn(service, id)
 }
 
+func (s *MockStore) FailoverServiceLeader(service, id string) error {
+	return s.FailoverServiceLeaderFn(service, id)
+}
+
 func (s *MockStore) ServiceLeader(service string) (*discoverd.Instance, error) {
 	return s.ServiceLeaderFn(service)
 }
 
+func (s *MockStore) ProtoLeader(service, proto string) (*discoverd.Instance, error) {
+	return s.ProtoLeaderFn(service, proto)
+}
+
 func (s *MockStore) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
 	return s.SubscribeFn(service, sendCurrent, kinds, ch)
 }
+
+func (s *MockStore) SubscribeFiltered(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector) stream.Stream {
+	if s.SubscribeFilteredFn != nil {
+		return s.SubscribeFilteredFn(service, sendCurrent, kinds, ch, selector)
+	}
+	return s.SubscribeFn(service, sendCurrent, kinds, ch)
+}
+
+func (s *MockStore) SubscribePriority(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector, priority server.SubscriptionPriority) stream.Stream {
+	if s.SubscribePriorityFn != nil {
+		return s.SubscribePriorityFn(service, sendCurrent, kinds, ch, selector, priority)
+	}
+	return s.SubscribeFiltered(service, sendCurrent, kinds, ch, selector)
+}
+
+func (s *MockStore) SubscribeClient(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector server.Selector, priority server.SubscriptionPriority) (stream.Stream, error) {
+	if s.SubscribeClientFn != nil {
+		return s.SubscribeClientFn(service, client, sendCurrent, kinds, ch, selector, priority)
+	}
+	return s.SubscribePriority(service, sendCurrent, kinds, ch, selector, priority), nil
+}
+
+func (s *MockStore) InstancesFiltered(service string, selector server.Selector) ([]*discoverd.Instance, error) {
+	if s.InstancesFilteredFn != nil {
+		return s.InstancesFilteredFn(service, selector)
+	}
+	return s.InstancesFn(service)
+}
+
+func (s *MockStore) GetWithIndex(service string, selector server.Selector) ([]*discoverd.Instance, uint64, error) {
+	if s.GetWithIndexFn != nil {
+		return s.GetWithIndexFn(service, selector)
+	}
+	instances, err := s.InstancesFiltered(service, selector)
+	return instances, 0, err
+}
+
+func (s *MockStore) ServiceState(service string) *server.ServiceState {
+	return s.ServiceStateFn(service)
+}
+
+func (s *MockStore) History(service string) []*server.InstanceDeparture {
+	return s.HistoryFn(service)
+}
+
+func (s *MockStore) SubscribeSince(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error) {
+	return s.SubscribeSinceFn(service, sinceIndex, kinds, ch)
+}
+
+func (s *MockStore) Stats() map[string]server.ServiceStats { return s.StatsFn() }
+
+func (s *MockStore) Subscribers() []server.SubscriberStats { return s.SubscribersFn() }
+
+func (s *MockStore) AuditQuery(service string, from, to time.Time) ([]*server.AuditEntry, error) {
+	return s.AuditQueryFn(service, from, to)
+}
+
+func (s *MockStore) EventStats() map[string]map[string]server.EventKindStats {
+	return s.EventStatsFn()
+}
+
+func (s *MockStore) EvictionStats() map[string]uint64 { return s.EvictionStatsFn() }
+
+func (s *MockStore) ServiceDigests() map[string]uint64 {
+	if s.ServiceDigestsFn != nil {
+		return s.ServiceDigestsFn()
+	}
+	return nil
+}
+
+func (s *MockStore) Dependencies() map[string][]string { return s.DependenciesFn() }
+
+func (s *MockStore) MissingDependencies() map[string][]string { return s.MissingDependenciesFn() }
+
+func (s *MockStore) Export() *server.ClusterExport { return s.ExportFn() }
+
+func (s *MockStore) Import(export *server.ClusterExport) error { return s.ImportFn(export) }
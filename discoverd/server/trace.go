@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"go.opencensus.io/trace"
+)
+
+// Tracing instruments the registration path and event delivery with
+// OpenCensus spans, so high tail latencies can be attributed to raft
+// consensus, store mutex contention or slow subscribers. Trace context is
+// propagated from B3 headers on the HTTP API; gRPC calls start spans from
+// the call context. Tracing is off unless EnableTracing is called, and the
+// embedding process configures samplers and exporters through the OpenCensus
+// trace package.
+
+var traceEnabled bool
+
+// EnableTracing turns on span collection. It must be called before the
+// server starts handling requests.
+func EnableTracing() { traceEnabled = true }
+
+// traceHandler wraps an HTTP handler so requests run under a server span,
+// with trace context read from incoming B3 headers, when tracing is enabled.
+func traceHandler(h http.Handler) http.Handler {
+	traced := &ochttp.Handler{Handler: h, Propagation: &b3.HTTPFormat{}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if traceEnabled {
+			traced.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// traceStart begins a span as a child of the context's span, if tracing is
+// enabled, returning nil otherwise.
+func traceStart(ctx context.Context, name string, attrs ...trace.Attribute) (context.Context, *trace.Span) {
+	if !traceEnabled {
+		return ctx, nil
+	}
+	ctx, span := trace.StartSpan(ctx, name)
+	if len(attrs) > 0 {
+		span.AddAttributes(attrs...)
+	}
+	return ctx, span
+}
+
+// traceEnd finishes a span started by traceStart, recording err as its
+// status.
+func traceEnd(span *trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
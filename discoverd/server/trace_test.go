@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+	"go.opencensus.io/trace"
+)
+
+// spanRecorder is a trace exporter that collects spans for inspection.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(sd *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, sd)
+}
+
+func (r *spanRecorder) find(name string) *trace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, sd := range r.spans {
+		if sd.Name == name {
+			return sd
+		}
+	}
+	return nil
+}
+
+// Ensure registration requests produce store spans under the trace context
+// propagated from B3 headers.
+func TestHandler_Tracing(t *testing.T) {
+	server.EnableTracing()
+	exporter := &spanRecorder{}
+	trace.RegisterExporter(exporter)
+	defer trace.UnregisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(1e-4)})
+
+	h := NewHandler()
+	h.Store.AddServiceFn = func(service string, config *discoverd.ServiceConfig) error {
+		return nil
+	}
+
+	req := MustNewHTTPRequest("PUT", "/services/abc", strings.NewReader(`{"leader_type":"manual"}`))
+	req.Header.Set("X-B3-TraceId", "463ac35c9f6413ad48485a3953bb6124")
+	req.Header.Set("X-B3-SpanId", "0020000000000001")
+	req.Header.Set("X-B3-Sampled", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	sd := exporter.find("discoverd.store.AddService")
+	if sd == nil {
+		t.Fatalf("store span not exported: %+v", exporter.spans)
+	}
+	if id := sd.SpanContext.TraceID.String(); id != "463ac35c9f6413ad48485a3953bb6124" {
+		t.Fatalf("unexpected trace id: %s", id)
+	}
+	if sd.Attributes["service"] != "abc" {
+		t.Fatalf("unexpected attributes: %+v", sd.Attributes)
+	}
+}
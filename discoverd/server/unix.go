@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// The API can additionally be served on a unix domain socket so co-located
+// agents can register without network round-trips. Connections are
+// authenticated with the peer's credentials instead of tokens: requests from
+// root or from the user running the server may write without presenting a
+// token, regardless of the ACL.
+
+// peerCredKey is the context key under which a unix connection's peer
+// credentials are stored.
+type peerCredKey struct{}
+
+// ListenUnix listens for API connections on a unix socket at path, removing
+// any stale socket left behind by a previous run.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// UnixConnContext is used as an http.Server ConnContext to attach a unix
+// socket peer's credentials to the contexts of requests arriving on the
+// connection.
+func UnixConnContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, _ = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// peerAuthorized reports whether the request arrived over a unix socket from
+// a process owned by root or by the user running the server.
+func peerAuthorized(r *http.Request) bool {
+	cred, ok := r.Context().Value(peerCredKey{}).(*syscall.Ucred)
+	return ok && (cred.Uid == 0 || int(cred.Uid) == os.Getuid())
+}
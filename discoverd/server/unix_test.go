@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure requests arriving over the unix socket are authorized by peer
+// credentials, bypassing the token ACL.
+func TestUnixSocketAuth(t *testing.T) {
+	h := NewHandler()
+	h.ACL = server.NewACL() // empty ACL denies all token writes
+
+	var called bool
+	h.Store.AddServiceFn = func(service string, config *discoverd.ServiceConfig) error {
+		called = true
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "discoverd-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "api.sock")
+	ln, err := server.ListenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h, ConnContext: server.UnixConnContext}
+	defer srv.Close()
+	go srv.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+
+	req, err := http.NewRequest("PUT", "http://unix/services/web", strings.NewReader(`{"leader_type":"oldest"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	} else if !called {
+		t.Fatal("store should have been called")
+	}
+
+	// A stale socket left by a previous run is removed on listen.
+	ln.Close()
+	if ln, err = server.ListenUnix(sock); err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
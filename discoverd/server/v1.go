@@ -0,0 +1,266 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// v1Logger records mirror sync failures.
+var v1Logger = NewLogger("v1")
+
+const (
+	// DefaultV1PollInterval is the default interval between full listings
+	// of the legacy cluster. The v1 protocol has no resumable watch, so
+	// the bridge mirrors by polling.
+	DefaultV1PollInterval = 5 * time.Second
+
+	// V1BridgeMetaKey is the meta key mirrored instances are tagged with,
+	// holding the legacy cluster URL they were mirrored from.
+	V1BridgeMetaKey = "discoverd-v1"
+)
+
+// V1ServiceUpdate is the legacy discoverd (v1) wire format for one service
+// address. v1 had no instance IDs, protocols or lifecycle states: a service
+// was a set of addresses with string attributes, and an offline update
+// meant the address went away.
+type V1ServiceUpdate struct {
+	Name    string            `json:"name"`
+	Addr    string            `json:"addr"`
+	Online  bool              `json:"online"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Created uint64            `json:"created"`
+}
+
+// V1Bridge mirrors registrations from a legacy discoverd (v1) cluster into
+// the local store, so both generations see the same services during a
+// gradual migration. Mirrored instances are tagged with the legacy cluster
+// URL under the V1BridgeMetaKey meta key and re-registered on every poll,
+// so if the legacy cluster becomes unreachable they stop being refreshed
+// and expire like any other stale registration.
+//
+// The other direction of the migration — legacy clients reading from the
+// new cluster — is served read-only by the /legacy HTTP routes, which
+// render the store in the v1 wire format. v1 writes are not accepted;
+// writers must move to the new API first.
+type V1Bridge struct {
+	// URL is the base URL of a legacy cluster node.
+	URL string
+
+	// Services restricts mirroring to the given services. Empty means
+	// every service the legacy cluster lists.
+	Services []string
+
+	// PollInterval is the interval between full listings. Zero means
+	// DefaultV1PollInterval.
+	PollInterval time.Duration
+
+	// HTTPClient is used for requests to the legacy cluster. Nil means
+	// http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Store is the local store that legacy registrations are mirrored
+	// into.
+	Store interface {
+		AddService(service string, config *discoverd.ServiceConfig) error
+		AddInstance(service string, inst *discoverd.Instance) error
+		RemoveInstance(service, id string) error
+	}
+
+	// mirrored tracks the instance IDs registered per service, so
+	// addresses that disappear from the legacy cluster are removed.
+	mirrored map[string]map[string]struct{}
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewV1Bridge returns a bridge mirroring services from the legacy cluster
+// at url.
+func NewV1Bridge(url string, services []string) *V1Bridge {
+	return &V1Bridge{
+		URL:      url,
+		Services: services,
+		mirrored: make(map[string]map[string]struct{}),
+		closing:  make(chan struct{}),
+	}
+}
+
+// Start begins polling the legacy cluster.
+func (b *V1Bridge) Start() {
+	b.wg.Add(1)
+	go b.run()
+}
+
+// Close stops the bridge. Mirrored instances are left to expire.
+func (b *V1Bridge) Close() error {
+	close(b.closing)
+	b.wg.Wait()
+	return nil
+}
+
+func (b *V1Bridge) run() {
+	defer b.wg.Done()
+	interval := b.PollInterval
+	if interval == 0 {
+		interval = DefaultV1PollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := b.sync(); err != nil {
+			v1Logger.Warn("syncing from legacy cluster", "url", b.URL, "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+// sync performs one full mirror pass: list the legacy services, register
+// their current addresses and remove mirrored instances that disappeared.
+func (b *V1Bridge) sync() error {
+	services := b.Services
+	if len(services) == 0 {
+		var err error
+		if services, err = b.legacyServices(); err != nil {
+			return err
+		}
+	}
+	for _, service := range services {
+		if err := b.syncService(service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *V1Bridge) syncService(service string) error {
+	updates, err := b.legacyUpdates(service)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Store.AddService(service, nil); err != nil && !IsServiceExists(err) {
+		return err
+	}
+
+	seen := make(map[string]struct{}, len(updates))
+	for _, update := range updates {
+		if !update.Online {
+			continue
+		}
+		inst := v1Instance(b.URL, update)
+		if err := b.Store.AddInstance(service, inst); err != nil {
+			return err
+		}
+		seen[inst.ID] = struct{}{}
+	}
+
+	// Remove previously mirrored instances that are no longer listed.
+	for id := range b.mirrored[service] {
+		if _, ok := seen[id]; !ok {
+			if err := b.Store.RemoveInstance(service, id); err != nil && !IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	b.mirrored[service] = seen
+	return nil
+}
+
+// v1Instance maps a legacy update to an instance. v1 had no protocols, so
+// mirrored instances register as "tcp" with an ID derived from the address
+// the same way the client derives default IDs.
+func v1Instance(url string, update *V1ServiceUpdate) *discoverd.Instance {
+	addr := update.Addr
+	if normalized, err := discoverd.NormalizeAddr(addr); err == nil {
+		addr = normalized
+	}
+	meta := make(map[string]string, len(update.Attrs)+1)
+	for k, v := range update.Attrs {
+		meta[k] = v
+	}
+	meta[V1BridgeMetaKey] = url
+	digest := md5.Sum([]byte("tcp-" + addr))
+	return &discoverd.Instance{
+		ID:    hex.EncodeToString(digest[:]),
+		Addr:  addr,
+		Proto: "tcp",
+		Meta:  meta,
+	}
+}
+
+func (b *V1Bridge) legacyServices() ([]string, error) {
+	var services []string
+	if err := b.legacyGet("/services", &services); err != nil {
+		return nil, err
+	}
+	return services, nil
+}
+
+func (b *V1Bridge) legacyUpdates(service string) ([]*V1ServiceUpdate, error) {
+	var updates []*V1ServiceUpdate
+	if err := b.legacyGet("/services/"+service, &updates); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+func (b *V1Bridge) legacyGet(path string, v interface{}) error {
+	client := b.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Get(b.URL + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("discoverd: legacy cluster returned %s for %s", res.Status, path)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// serveV1Services implements GET /legacy/services, listing service names
+// in the v1 wire format (a plain array of names).
+func (h *Handler) serveV1Services(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	hh.JSON(w, 200, h.Store.ServiceNames())
+}
+
+// serveV1Service implements GET /legacy/services/:service, rendering the
+// current instances as online v1 updates. The legacy protocol is served
+// read-only; v1 watchers degrade to polling this endpoint.
+func (h *Handler) serveV1Service(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := params.ByName("service")
+	instances, err := h.Store.Instances(service)
+	if IsNotFound(err) {
+		hh.ObjectNotFoundError(w, err.Error())
+		return
+	} else if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	updates := make([]*V1ServiceUpdate, 0, len(instances))
+	for _, inst := range instances {
+		updates = append(updates, &V1ServiceUpdate{
+			Name:    service,
+			Addr:    inst.Addr,
+			Online:  true,
+			Attrs:   inst.Meta,
+			Created: inst.Index,
+		})
+	}
+	hh.JSON(w, 200, updates)
+}
@@ -0,0 +1,80 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure the bridge mirrors legacy registrations into the local store with
+// the legacy-cluster meta tag, and removes addresses that go offline.
+func TestV1Bridge_Mirror(t *testing.T) {
+	// Run a fake legacy cluster serving the v1 listing protocol.
+	var mu sync.Mutex
+	updates := []*server.V1ServiceUpdate{
+		{Name: "web", Addr: "localhost:10000", Online: true, Attrs: map[string]string{"env": "prod"}},
+	}
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/services":
+			json.NewEncoder(w).Encode([]string{"web"})
+		case "/services/web":
+			json.NewEncoder(w).Encode(updates)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer legacy.Close()
+
+	// Open a local store to mirror into.
+	s := MustOpenStore()
+	defer s.Close()
+
+	b := server.NewV1Bridge(legacy.URL, nil)
+	b.PollInterval = 10 * time.Millisecond
+	b.Store = s.Store
+	b.Start()
+	defer b.Close()
+
+	// Verify the legacy address is mirrored with the cluster tag.
+	mirrored := waitForInstances(t, s.Store, "web", 1)
+	if mirrored[0].Addr != "localhost:10000" {
+		t.Fatalf("unexpected instance: %#v", mirrored[0])
+	} else if mirrored[0].Meta[server.V1BridgeMetaKey] != legacy.URL {
+		t.Fatalf("unexpected meta: %#v", mirrored[0].Meta)
+	} else if mirrored[0].Meta["env"] != "prod" {
+		t.Fatalf("unexpected meta: %#v", mirrored[0].Meta)
+	}
+
+	// Take the address offline and verify the mirror is removed.
+	mu.Lock()
+	updates[0].Online = false
+	mu.Unlock()
+	waitForInstances(t, s.Store, "web", 0)
+}
+
+// Ensure the handler renders instances in the legacy v1 wire format.
+func TestHandler_V1Service(t *testing.T) {
+	h := NewHandler()
+	h.Store.InstancesFn = func(service string) ([]*discoverd.Instance, error) {
+		return []*discoverd.Instance{
+			{ID: "inst0", Addr: "localhost:10000", Proto: "http", Meta: map[string]string{"env": "prod"}, Index: 3},
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/legacy/services/abc", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	} else if w.Body.String() != `[{"name":"abc","addr":"localhost:10000","online":true,"attrs":{"env":"prod"},"created":3}]` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+)
+
+// The wire schema is versioned so instance and event extensions — weights,
+// health info, down reasons, annotations and the newer event kinds — can
+// ship without breaking components built against the original API. A client
+// states the schema it understands in the Discoverd-API-Version header;
+// requests without the header get the latest. Responses echo the negotiated
+// version, and for old clients the payload is translated down: fields their
+// schema does not define are stripped and event kinds they do not know are
+// dropped from streams.
+
+const (
+	// APIVersionHeader is the header carrying the requested and negotiated
+	// schema version.
+	APIVersionHeader = "Discoverd-API-Version"
+
+	// APIVersionV1 is the original schema: instances carry only ID, Addr,
+	// Proto, Meta, TTL and Index, and events only Service, Kind, Instance
+	// and ServiceMeta.
+	APIVersionV1 = 1
+
+	// APIVersionLatest is the current schema.
+	APIVersionLatest = 2
+)
+
+// v1EventKinds are the event kinds the original schema defines. Others are
+// dropped from downgraded streams; v1 clients would decode them as unknown.
+const v1EventKinds = discoverd.EventKindUp | discoverd.EventKindUpdate |
+	discoverd.EventKindDown | discoverd.EventKindLeader |
+	discoverd.EventKindCurrent | discoverd.EventKindServiceMeta
+
+// negotiateAPIVersion parses the schema version requested by a client and
+// echoes the negotiated version on the response.
+func negotiateAPIVersion(w http.ResponseWriter, r *http.Request) (int, error) {
+	version := APIVersionLatest
+	if s := r.Header.Get(APIVersionHeader); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < APIVersionV1 || v > APIVersionLatest {
+			return 0, fmt.Errorf("discoverd: unsupported API version %q", s)
+		}
+		version = v
+	}
+	w.Header().Set(APIVersionHeader, strconv.Itoa(version))
+	return version, nil
+}
+
+// downgradeInstance translates an instance to an older schema. The v1 fields
+// are copied rather than the newer ones cleared, so a field added to the
+// latest schema can't leak into old clients by omission.
+func downgradeInstance(inst *discoverd.Instance, version int) *discoverd.Instance {
+	if version >= APIVersionLatest || inst == nil {
+		return inst
+	}
+	return &discoverd.Instance{
+		ID:    inst.ID,
+		Addr:  inst.Addr,
+		Proto: inst.Proto,
+		Meta:  inst.Meta,
+		TTL:   inst.TTL,
+		Index: inst.Index,
+	}
+}
+
+// downgradeInstances translates a listing to an older schema.
+func downgradeInstances(instances []*discoverd.Instance, version int) []*discoverd.Instance {
+	if version >= APIVersionLatest {
+		return instances
+	}
+	other := make([]*discoverd.Instance, len(instances))
+	for i, inst := range instances {
+		other[i] = downgradeInstance(inst, version)
+	}
+	return other
+}
+
+// downgradeEvent translates an event to an older schema, returning nil for
+// events whose kind the schema does not define.
+func downgradeEvent(event *discoverd.Event, version int) *discoverd.Event {
+	if version >= APIVersionLatest {
+		return event
+	}
+	if event.Kind&v1EventKinds == 0 {
+		return nil
+	}
+	return &discoverd.Event{
+		Service:     event.Service,
+		Kind:        event.Kind,
+		Instance:    downgradeInstance(event.Instance, version),
+		ServiceMeta: event.ServiceMeta,
+	}
+}
+
+// downgradeEvents pumps events from in to out translated to an older
+// schema, dropping the ones it does not define.
+func downgradeEvents(in, out chan *discoverd.Event, version int) {
+	defer close(out)
+	for event := range in {
+		if e := downgradeEvent(event, version); e != nil {
+			out <- e
+		}
+	}
+}
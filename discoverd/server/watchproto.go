@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/julienschmidt/httprouter"
+)
+
+// The framed watch protocol is a bidirectional alternative to the SSE stream:
+// the server sends one JSON frame per line and the client acknowledges the
+// event sequence numbers it has processed. The acknowledgements let the
+// server measure genuine consumer lag instead of inferring it from channel
+// fullness, pausing delivery when the client falls a full window behind and
+// disconnecting it only when it stays there past the ack deadline.
+
+const (
+	// DefaultWatchWindow is the number of events the watch protocol sends
+	// beyond the client's last acknowledgement before pausing.
+	DefaultWatchWindow = 64
+
+	// DefaultWatchPingInterval is how often the watch protocol pings the
+	// connection. Each ping carries the last sent and last acknowledged
+	// sequence numbers so the client can observe its own lag.
+	DefaultWatchPingInterval = 30 * time.Second
+
+	// watchAckTimeoutIntervals is the number of ping intervals a paused
+	// connection may go without an acknowledgement before it is closed.
+	watchAckTimeoutIntervals = 2
+)
+
+// watchFrame is one line of the framed watch protocol. The server sends
+// "event" and "ping" frames; the client sends "ack" frames carrying the
+// sequence number of the last event it has processed.
+type watchFrame struct {
+	Type  string           `json:"type"`
+	Seq   uint64           `json:"seq,omitempty"`
+	Acked uint64           `json:"acked,omitempty"`
+	Event *discoverd.Event `json:"event,omitempty"`
+}
+
+// serveWatch serves the framed watch protocol on a hijacked connection.
+func (h *Handler) serveWatch(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	service := params.ByName("service")
+
+	// Parse the metadata selector, if given.
+	selector, err := parseSelectorParam(r)
+	if err != nil {
+		hh.ValidationError(w, "selector", err.Error())
+		return
+	}
+
+	// Parse the delivery priority, if given.
+	priority, err := ParseSubscriptionPriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		hh.ValidationError(w, "priority", err.Error())
+		return
+	}
+
+	// Parse the unacknowledged event window, if given.
+	window := DefaultWatchWindow
+	if s := r.URL.Query().Get("window"); s != "" {
+		window, err = strconv.Atoi(s)
+		if err != nil || window <= 0 {
+			hh.ValidationError(w, "window", "discoverd: window must be a positive integer")
+			return
+		}
+	}
+
+	// Parse the ping interval, if given.
+	pingInterval := DefaultWatchPingInterval
+	if s := r.URL.Query().Get("ping"); s != "" {
+		pingInterval, err = time.ParseDuration(s)
+		if err != nil || pingInterval <= 0 {
+			hh.ValidationError(w, "ping", "discoverd: ping must be a positive duration")
+			return
+		}
+	}
+
+	// Subscribe to events on the store before taking over the connection.
+	ch := make(chan *discoverd.Event, StreamBufferSize)
+	stream := h.Store.SubscribePriority(service, true, discoverd.EventKindAll, ch, selector, priority)
+	defer stream.Close()
+
+	// Take over the connection so frames can flow both ways.
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		hh.Error(w, hh.JSONError{
+			Code:    hh.ValidationErrorCode,
+			Message: "discoverd: connection does not support the watch protocol",
+		})
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		hh.Error(w, err)
+		return
+	}
+	defer conn.Close()
+
+	bufrw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.discoverd.watch+json\r\nConnection: close\r\n\r\n")
+	if err := bufrw.Flush(); err != nil {
+		return
+	}
+
+	// Read acknowledgements from the client, keeping only the latest one.
+	acks := make(chan uint64, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dec := json.NewDecoder(bufrw.Reader)
+		for {
+			var f watchFrame
+			if err := dec.Decode(&f); err != nil {
+				return
+			}
+			if f.Type != "ack" {
+				continue
+			}
+			select {
+			case <-acks:
+			default:
+			}
+			acks <- f.Seq
+		}
+	}()
+
+	enc := json.NewEncoder(bufrw.Writer)
+	write := func(f *watchFrame) bool {
+		if err := enc.Encode(f); err != nil {
+			return false
+		}
+		return bufrw.Flush() == nil
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	var seq, acked uint64
+	lastAck := time.Now()
+	for {
+		// Pause delivery once the client lags a full window behind its
+		// last acknowledgement, leaving further events queued on the
+		// subscription where the store's slow-subscriber policy applies.
+		var events chan *discoverd.Event
+		if seq-acked < uint64(window) {
+			events = ch
+		}
+
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			seq++
+			if !write(&watchFrame{Type: "event", Seq: seq, Event: event}) {
+				return
+			}
+		case n := <-acks:
+			if n > acked {
+				acked = n
+			}
+			lastAck = time.Now()
+		case <-ticker.C:
+			// A paused connection that has not acknowledged within
+			// the deadline is genuinely stalled, not just bursty.
+			if events == nil && time.Since(lastAck) >= watchAckTimeoutIntervals*pingInterval {
+				return
+			}
+			if !write(&watchFrame{Type: "ping", Seq: seq, Acked: acked}) {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// watchTestFrame mirrors the wire format of the framed watch protocol.
+type watchTestFrame struct {
+	Type  string           `json:"type"`
+	Seq   uint64           `json:"seq,omitempty"`
+	Acked uint64           `json:"acked,omitempty"`
+	Event *discoverd.Event `json:"event,omitempty"`
+}
+
+// dialWatch connects to the handler's watch endpoint and consumes the
+// response headers, leaving the connection positioned at the first frame.
+func dialWatch(t *testing.T, addr, path string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: discoverd\r\n\r\n", path)
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	} else if !strings.Contains(status, "200 OK") {
+		t.Fatalf("unexpected status line: %q", status)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\r\n" {
+			return conn, r
+		}
+	}
+}
+
+// readWatchFrame reads and decodes the next frame.
+func readWatchFrame(t *testing.T, r *bufio.Reader) *watchTestFrame {
+	t.Helper()
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f watchTestFrame
+	if err := json.Unmarshal(line, &f); err != nil {
+		t.Fatal(err)
+	}
+	return &f
+}
+
+// Ensure the watch protocol frames events with sequence numbers and pings
+// the connection with the last acknowledged sequence.
+func TestHandler_Watch(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		if service != "abc" {
+			t.Errorf("unexpected service: %s", service)
+		} else if sendCurrent != true {
+			t.Errorf("unexpected send current: %v", sendCurrent)
+		}
+		ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0"}}
+		ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst1"}}
+		return chanStream(ch)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, r := dialWatch(t, srv.Listener.Addr().String(), "/services/abc/watch?ping=50ms")
+	defer conn.Close()
+
+	for i, id := range []string{"inst0", "inst1"} {
+		f := readWatchFrame(t, r)
+		if f.Type != "event" {
+			t.Fatalf("unexpected frame type: %q", f.Type)
+		} else if f.Seq != uint64(i+1) {
+			t.Fatalf("unexpected seq: %d", f.Seq)
+		} else if f.Event == nil || f.Event.Instance.ID != id {
+			t.Fatalf("unexpected event: %#v", f.Event)
+		}
+	}
+
+	// Acknowledge both events, then expect a ping carrying the sequence.
+	fmt.Fprintf(conn, `{"type":"ack","seq":2}`+"\n")
+	f := readWatchFrame(t, r)
+	if f.Type != "ping" {
+		t.Fatalf("unexpected frame type: %q", f.Type)
+	} else if f.Seq != 2 {
+		t.Fatalf("unexpected seq: %d", f.Seq)
+	}
+}
+
+// Ensure the watch protocol pauses once the client falls a full window
+// behind and resumes when it acknowledges.
+func TestHandler_Watch_Pause(t *testing.T) {
+	h := NewHandler()
+	h.Store.SubscribeFn = func(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+		for i := 0; i < 5; i++ {
+			ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: fmt.Sprintf("inst%d", i)}}
+		}
+		close(ch)
+		return chanStream(ch)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, r := dialWatch(t, srv.Listener.Addr().String(), "/services/abc/watch?window=2&ping=1m")
+	defer conn.Close()
+
+	// The first window of events arrives unacknowledged.
+	for i := 0; i < 2; i++ {
+		if f := readWatchFrame(t, r); f.Seq != uint64(i+1) {
+			t.Fatalf("unexpected seq: %d", f.Seq)
+		}
+	}
+
+	// Delivery pauses until the window is acknowledged.
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := r.ReadBytes('\n'); err == nil {
+		t.Fatal("expected delivery to pause")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	fmt.Fprintf(conn, `{"type":"ack","seq":2}`+"\n")
+	for i := 2; i < 4; i++ {
+		if f := readWatchFrame(t, r); f.Seq != uint64(i+1) {
+			t.Fatalf("unexpected seq: %d", f.Seq)
+		}
+	}
+
+	fmt.Fprintf(conn, `{"type":"ack","seq":4}`+"\n")
+	if f := readWatchFrame(t, r); f.Seq != 5 {
+		t.Fatalf("unexpected seq: %d", f.Seq)
+	}
+}
+
+// Ensure the watch protocol rejects an invalid window.
+func TestHandler_Watch_ErrWindow(t *testing.T) {
+	h := NewHandler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewHTTPRequest("GET", "/services/abc/watch?window=0", nil))
+	if w.Code != 400 {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+}
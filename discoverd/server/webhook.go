@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/attempt"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/julienschmidt/httprouter"
+)
+
+// webhookLogger records webhook delivery failures.
+var webhookLogger = NewLogger("webhook")
+
+// webhookAttempts is the retry strategy for webhook deliveries.
+var webhookAttempts = attempt.Strategy{
+	Min:   5,
+	Total: 30 * time.Second,
+	Delay: 500 * time.Millisecond,
+}
+
+// WebhookSignatureHeader carries the hex-encoded HMAC-SHA256 of the request
+// body, keyed with the webhook's secret, so receivers can authenticate
+// deliveries.
+const WebhookSignatureHeader = "Flynn-Discoverd-Signature"
+
+// Webhook describes a URL which receives POSTed Event JSON.
+type Webhook struct {
+	ID string `json:"id"`
+
+	// URL is the endpoint events are POSTed to.
+	URL string `json:"url"`
+
+	// Services restricts deliveries to the named services. Glob patterns
+	// are allowed. Empty means all services.
+	Services []string `json:"services,omitempty"`
+
+	// Kinds restricts deliveries to the given event kinds. Empty means all
+	// kinds.
+	Kinds []discoverd.EventKind `json:"kinds,omitempty"`
+
+	// Secret, if set, is used to sign delivery bodies with HMAC-SHA256.
+	Secret string `json:"secret,omitempty"`
+}
+
+// matches reports whether an event should be delivered to the webhook.
+func (w *Webhook) matches(event *discoverd.Event) bool {
+	if len(w.Kinds) > 0 && !event.Kind.Any(w.Kinds...) {
+		return false
+	}
+	if len(w.Services) == 0 {
+		return true
+	}
+	for _, pattern := range w.Services {
+		if ok, _ := path.Match(pattern, event.Service); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDispatcher delivers service events to registered webhooks, so
+// alerting and automation systems can integrate without holding a long-lived
+// watch connection. Webhook registrations are held in memory on the local
+// node.
+type WebhookDispatcher struct {
+	store Backend
+
+	// HTTPClient is used for deliveries. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	hooks  map[string]*Webhook
+	events chan *discoverd.Event
+	stream stream.Stream
+	wg     sync.WaitGroup
+}
+
+// NewWebhookDispatcher returns a dispatcher which delivers events from store.
+func NewWebhookDispatcher(store Backend) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:      store,
+		HTTPClient: http.DefaultClient,
+		hooks:      make(map[string]*Webhook),
+	}
+}
+
+// Start subscribes to all service events and begins dispatching them.
+func (d *WebhookDispatcher) Start() error {
+	d.events = make(chan *discoverd.Event, StreamBufferSize)
+	d.stream = d.store.Subscribe("*", false, discoverd.EventKindAll, d.events)
+	d.wg.Add(1)
+	go d.run()
+	return nil
+}
+
+// Close stops dispatching events. In-flight deliveries are allowed to
+// finish.
+func (d *WebhookDispatcher) Close() error {
+	err := d.stream.Close()
+	d.wg.Wait()
+	return err
+}
+
+// Add registers a webhook, replacing any existing webhook with the same ID.
+func (d *WebhookDispatcher) Add(hook *Webhook) error {
+	if _, err := url.Parse(hook.URL); err != nil || hook.URL == "" {
+		return hh.JSONError{Code: hh.ValidationErrorCode, Message: fmt.Sprintf("invalid webhook url: %q", hook.URL)}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hooks[hook.ID] = hook
+	return nil
+}
+
+// Remove deregisters the webhook with the given ID.
+func (d *WebhookDispatcher) Remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.hooks[id]; !ok {
+		return hh.JSONError{Code: hh.ObjectNotFoundErrorCode, Message: fmt.Sprintf("webhook not found: %q", id)}
+	}
+	delete(d.hooks, id)
+	return nil
+}
+
+// List returns the registered webhooks sorted by ID.
+func (d *WebhookDispatcher) List() []*Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hooks := make([]*Webhook, 0, len(d.hooks))
+	for _, hook := range d.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Sort(webhookSlice(hooks))
+	return hooks
+}
+
+// run dispatches incoming events until the subscription is closed.
+func (d *WebhookDispatcher) run() {
+	defer d.wg.Done()
+	for event := range d.events {
+		d.mu.Lock()
+		var hooks []*Webhook
+		for _, hook := range d.hooks {
+			if hook.matches(event) {
+				hooks = append(hooks, hook)
+			}
+		}
+		d.mu.Unlock()
+
+		for _, hook := range hooks {
+			d.wg.Add(1)
+			go func(hook *Webhook, event *discoverd.Event) {
+				defer d.wg.Done()
+				d.deliver(hook, event)
+			}(hook, event)
+		}
+	}
+}
+
+// deliver POSTs an event to a webhook, retrying on failure.
+func (d *WebhookDispatcher) deliver(hook *Webhook, event *discoverd.Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	err = webhookAttempts.Run(func() error {
+		req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if hook.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(hook.Secret))
+			mac.Write(body)
+			req.Header.Set(WebhookSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+		}
+		res, err := d.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return fmt.Errorf("webhook returned status %d", res.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		webhookLogger.Error("error delivering webhook", "fn", "deliver", "webhook.id", hook.ID, "webhook.url", hook.URL, "error", err)
+	}
+}
+
+// webhookSlice represents a sortable list of webhooks by ID.
+type webhookSlice []*Webhook
+
+func (a webhookSlice) Len() int           { return len(a) }
+func (a webhookSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a webhookSlice) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// servePutWebhook registers a webhook under the ID in the URL.
+func (h *Handler) servePutWebhook(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if h.Webhooks == nil {
+		hh.Error(w, hh.PreconditionFailedErr("webhooks are not enabled"))
+		return
+	}
+
+	hook := &Webhook{}
+	if err := json.NewDecoder(r.Body).Decode(hook); err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+	hook.ID = params.ByName("id")
+
+	if err := h.Webhooks.Add(hook); err != nil {
+		hh.Error(w, err)
+		return
+	}
+	hh.JSON(w, 200, hook)
+}
+
+// serveDeleteWebhook deregisters a webhook.
+func (h *Handler) serveDeleteWebhook(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if h.Webhooks == nil {
+		hh.Error(w, hh.PreconditionFailedErr("webhooks are not enabled"))
+		return
+	}
+	if err := h.Webhooks.Remove(params.ByName("id")); err != nil {
+		hh.Error(w, err)
+		return
+	}
+}
+
+// serveGetWebhooks lists the registered webhooks.
+func (h *Handler) serveGetWebhooks(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if h.Webhooks == nil {
+		hh.Error(w, hh.PreconditionFailedErr("webhooks are not enabled"))
+		return
+	}
+	hh.JSON(w, 200, h.Webhooks.List())
+}
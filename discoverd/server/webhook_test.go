@@ -0,0 +1,84 @@
+package server_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// Ensure the dispatcher POSTs matching events to a registered webhook with a
+// valid HMAC signature.
+func TestWebhook_Deliver(t *testing.T) {
+	s := MustOpenStore()
+	defer s.Close()
+
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	deliveries := make(chan delivery, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- delivery{body: body, signature: r.Header.Get(server.WebhookSignatureHeader)}
+	}))
+	defer srv.Close()
+
+	d := server.NewWebhookDispatcher(s.Store)
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Add(&server.Webhook{
+		ID:       "hook0",
+		URL:      srv.URL,
+		Services: []string{"web"},
+		Kinds:    []discoverd.EventKind{discoverd.EventKindUp},
+		Secret:   "s3cret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Register an instance, which matches the webhook, and remove it,
+	// which doesn't.
+	if err := s.AddService("web", nil); err != nil {
+		t.Fatal(err)
+	} else if err := s.AddInstance("web", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err := s.RemoveInstance("web", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case dl := <-deliveries:
+		event := &discoverd.Event{}
+		if err := json.Unmarshal(dl.body, event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Kind != discoverd.EventKindUp || event.Service != "web" || event.Instance.ID != "inst0" {
+			t.Fatalf("unexpected event: %#v", event)
+		}
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(dl.body)
+		if expected := hex.EncodeToString(mac.Sum(nil)); dl.signature != expected {
+			t.Fatalf("unexpected signature: %q, expected %q", dl.signature, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook delivery")
+	}
+
+	// Verify the "down" event was filtered out.
+	select {
+	case dl := <-deliveries:
+		t.Fatalf("unexpected delivery: %s", dl.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+)
+
+// xdsEndpointsPath is the path Envoy's REST-JSON xDS transport posts
+// endpoint discovery requests to. It contains a literal colon, so it is
+// matched before routing rather than registered on the router.
+const xdsEndpointsPath = "/xds/v3/discovery:endpoints"
+
+// xdsTypeURL is the resource type served by the EDS endpoint.
+const xdsTypeURL = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+
+// xdsDiscoveryRequest is the subset of the Envoy DiscoveryRequest consumed
+// by the EDS endpoint. Cluster names map directly to service names.
+type xdsDiscoveryRequest struct {
+	VersionInfo   string   `json:"version_info,omitempty"`
+	ResourceNames []string `json:"resource_names,omitempty"`
+	ResponseNonce string   `json:"response_nonce,omitempty"`
+}
+
+// xdsDiscoveryResponse is the Envoy DiscoveryResponse returned by the EDS
+// endpoint.
+type xdsDiscoveryResponse struct {
+	VersionInfo string        `json:"version_info"`
+	Resources   []interface{} `json:"resources"`
+	TypeURL     string        `json:"type_url"`
+}
+
+// xdsClusterLoadAssignment is the EDS resource for a single cluster.
+type xdsClusterLoadAssignment struct {
+	Type        string                 `json:"@type"`
+	ClusterName string                 `json:"cluster_name"`
+	Endpoints   []xdsLocalityEndpoints `json:"endpoints"`
+}
+
+// xdsLocalityEndpoints groups endpoints sharing a locality, which is mapped
+// from the "region" and "zone" instance meta keys.
+type xdsLocalityEndpoints struct {
+	Locality    *xdsLocality    `json:"locality,omitempty"`
+	LbEndpoints []xdsLbEndpoint `json:"lb_endpoints"`
+}
+
+type xdsLocality struct {
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+}
+
+type xdsLbEndpoint struct {
+	Endpoint            xdsEndpoint `json:"endpoint"`
+	HealthStatus        string      `json:"health_status"`
+	LoadBalancingWeight uint32      `json:"load_balancing_weight"`
+}
+
+type xdsEndpoint struct {
+	Address xdsAddress `json:"address"`
+}
+
+type xdsAddress struct {
+	SocketAddress xdsSocketAddress `json:"socket_address"`
+}
+
+type xdsSocketAddress struct {
+	Address   string `json:"address"`
+	PortValue int    `json:"port_value"`
+}
+
+// serveXDSEndpoints implements the Envoy Endpoint Discovery Service over
+// the REST-JSON xDS transport, so Envoy sidecars can consume registered
+// instances directly.
+func (h *Handler) serveXDSEndpoints(w http.ResponseWriter, r *http.Request) {
+	var req xdsDiscoveryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		hh.ValidationError(w, "", err.Error())
+		return
+	}
+
+	res := &xdsDiscoveryResponse{
+		Resources: make([]interface{}, 0, len(req.ResourceNames)),
+		TypeURL:   xdsTypeURL,
+	}
+
+	// The response version is the highest instance index across the
+	// requested clusters, so Envoy sees a new version whenever the
+	// instance set changes.
+	var version uint64
+
+	for _, name := range req.ResourceNames {
+		if err := ValidServiceName(name); err != nil {
+			hh.ValidationError(w, "resource_names", err.Error())
+			return
+		}
+		instances, err := h.Store.Instances(name)
+		if err != nil {
+			hh.Error(w, err)
+			return
+		}
+		for _, inst := range instances {
+			if inst.Index > version {
+				version = inst.Index
+			}
+		}
+		res.Resources = append(res.Resources, xdsClusterLoadAssignment{
+			Type:        xdsTypeURL,
+			ClusterName: name,
+			Endpoints:   xdsEndpoints(instances),
+		})
+	}
+	res.VersionInfo = strconv.FormatUint(version, 10)
+
+	hh.JSON(w, 200, res)
+}
+
+// xdsEndpoints converts instances to EDS endpoints grouped by locality.
+func xdsEndpoints(instances []*discoverd.Instance) []xdsLocalityEndpoints {
+	// Group instances by their locality meta keys, keeping the group keys
+	// sorted so the output is deterministic.
+	groups := make(map[xdsLocality][]*discoverd.Instance)
+	keys := make([]xdsLocality, 0, 1)
+	for _, inst := range instances {
+		locality := xdsLocality{Region: inst.Meta["region"], Zone: inst.Meta["zone"]}
+		if _, ok := groups[locality]; !ok {
+			keys = append(keys, locality)
+		}
+		groups[locality] = append(groups[locality], inst)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Region != keys[j].Region {
+			return keys[i].Region < keys[j].Region
+		}
+		return keys[i].Zone < keys[j].Zone
+	})
+
+	endpoints := make([]xdsLocalityEndpoints, 0, len(keys))
+	for _, locality := range keys {
+		group := xdsLocalityEndpoints{
+			LbEndpoints: make([]xdsLbEndpoint, 0, len(groups[locality])),
+		}
+		if locality != (xdsLocality{}) {
+			l := locality
+			group.Locality = &l
+		}
+		for _, inst := range groups[locality] {
+			host, portStr, err := net.SplitHostPort(inst.Addr)
+			if err != nil {
+				continue
+			}
+			port, _ := strconv.Atoi(portStr)
+
+			status := "HEALTHY"
+			if inst.State == discoverd.InstanceStateDraining {
+				status = "DRAINING"
+			}
+
+			group.LbEndpoints = append(group.LbEndpoints, xdsLbEndpoint{
+				Endpoint: xdsEndpoint{
+					Address: xdsAddress{
+						SocketAddress: xdsSocketAddress{Address: host, PortValue: port},
+					},
+				},
+				HealthStatus:        status,
+				LoadBalancingWeight: uint32(inst.EffectiveWeight()),
+			})
+		}
+		endpoints = append(endpoints, group)
+	}
+	return endpoints
+}
@@ -0,0 +1,758 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// zkLogger records watch stream failures and dropped subscriber events.
+var zkLogger = NewLogger("zookeeper")
+
+// DefaultZKPrefix is the znode prefix registrations are stored under when
+// ZKConfig.Prefix is empty.
+const DefaultZKPrefix = "/discoverd"
+
+// Errors a ZKConn implementation must translate its client's errors into,
+// so the backend can map them onto the discoverd error types.
+var (
+	// ErrZKNoNode is returned by Get, Set and Delete when the znode does
+	// not exist.
+	ErrZKNoNode = errors.New("discoverd: zookeeper node does not exist")
+
+	// ErrZKNodeExists is returned by Create when the znode already
+	// exists.
+	ErrZKNodeExists = errors.New("discoverd: zookeeper node already exists")
+)
+
+// ZKStat is the subset of a znode's stat the backend uses. Zxids are
+// cluster-wide and monotonic, so they stand in for the store's indexes the
+// way etcd revisions do for the etcd backend.
+type ZKStat struct {
+	// Czxid is the zxid of the transaction that created the znode.
+	Czxid uint64
+
+	// Mzxid is the zxid of the transaction that last modified the znode.
+	Mzxid uint64
+}
+
+// ZKEventType is the type of a watch notification.
+type ZKEventType int
+
+const (
+	ZKEventCreated ZKEventType = iota
+	ZKEventChanged
+	ZKEventDeleted
+)
+
+// ZKEvent is a watch notification for one znode. ZooKeeper notifications
+// carry no data, so the backend re-reads changed znodes and keeps a mirror
+// of instance data to resolve deletions.
+type ZKEvent struct {
+	Type ZKEventType
+	Path string
+}
+
+// ZKConn is the narrow ZooKeeper client interface the backend needs. No
+// client library is bundled; a *zk.Conn from a library such as go-zookeeper
+// satisfies it with a small wrapper that translates errors to ErrZKNoNode
+// and ErrZKNodeExists and re-arms watches into the subtree channel.
+type ZKConn interface {
+	// Create creates a znode with the given data. Ephemeral znodes are
+	// removed by the server when the session ends.
+	Create(path string, data []byte, ephemeral bool) error
+
+	// Set replaces the data of an existing znode.
+	Set(path string, data []byte) error
+
+	// Get returns the data and stat of a znode.
+	Get(path string) ([]byte, *ZKStat, error)
+
+	// Children returns the names of the znode's children.
+	Children(path string) ([]string, error)
+
+	// Delete removes a znode, which must have no children.
+	Delete(path string) error
+
+	// Watch delivers notifications for every znode under path until the
+	// connection is closed, at which point the channel is closed.
+	Watch(path string) (<-chan ZKEvent, error)
+}
+
+// ZKConfig configures a ZKBackend.
+type ZKConfig struct {
+	// Conn is the ZooKeeper connection. Required.
+	Conn ZKConn
+
+	// Prefix is the znode prefix state is stored under. Empty means
+	// DefaultZKPrefix. Multiple discoverd façades sharing a ZooKeeper
+	// ensemble should use distinct prefixes.
+	Prefix string
+}
+
+// ZKBackend is a Backend that stores registrations in a ZooKeeper ensemble,
+// for organizations standardized on ZooKeeper that want the discoverd API
+// without running another stateful service. Instances are ephemeral znodes,
+// so registrations live as long as the façade's session and vanish with it;
+// subscriptions are fed by a single watch on the znode prefix.
+//
+// The same caveats apply as for EtcdBackend: features that depend on the
+// raft store's replicated state machine — transactions, renames, freezes,
+// the audit log, departure history and resumable subscriptions — return
+// errors or empty results, and leader election is first-registered unless a
+// leader znode names another instance.
+type ZKBackend struct {
+	conn   ZKConn
+	prefix string
+
+	subs      adapterSubs
+	watchOnce sync.Once
+
+	// mirror resolves deleted instance znodes to their last known data,
+	// since ZooKeeper deletion notifications carry none. Guarded by mu.
+	mu     sync.Mutex
+	mirror map[string]*discoverd.Instance
+
+	// lastIndex is the highest zxid observed in a stat, reported as the
+	// store index.
+	lastIndex uint64
+}
+
+// NewZKBackend returns a backend storing registrations in the ZooKeeper
+// ensemble behind config.Conn.
+func NewZKBackend(config ZKConfig) *ZKBackend {
+	b := &ZKBackend{
+		conn:   config.Conn,
+		prefix: config.Prefix,
+		mirror: make(map[string]*discoverd.Instance),
+	}
+	if b.prefix == "" {
+		b.prefix = DefaultZKPrefix
+	}
+	return b
+}
+
+// Close closes any active subscriptions. The connection itself belongs to
+// the caller.
+func (b *ZKBackend) Close() error {
+	b.subs.closeAll()
+	return nil
+}
+
+// Znode layout under the prefix:
+//
+//	<prefix>/services/<service>                 ServiceConfig JSON
+//	<prefix>/services/<service>/meta            ServiceMeta JSON
+//	<prefix>/services/<service>/leader          instance ID
+//	<prefix>/services/<service>/instances       parent
+//	<prefix>/services/<service>/instances/<id>  Instance JSON, ephemeral
+
+func (b *ZKBackend) servicesKey() string {
+	return b.prefix + "/services"
+}
+
+func (b *ZKBackend) serviceKey(service string) string {
+	return b.servicesKey() + "/" + service
+}
+
+func (b *ZKBackend) instanceKey(service, id string) string {
+	return b.serviceKey(service) + "/instances/" + id
+}
+
+// ensurePath creates each segment of path, ignoring segments that already
+// exist, since ZooKeeper requires parents to be created explicitly.
+func (b *ZKBackend) ensurePath(path string) error {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	node := ""
+	for _, segment := range segments {
+		node += "/" + segment
+		if err := b.conn.Create(node, nil, false); err != nil && err != ErrZKNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// observeStat tracks the highest zxid seen, mirroring how the etcd backend
+// tracks the cluster revision.
+func (b *ZKBackend) observeStat(stat *ZKStat) {
+	if stat == nil {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&b.lastIndex)
+		if stat.Mzxid <= old || atomic.CompareAndSwapUint64(&b.lastIndex, old, stat.Mzxid) {
+			return
+		}
+	}
+}
+
+// zkUnsupported is returned by operations the ZooKeeper mapping cannot
+// provide.
+func zkUnsupported(op string) error {
+	return fmt.Errorf("discoverd: %s is not supported by the zookeeper backend", op)
+}
+
+// Leader returns an empty address: every façade node writes to ZooKeeper
+// directly, so there is nothing to proxy writes to.
+func (b *ZKBackend) Leader() string { return "" }
+
+func (b *ZKBackend) ServiceNames() []string {
+	names, err := b.conn.Children(b.servicesKey())
+	if err != nil {
+		return nil
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b *ZKBackend) serviceExists(service string) (bool, error) {
+	_, _, err := b.conn.Get(b.serviceKey(service))
+	if err == ErrZKNoNode {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *ZKBackend) AddService(service string, config *discoverd.ServiceConfig) error {
+	if err := ValidServiceName(service); err != nil {
+		return err
+	}
+	if config == nil {
+		config = DefaultServiceConfig
+	}
+	value, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := b.ensurePath(b.servicesKey()); err != nil {
+		return err
+	}
+	if err := b.conn.Create(b.serviceKey(service), value, false); err != nil {
+		if err == ErrZKNodeExists {
+			return ServiceExistsError(service)
+		}
+		return err
+	}
+	return b.conn.Create(b.serviceKey(service)+"/instances", nil, false)
+}
+
+// RemoveService deletes the service's subtree, children first since
+// ZooKeeper only deletes empty znodes.
+func (b *ZKBackend) RemoveService(service string) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	return b.deleteRecursive(b.serviceKey(service))
+}
+
+func (b *ZKBackend) deleteRecursive(path string) error {
+	children, err := b.conn.Children(path)
+	if err != nil && err != ErrZKNoNode {
+		return err
+	}
+	for _, child := range children {
+		if err := b.deleteRecursive(path + "/" + child); err != nil {
+			return err
+		}
+	}
+	if err := b.conn.Delete(path); err != nil && err != ErrZKNoNode {
+		return err
+	}
+	return nil
+}
+
+func (b *ZKBackend) RemoveServiceAsync(service string) (string, error) {
+	return "", zkUnsupported("asynchronous service removal")
+}
+
+func (b *ZKBackend) ServiceRemoval(id string) *ServiceRemoval { return nil }
+
+func (b *ZKBackend) RenameService(service, newName string) error {
+	return zkUnsupported("service rename")
+}
+
+func (b *ZKBackend) RetireAlias(alias string) error {
+	return zkUnsupported("alias retirement")
+}
+
+func (b *ZKBackend) SetServiceFrozen(service string, frozen bool) error {
+	return zkUnsupported("service freeze")
+}
+
+// SetServiceMeta stores the service metadata. The optimistic Index check is
+// not enforced; last write wins.
+func (b *ZKBackend) SetServiceMeta(service string, meta *discoverd.ServiceMeta) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	key := b.serviceKey(service) + "/meta"
+	if err := b.conn.Set(key, value); err == ErrZKNoNode {
+		err = b.conn.Create(key, value, false)
+	} else if err != nil {
+		return err
+	}
+	if _, stat, err := b.conn.Get(key); err == nil {
+		b.observeStat(stat)
+		meta.Index = stat.Mzxid
+	}
+	return nil
+}
+
+func (b *ZKBackend) ServiceMeta(service string) *discoverd.ServiceMeta {
+	value, stat, err := b.conn.Get(b.serviceKey(service) + "/meta")
+	if err != nil {
+		return nil
+	}
+	b.observeStat(stat)
+	meta := &discoverd.ServiceMeta{}
+	if err := json.Unmarshal(value, meta); err != nil {
+		return nil
+	}
+	meta.Index = stat.Mzxid
+	return meta
+}
+
+// AddInstance registers an instance as an ephemeral znode, so it lives as
+// long as the façade's ZooKeeper session: expiry is delegated to session
+// tracking rather than heartbeat timestamps, and the instance TTL field is
+// not interpreted.
+func (b *ZKBackend) AddInstance(service string, inst *discoverd.Instance) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	if addr, err := discoverd.NormalizeAddr(inst.Addr); err == nil {
+		inst.Addr = addr
+	}
+	value, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	key := b.instanceKey(service, inst.ID)
+	if err := b.conn.Create(key, value, true); err == ErrZKNodeExists {
+		return b.conn.Set(key, value)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddInstances registers a batch of instances. Unlike the raft store the
+// registrations are applied one at a time, so a failure can leave a prefix
+// of the batch registered.
+func (b *ZKBackend) AddInstances(regs []*discoverd.Registration) error {
+	for _, reg := range regs {
+		if err := b.AddInstance(reg.Service, reg.Instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *ZKBackend) AddServiceInstances(service string, instances []*discoverd.Instance) error {
+	for _, inst := range instances {
+		if err := b.AddInstance(service, inst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *ZKBackend) Transact(ops []*TxOp) error {
+	return zkUnsupported("transactions")
+}
+
+func (b *ZKBackend) RemoveInstance(service, id string) error {
+	if err := b.conn.Delete(b.instanceKey(service, id)); err != nil {
+		if err == ErrZKNoNode {
+			return NotFoundError{Service: service, Instance: id}
+		}
+		return err
+	}
+	return nil
+}
+
+// setInstanceState rewrites an instance znode with a new lifecycle state.
+func (b *ZKBackend) setInstanceState(service, id string, state discoverd.InstanceState) error {
+	key := b.instanceKey(service, id)
+	value, _, err := b.conn.Get(key)
+	if err != nil {
+		if err == ErrZKNoNode {
+			return NotFoundError{Service: service, Instance: id}
+		}
+		return err
+	}
+	inst := &discoverd.Instance{}
+	if err := json.Unmarshal(value, inst); err != nil {
+		return err
+	}
+	if inst.State == state {
+		return nil
+	}
+	inst.State = state
+	updated, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	return b.conn.Set(key, updated)
+}
+
+func (b *ZKBackend) Drain(service, id string) error {
+	return b.setInstanceState(service, id, discoverd.InstanceStateDraining)
+}
+
+func (b *ZKBackend) SetMaintenance(service, id string, maintenance bool) error {
+	state := discoverd.InstanceStateUp
+	if maintenance {
+		state = discoverd.InstanceStateMaintenance
+	}
+	return b.setInstanceState(service, id, state)
+}
+
+// instances returns the registered instances ordered by creation zxid,
+// which stands in for the store's registration index.
+func (b *ZKBackend) instances(service string) ([]*discoverd.Instance, error) {
+	if exists, err := b.serviceExists(service); err != nil {
+		return nil, err
+	} else if !exists {
+		return nil, NotFoundError{Service: service}
+	}
+	ids, err := b.conn.Children(b.serviceKey(service) + "/instances")
+	if err != nil && err != ErrZKNoNode {
+		return nil, err
+	}
+	instances := make([]*discoverd.Instance, 0, len(ids))
+	for _, id := range ids {
+		inst := b.getInstance(b.instanceKey(service, id))
+		if inst == nil {
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Index < instances[j].Index })
+	return instances, nil
+}
+
+// getInstance reads and decodes an instance znode, mapping its creation
+// zxid to the instance index and updating the deletion mirror.
+func (b *ZKBackend) getInstance(key string) *discoverd.Instance {
+	value, stat, err := b.conn.Get(key)
+	if err != nil {
+		return nil
+	}
+	b.observeStat(stat)
+	inst := &discoverd.Instance{}
+	if err := json.Unmarshal(value, inst); err != nil {
+		return nil
+	}
+	inst.Index = stat.Czxid
+	b.mu.Lock()
+	b.mirror[key] = inst
+	b.mu.Unlock()
+	return inst
+}
+
+func (b *ZKBackend) Instances(service string) ([]*discoverd.Instance, error) {
+	return b.instances(service)
+}
+
+func (b *ZKBackend) InstancesFiltered(service string, selector Selector) ([]*discoverd.Instance, error) {
+	instances, err := b.instances(service)
+	if err != nil || selector == nil {
+		return instances, err
+	}
+	filtered := instances[:0]
+	for _, inst := range instances {
+		if selector.Match(inst) {
+			filtered = append(filtered, inst)
+		}
+	}
+	return filtered, nil
+}
+
+func (b *ZKBackend) GetWithIndex(service string, selector Selector) ([]*discoverd.Instance, uint64, error) {
+	instances, err := b.InstancesFiltered(service, selector)
+	if err != nil {
+		return nil, 0, err
+	}
+	return instances, atomic.LoadUint64(&b.lastIndex), nil
+}
+
+func (b *ZKBackend) ServiceState(service string) *ServiceState { return nil }
+
+func (b *ZKBackend) History(service string) []*InstanceDeparture { return nil }
+
+func (b *ZKBackend) Config(service string) *discoverd.ServiceConfig {
+	value, stat, err := b.conn.Get(b.serviceKey(service))
+	if err != nil {
+		return nil
+	}
+	b.observeStat(stat)
+	config := &discoverd.ServiceConfig{}
+	if err := json.Unmarshal(value, config); err != nil {
+		return nil
+	}
+	return config
+}
+
+func (b *ZKBackend) SetServiceConfig(service string, config *discoverd.ServiceConfig) error {
+	if exists, err := b.serviceExists(service); err != nil {
+		return err
+	} else if !exists {
+		return NotFoundError{Service: service}
+	}
+	value, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return b.conn.Set(b.serviceKey(service), value)
+}
+
+func (b *ZKBackend) SetServiceLeader(service, id string) error {
+	if _, _, err := b.conn.Get(b.instanceKey(service, id)); err != nil {
+		if err == ErrZKNoNode {
+			return NotFoundError{Service: service, Instance: id}
+		}
+		return err
+	}
+	key := b.serviceKey(service) + "/leader"
+	if err := b.conn.Set(key, []byte(id)); err == ErrZKNoNode {
+		return b.conn.Create(key, []byte(id), false)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *ZKBackend) FailoverServiceLeader(service, id string) error {
+	return b.SetServiceLeader(service, id)
+}
+
+// ServiceLeader returns the instance named by the leader znode, falling
+// back to the longest-registered instance.
+func (b *ZKBackend) ServiceLeader(service string) (*discoverd.Instance, error) {
+	instances, err := b.instances(service)
+	if err != nil {
+		return nil, err
+	}
+	if value, _, err := b.conn.Get(b.serviceKey(service) + "/leader"); err == nil {
+		for _, inst := range instances {
+			if inst.ID == string(value) {
+				return inst, nil
+			}
+		}
+	} else if err != ErrZKNoNode {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, nil
+	}
+	return instances[0], nil
+}
+
+// ProtoLeader returns the longest-registered instance speaking proto.
+func (b *ZKBackend) ProtoLeader(service, proto string) (*discoverd.Instance, error) {
+	instances, err := b.instances(service)
+	if err != nil {
+		return nil, err
+	}
+	for _, inst := range instances {
+		if inst.Proto == proto {
+			return inst, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *ZKBackend) Stats() map[string]ServiceStats                   { return nil }
+func (b *ZKBackend) Subscribers() []SubscriberStats                   { return nil }
+func (b *ZKBackend) EventStats() map[string]map[string]EventKindStats { return nil }
+func (b *ZKBackend) EvictionStats() map[string]uint64                 { return nil }
+func (b *ZKBackend) ServiceDigests() map[string]uint64                { return nil }
+func (b *ZKBackend) Dependencies() map[string][]string                { return nil }
+func (b *ZKBackend) MissingDependencies() map[string][]string         { return nil }
+
+func (b *ZKBackend) Export() *ClusterExport {
+	return adapterExport(b, time.Now().UTC())
+}
+
+func (b *ZKBackend) Import(export *ClusterExport) error {
+	return adapterImport(b, export)
+}
+
+func (b *ZKBackend) AuditQuery(service string, from, to time.Time) ([]*AuditEntry, error) {
+	return nil, zkUnsupported("the audit log")
+}
+
+// AddPeer returns an error: ZooKeeper ensemble membership is managed with
+// ZooKeeper's own tooling, not through the façade.
+func (b *ZKBackend) AddPeer(peer string) error {
+	return zkUnsupported("peer management")
+}
+
+func (b *ZKBackend) RemovePeer(peer string) error {
+	return zkUnsupported("peer management")
+}
+
+func (b *ZKBackend) GetPeers() ([]string, error) {
+	return nil, zkUnsupported("peer management")
+}
+
+func (b *ZKBackend) LastIndex() uint64 {
+	return atomic.LoadUint64(&b.lastIndex)
+}
+
+// WriteConsistency reports the level an acknowledged ZooKeeper write
+// guarantees: the ensemble commits at quorum.
+func (b *ZKBackend) WriteConsistency() WriteConsistency {
+	return ConsistencyQuorum
+}
+
+func (b *ZKBackend) Subscribe(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event) stream.Stream {
+	return b.SubscribeFiltered(service, sendCurrent, kinds, ch, nil)
+}
+
+func (b *ZKBackend) SubscribeFiltered(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector) stream.Stream {
+	sub := &adapterSubscription{registry: &b.subs, kinds: kinds, selector: selector, ch: ch, logger: zkLogger}
+	if service != "" {
+		sub.services = map[string]bool{service: true}
+	}
+
+	if sendCurrent {
+		instances, _ := b.Instances(service)
+		for _, inst := range instances {
+			if selector != nil && !selector.Match(inst) {
+				continue
+			}
+			if kinds&discoverd.EventKindUp != 0 {
+				ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindUp, Instance: inst}
+			}
+		}
+		if kinds&discoverd.EventKindLeader != 0 {
+			if leader, err := b.ServiceLeader(service); err == nil && leader != nil {
+				ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindLeader, Instance: leader}
+			}
+		}
+		if kinds&discoverd.EventKindCurrent != 0 {
+			ch <- &discoverd.Event{Service: service, Kind: discoverd.EventKindCurrent}
+		}
+	}
+
+	b.subs.add(sub)
+	b.ensureWatcher()
+	return sub
+}
+
+// SubscribePriority ignores the priority: the adapter's delivery pipeline
+// drops on overflow rather than tiering subscribers.
+func (b *ZKBackend) SubscribePriority(service string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) stream.Stream {
+	return b.SubscribeFiltered(service, sendCurrent, kinds, ch, selector)
+}
+
+// SubscribeClient ignores the client identity: the adapter does not enforce
+// subscriber quotas.
+func (b *ZKBackend) SubscribeClient(service, client string, sendCurrent bool, kinds discoverd.EventKind, ch chan *discoverd.Event, selector Selector, priority SubscriptionPriority) (stream.Stream, error) {
+	return b.SubscribeFiltered(service, sendCurrent, kinds, ch, selector), nil
+}
+
+// SubscribeSince is unavailable: ZooKeeper watches don't replay history,
+// so the backend cannot promise replay from an arbitrary index.
+func (b *ZKBackend) SubscribeSince(service string, sinceIndex uint64, kinds discoverd.EventKind, ch chan *discoverd.Event) (stream.Stream, error) {
+	return nil, zkUnsupported("resumable subscriptions")
+}
+
+// ensureWatcher starts the shared watch loop on first use.
+func (b *ZKBackend) ensureWatcher() {
+	b.watchOnce.Do(func() {
+		ch, err := b.conn.Watch(b.servicesKey())
+		if err != nil {
+			zkLogger.Error("starting watch stream", "err", err)
+			return
+		}
+		go b.watchLoop(ch)
+	})
+}
+
+// watchLoop translates ZooKeeper notifications into discoverd events until
+// the connection closes the channel.
+func (b *ZKBackend) watchLoop(ch <-chan ZKEvent) {
+	for we := range ch {
+		if event := b.translateWatchEvent(we); event != nil {
+			b.subs.broadcast(event)
+		}
+	}
+}
+
+// translateWatchEvent maps a znode change to a discoverd event, or nil for
+// znodes that don't correspond to one.
+func (b *ZKBackend) translateWatchEvent(we ZKEvent) *discoverd.Event {
+	rest := strings.TrimPrefix(we.Path, b.servicesKey()+"/")
+	if rest == we.Path {
+		return nil
+	}
+
+	if i := strings.Index(rest, "/instances/"); i >= 0 {
+		service := rest[:i]
+		if we.Type == ZKEventDeleted {
+			b.mu.Lock()
+			inst := b.mirror[we.Path]
+			delete(b.mirror, we.Path)
+			b.mu.Unlock()
+			if inst == nil {
+				return nil
+			}
+			return &discoverd.Event{Service: service, Kind: discoverd.EventKindDown, Instance: inst}
+		}
+		inst := b.getInstance(we.Path)
+		if inst == nil {
+			return nil
+		}
+		kind := discoverd.EventKindUpdate
+		if we.Type == ZKEventCreated {
+			kind = discoverd.EventKindUp
+		}
+		return &discoverd.Event{Service: service, Kind: kind, Instance: inst}
+	}
+
+	if service := strings.TrimSuffix(rest, "/meta"); service != rest && we.Type != ZKEventDeleted {
+		meta := b.ServiceMeta(service)
+		if meta == nil {
+			return nil
+		}
+		return &discoverd.Event{Service: service, Kind: discoverd.EventKindServiceMeta, ServiceMeta: meta}
+	}
+
+	if service := strings.TrimSuffix(rest, "/leader"); service != rest && we.Type != ZKEventDeleted {
+		inst, err := b.ServiceLeader(service)
+		if err != nil || inst == nil {
+			return nil
+		}
+		return &discoverd.Event{Service: service, Kind: discoverd.EventKindLeader, Instance: inst}
+	}
+
+	if !strings.Contains(rest, "/") && we.Type == ZKEventDeleted {
+		return &discoverd.Event{Service: rest, Kind: discoverd.EventKindServiceDown}
+	}
+
+	return nil
+}
+
+var _ Backend = (*ZKBackend)(nil)
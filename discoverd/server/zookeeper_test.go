@@ -0,0 +1,203 @@
+package server_test
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/discoverd/server"
+)
+
+// fakeZKConn is an in-memory stand-in for a ZooKeeper connection.
+type fakeZKConn struct {
+	mu    sync.Mutex
+	zxid  uint64
+	nodes map[string]*fakeZKNode
+	watch chan server.ZKEvent
+}
+
+type fakeZKNode struct {
+	data      []byte
+	czxid     uint64
+	mzxid     uint64
+	ephemeral bool
+}
+
+func newFakeZKConn() *fakeZKConn {
+	return &fakeZKConn{
+		nodes: make(map[string]*fakeZKNode),
+		watch: make(chan server.ZKEvent, 16),
+	}
+}
+
+func (c *fakeZKConn) notify(typ server.ZKEventType, path string) {
+	select {
+	case c.watch <- server.ZKEvent{Type: typ, Path: path}:
+	default:
+	}
+}
+
+func (c *fakeZKConn) Create(path string, data []byte, ephemeral bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes[path] != nil {
+		return server.ErrZKNodeExists
+	}
+	c.zxid++
+	c.nodes[path] = &fakeZKNode{data: data, czxid: c.zxid, mzxid: c.zxid, ephemeral: ephemeral}
+	c.notify(server.ZKEventCreated, path)
+	return nil
+}
+
+func (c *fakeZKConn) Set(path string, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.nodes[path]
+	if node == nil {
+		return server.ErrZKNoNode
+	}
+	c.zxid++
+	node.data = data
+	node.mzxid = c.zxid
+	c.notify(server.ZKEventChanged, path)
+	return nil
+}
+
+func (c *fakeZKConn) Get(path string) ([]byte, *server.ZKStat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	node := c.nodes[path]
+	if node == nil {
+		return nil, nil, server.ErrZKNoNode
+	}
+	return node.data, &server.ZKStat{Czxid: node.czxid, Mzxid: node.mzxid}, nil
+}
+
+func (c *fakeZKConn) Children(path string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes[path] == nil {
+		return nil, server.ErrZKNoNode
+	}
+	var children []string
+	for p := range c.nodes {
+		if rest := strings.TrimPrefix(p, path+"/"); rest != p && !strings.Contains(rest, "/") {
+			children = append(children, rest)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+func (c *fakeZKConn) Delete(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes[path] == nil {
+		return server.ErrZKNoNode
+	}
+	c.zxid++
+	delete(c.nodes, path)
+	c.notify(server.ZKEventDeleted, path)
+	return nil
+}
+
+func (c *fakeZKConn) Watch(path string) (<-chan server.ZKEvent, error) {
+	return c.watch, nil
+}
+
+// Ensure the ZooKeeper backend round-trips services and instances, storing
+// registrations as ephemeral znodes ordered by creation zxid.
+func TestZKBackend(t *testing.T) {
+	conn := newFakeZKConn()
+	b := server.NewZKBackend(server.ZKConfig{Conn: conn})
+	defer b.Close()
+
+	// Registering against a missing service fails.
+	if err := b.AddInstance("abc", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Create the service; creating it again fails.
+	if err := b.AddService("abc", nil); err != nil {
+		t.Fatal(err)
+	} else if err = b.AddService("abc", nil); !server.IsServiceExists(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Register two instances and verify they come back in registration
+	// order as ephemeral znodes.
+	if err := b.AddInstance("abc", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	} else if err = b.AddInstance("abc", &discoverd.Instance{ID: "inst1", Addr: "localhost:1001"}); err != nil {
+		t.Fatal(err)
+	}
+	instances, err := b.Instances("abc")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 2 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	} else if instances[0].ID != "inst0" || instances[1].ID != "inst1" {
+		t.Fatalf("unexpected order: %s, %s", instances[0].ID, instances[1].ID)
+	} else if instances[0].Index == 0 || instances[0].Index >= instances[1].Index {
+		t.Fatalf("unexpected indexes: %d, %d", instances[0].Index, instances[1].Index)
+	}
+	if node := conn.nodes["/discoverd/services/abc/instances/inst0"]; node == nil || !node.ephemeral {
+		t.Fatalf("expected ephemeral instance znode, got %#v", node)
+	}
+
+	// The first registered instance leads until a leader is set.
+	if leader, err := b.ServiceLeader("abc"); err != nil {
+		t.Fatal(err)
+	} else if leader.ID != "inst0" {
+		t.Fatalf("unexpected leader: %s", leader.ID)
+	}
+	if err := b.SetServiceLeader("abc", "inst1"); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := b.ServiceLeader("abc"); err != nil {
+		t.Fatal(err)
+	} else if leader.ID != "inst1" {
+		t.Fatalf("unexpected leader: %s", leader.ID)
+	}
+
+	// Removing the service clears its subtree.
+	if err := b.RemoveService("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Instances("abc"); !server.IsNotFound(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure znode changes surface as subscription events.
+func TestZKBackend_Subscribe(t *testing.T) {
+	conn := newFakeZKConn()
+	b := server.NewZKBackend(server.ZKConfig{Conn: conn})
+	defer b.Close()
+
+	if err := b.AddService("abc", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan *discoverd.Event, 16)
+	stream := b.Subscribe("abc", false, discoverd.EventKindUp|discoverd.EventKindDown, ch)
+	defer stream.Close()
+
+	if err := b.AddInstance("abc", &discoverd.Instance{ID: "inst0", Addr: "localhost:1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindUp || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+
+	// Deleting the znode, as the server would when the session ends,
+	// surfaces as a down event resolved from the mirror.
+	if err := b.RemoveInstance("abc", "inst0"); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-ch; e.Kind != discoverd.EventKindDown || e.Instance.ID != "inst0" {
+		t.Fatalf("unexpected event: %#v", e)
+	}
+}
@@ -0,0 +1,238 @@
+// Package template renders Go templates to disk from watched service
+// state, in the style of consul-template, so configuration files like
+// haproxy.cfg or nginx upstream blocks track registered instances without
+// polling.
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"text/template"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// DefaultDebounce is the default delay between an event arriving and
+// templates re-rendering, batching bursts of changes into one render.
+const DefaultDebounce = 500 * time.Millisecond
+
+// Template describes a single rendered file.
+type Template struct {
+	// Src is the path of the template file. Contents, if set, is used
+	// instead.
+	Src      string
+	Contents string
+
+	// Dest is the path the rendered file is written to.
+	Dest string
+
+	// Services are the services the template reads. They are watched and
+	// made available to the template via .Instances, .Addrs and .Leader.
+	Services []string
+
+	// Command, if set, is run with "sh -c" after the rendered file
+	// changes, e.g. to reload a proxy.
+	Command string
+
+	tmpl *template.Template
+}
+
+// Renderer watches the services referenced by a set of templates and
+// re-renders them to disk as instances come and go. Files are written
+// atomically and the reload command only runs when the rendered output
+// changes.
+type Renderer struct {
+	client    *discoverd.Client
+	templates []*Template
+
+	// Debounce is the delay between an event arriving and templates
+	// re-rendering. Zero means DefaultDebounce.
+	Debounce time.Duration
+
+	caches  map[string]*cache.ServiceCache
+	events  chan *discoverd.Event
+	streams []stream.Stream
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRenderer returns a renderer for the given templates using c.
+func NewRenderer(c *discoverd.Client, templates ...*Template) *Renderer {
+	return &Renderer{
+		client:    c,
+		templates: templates,
+		caches:    make(map[string]*cache.ServiceCache),
+		events:    make(chan *discoverd.Event, 64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start parses the templates, watches their services, performs an initial
+// render and then re-renders on changes until the renderer is closed.
+func (r *Renderer) Start() error {
+	for _, t := range r.templates {
+		contents := t.Contents
+		if contents == "" {
+			b, err := ioutil.ReadFile(t.Src)
+			if err != nil {
+				return err
+			}
+			contents = string(b)
+		}
+		tmpl, err := template.New(t.Dest).Parse(contents)
+		if err != nil {
+			return err
+		}
+		t.tmpl = tmpl
+
+		for _, service := range t.Services {
+			if _, ok := r.caches[service]; ok {
+				continue
+			}
+			c, err := cache.New(r.client.Service(service))
+			if err != nil {
+				return err
+			}
+			r.caches[service] = c
+			r.streams = append(r.streams, c.Watch(r.events, false))
+		}
+	}
+
+	if err := r.render(); err != nil {
+		return err
+	}
+	go r.run()
+	return nil
+}
+
+// Close stops the renderer, leaving the rendered files in place.
+func (r *Renderer) Close() error {
+	close(r.stop)
+	<-r.done
+	for _, s := range r.streams {
+		s.Close()
+	}
+	for _, c := range r.caches {
+		c.Close()
+	}
+	return nil
+}
+
+// run re-renders after events arrive, debouncing bursts into one render.
+func (r *Renderer) run() {
+	defer close(r.done)
+	var timer *time.Timer
+	var pending <-chan time.Time
+	debounce := r.Debounce
+	if debounce == 0 {
+		debounce = DefaultDebounce
+	}
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.events:
+			if timer == nil {
+				timer = time.NewTimer(debounce)
+			} else {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(debounce)
+			}
+			pending = timer.C
+		case <-pending:
+			pending = nil
+			if err := r.render(); err != nil {
+				r.client.Logger.Error("error rendering templates", "err", err)
+			}
+		}
+	}
+}
+
+// render renders each template, writing the file and running the reload
+// command only if the output changed.
+func (r *Renderer) render() error {
+	for _, t := range r.templates {
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, &templateData{r}); err != nil {
+			return fmt.Errorf("template: error rendering %s: %s", t.Dest, err)
+		}
+
+		if prev, err := ioutil.ReadFile(t.Dest); err == nil && bytes.Equal(prev, buf.Bytes()) {
+			continue
+		}
+
+		tmp := t.Dest + ".tmp"
+		if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, t.Dest); err != nil {
+			return err
+		}
+
+		if t.Command != "" {
+			if out, err := exec.Command("sh", "-c", t.Command).CombinedOutput(); err != nil {
+				return fmt.Errorf("template: error running command for %s: %s: %q", t.Dest, err, out)
+			}
+		}
+	}
+	return nil
+}
+
+// templateData is the root object available to templates.
+type templateData struct {
+	r *Renderer
+}
+
+// Instances returns the current instances of a watched service sorted by
+// creation order.
+func (d *templateData) Instances(service string) []*discoverd.Instance {
+	c, ok := d.r.caches[service]
+	if !ok {
+		return nil
+	}
+	instances := c.Instances()
+	sort.Sort(instanceIndexSlice(instances))
+	return instances
+}
+
+// Addrs returns the current addresses of a watched service sorted by
+// creation order.
+func (d *templateData) Addrs(service string) []string {
+	instances := d.Instances(service)
+	addrs := make([]string, len(instances))
+	for i, inst := range instances {
+		addrs[i] = inst.Addr
+	}
+	return addrs
+}
+
+// Leader returns the current leader of a watched service, or nil.
+func (d *templateData) Leader(service string) *discoverd.Instance {
+	c, ok := d.r.caches[service]
+	if !ok {
+		return nil
+	}
+	if leader := c.Leader(); len(leader) > 0 {
+		return leader[0]
+	}
+	return nil
+}
+
+// instanceIndexSlice represents a sortable list of instances by creation
+// order.
+type instanceIndexSlice []*discoverd.Instance
+
+func (a instanceIndexSlice) Len() int           { return len(a) }
+func (a instanceIndexSlice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a instanceIndexSlice) Less(i, j int) bool { return a[i].Index < a[j].Index }
@@ -0,0 +1,236 @@
+package testutil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// ScriptedService is a deterministic in-memory implementation of
+// discoverd.Service for testing subscription consumers. Events emitted on it
+// are recorded as a script and replayed, in order, to every watcher, so
+// tests can drive client code through exact event sequences without a
+// server.
+type ScriptedService struct {
+	mu        sync.Mutex
+	script    []*discoverd.Event
+	instances map[string]*discoverd.Instance
+	leader    *discoverd.Instance
+	meta      *discoverd.ServiceMeta
+	watchers  map[chan *discoverd.Event]struct{}
+}
+
+// NewScriptedService returns a service pre-loaded with the given event
+// script. Watchers created later replay the script from the beginning
+// before receiving live events.
+func NewScriptedService(events ...*discoverd.Event) *ScriptedService {
+	s := &ScriptedService{
+		instances: make(map[string]*discoverd.Instance),
+		watchers:  make(map[chan *discoverd.Event]struct{}),
+	}
+	for _, event := range events {
+		s.Emit(event)
+	}
+	return s
+}
+
+// Emit records an event, applies it to the derived service state and
+// delivers it to active watchers. Events are assigned 1-based indexes in
+// emission order so WatchSince can resume mid-script.
+func (s *ScriptedService) Emit(event *discoverd.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.script = append(s.script, event)
+	event.EventIndex = uint64(len(s.script))
+
+	switch event.Kind {
+	case discoverd.EventKindUp, discoverd.EventKindUpdate, discoverd.EventKindDraining:
+		s.instances[event.Instance.ID] = event.Instance
+	case discoverd.EventKindDown:
+		delete(s.instances, event.Instance.ID)
+	case discoverd.EventKindLeader:
+		s.leader = event.Instance
+	case discoverd.EventKindServiceMeta:
+		s.meta = event.ServiceMeta
+	}
+
+	for ch := range s.watchers {
+		ch <- event
+	}
+}
+
+// Script returns the events recorded so far, in emission order.
+func (s *ScriptedService) Script() []*discoverd.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*discoverd.Event(nil), s.script...)
+}
+
+// Record copies events from ch into the script until ch closes, so a
+// sequence captured from a live watch can be replayed later.
+func (s *ScriptedService) Record(ch chan *discoverd.Event) {
+	for event := range ch {
+		s.Emit(event)
+	}
+}
+
+func (s *ScriptedService) Leader() (*discoverd.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leader == nil {
+		return nil, fmt.Errorf("testutil: no leader")
+	}
+	return s.leader, nil
+}
+
+func (s *ScriptedService) Instances() ([]*discoverd.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instances := make([]*discoverd.Instance, 0, len(s.instances))
+	for _, inst := range s.instances {
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+func (s *ScriptedService) Addrs() ([]string, error) {
+	instances, err := s.Instances()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(instances))
+	for i, inst := range instances {
+		addrs[i] = inst.Addr
+	}
+	return addrs, nil
+}
+
+func (s *ScriptedService) Leaders(leaders chan *discoverd.Instance) (stream.Stream, error) {
+	events := make(chan *discoverd.Event)
+	str, err := s.Watch(events)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(leaders)
+		for event := range events {
+			if event.Kind == discoverd.EventKindLeader {
+				leaders <- event.Instance
+			}
+		}
+	}()
+	return str, nil
+}
+
+// Watch replays the recorded script followed by a "current" event, then
+// delivers live events as they are emitted.
+func (s *ScriptedService) Watch(ch chan *discoverd.Event) (stream.Stream, error) {
+	return s.WatchSince(0, ch)
+}
+
+// WatchSince replays the script from the given 1-based event index.
+func (s *ScriptedService) WatchSince(since uint64, ch chan *discoverd.Event) (stream.Stream, error) {
+	s.mu.Lock()
+	replay := append([]*discoverd.Event(nil), s.script[since:]...)
+	s.mu.Unlock()
+
+	str := stream.New()
+	live := make(chan *discoverd.Event, 64)
+
+	go func() {
+		defer close(ch)
+		for _, event := range replay {
+			select {
+			case ch <- event:
+			case <-str.StopCh:
+				return
+			}
+		}
+		if since == 0 {
+			select {
+			case ch <- &discoverd.Event{Kind: discoverd.EventKindCurrent}:
+			case <-str.StopCh:
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.watchers[live] = struct{}{}
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			delete(s.watchers, live)
+			s.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case event := <-live:
+				select {
+				case ch <- event:
+				case <-str.StopCh:
+					return
+				}
+			case <-str.StopCh:
+				return
+			}
+		}
+	}()
+	return str, nil
+}
+
+func (s *ScriptedService) GetMeta() (*discoverd.ServiceMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.meta == nil {
+		return nil, fmt.Errorf("testutil: no service meta")
+	}
+	return s.meta, nil
+}
+
+func (s *ScriptedService) SetMeta(meta *discoverd.ServiceMeta) error {
+	s.Emit(&discoverd.Event{Kind: discoverd.EventKindServiceMeta, ServiceMeta: meta})
+	return nil
+}
+
+func (s *ScriptedService) SetLeader(id string) error {
+	s.mu.Lock()
+	inst, ok := s.instances[id]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("testutil: unknown instance %q", id)
+	}
+	s.Emit(&discoverd.Event{Kind: discoverd.EventKindLeader, Instance: inst})
+	return nil
+}
+
+// NextEvent returns the next event from ch, failing the test if none
+// arrives within the timeout.
+func NextEvent(t TestingT, ch chan *discoverd.Event, timeout time.Duration) *discoverd.Event {
+	select {
+	case event, ok := <-ch:
+		if !ok {
+			t.Fatal("event channel closed")
+			return nil
+		}
+		return event
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for event")
+		return nil
+	}
+}
+
+// AssertEventOrder asserts that the next events on ch arrive with the given
+// kinds, in order.
+func AssertEventOrder(t TestingT, ch chan *discoverd.Event, kinds ...discoverd.EventKind) {
+	for i, kind := range kinds {
+		event := NextEvent(t, ch, 5*time.Second)
+		if event.Kind != kind {
+			t.Fatalf("unexpected event %d: got %s, want %s", i, event.Kind, kind)
+		}
+	}
+}
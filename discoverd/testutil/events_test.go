@@ -0,0 +1,42 @@
+package testutil
+
+import (
+	"testing"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// Ensure a scripted service replays its script to watchers in order,
+// followed by live events.
+func TestScriptedService(t *testing.T) {
+	s := NewScriptedService(
+		&discoverd.Event{Kind: discoverd.EventKindUp, Instance: &discoverd.Instance{ID: "inst0", Addr: "127.0.0.1:1"}},
+		&discoverd.Event{Kind: discoverd.EventKindLeader, Instance: &discoverd.Instance{ID: "inst0", Addr: "127.0.0.1:1"}},
+	)
+
+	ch := make(chan *discoverd.Event)
+	stream, err := s.Watch(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	AssertEventOrder(t, ch, discoverd.EventKindUp, discoverd.EventKindLeader, discoverd.EventKindCurrent)
+
+	s.Emit(&discoverd.Event{Kind: discoverd.EventKindDown, Instance: &discoverd.Instance{ID: "inst0"}})
+	AssertEventOrder(t, ch, discoverd.EventKindDown)
+
+	if instances, err := s.Instances(); err != nil {
+		t.Fatal(err)
+	} else if len(instances) != 0 {
+		t.Fatalf("unexpected instances: %#v", instances)
+	}
+
+	// Resuming mid-script only replays the events that followed.
+	ch = make(chan *discoverd.Event)
+	stream, err = s.WatchSince(2, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	AssertEventOrder(t, ch, discoverd.EventKindDown)
+}
@@ -5,7 +5,6 @@ import (
 	"time"
 
 	discoverd "github.com/flynn/flynn/discoverd/client"
-	"github.com/flynn/flynn/pkg/shutdown"
 	"github.com/flynn/flynn/pkg/stream"
 	"github.com/inconshreveable/log15"
 )
@@ -35,7 +34,7 @@ func (d *discoverdWrapper) Register() (bool, error) {
 		log.Error("error registering with service discovery", "err", err)
 		return false, err
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	selfAddr := hb.Addr()
 	log = log.New("self.addr", selfAddr)
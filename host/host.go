@@ -509,7 +509,7 @@ func runDaemon(args *docopt.Args) {
 			log.Error("error registering with service discovery", "err", err)
 			shutdown.Fatal(err)
 		}
-		shutdown.BeforeExit(func() { hb.Close() })
+		discoverd.CloseOnExit(hb)
 
 		log.Info("determining cluster size", "service", discoveryService)
 		meta, err := discoverd.NewService(discoveryService).GetMeta()
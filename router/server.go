@@ -266,7 +266,7 @@ func main() {
 			log.Error("error registering service", "name", service, "addr", addr, "err", err)
 			shutdown.Fatal(err)
 		}
-		shutdown.BeforeExit(func() { hb.Close() })
+		discoverd.CloseOnExit(hb)
 	}
 
 	log.Info("serving API requests")
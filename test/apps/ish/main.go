@@ -35,7 +35,7 @@ func main() {
 	if err != nil {
 		shutdown.Fatal(err)
 	}
-	shutdown.BeforeExit(func() { hb.Close() })
+	discoverd.CloseOnExit(hb)
 
 	http.HandleFunc("/ish", ish)
 	if err := http.Serve(l, nil); err != nil {